@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var addonCmd = &cobra.Command{
+	Use:   "addon",
+	Short: "Create a systemd-stub addon with extra cmdline or devicetree",
+	Long: `Create a systemd-stub addon carrying an extra kernel cmdline and/or a devicetree blob.
+
+The PCR 12 measurements the addon contributes when loaded by systemd-stub are printed once built.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireFlags("addon-stub-path"); err != nil {
+			return err
+		}
+
+		addon := &uki.AddonBuilder{
+			AddonStubPath: viper.GetString("addon-stub-path"),
+			Cmdline:       viper.GetString("cmdline"),
+			DTBPath:       viper.GetString("dtb"),
+			SBKey:         viper.GetString("sb-key"),
+			SBCert:        viper.GetString("sb-cert"),
+			OutPath:       viper.GetString("output-addon"),
+			Passphrase:    terminalPassphrase,
+		}
+
+		if err := addon.Build(); err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(struct {
+				Path         string `json:"path"`
+				Measurements any    `json:"measurements"`
+			}{Path: addon.OutPath, Measurements: addon.Measurements()})
+		}
+
+		for _, event := range addon.Measurements() {
+			fmt.Printf("%d:%s=%s %s\n", event.PCR, event.Algorithm, event.Digest, event.Description)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	addonCmd.Flags().StringP("addon-stub-path", "s", "", "Path to the addon stub.")
+	addonCmd.Flags().StringP("cmdline", "c", "", "Kernel cmdline to add.")
+	addonCmd.Flags().String("dtb", "", "Path to the devicetree blob to add.")
+	addonCmd.Flags().String("sb-cert", "", "SecureBoot certificate to sign the addon with.")
+	addonCmd.Flags().String("sb-key", "", "SecureBoot key to sign the addon with.")
+	addonCmd.Flags().String("output-addon", "addon.signed.efi", "addon artifact output.")
+
+	rootCmd.AddCommand(addonCmd)
+}
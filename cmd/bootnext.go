@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/install"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var bootNextCmd = &cobra.Command{
+	Use:   "boot-next [entry]",
+	Short: "Boot an installed uki once on the next boot",
+	Long: `Select an installed uki for the next boot only, so an update can be test booted before making it the
+default. If it fails to boot, the boot after goes back to the default entry.
+
+The entry is a uki in EFI/Linux/ or a type #1 entry in loader/entries/ of the ESP, selected through the
+systemd-boot LoaderEntryOneShot variable. With --firmware any file of the ESP can be given, a Boot####
+entry is created for it if needed and selected through the UEFI BootNext variable instead.
+
+--clear cancels a pending selection.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		next := &install.BootNext{
+			ESPPath:     viper.GetString("esp-path"),
+			Firmware:    viper.GetBool("firmware"),
+			Description: viper.GetString("description"),
+			DryRun:      viper.GetBool("dry-run"),
+		}
+
+		if viper.GetBool("clear") {
+			return next.Clear()
+		}
+
+		if len(args) == 0 {
+			return types.WithCategory(types.ErrInvalidInput, errors.New("an entry to boot is required"))
+		}
+
+		entry, err := next.Set(args[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(struct {
+				Entry string `json:"entry"`
+			}{Entry: entry})
+		}
+
+		fmt.Println(entry)
+
+		return nil
+	},
+}
+
+func init() {
+	bootNextCmd.Flags().String("esp-path", "", "Mount point of the ESP, autodetected if not given.")
+	bootNextCmd.Flags().Bool("firmware", false, "Select the file through the UEFI BootNext variable instead of systemd-boot.")
+	bootNextCmd.Flags().String("description", "Linux Boot Next", "Description of the boot entry created with --firmware.")
+	bootNextCmd.Flags().Bool("clear", false, "Cancel a pending next boot selection.")
+	bootNextCmd.Flags().Bool("dry-run", false, "Print the variables that would be written without writing them.")
+
+	rootCmd.AddCommand(bootNextCmd)
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var buildAllCmd = &cobra.Command{
+	Use:   "build-all manifest.yaml",
+	Short: "Build several uki files described in a manifest",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manifest, err := uki.LoadManifest(args[0])
+		if err != nil {
+			return err
+		}
+
+		if cmd.Flags().Changed("jobs") {
+			manifest.Jobs, _ = cmd.Flags().GetInt("jobs")
+		}
+
+		if cmd.Flags().Changed("memory-limit") {
+			manifest.MemoryLimit, _ = cmd.Flags().GetString("memory-limit")
+		}
+
+		if cmd.Flags().Changed("webhook-url") {
+			manifest.Webhook, _ = cmd.Flags().GetString("webhook-url")
+		}
+
+		multi, err := uki.NewMultiBuilder(manifest)
+		if err != nil {
+			return err
+		}
+		multi.Passphrase = terminalPassphrase
+
+		if multi.Webhook != nil {
+			multi.Webhook.Secret = viper.GetString("webhook-secret")
+		}
+
+		results, buildErr := multi.Build()
+
+		if jsonOutput() {
+			if err = printJSON(results); err != nil {
+				return err
+			}
+		} else {
+			for _, result := range results {
+				status := "ok"
+				if result.Error != "" {
+					status = "failed: " + result.Error
+				}
+				fmt.Printf("%s\t%s\t%s\n", result.Name, result.Duration.Round(1e6), status)
+			}
+		}
+
+		return buildErr
+	},
+}
+
+func init() {
+	buildAllCmd.Flags().IntP("jobs", "j", 1, "Number of builds to run in parallel, overrides the manifest value.")
+	buildAllCmd.Flags().String("memory-limit", "", "Bound on the size of the inputs of the builds running at once, i.e. 8G, overrides the manifest value.")
+	buildAllCmd.Flags().String("webhook-url", "", "URL the build events are posted to as JSON when each build finishes, overrides the manifest value.")
+	buildAllCmd.Flags().String("webhook-secret", "", "Secret the build events are signed with, as an HMAC-SHA256 in the X-Ukify-Signature header.")
+	rootCmd.AddCommand(buildAllCmd)
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cmd test Suite")
+}
+
+// runCmd runs the command line and returns what it printed, the flags are reset first as the
+// commands are shared by the runs.
+func runCmd(args ...string) (string, error) {
+	viper.Reset()
+	resetFlags(rootCmd)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	Expect(err).ToNot(HaveOccurred())
+
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	printed := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- data
+	}()
+
+	rootCmd.SetArgs(args)
+	err = rootCmd.Execute()
+
+	Expect(w.Close()).To(Succeed())
+
+	return string(<-printed), err
+}
+
+// resetFlags sets the flags of cmd and of its subcommands back to their defaults.
+func resetFlags(cmd *cobra.Command) {
+	for _, flags := range []*pflag.FlagSet{cmd.PersistentFlags(), cmd.Flags()} {
+		flags.VisitAll(func(flag *pflag.Flag) {
+			if slice, ok := flag.Value.(pflag.SliceValue); ok {
+				_ = slice.Replace(nil)
+			} else {
+				_ = flag.Value.Set(flag.DefValue)
+			}
+
+			flag.Changed = false
+		})
+	}
+
+	for _, sub := range cmd.Commands() {
+		resetFlags(sub)
+	}
+}
+
+var _ = Describe("Cmd tests", func() {
+	Describe("Exit codes", func() {
+		It("Maps the error categories to exit codes", func() {
+			Expect(exitCode(nil)).To(Equal(exitOK))
+			Expect(exitCode(errors.New("boom"))).To(Equal(exitFailure))
+			Expect(exitCode(types.WithCategory(types.ErrInvalidInput, errors.New("no kernel")))).To(Equal(exitInvalidInput))
+			Expect(exitCode(types.WithCategory(types.ErrSigning, errors.New("no signature")))).To(Equal(exitSigning))
+			Expect(exitCode(types.WithCategory(types.ErrMeasurement, errors.New("no PCR")))).To(Equal(exitMeasurement))
+			Expect(exitCode(types.WithCategory(types.ErrVerification, errors.New("bad signature")))).To(Equal(exitVerification))
+		})
+		It("Exits with the input code on invalid inputs failing a later stage", func() {
+			key := types.WithCategory(types.ErrInvalidInput, errors.New("no such key"))
+			err := types.WithCategory(types.ErrSigning, fmt.Errorf("error signing UKI: %w", key))
+			Expect(exitCode(err)).To(Equal(exitInvalidInput))
+
+			err = types.NewBuildError(types.StageSign, "", "uki.efi", types.WithCategory(types.ErrVerification, err))
+			Expect(exitCode(err)).To(Equal(exitInvalidInput))
+		})
+		It("Exits with the verification code on signed files not verifying", func() {
+			err := types.WithCategory(types.ErrSigning, types.WithCategory(types.ErrVerification, errors.New("bad signature")))
+			Expect(exitCode(err)).To(Equal(exitVerification))
+		})
+	})
+	Describe("Serve", func() {
+		It("Refuses to serve signing keys to clients not authenticated", func() {
+			for _, args := range [][]string{
+				{"serve", "--sb-key", "missing.key", "--sb-cert", "missing.pem"},
+				{"serve", "--pcr-key", "missing.key", "--tls-cert", "tls.pem", "--tls-key", "tls.key"},
+			} {
+				_, err := runCmd(args...)
+				Expect(err).To(MatchError(types.ErrInvalidInput))
+				Expect(err).To(MatchError(ContainSubstring("--client-ca, or --insecure")))
+			}
+
+			// the keys are loaded with --insecure, failing on the missing files instead
+			_, err := runCmd("serve", "--pcr-key", "missing.key", "--insecure")
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+			Expect(err).ToNot(MatchError(ContainSubstring("--insecure")))
+		})
+	})
+})
@@ -0,0 +1,461 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kairos-io/go-ukify/internal/common"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// compatSystemdVersion is the version of systemd ukify the compat command takes the flags of,
+// reported by --version to the tools checking it, i.e. mkosi.
+const compatSystemdVersion = "256"
+
+var compatCmd = &cobra.Command{
+	Use:   "compat",
+	Short: "Run the commands of systemd ukify with its flag names",
+	Long: `Run the commands of systemd ukify with its flag names, as a drop-in replacement of it.
+
+As with ukify, the flags can be given before or after the verb, and --version prints the version
+of ukify the flags are taken from. To have mkosi, or any tool looking for ukify, run go-ukify,
+put an executable named ukify first in its PATH running:
+
+  exec go-ukify compat "$@"`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if version, _ := cmd.Flags().GetBool("version"); version {
+			fmt.Printf("ukify %s (%s) go-ukify %s\n", compatSystemdVersion, compatSystemdVersion, common.GetVersion())
+
+			return nil
+		}
+
+		return cmd.Help()
+	},
+	// --output is the path of the UKI for systemd ukify, the output format follows --json instead
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := viper.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+
+		switch viper.GetString("json") {
+		case "off":
+			viper.Set("output", outputText)
+		case "pretty", "short":
+			viper.Set("output", outputJSON)
+		default:
+			return fmt.Errorf("unknown --json format %q", viper.GetString("json"))
+		}
+
+		if err := setupLogging(); err != nil {
+			return err
+		}
+
+		return setupIO()
+	},
+}
+
+var compatBuildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Build a UKI with the flags of ukify build",
+	Long: `Build a UKI taking the flags of systemd ukify build, so scripts written for it, i.e. mkosi or
+distro packaging, can run go-ukify instead.
+
+As in ukify, --cmdline, --os-release, --sbat and --section take either the text or @ and the path
+to a file, --initrd can be repeated to concatenate several initrds, and --phases lists the phase
+paths to sign for. The phase paths must extend one another, as they are measured in one sequence.
+Signing is always done natively, --signtool and --tools are accepted and ignored.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireFlags("linux"); err != nil {
+			return err
+		}
+
+		// named after the kernel by default, as ukify does
+		out, _ := cmd.Flags().GetString("output")
+		if out == "" {
+			out = filepath.Base(viper.GetString("linux")) + ".unsigned.efi"
+			if viper.GetString("secureboot-private-key") != "" {
+				out = filepath.Base(viper.GetString("linux")) + ".efi"
+			}
+		}
+
+		builder := &uki.Builder{
+			Arch:       viper.GetString("efi-arch"),
+			SdStubPath: viper.GetString("stub"),
+			KernelPath: viper.GetString("linux"),
+			SBKey:      viper.GetString("secureboot-private-key"),
+			SBCert:     viper.GetString("secureboot-certificate"),
+			Splash:     viper.GetString("splash"),
+			OutUKIPath: out,
+			Passphrase: terminalPassphrase,
+		}
+
+		cleanup, err := compatBuilder(builder)
+		if err != nil {
+			return err
+		}
+
+		defer cleanup()
+
+		if err = builder.Build(); err != nil {
+			return err
+		}
+
+		result := builder.Result()
+		if err = compatOutput(result, out); err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printCompatJSON(result)
+		}
+
+		if viper.GetBool("measure") {
+			for _, m := range result.Measurements {
+				fmt.Printf("%s:%d:%s=%s\n", m.Phase, m.PCR, m.Algorithm, m.Digest)
+			}
+		}
+
+		return nil
+	},
+}
+
+var compatInspectCmd = &cobra.Command{
+	Use:   "inspect uki.efi",
+	Short: "Print the sections of a UKI as ukify inspect",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := uki.ListSections(args[0])
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		sections := make(map[string]compatSection, len(names))
+
+		for _, name := range names {
+			data, err := uki.GetSection(args[0], name)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			sum := sha256.Sum256(data)
+			section := compatSection{Size: len(data), SHA256: hex.EncodeToString(sum[:])}
+
+			// ukify shows the text of the sections holding text only
+			if utf8.Valid(data) && !slices.Contains(data, 0) {
+				section.Text = string(data)
+			}
+
+			sections[string(name)] = section
+		}
+
+		if jsonOutput() {
+			return printCompatJSON(sections)
+		}
+
+		for _, name := range names {
+			section := sections[string(name)]
+
+			fmt.Printf("%s:\n  size: %d bytes\n  sha256: %s\n", name, section.Size, section.SHA256)
+
+			if section.Text != "" {
+				fmt.Printf("  text:\n    %s\n", strings.ReplaceAll(strings.TrimSpace(section.Text), "\n", "\n    "))
+			}
+
+			fmt.Println()
+		}
+
+		return nil
+	},
+}
+
+// compatSection is a section as printed by ukify inspect.
+type compatSection struct {
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+	Text   string `json:"text,omitempty"`
+}
+
+// printCompatJSON prints v as ukify does for --json, on one line with short.
+func printCompatJSON(v any) error {
+	if viper.GetString("json") == "short" {
+		return json.NewEncoder(os.Stdout).Encode(v)
+	}
+
+	return printJSON(v)
+}
+
+// compatOutput moves the unsigned UKI to out, as the builder names unsigned UKIs after the path of the signed one
+// while ukify writes them to --output.
+func compatOutput(result *uki.Result, out string) error {
+	for i, output := range result.Outputs {
+		if output.Kind != "uki" || output.Path == out {
+			continue
+		}
+
+		st, err := os.Stat(output.Path)
+		if err != nil {
+			return err
+		}
+
+		if err = utils.Publish(output.Path, out, st.Mode().Perm()); err != nil {
+			return err
+		}
+
+		result.Outputs[i].Path = out
+	}
+
+	return nil
+}
+
+// compatBuilder maps the ukify flags which do not map to a builder field one to one.
+// The returned function removes the concatenated initrd.
+func compatBuilder(builder *uki.Builder) (func(), error) {
+	cleanup := func() {}
+
+	cmdline, err := textOrFile(viper.GetString("cmdline"))
+	if err != nil {
+		return cleanup, err
+	}
+	builder.Cmdline = strings.TrimSpace(string(cmdline))
+
+	if osRelease := viper.GetString("os-release"); osRelease != "" {
+		if err = compatOSRelease(builder, osRelease); err != nil {
+			return cleanup, err
+		}
+	}
+
+	if uname := viper.GetString("uname"); uname != "" {
+		if err = builder.ReplaceGenerator(uki.GeneratorUname, uki.GeneratorFunc("compat-uname", func(*uki.Builder) ([]uki.Section, error) {
+			return []uki.Section{{Name: constants.Uname, Source: types.BytesSource([]byte(uname)), Measure: true, Append: true}}, nil
+		})); err != nil {
+			return cleanup, err
+		}
+	}
+
+	switch keys := viper.GetStringSlice("pcr-private-key"); len(keys) {
+	case 0:
+	case 1:
+		builder.PCRKey = keys[0]
+	default:
+		return cleanup, types.WithCategory(types.ErrInvalidInput, errors.New("only one --pcr-private-key is supported, the phases are signed with the same key"))
+	}
+
+	if builder.Phases, err = compatPhases(viper.GetStringSlice("phases")); err != nil {
+		return cleanup, err
+	}
+
+	for _, text := range viper.GetStringSlice("sbat") {
+		data, err := textOrFile(text)
+		if err != nil {
+			return cleanup, err
+		}
+
+		entries, err := sbat.Parse(data)
+		if err != nil {
+			return cleanup, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("--sbat: %w", err))
+		}
+
+		builder.SBAT = append(builder.SBAT, entries...)
+	}
+
+	if dtb := viper.GetString("devicetree"); dtb != "" {
+		if err = builder.AddSection(uki.Section{Name: constants.DTB, Path: dtb, Measure: true, Append: true}); err != nil {
+			return cleanup, err
+		}
+	}
+
+	for _, section := range viper.GetStringSlice("section") {
+		if err = compatAddSection(builder, section); err != nil {
+			return cleanup, err
+		}
+	}
+
+	if viper.GetBool("sign-kernel") {
+		slog.Warn("The kernel is not signed on its own, --sign-kernel is ignored")
+	}
+
+	if viper.GetString("pcr-public-key") != "" {
+		slog.Debug("The PCR public key is derived from --pcr-private-key, --pcr-public-key is ignored")
+	}
+
+	initrds := viper.GetStringSlice("initrd")
+	switch len(initrds) {
+	case 0:
+		// ukify builds UKIs without initrd
+		return cleanup, builder.RemoveGenerator(uki.GeneratorInitrd)
+	case 1:
+		builder.InitrdPath = initrds[0]
+
+		return cleanup, nil
+	}
+
+	path, err := concatInitrds(initrds)
+	if err != nil {
+		return cleanup, err
+	}
+	builder.InitrdPath = path
+
+	return func() { os.Remove(path) }, nil //nolint:errcheck
+}
+
+// textOrFile returns the value of a ukify TEXT|@PATH flag.
+func textOrFile(value string) ([]byte, error) {
+	path, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		return []byte(value), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	return data, nil
+}
+
+// compatOSRelease uses the os-release file, or the text given in place of it.
+func compatOSRelease(builder *uki.Builder, value string) error {
+	if path, ok := strings.CutPrefix(value, "@"); ok {
+		builder.OsRelease = path
+
+		return nil
+	}
+
+	return builder.ReplaceGenerator(uki.GeneratorOSRelease, uki.GeneratorFunc("compat-os-release", func(*uki.Builder) ([]uki.Section, error) {
+		return []uki.Section{{Name: constants.OSRel, Source: types.BytesSource([]byte(value)), Measure: true, Append: true}}, nil
+	}))
+}
+
+// compatAddSection adds a NAME:TEXT|@PATH section, measured if systemd-stub measures it.
+func compatAddSection(builder *uki.Builder, value string) error {
+	name, contents, ok := strings.Cut(value, ":")
+	if !ok {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("--section %q is not NAME:TEXT or NAME:@PATH", value))
+	}
+
+	section := uki.Section{Name: constants.Section(name), Append: true}
+	section.Measure = slices.Contains(constants.OrderedSections(), section.Name)
+
+	if path, ok := strings.CutPrefix(contents, "@"); ok {
+		section.Path = path
+	} else {
+		section.Source = types.BytesSource([]byte(contents))
+	}
+
+	return builder.AddSection(section)
+}
+
+// compatPhases maps the phase paths of ukify to the phases measured, the longest path, as the builder
+// signs the PCR 11 value after each phase of it.
+func compatPhases(paths []string) ([]types.PhaseInfo, error) {
+	var longest []types.PhaseInfo
+
+	for _, path := range strings.Fields(strings.Join(paths, " ")) {
+		if phases := types.PhasesFromString(path); len(phases) > len(longest) {
+			longest = phases
+		}
+	}
+
+	for _, path := range strings.Fields(strings.Join(paths, " ")) {
+		if phases := types.PhasesFromString(path); !slices.Equal(phases, longest[:len(phases)]) {
+			return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("phase path %s is not a prefix of the longest one", path))
+		}
+	}
+
+	if longest == nil {
+		return types.OrderedPhases(), nil
+	}
+
+	return longest, nil
+}
+
+// concatInitrds concatenates the initrds into a temporary file and returns its path, as the kernel
+// unpacks concatenated cpio archives one after the other.
+func concatInitrds(paths []string) (string, error) {
+	out, err := os.CreateTemp("", "ukify-initrd")
+	if err != nil {
+		return "", err
+	}
+
+	err = func() error {
+		defer out.Close() //nolint:errcheck
+
+		for _, path := range paths {
+			in, err := os.Open(path)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			_, err = io.Copy(out, in)
+			in.Close() //nolint:errcheck
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return out.Close()
+	}()
+	if err != nil {
+		os.Remove(out.Name()) //nolint:errcheck
+
+		return "", err
+	}
+
+	return out.Name(), nil
+}
+
+func init() {
+	compatFlags(compatCmd.PersistentFlags())
+	compatCmd.Flags().Bool("version", false, "Print the version of ukify the flags are taken from.")
+
+	compatCmd.AddCommand(compatBuildCmd, compatInspectCmd)
+	rootCmd.AddCommand(compatCmd)
+}
+
+// compatFlags adds the ukify flags, on the compat command so they can be given before the verb as well.
+func compatFlags(flags *pflag.FlagSet) {
+	flags.String("linux", "", "Path to the kernel image.")
+	flags.StringArray("initrd", nil, "Path to an initrd, can be repeated to concatenate several initrds.")
+	flags.String("cmdline", "", "Kernel cmdline, as TEXT or @PATH.")
+	flags.String("os-release", "", "os-release, as TEXT or @PATH.")
+	flags.String("devicetree", "", "Path to the devicetree blob.")
+	flags.String("splash", "", "Path to the splash BMP image, PNG and JPEG images are converted to BMP.")
+	flags.String("uname", "", "Kernel version, read from the kernel image if not given.")
+	flags.StringArray("sbat", nil, "SBAT entries to add, as TEXT or @PATH, can be repeated.")
+	flags.StringArray("section", nil, "Extra section, as NAME:TEXT or NAME:@PATH, can be repeated.")
+	flags.String("stub", "", "Path to the sd-stub, the installed one for --efi-arch if not given.")
+	flags.String("efi-arch", "", "EFI architecture of the UKI, i.e. x64 or aa64.")
+	flags.String("secureboot-private-key", "", "SecureBoot key to sign the UKI with.")
+	flags.String("secureboot-certificate", "", "SecureBoot certificate to sign the UKI with.")
+	flags.Bool("sign-kernel", false, "Accepted for compatibility, the kernel is not signed on its own.")
+	flags.Bool("no-sign-kernel", false, "Accepted for compatibility, the kernel is not signed on its own.")
+	flags.StringSlice("pcr-banks", nil, "Accepted for compatibility, the PCR values of every supported bank are signed.")
+	flags.String("signtool", "", "Accepted for compatibility, signing is done natively.")
+	flags.StringArray("tools", nil, "Accepted for compatibility, no external tool is run.")
+	flags.StringArray("pcr-private-key", nil, "Key to sign the PCR 11 values with.")
+	flags.StringArray("pcr-public-key", nil, "Accepted for compatibility, derived from --pcr-private-key.")
+	flags.StringArray("phases", nil, "Phase paths to sign the PCR 11 values for, separated by spaces, i.e. enter-initrd enter-initrd:leave-initrd.")
+	flags.Bool("measure", false, "Print the expected PCR 11 values.")
+	flags.String("output", "", "Path to the UKI, named after --linux if not given.")
+	flags.String("json", "off", "Print the build result as JSON, one of: pretty, short, off.")
+}
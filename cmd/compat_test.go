@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compat", func() {
+	var dir, kernel, out string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		kernel = filepath.Join(dir, "vmlinuz")
+		out = filepath.Join(dir, "uki.efi")
+		Expect(os.WriteFile(kernel, []byte("kernel"), 0o600)).To(Succeed())
+	})
+
+	It("Reads the @PATH values from the files", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "cmdline"), []byte("console=ttyS0\n"), 0o600)).To(Succeed())
+
+		data, err := textOrFile("@" + filepath.Join(dir, "cmdline"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("console=ttyS0\n"))
+
+		data, err = textOrFile("console=tty0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("console=tty0"))
+
+		_, err = textOrFile("@" + filepath.Join(dir, "missing"))
+		Expect(err).To(MatchError(types.ErrInvalidInput))
+	})
+	It("Measures the phases of the longest phase path", func() {
+		phases, err := compatPhases([]string{"enter-initrd enter-initrd:leave-initrd", "enter-initrd:leave-initrd:sysinit"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(phases).To(Equal(types.PhasesFromString("enter-initrd:leave-initrd:sysinit")))
+
+		phases, err = compatPhases(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(phases).To(Equal(types.OrderedPhases()))
+
+		_, err = compatPhases([]string{"enter-initrd:leave-initrd", "leave-initrd"})
+		Expect(err).To(MatchError(types.ErrInvalidInput))
+	})
+	It("Builds a UKI with the flags given before and after the verb", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "cmdline"), []byte("console=ttyS0 quiet\n"), 0o600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "os-release"), []byte("ID=kairos\n"), 0o600)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "profile"), []byte("ID=recovery\n"), 0o600)).To(Succeed())
+
+		printed, err := runCmd("compat",
+			"--linux", kernel, "--stub", "../pkg/pesign/testdata/file.efi", "--cmdline", "@"+filepath.Join(dir, "cmdline"),
+			"build",
+			"--os-release", "@"+filepath.Join(dir, "os-release"), "--uname", "6.6.0",
+			"--section", ".profile:@"+filepath.Join(dir, "profile"), "--section", ".note:extra",
+			"--output", out,
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(printed).To(BeEmpty())
+
+		sections := map[constants.Section]string{
+			constants.CMDLine: "console=ttyS0 quiet",
+			constants.OSRel:   "ID=kairos\n",
+			constants.Uname:   "6.6.0",
+			".profile":        "ID=recovery\n",
+			".note":           "extra",
+		}
+		for name, contents := range sections {
+			data, err := uki.GetSection(out, name)
+			Expect(err).ToNot(HaveOccurred(), string(name))
+			Expect(string(data)).To(Equal(contents), string(name))
+		}
+
+		names, err := uki.ListSections(out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(names).ToNot(ContainElement(constants.Initrd))
+	})
+	It("Prints the build result as JSON with --json", func() {
+		printed, err := runCmd("compat", "build", "--linux", kernel, "--stub", "../pkg/pesign/testdata/file.efi", "--output", out, "--json", "short")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(printed).To(HaveSuffix("}\n"))
+		Expect(printed[:len(printed)-1]).ToNot(ContainSubstring("\n"))
+
+		var result uki.Result
+		Expect(json.Unmarshal([]byte(printed), &result)).To(Succeed())
+		Expect(result.Outputs).To(ContainElement(HaveField("Path", out)))
+		Expect(out).To(BeAnExistingFile())
+	})
+	It("Prints the sections as JSON with --json", func() {
+		_, err := runCmd("compat", "build", "--linux", kernel, "--stub", "../pkg/pesign/testdata/file.efi", "--cmdline", "console=ttyS0", "--output", out)
+		Expect(err).ToNot(HaveOccurred())
+
+		printed, err := runCmd("compat", "--json", "pretty", "inspect", out)
+		Expect(err).ToNot(HaveOccurred())
+
+		var sections map[string]compatSection
+		Expect(json.Unmarshal([]byte(printed), &sections)).To(Succeed())
+		Expect(sections).To(HaveKeyWithValue(".cmdline", HaveField("Text", "console=ttyS0")))
+		Expect(sections).To(HaveKeyWithValue(".linux", HaveField("Size", len("kernel"))))
+	})
+	It("Fails on invalid flags", func() {
+		_, err := runCmd("compat", "build", "--linux", kernel, "--output", out, "--section", "no-name")
+		Expect(err).To(MatchError(types.ErrInvalidInput))
+
+		_, err = runCmd("compat", "build", "--linux", kernel, "--output", out, "--cmdline", "@"+filepath.Join(dir, "missing"))
+		Expect(err).To(MatchError(types.ErrInvalidInput))
+
+		_, err = runCmd("compat", "build", "--linux", kernel, "--output", out, "--json", "yaml")
+		Expect(err).To(MatchError(ContainSubstring("unknown --json format")))
+
+		_, err = runCmd("compat", "build", "--output", out)
+		Expect(err).To(MatchError(types.ErrInvalidInput))
+		Expect(out).ToNot(BeAnExistingFile())
+	})
+})
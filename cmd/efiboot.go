@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/install"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var efiBootCmd = &cobra.Command{
+	Use:   "efiboot",
+	Short: "Manage the UEFI boot entries",
+	Long: `Manage the UEFI Boot#### variables and the BootOrder through efivarfs, like efibootmgr.
+
+Changing the variables needs root and a system booted in UEFI mode.`,
+}
+
+var efiBootListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the boot entries in boot order",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager := &install.BootManager{}
+
+		entries, err := manager.Entries()
+		if err != nil {
+			return err
+		}
+
+		order, err := manager.BootOrder()
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(struct {
+				BootOrder []uint16            `json:"bootOrder"`
+				Entries   []install.BootEntry `json:"entries"`
+			}{BootOrder: order, Entries: entries})
+		}
+
+		names := make([]string, 0, len(order))
+		for _, number := range order {
+			names = append(names, fmt.Sprintf("%04X", number))
+		}
+
+		fmt.Printf("BootOrder: %s\n", strings.Join(names, ","))
+
+		for _, entry := range entries {
+			active := " "
+			if entry.Active {
+				active = "*"
+			}
+
+			fmt.Printf("%s%s %s\t%s\n", entry.Name(), active, entry.Description, entry.Path)
+		}
+
+		return nil
+	},
+}
+
+var efiBootAddCmd = &cobra.Command{
+	Use:   "add file.efi",
+	Short: "Create or update a boot entry for a file in the ESP",
+	Long: `Create or update a boot entry booting the given file, which has to be in the ESP.
+
+An existing entry with the same description and file is updated instead of creating a duplicate.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		esp := viper.GetString("esp-path")
+		if esp == "" {
+			var err error
+			if esp, err = install.FindESP(); err != nil {
+				return err
+			}
+		}
+
+		manager := &install.BootManager{DryRun: viper.GetBool("dry-run")}
+
+		entry, err := manager.AddEntry(esp, args[0], viper.GetString("description"), !viper.GetBool("last"))
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(entry)
+		}
+
+		fmt.Println(entry.Name())
+
+		return nil
+	},
+}
+
+var efiBootOrderCmd = &cobra.Command{
+	Use:   "order 0001,0002,...",
+	Short: "Set the boot order",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var order []uint16
+
+		for _, field := range strings.Split(args[0], ",") {
+			number, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(field), "Boot"), 16, 16)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid boot entry number %q", field))
+			}
+
+			order = append(order, uint16(number))
+		}
+
+		return (&install.BootManager{DryRun: viper.GetBool("dry-run")}).SetBootOrder(order)
+	},
+}
+
+func init() {
+	efiBootAddCmd.Flags().String("esp-path", "", "Mount point of the ESP, autodetected if not given.")
+	efiBootAddCmd.Flags().String("description", "Linux Boot Manager", "Description of the boot entry, shown by the firmware.")
+	efiBootAddCmd.Flags().Bool("last", false, "Add the entry at the end of the boot order instead of first.")
+	efiBootAddCmd.Flags().Bool("dry-run", false, "Print the variables that would be written without writing them.")
+	efiBootOrderCmd.Flags().Bool("dry-run", false, "Print the variables that would be written without writing them.")
+
+	efiBootCmd.AddCommand(efiBootListCmd, efiBootAddCmd, efiBootOrderCmd)
+	rootCmd.AddCommand(efiBootCmd)
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes returned by ukify, so scripts can tell failures apart.
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitInvalidInput = 2
+	exitSigning      = 3
+	exitMeasurement  = 4
+	exitVerification = 5
+	// ExitInterrupted is used when ukify is interrupted, following the shell convention of 128 + SIGINT.
+	ExitInterrupted = 130
+)
+
+const exitCodesHelp = `Exit codes:
+  0    success
+  1    generic failure
+  2    invalid usage or input (bad flags, missing or invalid files and keys)
+  3    signing failure
+  4    measurement failure
+  5    verification failure
+  130  interrupted`
+
+// exitCode maps an error returned by a command to the process exit code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	// invalid inputs are checked first, as they are the cause of the signing or measurement
+	// failures wrapping them
+	case errors.Is(err, types.ErrInvalidInput):
+		return exitInvalidInput
+	// verification is checked before signing, as signing also verifies the signed file
+	case errors.Is(err, types.ErrVerification):
+		return exitVerification
+	case errors.Is(err, types.ErrSigning):
+		return exitSigning
+	case errors.Is(err, types.ErrMeasurement):
+		return exitMeasurement
+	default:
+		return exitFailure
+	}
+}
+
+// trackRun wraps the RunE of cmd and all its subcommands to record when one of them starts.
+//
+// cobra validates arguments and flags before calling RunE, so an error returned before
+// RunE is reached is a usage error.
+func trackRun(cmd *cobra.Command, ran *bool) {
+	if runE := cmd.RunE; runE != nil {
+		cmd.RunE = func(cmd *cobra.Command, args []string) error {
+			*ran = true
+			return runE(cmd, args)
+		}
+	}
+
+	for _, sub := range cmd.Commands() {
+		trackRun(sub, ran)
+	}
+}
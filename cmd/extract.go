@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var extractCmd = &cobra.Command{
+	Use:   "extract uki.efi",
+	Short: "Extract sections from a UKI",
+	Long: `Extract a single section of a UKI with --section, or all the UKI sections with --all.
+
+A single section is written to --out, or to stdout if not given. With --all, --out is the
+directory where each section is written to a file named after it, i.e. initrd for .initrd.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		input := args[0]
+		out := viper.GetString("out")
+
+		if viper.GetBool("all") {
+			if out == "" {
+				out = "."
+			}
+
+			names, err := uki.ListSections(input)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			if err = os.MkdirAll(out, 0o755); err != nil {
+				return err
+			}
+
+			var extracted []extractOutput
+
+			for _, name := range names {
+				path := filepath.Join(out, strings.TrimPrefix(string(name), "."))
+
+				size, err := extractSection(input, name, path)
+				if err != nil {
+					return err
+				}
+
+				extracted = append(extracted, extractOutput{Section: string(name), Path: path, Size: size})
+			}
+
+			if jsonOutput() {
+				return printJSON(extracted)
+			}
+
+			for _, e := range extracted {
+				fmt.Printf("%s\t%s\t%d\n", e.Section, e.Path, e.Size)
+			}
+
+			return nil
+		}
+
+		name := viper.GetString("section")
+		if name == "" {
+			return types.WithCategory(types.ErrInvalidInput, errors.New("one of --section or --all is required"))
+		}
+
+		if !strings.HasPrefix(name, ".") {
+			name = "." + name
+		}
+
+		if out == "" {
+			if jsonOutput() {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("--output json can not be used when writing the section to stdout"))
+			}
+
+			_, err := extractSection(input, constants.Section(name), stdioPath)
+
+			return err
+		}
+
+		size, err := extractSection(input, constants.Section(name), out)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON([]extractOutput{{Section: name, Path: out, Size: size}})
+		}
+
+		return nil
+	},
+}
+
+// extractOutput is the machine-readable output of the extract command.
+type extractOutput struct {
+	Section string `json:"section"`
+	Path    string `json:"path"`
+	Size    int    `json:"size"`
+}
+
+// extractSection writes the contents of a section of the PE file to path, - is stdout.
+func extractSection(input string, name constants.Section, path string) (int, error) {
+	data, err := uki.GetSection(input, name)
+	if err != nil {
+		return 0, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("failed extracting %s from %s: %w", name, input, err))
+	}
+
+	if path == stdioPath {
+		_, err = os.Stdout.Write(data)
+
+		return len(data), err
+	}
+
+	return len(data), utils.WriteFile(path, data, 0o644)
+}
+
+func init() {
+	extractCmd.Flags().String("section", "", "Name of the section to extract, i.e. .initrd.")
+	extractCmd.Flags().Bool("all", false, "Extract all the UKI sections.")
+	extractCmd.Flags().String("out", "", "File to write the section to, or directory with --all.")
+	extractCmd.MarkFlagsMutuallyExclusive("section", "all")
+
+	rootCmd.AddCommand(extractCmd)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/install"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var installCmd = &cobra.Command{
+	Use:   "install uki.efi",
+	Short: "Install a uki file into the ESP",
+	Long: `Install a uki file into the ESP under EFI/Linux/ as <entry-token>-<version>.efi, with the version
+taken from the os-release embedded in it.
+
+The entry token follows kernel-install(8): auto uses /etc/kernel/entry-token, the machine ID, IMAGE_ID or ID,
+whichever is found first. machine-id, os-id and os-image-id pick one of them, any other value is used as is.
+
+With --type1 the kernel and initrd are extracted to <entry-token>/<version>/ and booted through a
+loader/entries/ entry instead. --loader-conf writes loader/loader.conf, so the ESP is bootable as a whole
+once sd-boot is installed too.
+
+--recovery installs a recovery uki built with create --output-recovery-uki as <entry-name>-recovery.efi. It
+is listed in the systemd-boot menu as the fallback while the loader.conf default stays on the main entry.
+
+--boot-once selects the installed entry for the next boot only, see the boot-next command.
+
+The ESP is autodetected among /efi, /boot and /boot/efi by its GPT partition type unless --esp-path is given.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		installer := &install.Installer{
+			ESPPath:         viper.GetString("esp-path"),
+			UKIPath:         args[0],
+			RecoveryUKIPath: viper.GetString("recovery"),
+			SdBootPath:      viper.GetString("sd-boot"),
+			Fallback:        viper.GetBool("fallback"),
+			ShimPath:        viper.GetString("shim"),
+			MokManagerPath:  viper.GetString("mok-manager"),
+			EntryToken:      viper.GetString("entry-token"),
+			EntryName:       viper.GetString("entry-name"),
+			Type1:           viper.GetBool("type1"),
+			BootEntry:       viper.GetString("boot-entry"),
+			BootOnce:        viper.GetBool("boot-once"),
+		}
+
+		if viper.GetBool("loader-conf") {
+			installer.Loader = &install.LoaderConfig{
+				Timeout:     viper.GetString("timeout"),
+				Default:     viper.GetString("default-entry"),
+				ConsoleMode: viper.GetString("console-mode"),
+			}
+		}
+
+		if viper.GetBool("preflight") {
+			space, err := spaceCheckFromFlags()
+			if err != nil {
+				return err
+			}
+			installer.Space = space
+		}
+
+		installed, err := installer.Install()
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(struct {
+				ESP       string   `json:"esp"`
+				Installed []string `json:"installed"`
+			}{ESP: installer.ESPPath, Installed: installed})
+		}
+
+		for _, path := range installed {
+			fmt.Println(path)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	installCmd.Flags().String("esp-path", "", "Mount point of the ESP, autodetected if not given.")
+	installCmd.Flags().String("recovery", "", "Path to a recovery uki, installed next to the uki as <entry-name>-recovery.efi.")
+	installCmd.Flags().String("sd-boot", "", "Path to the signed sd-boot to install along the uki.")
+	installCmd.Flags().Bool("fallback", true, "Also install sd-boot as the EFI/BOOT/BOOT<ARCH>.EFI removable media fallback.")
+	installCmd.Flags().String("shim", "", "Path to the signed shim, installed as EFI/BOOT/BOOT<ARCH>.EFI chain loading sd-boot or the uki.")
+	installCmd.Flags().String("mok-manager", "", "Path to the signed MokManager to install next to shim.")
+	installCmd.Flags().String("entry-token", install.EntryTokenAuto, "Entry token prefixing the entry name: auto, machine-id, os-id, os-image-id or a literal token.")
+	installCmd.Flags().String("entry-name", "", "Name of the boot entry, overrides <entry-token>-<version>.")
+	installCmd.Flags().Bool("type1", false, "Install a type #1 entry with the kernel and initrd extracted from the uki, instead of the uki.")
+	installCmd.Flags().String("boot-entry", "", "Create a first in order UEFI boot entry with this description, booting sd-boot if given or the uki.")
+	installCmd.Flags().Bool("boot-once", false, "Boot the installed entry once on the next boot, through systemd-boot LoaderEntryOneShot.")
+	installCmd.Flags().Bool("preflight", true, "Check the ESP can hold the uki before copying anything.")
+	installCmd.Flags().String("preflight-budget", "", "Size of the ESP for the preflight check, i.e. 512M, instead of the file system size.")
+	installCmd.Flags().Int("preflight-keep", 0, "Number of versions kept on the ESP by pruning, the new one included, older ones count as free space.")
+	installCmd.Flags().Bool("loader-conf", false, "Write loader/loader.conf to configure systemd-boot.")
+	installCmd.Flags().String("timeout", "", "Menu timeout in seconds for loader.conf, or menu-force, menu-hidden, menu-disabled.")
+	installCmd.Flags().String("default-entry", "", "Glob matching the default entry for loader.conf, defaults to the installed entry token.")
+	installCmd.Flags().String("console-mode", "", "Console mode for loader.conf, one of: 0, 1, 2, auto, max, keep.")
+
+	rootCmd.AddCommand(installCmd)
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var kernelInfoCmd = &cobra.Command{
+	Use:   "kernel-info kernel",
+	Short: "Describe a kernel image",
+	Long: `Print the format, architecture, compression and banner of a kernel image, and the boot and
+security options of the configuration it embeds when built with CONFIG_IKCONFIG=y.
+
+With --config, the whole embedded configuration is printed as a .config file instead.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if viper.GetBool("config") {
+			config, err := uki.ReadKernelConfig(args[0])
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			_, err = os.Stdout.Write(config)
+
+			return err
+		}
+
+		info, err := uki.InspectKernel(args[0])
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		if jsonOutput() {
+			return printJSON(info)
+		}
+
+		fmt.Printf("Format:\t%s\n", info.Format)
+		fmt.Printf("EFI stub:\t%t\n", info.EFIStub)
+		fmt.Printf("Arch:\t%s\n", info.Arch)
+		fmt.Printf("Compression:\t%s\n", info.Compression)
+		fmt.Printf("Banner:\t%s\n", info.Banner)
+
+		if info.Config == nil {
+			fmt.Println("Config:\tnot embedded")
+
+			return nil
+		}
+
+		fmt.Printf("Config:\t%s\n", info.ConfigSHA256)
+
+		options := make([]string, 0, len(info.Config))
+		for option := range info.Config {
+			options = append(options, option)
+		}
+
+		slices.Sort(options)
+
+		for _, option := range options {
+			fmt.Printf("  %s=%s\n", option, info.Config[option])
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	kernelInfoCmd.Flags().Bool("config", false, "Print the embedded kernel configuration.")
+
+	rootCmd.AddCommand(kernelInfoCmd)
+}
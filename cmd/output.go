@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Log formats.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jsonOutput returns whether the user asked for machine-readable output.
+// In that mode commands print a single JSON document to stdout, logs keep going to stderr.
+func jsonOutput() bool {
+	return viper.GetString("output") == outputJSON
+}
+
+// printJSON writes v to stdout as an indented JSON document.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
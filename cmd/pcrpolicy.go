@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var pcrPolicyCmd = &cobra.Command{
+	Use:   "pcr-policy [uki.efi]",
+	Short: "Write the files needed to enroll a LUKS volume against a signed PCR policy",
+	Long: `Write the PCR public key and signed policy of a UKI, and print the systemd-cryptenroll
+invocation binding a LUKS volume to them.
+
+The public key and signature are read from the .pcrpkey and .pcrsig sections of the UKI. Without
+a UKI, --pcr-key is used to write the public key only, which is all systemd-cryptenroll needs as
+systemd-stub provides the signature at boot.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		outDir := viper.GetString("out-dir")
+
+		var publicKey, signature []byte
+
+		switch {
+		case len(args) == 1:
+			var err error
+
+			publicKey, err = uki.GetSection(args[0], constants.PCRPKey)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("failed reading PCR public key from %s: %w", args[0], err))
+			}
+
+			signature, err = uki.GetSection(args[0], constants.PCRSig)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("failed reading PCR signature from %s: %w", args[0], err))
+			}
+		case viper.GetString("pcr-key") != "":
+			signer, err := pesign.NewPCRSignerWithPassphrase(viper.GetString("pcr-key"), terminalPassphrase)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			publicKey, err = measure.PublicKeyPEM(signer.PublicRSAKey())
+			if err != nil {
+				return err
+			}
+		default:
+			return types.WithCategory(types.ErrInvalidInput, errors.New("a UKI or --pcr-key is required"))
+		}
+
+		if err := os.MkdirAll(outDir, 0o755); err != nil {
+			return err
+		}
+
+		out := pcrPolicyOutput{
+			PublicKey: filepath.Join(outDir, constants.PCRPublicKeyFile),
+			PCRs:      []int{constants.UKIPCR},
+		}
+
+		if err := utils.WriteFile(out.PublicKey, publicKey, 0o644); err != nil {
+			return err
+		}
+
+		if signature != nil {
+			out.Signature = filepath.Join(outDir, constants.PCRSignatureFile)
+
+			if err := utils.WriteFile(out.Signature, signature, 0o644); err != nil {
+				return err
+			}
+		}
+
+		out.Command = cryptenrollCommand(out, viper.GetString("device"))
+
+		if jsonOutput() {
+			return printJSON(out)
+		}
+
+		fmt.Printf("Wrote %s\n", out.PublicKey)
+		if out.Signature != "" {
+			fmt.Printf("Wrote %s\n", out.Signature)
+		}
+		fmt.Printf("Enroll with:\n  %s\n", strings.Join(out.Command, " "))
+
+		return nil
+	},
+}
+
+// pcrPolicyOutput is the machine-readable output of the pcr-policy command.
+type pcrPolicyOutput struct {
+	PublicKey string   `json:"publicKey"`
+	Signature string   `json:"signature,omitempty"`
+	PCRs      []int    `json:"pcrs"`
+	Command   []string `json:"command"`
+}
+
+// cryptenrollCommand returns the systemd-cryptenroll arguments to enroll the device against the policy.
+func cryptenrollCommand(out pcrPolicyOutput, device string) []string {
+	pcrs := make([]string, 0, len(out.PCRs))
+	for _, pcr := range out.PCRs {
+		pcrs = append(pcrs, strconv.Itoa(pcr))
+	}
+
+	command := []string{
+		"systemd-cryptenroll",
+		"--tpm2-device=auto",
+		"--tpm2-public-key=" + out.PublicKey,
+		"--tpm2-public-key-pcrs=" + strings.Join(pcrs, "+"),
+	}
+
+	if out.Signature != "" {
+		command = append(command, "--tpm2-signature="+out.Signature)
+	}
+
+	return append(command, device)
+}
+
+func init() {
+	pcrPolicyCmd.Flags().StringP("pcr-key", "p", "", "PCR key to derive the public key from when no UKI is given.")
+	pcrPolicyCmd.Flags().String("out-dir", ".", "Directory to write the public key and signature to.")
+	pcrPolicyCmd.Flags().String("device", "/dev/disk/by-partlabel/root", "LUKS device to use in the suggested command.")
+
+	rootCmd.AddCommand(pcrPolicyCmd)
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/install"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	"github.com/spf13/viper"
+)
+
+// spaceCheckFromFlags returns the ESP space check configured by the preflight flags.
+func spaceCheckFromFlags() (*install.SpaceCheck, error) {
+	budget, err := utils.ParseSize(viper.GetString("preflight-budget"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &install.SpaceCheck{Budget: budget, Keep: viper.GetInt("preflight-keep")}, nil
+}
+
+// preflightBuild checks, before building, that the ESP or the size budget can hold the UKI.
+func preflightBuild(builder *uki.Builder) error {
+	if viper.GetString("preflight-esp") == "" && viper.GetString("preflight-budget") == "" {
+		return nil
+	}
+
+	check, err := spaceCheckFromFlags()
+	if err != nil {
+		return err
+	}
+	check.ESPPath = viper.GetString("preflight-esp")
+
+	size, err := builder.EstimatedSize()
+	if err != nil {
+		return err
+	}
+
+	space, err := check.Check(size, buildOSID(builder))
+	if err != nil {
+		return err
+	}
+
+	slog.Info("ESP can hold the UKI", "estimated", formatBytes(size), "available", formatBytes(space.Available()))
+
+	return nil
+}
+
+// buildOSID returns the os-release ID the UKI will carry.
+func buildOSID(builder *uki.Builder) string {
+	if builder.OsRelease == "" {
+		return builder.Identity.Resolve().ID
+	}
+
+	data, err := os.ReadFile(builder.OsRelease)
+	if err != nil {
+		return ""
+	}
+
+	values := utils.ParseOSRelease(data)
+	if values["IMAGE_ID"] != "" {
+		return values["IMAGE_ID"]
+	}
+
+	return values["ID"]
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// progressInterval limits how often the progress line is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+// progressLine renders the build progress on a single line of the terminal.
+//
+// Log messages clear the line before being written, so they do not get mixed with it.
+type progressLine struct {
+	mu    sync.Mutex
+	out   io.Writer
+	drawn bool
+	last  time.Time
+}
+
+// newProgress returns a progress callback rendering to stderr, or nil if stderr is not
+// a terminal or the logs are meant for machines.
+func newProgress() func(uki.Progress) {
+	if viper.GetString("log-format") == logFormatJSON || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+
+	line := &progressLine{out: os.Stderr}
+	log.SetOutput(line.logWriter())
+
+	return line.update
+}
+
+func (p *progressLine) update(progress uki.Progress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if progress.Finished {
+		p.clear()
+
+		return
+	}
+
+	// always draw the start of a stage, throttle the byte counts
+	if progress.Done != 0 && time.Since(p.last) < progressInterval {
+		return
+	}
+
+	p.last = time.Now()
+
+	text := fmt.Sprintf("[%s]", progress.Stage)
+	if progress.Item != "" {
+		text += " " + progress.Item
+	}
+
+	switch {
+	case progress.Total > 0 && progress.Done > 0:
+		text += fmt.Sprintf(" %3d%% %s / %s", progress.Done*100/progress.Total, formatBytes(progress.Done), formatBytes(progress.Total))
+	case progress.Total > 0:
+		text += fmt.Sprintf(" %s", formatBytes(progress.Total))
+	}
+
+	fmt.Fprintf(p.out, "\r\033[K%s", text) //nolint:errcheck
+	p.drawn = true
+}
+
+// clear removes the progress line, the caller holds the lock.
+func (p *progressLine) clear() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K") //nolint:errcheck
+		p.drawn = false
+	}
+}
+
+// logWriter clears the progress line before writing log messages.
+func (p *progressLine) logWriter() io.Writer {
+	return writerFunc(func(b []byte) (int, error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		p.clear()
+
+		return p.out.Write(b)
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// logTimings logs how long each stage of the build took.
+func logTimings(result *uki.Result, total time.Duration) {
+	args := make([]any, 0, 2*len(result.Timings)+2)
+
+	for _, timing := range result.Timings {
+		args = append(args, string(timing.Stage), timing.Duration.Round(time.Millisecond))
+	}
+
+	args = append(args, "total", total.Round(time.Millisecond))
+
+	slog.Info("Build timings", args...)
+
+	report := result.Report
+	slog.Debug("Build report", "hashed", formatBytes(report.BytesHashed), "written", formatBytes(report.OutputBytes),
+		"cache-hits", report.CacheHits, "cache-misses", report.CacheMisses)
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// terminalPassphrase asks for a key passphrase or token PIN on the controlling terminal.
+//
+// It fails right away when there is no terminal, so non-interactive jobs error out instead of hanging.
+func terminalPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.New("a passphrase is required but there is no terminal to ask for it")
+	}
+
+	defer tty.Close() //nolint:errcheck
+
+	if !term.IsTerminal(int(tty.Fd())) {
+		return nil, errors.New("a passphrase is required but there is no terminal to ask for it")
+	}
+
+	if _, err = fmt.Fprint(tty, prompt); err != nil {
+		return nil, err
+	}
+
+	secret, err := term.ReadPassword(int(tty.Fd()))
+	_, _ = fmt.Fprintln(tty)
+
+	return secret, err
+}
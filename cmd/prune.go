@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/install"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove old uki files from the ESP",
+	Long: `Remove old uki files from EFI/Linux/ in the ESP, keeping the most recent versions of each OS.
+
+Versions are taken from the IMAGE_VERSION or VERSION_ID of the os-release embedded in each uki, and
+compared like systemd-boot does. The entry systemd-boot booted is never removed, nor are ukis without a version.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pruner := &install.Pruner{
+			ESPPath: viper.GetString("esp-path"),
+			Keep:    viper.GetInt("keep"),
+			Protect: viper.GetStringSlice("protect"),
+			DryRun:  viper.GetBool("dry-run"),
+		}
+
+		removed, err := pruner.Prune()
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(struct {
+				ESP     string   `json:"esp"`
+				Removed []string `json:"removed"`
+				DryRun  bool     `json:"dryRun"`
+			}{ESP: pruner.ESPPath, Removed: removed, DryRun: pruner.DryRun})
+		}
+
+		for _, path := range removed {
+			fmt.Println(path)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	pruneCmd.Flags().String("esp-path", "", "Mount point of the ESP, autodetected if not given.")
+	pruneCmd.Flags().Int("keep", 3, "Number of versions to keep for each OS.")
+	pruneCmd.Flags().StringSlice("protect", nil, "File names under EFI/Linux/ to never remove.")
+	pruneCmd.Flags().Bool("dry-run", false, "Print the files that would be removed without removing them.")
+
+	rootCmd.AddCommand(pruneCmd)
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var repackCmd = &cobra.Command{
+	Use:   "repack uki.efi",
+	Short: "Rebuild an existing UKI with a new cmdline or os-release",
+	Long: `Rebuild an existing UKI, replacing its cmdline and/or os-release.
+
+The stub, kernel, initrd and splash are taken from the given UKI, the result is measured again
+and signed with the given keys, so config-only updates do not need the original build inputs.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		builder := &uki.Builder{
+			Cmdline:    viper.GetString("cmdline"),
+			OsRelease:  viper.GetString("os-release"),
+			OutUKIPath: viper.GetString("output-uki"),
+			PCRKey:     viper.GetString("pcr-key"),
+			SBKey:      viper.GetString("sb-key"),
+			SBCert:     viper.GetString("sb-cert"),
+			Phases:     types.PhasesFromString(viper.GetString("phases")),
+			Passphrase: terminalPassphrase,
+		}
+
+		if err := uki.Repack(args[0], builder); err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(builder.Result())
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	repackCmd.Flags().StringP("cmdline", "c", "", "New kernel cmdline, the current one is kept if not given.")
+	repackCmd.Flags().StringP("os-release", "o", "", "New os-release file, the current one is kept if not given.")
+	repackCmd.Flags().String("sb-cert", "", "SecureBoot certificate to sign the UKI with.")
+	repackCmd.Flags().String("sb-key", "", "SecureBoot key to sign the UKI with.")
+	repackCmd.Flags().StringP("pcr-key", "p", "", "PCR key.")
+	repackCmd.Flags().String("phases", "enter-initrd:leave-initrd:sysinit:ready", "phases to measure for, separated by : and in order of measurement")
+	repackCmd.Flags().String("output-uki", "uki.signed.efi", "uki artifact output.")
+
+	rootCmd.AddCommand(repackCmd)
+}
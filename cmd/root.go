@@ -1,28 +1,173 @@
 package cmd
 
 import (
-	"github.com/spf13/cobra"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	"github.com/kairos-io/go-ukify/pkg/redact"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func NewRootCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use: "ukify",
+		Use:  "ukify",
+		Long: "Build, sign and install Unified Kernel Images.\n\n" + envHelp + "\n\n" + exitCodesHelp,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// Bind the flags of the command being run only, as several commands share flag names
+			if err := viper.BindPFlags(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := setupLogging(); err != nil {
+				return err
+			}
+			if err := setupIO(); err != nil {
+				return err
+			}
+			fips.Enforce(viper.GetBool("fips"))
+			return validateOutputFormat()
+		},
 	}
 
+	cmd.PersistentFlags().String("output", outputText, "Output format for command results, one of: text, json.")
+	cmd.PersistentFlags().Bool("debug", false, "Enable debug output, same as --log-level debug")
+	cmd.PersistentFlags().String("log-level", "info", "Log level, one of: debug, info, warn, error.")
+	cmd.PersistentFlags().String("log-format", logFormatText, "Log format, one of: text, json.")
+	cmd.PersistentFlags().String("io-buffer-size", "1M", "Size of the buffers streaming files, i.e. 4M.")
+	cmd.PersistentFlags().Bool("drop-cache", false, "Drop the files streamed from the page cache once done with, to spare the cache of other jobs on shared hosts.")
+	cmd.PersistentFlags().Bool("fips", false, "Fail instead of using algorithms not approved for FIPS 140-3, i.e. SHA-1 PCR banks, RSA keys under 2048 bits or legacy encrypted PEM keys. Run with GODEBUG=fips140=on to use the FIPS 140-3 Go Cryptographic Module.")
+	_ = viper.BindPFlags(cmd.PersistentFlags())
+
+	// every flag can also be set with an UKIFY_ prefixed environment variable, i.e. UKIFY_SB_KEY for --sb-key
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+
 	cmd.CompletionOptions = cobra.CompletionOptions{
 		DisableDefaultCmd: true,
 	}
 	return cmd
 }
 
+// envPrefix is the prefix of the environment variables configuring the flags.
+const envPrefix = "UKIFY"
+
+const envHelp = `Every flag can also be set with an environment variable named after it, prefixed with
+UKIFY_, uppercased and with dashes replaced by underscores, i.e. UKIFY_SB_KEY for --sb-key or
+UKIFY_LOG_LEVEL for --log-level. Flags given on the command line take precedence.`
+
 var rootCmd = NewRootCmd()
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	var ran bool
+	trackRun(rootCmd, &ran)
+
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		if !ran {
+			err = types.WithCategory(types.ErrInvalidInput, err)
+		}
+		if jsonOutput() {
+			out := struct {
+				Error   string `json:"error"`
+				Stage   string `json:"stage,omitempty"`
+				Section string `json:"section,omitempty"`
+				Path    string `json:"path,omitempty"`
+			}{Error: err.Error()}
+
+			var buildErr *types.BuildError
+			if errors.As(err, &buildErr) {
+				out.Stage, out.Section, out.Path = string(buildErr.Stage), string(buildErr.Section), buildErr.Path
+			}
+
+			_ = printJSON(out)
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// setupIO applies the I/O tunables.
+func setupIO() error {
+	size, err := utils.ParseSize(viper.GetString("io-buffer-size"))
+	if err != nil {
+		return err
+	}
+
+	if size > 0 {
+		utils.BufferSize = int(size)
+	}
+
+	utils.DropCache = viper.GetBool("drop-cache")
+
+	return nil
+}
+
+// setupLogging applies the requested log level and format.
+func setupLogging() error {
+	level := slog.LevelDebug
+
+	if !viper.GetBool("debug") {
+		if err := level.UnmarshalText([]byte(viper.GetString("log-level"))); err != nil {
+			return fmt.Errorf("unknown log level %q", viper.GetString("log-level"))
+		}
+	}
+
+	switch viper.GetString("log-format") {
+	case logFormatText:
+		slog.SetLogLoggerLevel(level)
+
+		// the default handler writes through the log package, which SetDefault points back at the
+		// new handler, without the date
+		flags := log.Flags()
+		slog.SetDefault(slog.New(redact.NewHandler(slog.Default().Handler())))
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	case logFormatJSON:
+		// JSON records use the standard slog keys: time, level, msg and the attributes of each message
+		slog.SetDefault(slog.New(redact.NewHandler(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))))
+	default:
+		return fmt.Errorf("unknown log format %q", viper.GetString("log-format"))
+	}
+
+	return nil
+}
+
+// requireFlags checks that the flags are set, either on the command line or through the environment.
+//
+// cobra required flags only look at the command line, so they can not be used with environment variables.
+func requireFlags(names ...string) error {
+	var missing []string
+
+	for _, name := range names {
+		if viper.GetString(name) == "" && len(viper.GetStringSlice(name)) == 0 {
+			missing = append(missing, strconv.Quote(name))
+		}
+	}
+
+	if len(missing) > 0 {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("required flag(s) %s not set", strings.Join(missing, ", ")))
+	}
+
+	return nil
+}
+
+// validateOutputFormat checks that the requested output format is a known one.
+func validateOutputFormat() error {
+	switch viper.GetString("output") {
+	case outputText, outputJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", viper.GetString("output"))
 	}
 }
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var sbatCmd = &cobra.Command{
+	Use:   "sbat",
+	Short: "Inspect and check the SBAT table of EFI binaries",
+}
+
+var sbatShowCmd = &cobra.Command{
+	Use:   "show file.efi",
+	Short: "Print the SBAT table of a stub or UKI",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := readSBAT(args[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(entries)
+		}
+
+		data, err := sbat.Marshal(entries)
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(string(data))
+
+		return nil
+	},
+}
+
+var sbatCheckCmd = &cobra.Command{
+	Use:   "check file.efi",
+	Short: "Check the SBAT table of a stub or UKI against a revocation policy",
+	Long: `Check the SBAT table of a stub or UKI against a revocation policy in the SbatLevel format,
+failing if any of its components has a generation lower than the policy allows.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireFlags("policy"); err != nil {
+			return err
+		}
+
+		entries, err := readSBAT(args[0])
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(viper.GetString("policy"))
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		policy, err := sbat.ParsePolicy(data)
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		if err = policy.Check(entries); err != nil {
+			return types.WithCategory(types.ErrVerification, err)
+		}
+
+		if !jsonOutput() {
+			fmt.Printf("%s is allowed by %s\n", args[0], viper.GetString("policy"))
+		}
+
+		return nil
+	},
+}
+
+// readSBAT parses the SBAT section of a PE file.
+func readSBAT(path string) ([]sbat.Entry, error) {
+	data, err := uki.GetSBAT(path)
+	if err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s: %w", path, err))
+	}
+
+	return sbat.Parse(data)
+}
+
+// readSBATFile parses a file with extra SBAT entries, an empty path returns no entries.
+func readSBATFile(path string) ([]sbat.Entry, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	entries, err := sbat.Parse(data)
+	if err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s: %w", path, err))
+	}
+
+	if len(entries) == 0 {
+		return nil, types.WithCategory(types.ErrInvalidInput, errors.New("no SBAT entries in "+path))
+	}
+
+	return entries, nil
+}
+
+// sbatOverrides parses the component=generation and component=vendor overrides of SBAT components.
+func sbatOverrides(generations, vendors []string) (map[string]int, map[string]string, error) {
+	var (
+		generationOverrides map[string]int
+		vendorOverrides     map[string]string
+	)
+
+	for _, override := range generations {
+		component, value, ok := strings.Cut(override, "=")
+
+		generation, err := strconv.Atoi(value)
+		if !ok || component == "" || err != nil {
+			return nil, nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid SBAT generation override %q, expected component=generation", override))
+		}
+
+		if generationOverrides == nil {
+			generationOverrides = map[string]int{}
+		}
+		generationOverrides[component] = generation
+	}
+
+	for _, override := range vendors {
+		component, vendor, ok := strings.Cut(override, "=")
+		if !ok || component == "" {
+			return nil, nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid SBAT vendor override %q, expected component=vendor", override))
+		}
+
+		if vendorOverrides == nil {
+			vendorOverrides = map[string]string{}
+		}
+		vendorOverrides[component] = vendor
+	}
+
+	return generationOverrides, vendorOverrides, nil
+}
+
+func init() {
+	sbatCheckCmd.Flags().String("policy", "", "Revocation policy file, in the SbatLevel format.")
+
+	sbatCmd.AddCommand(sbatShowCmd, sbatCheckCmd)
+	rootCmd.AddCommand(sbatCmd)
+}
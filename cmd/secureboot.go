@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var secureBootCmd = &cobra.Command{
+	Use:   "secureboot",
+	Short: "Author the UEFI Secure Boot key variables and shim MOK requests, and report the host state",
+}
+
+var enrollFilesCmd = &cobra.Command{
+	Use:   "enroll-files",
+	Short: "Write the signature lists and signed updates to enroll PK, KEK and db",
+	Long: `Convert the PK, KEK and db certificates into EFI signature lists (.esl) and signed variable
+updates (.auth), written under --out-dir in PK/, KEK/ and db/ as sbkeysync expects them.
+
+The PK update is self-signed, the KEK update is signed with the PK and the db update with the KEK.
+Enroll them from the firmware setup, or with sbkeysync --keystore <out-dir> on a machine in setup mode.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireFlags("owner", "pk-cert", "pk-key", "kek-cert", "kek-key"); err != nil {
+			return err
+		}
+
+		pk, err := secureBootKey(viper.GetString("pk-cert"), viper.GetString("pk-key"))
+		if err != nil {
+			return err
+		}
+
+		kek, err := secureBootKey(viper.GetString("kek-cert"), viper.GetString("kek-key"))
+		if err != nil {
+			return err
+		}
+
+		var db []*x509.Certificate
+
+		for _, path := range viper.GetStringSlice("db-cert") {
+			cert, err := pesign.LoadCertificate(path)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			db = append(db, cert)
+		}
+
+		enroll := &secureboot.EnrollFiles{
+			Owner: viper.GetString("owner"),
+			PK:    pk,
+			KEK:   kek,
+			DB:    db,
+		}
+
+		files, err := enroll.Write(viper.GetString("out-dir"))
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(files)
+		}
+
+		for _, f := range files {
+			fmt.Printf("%s\t%s\n", f.Variable, f.Path)
+		}
+
+		return nil
+	},
+}
+
+var mokRequestCmd = &cobra.Command{
+	Use:   "mok-request",
+	Short: "Request enrolling certificates in the shim MOK list",
+	Long: `Request enrolling certificates in the shim MOK list, for machines booting through shim where the
+PK can not be replaced.
+
+The request is written to --out-dir as MokNew and MokAuth, the contents of the variables, along with each
+certificate in DER form for mokutil --import. With --enroll the variables are written to the running system
+so MokManager asks to confirm the enrollment with the password on the next boot.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireFlags("cert"); err != nil {
+			return err
+		}
+
+		if viper.GetString("out-dir") == "" && !viper.GetBool("enroll") {
+			return types.WithCategory(types.ErrInvalidInput, errors.New("either --out-dir or --enroll is required"))
+		}
+
+		request := &secureboot.MokRequest{}
+
+		for _, path := range viper.GetStringSlice("cert") {
+			cert, err := pesign.LoadCertificate(path)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			request.Certificates = append(request.Certificates, cert)
+		}
+
+		password, err := terminalPassphrase("MOK enrollment password: ")
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+		request.Password = password
+
+		if dir := viper.GetString("out-dir"); dir != "" {
+			files, err := request.Write(dir)
+			if err != nil {
+				return err
+			}
+
+			for _, path := range files {
+				fmt.Println(path)
+			}
+		}
+
+		if viper.GetBool("enroll") {
+			if err = request.Enroll(); err != nil {
+				return err
+			}
+
+			slog.Info("Requested MOK enrollment, confirm it in MokManager on the next boot")
+		}
+
+		return nil
+	},
+}
+
+var mokCheckCmd = &cobra.Command{
+	Use:   "mok-check file.efi",
+	Short: "Check that an EFI binary is signed by a certificate of the MOK list",
+	Long: `Check that an EFI binary is signed by a certificate of the MOK list, so shim boots it.
+
+The MOK list is read from the MokListRT variable shim exports, or from --mok-list, a signature list file.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var certs []*x509.Certificate
+		var err error
+
+		if path := viper.GetString("mok-list"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			certs, err = secureboot.ParseCertificates(data)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+		} else if certs, err = secureboot.MokList(); err != nil {
+			return fmt.Errorf("failed reading the MOK list: %w", err)
+		}
+
+		cert, err := secureboot.SignedBy(args[0], certs)
+		if err != nil {
+			return err
+		}
+
+		if cert == nil {
+			return types.WithCategory(types.ErrVerification, fmt.Errorf("%s is not signed by any of the %d certificates in the MOK list", args[0], len(certs)))
+		}
+
+		if jsonOutput() {
+			return printJSON(struct {
+				File    string `json:"file"`
+				Subject string `json:"subject"`
+			}{File: args[0], Subject: cert.Subject.String()})
+		}
+
+		fmt.Printf("%s is signed by %s\n", args[0], cert.Subject)
+
+		return nil
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Report the Secure Boot state of this host",
+	Long: `Report the Secure Boot state of this host, from its SecureBoot, SetupMode, PK and db variables.
+
+With --sb-cert, also check that the firmware boots binaries signed with the certificate.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state, err := secureboot.SystemState()
+		if err != nil {
+			return fmt.Errorf("failed reading the Secure Boot state: %w", err)
+		}
+
+		var accepted *bool
+		var reason error
+
+		if path := viper.GetString("sb-cert"); path != "" {
+			cert, err := pesign.LoadCertificate(path)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			reason = state.Accepts(cert)
+			ok := reason == nil
+			accepted = &ok
+		}
+
+		if jsonOutput() {
+			if err = printJSON(struct {
+				*secureboot.State
+				DbCertificates int   `json:"dbCertificates"`
+				Accepted       *bool `json:"accepted,omitempty"`
+			}{State: state, DbCertificates: len(state.Db), Accepted: accepted}); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("SecureBoot:\t%t\nSetupMode:\t%t\nPK enrolled:\t%t\ndb certificates:\t%d\n", state.SecureBoot, state.SetupMode, state.PK, len(state.Db))
+
+			if accepted != nil && *accepted {
+				fmt.Printf("%s is accepted\n", viper.GetString("sb-cert"))
+			}
+		}
+
+		if reason != nil {
+			return types.WithCategory(types.ErrVerification, reason)
+		}
+
+		return nil
+	},
+}
+
+// secureBootKey loads a certificate and its key.
+func secureBootKey(certPath, keyPath string) (secureboot.Key, error) {
+	sb, err := pesign.NewSecureBootSignerWithPassphrase(certPath, keyPath, terminalPassphrase)
+	if err != nil {
+		return secureboot.Key{}, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	return secureboot.Key{Certificate: sb.Certificate(), Signer: sb.Signer()}, nil
+}
+
+func init() {
+	enrollFilesCmd.Flags().String("owner", "", "GUID identifying the owner of the certificates.")
+	enrollFilesCmd.Flags().String("pk-cert", "", "Platform key certificate.")
+	enrollFilesCmd.Flags().String("pk-key", "", "Platform key.")
+	enrollFilesCmd.Flags().String("kek-cert", "", "Key exchange key certificate.")
+	enrollFilesCmd.Flags().String("kek-key", "", "Key exchange key.")
+	enrollFilesCmd.Flags().StringSlice("db-cert", nil, "Certificate allowed to sign boot binaries, can be repeated.")
+	enrollFilesCmd.Flags().String("out-dir", ".", "Directory to write the files to.")
+
+	mokRequestCmd.Flags().StringSlice("cert", nil, "Certificate to enroll, can be given several times.")
+	mokRequestCmd.Flags().String("out-dir", "", "Directory to write the request to.")
+	mokRequestCmd.Flags().Bool("enroll", false, "Write the request to the MokNew and MokAuth variables of the running system.")
+	mokCheckCmd.Flags().String("mok-list", "", "Signature list file to check against instead of the MokListRT variable.")
+
+	statusCmd.Flags().String("sb-cert", "", "SecureBoot certificate to check the firmware accepts.")
+
+	secureBootCmd.AddCommand(enrollFilesCmd, mokRequestCmd, mokCheckCmd, statusCmd)
+	rootCmd.AddCommand(secureBootCmd)
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/buildd"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/signd"
+	"github.com/kairos-io/go-ukify/pkg/stub"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Build and sign UKIs requested over HTTP",
+	Long: `Serve the build endpoint, POST /v1/build: build and sign the UKI of each request with the
+stub and keys of the service, and return it.
+
+A request is a multipart form with the build options as JSON in its config part, i.e.
+{"name": "kairos", "version": "3.1", "cmdline": "console=ttyS0"}, and the kernel, initrd,
+os-release and splash parts uploaded. Inputs not uploaded may be referenced in the config by
+their path in --input-dir:
+
+  curl -F config='{"cmdline":"console=ttyS0"}' -F kernel=@vmlinuz -F initrd=@initrd \
+    -o uki.signed.efi http://factory:8080/v1/build
+
+With --client-ca, the clients must present a certificate signed by it. As anyone reaching the
+service could have it sign, serving with --sb-key or --pcr-key needs both --tls-cert and
+--client-ca, unless --insecure is given.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		maxUpload, err := utils.ParseSize(viper.GetString("max-upload-size"))
+		if err != nil {
+			return err
+		}
+
+		// checked before the keys are loaded, not to ask for their passphrases first
+		signing := viper.GetString("sb-key") != "" || viper.GetString("pcr-key") != ""
+		if signing && (viper.GetString("tls-cert") == "" || viper.GetString("client-ca") == "") {
+			if !viper.GetBool("insecure") {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("serving with signing keys needs --tls-cert and --client-ca, or --insecure"))
+			}
+
+			slog.Warn("Serving with signing keys to clients not authenticated")
+		}
+
+		server := &buildd.Server{
+			Defaults: uki.BuildConfig{
+				SdStubPath: viper.GetString("sd-stub-path"),
+				Dbx:        viper.GetString("dbx"),
+			},
+			InputDir:      viper.GetString("input-dir"),
+			Jobs:          viper.GetInt("jobs"),
+			MaxUploadSize: maxUpload,
+		}
+
+		if viper.GetString("webhook-url") != "" {
+			server.Webhook = &uki.Webhook{URL: viper.GetString("webhook-url"), Secret: viper.GetString("webhook-secret")}
+		}
+
+		// the keys are loaded once, the passphrases are asked for at start
+		if viper.GetString("sb-key") != "" || viper.GetString("sb-cert") != "" {
+			if err = requireFlags("sb-key", "sb-cert"); err != nil {
+				return err
+			}
+
+			sb, err := pesign.NewSecureBootSignerWithPassphrase(viper.GetString("sb-cert"), viper.GetString("sb-key"), terminalPassphrase)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			if server.SecureBootSigner, err = pesign.NewSigner(sb); err != nil {
+				return err
+			}
+		}
+
+		if viper.GetString("pcr-key") != "" {
+			if server.PCRSigner, err = pesign.NewPCRSignerWithPassphrase(viper.GetString("pcr-key"), terminalPassphrase); err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+		}
+
+		httpServer := &http.Server{
+			Addr:              viper.GetString("listen"),
+			Handler:           server,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		if viper.GetString("tls-cert") == "" {
+			if viper.GetString("client-ca") != "" {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("--client-ca needs --tls-cert and --tls-key"))
+			}
+
+			slog.Info("Serving build requests", "address", httpServer.Addr)
+
+			return httpServer.ListenAndServe()
+		}
+
+		if err = requireFlags("tls-cert", "tls-key"); err != nil {
+			return err
+		}
+
+		if viper.GetString("client-ca") != "" {
+			if httpServer.TLSConfig, err = signd.ServerTLSConfig(viper.GetString("tls-cert"), viper.GetString("tls-key"), viper.GetString("client-ca")); err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+		} else {
+			cert, err := tls.LoadX509KeyPair(viper.GetString("tls-cert"), viper.GetString("tls-key"))
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			httpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+
+		slog.Info("Serving build requests", "address", httpServer.Addr, "tls", true)
+
+		return httpServer.ListenAndServeTLS("", "")
+	},
+}
+
+func init() {
+	serveCmd.Flags().String("listen", ":8080", "Address to listen on.")
+	serveCmd.Flags().StringP("sd-stub-path", "s", stub.Auto, "Path or http(s) URL to the sd-stub, auto to use the one installed, or embedded.")
+	serveCmd.Flags().String("sb-cert", "", "SecureBoot certificate to sign the UKIs with.")
+	serveCmd.Flags().String("sb-key", "", "SecureBoot key to sign the UKIs with.")
+	serveCmd.Flags().StringP("pcr-key", "p", "", "PCR key.")
+	serveCmd.Flags().String("dbx", "", "EFI signature list to check the SecureBoot certificate and binaries against before signing.")
+	serveCmd.Flags().String("input-dir", "", "Directory the requests may reference inputs in, instead of uploading them.")
+	serveCmd.Flags().IntP("jobs", "j", 1, "Number of UKIs to build at once.")
+	serveCmd.Flags().String("max-upload-size", "1G", "Size limit of the uploads of a request.")
+	serveCmd.Flags().String("tls-cert", "", "TLS certificate of the service, served over plain HTTP without.")
+	serveCmd.Flags().String("tls-key", "", "TLS key of the service.")
+	serveCmd.Flags().String("client-ca", "", "Require client certificates signed by these CA certificates.")
+	serveCmd.Flags().Bool("insecure", false, "Serve with signing keys without --tls-cert and --client-ca, letting any client reaching the service sign.")
+	serveCmd.Flags().String("webhook-url", "", "URL the build events are posted to as JSON when each build finishes.")
+	serveCmd.Flags().String("webhook-secret", "", "Secret the build events are signed with, as an HMAC-SHA256 in the X-Ukify-Signature header.")
+
+	rootCmd.AddCommand(serveCmd)
+}
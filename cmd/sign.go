@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var signCmd = &cobra.Command{
+	Use:   "sign input [output]",
+	Short: "Sign, verify or unsign an EFI binary",
+	Long: `Sign any EFI binary (sd-boot, UKIs, shim-loaded apps...) with the SecureBoot key and certificate.
+
+With --verify the input is only checked against the certificate, with --unsign all signatures
+are removed from the input and the result is written to the output.
+
+With --verify and --db, the input is checked as firmware would against the db and dbx signature
+lists, in .esl or .auth form, or the ones of the running system with --db system.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		input := args[0]
+		output := input
+		if len(args) > 1 {
+			output = args[1]
+		}
+
+		switch {
+		case viper.GetBool("verify") && viper.GetString("db") != "":
+			policy, err := loadPolicy(viper.GetString("db"), viper.GetString("dbx"))
+			if err != nil {
+				return err
+			}
+			cert, err := policy.CheckImage(input)
+			allowedBy := ""
+			if cert != nil {
+				allowedBy = cert.Subject.String()
+			}
+			if jsonOutput() {
+				if jsonErr := printJSON(signOutput{File: input, Verified: err == nil, AllowedBy: allowedBy}); jsonErr != nil {
+					return jsonErr
+				}
+			}
+			if err != nil {
+				return types.WithCategory(types.ErrVerification, err)
+			}
+			if !jsonOutput() {
+				if cert != nil {
+					fmt.Printf("%s is allowed by %s\n", input, allowedBy)
+				} else {
+					fmt.Printf("%s is allowed by its digest\n", input)
+				}
+			}
+			return nil
+		case viper.GetBool("verify"):
+			if viper.GetString("sb-cert") == "" {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("--sb-cert is required to verify"))
+			}
+			cert, err := pesign.LoadCertificate(viper.GetString("sb-cert"))
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+			ok, err := pesign.VerifyFile(input, cert)
+			if jsonOutput() {
+				if jsonErr := printJSON(signOutput{File: input, Verified: ok}); jsonErr != nil {
+					return jsonErr
+				}
+			}
+			if err != nil {
+				return types.WithCategory(types.ErrVerification, err)
+			}
+			if !ok {
+				return types.WithCategory(types.ErrVerification, fmt.Errorf("%s is not signed with %s", input, viper.GetString("sb-cert")))
+			}
+			if !jsonOutput() {
+				fmt.Printf("%s is signed with %s\n", input, viper.GetString("sb-cert"))
+			}
+			return nil
+		case viper.GetBool("unsign"):
+			if err := pesign.Unsign(input, output); err != nil {
+				return err
+			}
+			if jsonOutput() {
+				return printJSON(signOutput{File: output})
+			}
+			return nil
+		default:
+			if viper.GetString("sb-cert") == "" || viper.GetString("sb-key") == "" {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("--sb-cert and --sb-key are required to sign"))
+			}
+			sb, err := pesign.NewSecureBootSignerWithPassphrase(viper.GetString("sb-cert"), viper.GetString("sb-key"), terminalPassphrase)
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+			signer, err := pesign.NewSigner(sb)
+			if err != nil {
+				return err
+			}
+			if err = signer.Sign(input, output); err != nil {
+				return types.WithCategory(types.ErrSigning, err)
+			}
+			if jsonOutput() {
+				return printJSON(signOutput{File: output, Signed: true, Verified: true})
+			}
+			return nil
+		}
+	},
+}
+
+// signOutput is the machine-readable output of the sign command.
+type signOutput struct {
+	File     string `json:"file"`
+	Signed   bool   `json:"signed"`
+	Verified bool   `json:"verified"`
+	// Subject of the db certificate allowing the file, with --db.
+	AllowedBy string `json:"allowedBy,omitempty"`
+}
+
+// loadPolicy reads the db and dbx signature lists, the ones of the running system when db is system.
+func loadPolicy(db, dbx string) (*secureboot.Policy, error) {
+	if db == uki.DbxSystem {
+		if dbx != "" {
+			return nil, types.WithCategory(types.ErrInvalidInput, errors.New("--dbx can't be given with --db system"))
+		}
+		return secureboot.SystemPolicy()
+	}
+
+	policy := &secureboot.Policy{}
+	var err error
+
+	if policy.Db, err = secureboot.LoadRevocations(db); err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, err)
+	}
+	if dbx != "" {
+		if policy.Dbx, err = secureboot.LoadRevocations(dbx); err != nil {
+			return nil, types.WithCategory(types.ErrInvalidInput, err)
+		}
+	}
+
+	return policy, nil
+}
+
+func init() {
+	signCmd.Flags().String("sb-cert", "", "SecureBoot certificate to sign or verify efi files with.")
+	signCmd.Flags().String("sb-key", "", "SecureBoot key to sign efi files with.")
+	signCmd.Flags().Bool("verify", false, "Only verify that the input is signed with the certificate.")
+	signCmd.Flags().Bool("unsign", false, "Remove all signatures from the input.")
+	signCmd.Flags().String("db", "", "With --verify, db signature list to check the input against as firmware would, or system.")
+	signCmd.Flags().String("dbx", "", "With --verify and --db, dbx signature list to check the input against.")
+	signCmd.MarkFlagsMutuallyExclusive("verify", "unsign")
+
+	rootCmd.AddCommand(signCmd)
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/install"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var slotCmd = &cobra.Command{
+	Use:   "slot",
+	Short: "Update a uki with an A/B slot layout",
+	Long: `Update a uki with an A/B slot layout.
+
+Each slot is installed as EFI/Linux/<entry-token>-<slot>.efi. update installs to the slot not booted and
+boots it once on the next boot. If it fails, systemd-boot goes back to the previous slot on the boot after.
+Once the new slot booted fine, confirm makes it the default, rollback goes back to the other slot instead.`,
+}
+
+func newSlotManager() *install.SlotManager {
+	return &install.SlotManager{
+		ESPPath:    viper.GetString("esp-path"),
+		EntryToken: viper.GetString("entry-token"),
+		DryRun:     viper.GetBool("dry-run"),
+	}
+}
+
+var slotStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the booted slot and the pending update",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		status, err := newSlotManager().Status()
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(status)
+		}
+
+		fmt.Printf("Booted: %s\nDefault: %s\nOne shot: %s\nPending: %t\n", status.Booted, status.Default, status.OneShot, status.Pending)
+
+		return nil
+	},
+}
+
+var slotUpdateCmd = &cobra.Command{
+	Use:   "update uki.efi",
+	Short: "Install a uki into the slot not booted and boot it once",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slot, path, err := newSlotManager().Update(args[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(struct {
+				Slot install.Slot `json:"slot"`
+				Path string       `json:"path"`
+			}{Slot: slot, Path: path})
+		}
+
+		fmt.Println(path)
+
+		return nil
+	},
+}
+
+var slotConfirmCmd = &cobra.Command{
+	Use:   "confirm",
+	Short: "Make the booted slot the default",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return printSlot(newSlotManager().Confirm())
+	},
+}
+
+var slotRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Make the slot not booted the default",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return printSlot(newSlotManager().Rollback())
+	},
+}
+
+// printSlot prints the slot made default.
+func printSlot(slot install.Slot, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		return printJSON(struct {
+			Default install.Slot `json:"default"`
+		}{Default: slot})
+	}
+
+	fmt.Println(slot)
+
+	return nil
+}
+
+func init() {
+	slotCmd.PersistentFlags().String("esp-path", "", "Mount point of the ESP, autodetected if not given.")
+	slotCmd.PersistentFlags().String("entry-token", install.EntryTokenAuto, "Entry token prefixing the slot entries: auto, machine-id, os-id, os-image-id or a literal token.")
+	slotCmd.PersistentFlags().Bool("dry-run", false, "Print the files and variables that would be written without writing them.")
+
+	slotCmd.AddCommand(slotStatusCmd, slotUpdateCmd, slotConfirmCmd, slotRollbackCmd)
+	rootCmd.AddCommand(slotCmd)
+}
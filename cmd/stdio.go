@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+)
+
+// stdioPath is the path given to read an input from stdin or write an output to stdout.
+const stdioPath = "-"
+
+// stdio lets the builder read its kernel or initrd from stdin and write the UKI to stdout.
+//
+// The builder works on files, so stdin is spooled to a temporary file and the UKI is built
+// into a temporary file that is then copied to stdout.
+type stdio struct {
+	dir    string
+	stdout bool
+}
+
+// usesStdio returns whether any of the builder inputs or outputs is stdin or stdout.
+func usesStdio(builder *uki.Builder) bool {
+	return builder.KernelPath == stdioPath || builder.InitrdPath == stdioPath || builder.OutUKIPath == stdioPath
+}
+
+// redirectStdio replaces the "-" paths of the builder with temporary files.
+func redirectStdio(builder *uki.Builder) (*stdio, error) {
+	if builder.KernelPath == stdioPath && builder.InitrdPath == stdioPath {
+		return nil, types.WithCategory(types.ErrInvalidInput, errors.New("only one of --kernel and --initrd can be read from stdin"))
+	}
+
+	if builder.OutUKIPath == stdioPath && jsonOutput() {
+		return nil, types.WithCategory(types.ErrInvalidInput, errors.New("--output json can not be used when writing the UKI to stdout"))
+	}
+
+	dir, err := os.MkdirTemp("", "ukify-stdio")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &stdio{dir: dir}
+
+	for _, path := range []*string{&builder.KernelPath, &builder.InitrdPath} {
+		if *path != stdioPath {
+			continue
+		}
+
+		if *path, err = s.spoolStdin(); err != nil {
+			s.cleanup()
+
+			return nil, err
+		}
+	}
+
+	if builder.OutUKIPath == stdioPath {
+		s.stdout = true
+		builder.OutUKIPath = filepath.Join(dir, "uki.signed.efi")
+	}
+
+	return s, nil
+}
+
+// spoolStdin copies stdin into a temporary file and returns its path.
+func (s *stdio) spoolStdin() (string, error) {
+	f, err := os.Create(filepath.Join(s.dir, "stdin"))
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	if _, err = io.Copy(f, os.Stdin); err != nil {
+		return "", err
+	}
+
+	return f.Name(), f.Close()
+}
+
+// flush writes the built UKI to stdout if requested.
+func (s *stdio) flush(result *uki.Result) error {
+	if !s.stdout {
+		return nil
+	}
+
+	for _, output := range result.Outputs {
+		if output.Kind != "uki" {
+			continue
+		}
+
+		f, err := os.Open(output.Path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close() //nolint:errcheck
+
+		_, err = io.Copy(os.Stdout, f)
+
+		return err
+	}
+
+	return errors.New("build produced no UKI")
+}
+
+// cleanup removes the temporary files.
+func (s *stdio) cleanup() {
+	_ = os.RemoveAll(s.dir)
+}
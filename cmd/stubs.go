@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/stub"
+	"github.com/spf13/cobra"
+)
+
+var stubsCmd = &cobra.Command{
+	Use:   "stubs",
+	Short: "List the sd-stub and sd-boot binaries installed on the host",
+	Long: fmt.Sprintf(`List the systemd-stub and systemd-boot binaries found in %s, with their architecture
+and version. They are used by create when --sd-stub-path or --sd-boot-path are auto.`, stub.Dir),
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		binaries, err := stub.List()
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(binaries)
+		}
+
+		for _, binary := range binaries {
+			fmt.Printf("%s\t%s\t%s %s\n", binary.Path, binary.Arch, binary.Name, binary.Version)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stubsCmd)
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/sysupdate"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var sysupdateCmd = &cobra.Command{
+	Use:   "sysupdate uki.efi",
+	Short: "Generate the systemd-sysupdate transfer for a published uki",
+	Long: `Generate a sysupdate.d(5) transfer definition pulling new versions of a uki from --url into EFI/Linux/
+on the ESP, and add the uki digest to the SHA256SUMS next to it, which sysupdate reads to list the versions.
+
+The uki is expected to be published under its current name, which has to contain its version, i.e.
+kairos_1.2.3.efi. The version is the IMAGE_VERSION or VERSION_ID of the os-release embedded in it. Installed
+ukis are named <entry-token>-<version>.efi like the install command does, so both can manage the same ESP.
+
+The transfer is written to <entry-token>.transfer next to the uki unless --output-transfer is given, and
+is meant to be installed in /etc/sysupdate.d/.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireFlags("url"); err != nil {
+			return err
+		}
+
+		transfer, err := sysupdate.NewTransfer(args[0], viper.GetString("url"), viper.GetString("entry-token"))
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		transfer.Tries = viper.GetInt("tries")
+		transfer.Instances = viper.GetInt("instances")
+
+		data, err := transfer.Marshal()
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		transferPath := viper.GetString("output-transfer")
+		if transferPath == "" {
+			transferPath = filepath.Join(filepath.Dir(args[0]), transfer.EntryToken+".transfer")
+		}
+
+		if err = utils.WriteFile(transferPath, data, 0o644); err != nil {
+			return err
+		}
+
+		checksumsPath, err := sysupdate.AddChecksum(args[0])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(struct {
+				Transfer  string `json:"transfer"`
+				Checksums string `json:"checksums"`
+			}{Transfer: transferPath, Checksums: checksumsPath})
+		}
+
+		fmt.Println(transferPath)
+		fmt.Println(checksumsPath)
+
+		return nil
+	},
+}
+
+func init() {
+	sysupdateCmd.Flags().String("url", "", "URL of the directory the ukis and SHA256SUMS are published in.")
+	sysupdateCmd.Flags().String("entry-token", "", "Entry token prefixing the installed ukis, defaults to the os-release IMAGE_ID or ID.")
+	sysupdateCmd.Flags().Int("tries", 0, "Number of boot counting tries given to new ukis, disabled when 0.")
+	sysupdateCmd.Flags().Int("instances", sysupdate.DefaultInstances, "Number of versions kept on the ESP.")
+	sysupdateCmd.Flags().String("output-transfer", "", "Path to write the transfer to, defaults to <entry-token>.transfer next to the uki.")
+
+	rootCmd.AddCommand(sysupdateCmd)
+}
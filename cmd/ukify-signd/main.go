@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// ukify-signd is the signing service of the builds: it holds the SecureBoot and PCR keys, and signs
+// the digests sent by the builds run with --signd-url, over mutual TLS.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/redact"
+	"github.com/kairos-io/go-ukify/pkg/signd"
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ukify-signd",
+		Short: "Sign the UKIs of remote builds, without handing them the keys",
+		Long: `Serve the signing endpoints of the builds run with --signd-url: the builds send the digests of
+the UKIs and PCR policies, the service signs them with its SecureBoot and PCR keys.
+
+Clients must present a certificate signed by --client-ca. Every signing request is written to the
+audit log, as JSON, with the subject of the client certificate and the digest signed.`,
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			flags := cmd.Flags()
+			get := func(name string) string {
+				value, _ := flags.GetString(name) //nolint:errcheck
+				return value
+			}
+
+			enforce, _ := flags.GetBool("fips") //nolint:errcheck
+			fips.Enforce(enforce)
+
+			server := &signd.Server{}
+
+			if get("sb-key") != "" || get("sb-cert") != "" {
+				if get("sb-key") == "" || get("sb-cert") == "" {
+					return errors.New("--sb-key and --sb-cert must be given together")
+				}
+
+				sb, err := pesign.NewSecureBootSigner(get("sb-cert"), get("sb-key"))
+				if err != nil {
+					return err
+				}
+				server.SecureBoot = sb
+			}
+
+			if get("pcr-key") != "" {
+				pcr, err := pesign.NewPCRSigner(get("pcr-key"))
+				if err != nil {
+					return err
+				}
+				server.PCR = pcr
+			}
+
+			if server.SecureBoot == nil && server.PCR == nil {
+				return errors.New("no key to serve, give --sb-key and --sb-cert, or --pcr-key")
+			}
+
+			var audit io.Writer = os.Stderr
+			if path := get("audit-log"); path != "" {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+				if err != nil {
+					return err
+				}
+
+				defer f.Close() //nolint:errcheck
+				audit = f
+			}
+			server.Audit = slog.New(redact.NewHandler(slog.NewJSONHandler(audit, nil)))
+
+			tlsConfig, err := signd.ServerTLSConfig(get("tls-cert"), get("tls-key"), get("client-ca"))
+			if err != nil {
+				return err
+			}
+
+			httpServer := &http.Server{
+				Addr:              get("listen"),
+				Handler:           server,
+				TLSConfig:         tlsConfig,
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+
+			slog.Info("Serving signing requests", "address", httpServer.Addr)
+
+			if err = httpServer.ListenAndServeTLS("", ""); err != nil {
+				return fmt.Errorf("signing service: %w", err)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().String("listen", ":8443", "Address to listen on.")
+	cmd.Flags().String("tls-cert", "", "TLS certificate of the service.")
+	cmd.Flags().String("tls-key", "", "TLS key of the service.")
+	cmd.Flags().String("client-ca", "", "CA certificates the client certificates must be signed by.")
+	cmd.Flags().String("sb-cert", "", "SecureBoot certificate to sign efi files with.")
+	cmd.Flags().String("sb-key", "", "SecureBoot key to sign efi files with, unencrypted.")
+	cmd.Flags().String("pcr-key", "", "PCR key to sign the PCR policies with, unencrypted.")
+	cmd.Flags().String("audit-log", "", "File the audit records are appended to, stderr by default.")
+	cmd.Flags().Bool("fips", false, "Refuse the signing requests using algorithms not approved for FIPS 140-3, i.e. RSA keys under 2048 bits.")
+	_ = cmd.MarkFlagRequired("tls-cert")
+	_ = cmd.MarkFlagRequired("tls-key")
+	_ = cmd.MarkFlagRequired("client-ca")
+
+	return cmd
+}
@@ -1,83 +1,558 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/cmdline"
 	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/cpio"
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+	"github.com/kairos-io/go-ukify/pkg/oci"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/rekor"
+	"github.com/kairos-io/go-ukify/pkg/signd"
+	"github.com/kairos-io/go-ukify/pkg/stub"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/kairos-io/go-ukify/pkg/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"log/slog"
-	"strings"
 )
 
 var createUkify = &cobra.Command{
 	Use:   "create",
 	Short: "Create a uki file",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var parsedPhases []types.PhaseInfo
+		if err := requireFlags("kernel"); err != nil {
+			return err
+		}
+
+		if !viper.GetBool("dracut") && viper.GetString("initrd-dir") == "" {
+			if err := requireFlags("initrd"); err != nil {
+				return err
+			}
+		}
 
-		phases := viper.GetString("phases")
+		parsedPhases := types.PhasesFromString(viper.GetString("phases"))
 		// Default to know systemd phases
-		if phases == "" {
+		if len(parsedPhases) == 0 {
 			parsedPhases = types.OrderedPhases()
-		} else {
-			// Parse phases from string in order
-			for _, phase := range strings.Split(phases, ":") {
-				parsedPhases = append(parsedPhases, types.PhaseInfo{Phase: constants.Phase(phase)})
+		}
+
+		builder := &uki.Builder{
+			Arch:             viper.GetString("arch"),
+			Version:          viper.GetString("version"),
+			SdStubPath:       viper.GetString("sd-stub-path"),
+			SdStubSHA256:     viper.GetString("sd-stub-sha256"),
+			SdBootPath:       viper.GetString("sd-boot-path"),
+			KernelPath:       viper.GetString("kernel"),
+			InitrdPath:       viper.GetString("initrd"),
+			Uname:            viper.GetString("uname"),
+			UnamePath:        viper.GetString("uname-path"),
+			KernelSignature:  viper.GetString("kernel-signature"),
+			KernelCAs:        viper.GetStringSlice("kernel-ca"),
+			KernelReport:     viper.GetBool("kernel-report"),
+			Cmdline:          viper.GetString("cmdline"),
+			Extensions:       viper.GetStringSlice("extension"),
+			OutSdBootPath:    viper.GetString("output-sdboot"),
+			OutUKIPath:       viper.GetString("output-uki"),
+			OutChecksumsPath: viper.GetString("output-checksums"),
+			OutBundlePath:    viper.GetString("output-bundle"),
+			OutSBOMPath:      viper.GetString("output-sbom"),
+			SBOMFormat:       viper.GetString("sbom-format"),
+			EmbedSBOM:        viper.GetBool("embed-sbom"),
+			PCRKey:           viper.GetString("pcr-key"),
+			SBKey:            viper.GetString("sb-key"),
+			SBCert:           viper.GetString("sb-cert"),
+			DbxPath:          viper.GetString("dbx"),
+			DbxWarnOnly:      viper.GetBool("dbx-warn-only"),
+			SBATPolicyPath:   viper.GetString("sbat-policy"),
+			SBATWarnOnly:     viper.GetBool("sbat-warn-only"),
+			Splash:           viper.GetString("splash"),
+			SplashFallback:   viper.GetBool("splash-fallback"),
+			SplashText:       viper.GetBool("splash-text"),
+			Firmware:         viper.GetString("efifw"),
+			Phases:           parsedPhases,
+			Passphrase:       terminalPassphrase,
+			Registry:         registryClient(),
+			Progress:         newProgress(),
+			BuildCacheDir:    viper.GetString("build-cache"),
+			InMemory:         viper.GetBool("in-memory"),
+			Profile:          viper.GetString("profile"),
+			Identity: uki.Identity{
+				Name:           viper.GetString("os-name"),
+				ID:             viper.GetString("os-id"),
+				URL:            viper.GetString("os-url"),
+				Vendor:         viper.GetString("sbat-vendor"),
+				SBATGeneration: viper.GetInt("sbat-generation"),
+			},
+
+			RecoveryCmdline:    viper.GetString("recovery-cmdline"),
+			RecoveryInitrdPath: viper.GetString("recovery-initrd"),
+			RecoverySplash:     viper.GetString("recovery-splash"),
+			OutRecoveryUKIPath: viper.GetString("output-recovery-uki"),
+		}
+
+		// the profile names the outputs unless given
+		if builder.Profile != "" {
+			for flag, path := range map[string]*string{"output-uki": &builder.OutUKIPath, "output-sdboot": &builder.OutSdBootPath} {
+				if !viper.IsSet(flag) {
+					*path = ""
+				}
 			}
 		}
 
-		if viper.GetBool("debug") {
-			slog.SetLogLoggerLevel(slog.LevelDebug)
+		if viper.GetString("signd-url") != "" {
+			if err := remoteSigners(builder); err != nil {
+				return err
+			}
 		}
 
-		builder := &uki.Builder{
-			Arch:          viper.GetString("arch"),
-			Version:       viper.GetString("version"),
-			SdStubPath:    viper.GetString("sd-stub-path"),
-			SdBootPath:    viper.GetString("sd-boot-path"),
-			KernelPath:    viper.GetString("kernel"),
-			InitrdPath:    viper.GetString("initrd"),
-			Cmdline:       viper.GetString("cmdline"),
-			OutSdBootPath: viper.GetString("output-sdboot"),
-			OutUKIPath:    viper.GetString("output-uki"),
-			PCRKey:        viper.GetString("pcr-key"),
-			SBKey:         viper.GetString("sb-key"),
-			SBCert:        viper.GetString("sb-cert"),
-			Splash:        viper.GetString("splash"),
-			Phases:        parsedPhases,
+		if viper.GetString("sign-tool") != "" {
+			if err := externalSigner(builder); err != nil {
+				return err
+			}
+		}
+
+		if viper.GetString("transparency-log") != "" {
+			builder.TransparencyLog = rekor.NewClient(viper.GetString("transparency-log"))
+		}
+
+		builder.TransparencyLogKey = viper.GetString("transparency-log-key")
+
+		if len(viper.GetStringSlice("approver-url")) > 0 {
+			approvals, err := approvers()
+			if err != nil {
+				return err
+			}
+			builder.Approvals = approvals
+		}
+
+		if viper.GetBool("dracut") {
+			builder.KernelVersion = viper.GetString("kernel-version")
+			builder.InitrdGenerator = &initrd.Dracut{
+				Modules:          viper.GetStringSlice("dracut-modules"),
+				OmitModules:      viper.GetStringSlice("dracut-omit-modules"),
+				Drivers:          viper.GetStringSlice("dracut-drivers"),
+				KernelModulesDir: viper.GetString("dracut-kmoddir"),
+				Args:             viper.GetStringSlice("dracut-args"),
+			}
+		}
+
+		if dir := viper.GetString("initrd-dir"); dir != "" {
+			compression := viper.GetString("initrd-compression")
+			if compression == "none" {
+				compression = cpio.CompressionNone
+			}
+
+			builder.InitrdGenerator = &initrd.Directory{
+				Dir: dir,
+				Options: cpio.Options{
+					Compression:  compression,
+					Reproducible: viper.GetBool("initrd-reproducible"),
+				},
+			}
+		}
+
+		if sections := viper.GetStringSlice("stub-sections"); len(sections) > 0 {
+			if builder.SdStubPath == stub.Auto || stub.IsURL(builder.SdStubPath) {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("--stub-sections needs the path to the custom stub in --sd-stub-path"))
+			}
+
+			custom := &stub.Custom{StubPath: builder.SdStubPath}
+			for _, section := range sections {
+				custom.Sections = append(custom.Sections, constants.Section(section))
+			}
+			builder.Stub = custom
+		}
+
+		maxMemory, err := utils.ParseSize(viper.GetString("max-memory"))
+		if err != nil {
+			return err
+		}
+		builder.MaxMemory = maxMemory
+
+		if builder.MaxInitrdSize, err = utils.ParseSize(viper.GetString("max-initrd-size")); err != nil {
+			return err
+		}
+		builder.AddonStubPath = viper.GetString("addon-stub-path")
+
+		if builder.SplashMaxSize, err = utils.ParseSize(viper.GetString("splash-max-size")); err != nil {
+			return err
+		}
+		builder.CheckHostSecureBoot = viper.GetBool("check-host-secureboot")
+		builder.RequireHardwareKeys = viper.GetBool("require-hardware-keys")
+
+		if builder.OutputMode, err = utils.ParseMode(viper.GetString("output-mode")); err != nil {
+			return err
+		}
+		builder.OutputOwner = viper.GetString("output-owner")
+
+		sbatEntries, err := readSBATFile(viper.GetString("sbat"))
+		if err != nil {
+			return err
+		}
+		builder.SBAT = sbatEntries
+
+		if builder.SBATGenerations, builder.SBATVendors, err = sbatOverrides(
+			viper.GetStringSlice("sbat-component-generation"), viper.GetStringSlice("sbat-component-vendor")); err != nil {
+			return err
+		}
+
+		if builder.CmdlineLint, err = cmdlineLint(viper.GetStringSlice("cmdline-lint")); err != nil {
+			return err
 		}
 
 		if viper.GetString("os-release") != "" {
 			builder.OsRelease = viper.GetString("os-release")
 		}
 
-		return builder.Build()
+		if usesStdio(builder) {
+			if viper.GetString("push") != "" {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("--push can not be used with stdin or stdout"))
+			}
+
+			if viper.GetBool("watch") {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("--watch can not be used with stdin or stdout"))
+			}
+
+			if builder.InMemory {
+				return types.WithCategory(types.ErrInvalidInput, errors.New("--in-memory can not be used with stdin or stdout, they are spooled to temporary files"))
+			}
+
+			s, err := redirectStdio(builder)
+			if err != nil {
+				return err
+			}
+
+			defer s.cleanup()
+
+			if viper.GetBool("dry-run") {
+				return printPlan(builder)
+			}
+
+			start := time.Now()
+
+			if err = builder.Build(); err != nil {
+				return err
+			}
+
+			logTimings(builder.Result(), time.Since(start))
+
+			return s.flush(builder.Result())
+		}
+
+		if viper.GetBool("dry-run") {
+			return printPlan(builder)
+		}
+
+		if err = preflightBuild(builder); err != nil {
+			return err
+		}
+
+		build := func() error {
+			start := time.Now()
+
+			if err := builder.Build(); err != nil {
+				return err
+			}
+
+			logTimings(builder.Result(), time.Since(start))
+
+			if ref := viper.GetString("push"); ref != "" {
+				if err := pushUKI(ref, builder.Result()); err != nil {
+					return err
+				}
+			}
+
+			if jsonOutput() {
+				return printJSON(builder.Result())
+			}
+
+			return nil
+		}
+
+		if viper.GetBool("watch") {
+			return watchAndBuild(builder, build)
+		}
+
+		return build()
 	},
 }
 
+// remoteSigners sets the signers of the builder to the keys of the signing service.
+func remoteSigners(builder *uki.Builder) error {
+	if err := requireFlags("signd-cert", "signd-key"); err != nil {
+		return err
+	}
+
+	tlsConfig, err := signd.ClientTLSConfig(viper.GetString("signd-cert"), viper.GetString("signd-key"), viper.GetString("signd-ca"))
+	if err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	client := signd.NewClient(viper.GetString("signd-url"), tlsConfig)
+
+	keys, err := client.Keys()
+	if err != nil {
+		return err
+	}
+
+	if keys.SecureBootCertificate != "" {
+		remote, err := client.SecureBootSigner()
+		if err != nil {
+			return err
+		}
+
+		if builder.SecureBootSigner, err = pesign.NewSigner(remote); err != nil {
+			return err
+		}
+	}
+
+	if keys.PCRPublicKey != "" {
+		if builder.PCRSigner, err = client.PCRSigner(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// approvers returns the threshold of the approvals of the --approver-url signing services, all of
+// them unless --approvals is given.
+func approvers() (*pesign.Threshold, error) {
+	if err := requireFlags("signd-cert", "signd-key"); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := signd.ClientTLSConfig(viper.GetString("signd-cert"), viper.GetString("signd-key"), viper.GetString("signd-ca"))
+	if err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	threshold := &pesign.Threshold{Required: viper.GetInt("approvals")}
+
+	for _, url := range viper.GetStringSlice("approver-url") {
+		approver, err := signd.NewClient(url, tlsConfig).SecureBootSigner()
+		if err != nil {
+			return nil, fmt.Errorf("approver %s: %w", url, err)
+		}
+
+		threshold.Approvers = append(threshold.Approvers, approver)
+	}
+
+	if threshold.Required == 0 {
+		threshold.Required = len(threshold.Approvers)
+	}
+
+	return threshold, nil
+}
+
+// externalSigner sets the SecureBoot signer of the builder to the external signing tool.
+func externalSigner(builder *uki.Builder) error {
+	if err := requireFlags("sb-cert"); err != nil {
+		return err
+	}
+
+	cert, err := pesign.LoadCertificate(viper.GetString("sb-cert"))
+	if err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	signer, err := pesign.NewExternalSigner(&pesign.ExternalTool{
+		Name:     viper.GetString("sign-tool"),
+		Path:     viper.GetString("sign-tool-path"),
+		Key:      viper.GetString("sb-key"),
+		Cert:     viper.GetString("sb-cert"),
+		CertDir:  viper.GetString("pesign-certdir"),
+		CertName: viper.GetString("pesign-cert-name"),
+		Args:     viper.GetStringSlice("sign-tool-args"),
+	}, cert)
+	if err != nil {
+		return err
+	}
+
+	signer.Logger = builder.Logger
+	builder.SecureBootSigner = signer
+
+	return nil
+}
+
+// cmdlineLint parses the rule=severity severities of the cmdline rules.
+func cmdlineLint(rules []string) (map[string]cmdline.Severity, error) {
+	var severities map[string]cmdline.Severity
+
+	for _, rule := range rules {
+		name, severity, ok := strings.Cut(rule, "=")
+		if !ok || name == "" {
+			return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid cmdline rule severity %q, expected rule=severity", rule))
+		}
+
+		if severities == nil {
+			severities = map[string]cmdline.Severity{}
+		}
+		severities[name] = cmdline.Severity(severity)
+	}
+
+	return severities, nil
+}
+
+// pushUKI pushes the UKI of the build result to the registry, with the build manifest and the PCR
+// predictions as referrers.
+func pushUKI(ref string, result *uki.Result) error {
+	pushed, err := result.Push(registryClient(), ref)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Pushed UKI", "reference", pushed.Reference, "digest", pushed.UKI.Digest, "referrers", len(pushed.Referrers))
+
+	return nil
+}
+
+// registryClient returns the client of the registries the inputs are pulled from and the UKI pushed to.
+func registryClient() *oci.Client {
+	return &oci.Client{
+		Username:  viper.GetString("registry-username"),
+		Password:  viper.GetString("registry-password"),
+		PlainHTTP: viper.GetBool("plain-http"),
+	}
+}
+
+// printPlan prints what the builder would produce.
+func printPlan(builder *uki.Builder) error {
+	plan, err := builder.Plan()
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		return printJSON(plan)
+	}
+
+	fmt.Println("Sections:")
+	for _, section := range plan.Sections {
+		fmt.Printf("  %s\tsize=%d\tsha256=%s\tmeasured=%t\tappended=%t\n", section.Name, section.Size, section.SHA256, section.Measured, section.Appended)
+	}
+
+	fmt.Println("Measurements:")
+	for _, m := range plan.Measurements {
+		if m.Variant != "" {
+			fmt.Printf("  %s:%s:%d:%s=%s\n", m.Variant, m.Phase, m.PCR, m.Algorithm, m.Digest)
+			continue
+		}
+		fmt.Printf("  %s:%d:%s=%s\n", m.Phase, m.PCR, m.Algorithm, m.Digest)
+	}
+
+	fmt.Println("Outputs:")
+	for _, output := range plan.Outputs {
+		fmt.Printf("  %s\t%s\tsigned=%t\n", output.Kind, output.Path, output.Signed)
+	}
+
+	return nil
+}
+
 func init() {
 	createUkify.Flags().StringP("arch", "a", "", "Arch of the UKI file.")
 	createUkify.Flags().String("version", "", "Version.")
-	createUkify.Flags().StringP("sd-stub-path", "s", "", "Path to the sd-stub.")
-	createUkify.Flags().StringP("sd-boot-path", "b", "", "Path to the sd-boot.")
-	createUkify.Flags().StringP("kernel", "k", "", "Path to the kernel image.")
-	createUkify.Flags().StringP("initrd", "i", "", "Path to the initrd image.")
+	createUkify.Flags().StringP("sd-stub-path", "s", stub.Auto, "Path or http(s) URL to the sd-stub, auto to use the one installed, or embedded, for --arch.")
+	createUkify.Flags().StringSlice("stub-sections", nil, "Use --sd-stub-path as a custom stub only handling these sections, i.e. .linux,.initrd,.cmdline.")
+	createUkify.Flags().String("sd-stub-sha256", "", "Expected SHA256 of the sd-stub, required when fetching it from an URL.")
+	createUkify.Flags().StringP("sd-boot-path", "b", "", "Path to the sd-boot, auto to use the one installed for --arch.")
+	createUkify.Flags().StringP("kernel", "k", "", "Path to the kernel image, - to read it from stdin, or oci://registry/repository:tag!/path to pull it out of an image.")
+	createUkify.Flags().String("kernel-signature", "", "Record the vendor signature of a signed kernel in the result, or require a valid one, record or require.")
+	createUkify.Flags().StringSlice("kernel-ca", nil, "CA certificates a required kernel signature must chain to, any valid signature is accepted if none.")
+	createUkify.Flags().Bool("kernel-report", false, "Record the format, banner and embedded configuration options of the kernel in the result, see kernel-info.")
+	createUkify.Flags().StringP("initrd", "i", "", "Path to the initrd image, - to read it from stdin, or oci://registry/repository:tag!/path to pull it out of an image.")
+	createUkify.Flags().Bool("dracut", false, "Generate the initrd with dracut instead of reading --initrd.")
+	createUkify.Flags().String("initrd-dir", "", "Archive this initramfs root directory as the initrd instead of reading --initrd.")
+	createUkify.Flags().String("initrd-compression", cpio.CompressionZstd, "Compression of the --initrd-dir archive, zstd, gzip or none.")
+	createUkify.Flags().Bool("initrd-reproducible", false, "Own the --initrd-dir entries by root and date them SOURCE_DATE_EPOCH, or the epoch, so the initrd only depends on the tree.")
+	createUkify.Flags().String("max-initrd-size", "", "Embed at most this much of the initrd, i.e. 512M, splitting the rest into addons in <output-uki>.extra.d/ built from --addon-stub-path.")
+	createUkify.Flags().String("addon-stub-path", "", "Path to the addon stub the initrd addons of --max-initrd-size are built from.")
+	createUkify.Flags().String("kernel-version", "", "Kernel version to generate the initrd for with --dracut, read from the kernel image if not given.")
+	createUkify.Flags().String("uname", "", "Kernel version of the .uname section, read from the kernel image if not given.")
+	createUkify.Flags().String("uname-path", "", "File holding the kernel version of the .uname section, i.e. include/config/kernel.release.")
+	createUkify.Flags().StringSlice("dracut-modules", nil, "Dracut modules to add to the generated initrd.")
+	createUkify.Flags().StringSlice("dracut-omit-modules", nil, "Dracut modules to leave out of the generated initrd.")
+	createUkify.Flags().StringSlice("dracut-drivers", nil, "Kernel drivers to add to the generated initrd.")
+	createUkify.Flags().String("dracut-kmoddir", "", "Directory of the kernel modules dracut reads, /lib/modules/<kernel-version> by default.")
+	createUkify.Flags().StringArray("dracut-args", nil, "Extra dracut argument, can be repeated.")
 	createUkify.Flags().StringP("cmdline", "c", "", "Kernel cmdline.")
-	createUkify.Flags().StringP("os-release", "o", "", "os-release file.")
+	createUkify.Flags().StringSlice("cmdline-lint", nil, "Severity of a cmdline rule as rule=severity, the severity one of error, warn or ignore, or all=severity for all rules, can be repeated. Options flagged by error rules fail the build. Rules: "+strings.Join(cmdline.RuleNames(), ", ")+".")
+	createUkify.Flags().StringSlice("extension", nil, "System (*.sysext.raw) or configuration (*.confext.raw) extension image to place in <output-uki>.extra.d/ and predict the measurements of, can be repeated.")
+	createUkify.Flags().StringP("os-release", "o", "", "os-release file, or oci://registry/repository:tag!/etc/os-release to pull it out of an image.")
 	createUkify.Flags().String("sb-cert", "", "SecureBoot certificate to sign efi files with.")
-	createUkify.Flags().String("sb-key", "", "SecureBoot certificate to sign efi files with.")
-	createUkify.Flags().StringP("pcr-key", "p", "", "PCR key.")
+	createUkify.Flags().String("sb-key", "", "SecureBoot key to sign efi files with, PEM encoded or a systemd-creds encrypted credential.")
+	createUkify.Flags().String("dbx", "", "EFI signature list to check the SecureBoot certificate and binaries against before signing, or system for the dbx of this machine.")
+	createUkify.Flags().Bool("dbx-warn-only", false, "Only warn, instead of failing, when the dbx would make firmware reject the output.")
+	createUkify.Flags().String("sbat-policy", "", "SBAT revocation policy in the SbatLevel format to check the stubs against before embedding them, latest for the latest revocations of shim, which only list shim and grub so never reject systemd-stub or systemd-boot, or system for the ones of this machine.")
+	createUkify.Flags().Bool("sbat-warn-only", false, "Only warn, instead of failing, when the SBAT policy revokes a stub.")
+	createUkify.Flags().Bool("check-host-secureboot", false, "Warn when the Secure Boot state of this host, the target, would not accept the SecureBoot certificate.")
+	createUkify.Flags().Bool("require-hardware-keys", false, "Refuse to sign with key files, only PKCS#11 keys of --sign-tool and the keys of --signd-url are accepted.")
+	createUkify.Flags().StringP("pcr-key", "p", "", "PCR key, PEM encoded or a systemd-creds encrypted credential.")
+	createUkify.Flags().String("sign-tool", "", "Sign the efi files with an external tool, sbsign, osslsigncode or pesign, instead of in process. --sb-key is passed to the tool as is.")
+	createUkify.Flags().String("sign-tool-path", "", "Path to the signing tool, looked up in PATH by default.")
+	createUkify.Flags().StringSlice("sign-tool-args", nil, "Extra arguments passed to the signing tool, i.e. its engine options.")
+	createUkify.Flags().String("pesign-certdir", "", "NSS database pesign reads the certificate and key from, its default one if empty.")
+	createUkify.Flags().String("pesign-cert-name", "", "Nickname of the certificate in the pesign NSS database.")
+	createUkify.Flags().String("signd-url", "", "URL of the ukify-signd signing service to sign with, instead of --sb-key and --pcr-key.")
+	createUkify.Flags().String("signd-cert", "", "Client certificate authenticating to the signing service.")
+	createUkify.Flags().String("signd-key", "", "Key of the client certificate of the signing service.")
+	createUkify.Flags().String("signd-ca", "", "CA certificates the signing service certificate is checked against, the system ones by default.")
+	createUkify.Flags().StringSlice("approver-url", nil, "URL of a ukify-signd service approving the signed files by signing their digest before they are signed, can be repeated.")
+	createUkify.Flags().Int("approvals", 0, "Approvals of the --approver-url services the signed files need, all of them by default.")
+	createUkify.Flags().String("transparency-log", "", "Submit the SecureBoot signatures to this Rekor transparency log, i.e. "+rekor.DefaultURL+", recording the inclusion proofs in the result.")
+	createUkify.Flags().String("transparency-log-key", "", "PEM public key of the --transparency-log, i.e. the one served at /api/v1/log/publicKey, its signed checkpoints authenticating the inclusion proofs. Without it the proofs are only checked to be consistent with the entries, which does not authenticate them.")
 	createUkify.Flags().StringP("output-sdboot", "", "sdboot.signed.efi", "sdboot output.")
-	createUkify.Flags().StringP("output-uki", "", "uki.signed.efi", "uki artifact output.")
+	createUkify.Flags().StringP("output-uki", "", "uki.signed.efi", "uki artifact output, - to write it to stdout.")
 	createUkify.Flags().StringP("phases", "", "enter-initrd:leave-initrd:sysinit:ready", "phases to measure for, separated by : and in order of measurement")
-	createUkify.Flags().String("splash", "", "Path to the custom logo splash BMP file.")
-	createUkify.Flags().Bool("debug", false, "Enable debug output")
-
-	_ = createUkify.MarkFlagRequired("sd-stub-path")
-	_ = createUkify.MarkFlagRequired("initrd")
-	_ = createUkify.MarkFlagRequired("kernel")
-	_ = viper.BindPFlags(createUkify.Flags())
+	createUkify.Flags().String("splash", "", "Path to the custom logo splash BMP file, PNG and JPEG files are converted to BMP.")
+	createUkify.Flags().String("efifw", "", "Firmware image to embed as the .efifw section, for systemd-stub 258 or later.")
+	createUkify.Flags().Bool("splash-text", false, "Render the splash with the --os-name, --version and build date instead of reading --splash.")
+	createUkify.Flags().String("splash-max-size", "", "Warn when the BMP splash is larger than this, i.e. 512K.")
+	createUkify.Flags().Bool("splash-fallback", false, "Use the bundled logo with a warning when the --splash file is missing or invalid, instead of failing.")
+	createUkify.Flags().String("output-checksums", "", "Write a SHA256SUMS file covering the outputs, signed to <file>.p7s with the SecureBoot key.")
+	createUkify.Flags().String("output-sbom", "", "Write an SBOM listing the stub, kernel, initrd, splash, sd-boot, SecureBoot certificate and outputs with their digests.")
+	createUkify.Flags().String("sbom-format", uki.SBOMCycloneDX, "Format of the SBOM, cyclonedx or spdx.")
+	createUkify.Flags().Bool("embed-sbom", false, "Embed an SBOM of the inputs into the UKI as a .sbom section.")
+	createUkify.Flags().String("output-mode", "", "Octal mode of the output files, i.e. 0640, defaults to 0644 and 0755 for the unsigned UKI.")
+	createUkify.Flags().String("output-owner", "", "Owner of the output files as user[:group], each a name or an id.")
+	createUkify.Flags().String("output-bundle", "", "Collect the outputs, PCR public key and signature, measurements and manifest into a directory, or a tarball if it ends in .tar, .tar.gz or .tgz.")
+	createUkify.Flags().String("recovery-cmdline", "", "Kernel cmdline of the recovery UKI.")
+	createUkify.Flags().String("recovery-initrd", "", "Path to the initrd of the recovery UKI, defaults to --initrd.")
+	createUkify.Flags().String("recovery-splash", "", "Path to the splash image of the recovery UKI, defaults to --splash.")
+	createUkify.Flags().String("output-recovery-uki", "", "Also build a recovery UKI with --recovery-cmdline and --recovery-initrd to this path.")
+	createUkify.Flags().String("sbat", "", "File with extra SBAT entries to merge into the sd-stub SBAT.")
+	createUkify.Flags().String("profile", "", "Conventions of the UKI, one of: "+strings.Join(uki.Profiles(), ", ")+", kairos by default.")
+	createUkify.Flags().String("os-name", "", "Product name of the generated os-release, Kairos by default.")
+	createUkify.Flags().String("os-id", "", "ID of the generated os-release and SBAT entry, the lower case --os-name by default.")
+	createUkify.Flags().String("os-url", "", "Vendor URL of the generated os-release and SBAT entry.")
+	createUkify.Flags().String("sbat-vendor", "", "Vendor of the SBAT entry of the UKI, --os-name by default.")
+	createUkify.Flags().Int("sbat-generation", 0, "Add an SBAT entry for the UKI with this generation, bumped to revoke older UKIs.")
+	createUkify.Flags().StringSlice("sbat-component-generation", nil, "Override the generation of an SBAT component, as component=generation, can be repeated.")
+	createUkify.Flags().StringSlice("sbat-component-vendor", nil, "Override the vendor of an SBAT component, as component=vendor, can be repeated.")
+	createUkify.Flags().String("preflight-esp", "", "Check before building that the UKI fits on the ESP mounted there, next to the versions kept.")
+	createUkify.Flags().String("preflight-budget", "", "Check before building that the UKI fits in an ESP of this size, i.e. 512M, next to the versions kept.")
+	createUkify.Flags().Int("preflight-keep", 0, "Number of versions kept on the ESP by pruning, the new one included, for the preflight checks.")
+	createUkify.Flags().String("push", "", "Push the UKI to this registry/repository[:tag] as an OCI artifact, with the build manifest and PCR predictions as referrers.")
+	createUkify.Flags().String("registry-username", "", "Username of the registries of --push and of the oci:// inputs, the docker config credentials and credential helpers are used by default.")
+	createUkify.Flags().String("registry-password", "", "Password of the registries of --push and of the oci:// inputs.")
+	createUkify.Flags().Bool("plain-http", false, "Talk to the registries over plain HTTP, for local registries.")
+	createUkify.Flags().Bool("in-memory", false, "Keep the generated sections in memory instead of a temporary directory, for read-only file systems.")
+	createUkify.Flags().String("max-memory", "", "Memory budget of the build, i.e. 256M, streaming every input through buffers sized after it.")
+	createUkify.Flags().String("build-cache", "", "Directory caching the digests of the inputs, so rebuilds only hash the changed ones.")
+	createUkify.Flags().Bool("dry-run", false, "Print the planned sections, measurements and outputs without writing any file.")
+	createUkify.Flags().Bool("watch", false, "Rebuild the UKI every time one of the input files changes.")
+	createUkify.MarkFlagsMutuallyExclusive("dry-run", "watch")
+	createUkify.MarkFlagsMutuallyExclusive("dracut", "initrd", "initrd-dir")
+	createUkify.MarkFlagsMutuallyExclusive("signd-url", "sb-key")
+	createUkify.MarkFlagsMutuallyExclusive("signd-url", "pcr-key")
+	createUkify.MarkFlagsMutuallyExclusive("signd-url", "sign-tool")
 
 	rootCmd.AddCommand(createUkify)
 
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var buildUpgradeCmd = &cobra.Command{
+	Use:   "build-upgrade rootfs",
+	Short: "Build the UKIs of the boot entries out of an upgrade rootfs",
+	Long: `Build the UKIs of the boot entries, active, passive and recovery by default, out of the
+extracted rootfs of an upgrade artifact, i.e. an OCI image.
+
+The kernel and initrd are found in the /boot or /lib/modules of the rootfs, the os-release and
+cmdline are its /etc/os-release and /etc/kernel/cmdline, unless given in --config. The UKIs are
+written to --out-dir as <entry>.efi.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config := &uki.UpgradeConfig{}
+
+		if path := viper.GetString("config"); path != "" {
+			var err error
+			if config, err = uki.LoadUpgradeConfig(path); err != nil {
+				return err
+			}
+		}
+
+		for flag, field := range map[string]*string{
+			"out-dir":      &config.OutDir,
+			"cmdline":      &config.Cmdline,
+			"sd-stub-path": &config.SdStubPath,
+			"sb-key":       &config.SBKey,
+			"sb-cert":      &config.SBCert,
+			"pcr-key":      &config.PCRKey,
+		} {
+			if cmd.Flags().Changed(flag) {
+				*field = viper.GetString(flag)
+			}
+		}
+
+		if cmd.Flags().Changed("jobs") {
+			config.Jobs = viper.GetInt("jobs")
+		}
+
+		config.Passphrase = terminalPassphrase
+
+		results, buildErr := uki.BuildForUpgrade(args[0], *config)
+
+		if jsonOutput() {
+			if err := printJSON(results); err != nil {
+				return err
+			}
+		} else {
+			for _, result := range results {
+				status := "ok"
+				if result.Error != "" {
+					status = "failed: " + result.Error
+				}
+				fmt.Printf("%s\t%s\t%s\n", result.Name, result.Duration.Round(1e6), status)
+			}
+		}
+
+		return buildErr
+	},
+}
+
+func init() {
+	buildUpgradeCmd.Flags().String("config", "", "Upgrade config with the build options and the entries to build.")
+	buildUpgradeCmd.Flags().String("out-dir", "", "Directory to write the UKIs to, the rootfs by default.")
+	buildUpgradeCmd.Flags().StringP("cmdline", "c", "", "Kernel cmdline shared by the entries, the /etc/kernel/cmdline of the rootfs by default.")
+	buildUpgradeCmd.Flags().StringP("sd-stub-path", "s", "", "Path to the sd-stub, auto to use the one installed.")
+	buildUpgradeCmd.Flags().String("sb-cert", "", "SecureBoot certificate to sign the UKIs with.")
+	buildUpgradeCmd.Flags().String("sb-key", "", "SecureBoot key to sign the UKIs with.")
+	buildUpgradeCmd.Flags().StringP("pcr-key", "p", "", "PCR key.")
+	buildUpgradeCmd.Flags().IntP("jobs", "j", 1, "Number of UKIs to build in parallel.")
+
+	rootCmd.AddCommand(buildUpgradeCmd)
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/kairos-io/go-ukify/internal/common"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var versionCmd = &cobra.Command{
@@ -12,6 +11,9 @@ var versionCmd = &cobra.Command{
 	Short: "Show version",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		long, _ := cmd.Flags().GetBool("long")
+		if jsonOutput() {
+			return printJSON(common.Get())
+		}
 		if long {
 			fmt.Printf("%+v\n", common.Get())
 		} else {
@@ -23,6 +25,5 @@ var versionCmd = &cobra.Command{
 
 func init() {
 	versionCmd.Flags().BoolP("long", "l", false, "long version format")
-	_ = viper.BindPFlags(versionCmd.Flags())
 	rootCmd.AddCommand(versionCmd)
 }
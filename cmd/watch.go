@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/oci"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+)
+
+// watchDebounce is how long to wait for more changes before rebuilding, as editors and
+// build tools usually write files in several steps.
+const watchDebounce = 500 * time.Millisecond
+
+// watchInputs returns the input files of the builder that trigger a rebuild when changed, the
+// inputs pulled out of images are not watched.
+func watchInputs(builder *uki.Builder) []string {
+	var inputs []string
+
+	for _, path := range []string{
+		builder.SdStubPath, builder.SdBootPath, builder.KernelPath, builder.InitrdPath, builder.OsRelease, builder.Splash,
+	} {
+		if path != "" && !oci.IsImagePath(path) {
+			inputs = append(inputs, filepath.Clean(path))
+		}
+	}
+
+	return inputs
+}
+
+// watchAndBuild builds the UKI and rebuilds it every time one of its inputs changes.
+//
+// The hashes of unchanged sections are cached between builds. Build errors are
+// logged and watching continues, only watcher errors are returned.
+func watchAndBuild(builder *uki.Builder, build func() error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	defer watcher.Close() //nolint:errcheck
+
+	if err = builder.DiscoverStubs(); err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	inputs := map[string]bool{}
+
+	// watch the parent directories, so files replaced by a rename are still noticed
+	for _, path := range watchInputs(builder) {
+		inputs[path] = true
+
+		if err = watcher.Add(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+
+	pcr.SetHashCache(pcr.NewHashCache())
+	defer pcr.SetHashCache(nil)
+
+	// loaded once, so passphrases are not asked for again on every rebuild
+	builder.KeepKeys = true
+
+	rebuild := func() {
+		if err := build(); err != nil {
+			slog.Error("Build failed", "error", err)
+			return
+		}
+
+		slog.Info("Watching for changes")
+	}
+
+	rebuild()
+
+	var debounce <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if !inputs[filepath.Clean(event.Name)] || !event.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+
+			slog.Debug("Input changed", "path", event.Name, "op", event.Op.String())
+			debounce = time.After(watchDebounce)
+		case <-debounce:
+			debounce = nil
+
+			slog.Info("Inputs changed, rebuilding")
+			rebuild()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			return err
+		}
+	}
+}
@@ -10,11 +10,11 @@ import (
 func main() {
 	// Allow catching SIGINT to exit soon
 	go func() {
-		sigchan := make(chan os.Signal)
+		sigchan := make(chan os.Signal, 1)
 		signal.Notify(sigchan, os.Interrupt)
 		<-sigchan
 		log.Println("Program killed !")
-		os.Exit(1)
+		os.Exit(cmd.ExitInterrupted)
 	}()
 
 	cmd.Execute()
@@ -0,0 +1,339 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package buildd implements a build service: it builds and signs the UKIs requested over HTTP,
+// with the stub and keys of the service, so a fleet gets its UKIs from a single factory.
+//
+// A build request is a multipart form of the build options, as JSON in the config part, and of the
+// uploaded inputs. Inputs may also be referenced by path in the input directory of the service.
+// The response is the signed UKI.
+package buildd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+)
+
+// BuildPath is the path of the build endpoint.
+const BuildPath = "/v1/build"
+
+// Names of the parts of a build request.
+const (
+	PartConfig    = "config"
+	PartKernel    = "kernel"
+	PartInitrd    = "initrd"
+	PartOsRelease = "os-release"
+	PartSplash    = "splash"
+)
+
+// DefaultMaxUploadSize is the size limit of build requests, when Server.MaxUploadSize is unset.
+const DefaultMaxUploadSize = 1 << 30
+
+// BuildRequest is the config part of a build request: the options a client may set. The stub, keys and
+// outputs are the ones of the service.
+type BuildRequest struct {
+	Name    string `json:"name,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+	Version string `json:"version,omitempty"`
+	Cmdline string `json:"cmdline,omitempty"`
+	Phases  string `json:"phases,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	// Inputs in the input directory of the service, by path relative to it, for the inputs not uploaded.
+	Kernel    string `json:"kernel,omitempty"`
+	Initrd    string `json:"initrd,omitempty"`
+	OsRelease string `json:"os-release,omitempty"`
+	Splash    string `json:"splash,omitempty"`
+	// Identity options.
+	OSName         string `json:"os-name,omitempty"`
+	OSID           string `json:"os-id,omitempty"`
+	OSURL          string `json:"os-url,omitempty"`
+	SBATVendor     string `json:"sbat-vendor,omitempty"`
+	SBATGeneration int    `json:"sbat-generation,omitempty"`
+}
+
+// Server builds the UKIs of the requests.
+type Server struct {
+	// Options of every build, i.e. the stub and the keys, the requests do not set them. Its outputs are unused.
+	Defaults uki.BuildConfig
+	// Directory the inputs of the requests may be referenced in, references are refused when empty.
+	InputDir string
+	// Number of builds run at once, defaults to 1.
+	Jobs int
+	// Size limit of the requests, DefaultMaxUploadSize when 0.
+	MaxUploadSize int64
+	// Signers of every build, loaded once instead of reading the keys of Defaults for each build.
+	SecureBootSigner *pesign.Signer
+	PCRSigner        types.RSAKey
+	// Called to obtain the passphrase of the encrypted keys of Defaults
+	Passphrase pesign.PassphraseFunc
+	// Logger of the builds, slog.Default() when nil.
+	Logger *slog.Logger
+	// Webhook the events of the builds are posted to, none when nil. Failing to post one does not
+	// fail the build.
+	Webhook *uki.Webhook
+
+	once sync.Once
+	jobs *semaphore.Weighted
+}
+
+// errorResponse is the response of failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP implements http.Handler.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != BuildPath || r.Method != http.MethodPost {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+
+		return
+	}
+
+	server.once.Do(func() {
+		server.jobs = semaphore.NewWeighted(int64(max(server.Jobs, 1)))
+	})
+
+	if err := server.jobs.Acquire(r.Context(), 1); err != nil {
+		// the client went away
+		return
+	}
+
+	defer server.jobs.Release(1)
+
+	dir, err := os.MkdirTemp("", "ukify-buildd")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	out, err := server.build(r, dir)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, types.ErrInvalidInput) {
+			status = http.StatusBadRequest
+		}
+
+		server.log().Warn("Build failed", "remote", r.RemoteAddr, "error", err)
+		writeError(w, status, err)
+
+		return
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	st, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(st.Size(), 10))
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(out)+`"`)
+	_, _ = io.Copy(w, f) //nolint:errcheck
+}
+
+// build builds the UKI of the request in dir, and returns its path.
+func (server *Server) build(r *http.Request, dir string) (string, error) {
+	limit := server.MaxUploadSize
+	if limit == 0 {
+		limit = DefaultMaxUploadSize
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	var request BuildRequest
+
+	uploads := map[string]string{}
+	remaining := limit
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return "", types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		switch name := part.FormName(); name {
+		case PartConfig:
+			if err = json.NewDecoder(io.LimitReader(part, 1<<20)).Decode(&request); err != nil {
+				return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid build config: %w", err))
+			}
+		case PartKernel, PartInitrd, PartOsRelease, PartSplash:
+			path := filepath.Join(dir, name)
+
+			n, err := saveUpload(part, path, remaining)
+			if err != nil {
+				return "", err
+			}
+
+			remaining -= n
+			uploads[name] = path
+		default:
+			return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("unknown part %q", name))
+		}
+	}
+
+	config, err := server.config(request, uploads)
+	if err != nil {
+		return "", err
+	}
+
+	config.OutUKIPath = filepath.Join(dir, "uki.signed.efi")
+
+	builder := config.Builder()
+	builder.Passphrase = server.Passphrase
+	builder.SecureBootSigner = server.SecureBootSigner
+	builder.PCRSigner = server.PCRSigner
+	builder.Logger = server.log()
+
+	server.log().Info("Building UKI", "remote", r.RemoteAddr, "name", request.Name, "version", request.Version)
+
+	err = builder.Build()
+
+	if server.Webhook != nil {
+		if err := server.Webhook.Notify(uki.NewBuildEvent(request.Name, builder, err)); err != nil {
+			server.log().Warn("Failed posting the build event", "name", request.Name, "error", err)
+		}
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return config.OutUKIPath, nil
+}
+
+// config returns the config of the build of the request, the inputs are the uploads or the references.
+func (server *Server) config(request BuildRequest, uploads map[string]string) (uki.BuildConfig, error) {
+	config := uki.BuildConfig{
+		Name:           request.Name,
+		Arch:           request.Arch,
+		Version:        request.Version,
+		Cmdline:        request.Cmdline,
+		Phases:         request.Phases,
+		Profile:        request.Profile,
+		OSName:         request.OSName,
+		OSID:           request.OSID,
+		OSURL:          request.OSURL,
+		SBATVendor:     request.SBATVendor,
+		SBATGeneration: request.SBATGeneration,
+	}
+
+	for _, input := range []struct {
+		part string
+		ref  string
+		dst  *string
+	}{
+		{PartKernel, request.Kernel, &config.KernelPath},
+		{PartInitrd, request.Initrd, &config.InitrdPath},
+		{PartOsRelease, request.OsRelease, &config.OsRelease},
+		{PartSplash, request.Splash, &config.Splash},
+	} {
+		path, err := server.input(input.part, uploads[input.part], input.ref)
+		if err != nil {
+			return config, err
+		}
+
+		*input.dst = path
+	}
+
+	if config.KernelPath == "" || config.InitrdPath == "" {
+		return config, types.WithCategory(types.ErrInvalidInput, errors.New("the kernel and the initrd must be uploaded or referenced"))
+	}
+
+	defaults := server.Defaults
+	// the service only returns the UKI
+	defaults.SdBootPath, defaults.OutSdBootPath, defaults.OutUKIPath = "", "", ""
+	defaults.OutChecksums, defaults.OutBundle, defaults.OutRecoveryUKI, defaults.OutSBOM = "", "", "", ""
+
+	return config.Merge(defaults), nil
+}
+
+// input returns the path of an input, uploaded or referenced.
+func (server *Server) input(part, upload, ref string) (string, error) {
+	switch {
+	case upload != "" && ref != "":
+		return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s is both uploaded and referenced", part))
+	case upload != "":
+		return upload, nil
+	case ref == "":
+		return "", nil
+	case server.InputDir == "":
+		return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s must be uploaded, the service has no input directory", part))
+	case !filepath.IsLocal(ref):
+		return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s reference %q is not within the input directory", part, ref))
+	}
+
+	return filepath.Join(server.InputDir, ref), nil
+}
+
+// log returns the logger of the builds.
+func (server *Server) log() *slog.Logger {
+	if server.Logger == nil {
+		return slog.Default()
+	}
+
+	return server.Logger
+}
+
+// saveUpload writes the part to path, refusing parts over limit bytes. It returns the size written.
+func saveUpload(part *multipart.Part, path string, limit int64) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	n, err := io.Copy(f, io.LimitReader(part, limit+1))
+	if err != nil {
+		return n, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("failed to read %s: %w", part.FormName(), err))
+	}
+
+	if n > limit {
+		return n, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("the build request is over the %d bytes limit", limit))
+	}
+
+	return n, f.Close()
+}
+
+// writeError writes the JSON error response.
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: err.Error()}) //nolint:errcheck
+}
@@ -0,0 +1,111 @@
+package buildd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Buildd test Suite")
+}
+
+// post sends a build request of the config and parts, and returns the response.
+func post(url string, config BuildRequest, parts map[string][]byte) *http.Response {
+	var body bytes.Buffer
+
+	form := multipart.NewWriter(&body)
+
+	w, err := form.CreateFormField(PartConfig)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(json.NewEncoder(w).Encode(config)).To(Succeed())
+
+	for name, data := range parts {
+		w, err := form.CreateFormFile(name, name)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = w.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	Expect(form.Close()).To(Succeed())
+
+	resp, err := http.Post(url+BuildPath, form.FormDataContentType(), &body)
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(resp.Body.Close)
+
+	return resp
+}
+
+var _ = Describe("Build service", func() {
+	var dir string
+	var service *httptest.Server
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("shared initrd"), 0o600)).To(Succeed())
+
+		sb, err := pesign.NewSecureBootSigner("../pesign/testdata/sb.pem", "../pesign/testdata/sb.key")
+		Expect(err).ToNot(HaveOccurred())
+		signer, err := pesign.NewSigner(sb)
+		Expect(err).ToNot(HaveOccurred())
+
+		service = httptest.NewServer(&Server{
+			Defaults:         uki.BuildConfig{SdStubPath: "../pesign/testdata/file.efi"},
+			InputDir:         dir,
+			SecureBootSigner: signer,
+		})
+		DeferCleanup(service.Close)
+	})
+
+	It("Builds and signs the UKI of the uploads and references", func() {
+		resp := post(service.URL, BuildRequest{Cmdline: "console=ttyS0", Initrd: "initrd"}, map[string][]byte{PartKernel: []byte("kernel")})
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		data, err := io.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+
+		out := filepath.Join(GinkgoT().TempDir(), "uki.efi")
+		Expect(os.WriteFile(out, data, 0o600)).To(Succeed())
+
+		cert, err := pesign.LoadCertificate("../pesign/testdata/sb.pem")
+		Expect(err).ToNot(HaveOccurred())
+		ok, err := pesign.VerifyFile(out, cert)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		cmdline, err := uki.GetSection(out, constants.CMDLine)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(cmdline)).To(Equal("console=ttyS0"))
+
+		initrd, err := uki.GetSection(out, constants.Initrd)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(initrd)).To(Equal("shared initrd"))
+	})
+
+	It("Refuses references out of the input directory", func() {
+		resp := post(service.URL, BuildRequest{Initrd: "../initrd"}, map[string][]byte{PartKernel: []byte("kernel")})
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		data, err := io.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("not within the input directory"))
+	})
+
+	It("Refuses requests without kernel", func() {
+		resp := post(service.URL, BuildRequest{Initrd: "initrd"}, nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -0,0 +1,356 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package cmdline parses kernel cmdlines and flags the options defeating a signed and measured UKI,
+// i.e. the ones giving a shell before the system is up, debug options and disabled security modules.
+package cmdline
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Severity of a rule: the findings of SeverityError rules fail the builds, the ones of SeverityWarn
+// rules raise a warning, SeverityIgnore rules are not checked.
+type Severity string
+
+// Severities, see Severity.
+const (
+	SeverityIgnore Severity = "ignore"
+	SeverityWarn   Severity = "warn"
+	SeverityError  Severity = "error"
+)
+
+// AllRules is the name of the rules in the severities given to Lint, setting the severity of all of
+// them. The ones given by name take precedence.
+const AllRules = "all"
+
+// Rule names, see Rules.
+const (
+	RuleDebugShell     = "debug-shell"
+	RuleInitShell      = "init-shell"
+	RuleBreak          = "rd-break"
+	RuleRescue         = "rescue"
+	RuleKernelDebugger = "kernel-debugger"
+	RuleInsecure       = "insecure"
+	RuleDebug          = "debug"
+	RuleMissingRoot    = "missing-root"
+)
+
+// Param is a kernel parameter, key=value or a bare key.
+type Param struct {
+	Key   string
+	Value string
+	// Whether the parameter has a value, possibly empty.
+	HasValue bool
+}
+
+// String returns the parameter as given on the cmdline, the value quoted if it has spaces.
+func (p Param) String() string {
+	if !p.HasValue {
+		return p.Key
+	}
+
+	if strings.ContainsAny(p.Value, " \t") {
+		return p.Key + `="` + p.Value + `"`
+	}
+
+	return p.Key + "=" + p.Value
+}
+
+// Parse splits the cmdline into its parameters, the way the kernel does: double quotes group words.
+func Parse(cmdline string) []Param {
+	var (
+		params []Param
+		word   strings.Builder
+		quoted bool
+		inWord bool
+	)
+
+	flush := func() {
+		if !inWord {
+			return
+		}
+
+		key, value, ok := strings.Cut(word.String(), "=")
+		params = append(params, Param{Key: key, Value: value, HasValue: ok})
+		word.Reset()
+
+		inWord = false
+	}
+
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			flush()
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	flush()
+
+	return params
+}
+
+// Rule flags parameters of the cmdline.
+type Rule struct {
+	// Name of the rule, used to set its severity.
+	Name string
+	// Description of what is wrong with the parameters flagged.
+	Description string
+	// Severity of the rule unless set.
+	Severity Severity
+	// match returns the parameters flagged, or a description of what is missing.
+	match func(params []Param) []string
+}
+
+// Rules are the rules checked by Lint.
+var Rules = []Rule{
+	{
+		Name:        RuleDebugShell,
+		Description: "gives a root shell on a console without authentication",
+		Severity:    SeverityError,
+		match: matchAll(
+			enabled("systemd.debug_shell"), enabled("rd.systemd.debug_shell"),
+			enabled("systemd.confirm_spawn"), enabled("rd.shell"),
+		),
+	},
+	{
+		Name:        RuleInitShell,
+		Description: "runs a shell instead of init",
+		Severity:    SeverityError,
+		match:       matchAll(shell("init"), shell("rdinit")),
+	},
+	{
+		Name:        RuleBreak,
+		Description: "drops to a shell in the initrd",
+		Severity:    SeverityError,
+		match:       matchAll(present("rd.break"), present("rdbreak")),
+	},
+	{
+		Name:        RuleRescue,
+		Description: "boots to the emergency or rescue shell",
+		Severity:    SeverityError,
+		match: matchAll(
+			bare("single", "emergency", "rescue", "s", "S", "1", "-s", "-b"),
+			value("systemd.unit", "emergency.target", "rescue.target"),
+			value("rd.systemd.unit", "emergency.target", "rescue.target"),
+		),
+	},
+	{
+		Name:        RuleKernelDebugger,
+		Description: "enables the kernel debugger",
+		Severity:    SeverityError,
+		match:       matchAll(present("kgdboc"), present("kgdbwait"), present("kgdbdbgp"), present("kgdbcon"), present("ekgdboc")),
+	},
+	{
+		Name:        RuleInsecure,
+		Description: "disables a security feature",
+		Severity:    SeverityWarn,
+		match: matchAll(
+			value("selinux", "0"), value("enforcing", "0"), value("apparmor", "0"), value("security", "none"),
+			value("module.sig_enforce", "0"), value("ima_appraise", "off", "fix", "log"),
+			value("mitigations", "off"), present("nokaslr"), value("iommu", "off"), value("lockdown", "none"),
+			disabled("systemd.verity"), disabled("rd.systemd.verity"),
+		),
+	},
+	{
+		Name:        RuleDebug,
+		Description: "enables debug output, which may leak secrets to the console",
+		Severity:    SeverityWarn,
+		match: matchAll(
+			bare("debug"), present("rd.debug"), present("rd.udev.debug"),
+			value("systemd.log_level", "debug"), value("rd.systemd.log_level", "debug"),
+		),
+	},
+	{
+		Name:        RuleMissingRoot,
+		Description: "has no root= option, the root file system is left to discovery",
+		// the Kairos and Talos initrds find the root file system themselves
+		Severity: SeverityIgnore,
+		match: func(params []Param) []string {
+			if slices.ContainsFunc(params, present("root")) {
+				return nil
+			}
+
+			return []string{"root="}
+		},
+	},
+}
+
+// Finding is a parameter flagged by a rule.
+type Finding struct {
+	// Rule flagging the parameter.
+	Rule string
+	// Parameter flagged as given on the cmdline, or the missing one.
+	Param string
+	// Severity of the rule.
+	Severity Severity
+	// Description of the rule.
+	Description string
+}
+
+// String returns the finding as a message.
+func (f Finding) String() string {
+	return fmt.Sprintf("%s %s (%s)", f.Param, f.Description, f.Rule)
+}
+
+// Lint returns the parameters of the cmdline flagged by the rules, with their severity, the rule
+// ones unless set in severities by rule name or AllRules. Rules of SeverityIgnore are left out.
+func Lint(cmdline string, severities map[string]Severity) []Finding {
+	params := Parse(cmdline)
+
+	var findings []Finding
+
+	for _, rule := range Rules {
+		severity := rule.Severity
+		if s, ok := severities[AllRules]; ok {
+			severity = s
+		}
+
+		if s, ok := severities[rule.Name]; ok {
+			severity = s
+		}
+
+		if severity == SeverityIgnore {
+			continue
+		}
+
+		for _, param := range rule.match(params) {
+			findings = append(findings, Finding{Rule: rule.Name, Param: param, Severity: severity, Description: rule.Description})
+		}
+	}
+
+	return findings
+}
+
+// ValidateSeverities checks the severities name known rules, or AllRules, and known severities.
+func ValidateSeverities(severities map[string]Severity) error {
+	for name, severity := range severities {
+		if name != AllRules && !slices.ContainsFunc(Rules, func(rule Rule) bool { return rule.Name == name }) {
+			return fmt.Errorf("unknown cmdline rule %q, one of: %s", name, strings.Join(RuleNames(), ", "))
+		}
+
+		switch severity {
+		case SeverityIgnore, SeverityWarn, SeverityError:
+		default:
+			return fmt.Errorf("unknown severity %q of cmdline rule %s, one of: ignore, warn, error", severity, name)
+		}
+	}
+
+	return nil
+}
+
+// RuleNames returns the names of the rules.
+func RuleNames() []string {
+	names := make([]string, len(Rules))
+	for i, rule := range Rules {
+		names[i] = rule.Name
+	}
+
+	return names
+}
+
+// matchAll returns the parameters matched by any of the matchers.
+func matchAll(matchers ...func(Param) bool) func([]Param) []string {
+	return func(params []Param) []string {
+		var matched []string
+
+		for _, param := range params {
+			if slices.ContainsFunc(matchers, func(match func(Param) bool) bool { return match(param) }) {
+				matched = append(matched, param.String())
+			}
+		}
+
+		return matched
+	}
+}
+
+// normalize returns the key with underscores, dashes and underscores being the same in keys for the
+// kernel.
+func normalize(key string) string {
+	return strings.ReplaceAll(key, "-", "_")
+}
+
+// present matches the key, with or without a value.
+func present(key string) func(Param) bool {
+	key = normalize(key)
+
+	return func(p Param) bool {
+		return normalize(p.Key) == key
+	}
+}
+
+// bare matches the words given without a value.
+func bare(words ...string) func(Param) bool {
+	return func(p Param) bool {
+		return !p.HasValue && slices.Contains(words, p.Key)
+	}
+}
+
+// value matches the key set to one of the values.
+func value(key string, values ...string) func(Param) bool {
+	key = normalize(key)
+
+	return func(p Param) bool {
+		return normalize(p.Key) == key && p.HasValue && slices.Contains(values, p.Value)
+	}
+}
+
+// enabled matches the boolean key given bare or set to a true value, the way systemd reads them.
+func enabled(key string) func(Param) bool {
+	key = normalize(key)
+
+	return func(p Param) bool {
+		if normalize(p.Key) != key {
+			return false
+		}
+
+		return !p.HasValue || !isFalse(p.Value)
+	}
+}
+
+// disabled matches the boolean key set to a false value.
+func disabled(key string) func(Param) bool {
+	key = normalize(key)
+
+	return func(p Param) bool {
+		return normalize(p.Key) == key && p.HasValue && isFalse(p.Value)
+	}
+}
+
+// shell matches the key set to the path of a shell.
+func shell(key string) func(Param) bool {
+	key = normalize(key)
+
+	return func(p Param) bool {
+		if normalize(p.Key) != key || !p.HasValue {
+			return false
+		}
+
+		switch filepath.Base(p.Value) {
+		case "sh", "bash", "dash", "ash", "zsh", "ksh", "busybox":
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// isFalse returns whether the value is false for systemd.
+func isFalse(v string) bool {
+	switch strings.ToLower(v) {
+	case "0", "no", "n", "false", "f", "off":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,81 @@
+package cmdline
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cmdline test Suite")
+}
+
+// flagged returns the parameters flagged by the findings, by rule.
+func flagged(findings []Finding) map[string][]string {
+	params := map[string][]string{}
+	for _, finding := range findings {
+		params[finding.Rule] = append(params[finding.Rule], finding.Param)
+	}
+
+	return params
+}
+
+var _ = Describe("Cmdline tests", func() {
+	It("Parses the parameters with quoted values", func() {
+		Expect(Parse(` console=ttyS0  quiet dyndbg="file x.c +p"	rd.break `)).To(Equal([]Param{
+			{Key: "console", Value: "ttyS0", HasValue: true},
+			{Key: "quiet"},
+			{Key: "dyndbg", Value: "file x.c +p", HasValue: true},
+			{Key: "rd.break"},
+		}))
+		Expect(Param{Key: "dyndbg", Value: "file x.c +p", HasValue: true}.String()).To(Equal(`dyndbg="file x.c +p"`))
+	})
+	It("Flags the options giving a shell", func() {
+		findings := Lint("console=ttyS0 rd.break=pre-mount init=/bin/sh systemd.debug-shell systemd.unit=rescue.target single kgdboc=ttyS0", nil)
+
+		Expect(flagged(findings)).To(Equal(map[string][]string{
+			RuleDebugShell:     {"systemd.debug-shell"},
+			RuleInitShell:      {"init=/bin/sh"},
+			RuleBreak:          {"rd.break=pre-mount"},
+			RuleRescue:         {"systemd.unit=rescue.target", "single"},
+			RuleKernelDebugger: {"kgdboc=ttyS0"},
+		}))
+		for _, finding := range findings {
+			Expect(finding.Severity).To(Equal(SeverityError))
+		}
+		Expect(findings[0].String()).To(Equal("systemd.debug-shell gives a root shell on a console without authentication (debug-shell)"))
+	})
+	It("Does not flag the options turned off", func() {
+		Expect(Lint("systemd.debug_shell=0 rd.shell=no init=/usr/lib/systemd/systemd systemd.unit=multi-user.target selinux=1 systemd.verity=yes", nil)).To(BeEmpty())
+	})
+	It("Warns about debug and insecure options", func() {
+		findings := Lint("debug systemd.log_level=debug selinux=0 mitigations=off rd.systemd.verity=0", nil)
+
+		Expect(flagged(findings)).To(Equal(map[string][]string{
+			RuleInsecure: {"selinux=0", "mitigations=off", "rd.systemd.verity=0"},
+			RuleDebug:    {"debug", "systemd.log_level=debug"},
+		}))
+		for _, finding := range findings {
+			Expect(finding.Severity).To(Equal(SeverityWarn))
+		}
+	})
+	It("Applies the severities given", func() {
+		Expect(Lint("console=ttyS0", nil)).To(BeEmpty())
+		Expect(Lint("console=ttyS0", map[string]Severity{RuleMissingRoot: SeverityError})).To(ConsistOf(Finding{
+			Rule: RuleMissingRoot, Param: "root=", Severity: SeverityError, Description: "has no root= option, the root file system is left to discovery",
+		}))
+		Expect(Lint("root=/dev/sda2", map[string]Severity{RuleMissingRoot: SeverityError})).To(BeEmpty())
+
+		findings := Lint("rd.break debug", map[string]Severity{AllRules: SeverityIgnore, RuleBreak: SeverityWarn})
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Rule).To(Equal(RuleBreak))
+		Expect(findings[0].Severity).To(Equal(SeverityWarn))
+	})
+	It("Refuses unknown rules and severities", func() {
+		Expect(ValidateSeverities(map[string]Severity{AllRules: SeverityWarn, RuleDebug: SeverityIgnore})).To(Succeed())
+		Expect(ValidateSeverities(map[string]Severity{"shell": SeverityWarn})).To(MatchError(ContainSubstring(`unknown cmdline rule "shell"`)))
+		Expect(ValidateSeverities(map[string]Severity{RuleDebug: "fatal"})).To(MatchError(ContainSubstring(`unknown severity "fatal"`)))
+	})
+})
@@ -16,12 +16,20 @@ const (
 	PEMTypeRSAPublic = "PUBLIC KEY"
 	Name             = "Kairos"
 	// UKIPCR is the PCR number where sections except `.pcrsig` are measured.
-	UKIPCR            = 11
+	UKIPCR = 11
+	// KernelConfigPCR is the PCR number where systemd-stub measures addons and the kernel cmdline.
+	KernelConfigPCR = 12
+	// SysextPCR is the PCR number where systemd-stub measures the system extension images.
+	SysextPCR = 13
+	// File names systemd looks for the PCR public key and signed policy under, in /etc/systemd and /run/systemd.
+	PCRPublicKeyFile  = "tpm2-pcr-public-key.pem"
+	PCRSignatureFile  = "tpm2-pcr-signature.json"
 	OSReleaseTemplate = `NAME="{{ .Name }}"
 ID={{ .ID }}
 VERSION_ID={{ .Version }}
 PRETTY_NAME="{{ .Name }} ({{ .Version }})"
-)
+{{ with .HomeURL }}HOME_URL="{{ . }}"
+{{ end }})
 `
 	// EnterInitrd is the phase value extended to the PCR during the initrd.
 	EnterInitrd Phase = "enter-initrd"
@@ -42,6 +50,8 @@ PRETTY_NAME="{{ .Name }} ({{ .Version }})"
 	SBAT    Section = ".sbat"
 	PCRSig  Section = ".pcrsig"
 	PCRPKey Section = ".pcrpkey"
+	SBOM    Section = ".sbom"
+	EFIFW   Section = ".efifw"
 )
 
 // OrderedSections returns the sections that are measured into PCR.
@@ -59,21 +69,26 @@ func OrderedSections() []Section {
 		DTB,
 		Uname,
 		SBAT,
-		PCRPKey}
+		PCRPKey,
+		EFIFW}
+}
+
+// OSReleaseInfo is the identity written to a generated os-release.
+type OSReleaseInfo struct {
+	Name    string
+	ID      string
+	Version string
+	// HOME_URL, left out when empty.
+	HomeURL string
 }
 
 // OSReleaseFor returns the contents of /etc/os-release for a given name and version.
 func OSReleaseFor(name, version string) ([]byte, error) {
-	data := struct {
-		Name    string
-		ID      string
-		Version string
-	}{
-		Name:    name,
-		ID:      strings.ToLower(name),
-		Version: version,
-	}
+	return OSRelease(OSReleaseInfo{Name: name, ID: strings.ToLower(name), Version: version})
+}
 
+// OSRelease returns the contents of /etc/os-release for the identity.
+func OSRelease(data OSReleaseInfo) ([]byte, error) {
 	tmpl, err := template.New("").Parse(OSReleaseTemplate)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,324 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package cpio builds the newc cpio archives the kernel unpacks as its initramfs.
+package cpio
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Compressions of the archive, see Options.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Mode bits of the newc format, from linux/stat.h.
+const (
+	modeSocket    = 0o140000
+	modeSymlink   = 0o120000
+	modeRegular   = 0o100000
+	modeBlock     = 0o060000
+	modeDir       = 0o040000
+	modeChar      = 0o020000
+	modeFIFO      = 0o010000
+	modeSetuid    = 0o004000
+	modeSetgid    = 0o002000
+	modeSticky    = 0o001000
+	newcMagic     = "070701"
+	newcTrailer   = "TRAILER!!!"
+	newcAlignment = 4
+)
+
+// Options are the options of the archives.
+type Options struct {
+	// Compression of the archive, CompressionNone, CompressionGzip or CompressionZstd.
+	Compression string
+	// Whether the entries are owned by root and dated ModTime, instead of the owner and modification
+	// time of the files, so the archive only depends on the contents and modes of the tree.
+	Reproducible bool
+	// Time the entries are dated with when Reproducible, SOURCE_DATE_EPOCH or the epoch when zero.
+	ModTime time.Time
+	// Path to zstd, zstd in PATH when empty.
+	ZstdPath string
+}
+
+// entry is the header of an archive entry.
+type entry struct {
+	name     string
+	ino      uint32
+	mode     uint32
+	uid, gid uint32
+	nlink    uint32
+	mtime    uint32
+	size     uint32
+	rdev     [2]uint32
+}
+
+// WriteDir writes the archive of the tree at dir to w, the entries named after their path in dir in
+// lexical order, and the inodes numbered in that order, so the same tree gives the same archive.
+// Hard links are archived as separate files.
+func WriteDir(w io.Writer, dir string, opts Options) (err error) {
+	out, finish, err := compress(w, opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if finishErr := finish(); err == nil {
+			err = finishErr
+		}
+	}()
+
+	bw := bufio.NewWriterSize(out, 1<<16)
+	mtime := opts.modTime()
+	ino := uint32(0)
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		ino++
+
+		e := entry{name: filepath.ToSlash(rel), ino: ino, mode: mode(info), nlink: 1, mtime: mtime}
+		if !opts.Reproducible {
+			e.uid, e.gid = owner(info)
+			e.mtime = uint32(info.ModTime().Unix())
+		}
+
+		switch info.Mode().Type() {
+		case fs.ModeDir:
+			e.nlink = 2
+
+			return writeEntry(bw, e, nil)
+		case fs.ModeSymlink:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			e.size = uint32(len(target))
+
+			return writeEntry(bw, e, []byte(target))
+		case 0:
+			if info.Size() > 0xffffffff {
+				return fmt.Errorf("%s is over the 4G newc limit", path)
+			}
+
+			e.size = uint32(info.Size())
+
+			return writeFile(bw, e, path)
+		default:
+			e.rdev = device(info)
+
+			return writeEntry(bw, e, nil)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = writeEntry(bw, entry{name: newcTrailer, nlink: 1}, nil); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// WriteDirFile writes the archive of the tree at dir to the file at path, created 0600 as the
+// archive may hold the files of a root file system.
+func WriteDirFile(path, dir string, opts Options) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if err = WriteDir(f, dir, opts); err != nil {
+		f.Close() //nolint:errcheck
+
+		return err
+	}
+
+	return f.Close()
+}
+
+// modTime returns the modification time of the entries of reproducible archives.
+func (opts Options) modTime() uint32 {
+	if !opts.ModTime.IsZero() {
+		return uint32(opts.ModTime.Unix())
+	}
+
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return uint32(epoch)
+	}
+
+	return 0
+}
+
+// mode returns the newc mode of the file.
+func mode(info fs.FileInfo) uint32 {
+	m := uint32(info.Mode().Perm())
+
+	switch info.Mode().Type() {
+	case fs.ModeDir:
+		m |= modeDir
+	case fs.ModeSymlink:
+		m |= modeSymlink
+	case fs.ModeNamedPipe:
+		m |= modeFIFO
+	case fs.ModeSocket:
+		m |= modeSocket
+	case fs.ModeDevice:
+		m |= modeBlock
+	case fs.ModeDevice | fs.ModeCharDevice:
+		m |= modeChar
+	default:
+		m |= modeRegular
+	}
+
+	if info.Mode()&fs.ModeSetuid != 0 {
+		m |= modeSetuid
+	}
+
+	if info.Mode()&fs.ModeSetgid != 0 {
+		m |= modeSetgid
+	}
+
+	if info.Mode()&fs.ModeSticky != 0 {
+		m |= modeSticky
+	}
+
+	return m
+}
+
+// writeEntry writes the header of the entry, followed by its data.
+func writeEntry(w io.Writer, e entry, data []byte) error {
+	if err := writeHeader(w, e); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	return pad(w, len(data))
+}
+
+// writeFile writes the header of the entry, followed by the contents of the file.
+func writeFile(w io.Writer, e entry, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	if err = writeHeader(w, e); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w, io.LimitReader(f, int64(e.size)))
+	if err != nil {
+		return err
+	}
+
+	if n != int64(e.size) {
+		return fmt.Errorf("%s changed while archiving it", path)
+	}
+
+	return pad(w, int(n))
+}
+
+// writeHeader writes the newc header of the entry and its name.
+func writeHeader(w io.Writer, e entry) error {
+	_, err := fmt.Fprintf(w, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+		newcMagic, e.ino, e.mode, e.uid, e.gid, e.nlink, e.mtime, e.size, 0, 0, e.rdev[0], e.rdev[1], len(e.name)+1, 0, e.name)
+	if err != nil {
+		return err
+	}
+
+	// the header is 110 bytes
+	return pad(w, 110+len(e.name)+1)
+}
+
+// pad aligns the archive after n bytes were written.
+func pad(w io.Writer, n int) error {
+	if rem := n % newcAlignment; rem != 0 {
+		_, err := w.Write(make([]byte, newcAlignment-rem))
+
+		return err
+	}
+
+	return nil
+}
+
+// compress returns the writer of the uncompressed archive, and the function completing the compressed one.
+func compress(w io.Writer, opts Options) (io.Writer, func() error, error) {
+	switch opts.Compression {
+	case CompressionNone:
+		return w, func() error { return nil }, nil
+	case CompressionGzip:
+		zw := gzip.NewWriter(w)
+
+		return zw, zw.Close, nil
+	case CompressionZstd:
+		path := opts.ZstdPath
+		if path == "" {
+			path = "zstd"
+		}
+
+		// the compression of the kernel initramfs, as dracut does it
+		cmd := exec.Command(path, "-q", "-c", "-T0", "-15")
+		cmd.Stdout = w
+
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err = cmd.Start(); err != nil {
+			return nil, nil, fmt.Errorf("failed running zstd: %w", err)
+		}
+
+		return in, func() error {
+			if err := in.Close(); err != nil {
+				return err
+			}
+
+			if err := cmd.Wait(); err != nil {
+				return fmt.Errorf("zstd failed: %w", err)
+			}
+
+			return nil
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown compression %q, expected gzip or zstd", opts.Compression)
+	}
+}
@@ -0,0 +1,164 @@
+package cpio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cpio test Suite")
+}
+
+// testEntry is an entry read back from an archive.
+type testEntry struct {
+	name             string
+	mode, uid, mtime uint64
+	nlink            uint64
+	data             string
+}
+
+// readArchive parses a newc archive up to its trailer.
+func readArchive(data []byte) []testEntry {
+	var entries []testEntry
+
+	field := func(header []byte, i int) uint64 {
+		v, err := strconv.ParseUint(string(header[6+8*i:14+8*i]), 16, 32)
+		Expect(err).ToNot(HaveOccurred())
+
+		return v
+	}
+	align := func(n int) int { return (n + 3) &^ 3 }
+
+	for off := 0; ; {
+		header := data[off : off+110]
+		Expect(string(header[:6])).To(Equal(newcMagic))
+
+		nameSize := int(field(header, 11))
+		name := string(data[off+110 : off+110+nameSize-1])
+		off = align(off + 110 + nameSize)
+
+		if name == newcTrailer {
+			Expect(data[off:]).To(BeEmpty())
+
+			return entries
+		}
+
+		size := int(field(header, 6))
+		entries = append(entries, testEntry{
+			name:  name,
+			mode:  field(header, 1),
+			uid:   field(header, 2),
+			nlink: field(header, 4),
+			mtime: field(header, 5),
+			data:  string(data[off : off+size]),
+		})
+		off = align(off + size)
+	}
+}
+
+// writeTree writes a small initramfs tree to a temporary directory.
+func writeTree() string {
+	dir := GinkgoT().TempDir()
+	Expect(os.MkdirAll(filepath.Join(dir, "usr", "bin"), 0o755)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(dir, "init"), []byte("#!/bin/sh\n"), 0o755)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(dir, "usr", "bin", "busybox"), []byte("busybox"), 0o755)).To(Succeed())
+	Expect(os.Symlink("usr/bin", filepath.Join(dir, "bin"))).To(Succeed())
+
+	return dir
+}
+
+var _ = Describe("Cpio", func() {
+	It("Archives the tree in lexical order", func() {
+		var buf bytes.Buffer
+		Expect(WriteDir(&buf, writeTree(), Options{})).To(Succeed())
+
+		entries := readArchive(buf.Bytes())
+		Expect(entries).To(HaveLen(5))
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.name)
+		}
+
+		Expect(names).To(Equal([]string{"bin", "init", "usr", "usr/bin", "usr/bin/busybox"}))
+		Expect(entries[0].mode).To(Equal(uint64(modeSymlink | 0o777)))
+		Expect(entries[0].data).To(Equal("usr/bin"))
+		Expect(entries[1].mode).To(Equal(uint64(modeRegular | 0o755)))
+		Expect(entries[1].data).To(Equal("#!/bin/sh\n"))
+		Expect(entries[2].mode).To(Equal(uint64(modeDir | 0o755)))
+		Expect(entries[2].nlink).To(Equal(uint64(2)))
+		Expect(entries[4].data).To(Equal("busybox"))
+	})
+	It("Writes the same archive of the same tree when reproducible", func() {
+		modTime := time.Unix(1700000000, 0)
+
+		archive := func(mtime time.Time) []byte {
+			dir := writeTree()
+			Expect(os.Chtimes(filepath.Join(dir, "init"), mtime, mtime)).To(Succeed())
+
+			var buf bytes.Buffer
+			Expect(WriteDir(&buf, dir, Options{Reproducible: true, ModTime: modTime})).To(Succeed())
+
+			return buf.Bytes()
+		}
+
+		first := archive(time.Unix(1, 0))
+		Expect(archive(time.Now())).To(Equal(first))
+
+		for _, e := range readArchive(first) {
+			Expect(e.uid).To(BeZero())
+			Expect(e.mtime).To(Equal(uint64(modTime.Unix())))
+		}
+	})
+	It("Dates the reproducible entries SOURCE_DATE_EPOCH", func() {
+		GinkgoT().Setenv("SOURCE_DATE_EPOCH", "1234")
+
+		var buf bytes.Buffer
+		Expect(WriteDir(&buf, writeTree(), Options{Reproducible: true})).To(Succeed())
+		Expect(readArchive(buf.Bytes())[0].mtime).To(Equal(uint64(1234)))
+	})
+	It("Compresses the archive with gzip", func() {
+		dir := writeTree()
+		out := filepath.Join(GinkgoT().TempDir(), "initrd")
+		Expect(WriteDirFile(out, dir, Options{Compression: CompressionGzip})).To(Succeed())
+
+		f, err := os.Open(out)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+
+		zr, err := gzip.NewReader(f)
+		Expect(err).ToNot(HaveOccurred())
+
+		data, err := io.ReadAll(zr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readArchive(data)).To(HaveLen(5))
+	})
+	It("Compresses the archive with zstd", func() {
+		if _, err := exec.LookPath("zstd"); err != nil {
+			Skip("zstd is not installed")
+		}
+
+		var buf bytes.Buffer
+		Expect(WriteDir(&buf, writeTree(), Options{Compression: CompressionZstd})).To(Succeed())
+
+		cmd := exec.Command("zstd", "-d", "-c")
+		cmd.Stdin = &buf
+		data, err := cmd.Output()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readArchive(data)).To(HaveLen(5))
+	})
+	It("Refuses unknown compressions", func() {
+		Expect(WriteDir(io.Discard, writeTree(), Options{Compression: "xz"})).To(MatchError(ContainSubstring("unknown compression")))
+	})
+})
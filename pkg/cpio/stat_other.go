@@ -0,0 +1,19 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !unix
+
+package cpio
+
+import "io/fs"
+
+// owner returns root, the owner of the files is only known on unix.
+func owner(fs.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+// device returns no device numbers, they are only known on unix.
+func device(fs.FileInfo) [2]uint32 {
+	return [2]uint32{}
+}
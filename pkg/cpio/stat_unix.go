@@ -0,0 +1,36 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build unix
+
+package cpio
+
+import (
+	"io/fs"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// owner returns the uid and gid of the file.
+func owner(info fs.FileInfo) (uint32, uint32) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+
+	return st.Uid, st.Gid
+}
+
+// device returns the major and minor numbers of the device file.
+func device(info fs.FileInfo) [2]uint32 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return [2]uint32{}
+	}
+
+	rdev := uint64(st.Rdev) //nolint:unconvert // int32 on some platforms
+
+	return [2]uint32{unix.Major(rdev), unix.Minor(rdev)}
+}
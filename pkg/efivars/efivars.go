@@ -0,0 +1,110 @@
+// Package efivars reads and writes UEFI variables through efivarfs.
+package efivars
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// LoaderGUID is the vendor GUID of the variables of the boot loader interface, set by systemd-boot.
+const LoaderGUID = "4a67b082-0a4c-41cf-b6c7-440b29bb8c4f"
+
+// GlobalGUID is the vendor GUID of the variables defined by the UEFI specification, i.e. Boot####.
+const GlobalGUID = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// Attributes of the non-volatile variables written, as NON_VOLATILE | BOOTSERVICE_ACCESS | RUNTIME_ACCESS.
+const attributes uint32 = 0x7
+
+// Path is the mount point of efivarfs.
+var Path = "/sys/firmware/efi/efivars"
+
+// Read returns the contents of an EFI variable, without the attributes.
+func Read(name, guid string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(Path, fmt.Sprintf("%s-%s", name, guid)))
+	if err != nil {
+		return nil, err
+	}
+
+	// efivarfs prepends the 32 bit attributes to the data
+	if len(data) < 4 {
+		return nil, fmt.Errorf("EFI variable %s is too short", name)
+	}
+
+	return data[4:], nil
+}
+
+// Write creates or replaces a non-volatile EFI variable, accessible at runtime, with the given data.
+func Write(name, guid string, data []byte) error {
+	path := filepath.Join(Path, fmt.Sprintf("%s-%s", name, guid))
+
+	if err := clearImmutable(path); err != nil {
+		return fmt.Errorf("failed making EFI variable %s writable: %w", name, err)
+	}
+
+	buf := binary.LittleEndian.AppendUint32(nil, attributes)
+	buf = append(buf, data...)
+
+	// efivarfs needs the whole variable in a single write
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(buf); err != nil {
+		f.Close() //nolint:errcheck
+
+		return err
+	}
+
+	return f.Close()
+}
+
+// Delete removes an EFI variable, it is not an error if it does not exist.
+func Delete(name, guid string) error {
+	path := filepath.Join(Path, fmt.Sprintf("%s-%s", name, guid))
+
+	if err := clearImmutable(path); err != nil {
+		return fmt.Errorf("failed making EFI variable %s writable: %w", name, err)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// ReadString returns the contents of an EFI variable holding a NUL terminated UTF-16 string.
+func ReadString(name, guid string) (string, error) {
+	data, err := Read(name, guid)
+	if err != nil {
+		return "", err
+	}
+
+	return DecodeUTF16(data), nil
+}
+
+// EncodeUTF16 encodes a string as NUL terminated UTF-16.
+func EncodeUTF16(s string) []byte {
+	var buf []byte
+
+	for _, c := range utf16.Encode([]rune(s + "\x00")) {
+		buf = binary.LittleEndian.AppendUint16(buf, c)
+	}
+
+	return buf
+}
+
+// DecodeUTF16 decodes a UTF-16 string, dropping the trailing NULs.
+func DecodeUTF16(data []byte) string {
+	chars := make([]uint16, len(data)/2)
+	_ = binary.Read(bytes.NewReader(data[:2*len(chars)]), binary.LittleEndian, chars)
+
+	return strings.TrimRight(string(utf16.Decode(chars)), "\x00")
+}
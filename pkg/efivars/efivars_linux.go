@@ -0,0 +1,37 @@
+package efivars
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsImmutableFL is FS_IMMUTABLE_FL from linux/fs.h.
+const fsImmutableFL = 0x10
+
+// clearImmutable clears the immutable flag efivarfs puts on variables it does not know are safe to change.
+func clearImmutable(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		// not every filesystem supports flags, i.e. a plain directory standing in for efivarfs
+		return nil
+	}
+
+	if flags&fsImmutableFL == 0 {
+		return nil
+	}
+
+	return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags&^fsImmutableFL))
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package efivars
+
+// clearImmutable is a no-op, efivarfs only exists on Linux.
+func clearImmutable(string) error {
+	return nil
+}
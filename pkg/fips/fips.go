@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package fips tells whether the Go crypto runs in FIPS 140 mode, and refuses the algorithms not
+// approved for FIPS 140-3 when enforced.
+//
+// In FIPS mode, GODEBUG=fips140=on or only or a boringcrypto build, only approved algorithms are used
+// by default: the SHA-1 PCR bank is left out of the measurements and the PCR signatures. With Enforce,
+// i.e. --fips, the other non-approved algorithms fail with ErrNotApproved before the Go crypto is
+// reached, instead of the errors and panics of GODEBUG=fips140=only.
+package fips
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrNotApproved is returned for the algorithms not approved for FIPS 140-3, when enforced.
+var ErrNotApproved = errors.New("not FIPS 140-3 approved")
+
+// MinRSABits is the minimum size of the RSA keys approved for signatures.
+const MinRSABits = 2048
+
+// MinHMACKeyBytes is the minimum length of the HMAC keys, 112 bits, the passphrases keys are derived
+// from with PBKDF2 being HMAC keys too.
+const MinHMACKeyBytes = 14
+
+var enforced atomic.Bool
+
+// Enforce makes the non-approved algorithms fail, or stops doing so.
+func Enforce(on bool) {
+	enforced.Store(on)
+}
+
+// Enabled returns whether only approved algorithms are used by default: in FIPS mode, or enforced.
+func Enabled() bool {
+	return enforced.Load() || runtimeEnabled()
+}
+
+// Enforced returns whether the non-approved algorithms fail, with Enforce or GODEBUG=fips140=only.
+func Enforced() bool {
+	return enforced.Load() || runtimeEnforced()
+}
+
+// Check fails with ErrNotApproved for the named algorithm when enforced, for the non-approved
+// algorithms without a crypto.Hash or a key, i.e. the MD5 key derivation of legacy encrypted PEM keys.
+func Check(algorithm string) error {
+	if !Enforced() {
+		return nil
+	}
+
+	return fmt.Errorf("%s is %w", algorithm, ErrNotApproved)
+}
+
+// CheckHMACKey fails with ErrNotApproved when enforced and the HMAC key, or the passphrase a key is
+// derived from with PBKDF2, is shorter than MinHMACKeyBytes.
+func CheckHMACKey(key []byte) error {
+	if !Enforced() || len(key) >= MinHMACKeyBytes {
+		return nil
+	}
+
+	return fmt.Errorf("HMAC key shorter than %d bytes is %w", MinHMACKeyBytes, ErrNotApproved)
+}
+
+// CheckHash fails with ErrNotApproved when enforced and the hash is not approved for signatures,
+// only the SHA-2 and SHA-3 families are.
+func CheckHash(hash crypto.Hash) error {
+	if !Enforced() {
+		return nil
+	}
+
+	switch hash {
+	case crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512, crypto.SHA512_224, crypto.SHA512_256,
+		crypto.SHA3_224, crypto.SHA3_256, crypto.SHA3_384, crypto.SHA3_512:
+		return nil
+	default:
+		return fmt.Errorf("hash %s is %w", hash, ErrNotApproved)
+	}
+}
+
+// CheckKey fails with ErrNotApproved when enforced and the public key is not approved for
+// signatures: RSA keys of at least MinRSABits bits and ECDSA keys on the P-256, P-384 and P-521
+// curves are.
+func CheckKey(key crypto.PublicKey) error {
+	if !Enforced() {
+		return nil
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < MinRSABits {
+			return fmt.Errorf("%d bit RSA key is %w, %d bits at least are", key.N.BitLen(), ErrNotApproved, MinRSABits)
+		}
+
+		return nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return nil
+		}
+
+		return fmt.Errorf("ECDSA key on curve %s is %w", key.Curve.Params().Name, ErrNotApproved)
+	default:
+		return fmt.Errorf("%T key is %w", key, ErrNotApproved)
+	}
+}
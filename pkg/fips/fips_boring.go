@@ -0,0 +1,18 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build boringcrypto
+
+package fips
+
+import "crypto/boring"
+
+func runtimeEnabled() bool {
+	return boring.Enabled()
+}
+
+// runtimeEnforced is false, BoringCrypto builds still run the non-approved algorithms.
+func runtimeEnforced() bool {
+	return false
+}
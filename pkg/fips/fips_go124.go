@@ -0,0 +1,28 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.24 && !go1.26 && !boringcrypto
+
+package fips
+
+import (
+	"crypto/fips140"
+	"os"
+	"strings"
+)
+
+func runtimeEnabled() bool {
+	return fips140.Enabled()
+}
+
+// runtimeEnforced looks for fips140=only in GODEBUG, fips140.Enforced is only there from Go 1.26 on.
+func runtimeEnforced() bool {
+	for _, setting := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if strings.TrimSpace(setting) == "fips140=only" {
+			return true
+		}
+	}
+
+	return false
+}
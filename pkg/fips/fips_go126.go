@@ -0,0 +1,17 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.26 && !boringcrypto
+
+package fips
+
+import "crypto/fips140"
+
+func runtimeEnabled() bool {
+	return fips140.Enabled()
+}
+
+func runtimeEnforced() bool {
+	return fips140.Enforced()
+}
@@ -0,0 +1,16 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !go1.24 && !boringcrypto
+
+package fips
+
+// runtimeEnabled is false, Go crypto has no FIPS 140 mode before Go 1.24 but with boringcrypto.
+func runtimeEnabled() bool {
+	return false
+}
+
+func runtimeEnforced() bool {
+	return false
+}
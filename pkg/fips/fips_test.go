@@ -0,0 +1,70 @@
+package fips
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "FIPS test Suite")
+}
+
+var _ = Describe("FIPS tests", func() {
+	AfterEach(func() {
+		Enforce(false)
+	})
+	It("Allows every algorithm unless enforced", func() {
+		if runtimeEnforced() {
+			Skip("FIPS 140-only mode")
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(Enforced()).To(BeFalse())
+		Expect(CheckHash(crypto.SHA1)).To(Succeed())
+		Expect(CheckKey(&key.PublicKey)).To(Succeed())
+		Expect(CheckHMACKey([]byte("secret"))).To(Succeed())
+		Expect(Check("MD5")).To(Succeed())
+	})
+	It("Refuses the algorithms not approved once enforced", func() {
+		Enforce(true)
+		Expect(Enabled()).To(BeTrue())
+		Expect(Enforced()).To(BeTrue())
+
+		Expect(CheckHash(crypto.SHA1)).To(MatchError(ErrNotApproved))
+		Expect(CheckHash(crypto.MD5)).To(MatchError(ErrNotApproved))
+		Expect(CheckHash(crypto.SHA256)).To(Succeed())
+		Expect(CheckHash(crypto.SHA3_384)).To(Succeed())
+
+		Expect(CheckHMACKey([]byte("secret"))).To(MatchError(ErrNotApproved))
+		Expect(CheckHMACKey([]byte("a much longer secret"))).To(Succeed())
+
+		Expect(Check("MD5")).To(MatchError(ContainSubstring("MD5 is not FIPS 140-3 approved")))
+	})
+	It("Refuses the keys not approved once enforced", func() {
+		Enforce(true)
+
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(CheckKey(&key.PublicKey)).To(Succeed())
+
+		ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(CheckKey(&ec.PublicKey)).To(Succeed())
+
+		// 1024 bit keys can't be generated in FIPS 140-only mode
+		small := &rsa.PublicKey{N: new(big.Int).Rsh(key.N, 1024), E: key.E}
+		Expect(CheckKey(small)).To(MatchError(ContainSubstring("1024 bit RSA key")))
+		Expect(CheckKey("key")).To(MatchError(ErrNotApproved))
+	})
+})
@@ -0,0 +1,186 @@
+// Package gpt reads GUID partition tables.
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	signature = "EFI PART"
+	// ESPType is the partition type GUID of an EFI system partition.
+	ESPType = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	// XBOOTLDRType is the partition type GUID of an extended boot loader partition.
+	XBOOTLDRType = "bc13c2ff-59e6-4262-a352-b275fd6f7172"
+)
+
+// Table is a parsed GUID partition table.
+type Table struct {
+	// Size of the disk sectors the table was found with.
+	SectorSize int
+	// GUID of the disk.
+	DiskGUID string
+	// Partitions with a non-empty type.
+	Partitions []Partition
+}
+
+// Partition is an entry of the partition table.
+type Partition struct {
+	// Partition number, starting at 1 as the kernel numbers them.
+	Number int
+	// Partition type GUID.
+	Type string
+	// Unique partition GUID.
+	GUID string
+	// First and last LBA of the partition, inclusive.
+	FirstLBA uint64
+	LastLBA  uint64
+	// Partition name.
+	Name string
+}
+
+// header is the on-disk GPT header, up to the fields we use.
+type header struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+}
+
+// entry is the on-disk partition entry.
+type entry struct {
+	Type       [16]byte
+	GUID       [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+// Read reads the primary GUID partition table of a disk.
+//
+// Both 512 and 4096 bytes sector sizes are probed.
+func Read(r io.ReaderAt) (*Table, error) {
+	for _, sectorSize := range []int{512, 4096} {
+		var h header
+
+		if err := binary.Read(io.NewSectionReader(r, int64(sectorSize), int64(binary.Size(h))), binary.LittleEndian, &h); err != nil {
+			return nil, fmt.Errorf("failed reading GPT header: %w", err)
+		}
+
+		if string(h.Signature[:]) != signature {
+			continue
+		}
+
+		return readEntries(r, sectorSize, h)
+	}
+
+	return nil, errors.New("no GPT found")
+}
+
+func readEntries(r io.ReaderAt, sectorSize int, h header) (*Table, error) {
+	if h.EntrySize < uint32(binary.Size(entry{})) {
+		return nil, fmt.Errorf("invalid GPT entry size %d", h.EntrySize)
+	}
+
+	table := &Table{
+		SectorSize: sectorSize,
+		DiskGUID:   FormatGUID(h.DiskGUID),
+	}
+
+	buf := make([]byte, h.EntrySize)
+	offset := int64(h.EntriesLBA) * int64(sectorSize)
+
+	for i := uint32(0); i < h.NumEntries; i++ {
+		if _, err := r.ReadAt(buf, offset+int64(i)*int64(h.EntrySize)); err != nil {
+			return nil, fmt.Errorf("failed reading GPT entry %d: %w", i, err)
+		}
+
+		var e entry
+
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &e); err != nil {
+			return nil, err
+		}
+
+		if e.Type == [16]byte{} {
+			continue
+		}
+
+		table.Partitions = append(table.Partitions, Partition{
+			Number:   int(i) + 1,
+			Type:     FormatGUID(e.Type),
+			GUID:     FormatGUID(e.GUID),
+			FirstLBA: e.FirstLBA,
+			LastLBA:  e.LastLBA,
+			Name:     strings.TrimRight(string(utf16.Decode(e.Name[:])), "\x00"),
+		})
+	}
+
+	return table, nil
+}
+
+// Partition returns the partition with the given number.
+func (t *Table) Partition(number int) (Partition, bool) {
+	for _, p := range t.Partitions {
+		if p.Number == number {
+			return p, true
+		}
+	}
+
+	return Partition{}, false
+}
+
+// FormatGUID formats a mixed-endian on-disk GUID in its canonical lowercase form.
+func FormatGUID(g [16]byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10],
+		g[10:16])
+}
+
+// ParseGUID parses a canonical GUID string into its mixed-endian on-disk form.
+func ParseGUID(s string) ([16]byte, error) {
+	var g [16]byte
+
+	var a uint32
+	var b, c uint16
+	var d, e []byte
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+
+	if _, err := fmt.Sscanf(strings.Join(parts[:3], " "), "%x %x %x", &a, &b, &c); err != nil {
+		return g, fmt.Errorf("invalid GUID %q: %w", s, err)
+	}
+
+	if _, err := fmt.Sscanf(parts[3]+" "+parts[4], "%x %x", &d, &e); err != nil || len(d) != 2 || len(e) != 6 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+
+	binary.LittleEndian.PutUint32(g[0:4], a)
+	binary.LittleEndian.PutUint16(g[4:6], b)
+	binary.LittleEndian.PutUint16(g[6:8], c)
+	copy(g[8:10], d)
+	copy(g[10:16], e)
+
+	return g, nil
+}
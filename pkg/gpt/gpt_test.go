@@ -0,0 +1,92 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "GPT test Suite")
+}
+
+// disk returns an in-memory disk image with a GPT holding the given entries.
+func disk(sectorSize int, entries ...entry) []byte {
+	img := make([]byte, sectorSize*40)
+
+	h := header{
+		Revision:   0x00010000,
+		HeaderSize: 92,
+		CurrentLBA: 1,
+		EntriesLBA: 2,
+		NumEntries: 128,
+		EntrySize:  128,
+	}
+	copy(h.Signature[:], signature)
+
+	var buf bytes.Buffer
+	Expect(binary.Write(&buf, binary.LittleEndian, h)).To(Succeed())
+	copy(img[sectorSize:], buf.Bytes())
+
+	for i, e := range entries {
+		buf.Reset()
+		Expect(binary.Write(&buf, binary.LittleEndian, e)).To(Succeed())
+		copy(img[2*sectorSize+i*128:], buf.Bytes())
+	}
+
+	return img
+}
+
+var _ = Describe("GPT tests", func() {
+	Describe("GUID", func() {
+		It("Round trips the mixed-endian encoding", func() {
+			g, err := ParseGUID(ESPType)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(g[:4]).To(Equal([]byte{0x28, 0x73, 0x2a, 0xc1}))
+			Expect(FormatGUID(g)).To(Equal(ESPType))
+		})
+		It("Fails on invalid GUIDs", func() {
+			_, err := ParseGUID("not-a-guid")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("Read", func() {
+		var esp entry
+
+		BeforeEach(func() {
+			var err error
+			esp = entry{FirstLBA: 2048, LastLBA: 1050623}
+			esp.Type, err = ParseGUID(ESPType)
+			Expect(err).ToNot(HaveOccurred())
+			esp.GUID, err = ParseGUID("8ec4c51e-24a1-4d62-9fd3-2e3ecd0d17a0")
+			Expect(err).ToNot(HaveOccurred())
+			copy(esp.Name[:], utf16.Encode([]rune("EFI")))
+		})
+
+		for _, sectorSize := range []int{512, 4096} {
+			It("Reads the partitions", func() {
+				table, err := Read(bytes.NewReader(disk(sectorSize, entry{}, esp)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(table.SectorSize).To(Equal(sectorSize))
+				Expect(table.Partitions).To(HaveLen(1))
+
+				p, ok := table.Partition(2)
+				Expect(ok).To(BeTrue())
+				Expect(p.Type).To(Equal(ESPType))
+				Expect(p.GUID).To(Equal("8ec4c51e-24a1-4d62-9fd3-2e3ecd0d17a0"))
+				Expect(p.FirstLBA).To(Equal(uint64(2048)))
+				Expect(p.Name).To(Equal("EFI"))
+			})
+		}
+
+		It("Fails without a GPT", func() {
+			_, err := Read(bytes.NewReader(make([]byte, 8192)))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package initrd generates the initrd of a UKI before building it, i.e. with dracut.
+package initrd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/cpio"
+)
+
+// Generator generates an initrd for a kernel version.
+type Generator interface {
+	// Generate writes the initrd of the kernel version to out.
+	Generate(kernelVersion, out string) error
+}
+
+// GeneratorFunc is a Generator calling the function.
+type GeneratorFunc func(kernelVersion, out string) error
+
+// Generate calls f.
+func (f GeneratorFunc) Generate(kernelVersion, out string) error {
+	return f(kernelVersion, out)
+}
+
+// Dracut generates the initrd with dracut, from the modules of the kernel version installed
+// in /lib/modules unless KernelModulesDir is set.
+type Dracut struct {
+	// Path to dracut, dracut in PATH when empty.
+	Path string
+	// Dracut modules to add, i.e. kairos-network.
+	Modules []string
+	// Dracut modules to leave out.
+	OmitModules []string
+	// Kernel drivers to add.
+	Drivers []string
+	// Directory of the kernel modules, /lib/modules/<version> by default.
+	KernelModulesDir string
+	// Whether to only include what the running host needs, the initrd is generic otherwise.
+	HostOnly bool
+	// Extra dracut arguments, added last.
+	Args []string
+}
+
+// Generate runs dracut, its output goes to stderr.
+func (d *Dracut) Generate(kernelVersion, out string) error {
+	path := d.Path
+	if path == "" {
+		path = "dracut"
+	}
+
+	cmd := exec.Command(path, d.args(kernelVersion, out)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("dracut failed: %w", err)
+	}
+
+	return nil
+}
+
+// args returns the arguments of dracut.
+func (d *Dracut) args(kernelVersion, out string) []string {
+	args := []string{"--force", "--kver", kernelVersion}
+
+	if d.HostOnly {
+		args = append(args, "--hostonly")
+	} else {
+		args = append(args, "--no-hostonly")
+	}
+
+	if len(d.Modules) > 0 {
+		args = append(args, "--add", strings.Join(d.Modules, " "))
+	}
+
+	if len(d.OmitModules) > 0 {
+		args = append(args, "--omit", strings.Join(d.OmitModules, " "))
+	}
+
+	if len(d.Drivers) > 0 {
+		args = append(args, "--add-drivers", strings.Join(d.Drivers, " "))
+	}
+
+	if d.KernelModulesDir != "" {
+		args = append(args, "--kmoddir", d.KernelModulesDir)
+	}
+
+	args = append(args, d.Args...)
+
+	return append(args, out)
+}
+
+// Directory archives an initramfs root directory as the initrd, for any kernel version.
+type Directory struct {
+	// Root directory of the initramfs.
+	Dir string
+	// Compression and reproducibility of the archive.
+	Options cpio.Options
+}
+
+// Generate writes the newc cpio archive of the directory.
+func (d *Directory) Generate(_, out string) error {
+	if err := cpio.WriteDirFile(out, d.Dir, d.Options); err != nil {
+		return fmt.Errorf("failed archiving %s: %w", d.Dir, err)
+	}
+
+	return nil
+}
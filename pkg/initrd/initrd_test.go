@@ -0,0 +1,65 @@
+package initrd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Initrd test Suite")
+}
+
+var _ = Describe("Dracut", func() {
+	It("Passes the modules, drivers and kernel version to dracut", func() {
+		dracut := &Dracut{
+			Modules:     []string{"kairos-network", "kairos-sysext"},
+			OmitModules: []string{"plymouth"},
+			Drivers:     []string{"virtio_blk"},
+			Args:        []string{"--compress", "zstd"},
+		}
+
+		Expect(dracut.args("6.1.0", "initrd")).To(Equal([]string{
+			"--force", "--kver", "6.1.0", "--no-hostonly",
+			"--add", "kairos-network kairos-sysext",
+			"--omit", "plymouth",
+			"--add-drivers", "virtio_blk",
+			"--compress", "zstd",
+			"initrd",
+		}))
+	})
+	It("Runs dracut to generate the initrd", func() {
+		dir := GinkgoT().TempDir()
+		script := filepath.Join(dir, "dracut")
+		// writes its arguments to the initrd, the last one
+		Expect(os.WriteFile(script, []byte("#!/bin/sh\nfor out; do :; done\necho \"$@\" > \"$out\"\n"), 0o755)).To(Succeed())
+
+		out := filepath.Join(dir, "initrd")
+		Expect((&Dracut{Path: script, HostOnly: true}).Generate("6.1.0", out)).To(Succeed())
+		Expect(os.ReadFile(out)).To(BeEquivalentTo("--force --kver 6.1.0 --hostonly " + out + "\n"))
+
+		Expect((&Dracut{Path: filepath.Join(dir, "missing")}).Generate("6.1.0", out)).To(MatchError(ContainSubstring("dracut failed")))
+	})
+})
+
+var _ = Describe("Directory", func() {
+	It("Archives the directory as the initrd", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "init"), []byte("#!/bin/sh\n"), 0o755)).To(Succeed())
+
+		out := filepath.Join(GinkgoT().TempDir(), "initrd")
+		Expect((&Directory{Dir: dir}).Generate("", out)).To(Succeed())
+
+		data, err := os.ReadFile(out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(HavePrefix("070701"))
+		Expect(string(data)).To(ContainSubstring("init\x00"))
+		Expect(string(data)).To(ContainSubstring("TRAILER!!!\x00"))
+
+		Expect((&Directory{Dir: filepath.Join(dir, "missing")}).Generate("", out)).To(MatchError(ContainSubstring("failed archiving")))
+	})
+})
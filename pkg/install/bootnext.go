@@ -0,0 +1,115 @@
+package install
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// bootCounter matches the boot counting suffix systemd-boot leaves out of the entry ids, i.e. +3-0.
+var bootCounter = regexp.MustCompile(`\+\d+(-\d+)?$`)
+
+// BootNext selects an installed entry for the next boot only, so an update can be test booted before it
+// is made the default. When it fails to boot, the boot after goes back to the default entry.
+//
+// By default the entry is selected through the systemd-boot LoaderEntryOneShot variable. With Firmware
+// the UEFI BootNext variable is used instead, for UKIs booted straight from the firmware.
+type BootNext struct {
+	// Mount point of the ESP, autodetected when empty.
+	ESPPath string
+	// Use BootNext with a Boot#### entry for the file instead of LoaderEntryOneShot.
+	Firmware bool
+	// Description of the Boot#### entry created for the file with Firmware.
+	Description string
+	// Only log the variables that would be written.
+	DryRun bool
+}
+
+// Set selects a file of the ESP for the next boot. It returns the systemd-boot entry id, or the
+// name of the Boot#### entry with Firmware.
+//
+// Without Firmware the file has to be a UKI in EFI/Linux/ or an entry in loader/entries/.
+func (b *BootNext) Set(path string) (string, error) {
+	if err := b.init(); err != nil {
+		return "", err
+	}
+
+	if b.Firmware {
+		manager := &BootManager{DryRun: b.DryRun}
+
+		entry, err := manager.AddEntry(b.ESPPath, path, b.Description, false)
+		if err != nil {
+			return "", err
+		}
+
+		return entry.Name(), manager.SetBootNext(entry.Number)
+	}
+
+	id, err := EntryID(b.ESPPath, path)
+	if err != nil {
+		return "", err
+	}
+
+	slots := &SlotManager{DryRun: b.DryRun}
+
+	return id, slots.writeLoaderVar("LoaderEntryOneShot", id)
+}
+
+// Clear cancels a pending next boot selection, through either variable.
+func (b *BootNext) Clear() error {
+	for _, v := range []struct{ name, guid string }{
+		{"LoaderEntryOneShot", efivars.LoaderGUID},
+		{"BootNext", efivars.GlobalGUID},
+	} {
+		if b.DryRun {
+			slog.Info("Would delete EFI variable", "name", v.name)
+
+			continue
+		}
+
+		if err := efivars.Delete(v.name, v.guid); err != nil {
+			return fmt.Errorf("failed deleting EFI variable %s: %w", v.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *BootNext) init() error {
+	if b.ESPPath == "" {
+		esp, err := FindESP()
+		if err != nil {
+			return err
+		}
+		slog.Info("Found ESP", "path", esp)
+		b.ESPPath = esp
+	}
+
+	return nil
+}
+
+// EntryID returns the systemd-boot entry id of a UKI in EFI/Linux/ or an entry in loader/entries/ of the
+// ESP mounted at espPath, its file name without the boot counting suffix, i.e. kairos-1.2.efi.
+func EntryID(espPath, path string) (string, error) {
+	rel, err := filepath.Rel(espPath, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s is not in the ESP %s", path, espPath))
+	}
+
+	dir, name := filepath.Split(filepath.ToSlash(rel))
+	ext := filepath.Ext(name)
+
+	switch {
+	case strings.EqualFold(dir, "EFI/Linux/") && strings.EqualFold(ext, ".efi"):
+	case dir == "loader/entries/" && ext == ".conf":
+	default:
+		return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s is neither a UKI in EFI/Linux/ nor an entry in loader/entries/", path))
+	}
+
+	return bootCounter.ReplaceAllString(strings.TrimSuffix(name, ext), "") + ext, nil
+}
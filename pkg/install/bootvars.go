@@ -0,0 +1,341 @@
+package install
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/gpt"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// LoadOptionActive is the attribute of boot entries the firmware considers for booting.
+const LoadOptionActive uint32 = 0x1
+
+// Device path node types and subtypes, from the UEFI specification section 10.3.
+const (
+	devicePathMedia         = 0x04
+	devicePathMediaHardDisk = 0x01
+	devicePathMediaFile     = 0x04
+	devicePathEnd           = 0x7f
+	devicePathEndEntire     = 0xff
+)
+
+// LoadOption is an EFI_LOAD_OPTION, the contents of a Boot#### variable.
+type LoadOption struct {
+	Attributes  uint32
+	Description string
+	// Device path list, as raw nodes.
+	FilePath     []byte
+	OptionalData []byte
+}
+
+// Marshal encodes the load option as stored in the Boot#### variables.
+func (o *LoadOption) Marshal() []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, o.Attributes)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(o.FilePath)))
+	buf = append(buf, efivars.EncodeUTF16(o.Description)...)
+	buf = append(buf, o.FilePath...)
+
+	return append(buf, o.OptionalData...)
+}
+
+// ParseLoadOption decodes the contents of a Boot#### variable.
+func ParseLoadOption(data []byte) (*LoadOption, error) {
+	if len(data) < 6 {
+		return nil, errors.New("load option is too short")
+	}
+
+	o := &LoadOption{Attributes: binary.LittleEndian.Uint32(data)}
+	pathLength := int(binary.LittleEndian.Uint16(data[4:]))
+	data = data[6:]
+
+	// the description is a NUL terminated UTF-16 string
+	end := -1
+	for i := 0; i+1 < len(data); i += 2 {
+		if data[i] == 0 && data[i+1] == 0 {
+			end = i
+			break
+		}
+	}
+
+	if end < 0 || end+2+pathLength > len(data) {
+		return nil, errors.New("load option is truncated")
+	}
+
+	o.Description = efivars.DecodeUTF16(data[:end])
+	o.FilePath = data[end+2 : end+2+pathLength]
+	o.OptionalData = data[end+2+pathLength:]
+
+	return o, nil
+}
+
+// File returns the path of the first file node of the device path, if any.
+func (o *LoadOption) File() string {
+	path := o.FilePath
+
+	for len(path) >= 4 {
+		typ, subtype, length := path[0], path[1], int(binary.LittleEndian.Uint16(path[2:]))
+		if length < 4 || length > len(path) || typ == devicePathEnd {
+			break
+		}
+
+		if typ == devicePathMedia && subtype == devicePathMediaFile {
+			return efivars.DecodeUTF16(path[4:length])
+		}
+
+		path = path[length:]
+	}
+
+	return ""
+}
+
+// FileDevicePath returns the device path of a file in a GPT partition, with the path relative
+// to the root of the partition and using backslashes, i.e. \EFI\systemd\systemd-bootx64.efi.
+func FileDevicePath(partition *gpt.Partition, path string) ([]byte, error) {
+	guid, err := gpt.ParseGUID(partition.GUID)
+	if err != nil {
+		return nil, err
+	}
+
+	// hard drive media node, 42 bytes
+	node := []byte{devicePathMedia, devicePathMediaHardDisk, 42, 0}
+	node = binary.LittleEndian.AppendUint32(node, uint32(partition.Number))
+	node = binary.LittleEndian.AppendUint64(node, partition.FirstLBA)
+	node = binary.LittleEndian.AppendUint64(node, partition.LastLBA-partition.FirstLBA+1)
+	node = append(node, guid[:]...)
+	// GPT partition format, GUID signature
+	node = append(node, 0x02, 0x02)
+
+	file := efivars.EncodeUTF16(path)
+	node = append(node, devicePathMedia, devicePathMediaFile)
+	node = binary.LittleEndian.AppendUint16(node, uint16(4+len(file)))
+	node = append(node, file...)
+
+	return append(node, devicePathEnd, devicePathEndEntire, 4, 0), nil
+}
+
+// BootEntry is a Boot#### variable.
+type BootEntry struct {
+	Number      uint16 `json:"number"`
+	Description string `json:"description"`
+	// File booted, relative to the root of its partition.
+	Path   string `json:"path"`
+	Active bool   `json:"active"`
+}
+
+// Name returns the name of the variable holding the entry, i.e. Boot0001.
+func (e *BootEntry) Name() string {
+	return bootVarName(e.Number)
+}
+
+// BootManager creates and orders the UEFI Boot#### variables through efivarfs, like efibootmgr.
+type BootManager struct {
+	// Only log the variables that would be written.
+	DryRun bool
+}
+
+// bootNumbers returns the numbers of the Boot#### variables, sorted, whether their load option can be
+// parsed or not.
+func bootNumbers() ([]uint16, error) {
+	paths, err := filepath.Glob(filepath.Join(efivars.Path, "Boot[0-9A-F][0-9A-F][0-9A-F][0-9A-F]-"+efivars.GlobalGUID))
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []uint16
+
+	for _, path := range paths {
+		number, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(path), "Boot")[:4], 16, 16)
+		if err != nil {
+			continue
+		}
+
+		numbers = append(numbers, uint16(number))
+	}
+
+	return numbers, nil
+}
+
+// Entries returns the Boot#### variables, sorted by number. The variables whose load option can't
+// be parsed are left out.
+func (m *BootManager) Entries() ([]BootEntry, error) {
+	numbers, err := bootNumbers()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []BootEntry
+
+	for _, number := range numbers {
+		data, err := efivars.Read(bootVarName(number), efivars.GlobalGUID)
+		if err != nil {
+			return nil, err
+		}
+
+		option, err := ParseLoadOption(data)
+		if err != nil {
+			slog.Debug("Skipping invalid boot entry", "name", bootVarName(number), "error", err)
+
+			continue
+		}
+
+		entries = append(entries, BootEntry{
+			Number:      number,
+			Description: option.Description,
+			Path:        option.File(),
+			Active:      option.Attributes&LoadOptionActive != 0,
+		})
+	}
+
+	return entries, nil
+}
+
+// BootOrder returns the BootOrder variable, or nothing if it is not set.
+func (m *BootManager) BootOrder() ([]uint16, error) {
+	data, err := efivars.Read("BootOrder", efivars.GlobalGUID)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]uint16, len(data)/2)
+	for i := range order {
+		order[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+
+	return order, nil
+}
+
+// SetBootOrder replaces the BootOrder variable.
+func (m *BootManager) SetBootOrder(order []uint16) error {
+	var data []byte
+	for _, number := range order {
+		data = binary.LittleEndian.AppendUint16(data, number)
+	}
+
+	return m.write("BootOrder", data)
+}
+
+// SetBootNext makes the firmware boot the entry on the next boot only, through the BootNext variable.
+func (m *BootManager) SetBootNext(number uint16) error {
+	return m.write("BootNext", binary.LittleEndian.AppendUint16(nil, number))
+}
+
+// AddEntry creates a Boot#### variable booting the given file of the ESP, mounted at espPath,
+// and puts it first in the BootOrder if first is set, or last if it is not in it yet.
+//
+// An entry with the same description and path is updated in place instead of duplicated.
+func (m *BootManager) AddEntry(espPath, file, description string, first bool) (*BootEntry, error) {
+	rel, err := filepath.Rel(espPath, file)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s is not in the ESP %s", file, espPath))
+	}
+
+	loaderPath := `\` + strings.ReplaceAll(rel, "/", `\`)
+
+	partition, err := MountedPartition(espPath)
+	if err != nil {
+		return nil, err
+	}
+
+	devicePath, err := FileDevicePath(partition, loaderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	option := &LoadOption{Attributes: LoadOptionActive, Description: description, FilePath: devicePath}
+
+	entries, err := m.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &BootEntry{Description: description, Path: loaderPath, Active: true}
+
+	if existing := findEntry(entries, description, loaderPath); existing != nil {
+		entry.Number = existing.Number
+	} else {
+		// the unparsed variables are used too, i.e. the firmware entries of unknown device paths
+		used, err := bootNumbers()
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Number, err = freeBootNumber(used); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = m.write(entry.Name(), option.Marshal()); err != nil {
+		return nil, err
+	}
+
+	order, err := m.BootOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case first:
+		order = append([]uint16{entry.Number}, slices.DeleteFunc(order, func(n uint16) bool { return n == entry.Number })...)
+	case !slices.Contains(order, entry.Number):
+		order = append(order, entry.Number)
+	default:
+		return entry, nil
+	}
+
+	return entry, m.SetBootOrder(order)
+}
+
+// write writes an EFI variable unless in dry run mode.
+func (m *BootManager) write(name string, data []byte) error {
+	if m.DryRun {
+		slog.Info("Would write EFI variable", "name", name, "size", len(data))
+
+		return nil
+	}
+
+	if err := efivars.Write(name, efivars.GlobalGUID, data); err != nil {
+		return fmt.Errorf("failed writing EFI variable %s: %w", name, err)
+	}
+
+	slog.Info("Wrote EFI variable", "name", name)
+
+	return nil
+}
+
+func findEntry(entries []BootEntry, description, path string) *BootEntry {
+	for i := range entries {
+		if entries[i].Description == description && strings.EqualFold(entries[i].Path, path) {
+			return &entries[i]
+		}
+	}
+
+	return nil
+}
+
+// freeBootNumber returns the lowest number not in used, the numbers of the Boot#### variables.
+func freeBootNumber(used []uint16) (uint16, error) {
+	for number := uint16(0); number < 0xffff; number++ {
+		if !slices.Contains(used, number) {
+			return number, nil
+		}
+	}
+
+	return 0, errors.New("no free boot entry number")
+}
+
+func bootVarName(number uint16) string {
+	return fmt.Sprintf("Boot%04X", number)
+}
@@ -0,0 +1,142 @@
+package install
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/gpt"
+)
+
+// ESPCandidates are the mount points probed, in order, when autodetecting the ESP.
+var ESPCandidates = []string{"/efi", "/boot", "/boot/efi"}
+
+// ErrNoESP is returned when no ESP could be found.
+var ErrNoESP = errors.New("could not find a mounted ESP")
+
+// mount is an entry in the mount table.
+type mount struct {
+	// Device number, as major:minor.
+	Device string
+	// Mount point.
+	Path string
+}
+
+// FindESP returns the mount point of the ESP, probing ESPCandidates.
+func FindESP() (string, error) {
+	for _, candidate := range ESPCandidates {
+		ok, err := IsESP(candidate)
+		if err != nil {
+			continue
+		}
+
+		if ok {
+			return candidate, nil
+		}
+	}
+
+	return "", ErrNoESP
+}
+
+// IsESP reports whether path is the mount point of a partition with the ESP GPT partition type.
+func IsESP(path string) (bool, error) {
+	partition, err := MountedPartition(path)
+	if err != nil {
+		return false, err
+	}
+
+	return partition.Type == gpt.ESPType, nil
+}
+
+// MountedPartition returns the GPT entry of the partition mounted at path.
+func MountedPartition(path string) (*gpt.Partition, error) {
+	m, err := findMount(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sysfs := filepath.Join("/sys/dev/block", m.Device)
+
+	number, err := readSysfsInt(filepath.Join(sysfs, "partition"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a partition: %w", path, err)
+	}
+
+	// /sys/dev/block/<maj:min> links to /sys/devices/.../block/<disk>/<partition>
+	partitionDir, err := filepath.EvalSymlinks(sysfs)
+	if err != nil {
+		return nil, err
+	}
+
+	disk := filepath.Join("/dev", filepath.Base(filepath.Dir(partitionDir)))
+
+	f, err := os.Open(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	table, err := gpt.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", disk, err)
+	}
+
+	partition, ok := table.Partition(number)
+	if !ok {
+		return nil, fmt.Errorf("partition %d not found in %s", number, disk)
+	}
+
+	return &partition, nil
+}
+
+// findMount returns the mount table entry whose mount point is exactly path.
+func findMount(path string) (*mount, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	var found *mount
+
+	// Format described in proc(5), the last mount on a path wins
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[4] != path {
+			continue
+		}
+
+		found = &mount{Device: fields[2], Path: fields[4]}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("%s is not a mount point", path)
+	}
+
+	return found, nil
+}
+
+func readSysfsInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,365 @@
+// Package install places built UKIs and boot loaders into an ESP.
+package install
+
+import (
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Installer copies UKIs, and optionally systemd-boot, into an ESP following the boot loader specification.
+//
+// UKIs are installed as type #2 entries under `EFI/Linux/<entry-token>-<version>.efi`.
+// Files are written next to their destination, synced and renamed over it, so an
+// interrupted install never leaves a truncated binary behind.
+type Installer struct {
+	// Mount point of the ESP, autodetected when empty.
+	ESPPath string
+	// Path to the UKI to install.
+	UKIPath string
+	// Path to a recovery UKI to install, optional. It is installed as `<entry-name>-recovery.efi`
+	// next to the main entry, which stays the loader.conf default, so systemd-boot offers it as
+	// the fallback to pick when the main entry does not boot.
+	RecoveryUKIPath string
+	// Path to the systemd-boot binary to install, optional.
+	SdBootPath string
+	// Whether to also install systemd-boot as the removable media fallback, EFI/BOOT/BOOT<ARCH>.EFI.
+	Fallback bool
+	// Path to shim, optional. When given, shim is installed as EFI/BOOT/BOOT<ARCH>.EFI and chain loads
+	// systemd-boot, or the UKI if there is no systemd-boot, installed as EFI/BOOT/grub<arch>.efi.
+	ShimPath string
+	// Path to MokManager, installed as EFI/BOOT/mm<arch>.efi next to shim, optional.
+	MokManagerPath string
+	// Entry token prefixing the entry name, see ResolveEntryToken. Defaults to EntryTokenAuto.
+	EntryToken string
+	// Name of the boot entry, derived from the entry token and the UKI os-release when empty.
+	EntryName string
+	// Whether to install a type #1 entry, with the kernel and initrd extracted from the UKI, instead of the UKI.
+	Type1 bool
+	// Description of a Boot#### entry to create, booting systemd-boot if installed or the UKI otherwise.
+	// No entry is created when empty.
+	BootEntry string
+	// Whether to select the installed entry for the next boot only, through systemd-boot LoaderEntryOneShot,
+	// so it can be test booted before becoming the default. See BootNext.
+	BootOnce bool
+	// Checks the ESP can hold the UKIs before copying anything, optional. Its ESP is the installer one.
+	Space *SpaceCheck
+	// systemd-boot configuration to write to loader/loader.conf, optional.
+	// The default entry matches the installed one when not set.
+	Loader *LoaderConfig
+}
+
+// Install copies the artifacts into the ESP and returns the paths written.
+func (i *Installer) Install() ([]string, error) {
+	if i.UKIPath == "" {
+		return nil, types.WithCategory(types.ErrInvalidInput, errors.New("no UKI to install"))
+	}
+
+	if i.ESPPath == "" {
+		esp, err := FindESP()
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Found ESP", "path", esp)
+		i.ESPPath = esp
+	}
+
+	var installed []string
+
+	// what the firmware boot entry, if any, points at
+	var bootFile string
+	// the installed systemd-boot entry
+	var entryFile string
+
+	osRelease, err := readOSRelease(i.UKIPath)
+	if err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	// an explicit entry name also stands for the token
+	name, token := i.EntryName, i.EntryName
+	if name == "" {
+		if token, err = ResolveEntryToken(i.EntryToken, osRelease); err != nil {
+			return nil, types.WithCategory(types.ErrInvalidInput, err)
+		}
+		name = entryName(token, osRelease)
+	}
+
+	if i.Space != nil {
+		if err = i.checkSpace(firstOf(osRelease, "IMAGE_ID", "ID")); err != nil {
+			return nil, err
+		}
+	}
+
+	if i.Type1 {
+		paths, err := i.installType1(token, name, osRelease)
+		if err != nil {
+			return nil, fmt.Errorf("failed installing type #1 entry: %w", err)
+		}
+		installed = append(installed, paths...)
+		entryFile = filepath.Join(i.ESPPath, "loader", "entries", name+".conf")
+	} else {
+		dst := filepath.Join(i.ESPPath, "EFI", "Linux", name+".efi")
+		if err = copyFile(i.UKIPath, dst); err != nil {
+			return nil, fmt.Errorf("failed installing UKI: %w", err)
+		}
+		slog.Info("Installed UKI", "path", dst)
+		installed = append(installed, dst)
+		bootFile = dst
+		entryFile = dst
+	}
+
+	if i.RecoveryUKIPath != "" {
+		dst := filepath.Join(i.ESPPath, "EFI", "Linux", name+"-"+uki.RecoveryVariant+".efi")
+		if err = copyFile(i.RecoveryUKIPath, dst); err != nil {
+			return nil, fmt.Errorf("failed installing recovery UKI: %w", err)
+		}
+		slog.Info("Installed recovery UKI", "path", dst)
+		installed = append(installed, dst)
+	}
+
+	// shim takes over the removable media path
+	fallback := i.Fallback && i.ShimPath == ""
+
+	if i.SdBootPath != "" {
+		arch, err := peArch(i.SdBootPath)
+		if err != nil {
+			return nil, types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		dsts := []string{filepath.Join(i.ESPPath, "EFI", "systemd", fmt.Sprintf("systemd-boot%s.efi", arch))}
+		if fallback {
+			dsts = append(dsts, filepath.Join(i.ESPPath, "EFI", "BOOT", fmt.Sprintf("BOOT%s.EFI", strings.ToUpper(arch))))
+		}
+
+		for _, dst := range dsts {
+			if err = copyFile(i.SdBootPath, dst); err != nil {
+				return nil, fmt.Errorf("failed installing systemd-boot: %w", err)
+			}
+			slog.Info("Installed systemd-boot", "path", dst)
+			installed = append(installed, dst)
+		}
+
+		bootFile = dsts[0]
+	}
+
+	if i.ShimPath != "" {
+		paths, err := i.installShim(bootFile)
+		if err != nil {
+			return nil, err
+		}
+		installed = append(installed, paths...)
+		bootFile = paths[0]
+	}
+
+	if i.Loader != nil {
+		loader := *i.Loader
+		switch {
+		case loader.Default != "":
+		case i.RecoveryUKIPath != "":
+			// the token would match the recovery entry too
+			loader.Default = name + ".efi"
+			if i.Type1 {
+				loader.Default = name + ".conf"
+			}
+		default:
+			loader.Default = token + "*"
+		}
+
+		dst := filepath.Join(i.ESPPath, "loader", "loader.conf")
+		if err = loader.Write(dst); err != nil {
+			return nil, fmt.Errorf("failed writing loader configuration: %w", err)
+		}
+		slog.Info("Wrote loader configuration", "path", dst)
+		installed = append(installed, dst)
+	}
+
+	if i.BootEntry != "" {
+		if bootFile == "" {
+			return nil, types.WithCategory(types.ErrInvalidInput, errors.New("a boot entry for a type #1 entry needs systemd-boot"))
+		}
+
+		entry, err := (&BootManager{}).AddEntry(i.ESPPath, bootFile, i.BootEntry, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed creating boot entry: %w", err)
+		}
+		slog.Info("Created boot entry", "name", entry.Name(), "description", entry.Description, "path", entry.Path)
+	}
+
+	if i.BootOnce {
+		if _, err = (&BootNext{ESPPath: i.ESPPath}).Set(entryFile); err != nil {
+			return nil, fmt.Errorf("failed selecting the entry for the next boot: %w", err)
+		}
+	}
+
+	return installed, nil
+}
+
+// checkSpace checks the ESP can hold the UKIs to install, for a new version of the id OS.
+func (i *Installer) checkSpace(id string) error {
+	var needed int64
+
+	for _, path := range []string{i.UKIPath, i.RecoveryUKIPath} {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+		needed += info.Size()
+	}
+
+	check := *i.Space
+	check.ESPPath = i.ESPPath
+
+	_, err := check.Check(needed, id)
+
+	return err
+}
+
+// installShim installs shim and MokManager into EFI/BOOT/, with the given file as the second
+// stage shim loads. It returns the paths written, shim first.
+func (i *Installer) installShim(second string) ([]string, error) {
+	if second == "" {
+		return nil, types.WithCategory(types.ErrInvalidInput, errors.New("shim needs systemd-boot to boot a type #1 entry"))
+	}
+
+	arch, err := peArch(i.ShimPath)
+	if err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	dir := filepath.Join(i.ESPPath, "EFI", "BOOT")
+
+	files := []struct{ src, dst string }{
+		{i.ShimPath, filepath.Join(dir, fmt.Sprintf("BOOT%s.EFI", strings.ToUpper(arch)))},
+		// shim loads the second stage from its own directory with the grub name
+		{second, filepath.Join(dir, fmt.Sprintf("grub%s.efi", arch))},
+	}
+
+	if i.MokManagerPath != "" {
+		files = append(files, struct{ src, dst string }{i.MokManagerPath, filepath.Join(dir, fmt.Sprintf("mm%s.efi", arch))})
+	}
+
+	var installed []string
+
+	for _, file := range files {
+		if err = copyFile(file.src, file.dst); err != nil {
+			return nil, fmt.Errorf("failed installing shim: %w", err)
+		}
+		slog.Info("Installed shim chain", "path", file.dst)
+		installed = append(installed, file.dst)
+	}
+
+	return installed, nil
+}
+
+// EntryName returns the boot loader specification name of a UKI, as `<id>-<version>`,
+// from the IMAGE_ID/ID and IMAGE_VERSION/VERSION_ID fields of its .osrel section.
+func EntryName(ukiPath string) (string, error) {
+	osRelease, err := readOSRelease(ukiPath)
+	if err != nil {
+		return "", err
+	}
+
+	id := firstOf(osRelease, "IMAGE_ID", "ID")
+	if id == "" {
+		return "", fmt.Errorf("os-release in %s has no ID", ukiPath)
+	}
+
+	return entryName(id, osRelease), nil
+}
+
+// EntryNameWithToken returns the boot loader specification name of a UKI, as `<entry-token>-<version>`,
+// with the version from the IMAGE_VERSION/VERSION_ID fields of its .osrel section.
+func EntryNameWithToken(ukiPath, token string) (string, error) {
+	osRelease, err := readOSRelease(ukiPath)
+	if err != nil {
+		return "", err
+	}
+
+	token, err = ResolveEntryToken(token, osRelease)
+	if err != nil {
+		return "", err
+	}
+
+	return entryName(token, osRelease), nil
+}
+
+func entryName(token string, osRelease map[string]string) string {
+	version := firstOf(osRelease, "IMAGE_VERSION", "VERSION_ID")
+	if version == "" {
+		return token
+	}
+
+	return token + "-" + version
+}
+
+func readOSRelease(ukiPath string) (map[string]string, error) {
+	data, err := uki.GetSection(ukiPath, constants.OSRel)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading os-release from %s: %w", ukiPath, err)
+	}
+
+	return utils.ParseOSRelease(data), nil
+}
+
+func firstOf(values map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if values[key] != "" {
+			return values[key]
+		}
+	}
+
+	return ""
+}
+
+// peArch returns the EFI architecture name of a PE file.
+func peArch(path string) (string, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	return utils.EFIArch(f.Machine)
+}
+
+// copyFile atomically replaces dst with the contents of src.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close() //nolint:errcheck
+
+	return writeFile(dst, in)
+}
+
+// writeFile atomically replaces dst with the contents of r, see utils.WriteFileAtomic, creating
+// its directory if missing.
+func writeFile(dst string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(dst, 0o644, func(w io.Writer) error {
+		_, err := utils.Copy(w, r)
+
+		return err
+	})
+}
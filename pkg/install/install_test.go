@@ -0,0 +1,427 @@
+package install
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/gpt"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Install test Suite")
+}
+
+var _ = Describe("Install tests", func() {
+	var esp string
+
+	BeforeEach(func() {
+		esp = GinkgoT().TempDir()
+	})
+
+	Describe("Installer", func() {
+		It("Installs the UKI and systemd-boot with its fallback", func() {
+			installer := &Installer{
+				ESPPath:    esp,
+				UKIPath:    "../pesign/testdata/file.efi",
+				SdBootPath: "../pesign/testdata/file.efi",
+				Fallback:   true,
+				EntryToken: "token",
+			}
+
+			installed, err := installer.Install()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(installed).To(Equal([]string{
+				filepath.Join(esp, "EFI", "Linux", "token.efi"),
+				filepath.Join(esp, "EFI", "systemd", "systemd-bootx64.efi"),
+				filepath.Join(esp, "EFI", "BOOT", "BOOTX64.EFI"),
+			}))
+
+			// no temporary files are left behind
+			entries, err := os.ReadDir(filepath.Join(esp, "EFI", "Linux"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+	})
+	Describe("Shim", func() {
+		It("Installs shim chain loading systemd-boot instead of the systemd-boot fallback", func() {
+			installer := &Installer{
+				ESPPath:        esp,
+				UKIPath:        "../pesign/testdata/file.efi",
+				SdBootPath:     "../pesign/testdata/file.efi",
+				ShimPath:       "../pesign/testdata/file.efi",
+				MokManagerPath: "../pesign/testdata/file.efi",
+				Fallback:       true,
+				EntryToken:     "token",
+			}
+
+			installed, err := installer.Install()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(installed).To(Equal([]string{
+				filepath.Join(esp, "EFI", "Linux", "token.efi"),
+				filepath.Join(esp, "EFI", "systemd", "systemd-bootx64.efi"),
+				filepath.Join(esp, "EFI", "BOOT", "BOOTX64.EFI"),
+				filepath.Join(esp, "EFI", "BOOT", "grubx64.efi"),
+				filepath.Join(esp, "EFI", "BOOT", "mmx64.efi"),
+			}))
+		})
+	})
+	Describe("ResolveEntryToken", func() {
+		osRelease := map[string]string{"ID": "kairos", "IMAGE_ID": "kairos-core"}
+
+		BeforeEach(func() {
+			oldToken, oldMachineID := entryTokenPath, machineIDPath
+			entryTokenPath = filepath.Join(esp, "entry-token")
+			machineIDPath = filepath.Join(esp, "machine-id")
+			DeferCleanup(func() {
+				entryTokenPath, machineIDPath = oldToken, oldMachineID
+			})
+		})
+
+		It("Falls back from the entry-token file to the machine ID and the os-release", func() {
+			Expect(ResolveEntryToken(EntryTokenAuto, osRelease)).To(Equal("kairos-core"))
+
+			Expect(os.WriteFile(machineIDPath, []byte("0123456789abcdef\n"), 0o600)).To(Succeed())
+			Expect(ResolveEntryToken(EntryTokenAuto, osRelease)).To(Equal("0123456789abcdef"))
+
+			Expect(os.WriteFile(entryTokenPath, []byte("custom\n"), 0o600)).To(Succeed())
+			Expect(ResolveEntryToken("", osRelease)).To(Equal("custom"))
+		})
+		It("Picks the requested source", func() {
+			Expect(ResolveEntryToken(EntryTokenOSID, osRelease)).To(Equal("kairos"))
+			Expect(ResolveEntryToken(EntryTokenOSImageID, osRelease)).To(Equal("kairos-core"))
+			Expect(ResolveEntryToken("literal", osRelease)).To(Equal("literal"))
+
+			_, err := ResolveEntryToken(EntryTokenMachineID, osRelease)
+			Expect(err).To(HaveOccurred())
+			_, err = ResolveEntryToken("a/b", osRelease)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("LoaderConfig", func() {
+		It("Writes only the set options", func() {
+			loader := &LoaderConfig{Timeout: "5", ConsoleMode: "max"}
+			Expect(loader.Marshal()).To(Equal([]byte("timeout 5\nconsole-mode max\n")))
+		})
+		It("Rejects unknown console modes", func() {
+			_, err := (&LoaderConfig{ConsoleMode: "huge"}).Marshal()
+			Expect(err).To(HaveOccurred())
+		})
+		It("Defaults to the installed entry", func() {
+			installer := &Installer{
+				ESPPath:    esp,
+				UKIPath:    "../pesign/testdata/file.efi",
+				EntryToken: "token",
+				Loader:     &LoaderConfig{Timeout: "0"},
+			}
+
+			_, err := installer.Install()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.ReadFile(filepath.Join(esp, "loader", "loader.conf"))).To(Equal([]byte("timeout 0\ndefault token*\n")))
+		})
+		It("Keeps the default on the main entry with a recovery UKI", func() {
+			installer := &Installer{
+				ESPPath:         esp,
+				UKIPath:         "../pesign/testdata/file.efi",
+				RecoveryUKIPath: "../pesign/testdata/file.efi",
+				EntryToken:      "token",
+				Loader:          &LoaderConfig{},
+			}
+
+			installed, err := installer.Install()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(installed).To(ContainElement(filepath.Join(esp, "EFI", "Linux", "token-recovery.efi")))
+			Expect(os.ReadFile(filepath.Join(esp, "loader", "loader.conf"))).To(Equal([]byte("default token.efi\n")))
+		})
+	})
+	Describe("Type1Entry", func() {
+		It("Lists every initrd", func() {
+			entry := &Type1Entry{Title: "Kairos", Version: "1.0", Options: "console=ttyS0", Linux: "/t/1.0/linux", Initrd: []string{"/t/1.0/initrd", "/t/1.0/extra"}}
+			Expect(string(entry.Marshal())).To(Equal("title Kairos\nversion 1.0\noptions console=ttyS0\nlinux /t/1.0/linux\ninitrd /t/1.0/initrd\ninitrd /t/1.0/extra\n"))
+		})
+	})
+	Describe("CompareVersions", func() {
+		DescribeTable("Sorts like systemd-boot",
+			func(a, b string, expected int) {
+				Expect(CompareVersions(a, b)).To(Equal(expected))
+				Expect(CompareVersions(b, a)).To(Equal(-expected))
+			},
+			Entry("equal", "1.2.3", "1.2.3", 0),
+			Entry("numeric runs", "1.10", "1.9", 1),
+			Entry("leading zeros", "1.02", "1.2", 0),
+			Entry("longer", "1.2.1", "1.2", 1),
+			Entry("tilde", "1.0~rc1", "1.0", -1),
+			Entry("numbers over letters", "1.0.1", "1.0.a", 1),
+			Entry("letters", "1.0b", "1.0a", 1),
+		)
+	})
+	Describe("Pruner", func() {
+		// versionedUKI builds a UKI of the kairos OS version.
+		versionedUKI := func(version string) string {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "os-release"), []byte("ID=kairos\nVERSION_ID="+version+"\n"), 0o600)).To(Succeed())
+
+			builder := &uki.Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OsRelease:  filepath.Join(dir, "os-release"),
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			return builder.OutUKIPath
+		}
+
+		BeforeEach(func() {
+			old := efivars.Path
+			efivars.Path = GinkgoT().TempDir()
+			DeferCleanup(func() { efivars.Path = old })
+		})
+
+		It("Keeps the most recent versions of each OS and the protected entries", func() {
+			entries := []ukiEntry{
+				{path: "EFI/Linux/kairos-1.9.efi", id: "kairos", version: "1.9"},
+				{path: "EFI/Linux/kairos-1.10.efi", id: "kairos", version: "1.10"},
+				{path: "EFI/Linux/kairos-1.8.efi", id: "kairos", version: "1.8"},
+				{path: "EFI/Linux/kairos-1.7.efi", id: "kairos", version: "1.7"},
+				{path: "EFI/Linux/other-1.0.efi", id: "other", version: "1.0"},
+			}
+
+			pruned := selectPruned(entries, 2, []string{"kairos-1.7.efi"})
+			Expect(pruned).To(Equal([]ukiEntry{{path: "EFI/Linux/kairos-1.8.efi", id: "kairos", version: "1.8"}}))
+		})
+		It("Counts the entries of the same version as one version", func() {
+			entries := []ukiEntry{
+				{path: "EFI/Linux/kairos-1.efi", id: "kairos", version: "1"},
+				{path: "EFI/Linux/kairos-a.efi", id: "kairos", version: "2"},
+				{path: "EFI/Linux/kairos-b.efi", id: "kairos", version: "2"},
+				{path: "EFI/Linux/kairos-1-recovery.efi", id: "kairos", version: "1"},
+			}
+
+			Expect(selectPruned(entries, 2, nil)).To(BeEmpty())
+			Expect(selectPruned(entries, 1, nil)).To(Equal([]ukiEntry{entries[0], entries[3]}))
+		})
+		It("Prunes the recovery UKIs with their version", func() {
+			for _, version := range []string{"1", "2"} {
+				_, err := (&Installer{ESPPath: esp, UKIPath: versionedUKI(version), RecoveryUKIPath: versionedUKI(version), EntryToken: "kairos"}).Install()
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			removed, err := (&Pruner{ESPPath: esp, Keep: 2}).Prune()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed).To(BeEmpty())
+
+			removed, err = (&Pruner{ESPPath: esp, Keep: 1}).Prune()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed).To(ConsistOf(filepath.Join(esp, "EFI", "Linux", "kairos-1.efi"), filepath.Join(esp, "EFI", "Linux", "kairos-1-recovery.efi")))
+			Expect(filepath.Join(esp, "EFI", "Linux", "kairos-2.efi")).To(BeAnExistingFile())
+			Expect(filepath.Join(esp, "EFI", "Linux", "kairos-2-recovery.efi")).To(BeAnExistingFile())
+		})
+		It("Keeps the entries systemd-boot booted, boots by default and boots next", func() {
+			for _, version := range []string{"1", "2", "3", "4"} {
+				_, err := (&Installer{ESPPath: esp, UKIPath: versionedUKI(version), EntryToken: "kairos"}).Install()
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Expect(efivars.Write("LoaderEntrySelected", efivars.LoaderGUID, efivars.EncodeUTF16("kairos-1.efi"))).To(Succeed())
+			Expect(efivars.Write("LoaderEntryDefault", efivars.LoaderGUID, efivars.EncodeUTF16("kairos-2.efi"))).To(Succeed())
+			Expect(efivars.Write("LoaderEntryOneShot", efivars.LoaderGUID, efivars.EncodeUTF16("KAIROS-3.EFI"))).To(Succeed())
+
+			removed, err := (&Pruner{ESPPath: esp, Keep: 1}).Prune()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed).To(BeEmpty())
+
+			Expect(efivars.Delete("LoaderEntryOneShot", efivars.LoaderGUID)).To(Succeed())
+			removed, err = (&Pruner{ESPPath: esp, Keep: 1}).Prune()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed).To(Equal([]string{filepath.Join(esp, "EFI", "Linux", "kairos-3.efi")}))
+		})
+		It("Requires keeping at least one version", func() {
+			_, err := (&Pruner{ESPPath: esp}).Prune()
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+		})
+	})
+	Describe("SpaceCheck", func() {
+		It("Assumes the kept versions have the new one size without an ESP", func() {
+			space, err := (&SpaceCheck{Budget: 1000, Keep: 3}).Check(400, "kairos")
+			Expect(err).To(MatchError(ErrNoSpace))
+			Expect(err).To(MatchError(ContainSubstring("400 bytes needed, 200 available")))
+			Expect(space.Used).To(Equal(int64(800)))
+
+			_, err = (&SpaceCheck{Budget: 1000, Keep: 2}).Check(400, "kairos")
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("Counts the files on the ESP against the budget", func() {
+			Expect(os.WriteFile(filepath.Join(esp, "file"), make([]byte, 100), 0o644)).To(Succeed())
+
+			space, err := (&SpaceCheck{ESPPath: esp, Budget: 1000}).Check(900, "kairos")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(space.Available()).To(Equal(int64(900)))
+
+			_, err = (&SpaceCheck{ESPPath: esp, Budget: 1000}).Check(901, "kairos")
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+		})
+	})
+	Describe("BootManager", func() {
+		BeforeEach(func() {
+			old := efivars.Path
+			efivars.Path = esp
+			DeferCleanup(func() { efivars.Path = old })
+		})
+
+		It("Encodes load options pointing at a file in a partition", func() {
+			partition := &gpt.Partition{Number: 1, GUID: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b", FirstLBA: 2048, LastLBA: 1050623}
+			devicePath, err := FileDevicePath(partition, `\EFI\systemd\systemd-bootx64.efi`)
+			Expect(err).ToNot(HaveOccurred())
+
+			option := &LoadOption{Attributes: LoadOptionActive, Description: "Linux Boot Manager", FilePath: devicePath}
+			parsed, err := ParseLoadOption(option.Marshal())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.Description).To(Equal("Linux Boot Manager"))
+			Expect(parsed.File()).To(Equal(`\EFI\systemd\systemd-bootx64.efi`))
+			Expect(parsed.FilePath).To(Equal(devicePath))
+		})
+		It("Lists the entries and the boot order", func() {
+			manager := &BootManager{}
+			option := &LoadOption{Attributes: LoadOptionActive, Description: "Linux Boot Manager"}
+			Expect(efivars.Write("Boot0001", efivars.GlobalGUID, option.Marshal())).To(Succeed())
+			Expect(manager.SetBootOrder([]uint16{1, 0x1a})).To(Succeed())
+
+			entries, err := manager.Entries()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(Equal([]BootEntry{{Number: 1, Description: "Linux Boot Manager", Active: true}}))
+			Expect(manager.BootOrder()).To(Equal([]uint16{1, 0x1a}))
+			Expect(freeBootNumber([]uint16{1})).To(Equal(uint16(0)))
+		})
+		It("Takes the variables it can't parse as used", func() {
+			// a firmware entry the load options are not parsed of
+			Expect(efivars.Write("Boot0000", efivars.GlobalGUID, []byte{1, 0, 0, 0})).To(Succeed())
+			option := &LoadOption{Attributes: LoadOptionActive, Description: "Linux Boot Manager"}
+			Expect(efivars.Write("Boot0001", efivars.GlobalGUID, option.Marshal())).To(Succeed())
+
+			entries, err := (&BootManager{}).Entries()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+
+			used, err := bootNumbers()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(used).To(Equal([]uint16{0, 1}))
+			Expect(freeBootNumber(used)).To(Equal(uint16(2)))
+		})
+		It("Does not write anything in dry run mode", func() {
+			Expect((&BootManager{DryRun: true}).SetBootOrder([]uint16{1})).To(Succeed())
+			Expect(filepath.Join(esp, "BootOrder-"+efivars.GlobalGUID)).ToNot(BeAnExistingFile())
+		})
+	})
+	Describe("SlotManager", func() {
+		var manager *SlotManager
+
+		BeforeEach(func() {
+			old := efivars.Path
+			efivars.Path = GinkgoT().TempDir()
+			DeferCleanup(func() { efivars.Path = old })
+
+			manager = &SlotManager{ESPPath: esp, EntryToken: "kairos"}
+		})
+
+		It("Updates the slot not booted for the next boot only and confirms it", func() {
+			slot, path, err := manager.Update("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(slot).To(Equal(SlotA))
+			Expect(path).To(Equal(filepath.Join(esp, "EFI", "Linux", "kairos-a.efi")))
+			Expect(efivars.ReadString("LoaderEntryOneShot", efivars.LoaderGUID)).To(Equal("kairos-a.efi"))
+
+			// systemd-boot booted the new slot
+			Expect(efivars.Write("LoaderEntrySelected", efivars.LoaderGUID, efivars.EncodeUTF16("kairos-a.efi"))).To(Succeed())
+			status, err := manager.Status()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status.Pending).To(BeTrue())
+
+			Expect(manager.Confirm()).To(Equal(SlotA))
+			Expect(efivars.ReadString("LoaderEntryDefault", efivars.LoaderGUID)).To(Equal("kairos-a.efi"))
+
+			slot, _, err = manager.Update("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(slot).To(Equal(SlotB))
+		})
+		It("Refuses to update from a pending slot", func() {
+			Expect(efivars.Write("LoaderEntryDefault", efivars.LoaderGUID, efivars.EncodeUTF16("kairos-a.efi"))).To(Succeed())
+			Expect(efivars.Write("LoaderEntrySelected", efivars.LoaderGUID, efivars.EncodeUTF16("kairos-b.efi"))).To(Succeed())
+
+			_, _, err := manager.Update("../pesign/testdata/file.efi")
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+			Expect(filepath.Join(esp, "EFI", "Linux", "kairos-a.efi")).ToNot(BeAnExistingFile())
+			_, err = efivars.ReadString("LoaderEntryOneShot", efivars.LoaderGUID)
+			Expect(err).To(MatchError(os.ErrNotExist))
+
+			Expect(manager.Confirm()).To(Equal(SlotB))
+			Expect(manager.Update("../pesign/testdata/file.efi")).Error().ToNot(HaveOccurred())
+			Expect(efivars.ReadString("LoaderEntryOneShot", efivars.LoaderGUID)).To(Equal("kairos-a.efi"))
+		})
+		It("Reads back the entry token resolved from the os-release of the update", func() {
+			manager.EntryToken = EntryTokenOSID
+			_, path, err := manager.Update("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(path).To(Equal(filepath.Join(esp, "EFI", "Linux", "systemd-boot-a.efi")))
+
+			Expect(efivars.Write("LoaderEntrySelected", efivars.LoaderGUID, efivars.EncodeUTF16("systemd-boot-a.efi"))).To(Succeed())
+			manager = &SlotManager{ESPPath: esp, EntryToken: EntryTokenOSID}
+			Expect(manager.Confirm()).To(Equal(SlotA))
+			Expect(efivars.ReadString("LoaderEntryDefault", efivars.LoaderGUID)).To(Equal("systemd-boot-a.efi"))
+		})
+		It("Rolls back to the other slot", func() {
+			Expect(efivars.Write("LoaderEntrySelected", efivars.LoaderGUID, efivars.EncodeUTF16("kairos-b.efi"))).To(Succeed())
+			Expect(efivars.Write("LoaderEntryOneShot", efivars.LoaderGUID, efivars.EncodeUTF16("kairos-b.efi"))).To(Succeed())
+
+			_, err := manager.Rollback()
+			Expect(err).To(HaveOccurred())
+
+			Expect(copyFile("../pesign/testdata/file.efi", filepath.Join(esp, "EFI", "Linux", "kairos-a.efi"))).To(Succeed())
+			Expect(manager.Rollback()).To(Equal(SlotA))
+			Expect(efivars.ReadString("LoaderEntryDefault", efivars.LoaderGUID)).To(Equal("kairos-a.efi"))
+			_, err = efivars.ReadString("LoaderEntryOneShot", efivars.LoaderGUID)
+			Expect(err).To(MatchError(os.ErrNotExist))
+		})
+	})
+	Describe("BootNext", func() {
+		BeforeEach(func() {
+			old := efivars.Path
+			efivars.Path = GinkgoT().TempDir()
+			DeferCleanup(func() { efivars.Path = old })
+		})
+
+		It("Selects an installed UKI for the next boot and clears it", func() {
+			next := &BootNext{ESPPath: esp}
+
+			id, err := next.Set(filepath.Join(esp, "EFI", "Linux", "kairos-1.2+3-0.efi"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal("kairos-1.2.efi"))
+			Expect(efivars.ReadString("LoaderEntryOneShot", efivars.LoaderGUID)).To(Equal("kairos-1.2.efi"))
+
+			Expect(next.Clear()).To(Succeed())
+			_, err = efivars.Read("LoaderEntryOneShot", efivars.LoaderGUID)
+			Expect(err).To(MatchError(os.ErrNotExist))
+		})
+		It("Derives entry ids of type #1 entries and rejects other files", func() {
+			Expect(EntryID(esp, filepath.Join(esp, "loader", "entries", "kairos-1.2+1.conf"))).To(Equal("kairos-1.2.conf"))
+			_, err := EntryID(esp, filepath.Join(esp, "EFI", "BOOT", "BOOTX64.EFI"))
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+			_, err = EntryID(esp, "/elsewhere/kairos.efi")
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+		})
+		It("Selects the installed entry when installing", func() {
+			installed, err := (&Installer{ESPPath: esp, UKIPath: "../pesign/testdata/file.efi", EntryToken: "token", BootOnce: true}).Install()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(efivars.ReadString("LoaderEntryOneShot", efivars.LoaderGUID)).To(Equal(filepath.Base(installed[0])))
+		})
+	})
+})
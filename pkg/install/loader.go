@@ -0,0 +1,161 @@
+package install
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+)
+
+// ConsoleModes accepted by systemd-boot in loader.conf.
+var ConsoleModes = []string{"0", "1", "2", "auto", "max", "keep"}
+
+// LoaderConfig is the systemd-boot configuration, see loader.conf(5).
+//
+// Empty fields are left out, so systemd-boot uses its defaults.
+type LoaderConfig struct {
+	// Menu timeout in seconds, or one of menu-force, menu-hidden, menu-disabled.
+	Timeout string
+	// Glob matching the id of the default entry.
+	Default string
+	// Console mode, one of ConsoleModes.
+	ConsoleMode string
+}
+
+// Marshal returns the loader.conf contents.
+func (c *LoaderConfig) Marshal() ([]byte, error) {
+	if c.ConsoleMode != "" && !slices.Contains(ConsoleModes, c.ConsoleMode) {
+		return nil, fmt.Errorf("invalid console mode %q, expected one of %s", c.ConsoleMode, strings.Join(ConsoleModes, ", "))
+	}
+
+	var buf bytes.Buffer
+
+	for _, option := range []struct{ key, value string }{
+		{"timeout", c.Timeout},
+		{"default", c.Default},
+		{"console-mode", c.ConsoleMode},
+	} {
+		if option.value != "" {
+			fmt.Fprintf(&buf, "%s %s\n", option.key, option.value)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Write atomically writes the configuration to path.
+func (c *LoaderConfig) Write(path string) error {
+	data, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, bytes.NewReader(data))
+}
+
+// Type1Entry is a boot loader specification type #1 entry, see
+// https://uapi-group.org/specifications/specs/boot_loader_specification/.
+type Type1Entry struct {
+	Title   string
+	Version string
+	SortKey string
+	Options string
+	// Paths to the kernel and initrds, relative to the root of the ESP.
+	Linux  string
+	Initrd []string
+}
+
+// Marshal returns the entry file contents.
+func (e *Type1Entry) Marshal() []byte {
+	var buf bytes.Buffer
+
+	for _, option := range []struct{ key, value string }{
+		{"title", e.Title},
+		{"version", e.Version},
+		{"sort-key", e.SortKey},
+		{"options", e.Options},
+		{"linux", e.Linux},
+	} {
+		if option.value != "" {
+			fmt.Fprintf(&buf, "%s %s\n", option.key, option.value)
+		}
+	}
+
+	for _, initrd := range e.Initrd {
+		fmt.Fprintf(&buf, "initrd %s\n", initrd)
+	}
+
+	return buf.Bytes()
+}
+
+// installType1 extracts the kernel and initrd of the UKI into `<entry-token>/<version>/` and
+// writes a `loader/entries/<name>.conf` entry booting them with the UKI cmdline.
+func (i *Installer) installType1(token, name string, osRelease map[string]string) ([]string, error) {
+	version := firstOf(osRelease, "IMAGE_VERSION", "VERSION_ID")
+	if version == "" {
+		version = name
+	}
+
+	entry := &Type1Entry{
+		Title:   firstOf(osRelease, "PRETTY_NAME", "NAME", "ID"),
+		Version: version,
+		SortKey: firstOf(osRelease, "IMAGE_ID", "ID"),
+	}
+
+	cmdline, err := uki.GetSection(i.UKIPath, constants.CMDLine)
+	if err != nil && !errors.Is(err, uki.ErrSectionNotFound) {
+		return nil, err
+	}
+
+	entry.Options = strings.TrimSpace(string(bytes.TrimRight(cmdline, "\x00")))
+
+	var installed []string
+
+	// paths in entries are relative to the ESP root and always use slashes
+	dir := path.Join("/", token, version)
+
+	for _, file := range []struct {
+		section  constants.Section
+		name     string
+		required bool
+	}{
+		{constants.Linux, "linux", true},
+		{constants.Initrd, "initrd", false},
+	} {
+		data, err := uki.GetSection(i.UKIPath, file.section)
+		if errors.Is(err, uki.ErrSectionNotFound) && !file.required {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		dst := filepath.Join(i.ESPPath, filepath.FromSlash(dir), file.name)
+		if err = writeFile(dst, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		installed = append(installed, dst)
+
+		if file.section == constants.Linux {
+			entry.Linux = path.Join(dir, file.name)
+		} else {
+			entry.Initrd = append(entry.Initrd, path.Join(dir, file.name))
+		}
+	}
+
+	dst := filepath.Join(i.ESPPath, "loader", "entries", name+".conf")
+	if err = writeFile(dst, bytes.NewReader(entry.Marshal())); err != nil {
+		return nil, err
+	}
+	slog.Info("Installed type #1 entry", "path", dst)
+
+	return append(installed, dst), nil
+}
@@ -0,0 +1,210 @@
+package install
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Pruner removes old type #2 entries from the ESP, keeping the most recent versions of each OS.
+//
+// UKIs are grouped by the IMAGE_ID/ID of their .osrel section and sorted by IMAGE_VERSION/VERSION_ID.
+// The UKIs of the same version, like a recovery UKI or the A/B slots, are kept or removed together.
+// UKIs without a version are never removed, neither are the ones systemd-boot booted, boots by
+// default or boots next, see LoaderEntries.
+type Pruner struct {
+	// Mount point of the ESP, autodetected when empty.
+	ESPPath string
+	// Number of versions to keep for each OS, at least 1.
+	Keep int
+	// File names under EFI/Linux/ never removed, on top of the loader entries.
+	Protect []string
+	// Only report what would be removed.
+	DryRun bool
+}
+
+// ukiEntry is a UKI found on the ESP.
+type ukiEntry struct {
+	path    string
+	id      string
+	version string
+}
+
+// Prune removes the old UKIs, along with their addon directories, and returns the paths removed.
+func (p *Pruner) Prune() ([]string, error) {
+	if p.Keep < 1 {
+		return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("at least one version has to be kept, got %d", p.Keep))
+	}
+
+	if p.ESPPath == "" {
+		esp, err := FindESP()
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Found ESP", "path", esp)
+		p.ESPPath = esp
+	}
+
+	entries, err := p.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	loaderEntries, err := LoaderEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	protected := append(slices.Clone(p.Protect), loaderEntries...)
+
+	var removed []string
+
+	for _, entry := range selectPruned(entries, p.Keep, protected) {
+		paths := []string{entry.path}
+		if _, err = os.Stat(entry.path + ".extra.d"); err == nil {
+			paths = append(paths, entry.path+".extra.d")
+		}
+
+		for _, path := range paths {
+			if !p.DryRun {
+				if err = os.RemoveAll(path); err != nil {
+					return removed, err
+				}
+			}
+
+			slog.Info("Pruned", "path", path, "version", entry.version, "dry-run", p.DryRun)
+			removed = append(removed, path)
+		}
+	}
+
+	return removed, nil
+}
+
+// selectPruned returns the entries to remove, all but the entries of the keep most recent versions
+// of each OS and the protected ones.
+func selectPruned(entries []ukiEntry, keep int, protected []string) []ukiEntry {
+	groups := map[string][]ukiEntry{}
+	for _, entry := range entries {
+		groups[entry.id] = append(groups[entry.id], entry)
+	}
+
+	var pruned []ukiEntry
+
+	for _, id := range sortedKeys(groups) {
+		group := groups[id]
+
+		sort.SliceStable(group, func(i, j int) bool {
+			return CompareVersions(group[i].version, group[j].version) > 0
+		})
+
+		// the entries of a version, i.e. the recovery UKI or the A/B slots, count as one version
+		versions := 0
+
+		for i, entry := range group {
+			if i == 0 || CompareVersions(entry.version, group[i-1].version) != 0 {
+				versions++
+			}
+
+			if versions <= keep {
+				continue
+			}
+
+			if slices.ContainsFunc(protected, func(id string) bool { return strings.EqualFold(id, filepath.Base(entry.path)) }) {
+				slog.Info("Keeping protected UKI", "path", entry.path, "version", entry.version)
+
+				continue
+			}
+
+			pruned = append(pruned, entry)
+		}
+	}
+
+	return pruned
+}
+
+// entries lists the versioned UKIs in EFI/Linux/.
+func (p *Pruner) entries() ([]ukiEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(p.ESPPath, "EFI", "Linux", "*.efi"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ukiEntry
+
+	for _, path := range paths {
+		osRelease, err := readOSRelease(path)
+		if err != nil {
+			slog.Debug("Skipping file without os-release", "path", path, "error", err)
+
+			continue
+		}
+
+		entry := ukiEntry{
+			path:    path,
+			id:      firstOf(osRelease, "IMAGE_ID", "ID"),
+			version: firstOf(osRelease, "IMAGE_VERSION", "VERSION_ID"),
+		}
+
+		if entry.version == "" {
+			slog.Debug("Skipping UKI without version", "path", path)
+
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// BootedEntry returns the id of the entry systemd-boot booted, from the LoaderEntrySelected EFI variable.
+//
+// For type #2 entries the id is the file name of the UKI under EFI/Linux/.
+func BootedEntry() (string, error) {
+	return efivars.ReadString("LoaderEntrySelected", efivars.LoaderGUID)
+}
+
+// loaderEntryVariables are the systemd-boot variables naming the entries pruning never removes: the
+// one booted, the default one and the one selected for the next boot only.
+var loaderEntryVariables = []string{"LoaderEntrySelected", "LoaderEntryDefault", "LoaderEntryOneShot"}
+
+// LoaderEntries returns the ids of the entries systemd-boot booted, boots by default and boots next,
+// from the loaderEntryVariables set.
+func LoaderEntries() ([]string, error) {
+	var entries []string
+
+	for _, variable := range loaderEntryVariables {
+		entry, err := efivars.ReadString(variable, efivars.LoaderGUID)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %w", variable, err)
+		}
+
+		slog.Debug("Protecting loader entry", "variable", variable, "entry", entry)
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
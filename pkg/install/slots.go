@@ -0,0 +1,289 @@
+package install
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Slot is one of the two UKI slots of an A/B update layout.
+type Slot string
+
+// The A/B slots.
+const (
+	SlotA Slot = "a"
+	SlotB Slot = "b"
+)
+
+// Other returns the other slot, slot A for an empty slot.
+func (s Slot) Other() Slot {
+	if s == SlotA {
+		return SlotB
+	}
+
+	return SlotA
+}
+
+// SlotManager implements A/B updates of a UKI.
+//
+// Each slot is a type #2 entry, `EFI/Linux/<entry-token>-<slot>.efi`. An update goes to the slot
+// not booted and is selected for the next boot only, through LoaderEntryOneShot. If it fails to
+// boot, systemd-boot falls back to the default entry, the previous slot, on the following boot.
+// Once the update is known to work, Confirm makes it the default, Rollback goes back instead.
+type SlotManager struct {
+	// Mount point of the ESP, autodetected when empty.
+	ESPPath string
+	// Entry token prefixing the slot entries, see ResolveEntryToken.
+	// Resolved against the os-release of the installed UKI during updates and saved on the ESP,
+	// the other operations read it back.
+	EntryToken string
+	// Only log the variables and files that would be written.
+	DryRun bool
+}
+
+// Entry returns the entry id of a slot, i.e. kairos-a.efi.
+func (m *SlotManager) Entry(slot Slot) string {
+	return fmt.Sprintf("%s-%s.efi", m.EntryToken, slot)
+}
+
+// Booted returns the slot systemd-boot booted, falling back to the default one if it did not boot
+// a slot. It is empty when no slot is in use yet.
+func (m *SlotManager) Booted() (Slot, error) {
+	for _, variable := range []string{"LoaderEntrySelected", "LoaderEntryDefault"} {
+		entry, err := efivars.ReadString(variable, efivars.LoaderGUID)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if slot, ok := m.slotOf(entry); ok {
+			return slot, nil
+		}
+	}
+
+	return "", nil
+}
+
+// SlotStatus is the state of the A/B slots.
+type SlotStatus struct {
+	// Slot booted, empty if none.
+	Booted Slot `json:"booted,omitempty"`
+	// Entries systemd-boot boots by default and on the next boot only, empty if the variables are not set.
+	Default string `json:"default,omitempty"`
+	OneShot string `json:"oneShot,omitempty"`
+	// Whether the update in the booted slot still has to be confirmed.
+	Pending bool `json:"pending"`
+}
+
+// Status returns the state of the slots.
+func (m *SlotManager) Status() (*SlotStatus, error) {
+	if err := m.resolveToken(); err != nil {
+		return nil, err
+	}
+
+	booted, err := m.Booted()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &SlotStatus{Booted: booted}
+
+	for variable, value := range map[string]*string{"LoaderEntryDefault": &status.Default, "LoaderEntryOneShot": &status.OneShot} {
+		if *value, err = efivars.ReadString(variable, efivars.LoaderGUID); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	status.Pending = booted != "" && !strings.EqualFold(status.Default, m.Entry(booted))
+
+	return status, nil
+}
+
+// Update installs the UKI into the slot not booted and selects it for the next boot only.
+// It refuses to while the booted slot is pending, see Confirm and Rollback. It returns the slot updated and the path of the installed UKI.
+func (m *SlotManager) Update(ukiPath string) (Slot, string, error) {
+	if err := m.init(); err != nil {
+		return "", "", err
+	}
+
+	osRelease, err := readOSRelease(ukiPath)
+	if err != nil {
+		return "", "", types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	if m.EntryToken, err = ResolveEntryToken(m.EntryToken, osRelease); err != nil {
+		return "", "", types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	status, err := m.Status()
+	if err != nil {
+		return "", "", err
+	}
+
+	// The default slot is the only one known to boot while the booted one is pending, updating
+	// would overwrite it.
+	if status.Pending {
+		return "", "", types.WithCategory(types.ErrInvalidInput,
+			fmt.Errorf("booted slot %s is not confirmed, confirm or roll it back before updating", status.Booted))
+	}
+
+	slot := status.Booted.Other()
+	dst := filepath.Join(m.ESPPath, "EFI", "Linux", m.Entry(slot))
+
+	if m.DryRun {
+		slog.Info("Would install UKI", "slot", slot, "path", dst)
+	} else {
+		if err = copyFile(ukiPath, dst); err != nil {
+			return "", "", fmt.Errorf("failed installing UKI: %w", err)
+		}
+		slog.Info("Installed UKI", "slot", slot, "path", dst)
+
+		if err = writeFile(m.tokenPath(), strings.NewReader(m.EntryToken+"\n")); err != nil {
+			return "", "", fmt.Errorf("failed saving the entry token: %w", err)
+		}
+	}
+
+	if err = m.writeLoaderVar("LoaderEntryOneShot", m.Entry(slot)); err != nil {
+		return "", "", err
+	}
+
+	return slot, dst, nil
+}
+
+// Confirm makes the booted slot the default one.
+func (m *SlotManager) Confirm() (Slot, error) {
+	if err := m.resolveToken(); err != nil {
+		return "", err
+	}
+
+	entry, err := BootedEntry()
+	if err != nil {
+		return "", fmt.Errorf("failed reading the booted entry: %w", err)
+	}
+
+	slot, ok := m.slotOf(entry)
+	if !ok {
+		return "", fmt.Errorf("booted entry %s is not a slot", entry)
+	}
+
+	return slot, m.writeLoaderVar("LoaderEntryDefault", m.Entry(slot))
+}
+
+// Rollback makes the slot not booted the default one and cancels a pending one-shot boot.
+func (m *SlotManager) Rollback() (Slot, error) {
+	if err := m.resolveToken(); err != nil {
+		return "", err
+	}
+
+	booted, err := m.Booted()
+	if err != nil {
+		return "", err
+	}
+
+	slot := booted.Other()
+	if _, err = os.Stat(filepath.Join(m.ESPPath, "EFI", "Linux", m.Entry(slot))); err != nil {
+		return "", fmt.Errorf("slot %s has no UKI to roll back to: %w", slot, err)
+	}
+
+	if err = m.deleteLoaderVar("LoaderEntryOneShot"); err != nil {
+		return "", err
+	}
+
+	return slot, m.writeLoaderVar("LoaderEntryDefault", m.Entry(slot))
+}
+
+func (m *SlotManager) init() error {
+	if m.ESPPath == "" {
+		esp, err := FindESP()
+		if err != nil {
+			return err
+		}
+		slog.Info("Found ESP", "path", esp)
+		m.ESPPath = esp
+	}
+
+	return nil
+}
+
+// resolveToken resolves the entry token without an os-release to look at, reading back the one
+// the last update saved unless the token is a literal one.
+func (m *SlotManager) resolveToken() error {
+	if err := m.init(); err != nil {
+		return err
+	}
+
+	switch m.EntryToken {
+	case "", EntryTokenAuto, EntryTokenMachineID, EntryTokenOSID, EntryTokenOSImageID:
+		token, err := readToken(m.tokenPath())
+		if err == nil {
+			m.EntryToken = token
+
+			return nil
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed reading the entry token: %w", err)
+		}
+	}
+
+	token, err := ResolveEntryToken(m.EntryToken, nil)
+	if err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	m.EntryToken = token
+
+	return nil
+}
+
+// tokenPath returns the path of the entry token saved by Update, like the entry-token file of
+// kernel-install but on the ESP: the os-release it is resolved from is in the slot UKIs.
+func (m *SlotManager) tokenPath() string {
+	return filepath.Join(m.ESPPath, "loader", "entry-token")
+}
+
+// slotOf returns the slot of an entry id, if it is one of ours.
+func (m *SlotManager) slotOf(entry string) (Slot, bool) {
+	for _, slot := range []Slot{SlotA, SlotB} {
+		if strings.EqualFold(entry, m.Entry(slot)) {
+			return slot, true
+		}
+	}
+
+	return "", false
+}
+
+func (m *SlotManager) writeLoaderVar(name, value string) error {
+	if m.DryRun {
+		slog.Info("Would write EFI variable", "name", name, "value", value)
+
+		return nil
+	}
+
+	if err := efivars.Write(name, efivars.LoaderGUID, efivars.EncodeUTF16(value)); err != nil {
+		return fmt.Errorf("failed writing EFI variable %s: %w", name, err)
+	}
+
+	slog.Info("Wrote EFI variable", "name", name, "value", value)
+
+	return nil
+}
+
+func (m *SlotManager) deleteLoaderVar(name string) error {
+	if m.DryRun {
+		slog.Info("Would delete EFI variable", "name", name)
+
+		return nil
+	}
+
+	return efivars.Delete(name, efivars.LoaderGUID)
+}
@@ -0,0 +1,157 @@
+package install
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// ErrNoSpace is returned when the ESP can not hold a new UKI.
+var ErrNoSpace = errors.New("not enough space on the ESP")
+
+// SpaceCheck checks an ESP can hold a new UKI next to the versions retained by pruning.
+type SpaceCheck struct {
+	// Mount point of the ESP, autodetected when empty unless there is a Budget.
+	ESPPath string
+	// Size of the ESP in bytes, used instead of the file system size and free space when set.
+	// The space used is then the size of the files on the ESP, or without an ESP, the older
+	// versions kept are assumed to be the size of the new one.
+	Budget int64
+	// Number of versions of each OS kept on the ESP, the new one included, see Pruner.Keep.
+	// Older versions beyond it count as free space. Nothing is assumed pruned when 0.
+	Keep int
+}
+
+// Space is the outcome of a SpaceCheck.
+type Space struct {
+	// Size of the ESP in bytes.
+	Total int64 `json:"total"`
+	// Bytes in use on the ESP.
+	Used int64 `json:"used"`
+	// Bytes used by the UKIs pruning would remove.
+	Reclaimable int64 `json:"reclaimable"`
+	// Bytes needed for the new UKI.
+	Needed int64 `json:"needed"`
+}
+
+// Available returns the bytes available for the new UKI once pruned.
+func (s *Space) Available() int64 {
+	return s.Total - s.Used + s.Reclaimable
+}
+
+// Check returns ErrNoSpace if needed bytes do not fit on the ESP, for a new version of the OS with the given id.
+//
+// The id is the IMAGE_ID/ID of the new UKI, its OS keeps one older version less as the new one takes its place.
+func (c *SpaceCheck) Check(needed int64, id string) (*Space, error) {
+	if c.ESPPath == "" && c.Budget > 0 {
+		space := &Space{Total: c.Budget, Needed: needed}
+		if c.Keep > 1 {
+			space.Used = needed * int64(c.Keep-1)
+		}
+
+		return space, space.check(fmt.Sprintf("budget of %d bytes", c.Budget), c.Keep)
+	}
+
+	if c.ESPPath == "" {
+		esp, err := FindESP()
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Found ESP", "path", esp)
+		c.ESPPath = esp
+	}
+
+	space := &Space{Needed: needed}
+
+	var err error
+
+	if c.Budget > 0 {
+		space.Total = c.Budget
+		space.Used, err = usedSpace(c.ESPPath)
+	} else {
+		space.Total, space.Used, err = fsSpace(c.ESPPath)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed getting the ESP size: %w", err)
+	}
+
+	if c.Keep > 0 {
+		if space.Reclaimable, err = c.reclaimable(id); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.Debug("ESP space", "total", space.Total, "used", space.Used, "reclaimable", space.Reclaimable, "needed", needed)
+
+	return space, space.check(c.ESPPath, c.Keep)
+}
+
+// check returns ErrNoSpace with the numbers if the needed bytes are not available.
+func (s *Space) check(where string, keep int) error {
+	if s.Needed <= s.Available() {
+		return nil
+	}
+
+	return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%w, %s: %d bytes needed, %d available (%d total, %d used, %d reclaimable keeping %d versions)",
+		ErrNoSpace, where, s.Needed, s.Available(), s.Total, s.Used, s.Reclaimable, keep))
+}
+
+// reclaimable returns the size of the UKIs pruning would remove once the new version of the id OS is installed.
+func (c *SpaceCheck) reclaimable(id string) (int64, error) {
+	entries, err := (&Pruner{ESPPath: c.ESPPath}).entries()
+	if err != nil {
+		return 0, err
+	}
+
+	var same, others []ukiEntry
+
+	for _, entry := range entries {
+		if entry.id == id {
+			same = append(same, entry)
+		} else {
+			others = append(others, entry)
+		}
+	}
+
+	// the booted entry may be among the pruned ones, it is only known on the target and counted as reclaimable
+	pruned := append(selectPruned(same, c.Keep-1, nil), selectPruned(others, c.Keep, nil)...)
+
+	var size int64
+
+	for _, entry := range pruned {
+		info, err := os.Stat(entry.path)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
+// usedSpace returns the size of the files under dir.
+func usedSpace(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+
+		return nil
+	})
+
+	return size, err
+}
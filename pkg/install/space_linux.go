@@ -0,0 +1,18 @@
+package install
+
+import "golang.org/x/sys/unix"
+
+// fsSpace returns the size and the bytes used of the file system mounted at path.
+func fsSpace(path string) (total, used int64, err error) {
+	var st unix.Statfs_t
+
+	if err = unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	total = int64(st.Blocks) * st.Bsize
+	// root reserved blocks are not available to the install either
+	used = total - int64(st.Bavail)*st.Bsize
+
+	return total, used, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package install
+
+import "errors"
+
+// fsSpace is not implemented outside of Linux, a budget has to be given instead.
+func fsSpace(string) (int64, int64, error) {
+	return 0, 0, errors.New("reading the file system size is only supported on Linux, give a size budget instead")
+}
@@ -0,0 +1,82 @@
+package install
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Entry token values with a special meaning, as understood by kernel-install(8).
+const (
+	// EntryTokenAuto uses /etc/kernel/entry-token, the machine ID, IMAGE_ID or ID, whichever is found first.
+	EntryTokenAuto = "auto"
+	// EntryTokenMachineID uses the machine ID.
+	EntryTokenMachineID = "machine-id"
+	// EntryTokenOSID uses the ID field of the os-release.
+	EntryTokenOSID = "os-id"
+	// EntryTokenOSImageID uses the IMAGE_ID field of the os-release.
+	EntryTokenOSImageID = "os-image-id"
+)
+
+var (
+	entryTokenPath = "/etc/kernel/entry-token"
+	machineIDPath  = "/etc/machine-id"
+)
+
+// ResolveEntryToken returns the entry token prefixing the boot entries of the given os-release.
+//
+// Token is one of the EntryToken* values, or a literal token. An empty token means EntryTokenAuto.
+func ResolveEntryToken(token string, osRelease map[string]string) (string, error) {
+	switch token {
+	case "", EntryTokenAuto:
+		if data, err := readToken(entryTokenPath); err == nil {
+			return data, nil
+		}
+
+		if id, err := readToken(machineIDPath); err == nil {
+			return id, nil
+		}
+
+		if id := firstOf(osRelease, "IMAGE_ID", "ID"); id != "" {
+			return id, nil
+		}
+
+		return "", errors.New("could not find an entry token: no entry-token file, machine ID or os-release ID")
+	case EntryTokenMachineID:
+		return readToken(machineIDPath)
+	case EntryTokenOSID:
+		return requireField(osRelease, "ID")
+	case EntryTokenOSImageID:
+		return requireField(osRelease, "IMAGE_ID")
+	}
+
+	if strings.ContainsAny(token, "/ ") {
+		return "", fmt.Errorf("invalid entry token %q", token)
+	}
+
+	return token, nil
+}
+
+// readToken reads a single line token file, failing if it is missing or empty.
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" || token == "uninitialized" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+
+	return token, nil
+}
+
+func requireField(osRelease map[string]string, key string) (string, error) {
+	if osRelease[key] == "" {
+		return "", fmt.Errorf("os-release has no %s", key)
+	}
+
+	return osRelease[key], nil
+}
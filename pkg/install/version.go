@@ -0,0 +1,97 @@
+package install
+
+import (
+	"strings"
+	"unicode"
+)
+
+// CompareVersions compares two versions the way systemd-boot sorts entries, returning
+// -1, 0 or 1 if a is older, equal or newer than b.
+//
+// Versions are split into numeric and alphabetic runs, compared numerically and
+// lexically respectively, ignoring separators. A numeric run is newer than an
+// alphabetic one, and a `~` makes the version older than one without it, so
+// `1.0~rc1` sorts before `1.0`.
+func CompareVersions(a, b string) int {
+	for {
+		a = strings.TrimLeftFunc(a, isVersionSeparator)
+		b = strings.TrimLeftFunc(b, isVersionSeparator)
+
+		// a tilde sorts before anything, even the end of the version
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+
+			a, b = a[1:], b[1:]
+
+			continue
+		}
+
+		if a == "" || b == "" {
+			return compare(len(a), len(b))
+		}
+
+		aDigit, bDigit := isDigit(rune(a[0])), isDigit(rune(b[0]))
+		if aDigit != bDigit {
+			if aDigit {
+				return 1
+			}
+
+			return -1
+		}
+
+		var aRun, bRun string
+
+		if aDigit {
+			aRun, a = splitRun(a, isDigit)
+			bRun, b = splitRun(b, isDigit)
+
+			aRun = strings.TrimLeft(aRun, "0")
+			bRun = strings.TrimLeft(bRun, "0")
+
+			if c := compare(len(aRun), len(bRun)); c != 0 {
+				return c
+			}
+		} else {
+			aRun, a = splitRun(a, unicode.IsLetter)
+			bRun, b = splitRun(b, unicode.IsLetter)
+		}
+
+		if c := strings.Compare(aRun, bRun); c != 0 {
+			return c
+		}
+	}
+}
+
+func splitRun(s string, f func(rune) bool) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool { return !f(r) })
+	if i < 0 {
+		return s, ""
+	}
+
+	return s[:i], s[i:]
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isVersionSeparator(r rune) bool {
+	return r != '~' && !isDigit(r) && !unicode.IsLetter(r)
+}
+
+func compare(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,99 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package measure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"unicode/utf16"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// AddonCmdlineData returns the bytes systemd-stub measures for the cmdline carried by an addon.
+//
+// The stub converts the cmdline to UTF-16, replaces ASCII control characters with spaces, strips the
+// trailing spaces, i.e. of a final newline, and measures the string including its NUL terminator.
+// ref: https://github.com/systemd/systemd/blob/v254/src/boot/efi/stub.c mangle_stub_cmdline
+func AddonCmdlineData(cmdline string) []byte {
+	encoded := utf16.Encode([]rune(cmdline))
+
+	for i, c := range encoded {
+		if c <= 0x1f {
+			encoded[i] = ' '
+		}
+	}
+
+	for len(encoded) > 0 && encoded[len(encoded)-1] == ' ' {
+		encoded = encoded[:len(encoded)-1]
+	}
+
+	data := make([]byte, 0, (len(encoded)+1)*2)
+	for _, c := range encoded {
+		data = binary.LittleEndian.AppendUint16(data, c)
+	}
+
+	return append(data, 0, 0)
+}
+
+// CalculateAddonMeasurements returns the events systemd-stub extends into PCR 12 when loading an addon
+// made of the given sections, for each bank. The initrd of the addon is read from the contents given
+// with WithContents, the other options are ignored.
+func CalculateAddonMeasurements(sectionsData SectionsData, opts ...Option) ([]types.PCREvent, error) {
+	o := newOptions(opts)
+
+	var events []types.PCREvent
+
+	type payload struct {
+		description string
+		data        io.Reader
+	}
+
+	var payloads []payload
+
+	if path := sectionsData[constants.CMDLine]; path != "" {
+		cmdline, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload{string(constants.CMDLine), bytes.NewReader(AddonCmdlineData(string(cmdline)))})
+	}
+
+	if path := sectionsData[constants.DTB]; path != "" {
+		dtb, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, payload{string(constants.DTB), bytes.NewReader(dtb)})
+	}
+
+	if source := o.contents[constants.Initrd]; source != nil {
+		payloads = append(payloads, payload{string(constants.Initrd), source.Open()})
+	}
+
+	_, algos := types.GetTPMALGorithm()
+	for _, p := range payloads {
+		sums, err := hashReader(p.data, algos)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, alg := range algos {
+			hashAlg, _ := alg.Alg.Hash() //nolint:errcheck
+			events = append(events, types.PCREvent{
+				PCR:         constants.KernelConfigPCR,
+				Algorithm:   hashAlg.String(),
+				Digest:      hex.EncodeToString(sums[i]),
+				Description: p.description,
+			})
+		}
+	}
+
+	return events, nil
+}
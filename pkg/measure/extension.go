@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package measure
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Suffixes of the extension images systemd-stub picks up from `<uki>.extra.d/`.
+const (
+	SysextSuffix  = ".sysext.raw"
+	ConfextSuffix = ".confext.raw"
+)
+
+// ExtensionPCR returns the PCR systemd-stub measures an extension image with this file name into,
+// PCR 13 for system extensions and PCR 12 for configuration extensions, or false if it does not pick
+// it up. The suffix is matched ignoring the case, as the stub does.
+func ExtensionPCR(name string) (int, bool) {
+	name = strings.ToLower(name)
+
+	switch {
+	case strings.HasSuffix(name, SysextSuffix):
+		return constants.SysextPCR, true
+	case strings.HasSuffix(name, ConfextSuffix):
+		return constants.KernelConfigPCR, true
+	default:
+		return 0, false
+	}
+}
+
+// SortExtensions sorts the extension image paths by file name, the order systemd-stub measures them in.
+func SortExtensions(paths []string) []string {
+	sorted := append([]string(nil), paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return filepath.Base(sorted[i]) < filepath.Base(sorted[j])
+	})
+
+	return sorted
+}
+
+// CalculateExtensionMeasurements returns the events systemd-stub extends when picking up the extension
+// images, for each bank and in the order it measures them, and the expected PCR 13 values after each
+// of the phases.
+//
+// The stub measures the contents of each image, system extensions into PCR 13 and configuration
+// extensions into PCR 12, where they follow the cmdline and addons measurements so only the events are
+// returned. Nothing else extends PCR 13 during boot.
+// ref: https://github.com/systemd/systemd/blob/v255/src/boot/efi/stub.c
+func CalculateExtensionMeasurements(paths []string, phases []types.PhaseInfo) ([]types.PCREvent, []types.PCRMeasurement, error) {
+	_, algos := types.GetTPMALGorithm()
+
+	sysext := make([]*pcr.Digest, len(algos))
+
+	var events []types.PCREvent
+
+	for i, alg := range algos {
+		hashAlg, err := alg.Alg.Hash()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sysext[i] = pcr.NewDigest(hashAlg)
+	}
+
+	for _, path := range SortExtensions(paths) {
+		index, ok := ExtensionPCR(filepath.Base(path))
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not a system or configuration extension image, its name must end in %s or %s", path, SysextSuffix, ConfextSuffix)
+		}
+
+		sums, err := hashFile(path, algos)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i, alg := range algos {
+			hashAlg, _ := alg.Alg.Hash() //nolint:errcheck
+
+			if index == constants.SysextPCR {
+				sysext[i].ExtendDigest(sums[i])
+			}
+
+			events = append(events, types.PCREvent{
+				PCR:         index,
+				Algorithm:   hashAlg.String(),
+				Digest:      hex.EncodeToString(sums[i]),
+				Description: filepath.Base(path),
+			})
+		}
+	}
+
+	var measurements []types.PCRMeasurement
+
+	for i, alg := range algos {
+		hashAlg, _ := alg.Alg.Hash() //nolint:errcheck
+
+		for _, phase := range phases {
+			measurements = append(measurements, types.PCRMeasurement{
+				Phase:     string(phase.Phase),
+				PCR:       constants.SysextPCR,
+				Algorithm: hashAlg.String(),
+				Digest:    hex.EncodeToString(sysext[i].Hash()),
+			})
+		}
+	}
+
+	return events, measurements, nil
+}
+
+// hashFile hashes the file once for all the banks.
+func hashFile(path string, algos []types.Algorithm) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	return hashReader(f, algos)
+}
+
+// hashReader hashes the data once for all the banks.
+func hashReader(r io.Reader, algos []types.Algorithm) ([][]byte, error) {
+	hashes := make([]hash.Hash, len(algos))
+	writers := make([]io.Writer, len(algos))
+
+	for i, alg := range algos {
+		hashAlg, err := alg.Alg.Hash()
+		if err != nil {
+			return nil, err
+		}
+
+		hashes[i] = hashAlg.New()
+		writers[i] = hashes[i]
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return nil, err
+	}
+
+	sums := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		sums[i] = h.Sum(nil)
+	}
+
+	return sums, nil
+}
@@ -8,8 +8,11 @@
 package measure
 
 import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/hex"
-	"fmt"
+	"encoding/pem"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
 	"github.com/kairos-io/go-ukify/pkg/types"
@@ -22,17 +25,23 @@ import (
 type SectionsData map[constants.Section]string
 
 // GenerateSignedPCR generates the PCR signed data for a given set of UKI file sections.
-func GenerateSignedPCR(sectionsData SectionsData, phases []types.PhaseInfo, rsaKey types.RSAKey, PCR int) (*types.PCRData, error) {
+func GenerateSignedPCR(sectionsData SectionsData, phases []types.PhaseInfo, rsaKey types.RSAKey, PCR int, opts ...Option) (*types.PCRData, error) {
+	o := newOptions(opts)
 	data := &types.PCRData{}
-	slog.Debug("Generating PCR data", "sections", sectionsData)
+	o.logger.Debug("Generating PCR data", "sections", sectionsData)
 
 	data, algos := types.GetTPMALGorithm()
+	digests, err := hashSections(algos, sectionsData, o)
+	if err != nil {
+		return nil, err
+	}
 	for _, alg := range algos {
 		banks := make([]types.BankData, 0)
-		hash, err := pcr.MeasureSections(alg.Alg, sectionsData)
+		hashAlg, err := alg.Alg.Hash()
 		if err != nil {
 			return nil, err
 		}
+		hash := pcr.MeasureSectionDigests(hashAlg, digests)
 		for _, phase := range phases {
 			hash = pcr.MeasurePhase(phase, alg.Alg, hash)
 			bank, err := pcr.SignPolicy(PCR, alg.Alg, rsaKey, hash)
@@ -48,21 +57,78 @@ func GenerateSignedPCR(sectionsData SectionsData, phases []types.PhaseInfo, rsaK
 }
 
 // GenerateMeasurements generates the PCR measurements for a given set of UKI file sections and phases
-func GenerateMeasurements(sectionsData SectionsData, phases []types.PhaseInfo, PCR int) {
-	slog.Debug("Generating PCR data", "sections", sectionsData)
-	slog.Info("Not signing data, just outputting it to stdout")
-	slog.Info("legend: <PHASE:PCR:ALGORITHM=HASH>")
+func GenerateMeasurements(sectionsData SectionsData, phases []types.PhaseInfo, PCR int, opts ...Option) ([]types.PCRMeasurement, error) {
+	o := newOptions(opts)
+	o.logger.Debug("Generating PCR data", "sections", sectionsData)
+	o.logger.Info("Not signing data, just outputting it to stdout")
+
+	measurements, err := CalculateMeasurements(sectionsData, phases, PCR, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range measurements {
+		o.logger.Info("PCR measurement", "phase", m.Phase, "pcr", m.PCR, "algorithm", m.Algorithm, "digest", m.Digest)
+	}
+
+	return measurements, nil
+}
+
+// CalculateMeasurements returns the expected PCR values for each bank after each of the given phases.
+func CalculateMeasurements(sectionsData SectionsData, phases []types.PhaseInfo, PCR int, opts ...Option) ([]types.PCRMeasurement, error) {
+	o := newOptions(opts)
+	var measurements []types.PCRMeasurement
 
 	_, algos := types.GetTPMALGorithm()
+	digests, err := hashSections(algos, sectionsData, o)
+	if err != nil {
+		return nil, err
+	}
 	for _, alg := range algos {
-		hash, _ := pcr.MeasureSections(alg.Alg, sectionsData)
+		al, err := alg.Alg.Hash()
+		if err != nil {
+			return nil, err
+		}
+		hash := pcr.MeasureSectionDigests(al, digests)
 		for _, phase := range phases {
 			pcr.MeasurePhase(phase, alg.Alg, hash)
-			al, _ := alg.Alg.Hash()
-			slog.Info(fmt.Sprintf("%s:%d:%s=%s", phase.Phase, PCR, al.String(), hex.EncodeToString(hash.Hash())))
+			measurements = append(measurements, types.PCRMeasurement{
+				Phase:     string(phase.Phase),
+				PCR:       PCR,
+				Algorithm: al.String(),
+				Digest:    hex.EncodeToString(hash.Hash()),
+			})
 		}
+	}
+
+	return measurements, nil
+}
+
+// hashSections hashes the sections once for all the banks.
+func hashSections(algos []types.Algorithm, sectionsData SectionsData, o options) (pcr.SectionDigests, error) {
+	hashes := make([]crypto.Hash, 0, len(algos))
+	for _, alg := range algos {
+		hashAlg, err := alg.Alg.Hash()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hashAlg)
+	}
 
+	return pcr.HashSectionContents(hashes, sectionsData, o.contents, o.cache, o.progress)
+}
+
+// PublicKeyPEM encodes the public key of the PCR signing key as systemd expects it in the .pcrpkey section.
+func PublicKeyPEM(key *rsa.PublicKey) ([]byte, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
 	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  constants.PEMTypeRSAPublic,
+		Bytes: publicKeyBytes,
+	}), nil
 }
 
 func PrintSystemdMeasurements(phase string, sectionsData SectionsData, privKey string) {
@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package measure
+
+import (
+	"log/slog"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Option configures how the sections are measured.
+type Option func(*options)
+
+type options struct {
+	progress pcr.ProgressFunc
+	cache    *pcr.HashCache
+	contents map[constants.Section]*types.SectionSource
+	logger   *slog.Logger
+}
+
+// WithProgress reports the progress of hashing each section, once for all the banks.
+func WithProgress(progress pcr.ProgressFunc) Option {
+	return func(o *options) {
+		o.progress = progress
+	}
+}
+
+// WithHashCache reuses the section digests of the cache, instead of the one set with pcr.SetHashCache.
+func WithHashCache(cache *pcr.HashCache) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// WithContents measures the sections read from the sources along with the files of SectionsData.
+func WithContents(contents map[constants.Section]*types.SectionSource) Option {
+	return func(o *options) {
+		o.contents = contents
+	}
+}
+
+// WithLogger logs the measurements with the logger instead of slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{logger: slog.Default()}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
@@ -5,6 +5,7 @@
 package pcr
 
 import (
+	"crypto"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
@@ -99,29 +100,111 @@ func CalculateBankData(pcrNumber int, phases []types.PhaseInfo, alg tpm2.TPMAlgI
 
 // MeasureSections would measure the given sections for a given TPM algorithm
 func MeasureSections(alg tpm2.TPMAlgID, sectionData map[constants.Section]string) (*Digest, error) {
-	var hashData *Digest
+	return MeasureSectionsWithProgress(alg, sectionData, nil)
+}
+
+// ProgressFunc is called while hashing a section with the bytes hashed so far and the section size.
+type ProgressFunc func(section constants.Section, alg crypto.Hash, done, total int64)
 
+// MeasureSectionsWithProgress is like MeasureSections, reporting the hashing progress to progress if not nil.
+func MeasureSectionsWithProgress(alg tpm2.TPMAlgID, sectionData map[constants.Section]string, progress ProgressFunc) (*Digest, error) {
 	hashAlg, err := alg.Hash()
 	if err != nil {
-		return hashData, err
+		return nil, err
+	}
+
+	digests, err := HashSections([]crypto.Hash{hashAlg}, sectionData, nil, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	return MeasureSectionDigests(hashAlg, digests), nil
+}
+
+// SectionDigests holds the digests of the section files, for each hash algorithm.
+type SectionDigests map[constants.Section]map[crypto.Hash][]byte
+
+// HashSections hashes every section file once for all the algorithms, so measuring the sections for
+// several banks does not read the inputs again for each bank.
+//
+// The cache is used when not nil, the one set with SetHashCache otherwise. When hashing for more than
+// one algorithm, progress is reported with a zero algorithm.
+func HashSections(algs []crypto.Hash, sectionData map[constants.Section]string, cache *HashCache, progress ProgressFunc) (SectionDigests, error) {
+	return HashSectionContents(algs, sectionData, nil, cache, progress)
+}
+
+// HashSectionContents hashes the sections like HashSections, along with the sections read from the
+// sources in contents, which take precedence over the files of the same sections.
+func HashSectionContents(algs []crypto.Hash, sectionData map[constants.Section]string, contents map[constants.Section]*types.SectionSource, cache *HashCache, progress ProgressFunc) (SectionDigests, error) {
+	if cache == nil {
+		cache = currentHashCache()
+	}
+
+	var progressAlg crypto.Hash
+	if len(algs) == 1 {
+		progressAlg = algs[0]
 	}
 
-	hashData = NewDigest(hashAlg)
+	digests := SectionDigests{}
 
 	for _, section := range constants.OrderedSections() {
-		if file := sectionData[section]; file != "" {
-			slog.Debug("Measuring section", "section", section, "alg", hashAlg.String())
+		file := sectionData[section]
+		source := contents[section]
 
-			sectionD, err := os.ReadFile(file)
-			if err != nil {
-				return hashData, err
+		if file == "" && source == nil {
+			continue
+		}
+
+		slog.Debug("Hashing section", "section", section, "algs", algs)
+
+		var fileProgress func(done, total int64)
+		if progress != nil {
+			fileProgress = func(done, total int64) {
+				progress(section, progressAlg, done, total)
 			}
-			// NULL terminated, thats why we adding the 0 at the end
-			hashData.Extend(append([]byte(section), 0))
-			hashData.Extend(sectionD)
 		}
+
+		var (
+			sums map[crypto.Hash][]byte
+			err  error
+		)
+
+		switch {
+		case source != nil:
+			sums, err = sourceSums(algs, source, fileProgress)
+		case cache != nil:
+			sums, err = cache.sums(algs, file, fileProgress)
+		default:
+			sums, err = fileSums(algs, file, fileProgress)
+		}
+		if err != nil {
+			return nil, types.NewBuildError(types.StageMeasure, section, file, err)
+		}
+
+		digests[section] = sums
 	}
-	return hashData, nil
+
+	return digests, nil
+}
+
+// MeasureSectionDigests measures the hashed sections for the given algorithm, in measurement order.
+func MeasureSectionDigests(alg crypto.Hash, digests SectionDigests) *Digest {
+	hashData := NewDigest(alg)
+
+	for _, section := range constants.OrderedSections() {
+		sums, ok := digests[section]
+		if !ok {
+			continue
+		}
+
+		slog.Debug("Measuring section", "section", section, "alg", alg.String())
+
+		// NULL terminated, thats why we adding the 0 at the end
+		hashData.Extend(append([]byte(section), 0))
+		hashData.ExtendDigest(sums[alg])
+	}
+
+	return hashData
 }
 
 // MeasurePhase will measure the given phase
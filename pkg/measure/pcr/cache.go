@@ -0,0 +1,461 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pcr
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// HashCache remembers the digests of section files so unchanged files are not hashed again
+// when measuring several times in the same process, i.e. when rebuilding on changes, or across
+// processes through Save and LoadHashCache.
+//
+// Entries are keyed by path and invalidated when the size, modification time, device, inode or
+// change time of the file changes: reproducible builds normalize the modification times, so size
+// and modification time alone do not tell a regenerated file from the cached one.
+type HashCache struct {
+	*hashCacheEntries
+
+	// where this view of the cache counts its hits and misses, may be nil
+	stats *HashStats
+}
+
+// hashCacheEntries are the digests shared by all the views of a HashCache.
+type hashCacheEntries struct {
+	mu      sync.Mutex
+	entries map[hashCacheKey][]byte
+}
+
+// HashStats counts how the files hashed through a HashCache were served.
+type HashStats struct {
+	// Files whose digests were all in the cache.
+	Hits int
+	// Files hashed as at least one of their digests was not in the cache.
+	Misses int
+	// Bytes read to hash the missed files.
+	BytesHashed int64
+}
+
+// Add adds the counts of other to s.
+func (s *HashStats) Add(other HashStats) {
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.BytesHashed += other.BytesHashed
+}
+
+// HitRate returns the share of files served from the cache, between 0 and 1.
+func (s HashStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// WithStats returns a view of the cache sharing its digests, counting its hits and misses into stats.
+func (c *HashCache) WithStats(stats *HashStats) *HashCache {
+	return &HashCache{hashCacheEntries: c.hashCacheEntries, stats: stats}
+}
+
+type hashCacheKey struct {
+	path string
+	alg  crypto.Hash
+	size int64
+	// modification time in nanoseconds, so keys survive a round trip through the cache file
+	modTime int64
+	// changed by rewriting or replacing the file, whatever its modification time
+	id utils.FileID
+}
+
+// newHashCacheKey returns the key of the file, keyed by its absolute path so saved caches
+// stay valid from any working directory.
+func newHashCacheKey(path string, alg crypto.Hash, st os.FileInfo) hashCacheKey {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	return hashCacheKey{path: path, alg: alg, size: st.Size(), modTime: st.ModTime().UnixNano(), id: utils.FileIdentity(st)}
+}
+
+// NewHashCache creates an empty HashCache.
+func NewHashCache() *HashCache {
+	return &HashCache{hashCacheEntries: &hashCacheEntries{entries: map[hashCacheKey][]byte{}}}
+}
+
+var (
+	hashCacheMu sync.Mutex
+	hashCache   *HashCache
+)
+
+// SetHashCache makes MeasureSections use the given cache, nil disables caching.
+func SetHashCache(cache *HashCache) {
+	hashCacheMu.Lock()
+	defer hashCacheMu.Unlock()
+
+	hashCache = cache
+}
+
+func currentHashCache() *HashCache {
+	hashCacheMu.Lock()
+	defer hashCacheMu.Unlock()
+
+	return hashCache
+}
+
+// CurrentHashCache returns the cache MeasureSections uses, nil if caching is disabled.
+func CurrentHashCache() *HashCache {
+	return currentHashCache()
+}
+
+// Sum returns the digest of the file contents, reusing the cached one if the file did not change.
+func (c *HashCache) Sum(alg crypto.Hash, path string) ([]byte, error) {
+	sums, err := c.sums([]crypto.Hash{alg}, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return sums[alg], nil
+}
+
+// sums returns the digests of the file for each algorithm, hashing it once for all the ones not cached.
+func (c *HashCache) sums(algs []crypto.Hash, path string, progress func(done, total int64)) (map[crypto.Hash][]byte, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := map[crypto.Hash][]byte{}
+
+	var missing []crypto.Hash
+
+	c.mu.Lock()
+	for _, alg := range algs {
+		if sum, ok := c.entries[newHashCacheKey(path, alg, st)]; ok {
+			sums[alg] = sum
+		} else {
+			missing = append(missing, alg)
+		}
+	}
+	if c.stats != nil {
+		if len(missing) == 0 {
+			c.stats.Hits++
+		} else {
+			c.stats.Misses++
+			c.stats.BytesHashed += st.Size()
+		}
+	}
+	c.mu.Unlock()
+
+	if len(missing) == 0 {
+		if progress != nil {
+			progress(st.Size(), st.Size())
+		}
+
+		return sums, nil
+	}
+
+	hashed, err := fileSums(missing, path, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	for alg, sum := range hashed {
+		key := newHashCacheKey(path, alg, st)
+
+		// drop stale entries of the same file
+		for k := range c.entries {
+			if k.path == key.path && k.alg == alg {
+				delete(c.entries, k)
+			}
+		}
+		c.entries[key] = sum
+		sums[alg] = sum
+	}
+	c.mu.Unlock()
+
+	return sums, nil
+}
+
+// hashCacheVersion is the version of the cache file format, files of other versions are ignored.
+const hashCacheVersion = 2
+
+// hashCacheAlgs are the algorithms stored in cache files, by name.
+var hashCacheAlgs = []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+// hashCacheFile is the on-disk format of a HashCache.
+type hashCacheFile struct {
+	Version int              `json:"version"`
+	Entries []hashCacheEntry `json:"entries"`
+}
+
+type hashCacheEntry struct {
+	Path       string `json:"path"`
+	Alg        string `json:"alg"`
+	Size       int64  `json:"size"`
+	ModTime    int64  `json:"modTime"`
+	Device     uint64 `json:"device"`
+	Inode      uint64 `json:"inode"`
+	ChangeTime int64  `json:"changeTime"`
+	Sum        string `json:"sum"`
+}
+
+// LoadHashCache reads a cache saved with Save, so digests are reused across processes.
+//
+// A missing, unreadable or outdated cache file results in an empty cache, as it only saves work.
+func LoadHashCache(path string) (*HashCache, error) {
+	c := NewHashCache()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var file hashCacheFile
+	if err = json.Unmarshal(data, &file); err != nil || file.Version != hashCacheVersion {
+		slog.Debug("Ignoring invalid hash cache", "path", path, "error", err)
+		return c, nil
+	}
+
+	for _, entry := range file.Entries {
+		sum, err := hex.DecodeString(entry.Sum)
+		if err != nil {
+			continue
+		}
+
+		for _, alg := range hashCacheAlgs {
+			if alg.String() == entry.Alg {
+				c.entries[hashCacheKey{
+					path:    entry.Path,
+					alg:     alg,
+					size:    entry.Size,
+					modTime: entry.ModTime,
+					id:      utils.FileID{Device: entry.Device, Inode: entry.Inode, ChangeTime: entry.ChangeTime},
+				}] = sum
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// Save writes the cache to path, leaving out the entries of files that are gone or changed.
+//
+// The file is replaced through a rename, so concurrent builds never read a partial cache.
+func (c *HashCache) Save(path string) error {
+	file := hashCacheFile{Version: hashCacheVersion, Entries: []hashCacheEntry{}}
+
+	c.mu.Lock()
+	for key, sum := range c.entries {
+		if st, err := os.Stat(key.path); err != nil || newHashCacheKey(key.path, key.alg, st) != key {
+			delete(c.entries, key)
+			continue
+		}
+
+		file.Entries = append(file.Entries, hashCacheEntry{
+			Path:       key.path,
+			Alg:        key.alg.String(),
+			Size:       key.size,
+			ModTime:    key.modTime,
+			Device:     key.id.Device,
+			Inode:      key.id.Inode,
+			ChangeTime: key.id.ChangeTime,
+			Sum:        hex.EncodeToString(sum),
+		})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(file.Entries, func(i, j int) bool {
+		if file.Entries[i].Path != file.Entries[j].Path {
+			return file.Entries[i].Path < file.Entries[j].Path
+		}
+
+		return file.Entries[i].Alg < file.Entries[j].Alg
+	})
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return utils.WriteFile(path, data, 0o600)
+}
+
+// hashChunk is the amount of data hashed between progress reports.
+const hashChunk = 4 << 20
+
+// fileSums hashes the contents of a file with every algorithm in a single pass over the memory mapped
+// file, or streamed through a buffer under a memory limit, reporting the bytes hashed to progress if not nil.
+func fileSums(algs []crypto.Hash, path string, progress func(done, total int64)) (map[crypto.Hash][]byte, error) {
+	h := newMultiHash(algs)
+
+	var err error
+	if utils.MemoryLimited() {
+		err = streamSums(h, path, progress)
+	} else {
+		err = mappedSums(h, path, progress)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return h.sums(), nil
+}
+
+// sourceSums hashes the contents of a section source with every algorithm.
+func sourceSums(algs []crypto.Hash, source *types.SectionSource, progress func(done, total int64)) (map[crypto.Hash][]byte, error) {
+	h := newMultiHash(algs)
+
+	if err := readerSums(h, source.Open(), source.Size, progress); err != nil {
+		return nil, err
+	}
+
+	return h.sums(), nil
+}
+
+// multiHash hashes the data written to it with every algorithm at once.
+type multiHash struct {
+	io.Writer
+
+	algs   []crypto.Hash
+	hashes []hash.Hash
+}
+
+func newMultiHash(algs []crypto.Hash) *multiHash {
+	h := &multiHash{algs: algs, hashes: make([]hash.Hash, len(algs))}
+	writers := make([]io.Writer, len(algs))
+
+	for i, alg := range algs {
+		h.hashes[i] = alg.New()
+		writers[i] = h.hashes[i]
+	}
+
+	h.Writer = io.MultiWriter(writers...)
+
+	return h
+}
+
+// sums returns the digest of each algorithm.
+func (h *multiHash) sums() map[crypto.Hash][]byte {
+	sums := make(map[crypto.Hash][]byte, len(h.algs))
+	for i, alg := range h.algs {
+		sums[alg] = h.hashes[i].Sum(nil)
+	}
+
+	return sums
+}
+
+// mappedSums writes the memory mapped file to the hashes.
+func mappedSums(w io.Writer, path string, progress func(done, total int64)) error {
+	f, err := utils.MapFile(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	if err = f.Read(func(data []byte) { hashData(w, data, progress) }); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// hashData writes the data to the hashes in chunks, reporting the progress after each one.
+func hashData(w io.Writer, data []byte, progress func(done, total int64)) {
+	total := int64(len(data))
+
+	if progress != nil {
+		progress(0, total)
+	}
+
+	for done := 0; done < len(data); {
+		chunk := data[done:min(done+hashChunk, len(data))]
+
+		w.Write(chunk) //nolint:errcheck
+
+		done += len(chunk)
+
+		if progress != nil {
+			progress(int64(done), total)
+		}
+	}
+}
+
+// streamSums reads the file through a buffer into the hashes.
+func streamSums(w io.Writer, path string, progress func(done, total int64)) error {
+	f, err := utils.OpenSequential(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err = readerSums(w, f, st.Size(), progress); err != nil {
+		return err
+	}
+
+	return utils.DoneWith(f, false)
+}
+
+// readerSums reads the total bytes of r through a buffer into the hashes.
+func readerSums(w io.Writer, r io.Reader, total int64, progress func(done, total int64)) error {
+	if progress != nil {
+		progress(0, total)
+	}
+
+	var done int64
+
+	buf := utils.NewBuffer()
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n]) //nolint:errcheck
+
+			done += int64(n)
+
+			if progress != nil {
+				progress(done, max(total, done))
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -37,10 +37,14 @@ func (d *Digest) Extend(data []byte) {
 	// create hash of incoming data
 	hash := d.alg.New()
 	hash.Write(data)
-	hashSum := hash.Sum(nil)
 
+	d.ExtendDigest(hash.Sum(nil))
+}
+
+// ExtendDigest extends the current hash with the already computed hash of some data.
+func (d *Digest) ExtendDigest(hashSum []byte) {
 	// extend hash with previous data and hashed incoming data
-	hash = d.alg.New()
+	hash := d.alg.New()
 	hash.Write(d.hash)
 	hash.Write(hashSum)
 
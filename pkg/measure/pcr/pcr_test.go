@@ -1,6 +1,8 @@
 package pcr
 
 import (
+	"crypto"
+	"crypto/sha256"
 	"github.com/google/go-tpm/tpm2"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/pesign"
@@ -9,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -333,4 +336,173 @@ var _ = Describe("PCR tests", func() {
 			Expect(hash.Hash()).ToNot(Equal([]byte("5d34a81817bcb7f1856a6e0484572077846d73e9ac5c82bac8d1ee049e2db43e")))
 		})
 	})
+	Describe("HashCache", func() {
+		It("Measures the same as without cache and notices changed files", func() {
+			sections := map[constants.Section]string{constants.CMDLine: cmdlineSection.Path}
+
+			uncached, err := MeasureSections(tpm2.TPMAlgSHA256, sections)
+			Expect(err).ToNot(HaveOccurred())
+
+			SetHashCache(NewHashCache())
+			defer SetHashCache(nil)
+
+			cached, err := MeasureSections(tpm2.TPMAlgSHA256, sections)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cached.Hash()).To(Equal(uncached.Hash()))
+
+			Expect(os.WriteFile(cmdlineSection.Path, []byte("root=LABEL=OTHER"), 0o600)).To(Succeed())
+
+			changed, err := MeasureSections(tpm2.TPMAlgSHA256, sections)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed.Hash()).ToNot(Equal(uncached.Hash()))
+		})
+		It("Notices changed files keeping their size and modification time", func() {
+			dir := GinkgoT().TempDir()
+			path := filepath.Join(dir, "initrd")
+			// as normalized by SOURCE_DATE_EPOCH
+			epoch := time.Unix(1700000000, 0)
+
+			write := func(data string) {
+				Expect(os.WriteFile(path, []byte(data), 0o600)).To(Succeed())
+				Expect(os.Chtimes(path, epoch, epoch)).To(Succeed())
+			}
+
+			sha256Sum := func(data string) []byte {
+				sum := sha256.Sum256([]byte(data))
+
+				return sum[:]
+			}
+
+			write("aaaa")
+
+			cache := NewHashCache()
+			sum, err := cache.Sum(crypto.SHA256, path)
+			Expect(err).ToNot(HaveOccurred())
+
+			// rewritten in place, once the coarse change time moved on
+			time.Sleep(20 * time.Millisecond)
+			write("bbbb")
+
+			rewritten, err := cache.Sum(crypto.SHA256, path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rewritten).ToNot(Equal(sum))
+			Expect(rewritten).To(Equal(sha256Sum("bbbb")))
+
+			// replaced by another file
+			Expect(os.WriteFile(filepath.Join(dir, "new"), []byte("cccc"), 0o600)).To(Succeed())
+			Expect(os.Chtimes(filepath.Join(dir, "new"), epoch, epoch)).To(Succeed())
+			Expect(os.Rename(filepath.Join(dir, "new"), path)).To(Succeed())
+
+			Expect(cache.Sum(crypto.SHA256, path)).To(Equal(sha256Sum("cccc")))
+
+			// still hit for the unchanged file, also through the cache file
+			stats := &HashStats{}
+			Expect(cache.WithStats(stats).Sum(crypto.SHA256, path)).To(Equal(sha256Sum("cccc")))
+			Expect(stats.Hits).To(Equal(1))
+
+			Expect(cache.Save(filepath.Join(dir, "hashes.json"))).To(Succeed())
+			loaded, err := LoadHashCache(filepath.Join(dir, "hashes.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded.WithStats(stats).Sum(crypto.SHA256, path)).To(Equal(sha256Sum("cccc")))
+			Expect(stats.Hits).To(Equal(2))
+		})
+		It("Saves and loads the digests of unchanged files", func() {
+			dir := GinkgoT().TempDir()
+			kept := filepath.Join(dir, "kept")
+			gone := filepath.Join(dir, "gone")
+			Expect(os.WriteFile(kept, []byte("kept"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(gone, []byte("gone"), 0o600)).To(Succeed())
+
+			cache := NewHashCache()
+			sum, err := cache.Sum(crypto.SHA256, kept)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cache.Sum(crypto.SHA384, gone)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.Remove(gone)).To(Succeed())
+
+			path := filepath.Join(dir, "cache", "hashes.json")
+			Expect(cache.Save(path)).To(Succeed())
+
+			loaded, err := LoadHashCache(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded.entries).To(HaveLen(1))
+
+			st, err := os.Stat(kept)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded.entries).To(HaveKeyWithValue(newHashCacheKey(kept, crypto.SHA256, st), sum))
+		})
+		It("Starts empty on missing or invalid cache files", func() {
+			dir := GinkgoT().TempDir()
+
+			cache, err := LoadHashCache(filepath.Join(dir, "missing.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.entries).To(BeEmpty())
+
+			Expect(os.WriteFile(filepath.Join(dir, "invalid.json"), []byte("{"), 0o600)).To(Succeed())
+			cache, err = LoadHashCache(filepath.Join(dir, "invalid.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.entries).To(BeEmpty())
+		})
+	})
+	Describe("Progress", func() {
+		It("Reports the bytes hashed for each section", func() {
+			sections := map[constants.Section]string{constants.CMDLine: cmdlineSection.Path}
+			st, err := os.Stat(cmdlineSection.Path)
+			Expect(err).ToNot(HaveOccurred())
+
+			var last int64
+			_, err = MeasureSectionsWithProgress(tpm2.TPMAlgSHA256, sections, func(section constants.Section, alg crypto.Hash, done, total int64) {
+				Expect(section).To(Equal(constants.CMDLine))
+				Expect(alg).To(Equal(crypto.SHA256))
+				Expect(total).To(Equal(st.Size()))
+				last = done
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(last).To(Equal(st.Size()))
+		})
+	})
+	Describe("HashSections", func() {
+		It("Hashes each section once for all the banks", func() {
+			sections := map[constants.Section]string{constants.CMDLine: cmdlineSection.Path}
+
+			var reports int
+			digests, err := HashSections([]crypto.Hash{crypto.SHA256, crypto.SHA512}, sections, nil, func(section constants.Section, alg crypto.Hash, done, total int64) {
+				Expect(alg).To(BeZero())
+				reports++
+			})
+			Expect(err).ToNot(HaveOccurred())
+			// start and end of the only chunk
+			Expect(reports).To(Equal(2))
+
+			for _, alg := range []tpm2.TPMAlgID{tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA512} {
+				hashAlg, err := alg.Hash()
+				Expect(err).ToNot(HaveOccurred())
+
+				expected, err := MeasureSections(alg, sections)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(MeasureSectionDigests(hashAlg, digests).Hash()).To(Equal(expected.Hash()))
+			}
+		})
+		It("Streams the sections under a memory limit", func() {
+			sections := map[constants.Section]string{constants.CMDLine: cmdlineSection.Path}
+			algs := []crypto.Hash{crypto.SHA256, crypto.SHA384}
+
+			mapped, err := HashSections(algs, sections, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			release := utils.LimitMemory(64 << 20)
+			defer release()
+
+			var last int64
+			streamed, err := HashSections(algs, sections, nil, func(section constants.Section, alg crypto.Hash, done, total int64) {
+				last = done
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(streamed).To(Equal(mapped))
+
+			st, err := os.Stat(cmdlineSection.Path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(last).To(Equal(st.Size()))
+		})
+	})
 })
@@ -10,6 +10,9 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	"github.com/kairos-io/go-ukify/pkg/types"
 )
 
 // Signature returns the hashed signature digest and base64 encoded signature.
@@ -20,6 +23,14 @@ type Signature struct {
 
 // Sign the digest using specified hash and key.
 func Sign(digest []byte, hash crypto.Hash, key crypto.Signer) (*Signature, error) {
+	if err := fips.CheckHash(hash); err != nil {
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("PCR signature: %w", err))
+	}
+
+	if err := fips.CheckKey(key.Public()); err != nil {
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("PCR signature: %w", err))
+	}
+
 	digestToHash := hash.New()
 	digestToHash.Write(digest)
 	digestHashed := digestToHash.Sum(nil)
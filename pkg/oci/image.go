@@ -0,0 +1,405 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ImageScheme prefixes the inputs given as a path in an OCI image, i.e. oci://ghcr.io/kairos-io/kairos:v3!/boot/vmlinuz.
+const ImageScheme = "oci://"
+
+// CacheDir is where the files pulled out of images are kept, the go-ukify/oci user cache directory when empty.
+var CacheDir string
+
+// maxLinks is the number of links followed looking for a file in an image, as the kernel does.
+const maxLinks = 40
+
+// whiteoutPrefix marks the files deleted from the lower layers, and whiteoutOpaque the directories
+// whose lower layers contents are hidden.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// errNotInImage is returned when the file is not in the image.
+var errNotInImage = errors.New("not found in the image")
+
+// IsImagePath returns whether the input is given as a path in an OCI image.
+func IsImagePath(input string) bool {
+	return strings.HasPrefix(input, ImageScheme)
+}
+
+// ParseImagePath parses an oci://registry/repository[:tag|@digest]!/path input.
+func ParseImagePath(input string) (Reference, string, error) {
+	image, file, ok := strings.Cut(strings.TrimPrefix(input, ImageScheme), "!")
+	if !IsImagePath(input) || !ok || strings.Trim(file, "/") == "" {
+		return Reference{}, "", fmt.Errorf("invalid image path %q, expected %sregistry/repository[:tag]!/path", input, ImageScheme)
+	}
+
+	ref, err := ParseReference(image)
+	if err != nil {
+		return Reference{}, "", err
+	}
+
+	return ref, cleanPath(file), nil
+}
+
+// Pull pulls the file of an oci://registry/repository[:tag|@digest]!/path input out of the image, for the
+// architecture, the host one when empty, and returns its path in CacheDir. Links are followed within the image.
+//
+// The file is kept in the cache by image digest, only the manifest is fetched again to pull it from the
+// same image.
+func (client *Client) Pull(input, arch string) (string, error) {
+	ref, file, err := ParseImagePath(input)
+	if err != nil {
+		return "", err
+	}
+
+	manifest, digest, err := client.imageManifest(ref, platformArch(arch))
+	if err != nil {
+		return "", err
+	}
+
+	cached, err := pullCachePath(digest, file)
+	if err != nil {
+		return "", err
+	}
+
+	if st, err := os.Stat(cached); err == nil && st.Mode().IsRegular() {
+		return cached, nil
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(cached), ".pull")
+	if err != nil {
+		return "", err
+	}
+
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	repo, err := client.repository(ref)
+	if err != nil {
+		return "", err
+	}
+
+	layers := &layerFiles{client: client, ref: ref, repo: repo, dir: dir, paths: map[string]string{}}
+
+	out := filepath.Join(dir, "file")
+
+	if err = layers.extract(manifest.Layers, file, out); err != nil {
+		if errors.Is(err, errNotInImage) {
+			return "", fmt.Errorf("%s %w %s", file, err, ref)
+		}
+
+		return "", err
+	}
+
+	return cached, os.Rename(out, cached)
+}
+
+// imageManifest returns the manifest of the image for the architecture and its digest, picking it out of
+// the index of a multi-platform image.
+func (client *Client) imageManifest(ref Reference, arch string) (*Manifest, string, error) {
+	desc, err := client.findManifest(ref, ref.Tag)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if desc.MediaType.IsIndex() {
+		var index Index
+
+		if err = json.Unmarshal(desc.Manifest, &index); err != nil {
+			return nil, "", fmt.Errorf("invalid index of %s: %w", ref, err)
+		}
+
+		var digest string
+
+		for _, m := range index.Manifests {
+			if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == arch {
+				digest = m.Digest
+
+				break
+			}
+		}
+
+		if digest == "" {
+			return nil, "", fmt.Errorf("%s has no linux/%s image", ref, arch)
+		}
+
+		if desc, err = client.findManifest(ref, digest); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if !desc.MediaType.IsImage() {
+		return nil, "", fmt.Errorf("%s is not an image, its manifest is %s", ref, desc.MediaType)
+	}
+
+	var manifest Manifest
+
+	if err = json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest of %s: %w", ref, err)
+	}
+
+	return &manifest, desc.Digest.String(), nil
+}
+
+// findManifest returns the manifest of the tag or digest, failing if there is none.
+func (client *Client) findManifest(ref Reference, tag string) (*remote.Descriptor, error) {
+	desc, found, err := client.getManifest(ref, tag)
+	if err == nil && !found {
+		err = fmt.Errorf("%s has no manifest %s", ref, tag)
+	}
+
+	return desc, err
+}
+
+// layerFiles downloads the layers of an image when first looked into.
+type layerFiles struct {
+	client *Client
+	ref    Reference
+	repo   name.Repository
+	dir    string
+	// downloaded layers by digest
+	paths map[string]string
+}
+
+// extract writes the file of the layers to out, looking from the top layer down and following links.
+func (layers *layerFiles) extract(descs []Descriptor, file, out string) error {
+	for range maxLinks {
+		next, err := layers.find(descs, file, out)
+		if err != nil || next == "" {
+			return err
+		}
+
+		file = next
+	}
+
+	return fmt.Errorf("too many links resolving %s", file)
+}
+
+// find writes the file to out if found in the layers, or returns the path to look for instead when it
+// resolves through a link.
+func (layers *layerFiles) find(descs []Descriptor, file, out string) (string, error) {
+	for i := len(descs) - 1; i >= 0; i-- {
+		path, err := layers.download(descs[i])
+		if err != nil {
+			return "", err
+		}
+
+		result, err := scanLayer(path, file, out)
+		if err != nil {
+			return "", fmt.Errorf("failed reading layer %s of %s: %w", descs[i].Digest, layers.ref, err)
+		}
+
+		switch {
+		case result.found:
+			return "", nil
+		case result.link != "":
+			return result.link, nil
+		case result.deleted:
+			return "", errNotInImage
+		}
+	}
+
+	return "", errNotInImage
+}
+
+// download returns the path of the layer, downloading it if needed.
+func (layers *layerFiles) download(desc Descriptor) (string, error) {
+	if path, ok := layers.paths[desc.Digest]; ok {
+		return path, nil
+	}
+
+	layer, err := remote.Layer(layers.repo.Digest(desc.Digest), layers.client.options()...)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the layer %s of %s: %w", desc.Digest, layers.ref, err)
+	}
+
+	blob, err := layer.Compressed()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the layer %s of %s: %w", desc.Digest, layers.ref, err)
+	}
+
+	defer blob.Close() //nolint:errcheck
+
+	f, err := os.CreateTemp(layers.dir, "layer")
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	// the blob is checked against its digest as it is read
+	if _, err = io.Copy(f, blob); err != nil {
+		return "", fmt.Errorf("failed to get the layer %s of %s: %w", desc.Digest, layers.ref, err)
+	}
+
+	layers.paths[desc.Digest] = f.Name()
+
+	return f.Name(), f.Close()
+}
+
+// layerResult is what a layer holds of a file.
+type layerResult struct {
+	// the file was written out
+	found bool
+	// the file, or one of its directories, is a link, to look for this path instead
+	link string
+	// the file is deleted from the lower layers
+	deleted bool
+}
+
+// scanLayer looks for the file in the layer tarball, gzip compressed or not, and writes it to out if found.
+func scanLayer(layer, file, out string) (layerResult, error) {
+	var result layerResult
+
+	f, err := os.Open(layer)
+	if err != nil {
+		return result, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	reader := bufio.NewReader(f)
+
+	magic, _ := reader.Peek(4) //nolint:errcheck
+
+	var stream io.Reader = reader
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return result, err
+		}
+
+		defer gz.Close() //nolint:errcheck
+
+		stream = gz
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return result, errors.New("zstd compressed layers are not supported")
+	}
+
+	archive := tar.NewReader(stream)
+
+	for {
+		hdr, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+
+		if err != nil {
+			return result, err
+		}
+
+		name := cleanPath(hdr.Name)
+		dir, base := path.Dir(name), path.Base(name)
+
+		switch {
+		case name == file:
+			switch hdr.Typeflag {
+			case tar.TypeReg:
+				return layerResult{found: true}, writeFile(archive, out)
+			case tar.TypeSymlink:
+				return layerResult{link: resolveLink(name, hdr.Linkname)}, nil
+			case tar.TypeLink:
+				return layerResult{link: cleanPath(hdr.Linkname)}, nil
+			default:
+				return result, fmt.Errorf("%s is not a regular file", file)
+			}
+		case hdr.Typeflag == tar.TypeSymlink && strings.HasPrefix(file, name+"/"):
+			return layerResult{link: path.Join(resolveLink(name, hdr.Linkname), strings.TrimPrefix(file, name+"/"))}, nil
+		case base == whiteoutOpaque:
+			result.deleted = result.deleted || strings.HasPrefix(file, dir+"/") || dir == "."
+		case strings.HasPrefix(base, whiteoutPrefix):
+			deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			result.deleted = result.deleted || file == deleted || strings.HasPrefix(file, deleted+"/")
+		}
+	}
+}
+
+// writeFile writes the content of the reader to path.
+func writeFile(r io.Reader, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close() //nolint:errcheck
+
+		return err
+	}
+
+	return f.Close()
+}
+
+// resolveLink returns the path a link of the image points to, absolute links point to the image root.
+func resolveLink(name, target string) string {
+	if path.IsAbs(target) {
+		return cleanPath(target)
+	}
+
+	return cleanPath(path.Join(path.Dir(name), target))
+}
+
+// cleanPath returns the path relative to the image root, never out of it.
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// platformArch returns the OCI architecture name for a Go or EFI architecture name, defaulting to the host one.
+func platformArch(arch string) string {
+	switch arch {
+	case "":
+		return runtime.GOARCH
+	case "x86_64", "x64":
+		return "amd64"
+	case "aarch64", "aa64":
+		return "arm64"
+	case "ia32":
+		return "386"
+	default:
+		return arch
+	}
+}
+
+// pullCachePath returns the path in the cache of the file of the image.
+func pullCachePath(digest, file string) (string, error) {
+	dir := CacheDir
+	if dir == "" {
+		userDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(userDir, "go-ukify", "oci")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(digest + "!" + file))
+
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+"-"+path.Base(file)), nil
+}
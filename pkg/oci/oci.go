@@ -0,0 +1,325 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package oci pushes UKIs to OCI registries as artifacts, following the OCI distribution spec, with
+// the build manifest and the PCR predictions attached to them as referrers, and pulls the build inputs
+// out of OCI images.
+//
+// The registries are talked to with the go-containerregistry client, the package only builds the
+// artifacts and looks for the files in the image layers.
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media types of the OCI specs.
+const (
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeEmptyJSON     = "application/vnd.oci.empty.v1+json"
+)
+
+// emptyJSON is the content of the empty config of artifacts.
+var emptyJSON = []byte("{}")
+
+// Descriptor describes a blob or manifest in a registry.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	// Platform of the manifests listed in an index.
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+// Platform is the platform of an image.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Manifest is an OCI image manifest.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Index is an OCI image index, as returned by the referrers API.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Reference is a repository in a registry, and a tag or digest in it.
+type Reference struct {
+	// Registry host, with its port, i.e. ghcr.io.
+	Registry string
+	// Repository in the registry, i.e. kairos-io/uki.
+	Repository string
+	// Tag, latest when not given, or digest, i.e. sha256:<hex>.
+	Tag string
+}
+
+// ParseReference parses a registry/repository[:tag|@digest] reference.
+func ParseReference(ref string) (Reference, error) {
+	invalid := fmt.Errorf("invalid reference %q, expected registry/repository[:tag|@digest]", ref)
+
+	registry, path, ok := strings.Cut(ref, "/")
+	if !ok || registry == "" || path == "" {
+		return Reference{}, invalid
+	}
+
+	reference := Reference{Registry: registry, Repository: path, Tag: "latest"}
+
+	if repository, digest, ok := strings.Cut(path, "@"); ok {
+		reference.Repository, reference.Tag = repository, digest
+	} else if i := strings.LastIndex(path, ":"); i >= 0 {
+		reference.Repository, reference.Tag = path[:i], path[i+1:]
+	}
+
+	if reference.Repository == "" || reference.Tag == "" || strings.ContainsAny(reference.Tag, "@/") {
+		return Reference{}, invalid
+	}
+
+	return reference, nil
+}
+
+// IsDigest returns whether the reference is to a digest rather than a tag.
+func (ref Reference) IsDigest() bool {
+	return strings.Contains(ref.Tag, ":")
+}
+
+// String returns the registry/repository:tag or registry/repository@digest form of the reference.
+func (ref Reference) String() string {
+	if ref.IsDigest() {
+		return ref.Registry + "/" + ref.Repository + "@" + ref.Tag
+	}
+
+	return ref.Registry + "/" + ref.Repository + ":" + ref.Tag
+}
+
+// Client pushes to and pulls from registries.
+type Client struct {
+	// Transport the requests are sent with, remote.DefaultTransport when nil.
+	Transport http.RoundTripper
+	// Credentials of the registries, the ones of the docker config and its credential helpers are
+	// used when empty.
+	Username string
+	Password string
+	// Whether to use plain HTTP instead of HTTPS, for local registries.
+	PlainHTTP bool
+}
+
+// PushBlob uploads the file as a blob, unless the repository already has it.
+func (client *Client) PushBlob(ref Reference, mediaType, path string) (Descriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	desc := Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(hash.Sum(nil)), Size: size}
+
+	layer, err := partial.CompressedToLayer(&fileBlob{path: path, desc: desc})
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	return desc, client.pushBlob(ref, desc, layer)
+}
+
+// PushBlobData uploads the data as a blob, unless the repository already has it.
+func (client *Client) PushBlobData(ref Reference, mediaType string, data []byte) (Descriptor, error) {
+	desc := descriptor(mediaType, data)
+
+	return desc, client.pushBlob(ref, desc, static.NewLayer(data, types.MediaType(mediaType)))
+}
+
+// pushBlob uploads the blob of the layer.
+func (client *Client) pushBlob(ref Reference, desc Descriptor, layer v1.Layer) error {
+	repo, err := client.repository(ref)
+	if err != nil {
+		return err
+	}
+
+	if err = remote.WriteLayer(repo, layer, client.options()...); err != nil {
+		return fmt.Errorf("failed to upload %s to %s: %w", desc.Digest, ref, err)
+	}
+
+	return nil
+}
+
+// PushManifest uploads the manifest, tagged with tag, or by digest only when tag is empty, and returns
+// its descriptor.
+//
+// The manifests with a subject are listed in the sha256-<digest> tag of the subject when the registry has
+// no referrers API, as the OCI distribution spec falls back to.
+func (client *Client) PushManifest(ref Reference, tag string, manifest any, mediaType string) (Descriptor, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	desc := descriptor(mediaType, data)
+
+	if tag == "" {
+		tag = desc.Digest
+	}
+
+	target, err := client.reference(Reference{Registry: ref.Registry, Repository: ref.Repository, Tag: tag})
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	if err = remote.Put(target, rawManifest{data: data, mediaType: mediaType}, client.options()...); err != nil {
+		return Descriptor{}, fmt.Errorf("failed to push the manifest %s to %s: %w", tag, ref, err)
+	}
+
+	return desc, nil
+}
+
+// getManifest returns the manifest of the tag or digest and its media type, the digest being checked,
+// and whether there is one.
+func (client *Client) getManifest(ref Reference, tag string) (*remote.Descriptor, bool, error) {
+	target, err := client.reference(Reference{Registry: ref.Registry, Repository: ref.Repository, Tag: tag})
+	if err != nil {
+		return nil, false, err
+	}
+
+	desc, err := remote.Get(target, client.options()...)
+
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get the manifest %s of %s: %w", tag, ref, err)
+	}
+
+	return desc, true, nil
+}
+
+// reference returns the go-containerregistry reference of ref.
+func (client *Client) reference(ref Reference) (name.Reference, error) {
+	opts := []name.Option{name.StrictValidation}
+	if client.PlainHTTP {
+		opts = append(opts, name.Insecure)
+	}
+
+	parsed, err := name.ParseReference(ref.String(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference %s: %w", ref, err)
+	}
+
+	return parsed, nil
+}
+
+// repository returns the go-containerregistry repository of ref.
+func (client *Client) repository(ref Reference) (name.Repository, error) {
+	parsed, err := client.reference(ref)
+	if err != nil {
+		return name.Repository{}, err
+	}
+
+	return parsed.Context(), nil
+}
+
+// options returns the options of the requests, authenticating with the credentials of the client or
+// of the docker config.
+func (client *Client) options() []remote.Option {
+	opts := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+	if client.Username != "" || client.Password != "" {
+		opts = []remote.Option{remote.WithAuth(&authn.Basic{Username: client.Username, Password: client.Password})}
+	}
+
+	if client.Transport != nil {
+		opts = append(opts, remote.WithTransport(client.Transport))
+	}
+
+	return opts
+}
+
+// rawManifest is a manifest pushed as is.
+type rawManifest struct {
+	data      []byte
+	mediaType string
+}
+
+// RawManifest implements remote.Taggable.
+func (m rawManifest) RawManifest() ([]byte, error) {
+	return m.data, nil
+}
+
+// MediaType gives the media type of the manifest to remote.Put.
+func (m rawManifest) MediaType() (types.MediaType, error) {
+	return types.MediaType(m.mediaType), nil
+}
+
+// fileBlob is a file uploaded as is, as the compressed form of a layer.
+type fileBlob struct {
+	path string
+	desc Descriptor
+}
+
+// Digest implements partial.CompressedLayer.
+func (b *fileBlob) Digest() (v1.Hash, error) {
+	return v1.NewHash(b.desc.Digest)
+}
+
+// Compressed implements partial.CompressedLayer.
+func (b *fileBlob) Compressed() (io.ReadCloser, error) {
+	return os.Open(b.path)
+}
+
+// Size implements partial.CompressedLayer.
+func (b *fileBlob) Size() (int64, error) {
+	return b.desc.Size, nil
+}
+
+// MediaType implements partial.CompressedLayer.
+func (b *fileBlob) MediaType() (types.MediaType, error) {
+	return types.MediaType(b.desc.MediaType), nil
+}
+
+// descriptor returns the descriptor of data.
+func descriptor(mediaType string, data []byte) Descriptor {
+	sum := sha256.Sum256(data)
+
+	return Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+}
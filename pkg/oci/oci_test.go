@@ -0,0 +1,373 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "OCI test Suite")
+}
+
+// registry is an in-memory registry of a single repository, asking for a bearer token.
+type registry struct {
+	mu        sync.Mutex
+	referrers bool
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+	// blobs being uploaded, by upload id
+	uploads map[string][]byte
+	// number of blobs downloaded
+	pulls int
+}
+
+func newRegistry(referrers bool) *registry {
+	return &registry{
+		referrers: referrers,
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+		uploads:   map[string][]byte{},
+	}
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" || !strings.HasPrefix(r.URL.Query().Get("scope"), "repository:uki:") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token":"secret"}`))
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == "/v2/" {
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, "/v2/uki/")
+	Expect(ok).To(BeTrue())
+
+	data, err := io.ReadAll(r.Body)
+	Expect(err).ToNot(HaveOccurred())
+
+	switch {
+	case (r.Method == http.MethodHead || r.Method == http.MethodGet) && strings.HasPrefix(path, "blobs/"):
+		blob, ok := reg.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			reg.pulls++
+			_, _ = w.Write(blob)
+		}
+	case r.Method == http.MethodPost && path == "blobs/uploads/":
+		id := strconv.Itoa(len(reg.uploads))
+		reg.uploads[id] = nil
+		w.Header().Set("Location", "/v2/uki/blobs/uploads/"+id+"?state=x")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPatch && strings.HasPrefix(path, "blobs/uploads/"):
+		id := strings.TrimPrefix(path, "blobs/uploads/")
+		Expect(reg.uploads).To(HaveKey(id))
+		reg.uploads[id] = append(reg.uploads[id], data...)
+		w.Header().Set("Location", r.URL.String())
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "blobs/uploads/"):
+		id := strings.TrimPrefix(path, "blobs/uploads/")
+		Expect(reg.uploads).To(HaveKey(id))
+		blob := append(reg.uploads[id], data...)
+		sum := sha256.Sum256(blob)
+		Expect(r.URL.Query().Get("state")).To(Equal("x"))
+		Expect(r.URL.Query().Get("digest")).To(Equal("sha256:" + hex.EncodeToString(sum[:])))
+		reg.blobs[r.URL.Query().Get("digest")] = blob
+		delete(reg.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "referrers/"):
+		if !reg.referrers {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeImageIndex)
+		_, _ = w.Write([]byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeImageIndex + `","manifests":[]}`))
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "manifests/"):
+		sum := sha256.Sum256(data)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		reg.manifests[strings.TrimPrefix(path, "manifests/")] = data
+		reg.manifests[digest] = data
+		reg.types[strings.TrimPrefix(path, "manifests/")] = r.Header.Get("Content-Type")
+		reg.types[digest] = r.Header.Get("Content-Type")
+
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "manifests/"):
+		data, ok := reg.manifests[strings.TrimPrefix(path, "manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", reg.types[strings.TrimPrefix(path, "manifests/")])
+		_, _ = w.Write(data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// layer returns the layer tarball of the entries, gzip compressed if asked to.
+func layer(compress bool, entries ...*tar.Header) []byte {
+	var buf bytes.Buffer
+
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+
+	archive := tar.NewWriter(w)
+	for _, hdr := range entries {
+		if hdr.Typeflag == tar.TypeReg {
+			content := hdr.Linkname
+			hdr.Linkname, hdr.Size, hdr.Mode = "", int64(len(content)), 0o644
+			Expect(archive.WriteHeader(hdr)).To(Succeed())
+			_, err := archive.Write([]byte(content))
+			Expect(err).ToNot(HaveOccurred())
+			continue
+		}
+		Expect(archive.WriteHeader(hdr)).To(Succeed())
+	}
+	Expect(archive.Close()).To(Succeed())
+
+	if gz != nil {
+		Expect(gz.Close()).To(Succeed())
+	}
+
+	return buf.Bytes()
+}
+
+// file returns the header of a regular file, its content is carried in Linkname until written.
+func file(name, content string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Linkname: content}
+}
+
+// manifest returns the manifest tagged or of the digest.
+func (reg *registry) manifest(ref string) Manifest {
+	var manifest Manifest
+	Expect(json.Unmarshal(reg.manifests[ref], &manifest)).To(Succeed())
+	return manifest
+}
+
+var _ = Describe("OCI", func() {
+	var out string
+	var referrers []Referrer
+
+	BeforeEach(func() {
+		out = filepath.Join(GinkgoT().TempDir(), "uki.signed.efi")
+		Expect(os.WriteFile(out, []byte("signed uki"), 0o600)).To(Succeed())
+
+		referrers = []Referrer{
+			{ArtifactType: ArtifactTypeManifest, Name: "manifest.json", Data: []byte(`{"outputs":[]}`)},
+			{ArtifactType: ArtifactTypeMeasurements, Name: "measurements.json", Data: []byte(`[{"pcr":11}]`)},
+		}
+	})
+
+	It("Parses references", func() {
+		ref, err := ParseReference("localhost:5000/kairos/uki:v3.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref).To(Equal(Reference{Registry: "localhost:5000", Repository: "kairos/uki", Tag: "v3.1"}))
+
+		ref, err = ParseReference("ghcr.io/kairos/uki")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref.Tag).To(Equal("latest"))
+
+		_, err = ParseReference("uki")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Pushes the UKI with its referrers", func() {
+		reg := newRegistry(true)
+		server := httptest.NewServer(reg)
+		DeferCleanup(server.Close)
+
+		client := &Client{Username: "user", Password: "pass", PlainHTTP: true}
+		pushed, err := client.PushUKI(strings.TrimPrefix(server.URL, "http://")+"/uki:v1", out, referrers...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pushed.Referrers).To(HaveLen(2))
+
+		manifest := reg.manifest("v1")
+		Expect(manifest.ArtifactType).To(Equal(ArtifactTypeUKI))
+		Expect(manifest.Config.MediaType).To(Equal(MediaTypeEmptyJSON))
+		Expect(manifest.Layers).To(HaveLen(1))
+		Expect(manifest.Layers[0].MediaType).To(Equal(MediaTypeUKI))
+		Expect(manifest.Layers[0].Annotations[AnnotationTitle]).To(Equal("uki.signed.efi"))
+		Expect(reg.blobs[manifest.Layers[0].Digest]).To(Equal([]byte("signed uki")))
+		Expect(reg.types[pushed.UKI.Digest]).To(Equal(MediaTypeImageManifest))
+
+		predictions := reg.manifest(pushed.Referrers[1].Digest)
+		Expect(predictions.ArtifactType).To(Equal(ArtifactTypeMeasurements))
+		Expect(predictions.Subject.Digest).To(Equal(pushed.UKI.Digest))
+		Expect(predictions.Layers[0].Annotations[AnnotationTitle]).To(Equal("measurements.json"))
+		Expect(reg.blobs[predictions.Layers[0].Digest]).To(Equal([]byte(`[{"pcr":11}]`)))
+		Expect(reg.manifest(pushed.Referrers[0].Digest).ArtifactType).To(Equal(ArtifactTypeManifest))
+
+		// the registry handles the referrers
+		Expect(reg.manifests).ToNot(HaveKey(strings.Replace(pushed.UKI.Digest, ":", "-", 1)))
+	})
+
+	It("Tags the referrers without the referrers API", func() {
+		reg := newRegistry(false)
+		server := httptest.NewServer(reg)
+		DeferCleanup(server.Close)
+
+		client := &Client{Username: "user", Password: "pass", PlainHTTP: true}
+		pushed, err := client.PushUKI(strings.TrimPrefix(server.URL, "http://")+"/uki:v1", out, referrers...)
+		Expect(err).ToNot(HaveOccurred())
+
+		tag := strings.Replace(pushed.UKI.Digest, ":", "-", 1)
+		var index Index
+		Expect(json.Unmarshal(reg.manifests[tag], &index)).To(Succeed())
+		Expect(index.Manifests).To(ConsistOf(pushed.Referrers))
+
+		// pushing again does not list the referrers twice
+		_, err = client.PushUKI(strings.TrimPrefix(server.URL, "http://")+"/uki:v1", out, referrers...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.Unmarshal(reg.manifests[tag], &index)).To(Succeed())
+		Expect(index.Manifests).To(HaveLen(2))
+	})
+
+	It("Fails with wrong credentials", func() {
+		server := httptest.NewServer(newRegistry(true))
+		DeferCleanup(server.Close)
+
+		client := &Client{Username: "user", Password: "wrong", PlainHTTP: true}
+		_, err := client.PushUKI(strings.TrimPrefix(server.URL, "http://")+"/uki:v1", out, referrers...)
+		Expect(err).To(MatchError(ContainSubstring("401 Unauthorized")))
+	})
+
+	Context("Pulling", func() {
+		var reg *registry
+		var host string
+		var client *Client
+
+		BeforeEach(func() {
+			CacheDir = GinkgoT().TempDir()
+			DeferCleanup(func() { CacheDir = "" })
+
+			reg = newRegistry(true)
+			server := httptest.NewServer(reg)
+			DeferCleanup(server.Close)
+			host = strings.TrimPrefix(server.URL, "http://")
+
+			client = &Client{Username: "user", Password: "pass", PlainHTTP: true}
+			ref, err := ParseReference(host + "/uki:v1")
+			Expect(err).ToNot(HaveOccurred())
+
+			config, err := client.PushBlobData(ref, MediaTypeEmptyJSON, emptyJSON)
+			Expect(err).ToNot(HaveOccurred())
+
+			lower, err := client.PushBlobData(ref, "application/vnd.oci.image.layer.v1.tar+gzip", layer(true,
+				file("./boot/vmlinuz-6.1", "kernel"),
+				&tar.Header{Name: "./boot/vmlinuz", Typeflag: tar.TypeSymlink, Linkname: "vmlinuz-6.1"},
+				&tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "/usr/lib"},
+				file("usr/lib/modules/6.1/initrd", "initrd"),
+				file("etc/os-release", "ID=old"),
+				file("etc/kernel/cmdline", "quiet"),
+			))
+			Expect(err).ToNot(HaveOccurred())
+
+			upper, err := client.PushBlobData(ref, "application/vnd.oci.image.layer.v1.tar", layer(false,
+				file("etc/kairos-release", "ID=kairos"),
+				&tar.Header{Name: "etc/.wh.os-release", Typeflag: tar.TypeReg},
+				&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeSymlink, Linkname: "kairos-release"},
+				&tar.Header{Name: "etc/kernel/.wh..wh..opq", Typeflag: tar.TypeReg},
+			))
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := client.PushManifest(ref, "", Manifest{
+				SchemaVersion: 2,
+				MediaType:     MediaTypeImageManifest,
+				Config:        config,
+				Layers:        []Descriptor{lower, upper},
+			}, MediaTypeImageManifest)
+			Expect(err).ToNot(HaveOccurred())
+
+			image.Platform = &Platform{OS: "linux", Architecture: "amd64"}
+			_, err = client.PushManifest(ref, "v1", Index{
+				SchemaVersion: 2,
+				MediaType:     MediaTypeImageIndex,
+				Manifests:     []Descriptor{image},
+			}, MediaTypeImageIndex)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		pull := func(path string) string {
+			out, err := client.Pull("oci://"+host+"/uki:v1!"+path, "x86_64")
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := os.ReadFile(out)
+			Expect(err).ToNot(HaveOccurred())
+
+			return string(data)
+		}
+
+		It("Pulls files following the links of the image", func() {
+			Expect(pull("/boot/vmlinuz")).To(Equal("kernel"))
+			Expect(pull("/lib/modules/6.1/initrd")).To(Equal("initrd"))
+			Expect(pull("/etc/os-release")).To(Equal("ID=kairos"))
+		})
+
+		It("Keeps the pulled files in the cache", func() {
+			Expect(pull("/boot/vmlinuz")).To(Equal("kernel"))
+			pulls := reg.pulls
+
+			Expect(pull("/boot/vmlinuz")).To(Equal("kernel"))
+			Expect(reg.pulls).To(Equal(pulls))
+		})
+
+		It("Honors the whiteouts of the upper layers", func() {
+			_, err := client.Pull("oci://"+host+"/uki:v1!/etc/kernel/cmdline", "amd64")
+			Expect(err).To(MatchError(ContainSubstring("etc/kernel/cmdline not found in the image")))
+		})
+
+		It("Picks the image of the architecture", func() {
+			_, err := client.Pull("oci://"+host+"/uki:v1!/boot/vmlinuz", "aarch64")
+			Expect(err).To(MatchError(ContainSubstring("has no linux/arm64 image")))
+		})
+
+		It("Parses image paths", func() {
+			ref, path, err := ParseImagePath("oci://ghcr.io/kairos-io/kairos@sha256:aa!/boot/vmlinuz")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ref).To(Equal(Reference{Registry: "ghcr.io", Repository: "kairos-io/kairos", Tag: "sha256:aa"}))
+			Expect(path).To(Equal("boot/vmlinuz"))
+
+			_, _, err = ParseImagePath("oci://ghcr.io/kairos-io/kairos:v3")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,150 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Artifact and media types of the UKIs and of their referrers.
+const (
+	ArtifactTypeUKI          = "application/vnd.kairos.uki.v1"
+	MediaTypeUKI             = "application/vnd.kairos.uki.v1+efi"
+	ArtifactTypeManifest     = "application/vnd.kairos.uki.manifest.v1+json"
+	ArtifactTypeMeasurements = "application/vnd.kairos.uki.measurements.v1+json"
+)
+
+// Annotations of the pushed manifests.
+const (
+	AnnotationTitle = "org.opencontainers.image.title"
+)
+
+// PushResult describes the manifests pushed by PushUKI.
+type PushResult struct {
+	// Reference the UKI was pushed to.
+	Reference string `json:"reference"`
+	// Manifest of the UKI.
+	UKI Descriptor `json:"uki"`
+	// Manifests of the referrers of the UKI.
+	Referrers []Descriptor `json:"referrers"`
+}
+
+// Referrer is a file attached to a pushed UKI, i.e. its build manifest.
+type Referrer struct {
+	// Artifact type of the referrer, i.e. ArtifactTypeManifest.
+	ArtifactType string
+	// File name of the referrer.
+	Name string
+	// Content of the referrer.
+	Data []byte
+}
+
+// PushUKI pushes the UKI at path to ref, and the referrers attached to it.
+//
+// Registries without the referrers API get the referrers listed in the sha256-<digest> tag of the
+// UKI manifest, as the OCI distribution spec falls back to, see PushManifest.
+func (client *Client) PushUKI(reference, path string, referrers ...Referrer) (*PushResult, error) {
+	ref, err := ParseReference(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := client.PushBlobData(ref, MediaTypeEmptyJSON, emptyJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	layer, err := client.PushBlob(ref, MediaTypeUKI, path)
+	if err != nil {
+		return nil, err
+	}
+
+	layer.Annotations = map[string]string{AnnotationTitle: filepath.Base(path)}
+
+	subject, err := client.PushManifest(ref, ref.Tag, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		ArtifactType:  ArtifactTypeUKI,
+		Config:        config,
+		Layers:        []Descriptor{layer},
+	}, MediaTypeImageManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	pushed := &PushResult{Reference: ref.String(), UKI: subject}
+
+	for _, referrer := range referrers {
+		layer, err := client.PushBlobData(ref, referrer.ArtifactType, referrer.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		layer.Annotations = map[string]string{AnnotationTitle: referrer.Name}
+
+		desc, err := client.PushManifest(ref, "", Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeImageManifest,
+			ArtifactType:  referrer.ArtifactType,
+			Config:        config,
+			Layers:        []Descriptor{layer},
+			Subject:       &subject,
+		}, MediaTypeImageManifest)
+		if err != nil {
+			return nil, err
+		}
+
+		desc.ArtifactType = referrer.ArtifactType
+		pushed.Referrers = append(pushed.Referrers, desc)
+	}
+
+	if err = client.tagReferrers(ref, subject, pushed.Referrers); err != nil {
+		return nil, err
+	}
+
+	return pushed, nil
+}
+
+// tagReferrers sets the artifact type of the referrers listed in the referrers tag of the subject, if
+// there is one: go-containerregistry lists them with the media type of their config instead, the empty
+// one of artifacts.
+func (client *Client) tagReferrers(ref Reference, subject Descriptor, referrers []Descriptor) error {
+	tag := strings.Replace(subject.Digest, ":", "-", 1)
+
+	desc, found, err := client.getManifest(ref, tag)
+	if err != nil || !found {
+		return err
+	}
+
+	var index Index
+
+	if err = json.Unmarshal(desc.Manifest, &index); err != nil {
+		return fmt.Errorf("invalid index %s of %s: %w", tag, ref, err)
+	}
+
+	changed := false
+
+	for i, m := range index.Manifests {
+		for _, referrer := range referrers {
+			if m.Digest == referrer.Digest && m.ArtifactType != referrer.ArtifactType {
+				index.Manifests[i].ArtifactType = referrer.ArtifactType
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if _, err = client.PushManifest(ref, tag, index, MediaTypeImageIndex); err != nil {
+		return fmt.Errorf("failed to tag the referrers of %s: %w", ref, err)
+	}
+
+	return nil
+}
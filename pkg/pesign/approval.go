@@ -0,0 +1,228 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// ErrNotApproved is returned when fewer approvers than required approved a file.
+var ErrNotApproved = errors.New("not enough approvals")
+
+// Threshold requires Required of the Approvers to approve a file before it is signed, approving
+// being signing its Authenticode digest with their key, e.g. the keys of several signing services
+// held by different release managers.
+type Threshold struct {
+	// Required approvals, N of the M approvers.
+	Required int
+	// Approvers asked to approve the files.
+	Approvers []CertificateSigner
+}
+
+// Approval is the approval of a digest by an approver.
+type Approval struct {
+	// Approver is the subject of the certificate of the approver.
+	Approver string `json:"approver"`
+	// Certificate of the approver, DER encoded.
+	Certificate []byte `json:"certificate"`
+	// Signature of the digest, checked against the certificate of the approver.
+	Signature []byte `json:"signature"`
+}
+
+// Verify checks the approval is a signature of the digest with the key of its certificate.
+func (a *Approval) Verify(digest []byte) error {
+	cert, err := x509.ParseCertificate(a.Certificate)
+	if err != nil {
+		return fmt.Errorf("approver %s: %w", a.Approver, err)
+	}
+
+	if cert.Subject.String() != a.Approver {
+		return fmt.Errorf("approver %s: certificate of %s", a.Approver, cert.Subject)
+	}
+
+	if err = verifyApproval(cert.PublicKey, digest, a.Signature); err != nil {
+		return fmt.Errorf("approver %s: invalid approval: %w", a.Approver, err)
+	}
+
+	return nil
+}
+
+// Validate checks the threshold can be reached, each approver counting once.
+func (t *Threshold) Validate() error {
+	if t.Required < 1 || t.Required > len(t.Approvers) {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%d approvals required of %d approvers", t.Required, len(t.Approvers)))
+	}
+
+	for i, approver := range t.Approvers {
+		if approver.Certificate() == nil {
+			return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("approver %d has no certificate", i+1))
+		}
+
+		for _, other := range t.Approvers[:i] {
+			if bytes.Equal(approver.Certificate().Raw, other.Certificate().Raw) {
+				return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("approver %s is given more than once", approverName(approver)))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Approve asks all approvers to approve the digest at once, and returns the valid approvals. It
+// fails with ErrNotApproved, along with the reasons of the approvers refusing, unless at least
+// Required approvers approved it.
+func (t *Threshold) Approve(digest []byte) ([]Approval, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	approvals := make([]*Approval, len(t.Approvers))
+	errs := make([]error, len(t.Approvers))
+
+	var wg sync.WaitGroup
+
+	for i, approver := range t.Approvers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			approvals[i], errs[i] = approve(approver, digest)
+		}()
+	}
+
+	wg.Wait()
+
+	var approved []Approval
+
+	for _, approval := range approvals {
+		if approval != nil {
+			approved = append(approved, *approval)
+		}
+	}
+
+	if len(approved) < t.Required {
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("%w: %d of %d required: %w", ErrNotApproved, len(approved), t.Required, errors.Join(errs...)))
+	}
+
+	return approved, nil
+}
+
+// Verify checks the approvals of the digest reach the threshold, each approval being valid and
+// made by a different one of the Approvers. It fails with ErrVerification otherwise.
+func (t *Threshold) Verify(digest []byte, approvals []Approval) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	approved := make([]bool, len(t.Approvers))
+
+	var (
+		count int
+		errs  []error
+	)
+
+	for _, approval := range approvals {
+		i := slices.IndexFunc(t.Approvers, func(approver CertificateSigner) bool {
+			return bytes.Equal(approver.Certificate().Raw, approval.Certificate)
+		})
+
+		switch {
+		case i < 0:
+			errs = append(errs, fmt.Errorf("approver %s is not an approver", approval.Approver))
+		case approved[i]:
+			errs = append(errs, fmt.Errorf("approver %s approved more than once", approval.Approver))
+		default:
+			if err := approval.Verify(digest); err != nil {
+				errs = append(errs, err)
+
+				continue
+			}
+
+			approved[i] = true
+			count++
+		}
+	}
+
+	if count < t.Required {
+		return types.WithCategory(types.ErrVerification, fmt.Errorf("%w: %d of %d required: %w", ErrNotApproved, count, t.Required, errors.Join(errs...)))
+	}
+
+	return nil
+}
+
+// VerifyApprovals checks each approval is a valid approval of the Authenticode digest of the file,
+// see Approval.Verify. It fails with ErrVerification otherwise.
+func VerifyApprovals(file string, approvals []Approval) error {
+	img, err := parseFile(file)
+	if err != nil {
+		return err
+	}
+
+	for _, approval := range approvals {
+		if err = approval.Verify(img.digest); err != nil {
+			return types.WithCategory(types.ErrVerification, fmt.Errorf("%s: %w", file, err))
+		}
+	}
+
+	return nil
+}
+
+// approve asks the approver to sign the digest, and checks the signature.
+func approve(approver CertificateSigner, digest []byte) (*Approval, error) {
+	name := approverName(approver)
+
+	signature, err := approver.Signer().Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("approver %s: %w", name, err)
+	}
+
+	if err = verifyApproval(approver.Certificate().PublicKey, digest, signature); err != nil {
+		return nil, fmt.Errorf("approver %s: invalid approval: %w", name, err)
+	}
+
+	return &Approval{Approver: name, Certificate: approver.Certificate().Raw, Signature: signature}, nil
+}
+
+// verifyApproval checks the signature of the SHA256 digest.
+func verifyApproval(public crypto.PublicKey, digest, signature []byte) error {
+	if err := fips.CheckKey(public); err != nil {
+		return err
+	}
+
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errors.New("ECDSA verification failure")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported key %T", public)
+	}
+}
+
+// approverName returns the subject of the certificate of the approver.
+func approverName(approver CertificateSigner) string {
+	if cert := approver.Certificate(); cert != nil {
+		return cert.Subject.String()
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// SystemdCredsPath is the systemd-creds binary decrypting the encrypted key files, looked up in PATH by default.
+var SystemdCredsPath = "systemd-creds"
+
+// readKey reads a key file, decrypting it in memory with systemd-creds if it is an encrypted credential,
+// i.e. one written by systemd-creds encrypt --with-key=tpm2, so the key is never at rest in plaintext.
+//
+// The credential name is checked against the file name, as systemd-creds does by default.
+func readKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isCredential(data) {
+		return data, nil
+	}
+
+	clear(data)
+
+	cmd := exec.Command(SystemdCredsPath, "decrypt", path, "-")
+
+	var stdout, stderr bytes.Buffer
+	// the key is smaller than its credential, so the buffer is not grown leaving copies of it behind
+	stdout.Grow(len(data) + bytes.MinRead)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		clear(stdout.Bytes())
+
+		return nil, fmt.Errorf("failed to decrypt credential %s: %w: %s", path, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// isCredential returns whether the key file is a systemd-creds encrypted credential: keys are PEM
+// encoded, credentials are Base64 encoded.
+func isCredential(data []byte) bool {
+	if block, _ := pem.Decode(data); block != nil {
+		return false
+	}
+
+	text := bytes.Join(bytes.Fields(data), nil)
+	if len(text) == 0 {
+		return false
+	}
+
+	_, err := base64.StdEncoding.DecodeString(string(text))
+
+	return err == nil
+}
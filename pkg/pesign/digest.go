@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"crypto/sha256"
+	"hash"
+)
+
+// Digester computes the Authenticode SHA256 digest of a PE32+ file while it is written through it
+// front to back, so a file being assembled does not have to be read again to be signed.
+//
+// The digest only matches the one of the written file if its sections follow the headers without gaps,
+// each one padded to the file alignment, and it has no certificate table yet, as assembled UKIs.
+type Digester struct {
+	h      hash.Hash
+	offset int64
+	// file ranges left out of the digest: the checksum and the certificate table entry
+	skipped [2][2]int64
+}
+
+// NewDigester returns a Digester of a file with its optional header at optOffset.
+func NewDigester(optOffset int64) *Digester {
+	cksum := optOffset + checksumOffset
+	entry := optOffset + certTableOffsetPE32Plus
+
+	return &Digester{
+		h:       sha256.New(),
+		skipped: [2][2]int64{{cksum, cksum + 4}, {entry, entry + 8}},
+	}
+}
+
+// Write hashes p, leaving out the bytes of the skipped ranges.
+func (d *Digester) Write(p []byte) (int, error) {
+	n := len(p)
+	start := d.offset
+
+	for _, skip := range d.skipped {
+		end := start + int64(len(p))
+		if skip[1] <= start || skip[0] >= end {
+			continue
+		}
+
+		if skip[0] > start {
+			d.h.Write(p[:skip[0]-start])
+		}
+
+		p = p[min(skip[1], end)-start:]
+		start = min(skip[1], end)
+	}
+
+	d.h.Write(p)
+	d.offset += int64(n)
+
+	return n, nil
+}
+
+// Digest returns the digest of the file written so far, nothing may be written after it.
+func (d *Digester) Digest() []byte {
+	d.h.Write(make([]byte, (8-d.offset%8)%8))
+
+	return d.h.Sum(nil)
+}
@@ -0,0 +1,223 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// External signing tools, see ExternalTool.
+const (
+	ToolSbsign       = "sbsign"
+	ToolOsslsigncode = "osslsigncode"
+	ToolPesign       = "pesign"
+)
+
+// ExternalTool signs PE files with an external binary, for environments where signing must go through
+// an approved tool. The key never enters the process, so it may be anything the tool understands,
+// i.e. a PKCS#11 URI.
+type ExternalTool struct {
+	// Tool, one of ToolSbsign, ToolOsslsigncode or ToolPesign.
+	Name string
+	// Path to the binary, Name is looked up in PATH when empty.
+	Path string
+	// Key and certificate passed to sbsign and osslsigncode.
+	Key  string
+	Cert string
+	// NSS database directory and certificate nickname passed to pesign, its default database when
+	// CertDir is empty.
+	CertDir  string
+	CertName string
+	// Extra arguments passed to the tool, i.e. the engine options of osslsigncode.
+	Args []string
+}
+
+// NewExternalSigner creates a new Signer signing PE files with the tool. The signatures are checked
+// against cert, the certificate the tool signs with.
+//
+// Detached signatures need the key in process, so they can't be made with the signer.
+func NewExternalSigner(tool *ExternalTool, cert *x509.Certificate) (*Signer, error) {
+	if err := tool.validate(); err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	if cert == nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, errors.New("the external signer needs the certificate the tool signs with"))
+	}
+
+	return &Signer{provider: certificateOnly{cert}, external: tool}, nil
+}
+
+// validate checks the tool has the options it needs.
+func (tool *ExternalTool) validate() error {
+	switch tool.Name {
+	case ToolSbsign, ToolOsslsigncode:
+		if tool.Key == "" || tool.Cert == "" {
+			return fmt.Errorf("%s needs a key and a certificate", tool.Name)
+		}
+	case ToolPesign:
+		if tool.CertName == "" {
+			return errors.New("pesign needs the nickname of the certificate")
+		}
+	default:
+		return fmt.Errorf("unknown signing tool %q, expected sbsign, osslsigncode or pesign", tool.Name)
+	}
+
+	return nil
+}
+
+// args returns the arguments signing input to output.
+func (tool *ExternalTool) args(input, output string) []string {
+	var args []string
+
+	switch tool.Name {
+	case ToolSbsign:
+		args = append(args, "--key", tool.Key, "--cert", tool.Cert, "--output", output)
+		args = append(args, tool.Args...)
+		args = append(args, input)
+	case ToolOsslsigncode:
+		args = append(args, "sign", "-h", "sha256", "-certs", tool.Cert, "-key", tool.Key)
+		args = append(args, tool.Args...)
+		args = append(args, "-in", input, "-out", output)
+	case ToolPesign:
+		args = append(args, "--sign", "--force", "--certificate", tool.CertName, "--in", input, "--out", output)
+		if tool.CertDir != "" {
+			args = append(args, "--certdir", tool.CertDir)
+		}
+
+		args = append(args, tool.Args...)
+	}
+
+	return args
+}
+
+// run runs the tool signing input to output.
+func (tool *ExternalTool) run(input, output string) error {
+	path := tool.Path
+	if path == "" {
+		path = tool.Name
+	}
+
+	cmd := exec.Command(path, tool.args(input, output)...)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", tool.Name, err, bytes.TrimSpace(out.Bytes()))
+	}
+
+	return nil
+}
+
+// signExternal signs input to output with the external tool, and checks the output is signed with
+// the certificate. It returns the SHA256 of the output.
+func (s *Signer) signExternal(input, output string, mode os.FileMode) ([]byte, error) {
+	s.log().Debug("Signing file with external tool", "tool", s.external.Name, "input", input, "output", output)
+
+	// written next to the output, which is replaced once the signature is checked
+	tmp, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".*")
+	if err != nil {
+		return nil, err
+	}
+
+	signed := tmp.Name()
+	tmp.Close() //nolint:errcheck
+
+	// the tools refuse, or fail, to write over an existing file
+	if err = os.Remove(signed); err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(signed) //nolint:errcheck
+
+	if err = s.external.run(input, signed); err != nil {
+		return nil, err
+	}
+
+	ok, err := VerifyFile(signed, s.provider.Certificate())
+	if !ok || err != nil {
+		return nil, types.WithCategory(types.ErrVerification, fmt.Errorf("%s output is not signed with the certificate: %w", s.external.Name, err))
+	}
+
+	sum, err := fileSum(signed)
+	if err != nil {
+		return nil, err
+	}
+
+	return sum, utils.Publish(signed, output, mode.Perm())
+}
+
+// fileSum returns the SHA256 of the file.
+func fileSum(path string) ([]byte, error) {
+	f, err := utils.OpenSequential(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	h := sha256.New()
+
+	if _, err = utils.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// certificateOnly provides the certificate of an external signer, the key being held by the tool.
+type certificateOnly struct {
+	cert *x509.Certificate
+}
+
+func (c certificateOnly) Signer() crypto.Signer {
+	return nil
+}
+
+func (c certificateOnly) Certificate() *x509.Certificate {
+	return c.cert
+}
+
+// defaultNSSToken is the software token of the NSS database pesign signs with by default.
+const defaultNSSToken = "NSS Certificate DB"
+
+// fileKey returns whether the tool signs with a key file: sbsign and osslsigncode unless the key is a
+// PKCS#11 URI, pesign unless a token other than the NSS database one is selected with -t or --token.
+func (tool *ExternalTool) fileKey() bool {
+	if tool.Name != ToolPesign {
+		return !strings.HasPrefix(tool.Key, "pkcs11:")
+	}
+
+	for i, arg := range tool.Args {
+		var token string
+
+		switch {
+		case (arg == "-t" || arg == "--token") && i+1 < len(tool.Args):
+			token = tool.Args[i+1]
+		case strings.HasPrefix(arg, "--token="):
+			token = strings.TrimPrefix(arg, "--token=")
+		}
+
+		if token != "" && token != defaultNSSToken {
+			return false
+		}
+	}
+
+	return true
+}
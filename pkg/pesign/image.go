@@ -0,0 +1,337 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/pkcs7"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// offset of the checksum from the start of the optional header.
+const checksumOffset = 64
+
+// image is a PE file parsed for Authenticode signing.
+//
+// It hashes and copies the file through its io.ReaderAt, and only keeps the offsets and the
+// certificate table around, so signing a file needs memory independent of its size.
+// The digest and the signed layout match the ones of go-uefi authenticode.Parse.
+type image struct {
+	r io.ReaderAt
+	// size of the file.
+	size int64
+	// size of the file without the certificate table.
+	contentSize int64
+	// file offset of the certificate table data directory entry.
+	entryOffset int64
+	// the certificate table data directory entry.
+	certDir pe.DataDirectory
+	// signatures already in the file.
+	certTable []byte
+	// Authenticode SHA256 digest of the file.
+	digest []byte
+	// file offset of the optional header.
+	optOffset int64
+	// whether digest was given instead of computed, it is checked against the file written then.
+	digestGiven bool
+}
+
+// parseImage reads the PE headers and computes the Authenticode digest of the file, unless it is
+// already known from writing the file. A known digest is only used for files without signatures,
+// as written through a Digester, and checked by writeTo against the file it writes.
+func parseImage(r io.ReaderAt, size int64, digest []byte) (*image, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading PE file: %w", err)
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	var sizeOfHeaders int64
+
+	switch optHeader := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		sizeOfHeaders = int64(optHeader.SizeOfHeaders)
+	case *pe.OptionalHeader64:
+		sizeOfHeaders = int64(optHeader.SizeOfHeaders)
+	default:
+		return nil, errors.New("missing optional header")
+	}
+
+	optOffset, _, err := optionalHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	entryOffset, tableOffset, tableSize, err := certificateTable(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &image{
+		r:           r,
+		size:        size,
+		contentSize: size - int64(tableSize),
+		entryOffset: entryOffset,
+		certDir:     pe.DataDirectory{VirtualAddress: tableOffset, Size: tableSize},
+		digest:      digest,
+		optOffset:   optOffset,
+		digestGiven: digest != nil && tableSize == 0,
+	}
+
+	if !img.digestGiven {
+		if img.digest, err = img.hash(f, optOffset, sizeOfHeaders); err != nil {
+			return nil, err
+		}
+	} else if img.contentSize < sizeOfHeaders {
+		return nil, errors.New("sections and certificate table exceed the file size")
+	}
+
+	if tableOffset != 0 && tableSize != 0 {
+		img.certTable = make([]byte, tableSize)
+		if _, err = r.ReadAt(img.certTable, int64(tableOffset)); err != nil {
+			return nil, fmt.Errorf("failed reading certificate table: %w", err)
+		}
+	}
+
+	return img, nil
+}
+
+// hash computes the Authenticode digest of the file.
+func (img *image) hash(f *pe.File, optOffset, sizeOfHeaders int64) ([]byte, error) {
+	r := img.r
+	h := sha256.New()
+	buf := utils.NewBuffer()
+
+	hashRange := func(start, end int64) error {
+		if end < start {
+			return fmt.Errorf("invalid range %d-%d", start, end)
+		}
+
+		n, err := io.CopyBuffer(h, io.NewSectionReader(r, start, end-start), buf)
+		if err != nil {
+			return err
+		}
+
+		if n != end-start {
+			return fmt.Errorf("short read at %d: %w", start, io.ErrUnexpectedEOF)
+		}
+
+		return nil
+	}
+
+	// the headers, without the checksum and the certificate table entry
+	cksumStart := optOffset + checksumOffset
+	for _, rng := range [][2]int64{
+		{0, cksumStart},
+		{cksumStart + 4, img.entryOffset},
+		{img.entryOffset + 8, sizeOfHeaders},
+	} {
+		if err := hashRange(rng[0], rng[1]); err != nil {
+			return nil, fmt.Errorf("failed hashing headers: %w", err)
+		}
+	}
+
+	hashed := sizeOfHeaders
+
+	// the sections in file order
+	sections := append([]*pe.Section(nil), f.Sections...)
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Offset < sections[j].Offset })
+
+	for _, section := range sections {
+		if section.Size == 0 {
+			continue
+		}
+
+		start := int64(section.Offset)
+		if err := hashRange(start, start+int64(section.Size)); err != nil {
+			return nil, fmt.Errorf("can't parse section data from binary: %w", err)
+		}
+
+		hashed += int64(section.Size)
+	}
+
+	// and anything after them save for the certificate table
+	if hashed > img.contentSize {
+		return nil, errors.New("sections and certificate table exceed the file size")
+	}
+
+	if err := hashRange(hashed, img.contentSize); err != nil {
+		return nil, fmt.Errorf("failed hashing trailing data: %w", err)
+	}
+
+	h.Write(make([]byte, img.padding()))
+
+	return h.Sum(nil), nil
+}
+
+// padding is the number of zero bytes aligning the file size to 8 bytes.
+func (img *image) padding() int64 {
+	return (8 - img.size%8) % 8
+}
+
+// signatures returns the Authenticode signatures in the certificate table.
+func (img *image) signatures() ([]*signature.WINCertificate, error) {
+	var signatures []*signature.WINCertificate
+
+	reader := bytes.NewReader(img.certTable)
+	for reader.Len() > signature.SizeofWINCertificate {
+		sig, err := signature.ReadWinCertificate(reader)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse signature: %w", err)
+		}
+
+		signatures = append(signatures, &sig)
+
+		// all certificates are padded to 8 bytes
+		if _, err = reader.Seek(int64(pad8(int(sig.Length))), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+
+	return signatures, nil
+}
+
+// verify checks whether one of the signatures covers the file digest and is signed with the certificate.
+//
+// It returns false and no error if the file has no signatures at all.
+func (img *image) verify(cert *x509.Certificate) (bool, error) {
+	sigs, err := img.signatures()
+	if err != nil {
+		return false, fmt.Errorf("failed fetching certificates from binary: %w", err)
+	}
+
+	if len(sigs) == 0 {
+		return false, nil
+	}
+
+	for _, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			return false, fmt.Errorf("failed parsing pkcs7 signature from binary: %w", err)
+		}
+
+		if !auth.Algid.Algorithm.Equal(pkcs7.OIDDigestAlgorithmSHA256) {
+			return false, errors.New("unsupported hashing function")
+		}
+
+		if !bytes.Equal(auth.Digest, img.digest) {
+			return false, errors.New("incorrect digest")
+		}
+
+		ok, err := auth.Pkcs.Verify(cert)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, authenticode.ErrNoValidSignatures
+}
+
+// sign appends a signature of the file digest to the certificate table.
+func (img *image) sign(signer crypto.Signer, cert *x509.Certificate) error {
+	content, err := authenticode.CreateSpcIndirectDataContent(img.digest, crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed creating SpcIndirectDataContent: %w", err)
+	}
+
+	sig, err := pkcs7.SignPKCS7(signer, cert, authenticode.OIDSpcIndirectDataContent, content)
+	if err != nil {
+		return fmt.Errorf("failed signing binary: %w", err)
+	}
+
+	length := uint32(signature.SizeofWINCertificate + len(sig))
+	padding := pad8(int(length))
+
+	var table bytes.Buffer
+
+	table.Write(img.certTable)
+	signature.WriteWinCertificate(&table, &signature.WINCertificate{
+		Length:      length,
+		Revision:    0x0200,
+		CertType:    signature.WIN_CERT_TYPE_PKCS_SIGNED_DATA,
+		Certificate: sig,
+	})
+	table.Write(make([]byte, padding))
+
+	if img.certDir.VirtualAddress == 0 || img.certDir.Size == 0 {
+		// the table goes after the padded contents
+		img.certDir.VirtualAddress = uint32(img.size + img.padding())
+		img.certDir.Size = 0
+	}
+
+	img.certDir.Size += length + uint32(padding)
+	img.certTable = table.Bytes()
+
+	return nil
+}
+
+// writeTo writes the file with its certificate table.
+//
+// A given digest is checked against the contents written, recomputed on the way, so a stale or
+// forged digest fails the write instead of being signed into a file it does not describe.
+func (img *image) writeTo(w io.Writer) error {
+	var entry [8]byte
+
+	binary.LittleEndian.PutUint32(entry[0:4], img.certDir.VirtualAddress)
+	binary.LittleEndian.PutUint32(entry[4:8], img.certDir.Size)
+
+	buf := utils.NewBuffer()
+
+	contents := w
+
+	var digester *Digester
+	if img.digestGiven {
+		digester = NewDigester(img.optOffset)
+		contents = io.MultiWriter(w, digester)
+	}
+
+	for _, part := range []io.Reader{
+		io.NewSectionReader(img.r, 0, img.entryOffset),
+		bytes.NewReader(entry[:]),
+		io.NewSectionReader(img.r, img.entryOffset+8, img.contentSize-img.entryOffset-8),
+	} {
+		if _, err := io.CopyBuffer(contents, part, buf); err != nil {
+			return err
+		}
+	}
+
+	if digester != nil && !bytes.Equal(digester.Digest(), img.digest) {
+		return types.WithCategory(types.ErrVerification, errors.New("the given digest does not match the file"))
+	}
+
+	for _, part := range []io.Reader{
+		bytes.NewReader(make([]byte, img.padding())),
+		bytes.NewReader(img.certTable),
+	} {
+		if _, err := io.CopyBuffer(w, part, buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pad8 returns the number of bytes aligning n to 8 bytes.
+func pad8(n int) int {
+	return (8 - n%8) % 8
+}
@@ -0,0 +1,148 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	"github.com/youmark/pkcs8"
+)
+
+// PassphraseFunc is called to obtain the secret protecting a key, i.e. the passphrase of an
+// encrypted key file or the PIN of a hardware token. The prompt describes what is asked for.
+type PassphraseFunc func(prompt string) ([]byte, error)
+
+// ErrEncryptedKey is returned when a key is encrypted and no PassphraseFunc was given.
+var ErrEncryptedKey = errors.New("key is encrypted and no passphrase was provided")
+
+// ErrKeyDestroyed is returned when signing with a signer whose key was destroyed.
+var ErrKeyDestroyed = errors.New("key was destroyed")
+
+// parsePrivateKey parses a PEM encoded RSA private key in PKCS#1 or PKCS#8 format,
+// decrypting it with the passphrase returned by the PassphraseFunc if needed.
+//
+// The decoded key and the passphrase are zeroed once parsed, keyData is left to the caller.
+func parsePrivateKey(keyData []byte, name string, passphrase PassphraseFunc) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, errors.New("failed to decode private key")
+	}
+
+	defer clear(block.Bytes)
+
+	der := block.Bytes
+
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		secret, err := askPassphrase(name, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		defer clear(secret)
+
+		if err = fips.CheckHMACKey(secret); err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key %s: %w", name, err)
+		}
+
+		key, err := pkcs8.ParsePKCS8PrivateKeyRSA(der, secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key %s: %w", name, err)
+		}
+
+		return key, nil
+	//nolint:staticcheck // legacy encrypted PEM keys are still produced by openssl rsa -aes256
+	case x509.IsEncryptedPEMBlock(block):
+		// the key is derived from the passphrase with MD5
+		if err := fips.Check("legacy PEM encryption of " + name); err != nil {
+			return nil, fmt.Errorf("%w, convert the key to encrypted PKCS#8", err)
+		}
+
+		secret, err := askPassphrase(name, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		//nolint:staticcheck
+		der, err = x509.DecryptPEMBlock(block, secret)
+		clear(secret)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key %s: %w", name, err)
+		}
+
+		defer clear(der)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private RSA key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
+
+func askPassphrase(name string, passphrase PassphraseFunc) ([]byte, error) {
+	if passphrase == nil {
+		return nil, fmt.Errorf("%s: %w", name, ErrEncryptedKey)
+	}
+
+	return passphrase(fmt.Sprintf("Passphrase for %s: ", name))
+}
+
+// zeroKey overwrites the private parts of the key, so they don't linger in memory once the key is no
+// longer used. The signers drop the key afterwards, as rsa may still sign with its precomputed values.
+func zeroKey(key *rsa.PrivateKey) {
+	if key == nil {
+		return
+	}
+
+	values := []*big.Int{key.D, key.Precomputed.Dp, key.Precomputed.Dq, key.Precomputed.Qinv}
+	values = append(values, key.Primes...)
+
+	//nolint:staticcheck // CRTValues are only set for keys of more than two primes
+	for _, crt := range key.Precomputed.CRTValues {
+		values = append(values, crt.Exp, crt.Coeff, crt.R)
+	}
+
+	for _, v := range values {
+		if v != nil {
+			clear(v.Bits())
+			v.SetInt64(0)
+		}
+	}
+}
+
+// destroyedKey stands for a destroyed key, keeping its public key.
+type destroyedKey struct {
+	public crypto.PublicKey
+}
+
+// Public implements crypto.Signer.
+func (k destroyedKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Sign implements crypto.Signer, always failing with ErrKeyDestroyed.
+func (k destroyedKey) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, ErrKeyDestroyed
+}
@@ -6,8 +6,11 @@
 package pesign
 
 import (
+	"bufio"
+	"bytes"
 	"crypto"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -16,13 +19,23 @@ import (
 	"log/slog"
 	"os"
 
-	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
+	"github.com/kairos-io/go-ukify/pkg/fips"
 	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
 )
 
 // Signer sigs PE (portable executable) files.
 type Signer struct {
 	provider CertificateSigner
+	// tool signing the files instead of provider, see NewExternalSigner
+	external *ExternalTool
+
+	// Logger of the signing messages, slog.Default() when nil.
+	Logger *slog.Logger
+	// Threshold of approvals the files need before they are signed by Sign and SignDigested, none
+	// when nil.
+	Threshold *Threshold
 }
 
 // CertificateSigner is a provider of the certificate and the signer.
@@ -38,91 +51,290 @@ func NewSigner(provider CertificateSigner) (*Signer, error) {
 	}, nil
 }
 
+// HardwareBacked is implemented by the providers and PCR signers holding their key out of the process,
+// i.e. in a PKCS#11 token, a TPM, a KMS or a signing service.
+type HardwareBacked interface {
+	HardwareBacked() bool
+}
+
+// IsHardwareBacked returns whether signer marks itself hardware-backed, any other signer is taken as
+// signing with a key file.
+func IsHardwareBacked(signer any) bool {
+	hw, ok := signer.(HardwareBacked)
+
+	return ok && hw.HardwareBacked()
+}
+
+// FileKey returns whether the signer signs with a key file: a key given to an external tool as a file,
+// or the key of a provider not marked hardware-backed, see HardwareBacked.
+func (s *Signer) FileKey() bool {
+	if s.external != nil {
+		return s.external.fileKey()
+	}
+
+	return !IsHardwareBacked(s.provider)
+}
+
 // Sign signs the input file and writes the output to the output file.
+//
+// The input is hashed and copied in a streaming fashion, so memory use does not grow with its size.
+// The output may be the input itself, it is replaced once fully written.
 func (s *Signer) Sign(input, output string) error {
+	_, _, err := s.sign(input, output, nil, s.Threshold)
+
+	return err
+}
+
+// SignDigested signs the input file like Sign, digest being its Authenticode SHA256 digest computed
+// while writing it, e.g. with a Digester, so the input is only read once to copy it into the output.
+// The digest is recomputed from the output while it is written, which fails with ErrVerification
+// and is not published if they differ. It is ignored for inputs already signed.
+//
+// It returns the SHA256 of the output computed while writing it, nil if the output is the input
+// signed already.
+func (s *Signer) SignDigested(input, output string, digest []byte) ([]byte, error) {
+	sum, _, err := s.sign(input, output, digest, s.Threshold)
+
+	return sum, err
+}
+
+// SignApproved signs the input file like SignDigested once approved by threshold instead of the
+// Threshold of the signer, and also returns the approvals, covering the Authenticode digest of the
+// output. There are none when threshold is nil. An input signed already is approved all the same
+// before it is copied.
+func (s *Signer) SignApproved(input, output string, digest []byte, threshold *Threshold) ([]byte, []Approval, error) {
+	return s.sign(input, output, digest, threshold)
+}
+
+func (s *Signer) sign(input, output string, digest []byte, threshold *Threshold) ([]byte, []Approval, error) {
 	if _, err := os.Stat(input); errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("%s does not exist", input)
+		return nil, nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s does not exist", input))
+	}
+	s.log().Debug("Signing file", "input", input, "output", output)
+
+	if err := s.checkKey(); err != nil {
+		return nil, nil, err
 	}
-	slog.Debug("Signing file", "input", input, "output", output)
 
-	si, err := os.Stat(input)
+	in, err := utils.OpenSequential(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer in.Close()                //nolint:errcheck
+	defer utils.DoneWith(in, false) //nolint:errcheck
+
+	si, err := in.Stat()
 	if err != nil {
-		return fmt.Errorf("failed getting input file info: %w", err)
+		return nil, nil, fmt.Errorf("failed getting input file info: %w", err)
 	}
 
-	ok, err := s.VerifyFile(input)
-	if ok {
-		slog.Warn("File is already signed with the cert, copying it into output file")
+	// parse the input once, both to check whether it is signed already and to sign it
+	img, err := parseImage(in, si.Size(), digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the output is hashed while written, for the caller to not read it once more
+	sum := sha256.New()
+
+	// the signature is only attached once approved, the approvals covering the same digest. Inputs
+	// signed already are approved too, every output then being covered.
+	var approvals []Approval
+
+	if threshold != nil {
+		if approvals, err = threshold.Approve(img.digest); err != nil {
+			return nil, nil, err
+		}
+
+		for _, approval := range approvals {
+			s.log().Info("File approved", "input", input, "approver", approval.Approver)
+		}
+	}
+
+	if ok, _ := img.verify(s.provider.Certificate()); ok {
+		s.log().Warn("File is already signed with the cert, copying it into output file", "input", input)
 		// already signed with the cert
 		// just copy it to the output place
-		f, err := os.ReadFile(input)
-		if err != nil {
-			return fmt.Errorf("failed reading input file: %w", err)
+		if so, err := os.Stat(output); err == nil && os.SameFile(si, so) {
+			return nil, approvals, nil
 		}
-		if err = os.WriteFile(output, f, si.Mode()); err != nil {
-			return fmt.Errorf("failed writing output file: %w", err)
+		if err = writeOutput(output, si.Mode(), func(w io.Writer) error {
+			_, err := io.CopyBuffer(io.MultiWriter(w, sum), io.NewSectionReader(in, 0, si.Size()), utils.NewBuffer())
+
+			return err
+		}); err != nil {
+			return nil, nil, fmt.Errorf("failed writing output file: %w", err)
 		}
-		return nil
+		return sum.Sum(nil), approvals, nil
 	}
 
-	peFile, err := os.Open(input)
-	if err != nil {
-		return err
-	}
-	defer peFile.Close()
+	if s.external != nil {
+		signed, err := s.signExternal(input, output, si.Mode())
+		if err != nil {
+			return nil, nil, err
+		}
 
-	peBinary, err := authenticode.Parse(peFile)
-	if err != nil {
-		return err
+		return signed, approvals, nil
 	}
 
-	_, err = peBinary.Sign(s.provider.Signer(), s.provider.Certificate())
-	if err != nil {
-		return err
+	if err = img.sign(s.provider.Signer(), s.provider.Certificate()); err != nil {
+		return nil, nil, err
 	}
 
-	if err = os.WriteFile(output, peBinary.Bytes(), si.Mode()); err != nil {
-		return err
+	if err = writeOutput(output, si.Mode(), func(w io.Writer) error {
+		return img.writeTo(io.MultiWriter(w, sum))
+	}); err != nil {
+		return nil, nil, err
 	}
 
-	// Now verify the output just in case
-	ok, err = s.VerifyFile(output)
+	// Now verify the new signature just in case, the digest covers the output written, see writeTo
+	ok, err := img.verify(s.provider.Certificate())
 	if !ok || err != nil {
-		return fmt.Errorf("failed verifying output file: %w", err)
+		return nil, nil, types.WithCategory(types.ErrVerification, fmt.Errorf("failed verifying output file: %w", err))
+	}
+
+	return sum.Sum(nil), approvals, nil
+}
+
+// checkKey refuses destroyed keys, before pkcs7 exits on their signing errors, and keys not approved
+// for FIPS 140-3 signatures, when enforced.
+func (s *Signer) checkKey() error {
+	if _, destroyed := s.provider.Signer().(destroyedKey); destroyed {
+		return types.WithCategory(types.ErrSigning, ErrKeyDestroyed)
+	}
+
+	if err := fips.CheckKey(s.provider.Certificate().PublicKey); err != nil {
+		return types.WithCategory(types.ErrSigning, fmt.Errorf("SecureBoot signature: %w", err))
 	}
 
 	return nil
 }
 
+// log returns the logger of the signing messages.
+func (s *Signer) log() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+
+	return s.Logger
+}
+
+// writeOutput writes the output file buffered, atomically with utils.WriteFileAtomic, so the output
+// can be the very file being read, and is never seen truncated.
+func writeOutput(output string, mode os.FileMode, write func(w io.Writer) error) error {
+	return utils.WriteFileAtomic(output, mode.Perm(), func(out io.Writer) error {
+		w := bufio.NewWriterSize(out, utils.StreamBufferSize())
+
+		if err := write(w); err != nil {
+			return err
+		}
+
+		return w.Flush()
+	})
+}
+
+// SignDetached returns a detached PKCS#7 signature of the data.
+func (s *Signer) SignDetached(data []byte) ([]byte, error) {
+	if s.external != nil {
+		return nil, fmt.Errorf("detached signatures can't be made with %s", s.external.Name)
+	}
+
+	if err := s.checkKey(); err != nil {
+		return nil, err
+	}
+
+	return pkcs7.SignPKCS7(s.provider.Signer(), s.provider.Certificate(), pkcs7.OIDData, data)
+}
+
+// Certificate returns the certificate files are signed with.
+func (s *Signer) Certificate() *x509.Certificate {
+	return s.provider.Certificate()
+}
+
+// VerifyFile checks whether the file is signed with the signer certificate.
 func (s *Signer) VerifyFile(file string) (bool, error) {
-	peFile, err := os.Open(file)
+	return VerifyFile(file, s.provider.Certificate())
+}
+
+// VerifyFile checks whether the PE file is signed with the given certificate.
+//
+// It returns false and no error if the file has no signatures at all.
+func VerifyFile(file string, cert *x509.Certificate) (bool, error) {
+	img, err := parseFile(file)
 	if err != nil {
 		return false, err
 	}
-	defer peFile.Close()
 
-	peBinary, err := authenticode.Parse(peFile)
+	ok, err := img.verify(cert)
 	if err != nil {
-		return false, err
+		return false, fmt.Errorf("%s: %w", file, err)
 	}
 
-	sigs, err := peBinary.Signatures()
+	return ok, nil
+}
+
+// VerifyDetached checks whether the detached PKCS#7 signature, as made by SignDetached, is a
+// signature of the data with the given certificate.
+func VerifyDetached(data, signature []byte, cert *x509.Certificate) (bool, error) {
+	p7, err := pkcs7.ParsePKCS7(signature)
 	if err != nil {
-		return false, fmt.Errorf("%s: %w", file, err)
+		return false, fmt.Errorf("failed parsing pkcs7 signature: %w", err)
 	}
 
-	if len(sigs) == 0 {
+	// as made by SignDetached, so the signer checked against the data is the one verified
+	if len(p7.SignerInfo) != 1 {
+		return false, fmt.Errorf("expected one signer, got %d", len(p7.SignerInfo))
+	}
+
+	// the signature covers the attributes, which carry the digest of the data
+	sum := sha256.Sum256(data)
+	if attrs := p7.SignerInfo[0].AuthenticatedAttributes; attrs == nil || !bytes.Equal(attrs.MessageDigest, sum[:]) {
 		return false, nil
 	}
 
-	return peBinary.Verify(s.provider.Certificate())
+	return p7.Verify(cert)
+}
+
+// Digest returns the Authenticode SHA256 digest of the PE file, as listed in db and dbx.
+//
+// The file is streamed, so the memory needed does not depend on its size.
+func Digest(file string) ([]byte, error) {
+	img, err := parseFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.digest, nil
+}
+
+// parseFile parses the PE file for its digest and signatures, the returned image can't be written.
+func parseFile(file string) (*image, error) {
+	f, err := utils.OpenSequential(file)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()                //nolint:errcheck
+	defer utils.DoneWith(f, false) //nolint:errcheck
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseImage(f, st.Size(), nil)
 }
 
 // Verify interface.
 var _ CertificateSigner = (*SecureBootSigner)(nil)
 
-// Signer returns the signer.
+// Signer returns the signer, failing to sign with ErrKeyDestroyed once destroyed.
 func (s *SecureBootSigner) Signer() crypto.Signer {
+	if s.key == nil {
+		return destroyedKey{public: s.cert.PublicKey}
+	}
+
 	return s.key
 }
 
@@ -137,30 +349,72 @@ type SecureBootSigner struct {
 	cert *x509.Certificate
 }
 
+// NewSecureBootSigner creates a new SecureBoot signer from PEM encoded certificate and key files.
 func NewSecureBootSigner(certPath, keyPath string) (*SecureBootSigner, error) {
-	keyData, err := os.ReadFile(keyPath)
+	return NewSecureBootSignerWithPassphrase(certPath, keyPath, nil)
+}
+
+// NewSecureBootSignerWithPassphrase is like NewSecureBootSigner, calling passphrase to decrypt the key if it is encrypted.
+// The key may also be a systemd-creds encrypted credential.
+func NewSecureBootSignerWithPassphrase(certPath, keyPath string, passphrase PassphraseFunc) (*SecureBootSigner, error) {
+	keyData, err := readKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer clear(keyData)
+
+	cert, err := LoadCertificate(certPath)
 	if err != nil {
 		return nil, err
 	}
 
-	// convert private key to rsa.PrivateKey
-	rsaPrivateKeyBlock, _ := pem.Decode(keyData)
-	if rsaPrivateKeyBlock == nil {
-		return nil, errors.New("failed to decode private key")
+	return newSecureBootSigner(cert, keyData, keyPath, passphrase)
+}
+
+// NewSecureBootSignerFromPEM creates a new SecureBoot signer from the PEM encoded certificate and key,
+// for keys that are never written to disk. The key is decrypted with passphrase if it is encrypted.
+//
+// The signer keeps no reference to keyPEM, the caller should zero it once the signer is created.
+func NewSecureBootSignerFromPEM(certPEM, keyPEM []byte, passphrase PassphraseFunc) (*SecureBootSigner, error) {
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
 	}
 
-	rsaKey, err := x509.ParsePKCS8PrivateKey(rsaPrivateKeyBlock.Bytes)
-	rsaKeyParsed := rsaKey.(*rsa.PrivateKey)
+	return newSecureBootSigner(cert, keyPEM, "the SecureBoot key", passphrase)
+}
 
+func newSecureBootSigner(cert *x509.Certificate, keyData []byte, name string, passphrase PassphraseFunc) (*SecureBootSigner, error) {
+	rsaKeyParsed, err := parsePrivateKey(keyData, name, passphrase)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse private RSA key: %w", err)
+		return nil, err
 	}
 
+	return &SecureBootSigner{
+		key:  rsaKeyParsed,
+		cert: cert,
+	}, nil
+}
+
+// Destroy zeroes the private key in memory and drops it, signing fails with ErrKeyDestroyed afterwards.
+func (s *SecureBootSigner) Destroy() {
+	zeroKey(s.key)
+	s.key = nil
+}
+
+// LoadCertificate reads a PEM encoded x509 certificate.
+func LoadCertificate(certPath string) (*x509.Certificate, error) {
 	certData, err := os.ReadFile(certPath)
 	if err != nil {
 		return nil, err
 	}
 
+	return ParseCertificate(certData)
+}
+
+// ParseCertificate parses a PEM encoded x509 certificate.
+func ParseCertificate(certData []byte) (*x509.Certificate, error) {
 	certBlock, _ := pem.Decode(certData)
 	if certBlock == nil {
 		return nil, errors.New("failed to decode certificate")
@@ -171,10 +425,7 @@ func NewSecureBootSigner(certPath, keyPath string) (*SecureBootSigner, error) {
 		return nil, fmt.Errorf("failed to parse certificate: %w", err)
 	}
 
-	return &SecureBootSigner{
-		key:  rsaKeyParsed,
-		cert: cert,
-	}, nil
+	return cert, nil
 }
 
 // SigningKeyAndCertificate describes a signing key & certificate.
@@ -189,6 +440,8 @@ type SigningKeyAndCertificate struct {
 // PCRSigner implements measure.RSAKey interface.
 type PCRSigner struct {
 	key *rsa.PrivateKey
+	// public is kept once the key is destroyed
+	public *rsa.PublicKey
 }
 
 // Verify interface.
@@ -196,7 +449,7 @@ var _ types.RSAKey = (*PCRSigner)(nil)
 
 // PublicRSAKey returns the public key.
 func (s *PCRSigner) PublicRSAKey() *rsa.PublicKey {
-	return &s.key.PublicKey
+	return s.public
 }
 
 // Public returns the public key.
@@ -206,33 +459,51 @@ func (s *PCRSigner) Public() crypto.PublicKey {
 
 // Sign implements the crypto.Signer interface.
 func (s *PCRSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
+	if s.key == nil {
+		return nil, ErrKeyDestroyed
+	}
+
 	return s.key.Sign(rand, digest, opts)
 }
 
 // NewPCRSigner creates a new PCR signer from the private key file.
 func NewPCRSigner(keyPath string) (*PCRSigner, error) {
-	keyData, err := os.ReadFile(keyPath)
+	return NewPCRSignerWithPassphrase(keyPath, nil)
+}
+
+// NewPCRSignerWithPassphrase is like NewPCRSigner, calling passphrase to decrypt the key if it is encrypted.
+// The key may also be a systemd-creds encrypted credential.
+func NewPCRSignerWithPassphrase(keyPath string, passphrase PassphraseFunc) (*PCRSigner, error) {
+	keyData, err := readKey(keyPath)
 	if err != nil {
 		return nil, err
 	}
 
-	// convert private key to rsa.PrivateKey
-	rsaPrivateKeyBlock, _ := pem.Decode(keyData)
-	if rsaPrivateKeyBlock == nil {
-		return nil, errors.New("failed to decode private key")
+	defer clear(keyData)
+
+	rsaKey, err := parsePrivateKey(keyData, keyPath, passphrase)
+	if err != nil {
+		return nil, err
 	}
 
-	var rsaKey *rsa.PrivateKey
-	rsaKey, err = x509.ParsePKCS1PrivateKey(rsaPrivateKeyBlock.Bytes)
+	return &PCRSigner{key: rsaKey, public: &rsaKey.PublicKey}, nil
+}
+
+// NewPCRSignerFromPEM creates a new PCR signer from the PEM encoded private key, for keys that are never
+// written to disk. The key is decrypted with passphrase if it is encrypted.
+//
+// The signer keeps no reference to keyPEM, the caller should zero it once the signer is created.
+func NewPCRSignerFromPEM(keyPEM []byte, passphrase PassphraseFunc) (*PCRSigner, error) {
+	rsaKey, err := parsePrivateKey(keyPEM, "the PCR key", passphrase)
 	if err != nil {
-		// Try to see if its in a different format maybe?
-		key, err := x509.ParsePKCS8PrivateKey(rsaPrivateKeyBlock.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse private RSA key: %v", err)
-		}
-		rsaKey = key.(*rsa.PrivateKey)
+		return nil, err
 	}
 
-	//rsaKeyParsed := rsaKey.(*rsa.PrivateKey)
-	return &PCRSigner{rsaKey}, nil
+	return &PCRSigner{key: rsaKey, public: &rsaKey.PublicKey}, nil
+}
+
+// Destroy zeroes the private key in memory and drops it, signing fails with ErrKeyDestroyed afterwards.
+func (s *PCRSigner) Destroy() {
+	zeroKey(s.key)
+	s.key = nil
 }
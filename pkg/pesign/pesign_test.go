@@ -1,10 +1,24 @@
 package pesign
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"github.com/foxboron/go-uefi/authenticode"
 	"github.com/foxboron/go-uefi/pkcs7"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/youmark/pkcs8"
+	"math/big"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -16,6 +30,11 @@ func TestSuite(t *testing.T) {
 	RunSpecs(t, "Pesign test Suite")
 }
 
+// hardwareProvider marks the provider it wraps hardware-backed.
+type hardwareProvider struct{ CertificateSigner }
+
+func (hardwareProvider) HardwareBacked() bool { return true }
+
 var _ = Describe("Pesign tests", func() {
 	var sbSigner *Signer
 	var tmpDir string
@@ -67,4 +86,444 @@ var _ = Describe("Pesign tests", func() {
 		})
 
 	})
+	Describe("Encrypted keys", func() {
+		var encryptedKey string
+
+		BeforeEach(func() {
+			sb, err := NewSecureBootSigner("testdata/sb.pem", "testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+			der, err := pkcs8.MarshalPrivateKey(sb.key, []byte("secret"), nil)
+			Expect(err).ToNot(HaveOccurred())
+			encryptedKey = filepath.Join(tmpDir, "sb.key")
+			Expect(os.WriteFile(encryptedKey, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), 0o600)).To(Succeed())
+		})
+		It("Asks for the passphrase", func() {
+			var prompts []string
+			sb, err := NewSecureBootSignerWithPassphrase("testdata/sb.pem", encryptedKey, func(prompt string) ([]byte, error) {
+				prompts = append(prompts, prompt)
+				return []byte("secret"), nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sb.key).ToNot(BeNil())
+			Expect(prompts).To(HaveLen(1))
+			Expect(prompts[0]).To(ContainSubstring(encryptedKey))
+		})
+		It("Fails without a passphrase", func() {
+			_, err := NewSecureBootSigner("testdata/sb.pem", encryptedKey)
+			Expect(errors.Is(err, ErrEncryptedKey)).To(BeTrue())
+		})
+		It("Fails with the wrong passphrase", func() {
+			_, err := NewPCRSignerWithPassphrase(encryptedKey, func(string) ([]byte, error) {
+				return []byte("wrong"), nil
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("Encrypted credentials", func() {
+		var credential string
+
+		BeforeEach(func() {
+			// the fake systemd-creds "decrypts" the Base64 encoded key
+			tool := filepath.Join(tmpDir, "systemd-creds")
+			Expect(os.WriteFile(tool, []byte("#!/bin/sh\n[ \"$1\" = decrypt ] && base64 -d \"$2\"\n"), 0o755)).To(Succeed())
+
+			previous := SystemdCredsPath
+			SystemdCredsPath = tool
+			DeferCleanup(func() { SystemdCredsPath = previous })
+
+			key, err := os.ReadFile("testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+			credential = filepath.Join(tmpDir, "sb.key.cred")
+			Expect(os.WriteFile(credential, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600)).To(Succeed())
+		})
+		It("Decrypts the key with systemd-creds", func() {
+			sb, err := NewSecureBootSigner("testdata/sb.pem", credential)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sb.key).ToNot(BeNil())
+
+			pcr, err := NewPCRSigner(credential)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pcr.PublicRSAKey()).To(Equal(&sb.key.PublicKey))
+		})
+		It("Fails when systemd-creds fails", func() {
+			SystemdCredsPath = "false"
+			_, err := NewPCRSigner(credential)
+			Expect(err).To(MatchError(ContainSubstring("failed to decrypt credential")))
+		})
+	})
+	Describe("In-memory keys", func() {
+		It("Loads the keys from memory and zeroes them", func() {
+			certPEM, err := os.ReadFile("testdata/sb.pem")
+			Expect(err).ToNot(HaveOccurred())
+			keyPEM, err := os.ReadFile("testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+
+			sb, err := NewSecureBootSignerFromPEM(certPEM, keyPEM, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sb.Certificate().Subject.CommonName).To(Equal("Kairos DB"))
+
+			signer, err := NewSigner(sb)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Sign("testdata/file.efi", filepath.Join(tmpDir, "file.signed.efi"))).To(Succeed())
+
+			// the passphrase is zeroed once the key is decrypted
+			der, err := pkcs8.MarshalPrivateKey(sb.key, []byte("secret"), nil)
+			Expect(err).ToNot(HaveOccurred())
+			secret := []byte("secret")
+			pcr, err := NewPCRSignerFromPEM(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), func(string) ([]byte, error) {
+				return secret, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pcr.PublicRSAKey()).To(Equal(&sb.key.PublicKey))
+			Expect(secret).To(Equal(make([]byte, len(secret))))
+
+			pcrKey, sbKey := pcr.key, sb.key
+
+			pcr.Destroy()
+			Expect(pcrKey.D.Sign()).To(BeZero())
+			for _, prime := range pcrKey.Primes {
+				Expect(prime.Sign()).To(BeZero())
+			}
+
+			sb.Destroy()
+			Expect(sbKey.D.Sign()).To(BeZero())
+
+			// neither signs afterwards
+			digest := sha256.Sum256([]byte("data"))
+			_, err = pcr.Sign(rand.Reader, digest[:], crypto.SHA256)
+			Expect(err).To(MatchError(ErrKeyDestroyed))
+			Expect(pcr.PublicRSAKey()).To(Equal(&pcrKey.PublicKey))
+
+			Expect(signer.Sign("testdata/file.efi", filepath.Join(tmpDir, "file.destroyed.efi"))).To(MatchError(ErrKeyDestroyed))
+			Expect(filepath.Join(tmpDir, "file.destroyed.efi")).ToNot(BeAnExistingFile())
+			_, err = signer.SignDetached([]byte("data"))
+			Expect(err).To(MatchError(ErrKeyDestroyed))
+		})
+	})
+	Describe("Approvals", func() {
+		It("Signs once enough approvers approved the digest", func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Release manager"}}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			Expect(err).ToNot(HaveOccurred())
+			cert, err := x509.ParseCertificate(der)
+			Expect(err).ToNot(HaveOccurred())
+
+			sb := sbSigner.provider.(*SecureBootSigner)
+			manager := &SecureBootSigner{key: key, cert: cert}
+			// signs with a key not matching its certificate
+			impostor := &SecureBootSigner{key: key, cert: sb.cert}
+
+			sbSigner.Threshold = &Threshold{Required: 2, Approvers: []CertificateSigner{sb, manager}}
+			Expect(sbSigner.Sign("testdata/file.efi", filepath.Join(tmpDir, "file.signed.efi"))).To(Succeed())
+			Expect(sbSigner.VerifyFile(filepath.Join(tmpDir, "file.signed.efi"))).To(BeTrue())
+
+			approvals, err := (&Threshold{Required: 1, Approvers: []CertificateSigner{impostor, manager}}).Approve(make([]byte, sha256.Size))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(approvals).To(HaveLen(1))
+			Expect(approvals[0].Approver).To(Equal("CN=Release manager"))
+
+			sbSigner.Threshold = &Threshold{Required: 2, Approvers: []CertificateSigner{impostor, manager}}
+			err = sbSigner.Sign("testdata/file.efi", filepath.Join(tmpDir, "rejected.efi"))
+			Expect(err).To(MatchError(ErrNotApproved))
+			Expect(filepath.Join(tmpDir, "rejected.efi")).ToNot(BeAnExistingFile())
+
+			for _, threshold := range []*Threshold{
+				{Required: 3, Approvers: []CertificateSigner{sb, manager}},
+				{Required: 0, Approvers: []CertificateSigner{sb}},
+				{Required: 2, Approvers: []CertificateSigner{sb, impostor}},
+			} {
+				Expect(threshold.Validate()).To(HaveOccurred())
+			}
+		})
+		It("Returns the approvals, verified against the signed file", func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Release manager"}}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			Expect(err).ToNot(HaveOccurred())
+			cert, err := x509.ParseCertificate(der)
+			Expect(err).ToNot(HaveOccurred())
+
+			sb := sbSigner.provider.(*SecureBootSigner)
+			manager := &SecureBootSigner{key: key, cert: cert}
+			threshold := &Threshold{Required: 2, Approvers: []CertificateSigner{sb, manager}}
+
+			signed := filepath.Join(tmpDir, "file.signed.efi")
+			_, approvals, err := sbSigner.SignApproved("testdata/file.efi", signed, nil, threshold)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(approvals).To(HaveLen(2))
+			Expect(approvals).To(ContainElement(HaveField("Certificate", cert.Raw)))
+			Expect(VerifyApprovals(signed, approvals)).To(Succeed())
+
+			// inputs signed already are approved too
+			copied := filepath.Join(tmpDir, "file.copied.efi")
+			_, copiedApprovals, err := sbSigner.SignApproved(signed, copied, nil, threshold)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(copiedApprovals).To(HaveLen(2))
+			Expect(VerifyApprovals(copied, copiedApprovals)).To(Succeed())
+			_, copiedApprovals, err = sbSigner.SignApproved(signed, signed, nil, threshold)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(copiedApprovals).To(HaveLen(2))
+
+			// the threshold of the signer is not used
+			Expect(sbSigner.Threshold).To(BeNil())
+			_, copiedApprovals, err = sbSigner.SignApproved(signed, copied, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(copiedApprovals).To(BeEmpty())
+
+			digest, _, err := Signatures(signed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(threshold.Verify(digest, approvals)).To(Succeed())
+
+			// not of the digest of the file
+			Expect(threshold.Verify(make([]byte, sha256.Size), approvals)).To(MatchError(types.ErrVerification))
+			Expect(VerifyApprovals("testdata/file.efi", approvals)).To(Succeed())
+			forged := approvals[0]
+			forged.Signature = approvals[1].Signature
+			Expect(VerifyApprovals(signed, []Approval{forged})).To(MatchError(types.ErrVerification))
+
+			// each approver counts once, the others not at all
+			Expect(threshold.Verify(digest, []Approval{approvals[0], approvals[0]})).To(MatchError(ContainSubstring("approved more than once")))
+			other := &Threshold{Required: 1, Approvers: []CertificateSigner{manager}}
+			Expect(other.Verify(digest, approvals)).To(Succeed())
+			i := slices.IndexFunc(approvals, func(a Approval) bool { return bytes.Equal(a.Certificate, sb.cert.Raw) })
+			Expect(other.Verify(digest, approvals[i:i+1])).To(MatchError(ContainSubstring("is not an approver")))
+		})
+	})
+	Describe("Unsign", func() {
+		It("Removes the signatures from a signed file", func() {
+			signed := filepath.Join(tmpDir, "file.signed.efi")
+			unsigned := filepath.Join(tmpDir, "file.unsigned.efi")
+			Expect(sbSigner.Sign("testdata/file.efi", signed)).ToNot(HaveOccurred())
+
+			ok, err := VerifyFile(signed, sbSigner.provider.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			Expect(Unsign(signed, unsigned)).ToNot(HaveOccurred())
+			ok, err = VerifyFile(unsigned, sbSigner.provider.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+
+			// The unsigned file can be signed again
+			Expect(sbSigner.Sign(unsigned, signed)).ToNot(HaveOccurred())
+		})
+		It("Unsigns a file in place", func() {
+			file := filepath.Join(tmpDir, "file.efi")
+			Expect(sbSigner.Sign("testdata/file.efi", file)).ToNot(HaveOccurred())
+
+			Expect(Unsign(file, file)).ToNot(HaveOccurred())
+			ok, err := VerifyFile(file, sbSigner.provider.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+
+			// The whole image is left, the same digest as the original
+			original, err := os.ReadFile("testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			unsigned, err := os.ReadFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unsigned).To(HaveLen(len(original)))
+
+			binary, err := authenticode.Parse(bytes.NewReader(original))
+			Expect(err).ToNot(HaveOccurred())
+			unsignedBinary, err := authenticode.Parse(bytes.NewReader(unsigned))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unsignedBinary.Hash(crypto.SHA256)).To(Equal(binary.Hash(crypto.SHA256)))
+		})
+	})
+	Describe("Streaming signing", func() {
+		It("Computes the same digest as go-uefi", func() {
+			signed := filepath.Join(tmpDir, "file.signed.efi")
+			Expect(sbSigner.Sign("testdata/file.efi", signed)).ToNot(HaveOccurred())
+
+			for _, file := range []string{"testdata/file.efi", signed} {
+				data, err := os.ReadFile(file)
+				Expect(err).ToNot(HaveOccurred())
+
+				img, err := parseImage(bytes.NewReader(data), int64(len(data)), nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				binary, err := authenticode.Parse(bytes.NewReader(data))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(img.digest).To(Equal(binary.Hash(crypto.SHA256)))
+			}
+
+			// go-uefi accepts the signature too
+			f, err := os.Open(signed)
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			binary, err := authenticode.Parse(f)
+			Expect(err).ToNot(HaveOccurred())
+			ok, err := binary.Verify(sbSigner.provider.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		})
+		It("Signs a file in place", func() {
+			data, err := os.ReadFile("testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			file := filepath.Join(tmpDir, "file.efi")
+			Expect(os.WriteFile(file, data, 0o600)).To(Succeed())
+
+			Expect(sbSigner.Sign(file, file)).ToNot(HaveOccurred())
+			ok, err := VerifyFile(file, sbSigner.provider.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			st, err := os.Stat(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st.Mode().Perm()).To(Equal(os.FileMode(0o600)))
+			Expect(st.Size()).To(BeNumerically(">", len(data)))
+
+			entries, err := os.ReadDir(tmpDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+		It("Signs with the digest computed while writing the file", func() {
+			data, err := os.ReadFile("testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			optOffset, _, err := optionalHeader(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+
+			// written in small writes straddling the skipped fields
+			digester := NewDigester(optOffset)
+			for chunk := data; len(chunk) > 0; chunk = chunk[min(len(chunk), 7):] {
+				_, err = digester.Write(chunk[:min(len(chunk), 7)])
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			digest := digester.Digest()
+			Expect(Digest("testdata/file.efi")).To(Equal(digest))
+
+			signed := filepath.Join(tmpDir, "file.signed.efi")
+			sum, err := sbSigner.SignDigested("testdata/file.efi", signed, digest)
+			Expect(err).ToNot(HaveOccurred())
+
+			out, err := os.ReadFile(signed)
+			Expect(err).ToNot(HaveOccurred())
+			outSum := sha256.Sum256(out)
+			Expect(sum).To(Equal(outSum[:]))
+
+			binary, err := authenticode.Parse(bytes.NewReader(out))
+			Expect(err).ToNot(HaveOccurred())
+			ok, err := binary.Verify(sbSigner.provider.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		})
+		It("Refuses to sign with a digest not matching the file", func() {
+			digest, err := Digest("testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			// i.e. of a file assembled by another build
+			digest[0] ^= 0xff
+
+			signed := filepath.Join(tmpDir, "file.signed.efi")
+			_, err = sbSigner.SignDigested("testdata/file.efi", signed, digest)
+			Expect(err).To(MatchError(types.ErrVerification))
+			Expect(signed).ToNot(BeAnExistingFile())
+
+			entries, err := os.ReadDir(tmpDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+		It("Recomputes the digest of files signed already", func() {
+			signed := filepath.Join(tmpDir, "file.signed.efi")
+			Expect(sbSigner.Sign("testdata/file.efi", signed)).To(Succeed())
+
+			// the digest of the unsigned file still covers the signed one, any other is not used
+			_, err := sbSigner.SignDigested(signed, filepath.Join(tmpDir, "copy.efi"), make([]byte, sha256.Size))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(VerifyFile(filepath.Join(tmpDir, "copy.efi"), sbSigner.provider.Certificate())).To(BeTrue())
+		})
+	})
+	Describe("Signatures", func() {
+		It("Lists the signatures and verifies their chain", func() {
+			signed := filepath.Join(tmpDir, "file.signed.efi")
+			Expect(sbSigner.Sign("testdata/file.efi", signed)).To(Succeed())
+
+			digest, signatures, err := Signatures(signed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(Digest("testdata/file.efi")).To(Equal(digest))
+			Expect(signatures).To(HaveLen(1))
+			Expect(signatures[0].DigestMatches).To(BeTrue())
+			Expect(signatures[0].Signer.Equal(sbSigner.Certificate())).To(BeTrue())
+			Expect(signatures[0].Verify([]*x509.Certificate{sbSigner.Certificate()})).To(Succeed())
+			Expect(signatures[0].Verify(nil)).To(HaveOccurred())
+
+			_, signatures, err = Signatures("testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signatures).To(BeEmpty())
+		})
+	})
+	Describe("External tool", func() {
+		// fakeTool writes a script copying source to the --output argument of sbsign
+		fakeTool := func(source string) string {
+			tool := filepath.Join(tmpDir, "sbsign")
+			script := "#!/bin/sh\nwhile [ $# -gt 1 ]; do if [ \"$1\" = --output ]; then out=$2; fi; shift; done\ncp " + source + " \"$out\"\n"
+			Expect(os.WriteFile(tool, []byte(script), 0o755)).To(Succeed())
+
+			return tool
+		}
+
+		It("Signs with the tool and checks its output", func() {
+			presigned := filepath.Join(tmpDir, "presigned.efi")
+			Expect(sbSigner.Sign("testdata/file.efi", presigned)).To(Succeed())
+
+			signer, err := NewExternalSigner(&ExternalTool{Name: ToolSbsign, Path: fakeTool(presigned), Key: "pkcs11:token=sb", Cert: "testdata/sb.pem"}, sbSigner.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+
+			output := filepath.Join(tmpDir, "file.signed.efi")
+			sum, err := signer.SignDigested("testdata/file.efi", output, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := os.ReadFile(output)
+			Expect(err).ToNot(HaveOccurred())
+			outSum := sha256.Sum256(data)
+			Expect(sum).To(Equal(outSum[:]))
+			Expect(VerifyFile(output, sbSigner.Certificate())).To(BeTrue())
+
+			_, err = signer.SignDetached([]byte("data"))
+			Expect(err).To(HaveOccurred())
+		})
+		It("Fails when the tool output is not signed with the certificate", func() {
+			signer, err := NewExternalSigner(&ExternalTool{Name: ToolSbsign, Path: fakeTool("testdata/file.efi"), Key: "sb.key", Cert: "testdata/sb.pem"}, sbSigner.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(signer.Sign("testdata/file.efi", filepath.Join(tmpDir, "file.signed.efi"))).To(MatchError(types.ErrVerification))
+			Expect(filepath.Join(tmpDir, "file.signed.efi")).ToNot(BeAnExistingFile())
+		})
+		It("Builds the arguments of each tool", func() {
+			Expect((&ExternalTool{Name: ToolOsslsigncode, Key: "k", Cert: "c"}).args("in", "out")).To(Equal([]string{"sign", "-h", "sha256", "-certs", "c", "-key", "k", "-in", "in", "-out", "out"}))
+			Expect((&ExternalTool{Name: ToolPesign, CertName: "sb", CertDir: "/etc/pki/pesign"}).args("in", "out")).To(Equal([]string{"--sign", "--force", "--certificate", "sb", "--in", "in", "--out", "out", "--certdir", "/etc/pki/pesign"}))
+
+			_, err := NewExternalSigner(&ExternalTool{Name: ToolPesign}, sbSigner.Certificate())
+			Expect(err).To(MatchError(ContainSubstring("nickname")))
+			_, err = NewExternalSigner(&ExternalTool{Name: "signtool"}, sbSigner.Certificate())
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+		})
+		It("Tells the signers holding key files", func() {
+			Expect(sbSigner.FileKey()).To(BeTrue())
+
+			// only the providers marked hardware-backed are not key files
+			wrapped, err := NewSigner(struct{ CertificateSigner }{sbSigner.provider})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(wrapped.FileKey()).To(BeTrue())
+			hardware, err := NewSigner(hardwareProvider{sbSigner.provider})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hardware.FileKey()).To(BeFalse())
+
+			for tool, fileKey := range map[*ExternalTool]bool{
+				{Name: ToolSbsign, Key: "sb.key", Cert: "c"}:                                   true,
+				{Name: ToolOsslsigncode, Key: "pkcs11:token=sb;object=db", Cert: "c"}:          false,
+				{Name: ToolPesign, CertName: "sb"}:                                             true,
+				{Name: ToolPesign, CertName: "sb", Args: []string{"-t", "NSS Certificate DB"}}: true,
+				{Name: ToolPesign, CertName: "sb", Args: []string{"--token=HSM"}}:              false,
+			} {
+				signer, err := NewExternalSigner(tool, sbSigner.Certificate())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signer.FileKey()).To(Equal(fileKey), tool.Name)
+			}
+		})
+	})
 })
@@ -0,0 +1,118 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
+)
+
+// Signature is an Authenticode signature of a PE file.
+type Signature struct {
+	// Certificate the signature was made with, nil if it is not embedded or the signature is invalid.
+	Signer *x509.Certificate
+	// Certificates embedded in the signature, usually the signer and its intermediates.
+	Certificates []*x509.Certificate
+	// Whether the signature covers the Authenticode digest of the file.
+	DigestMatches bool
+	// DER encoded attributes signed by Signer, covering the Authenticode digest, and their
+	// SHA256withRSA signature, empty when Signer is nil. They make the signature checkable on its
+	// own, i.e. by a transparency log.
+	SignedAttributes []byte
+	Value            []byte
+}
+
+// Signatures returns the Authenticode SHA256 digest of the PE file and its signatures, none if it is
+// unsigned, i.e. to check the vendor signature of a kernel.
+func Signatures(file string) ([]byte, []Signature, error) {
+	img, err := parseFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sigs, err := img.signatures()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	signatures := make([]Signature, 0, len(sigs))
+
+	for _, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: failed parsing pkcs7 signature: %w", file, err)
+		}
+
+		signature := Signature{
+			Certificates:  auth.Pkcs.Certs,
+			DigestMatches: auth.Algid.Algorithm.Equal(pkcs7.OIDDigestAlgorithmSHA256) && bytes.Equal(auth.Digest, img.digest),
+		}
+
+		for _, cert := range auth.Pkcs.Certs {
+			if ok, err := auth.Pkcs.Verify(cert); err == nil && ok {
+				signature.Signer = cert
+
+				break
+			}
+		}
+
+		for _, si := range auth.Pkcs.SignerInfo {
+			if signature.Signer == nil || si.AuthenticatedAttributes == nil {
+				break
+			}
+
+			attrs := si.AuthenticatedAttributes.Marshal()
+			if signature.Signer.CheckSignature(x509.SHA256WithRSA, attrs, si.EncryptedDigest) == nil {
+				signature.SignedAttributes, signature.Value = attrs, si.EncryptedDigest
+
+				break
+			}
+		}
+
+		signatures = append(signatures, signature)
+	}
+
+	return img.digest, signatures, nil
+}
+
+// Verify checks the signature is valid, covers the file and its signer chains to one of the roots,
+// through the embedded certificates.
+//
+// Firmware does not check the validity period of the certificates, so the chain is checked at the time
+// the signer was issued.
+func (s *Signature) Verify(roots []*x509.Certificate) error {
+	switch {
+	case !s.DigestMatches:
+		return errors.New("the signature does not cover the file")
+	case s.Signer == nil:
+		return errors.New("the signature is not made with an embedded certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   s.Signer.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	for _, root := range roots {
+		opts.Roots.AddCert(root)
+	}
+
+	for _, cert := range s.Certificates {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := s.Signer.Verify(opts); err != nil {
+		return fmt.Errorf("signer %s: %w", s.Signer.Subject, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pesign
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+const (
+	// offset of the PE header offset in the DOS header.
+	peHeaderPointerOffset = 0x3c
+	// size of the PE signature plus the COFF file header.
+	coffHeaderSize = 4 + 20
+	// offsets of the certificate table entry from the start of the optional header.
+	certTableOffsetPE32     = 128
+	certTableOffsetPE32Plus = 144
+)
+
+// optionalHeader returns the file offset and the magic of the optional header.
+func optionalHeader(r io.ReaderAt) (offset int64, magic uint16, err error) {
+	var buf [4]byte
+
+	if _, err = r.ReadAt(buf[:], peHeaderPointerOffset); err != nil {
+		return 0, 0, fmt.Errorf("failed reading DOS header: %w", err)
+	}
+
+	peOffset := int64(binary.LittleEndian.Uint32(buf[:]))
+
+	if _, err = r.ReadAt(buf[:], peOffset); err != nil {
+		return 0, 0, fmt.Errorf("failed reading PE header: %w", err)
+	}
+
+	if string(buf[:]) != "PE\x00\x00" {
+		return 0, 0, errors.New("not a PE file")
+	}
+
+	offset = peOffset + coffHeaderSize
+
+	if _, err = r.ReadAt(buf[:2], offset); err != nil {
+		return 0, 0, fmt.Errorf("failed reading optional header: %w", err)
+	}
+
+	return offset, binary.LittleEndian.Uint16(buf[:2]), nil
+}
+
+// certificateTable returns the file offset of the certificate table data directory entry,
+// and the file offset and size of the certificate table it points to.
+func certificateTable(r io.ReaderAt) (entryOffset int64, tableOffset, tableSize uint32, err error) {
+	optOffset, magic, err := optionalHeader(r)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	switch magic {
+	case 0x10b:
+		entryOffset = optOffset + certTableOffsetPE32
+	case 0x20b:
+		entryOffset = optOffset + certTableOffsetPE32Plus
+	default:
+		return 0, 0, 0, errors.New("unknown optional header magic")
+	}
+
+	var entry [8]byte
+
+	if _, err = r.ReadAt(entry[:], entryOffset); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed reading certificate table entry: %w", err)
+	}
+
+	return entryOffset, binary.LittleEndian.Uint32(entry[0:4]), binary.LittleEndian.Uint32(entry[4:8]), nil
+}
+
+// Unsign removes all the signatures from the input PE file and writes the result to the output file.
+//
+// The certificate table is always the last thing in a signed PE file, so the output is the input
+// truncated at the certificate table with the table entry cleared. The output can be the input.
+func Unsign(input, output string) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close() //nolint:errcheck
+
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	entryOffset, tableOffset, tableSize, err := certificateTable(in)
+	if err != nil {
+		return fmt.Errorf("%s: %w", input, err)
+	}
+
+	size := st.Size()
+
+	if tableOffset != 0 && tableSize != 0 {
+		if int64(tableOffset)+int64(tableSize) != size {
+			return fmt.Errorf("%s: certificate table is not at the end of the file", input)
+		}
+
+		size = int64(tableOffset)
+	} else {
+		slog.Warn("File has no signatures, copying it into output file", "input", input)
+	}
+
+	// written through a temporary file, so the output can be the input, unsigned in place
+	return utils.WriteFileAtomic(output, st.Mode().Perm(), func(w io.Writer) error {
+		// the image with the certificate table entry cleared
+		image := io.MultiReader(
+			io.NewSectionReader(in, 0, entryOffset),
+			bytes.NewReader(make([]byte, 8)),
+			io.NewSectionReader(in, entryOffset+8, size-entryOffset-8),
+		)
+
+		if _, err := io.Copy(w, image); err != nil {
+			return fmt.Errorf("failed writing output file: %w", err)
+		}
+
+		return nil
+	})
+}
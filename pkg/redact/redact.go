@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package redact keeps secrets out of the logs: Handler wraps a slog handler, replacing the values
+// of the attributes marked sensitive, and the credentials and private keys found in the others.
+//
+// Attributes are sensitive when made with Sensitive, or when their key is, see IsSensitive: i.e.
+// passphrase or pcr-key, whatever the case and separators. In the other strings and errors logged,
+// and in the messages, the passwords of URLs, the values of sensitive key=value pairs, i.e. of a
+// cmdline, and PEM private keys are replaced.
+package redact
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Redacted replaces the sensitive values.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are the keys of the attributes redacted, compared lowercased and without dashes,
+// underscores and dots.
+var sensitiveKeys = []string{
+	"password", "passphrase", "secret", "token", "pin", "credential", "authorization",
+	"privatekey", "sbkey", "pcrkey", "keypath",
+}
+
+var (
+	// userinfo of URLs, the user is kept
+	urlPassword = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]*):[^/\s@]*@`)
+	privateKey  = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`)
+	// key=value pairs, i.e. of a cmdline or arguments, with a sensitive key
+	sensitivePair = regexp.MustCompile(`(?i)\b(` + strings.Join(pairKeys(), "|") + `)=("[^"]*"|\S+)`)
+)
+
+// pairKeys returns the patterns of the sensitive keys, dashes, underscores and dots allowed
+// between their letters.
+func pairKeys() []string {
+	keys := make([]string, len(sensitiveKeys))
+	for i, key := range sensitiveKeys {
+		var pattern strings.Builder
+
+		for j, r := range key {
+			if j > 0 {
+				pattern.WriteString(`[-_.]?`)
+			}
+
+			pattern.WriteRune(r)
+		}
+
+		keys[i] = pattern.String()
+	}
+
+	return keys
+}
+
+// secret is the value of a sensitive attribute.
+type secret struct{}
+
+// LogValue returns Redacted, so the value is not logged by handlers without redaction either.
+func (secret) LogValue() slog.Value {
+	return slog.StringValue(Redacted)
+}
+
+// Sensitive returns an attribute whose value is never logged, only the key is.
+func Sensitive(key string) slog.Attr {
+	return slog.Any(key, secret{})
+}
+
+// IsSensitive returns whether the values of the attribute key are secrets: passwords, passphrases,
+// secrets, tokens, PINs, credentials and private keys, or the paths of the SecureBoot and PCR keys.
+func IsSensitive(key string) bool {
+	return slices.Contains(sensitiveKeys, normalize(key))
+}
+
+// normalize returns the key lowercased, without dashes, underscores and dots.
+func normalize(key string) string {
+	return strings.NewReplacer("-", "", "_", "", ".", "").Replace(strings.ToLower(key))
+}
+
+// String returns s with the passwords of URLs, the values of sensitive key=value pairs and the PEM
+// private keys replaced.
+func String(s string) string {
+	s = privateKey.ReplaceAllString(s, Redacted)
+	s = urlPassword.ReplaceAllString(s, "$1:"+Redacted+"@")
+
+	return sensitivePair.ReplaceAllString(s, "$1="+Redacted)
+}
+
+// Handler redacts the records before passing them to the wrapped handler.
+type Handler struct {
+	handler slog.Handler
+}
+
+// NewHandler returns a handler redacting the records passed to handler.
+func NewHandler(handler slog.Handler) *Handler {
+	if h, ok := handler.(*Handler); ok {
+		return h
+	}
+
+	return &Handler{handler: handler}
+}
+
+// Enabled implements slog.Handler.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, String(record.Message), record.PC)
+
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(Attr(attr))
+
+		return true
+	})
+
+	return h.handler.Handle(ctx, redacted)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = Attr(attr)
+	}
+
+	return &Handler{handler: h.handler.WithAttrs(redacted)}
+}
+
+// WithGroup implements slog.Handler.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{handler: h.handler.WithGroup(name)}
+}
+
+// Attr returns the attribute redacted: the value of sensitive attributes is replaced by Redacted,
+// the strings and errors are redacted with String, groups are redacted attribute by attribute.
+func Attr(attr slog.Attr) slog.Attr {
+	if _, ok := attr.Value.Any().(secret); ok || IsSensitive(attr.Key) {
+		return slog.String(attr.Key, Redacted)
+	}
+
+	value := attr.Value.Resolve()
+
+	switch value.Kind() {
+	case slog.KindGroup:
+		group := value.Group()
+
+		redacted := make([]any, len(group))
+		for i, a := range group {
+			redacted[i] = Attr(a)
+		}
+
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindString:
+		return slog.String(attr.Key, String(value.String()))
+	case slog.KindAny:
+		switch v := value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, String(v.Error()))
+		case []string:
+			redacted := make([]string, len(v))
+			for i, s := range v {
+				redacted[i] = String(s)
+			}
+
+			return slog.Any(attr.Key, redacted)
+		}
+	}
+
+	return slog.Attr{Key: attr.Key, Value: value}
+}
@@ -0,0 +1,145 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package rekor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// signaturePrefix starts the signature lines of a signed note.
+const signaturePrefix = "— "
+
+// checkpoint is the tree head a log signs, as a signed note, https://c2sp.org/tlog-checkpoint.
+type checkpoint struct {
+	// Size and root hash of the tree.
+	size int64
+	root []byte
+}
+
+// LoadPublicKey reads the PEM public key of a log, i.e. the one served at /api/v1/log/publicKey.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no public key in %s", path)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %w", path, err)
+	}
+
+	return key, nil
+}
+
+// verifyCheckpoint parses the signed note of a checkpoint, one of its signatures being made with the key.
+func verifyCheckpoint(note string, key crypto.PublicKey) (*checkpoint, error) {
+	text, signatures, ok := strings.Cut(note, "\n\n")
+	if !ok {
+		return nil, errors.New("invalid checkpoint, no signature")
+	}
+
+	// the text signed ends with its last newline
+	text += "\n"
+
+	verified := false
+
+	for _, line := range strings.Split(strings.TrimSuffix(signatures, "\n"), "\n") {
+		name, encoded, ok := strings.Cut(strings.TrimPrefix(line, signaturePrefix), " ")
+		if !strings.HasPrefix(line, signaturePrefix) || !ok {
+			return nil, fmt.Errorf("invalid checkpoint signature line %q", line)
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(signature) < 4 {
+			return nil, fmt.Errorf("invalid checkpoint signature of %s", name)
+		}
+
+		hint, err := keyHint(name, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(signature[:4], hint) && verifyNote(key, []byte(text), signature[4:]) {
+			verified = true
+
+			break
+		}
+	}
+
+	if !verified {
+		return nil, errors.New("the checkpoint is not signed with the key of the log")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) < 3 {
+		return nil, errors.New("invalid checkpoint, expected the origin, tree size and root hash lines")
+	}
+
+	size, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint tree size: %w", err)
+	}
+
+	root, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint root hash: %w", err)
+	}
+
+	return &checkpoint{size: size, root: root}, nil
+}
+
+// keyHint returns the key hash prefixing the signatures made with the key: the one of the signed note
+// spec for Ed25519 keys, the first bytes of the SHA256 of the PKIX public key for the others, as Rekor
+// signs its checkpoints.
+func keyHint(name string, key crypto.PublicKey) ([]byte, error) {
+	if key, ok := key.(ed25519.PublicKey); ok {
+		sum := sha256.Sum256(append([]byte(name+"\n\x01"), key...))
+
+		return sum[:4], nil
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log public key: %w", err)
+	}
+
+	sum := sha256.Sum256(der)
+
+	return sum[:4], nil
+}
+
+// verifyNote returns whether the signature of the note text is made with the key.
+func verifyNote(key crypto.PublicKey, text, signature []byte) bool {
+	sum := sha256.Sum256(text)
+
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, text, signature)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, sum[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) == nil
+	default:
+		return false
+	}
+}
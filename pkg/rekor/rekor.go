@@ -0,0 +1,378 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package rekor submits signatures to a Rekor transparency log, or any append-only log speaking its
+// API, and checks their inclusion proofs against the checkpoints signed by the log.
+//
+// Once logged, every signature made with a key can be listed, so a signature made with a leaked or
+// misused key shows up as an entry no release accounts for.
+package rekor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// EntriesPath is the path of the log entries in the Rekor API.
+const EntriesPath = "/api/v1/log/entries"
+
+// DefaultURL is the public Rekor instance of the sigstore project.
+const DefaultURL = "https://rekor.sigstore.dev"
+
+// Client submits entries to a log.
+type Client struct {
+	// URL of the log, i.e. https://rekor.sigstore.dev.
+	URL string
+	// HTTP client the requests are sent with.
+	HTTPClient *http.Client
+	// Public key of the log the checkpoints are signed with, see LoadPublicKey. Without it the entries
+	// are only checked to be consistent, see LogEntry.CheckConsistency, their inclusion is not
+	// authenticated.
+	PublicKey crypto.PublicKey
+}
+
+// NewClient returns a client of the log at url.
+func NewClient(url string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(url, "/"),
+		HTTPClient: &http.Client{Timeout: time.Minute},
+	}
+}
+
+// LogEntry is an entry of the log, with the proof of its inclusion.
+type LogEntry struct {
+	// UUID of the entry in the log.
+	UUID string `json:"uuid"`
+	// ID of the log, the SHA256 of its public key in hex.
+	LogID string `json:"logID"`
+	// Index of the entry in the log.
+	LogIndex int64 `json:"logIndex"`
+	// Unix time the entry was added at.
+	IntegratedTime int64 `json:"integratedTime"`
+	// Entry as stored in the log, base64 encoded.
+	Body string `json:"body"`
+	// Signature of the log promising the inclusion of the entry, base64 encoded.
+	SignedEntryTimestamp string `json:"signedEntryTimestamp,omitempty"`
+	// Proof of the inclusion of the entry in the log tree.
+	InclusionProof *InclusionProof `json:"inclusionProof,omitempty"`
+}
+
+// InclusionProof is the Merkle audit path of an entry, RFC 6962.
+type InclusionProof struct {
+	// Index of the entry in the tree.
+	LogIndex int64 `json:"logIndex"`
+	// Size of the tree the proof is for.
+	TreeSize int64 `json:"treeSize"`
+	// Root hash of the tree in hex.
+	RootHash string `json:"rootHash"`
+	// Hashes of the audit path in hex, from the leaf up.
+	Hashes []string `json:"hashes"`
+	// Signed checkpoint of the tree.
+	Checkpoint string `json:"checkpoint,omitempty"`
+}
+
+// apiEntry is an entry as returned by the API, keyed by its UUID.
+type apiEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+	Verification   struct {
+		InclusionProof       *InclusionProof `json:"inclusionProof"`
+		SignedEntryTimestamp string          `json:"signedEntryTimestamp"`
+	} `json:"verification"`
+}
+
+// hashedRekord is the entry of a signature of a hash, the hashedrekord kind.
+type hashedRekord struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Spec       hashedRekordSpec `json:"spec"`
+}
+
+type hashedRekordSpec struct {
+	Signature struct {
+		Content   string `json:"content"`
+		PublicKey struct {
+			Content string `json:"content"`
+		} `json:"publicKey"`
+	} `json:"signature"`
+	Data struct {
+		Hash struct {
+			Algorithm string `json:"algorithm"`
+			Value     string `json:"value"`
+		} `json:"hash"`
+	} `json:"data"`
+}
+
+// Submit logs the signature of the SHA256 digest, made with the key of the certificate, and returns
+// its entry once verified with the PublicKey, or checked to be consistent without it. A signature
+// logged already is returned as is.
+func (client *Client) Submit(digest, signature []byte, cert *x509.Certificate) (*LogEntry, error) {
+	var record hashedRekord
+
+	record.APIVersion = "0.0.1"
+	record.Kind = "hashedrekord"
+	record.Spec.Signature.Content = base64.StdEncoding.EncodeToString(signature)
+	record.Spec.Signature.PublicKey.Content = base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	record.Spec.Data.Hash.Algorithm = "sha256"
+	record.Spec.Data.Hash.Value = hex.EncodeToString(digest)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.HTTPClient.Post(client.URL+EntriesPath, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("transparency log: %w", err))
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	var entry *LogEntry
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+		entry, err = decodeEntry(resp.Body)
+	case http.StatusConflict:
+		// logged already, the location is the existing entry
+		entry, err = client.get(resp.Header.Get("Location"))
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) //nolint:errcheck
+
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("transparency log: %s: %s", resp.Status, bytes.TrimSpace(body)))
+	}
+
+	if err != nil {
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("transparency log: %w", err))
+	}
+
+	if client.PublicKey != nil {
+		err = entry.Verify(digest, signature, cert, client.PublicKey)
+	} else {
+		err = entry.CheckConsistency(digest, signature, cert)
+	}
+
+	if err != nil {
+		return nil, types.WithCategory(types.ErrVerification, fmt.Errorf("transparency log entry %s: %w", entry.UUID, err))
+	}
+
+	return entry, nil
+}
+
+// get reads the entry at location, a path of the log or a URL.
+func (client *Client) get(location string) (*LogEntry, error) {
+	if location == "" {
+		return nil, errors.New("conflicting entry without location")
+	}
+
+	if strings.HasPrefix(location, "/") {
+		location = client.URL + location
+	}
+
+	resp, err := client.HTTPClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading %s: %s", location, resp.Status)
+	}
+
+	return decodeEntry(resp.Body)
+}
+
+// decodeEntry decodes the single entry of a response.
+func decodeEntry(r io.Reader) (*LogEntry, error) {
+	var entries map[string]apiEntry
+
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("invalid response: %d entries", len(entries))
+	}
+
+	for uuid, e := range entries {
+		return &LogEntry{
+			UUID:                 uuid,
+			LogID:                e.LogID,
+			LogIndex:             e.LogIndex,
+			IntegratedTime:       e.IntegratedTime,
+			Body:                 e.Body,
+			SignedEntryTimestamp: e.Verification.SignedEntryTimestamp,
+			InclusionProof:       e.Verification.InclusionProof,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// Verify checks the entry is consistent, see CheckConsistency, and its inclusion is authenticated: the
+// checkpoint of the inclusion proof is signed with the key of the log, for the same tree.
+func (e *LogEntry) Verify(digest, signature []byte, cert *x509.Certificate, key crypto.PublicKey) error {
+	if err := e.CheckConsistency(digest, signature, cert); err != nil {
+		return err
+	}
+
+	if e.InclusionProof.Checkpoint == "" {
+		return errors.New("no checkpoint")
+	}
+
+	tree, err := verifyCheckpoint(e.InclusionProof.Checkpoint, key)
+	if err != nil {
+		return err
+	}
+
+	root, err := hex.DecodeString(e.InclusionProof.RootHash)
+	if err != nil {
+		return fmt.Errorf("invalid root hash: %w", err)
+	}
+
+	if tree.size != e.InclusionProof.TreeSize || !bytes.Equal(tree.root, root) {
+		return errors.New("the checkpoint is not of the tree of the inclusion proof")
+	}
+
+	return nil
+}
+
+// CheckConsistency checks the entry logs the signature of the digest made with the key of the
+// certificate, and its inclusion proof leads to the root hash of the tree.
+//
+// It does not authenticate the inclusion of the entry: the root hash comes with the entry, a log, or
+// anyone answering for it, can make up both. See Verify.
+func (e *LogEntry) CheckConsistency(digest, signature []byte, cert *x509.Certificate) error {
+	body, err := base64.StdEncoding.DecodeString(e.Body)
+	if err != nil {
+		return fmt.Errorf("invalid body: %w", err)
+	}
+
+	var record hashedRekord
+	if err = json.Unmarshal(body, &record); err != nil {
+		return fmt.Errorf("invalid body: %w", err)
+	}
+
+	if record.Spec.Data.Hash.Algorithm != "sha256" || record.Spec.Data.Hash.Value != hex.EncodeToString(digest) {
+		return errors.New("the entry does not log the digest")
+	}
+
+	logged, err := base64.StdEncoding.DecodeString(record.Spec.Signature.Content)
+	if err != nil || !bytes.Equal(logged, signature) {
+		return errors.New("the entry does not log the signature")
+	}
+
+	if !loggedCertificate(record.Spec.Signature.PublicKey.Content, cert) {
+		return errors.New("the entry does not log the certificate")
+	}
+
+	proof := e.InclusionProof
+	if proof == nil {
+		return errors.New("no inclusion proof")
+	}
+
+	root, err := hex.DecodeString(proof.RootHash)
+	if err != nil {
+		return fmt.Errorf("invalid root hash: %w", err)
+	}
+
+	path := make([][]byte, len(proof.Hashes))
+	for i, h := range proof.Hashes {
+		if path[i], err = hex.DecodeString(h); err != nil {
+			return fmt.Errorf("invalid proof hash: %w", err)
+		}
+	}
+
+	return verifyInclusion(proof.LogIndex, proof.TreeSize, LeafHash(body), path, root)
+}
+
+// loggedCertificate returns whether the public key content of an entry, a base64 encoded PEM
+// certificate, is the certificate.
+func loggedCertificate(content string, cert *x509.Certificate) bool {
+	data, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return false
+	}
+
+	block, _ := pem.Decode(data)
+
+	return block != nil && block.Type == "CERTIFICATE" && bytes.Equal(block.Bytes, cert.Raw)
+}
+
+// LeafHash returns the RFC 6962 hash of the leaf of the entry body.
+func LeafHash(body []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(body)
+
+	return h.Sum(nil)
+}
+
+// NodeHash returns the RFC 6962 hash of the inner node of the children.
+func NodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+
+	return h.Sum(nil)
+}
+
+// verifyInclusion checks the audit path of the leaf at index leads to the root of the tree of the
+// size, RFC 9162 section 2.1.3.2.
+func verifyInclusion(index, size int64, leaf []byte, path [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return fmt.Errorf("index %d out of a tree of %d leaves", index, size)
+	}
+
+	fn, sn := index, size-1
+	r := leaf
+
+	for _, p := range path {
+		if sn == 0 {
+			return errors.New("audit path too long")
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("audit path too short")
+	}
+
+	if !bytes.Equal(r, root) {
+		return errors.New("the audit path does not lead to the root hash")
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package rekor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Rekor test Suite")
+}
+
+// treeHash returns the RFC 6962 root hash of the leaf hashes.
+func treeHash(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+
+	k := splitPoint(len(leaves))
+
+	return NodeHash(treeHash(leaves[:k]), treeHash(leaves[k:]))
+}
+
+// auditPath returns the RFC 6962 audit path of the leaf m.
+func auditPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) == 1 {
+		return nil
+	}
+
+	k := splitPoint(len(leaves))
+	if m < k {
+		return append(auditPath(m, leaves[:k]), treeHash(leaves[k:]))
+	}
+
+	return append(auditPath(m-k, leaves[k:]), treeHash(leaves[:k]))
+}
+
+// splitPoint returns the largest power of two smaller than n.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+
+	return k
+}
+
+// signCheckpoint returns the checkpoint of the tree signed with the key, as Rekor signs them.
+func signCheckpoint(key *ecdsa.PrivateKey, size int64, root []byte) string {
+	text := fmt.Sprintf("test.log - 1\n%d\n%s\n", size, base64.StdEncoding.EncodeToString(root))
+
+	sum := sha256.Sum256([]byte(text))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	Expect(err).ToNot(HaveOccurred())
+
+	hint, err := keyHint("test.log", key.Public())
+	Expect(err).ToNot(HaveOccurred())
+
+	return text + "\n" + signaturePrefix + "test.log " + base64.StdEncoding.EncodeToString(append(hint, signature...)) + "\n"
+}
+
+var _ = Describe("Rekor tests", func() {
+	var server *httptest.Server
+	var bodies [][]byte
+	var tamper func(*apiEntry)
+	var logKey *ecdsa.PrivateKey
+
+	BeforeEach(func() {
+		var err error
+		logKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		// fill the log so the entries have a real audit path
+		bodies = [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+		tamper = func(*apiEntry) {}
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.URL.Path).To(Equal(EntriesPath))
+
+			body, err := io.ReadAll(r.Body)
+			Expect(err).ToNot(HaveOccurred())
+			bodies = append(bodies, body)
+
+			leaves := make([][]byte, len(bodies))
+			for i, b := range bodies {
+				leaves[i] = LeafHash(b)
+			}
+
+			index := len(bodies) - 1
+			entry := apiEntry{Body: base64.StdEncoding.EncodeToString(body), LogIndex: int64(index), LogID: "log"}
+			entry.Verification.InclusionProof = &InclusionProof{
+				LogIndex:   int64(index),
+				TreeSize:   int64(len(bodies)),
+				RootHash:   hex.EncodeToString(treeHash(leaves)),
+				Checkpoint: signCheckpoint(logKey, int64(len(bodies)), treeHash(leaves)),
+			}
+			for _, h := range auditPath(index, leaves) {
+				entry.Verification.InclusionProof.Hashes = append(entry.Verification.InclusionProof.Hashes, hex.EncodeToString(h))
+			}
+			tamper(&entry)
+
+			w.WriteHeader(http.StatusCreated)
+			Expect(json.NewEncoder(w).Encode(map[string]apiEntry{hex.EncodeToString(LeafHash(body)): entry})).To(Succeed())
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+	It("Submits signatures and checks their inclusion proofs", func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Kairos DB"}}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).ToNot(HaveOccurred())
+
+		digest := sha256.Sum256([]byte("signed attributes"))
+		client := NewClient(server.URL + "/")
+
+		for i := 0; i < 3; i++ {
+			entry, err := client.Submit(digest[:], []byte("signature"), cert)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entry.LogIndex).To(BeEquivalentTo(len(bodies) - 1))
+			Expect(entry.InclusionProof.Hashes).ToNot(BeEmpty())
+		}
+
+		var record hashedRekord
+		Expect(json.Unmarshal(bodies[len(bodies)-1], &record)).To(Succeed())
+		Expect(record.Kind).To(Equal("hashedrekord"))
+		Expect(record.Spec.Data.Hash.Value).To(Equal(hex.EncodeToString(digest[:])))
+
+		tamper = func(entry *apiEntry) {
+			entry.Verification.InclusionProof.Hashes[0] = hex.EncodeToString(make([]byte, sha256.Size))
+		}
+		_, err = client.Submit(digest[:], []byte("signature"), cert)
+		Expect(err).To(MatchError(ContainSubstring("does not lead to the root hash")))
+
+		other := sha256.Sum256([]byte("other"))
+		tamper = func(entry *apiEntry) {}
+		entry, err := client.Submit(digest[:], []byte("signature"), cert)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.CheckConsistency(digest[:], []byte("signature"), cert)).To(Succeed())
+		Expect(entry.CheckConsistency(other[:], []byte("signature"), cert)).To(MatchError(ContainSubstring("does not log the digest")))
+		Expect(entry.CheckConsistency(digest[:], []byte("other signature"), cert)).To(MatchError(ContainSubstring("does not log the signature")))
+
+		template.SerialNumber = big.NewInt(2)
+		otherDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		otherCert, err := x509.ParseCertificate(otherDER)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.CheckConsistency(digest[:], []byte("signature"), otherCert)).To(MatchError(ContainSubstring("does not log the certificate")))
+
+		// the log answering with the entry of another signature
+		tamper = func(entry *apiEntry) {
+			var record hashedRekord
+			body, err := base64.StdEncoding.DecodeString(entry.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(body, &record)).To(Succeed())
+			record.Spec.Signature.Content = base64.StdEncoding.EncodeToString([]byte("forged"))
+			body, err = json.Marshal(record)
+			Expect(err).ToNot(HaveOccurred())
+			entry.Body = base64.StdEncoding.EncodeToString(body)
+		}
+		_, err = client.Submit(digest[:], []byte("signature"), cert)
+		Expect(err).To(MatchError(ContainSubstring("does not log the signature")))
+	})
+	It("Verifies the inclusion with the checkpoint signed by the log", func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Kairos DB"}}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).ToNot(HaveOccurred())
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).ToNot(HaveOccurred())
+
+		keyDER, err := x509.MarshalPKIXPublicKey(logKey.Public())
+		Expect(err).ToNot(HaveOccurred())
+		keyPath := filepath.Join(GinkgoT().TempDir(), "rekor.pub")
+		Expect(os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyDER}), 0o600)).To(Succeed())
+
+		digest := sha256.Sum256([]byte("signed attributes"))
+		client := NewClient(server.URL)
+		client.PublicKey, err = LoadPublicKey(keyPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		entry, err := client.Submit(digest[:], []byte("signature"), cert)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.Verify(digest[:], []byte("signature"), cert, client.PublicKey)).To(Succeed())
+
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.Verify(digest[:], []byte("signature"), cert, otherKey.Public())).To(MatchError(ContainSubstring("not signed with the key of the log")))
+
+		// a consistent entry and proof, of a tree the log did not sign
+		tamper = func(entry *apiEntry) {
+			leaves := [][]byte{LeafHash([]byte("a")), LeafHash(bodies[len(bodies)-1])}
+			entry.LogIndex = 1
+			entry.Verification.InclusionProof.LogIndex = 1
+			entry.Verification.InclusionProof.TreeSize = 2
+			entry.Verification.InclusionProof.RootHash = hex.EncodeToString(treeHash(leaves))
+			entry.Verification.InclusionProof.Hashes = []string{hex.EncodeToString(leaves[0])}
+		}
+		_, err = client.Submit(digest[:], []byte("signature"), cert)
+		Expect(err).To(MatchError(ContainSubstring("the checkpoint is not of the tree of the inclusion proof")))
+
+		tamper = func(entry *apiEntry) {
+			entry.Verification.InclusionProof.Checkpoint = ""
+		}
+		_, err = client.Submit(digest[:], []byte("signature"), cert)
+		Expect(err).To(MatchError(ContainSubstring("no checkpoint")))
+
+		// only checked to be consistent without the key
+		client.PublicKey = nil
+		_, err = client.Submit(digest[:], []byte("signature"), cert)
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
@@ -0,0 +1,273 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sbat parses, merges and checks SBAT (Secure Boot Advanced Targeting) tables.
+//
+// See https://github.com/rhboot/shim/blob/main/SBAT.md for the format.
+package sbat
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+)
+
+// Entry is a line of an SBAT table.
+type Entry struct {
+	// Component name, i.e. systemd.
+	Component string `json:"component"`
+	// Security generation of the component.
+	Generation int `json:"generation"`
+	// Human readable vendor name.
+	Vendor string `json:"vendor"`
+	// Vendor package name.
+	Package string `json:"package"`
+	// Vendor package version.
+	Version string `json:"version"`
+	// Vendor URL.
+	URL string `json:"url"`
+}
+
+// Parse parses an SBAT table, as found in the .sbat section of PE files.
+//
+// Trailing NUL padding is ignored.
+func Parse(data []byte) ([]Entry, error) {
+	data = bytes.TrimRight(data, "\x00")
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+
+	var entries []Entry
+
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing SBAT: %w", err)
+		}
+
+		if len(record) < 2 {
+			return nil, fmt.Errorf("invalid SBAT entry %q: missing generation", strings.Join(record, ","))
+		}
+
+		generation, err := strconv.Atoi(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid SBAT entry %q: %w", strings.Join(record, ","), err)
+		}
+
+		// pad the optional fields
+		record = append(record, make([]string, 6)...)
+
+		entries = append(entries, Entry{
+			Component:  record[0],
+			Generation: generation,
+			Vendor:     record[2],
+			Package:    record[3],
+			Version:    record[4],
+			URL:        record[5],
+		})
+	}
+
+	return entries, nil
+}
+
+// Marshal encodes the entries as an SBAT table.
+func Marshal(entries []Entry) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := csv.NewWriter(&buf)
+
+	for _, e := range entries {
+		if e.Component == "" {
+			return nil, errors.New("SBAT entry without component")
+		}
+
+		if err := w.Write([]string{e.Component, strconv.Itoa(e.Generation), e.Vendor, e.Package, e.Version, e.URL}); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// Merge returns the entries of base with extra merged in.
+//
+// Entries of extra replace the base entries of the same component and vendor package,
+// other entries are appended in order.
+func Merge(base, extra []Entry) []Entry {
+	merged := append([]Entry(nil), base...)
+
+	for _, e := range extra {
+		replaced := false
+
+		for i := range merged {
+			if merged[i].Component == e.Component && merged[i].Package == e.Package {
+				merged[i] = e
+				replaced = true
+
+				break
+			}
+		}
+
+		if !replaced {
+			merged = append(merged, e)
+		}
+	}
+
+	return merged
+}
+
+// Override returns the entries with the generation and vendor of the named components replaced,
+// i.e. to bump the generation of a component for a revocation without rebuilding the stub.
+//
+// Components not found in entries are an error, as the override would be silently lost.
+func Override(entries []Entry, generations map[string]int, vendors map[string]string) ([]Entry, error) {
+	overridden := append([]Entry(nil), entries...)
+
+	var errs []error
+
+	for _, component := range sortedKeys(generations) {
+		generation := generations[component]
+		if generation < 1 {
+			errs = append(errs, fmt.Errorf("invalid SBAT generation %d for %s", generation, component))
+			continue
+		}
+
+		if !override(overridden, component, func(e *Entry) { e.Generation = generation }) {
+			errs = append(errs, fmt.Errorf("SBAT component %s not found", component))
+		}
+	}
+
+	for _, component := range sortedKeys(vendors) {
+		vendor := vendors[component]
+		if !override(overridden, component, func(e *Entry) { e.Vendor = vendor }) {
+			errs = append(errs, fmt.Errorf("SBAT component %s not found", component))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return overridden, nil
+}
+
+// override applies set to the entries of the component, reporting whether there was any.
+func override(entries []Entry, component string, set func(*Entry)) bool {
+	found := false
+
+	for i := range entries {
+		if entries[i].Component == component {
+			set(&entries[i])
+			found = true
+		}
+	}
+
+	return found
+}
+
+// sortedKeys returns the keys of m in order, so errors are reported in a stable order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Policy is an SBAT revocation policy, i.e. the contents of the SbatLevel variable.
+//
+// It maps component names to the minimum generation that is still allowed to boot.
+type Policy map[string]int
+
+// ParsePolicy parses a revocation policy in the SbatLevel format:
+//
+//	sbat,1,2023012900
+//	shim,2
+//	grub,3
+//
+// The first line is the policy header, generations of the listed components below it are the
+// minimum ones allowed.
+func ParsePolicy(data []byte) (Policy, error) {
+	entries, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := Policy{}
+
+	for _, e := range entries {
+		// skip the header
+		if e.Component == "sbat" {
+			continue
+		}
+
+		policy[e.Component] = e.Generation
+	}
+
+	return policy, nil
+}
+
+// LatestPolicyData is the latest revocation policy shipped with shim 15.8, applied by shim to the
+// SbatLevel variable when asked for the latest revocations. It only lists shim and grub components,
+// so it never revokes systemd-stub or systemd-boot.
+const LatestPolicyData = `sbat,1,2024010900
+shim,4
+grub,3
+grub.debian,4
+`
+
+// ShimLockGUID is the vendor GUID of the variables of shim, the SbatLevelRT one holding the
+// revocation policy applied by the firmware.
+const ShimLockGUID = "605dab50-e046-4300-abb6-3dd810dd8b23"
+
+// LatestPolicy returns the bundled LatestPolicyData policy.
+func LatestPolicy() Policy {
+	policy, _ := ParsePolicy([]byte(LatestPolicyData)) //nolint:errcheck
+
+	return policy
+}
+
+// SystemPolicy returns the revocation policy of the running system, as exposed by shim in the
+// SbatLevelRT variable.
+func SystemPolicy() (Policy, error) {
+	data, err := efivars.Read("SbatLevelRT", ShimLockGUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading the system SbatLevel: %w", err)
+	}
+
+	return ParsePolicy(data)
+}
+
+// ErrRevoked is returned when an SBAT table has components revoked by the policy.
+var ErrRevoked = errors.New("revoked by SBAT policy")
+
+// Check returns an error listing the entries with a generation lower than the policy allows.
+func (p Policy) Check(entries []Entry) error {
+	var errs []error
+
+	for _, e := range entries {
+		if minimum, ok := p[e.Component]; ok && e.Generation < minimum {
+			errs = append(errs, fmt.Errorf("%s generation %d is %w, minimum is %d", e.Component, e.Generation, ErrRevoked, minimum))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,99 @@
+package sbat_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SBAT test Suite")
+}
+
+const stubSBAT = "sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\n" +
+	"systemd,1,The systemd Developers,systemd,254,https://systemd.io/\n" +
+	"systemd.fedora,1,Fedora Linux,systemd,254.10-1.fc39,https://bugzilla.redhat.com/\n\x00"
+
+var _ = Describe("SBAT tests", func() {
+	It("Parses and marshals tables", func() {
+		entries, err := sbat.Parse([]byte(stubSBAT))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(3))
+		Expect(entries[1]).To(Equal(sbat.Entry{
+			Component:  "systemd",
+			Generation: 1,
+			Vendor:     "The systemd Developers",
+			Package:    "systemd",
+			Version:    "254",
+			URL:        "https://systemd.io/",
+		}))
+
+		data, err := sbat.Marshal(entries)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(stubSBAT[:len(stubSBAT)-1]))
+	})
+	It("Fails on invalid generations", func() {
+		_, err := sbat.Parse([]byte("systemd,one\n"))
+		Expect(err).To(HaveOccurred())
+	})
+	It("Merges entries", func() {
+		base, err := sbat.Parse([]byte(stubSBAT))
+		Expect(err).ToNot(HaveOccurred())
+
+		merged := sbat.Merge(base, []sbat.Entry{
+			{Component: "systemd", Generation: 2, Package: "systemd", Version: "255"},
+			{Component: "kairos", Generation: 1, Package: "kairos"},
+		})
+		Expect(merged).To(HaveLen(4))
+		Expect(merged[1].Generation).To(Equal(2))
+		Expect(merged[3].Component).To(Equal("kairos"))
+		Expect(base[1].Generation).To(Equal(1))
+	})
+	It("Overrides generations and vendors", func() {
+		base, err := sbat.Parse([]byte(stubSBAT))
+		Expect(err).ToNot(HaveOccurred())
+
+		overridden, err := sbat.Override(base, map[string]int{"systemd.fedora": 2}, map[string]string{"systemd": "Acme"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(overridden[2].Generation).To(Equal(2))
+		Expect(overridden[1].Vendor).To(Equal("Acme"))
+		Expect(base[2].Generation).To(Equal(1))
+
+		_, err = sbat.Override(base, map[string]int{"missing": 2, "systemd": 0}, nil)
+		Expect(err).To(MatchError(ContainSubstring("SBAT component missing not found")))
+		Expect(err).To(MatchError(ContainSubstring("invalid SBAT generation 0 for systemd")))
+	})
+	It("Checks against a revocation policy", func() {
+		entries, err := sbat.Parse([]byte(stubSBAT))
+		Expect(err).ToNot(HaveOccurred())
+
+		policy, err := sbat.ParsePolicy([]byte("sbat,1,2024010900\nshim,4\nsystemd,1\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(policy.Check(entries)).To(Succeed())
+
+		policy, err = sbat.ParsePolicy([]byte("sbat,1,2024010900\nsystemd,2\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(policy.Check(entries)).To(MatchError(sbat.ErrRevoked))
+	})
+	It("Reads the bundled and the system policies", func() {
+		Expect(sbat.LatestPolicy()).To(HaveKeyWithValue("shim", 4))
+		Expect(sbat.LatestPolicy()).ToNot(HaveKey("sbat"))
+
+		defer func(path string) { efivars.Path = path }(efivars.Path)
+		efivars.Path = GinkgoT().TempDir()
+
+		_, err := sbat.SystemPolicy()
+		Expect(err).To(HaveOccurred())
+
+		variable := append([]byte{0x06, 0, 0, 0}, "sbat,1,2023012900\nshim,2\n\x00"...)
+		Expect(os.WriteFile(filepath.Join(efivars.Path, "SbatLevelRT-"+sbat.ShimLockGUID), variable, 0o600)).To(Succeed())
+		Expect(sbat.SystemPolicy()).To(Equal(sbat.Policy{"shim": 2}))
+	})
+})
@@ -0,0 +1,174 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secureboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+)
+
+// ImageSecurityGUID is the vendor GUID of the db and dbx variables.
+const ImageSecurityGUID = "d719b2cb-3d3a-4596-a3bc-dad00e67656f"
+
+// ErrRevoked is returned when a certificate or binary is listed in the forbidden signature database.
+var ErrRevoked = errors.New("revoked by dbx")
+
+// Revocations are the entries of a forbidden signature database (dbx) firmware checks images against.
+// The entries of the allowed one (db) are read the same way, see Policy.
+type Revocations struct {
+	// Authenticode SHA256 digests of revoked images.
+	ImageHashes [][]byte
+	// Revoked certificates.
+	Certificates []*x509.Certificate
+	// SHA256 digests of the TBS part of revoked certificates.
+	CertificateHashes [][]byte
+}
+
+// ParseRevocations reads the revocations from an EFI signature database, ignoring the entry types
+// firmware does not check images against.
+//
+// The lists are walked here, as go-uefi does not know about all the types found in dbx updates. The
+// data may be a signed variable update (.auth), whose signature is not checked.
+func ParseRevocations(data []byte) (*Revocations, error) {
+	data, err := variableData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Revocations{}
+
+	for len(data) > 0 {
+		// EFI_SIGNATURE_LIST: type GUID, list size, header size and signature size, followed by the header
+		// and signatures made of the owner GUID and signature data
+		if len(data) < 28 {
+			return nil, errors.New("truncated signature list")
+		}
+
+		var sigType util.EFIGUID
+		if err := binary.Read(bytes.NewReader(data[:16]), binary.LittleEndian, &sigType); err != nil {
+			return nil, err
+		}
+
+		listSize := binary.LittleEndian.Uint32(data[16:])
+		headerSize := binary.LittleEndian.Uint32(data[20:])
+		sigSize := binary.LittleEndian.Uint32(data[24:])
+
+		if uint64(listSize) > uint64(len(data)) || uint64(listSize) < 28+uint64(headerSize) || sigSize <= 16 {
+			return nil, errors.New("invalid signature list")
+		}
+
+		sigs := data[28+headerSize : listSize]
+		if len(sigs)%int(sigSize) != 0 {
+			return nil, errors.New("invalid signature list")
+		}
+
+		for ; len(sigs) > 0; sigs = sigs[sigSize:] {
+			if err := r.add(sigType, sigs[16:sigSize]); err != nil {
+				return nil, err
+			}
+		}
+
+		data = data[listSize:]
+	}
+
+	return r, nil
+}
+
+func (r *Revocations) add(sigType util.EFIGUID, data []byte) error {
+	switch sigType {
+	case signature.CERT_SHA256_GUID:
+		r.ImageHashes = append(r.ImageHashes, data)
+	case signature.CERT_X509_GUID:
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return err
+		}
+		r.Certificates = append(r.Certificates, cert)
+	case signature.CERT_X509_SHA256_GUID:
+		// the digest is followed by the time of revocation
+		if len(data) < sha256.Size {
+			return fmt.Errorf("invalid X509 SHA256 entry of %d bytes", len(data))
+		}
+		r.CertificateHashes = append(r.CertificateHashes, data[:sha256.Size])
+	}
+
+	return nil
+}
+
+// LoadRevocations reads the revocations from an EFI signature list file, as written by efi-readvar or
+// cert-to-efi-sig-list, or a signed update of it.
+func LoadRevocations(path string) (*Revocations, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := ParseRevocations(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing dbx %s: %w", path, err)
+	}
+
+	return r, nil
+}
+
+// SystemRevocations reads the revocations from the dbx variable of the running system.
+func SystemRevocations() (*Revocations, error) {
+	data, err := efivars.Read("dbx", ImageSecurityGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseRevocations(data)
+}
+
+// CheckCertificate returns ErrRevoked if the certificate, or its digest, is in the dbx.
+func (r *Revocations) CheckCertificate(cert *x509.Certificate) error {
+	for _, revoked := range r.Certificates {
+		if revoked.Equal(cert) {
+			return fmt.Errorf("certificate %s: %w", cert.Subject, ErrRevoked)
+		}
+	}
+
+	digest := sha256.Sum256(cert.RawTBSCertificate)
+	for _, revoked := range r.CertificateHashes {
+		if bytes.Equal(revoked, digest[:]) {
+			return fmt.Errorf("certificate %s: %w", cert.Subject, ErrRevoked)
+		}
+	}
+
+	return nil
+}
+
+// CheckImage returns ErrRevoked if the authenticode digest of the PE file is in the dbx.
+func (r *Revocations) CheckImage(path string) error {
+	digest, err := pesign.Digest(path)
+	if err != nil {
+		return fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+
+	return r.CheckDigest(path, digest)
+}
+
+// CheckDigest returns ErrRevoked if the authenticode digest of the named image is in the dbx.
+func (r *Revocations) CheckDigest(name string, digest []byte) error {
+	for _, revoked := range r.ImageHashes {
+		if bytes.Equal(revoked, digest) {
+			return fmt.Errorf("%s: %w", name, ErrRevoked)
+		}
+	}
+
+	return nil
+}
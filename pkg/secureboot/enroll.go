@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package secureboot authors the UEFI Secure Boot key variables.
+package secureboot
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+
+	"github.com/kairos-io/go-ukify/pkg/gpt"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Key is a certificate with the private key signing updates of the variables below it.
+type Key struct {
+	Certificate *x509.Certificate
+	Signer      crypto.Signer
+}
+
+// EnrollFiles generates the signature lists and the signed updates of the PK, KEK and db variables.
+//
+// The PK update is self-signed, the KEK update is signed with the PK and the db update with the KEK.
+type EnrollFiles struct {
+	// GUID identifying the owner of the certificates in the signature lists.
+	Owner string
+	// Platform key.
+	PK Key
+	// Key exchange key.
+	KEK Key
+	// Certificates allowed to sign boot binaries.
+	DB []*x509.Certificate
+}
+
+// EnrollFile is a file written by EnrollFiles.
+type EnrollFile struct {
+	// Variable the file is an update for.
+	Variable string `json:"variable"`
+	// Path to the file.
+	Path string `json:"path"`
+	// Whether the file is a signed .auth update, or a plain .esl signature list.
+	Signed bool `json:"signed"`
+}
+
+// Write writes the files to dir, one subdirectory per variable as sbkeysync expects them:
+// PK/PK.esl, PK/PK.auth, KEK/KEK.esl, KEK/KEK.auth, db/db.esl and db/db.auth.
+func (e *EnrollFiles) Write(dir string) ([]EnrollFile, error) {
+	if _, err := gpt.ParseGUID(e.Owner); err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid owner: %w", err))
+	}
+
+	if e.PK.Certificate == nil || e.PK.Signer == nil || e.KEK.Certificate == nil || e.KEK.Signer == nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, errors.New("the PK and KEK certificates and keys are required"))
+	}
+
+	if len(e.DB) == 0 {
+		return nil, types.WithCategory(types.ErrInvalidInput, errors.New("at least one db certificate is required"))
+	}
+
+	owner := *util.StringToGUID(e.Owner)
+
+	var files []EnrollFile
+
+	for _, v := range []struct {
+		variable efivar.Efivar
+		certs    []*x509.Certificate
+		signer   Key
+	}{
+		{efivar.PK, []*x509.Certificate{e.PK.Certificate}, e.PK},
+		{efivar.KEK, []*x509.Certificate{e.KEK.Certificate}, e.PK},
+		{efivar.Db, e.DB, e.KEK},
+	} {
+		esl, err := SignatureList(owner, v.certs...)
+		if err != nil {
+			return nil, err
+		}
+
+		auth, err := SignVariable(v.variable, esl, v.signer)
+		if err != nil {
+			return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("failed signing %s: %w", v.variable.Name, err))
+		}
+
+		varDir := filepath.Join(dir, v.variable.Name)
+		if err = os.MkdirAll(varDir, 0o755); err != nil {
+			return nil, err
+		}
+
+		for _, f := range []struct {
+			ext    string
+			data   []byte
+			signed bool
+		}{
+			{".esl", esl.Bytes(), false},
+			{".auth", auth, true},
+		} {
+			path := filepath.Join(varDir, v.variable.Name+f.ext)
+
+			if err = os.WriteFile(path, f.data, 0o644); err != nil {
+				return nil, err
+			}
+
+			files = append(files, EnrollFile{Variable: v.variable.Name, Path: path, Signed: f.signed})
+		}
+	}
+
+	return files, nil
+}
+
+// SignatureList returns an EFI signature database holding the certificates.
+func SignatureList(owner util.EFIGUID, certs ...*x509.Certificate) (*signature.SignatureDatabase, error) {
+	db := signature.NewSignatureDatabase()
+
+	for _, cert := range certs {
+		if err := db.Append(signature.CERT_X509_GUID, owner, cert.Raw); err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// SignVariable returns an authenticated update of the variable with the signature database,
+// as accepted by SetVariable: an EFI_VARIABLE_AUTHENTICATION_2 header followed by the data.
+func SignVariable(variable efivar.Efivar, db *signature.SignatureDatabase, key Key) ([]byte, error) {
+	_, auth, err := signature.SignEFIVariable(variable, db, key.Signer, key.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	auth.Marshal(&buf)
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,273 @@
+package secureboot
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Secure Boot test Suite")
+}
+
+// newKey creates a self-signed certificate and its key.
+func newKey(name string) Key {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	Expect(err).ToNot(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	return Key{Certificate: cert, Signer: priv}
+}
+
+// keyProvider signs PE files with a Key.
+type keyProvider struct {
+	key Key
+}
+
+func (p keyProvider) Signer() crypto.Signer {
+	return p.key.Signer
+}
+
+func (p keyProvider) Certificate() *x509.Certificate {
+	return p.key.Certificate
+}
+
+var _ = Describe("Secure Boot tests", func() {
+	It("Writes signed updates for PK, KEK and db", func() {
+		pk, kek, db := newKey("PK"), newKey("KEK"), newKey("db")
+		dir := GinkgoT().TempDir()
+
+		files, err := (&EnrollFiles{
+			Owner: "8ec4c51e-24a1-4d62-9fd3-2e3ecd0d17a0",
+			PK:    pk,
+			KEK:   kek,
+			DB:    []*x509.Certificate{db.Certificate},
+		}).Write(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(6))
+
+		esl, err := os.ReadFile(filepath.Join(dir, "db", "db.esl"))
+		Expect(err).ToNot(HaveOccurred())
+
+		sigdb, err := signature.ReadSignatureDatabase(bytes.NewReader(esl))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sigdb).To(HaveLen(1))
+
+		auth, err := os.ReadFile(filepath.Join(dir, "db", "db.auth"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auth).To(HaveSuffix(string(esl)))
+
+		authvar, err := signature.ReadEFIVariableAuthencation2(bytes.NewReader(auth))
+		Expect(err).ToNot(HaveOccurred())
+
+		ok, err := authvar.Verify(kek.Certificate)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+	})
+	It("Fails without db certificates", func() {
+		_, err := (&EnrollFiles{Owner: "8ec4c51e-24a1-4d62-9fd3-2e3ecd0d17a0", PK: newKey("PK"), KEK: newKey("KEK")}).Write(GinkgoT().TempDir())
+		Expect(err).To(HaveOccurred())
+	})
+	Describe("MOK", func() {
+		It("Builds an enrollment request MokManager can check the password of", func() {
+			key := newKey("MOK")
+			request := &MokRequest{Certificates: []*x509.Certificate{key.Certificate}, Password: []byte("pass")}
+
+			mokNew, mokAuth, err := request.Marshal()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ParseCertificates(mokNew)).To(Equal([]*x509.Certificate{key.Certificate}))
+
+			// SHA256 of MokNew followed by the UCS-2 password
+			expected := sha256.Sum256(append(bytes.Clone(mokNew), 'p', 0, 'a', 0, 's', 0, 's', 0))
+			Expect(mokAuth).To(Equal(expected[:]))
+
+			paths, err := request.Write(GinkgoT().TempDir())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(paths).To(HaveLen(3))
+			Expect(os.ReadFile(paths[2])).To(Equal(key.Certificate.Raw))
+		})
+		It("Requires a password", func() {
+			_, _, err := (&MokRequest{Certificates: []*x509.Certificate{newKey("MOK").Certificate}}).Marshal()
+			Expect(err).To(HaveOccurred())
+		})
+		It("Finds no MOK certificate for unsigned binaries", func() {
+			cert, err := SignedBy("../pesign/testdata/file.efi", []*x509.Certificate{newKey("MOK").Certificate})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cert).To(BeNil())
+		})
+	})
+	Describe("Revocations", func() {
+		var owner util.EFIGUID
+
+		BeforeEach(func() {
+			owner = *util.StringToGUID("8ec4c51e-24a1-4d62-9fd3-2e3ecd0d17a0")
+		})
+
+		It("Finds revoked certificates by value or digest", func() {
+			revoked, hashed, good := newKey("revoked"), newKey("hashed"), newKey("good")
+
+			db := signature.NewSignatureDatabase()
+			Expect(db.Append(signature.CERT_X509_GUID, owner, revoked.Certificate.Raw)).To(Succeed())
+			digest := sha256.Sum256(hashed.Certificate.RawTBSCertificate)
+			Expect(db.Append(signature.CERT_X509_SHA256_GUID, owner, append(digest[:], make([]byte, 16)...))).To(Succeed())
+
+			dbx, err := ParseRevocations(db.Bytes())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dbx.CheckCertificate(revoked.Certificate)).To(MatchError(ErrRevoked))
+			Expect(dbx.CheckCertificate(hashed.Certificate)).To(MatchError(ErrRevoked))
+			Expect(dbx.CheckCertificate(good.Certificate)).To(Succeed())
+		})
+		It("Finds revoked images by authenticode digest", func() {
+			f, err := os.Open("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			binary, err := authenticode.Parse(f)
+			Expect(err).ToNot(HaveOccurred())
+
+			db := signature.NewSignatureDatabase()
+			Expect(db.Append(signature.CERT_SHA256_GUID, owner, binary.Hash(crypto.SHA256))).To(Succeed())
+
+			dbx, err := ParseRevocations(db.Bytes())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dbx.CheckImage("../pesign/testdata/file.efi")).To(MatchError(ErrRevoked))
+			Expect((&Revocations{}).CheckImage("../pesign/testdata/file.efi")).To(Succeed())
+		})
+	})
+	Describe("Policy", func() {
+		var (
+			owner  util.EFIGUID
+			key    Key
+			signed string
+		)
+
+		BeforeEach(func() {
+			owner = *util.StringToGUID("8ec4c51e-24a1-4d62-9fd3-2e3ecd0d17a0")
+			key = newKey("db")
+
+			signer, err := pesign.NewSigner(keyProvider{key})
+			Expect(err).ToNot(HaveOccurred())
+
+			signed = filepath.Join(GinkgoT().TempDir(), "signed.efi")
+			Expect(signer.Sign("../pesign/testdata/file.efi", signed)).To(Succeed())
+		})
+
+		It("Allows images signed by a db certificate of a signed update", func() {
+			esl, err := SignatureList(owner, key.Certificate)
+			Expect(err).ToNot(HaveOccurred())
+			auth, err := SignVariable(efivar.Db, esl, newKey("kek"))
+			Expect(err).ToNot(HaveOccurred())
+
+			db, err := ParseRevocations(auth)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(db.Certificates).To(HaveLen(1))
+
+			policy := &Policy{Db: db}
+			cert, err := policy.CheckImage(signed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cert.Equal(key.Certificate)).To(BeTrue())
+
+			_, err = policy.CheckImage("../pesign/testdata/file.efi")
+			Expect(err).To(MatchError(ErrNotAllowed))
+
+			_, err = (&Policy{Db: &Revocations{Certificates: []*x509.Certificate{newKey("other").Certificate}}}).CheckImage(signed)
+			Expect(err).To(MatchError(ErrNotAllowed))
+		})
+		It("Allows images by their digest", func() {
+			digest, err := pesign.Digest("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			cert, err := (&Policy{Db: &Revocations{ImageHashes: [][]byte{digest}}}).CheckImage("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cert).To(BeNil())
+		})
+		It("Rejects images revoked by digest or certificate", func() {
+			digest, err := pesign.Digest(signed)
+			Expect(err).ToNot(HaveOccurred())
+
+			db := &Revocations{Certificates: []*x509.Certificate{key.Certificate}}
+
+			_, err = (&Policy{Db: db, Dbx: &Revocations{ImageHashes: [][]byte{digest}}}).CheckImage(signed)
+			Expect(err).To(MatchError(ErrRevoked))
+
+			_, err = (&Policy{Db: db, Dbx: &Revocations{Certificates: []*x509.Certificate{key.Certificate}}}).CheckImage(signed)
+			Expect(err).To(MatchError(ErrRevoked))
+		})
+	})
+	Describe("State", func() {
+		var dir string
+
+		// writeVar writes a variable as efivarfs exposes it, after its attributes
+		writeVar := func(name, guid string, data []byte) {
+			Expect(os.WriteFile(filepath.Join(dir, name+"-"+guid), append([]byte{7, 0, 0, 0}, data...), 0o600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			dir = GinkgoT().TempDir()
+			old := efivars.Path
+			efivars.Path = dir
+			DeferCleanup(func() { efivars.Path = old })
+		})
+
+		It("Accepts certificates of the db when Secure Boot is enforced", func() {
+			enrolled, other := newKey("enrolled"), newKey("other")
+			esl, err := SignatureList(*util.StringToGUID("8ec4c51e-24a1-4d62-9fd3-2e3ecd0d17a0"), enrolled.Certificate)
+			Expect(err).ToNot(HaveOccurred())
+
+			writeVar("SecureBoot", efivars.GlobalGUID, []byte{1})
+			writeVar("SetupMode", efivars.GlobalGUID, []byte{0})
+			writeVar("PK", efivars.GlobalGUID, []byte("pk"))
+			writeVar("db", ImageSecurityGUID, esl.Bytes())
+
+			state, err := SystemState()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.SecureBoot).To(BeTrue())
+			Expect(state.SetupMode).To(BeFalse())
+			Expect(state.PK).To(BeTrue())
+			Expect(state.Db).To(HaveLen(1))
+
+			Expect(state.Accepts(enrolled.Certificate)).To(Succeed())
+			Expect(state.Accepts(other.Certificate)).To(MatchError(ErrNotAllowed))
+		})
+		It("Accepts any certificate in setup mode", func() {
+			writeVar("SecureBoot", efivars.GlobalGUID, []byte{0})
+			writeVar("SetupMode", efivars.GlobalGUID, []byte{1})
+
+			state, err := SystemState()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(state.SetupMode).To(BeTrue())
+			Expect(state.PK).To(BeFalse())
+			Expect(state.Accepts(newKey("any").Certificate)).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,172 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secureboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// ShimLockGUID is the vendor GUID of the shim variables, i.e. MokListRT and MokNew.
+const ShimLockGUID = "605dab50-e046-4300-abb6-3dd810dd8b23"
+
+// MokRequest asks MokManager to enroll certificates in the MOK list on the next boot,
+// like `mokutil --import` does.
+type MokRequest struct {
+	// Certificates to enroll.
+	Certificates []*x509.Certificate
+	// Password the user types in MokManager to confirm the enrollment.
+	Password []byte
+}
+
+// Marshal returns the contents of the MokNew and MokAuth variables of the request.
+//
+// MokNew is a signature list with the certificates, MokAuth the SHA256 of MokNew followed by the
+// UCS-2 password, which MokManager accepts next to the crypt(3) hashes mokutil writes.
+func (r *MokRequest) Marshal() (mokNew, mokAuth []byte, err error) {
+	if len(r.Certificates) == 0 {
+		return nil, nil, types.WithCategory(types.ErrInvalidInput, errors.New("no certificate to enroll"))
+	}
+
+	if len(r.Password) == 0 {
+		return nil, nil, types.WithCategory(types.ErrInvalidInput, errors.New("an enrollment password is required"))
+	}
+
+	db, err := SignatureList(*util.StringToGUID(ShimLockGUID), r.Certificates...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mokNew = db.Bytes()
+
+	h := sha256.New()
+	h.Write(mokNew)
+
+	for _, c := range utf16.Encode([]rune(string(r.Password))) {
+		_ = binary.Write(h, binary.LittleEndian, c)
+	}
+
+	return mokNew, h.Sum(nil), nil
+}
+
+// Enroll writes the MokNew and MokAuth variables, so MokManager asks to enroll the certificates on the next boot.
+func (r *MokRequest) Enroll() error {
+	mokNew, mokAuth, err := r.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err = efivars.Write("MokNew", ShimLockGUID, mokNew); err != nil {
+		return fmt.Errorf("failed writing MokNew: %w", err)
+	}
+
+	if err = efivars.Write("MokAuth", ShimLockGUID, mokAuth); err != nil {
+		return fmt.Errorf("failed writing MokAuth: %w", err)
+	}
+
+	return nil
+}
+
+// MokList returns the certificates enrolled in the MOK list, from the MokListRT variable shim exports.
+func MokList() ([]*x509.Certificate, error) {
+	data, err := efivars.Read("MokListRT", ShimLockGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseCertificates(data)
+}
+
+// ParseCertificates returns the X509 certificates of an EFI signature database, ignoring other entries.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+
+	for _, list := range db {
+		if list.SignatureType != signature.CERT_X509_GUID {
+			continue
+		}
+
+		for _, sig := range list.Signatures {
+			cert, err := x509.ParseCertificate(sig.Data)
+			if err != nil {
+				return nil, err
+			}
+
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
+
+// SignedBy returns the first of the certificates the PE file is signed with, or nil if none.
+func SignedBy(path string, certs []*x509.Certificate) (*x509.Certificate, error) {
+	for _, cert := range certs {
+		ok, err := pesign.VerifyFile(path, cert)
+		if err != nil {
+			return nil, types.WithCategory(types.ErrVerification, err)
+		}
+
+		if ok {
+			return cert, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Write writes the request to dir: MokNew and MokAuth with the contents of the variables, and the
+// certificates in DER form, as mokutil --import takes them. It returns the paths written.
+func (r *MokRequest) Write(dir string) ([]string, error) {
+	mokNew, mokAuth, err := r.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{"MokNew": mokNew, "MokAuth": mokAuth}
+	names := []string{"MokNew", "MokAuth"}
+
+	for n, cert := range r.Certificates {
+		name := fmt.Sprintf("mok-%d.der", n)
+		files[name] = cert.Raw
+		names = append(names, name)
+	}
+
+	paths := make([]string, 0, len(names))
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err = os.WriteFile(path, files[name], 0o644); err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secureboot
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+)
+
+// State is the Secure Boot state of a host, as its firmware reports it.
+type State struct {
+	// Whether the firmware enforces Secure Boot.
+	SecureBoot bool `json:"secureBoot"`
+	// Whether no platform key is enrolled, so the keys may be enrolled without authentication.
+	SetupMode bool `json:"setupMode"`
+	// Whether a platform key is enrolled.
+	PK bool `json:"pk"`
+	// Certificates of the db.
+	Db []*x509.Certificate `json:"-"`
+}
+
+// SystemState reads the Secure Boot state of the running system from the SecureBoot, SetupMode, PK
+// and db variables.
+func SystemState() (*State, error) {
+	state := &State{}
+
+	var err error
+
+	if state.SecureBoot, err = readFlag("SecureBoot"); err != nil {
+		return nil, err
+	}
+
+	if state.SetupMode, err = readFlag("SetupMode"); err != nil {
+		return nil, err
+	}
+
+	pk, err := efivars.Read("PK", efivars.GlobalGUID)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed reading PK: %w", err)
+	}
+
+	state.PK = len(pk) > 0
+
+	db, err := efivars.Read("db", ImageSecurityGUID)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed reading db: %w", err)
+	}
+
+	if len(db) > 0 {
+		if state.Db, err = ParseCertificates(db); err != nil {
+			return nil, fmt.Errorf("failed parsing db: %w", err)
+		}
+	}
+
+	return state, nil
+}
+
+// readFlag reads a boolean global variable, false if it is not set.
+func readFlag(name string) (bool, error) {
+	data, err := efivars.Read(name, efivars.GlobalGUID)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed reading %s: %w", name, err)
+	}
+
+	return len(data) > 0 && data[0] == 1, nil
+}
+
+// Accepts returns nil if the firmware boots images signed with the certificate: Secure Boot is not
+// enforced, the host is in setup mode, or the certificate is in the db or issued by one of its
+// certificates. It returns ErrNotAllowed otherwise.
+func (s *State) Accepts(cert *x509.Certificate) error {
+	if !s.SecureBoot || s.SetupMode {
+		return nil
+	}
+
+	for _, allowed := range s.Db {
+		if allowed.Equal(cert) || cert.CheckSignatureFrom(allowed) == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("certificate %s: %w", cert.Subject, ErrNotAllowed)
+}
@@ -0,0 +1,146 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secureboot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+
+	"github.com/kairos-io/go-ukify/pkg/efivars"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+)
+
+// ErrNotAllowed is returned when an image is neither signed by a certificate of the db nor has its digest in it.
+var ErrNotAllowed = errors.New("not allowed by db")
+
+// Policy is the pair of signature databases firmware decides whether images boot against.
+type Policy struct {
+	// Allowed signature database, db. Its entries are read as the dbx ones are.
+	Db *Revocations
+	// Forbidden signature database, dbx, nothing is revoked when nil.
+	Dbx *Revocations
+}
+
+// SystemPolicy reads the db and dbx variables of the running system.
+func SystemPolicy() (*Policy, error) {
+	db, err := systemDatabase("db")
+	if err != nil {
+		return nil, err
+	}
+
+	dbx, err := systemDatabase("dbx")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Policy{Db: db, Dbx: dbx}, nil
+}
+
+// systemDatabase reads the entries of the named signature database variable of the running system.
+func systemDatabase(name string) (*Revocations, error) {
+	data, err := efivars.Read(name, ImageSecurityGUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %w", name, err)
+	}
+
+	r, err := ParseRevocations(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", name, err)
+	}
+
+	return r, nil
+}
+
+// CheckImage decides whether firmware boots the PE file, as EDK2 does: its digest and the certificates
+// of its signatures must not be in the dbx, and one of its signatures must chain to a certificate of
+// the db, or its digest be in the db.
+//
+// It returns the db certificate allowing the image, nil if its digest does, ErrRevoked or ErrNotAllowed
+// otherwise. The validity periods of the certificates are not checked, as firmware has no trusted time.
+func (p *Policy) CheckImage(path string) (*x509.Certificate, error) {
+	digest, signatures, err := pesign.Signatures(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+
+	if p.Dbx != nil {
+		if err = p.Dbx.CheckDigest(path, digest); err != nil {
+			return nil, err
+		}
+
+		for _, sig := range signatures {
+			for _, cert := range append([]*x509.Certificate{sig.Signer}, sig.Certificates...) {
+				if cert == nil {
+					continue
+				}
+
+				if err = p.Dbx.CheckCertificate(cert); err != nil {
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+			}
+		}
+	}
+
+	if p.Db == nil {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotAllowed)
+	}
+
+	for _, sig := range signatures {
+		for _, cert := range p.Db.Certificates {
+			if sig.Verify([]*x509.Certificate{cert}) == nil {
+				return cert, nil
+			}
+		}
+	}
+
+	for _, allowed := range p.Db.ImageHashes {
+		if bytes.Equal(allowed, digest) {
+			return nil, nil
+		}
+	}
+
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("%s is unsigned: %w", path, ErrNotAllowed)
+	}
+
+	return nil, fmt.Errorf("%s: %w", path, ErrNotAllowed)
+}
+
+// variableData returns the signature lists of a signed variable update (.auth), as written by
+// sign-efi-sig-list or EnrollFiles, and the data as is when it is not one.
+func variableData(data []byte) ([]byte, error) {
+	// EFI_VARIABLE_AUTHENTICATION_2: EFI_TIME, followed by a WIN_CERTIFICATE_UEFI_GUID whose length
+	// covers its header
+	const timeSize, headerSize = 16, 24
+
+	if len(data) < timeSize+headerSize {
+		return data, nil
+	}
+
+	length := binary.LittleEndian.Uint32(data[timeSize:])
+	revision := binary.LittleEndian.Uint16(data[timeSize+4:])
+	certType := signature.WINCertType(binary.LittleEndian.Uint16(data[timeSize+6:]))
+
+	var guid util.EFIGUID
+	if err := binary.Read(bytes.NewReader(data[timeSize+8:timeSize+headerSize]), binary.LittleEndian, &guid); err != nil {
+		return nil, err
+	}
+
+	if revision != signature.WIN_CERTIFICATE_REVISION || certType != signature.WIN_CERT_TYPE_EFI_GUID || guid != signature.EFI_CERT_TYPE_PKCS7_GUID {
+		return data, nil
+	}
+
+	if length < headerSize || uint64(timeSize)+uint64(length) > uint64(len(data)) {
+		return nil, errors.New("truncated authenticated variable")
+	}
+
+	return data[timeSize+length:], nil
+}
@@ -0,0 +1,217 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Client signs with the keys of a signing service.
+type Client struct {
+	// URL of the service, i.e. https://signd.example:8443.
+	URL string
+	// HTTP client the requests are sent with.
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client of the service at url, authenticated with the TLS config, see ClientTLSConfig.
+func NewClient(url string, config *tls.Config) *Client {
+	return &Client{
+		URL: strings.TrimSuffix(url, "/"),
+		HTTPClient: &http.Client{
+			Timeout:   time.Minute,
+			Transport: &http.Transport{TLSClientConfig: config},
+		},
+	}
+}
+
+// Keys returns the public parts of the keys held by the service.
+func (client *Client) Keys() (*KeysResponse, error) {
+	var keys KeysResponse
+
+	if err := client.do(http.MethodGet, KeysPath, nil, &keys); err != nil {
+		return nil, err
+	}
+
+	return &keys, nil
+}
+
+// SecureBootSigner returns the signer of the SecureBoot key of the service, for pesign.NewSigner.
+func (client *Client) SecureBootSigner() (pesign.CertificateSigner, error) {
+	keys, err := client.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(keys.SecureBootCertificate))
+	if block == nil {
+		return nil, types.WithCategory(types.ErrSigning, errors.New("the signing service has no SecureBoot key"))
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("failed to parse the SecureBoot certificate of the signing service: %w", err))
+	}
+
+	rsaKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, types.WithCategory(types.ErrSigning, errors.New("the SecureBoot key of the signing service is not an RSA key"))
+	}
+
+	return &remoteSigner{client: client, key: KeySecureBoot, public: rsaKey, cert: cert}, nil
+}
+
+// PCRSigner returns the signer of the PCR key of the service, for the PCRSigner of a build.
+func (client *Client) PCRSigner() (types.RSAKey, error) {
+	keys, err := client.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(keys.PCRPublicKey))
+	if block == nil {
+		return nil, types.WithCategory(types.ErrSigning, errors.New("the signing service has no PCR key"))
+	}
+
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("failed to parse the PCR public key of the signing service: %w", err))
+	}
+
+	rsaKey, ok := public.(*rsa.PublicKey)
+	if !ok {
+		return nil, types.WithCategory(types.ErrSigning, errors.New("the PCR key of the signing service is not an RSA key"))
+	}
+
+	return &remoteSigner{client: client, key: KeyPCR, public: rsaKey}, nil
+}
+
+// do sends the request and decodes the response into out.
+func (client *Client) do(method, path string, in, out any) error {
+	var body io.Reader
+
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, client.URL+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return types.WithCategory(types.ErrSigning, fmt.Errorf("signing service: %w", err))
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		var failure errorResponse
+
+		_ = json.NewDecoder(resp.Body).Decode(&failure) //nolint:errcheck
+
+		return types.WithCategory(types.ErrSigning, fmt.Errorf("signing service: %s: %s", resp.Status, failure.Error))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// remoteSigner signs with a key of the service.
+type remoteSigner struct {
+	client *Client
+	key    string
+	public *rsa.PublicKey
+	// certificate of the SecureBoot key
+	cert *x509.Certificate
+}
+
+// Verify interfaces.
+var (
+	_ types.RSAKey             = (*remoteSigner)(nil)
+	_ pesign.CertificateSigner = (*remoteSigner)(nil)
+	_ pesign.HardwareBacked    = (*remoteSigner)(nil)
+)
+
+// Public implements crypto.Signer.
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// PublicRSAKey implements types.RSAKey.
+func (s *remoteSigner) PublicRSAKey() *rsa.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer, sending the digest to the service and verifying the signature it
+// returns against the public key.
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash, err := hashName(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	request := SignRequest{Key: s.key, Digest: digest, Hash: hash}
+
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		saltLength := pss.SaltLength
+		request.PSSSaltLength = &saltLength
+	}
+
+	var response SignResponse
+
+	if err = s.client.do(http.MethodPost, SignPath, request, &response); err != nil {
+		return nil, err
+	}
+
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		err = rsa.VerifyPSS(s.public, opts.HashFunc(), digest, response.Signature, pss)
+	} else {
+		err = rsa.VerifyPKCS1v15(s.public, opts.HashFunc(), digest, response.Signature)
+	}
+
+	if err != nil {
+		return nil, types.WithCategory(types.ErrSigning, fmt.Errorf("the signing service returned an invalid %s signature: %w", s.key, err))
+	}
+
+	return response.Signature, nil
+}
+
+// HardwareBacked implements pesign.HardwareBacked, the key being held by the service.
+func (s *remoteSigner) HardwareBacked() bool {
+	return true
+}
+
+// Signer implements pesign.CertificateSigner.
+func (s *remoteSigner) Signer() crypto.Signer {
+	return s
+}
+
+// Certificate implements pesign.CertificateSigner.
+func (s *remoteSigner) Certificate() *x509.Certificate {
+	return s.cert
+}
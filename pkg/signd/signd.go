@@ -0,0 +1,297 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package signd implements a signing service holding the SecureBoot and PCR keys, and the signers
+// of the builds using it, so the hosts building UKIs never get the private keys.
+//
+// The service signs digests only: the builds hash the UKIs and the PCR policies, the service returns
+// the signatures of the hashes. Clients are authenticated with TLS client certificates, each request
+// is written to the audit log.
+package signd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Keys held by the service.
+const (
+	KeySecureBoot = "secureboot"
+	KeyPCR        = "pcr"
+)
+
+// Paths of the service endpoints.
+const (
+	KeysPath = "/v1/keys"
+	SignPath = "/v1/sign"
+)
+
+// KeysResponse is the response of KeysPath: the public parts of the keys held by the service.
+type KeysResponse struct {
+	// PEM encoded SecureBoot certificate, empty without SecureBoot key.
+	SecureBootCertificate string `json:"secureBootCertificate,omitempty"`
+	// PEM encoded PCR public key, empty without PCR key.
+	PCRPublicKey string `json:"pcrPublicKey,omitempty"`
+}
+
+// SignRequest is the request of SignPath.
+type SignRequest struct {
+	// Key to sign with, KeySecureBoot or KeyPCR.
+	Key string `json:"key"`
+	// Digest to sign.
+	Digest []byte `json:"digest"`
+	// Hash the digest was computed with, i.e. SHA-256.
+	Hash string `json:"hash"`
+	// Salt length of an RSA-PSS signature, PKCS #1 v1.5 signatures are made if nil.
+	PSSSaltLength *int `json:"pssSaltLength,omitempty"`
+}
+
+// SignResponse is the response of SignPath.
+type SignResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// errorResponse is the response of failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// hashes are the hashes digests may be signed for, by name.
+var hashes = map[string]crypto.Hash{
+	crypto.SHA256.String(): crypto.SHA256,
+	crypto.SHA384.String(): crypto.SHA384,
+	crypto.SHA512.String(): crypto.SHA512,
+}
+
+// Server serves the signing endpoints.
+type Server struct {
+	// SecureBoot key and certificate, SecureBoot signing is refused when nil.
+	SecureBoot pesign.CertificateSigner
+	// PCR key, PCR signing is refused when nil.
+	PCR types.RSAKey
+	// Logger of the audit records, one per request, slog.Default() when nil.
+	Audit *slog.Logger
+}
+
+// ServeHTTP implements http.Handler.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == KeysPath && r.Method == http.MethodGet:
+		server.keys(w)
+	case r.URL.Path == SignPath && r.Method == http.MethodPost:
+		server.sign(w, r)
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+	}
+}
+
+// keys writes the public parts of the keys.
+func (server *Server) keys(w http.ResponseWriter) {
+	var response KeysResponse
+
+	if server.SecureBoot != nil {
+		response.SecureBootCertificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.SecureBoot.Certificate().Raw}))
+	}
+
+	if server.PCR != nil {
+		der, err := x509.MarshalPKIXPublicKey(server.PCR.PublicRSAKey())
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+
+			return
+		}
+
+		response.PCRPublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// sign signs the requested digest, and writes the audit record of the request.
+func (server *Server) sign(w http.ResponseWriter, r *http.Request) {
+	var request SignRequest
+
+	status, signature, err := http.StatusBadRequest, []byte(nil), json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&request)
+	if err == nil {
+		status, signature, err = server.signDigest(request)
+	}
+
+	attrs := []any{
+		"client", clientName(r),
+		"remote", r.RemoteAddr,
+		"key", request.Key,
+		"hash", request.Hash,
+		"digest", hex.EncodeToString(request.Digest),
+	}
+
+	if err != nil {
+		server.audit().Warn("Refused signing", append(attrs, "status", status, "error", err)...)
+		writeJSON(w, status, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	server.audit().Info("Signed digest", attrs...)
+	writeJSON(w, http.StatusOK, SignResponse{Signature: signature})
+}
+
+// signDigest signs the digest of the request with the requested key.
+func (server *Server) signDigest(request SignRequest) (int, []byte, error) {
+	var signer crypto.Signer
+
+	switch request.Key {
+	case KeySecureBoot:
+		if server.SecureBoot != nil {
+			signer = server.SecureBoot.Signer()
+		}
+	case KeyPCR:
+		if server.PCR != nil {
+			signer = server.PCR
+		}
+	default:
+		return http.StatusBadRequest, nil, fmt.Errorf("unknown key %q", request.Key)
+	}
+
+	if signer == nil {
+		return http.StatusNotFound, nil, fmt.Errorf("no %s key", request.Key)
+	}
+
+	hash, ok := hashes[request.Hash]
+	if !ok {
+		return http.StatusBadRequest, nil, fmt.Errorf("unsupported hash %q", request.Hash)
+	}
+
+	if len(request.Digest) != hash.Size() {
+		return http.StatusBadRequest, nil, fmt.Errorf("%s digests are %d bytes, got %d", hash, hash.Size(), len(request.Digest))
+	}
+
+	if err := fips.CheckHash(hash); err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	if err := fips.CheckKey(signer.Public()); err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	var opts crypto.SignerOpts = hash
+	if request.PSSSaltLength != nil {
+		opts = &rsa.PSSOptions{SaltLength: *request.PSSSaltLength, Hash: hash}
+	}
+
+	signature, err := signer.Sign(rand.Reader, request.Digest, opts)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+
+	return http.StatusOK, signature, nil
+}
+
+// audit returns the logger of the audit records.
+func (server *Server) audit() *slog.Logger {
+	if server.Audit == nil {
+		return slog.Default()
+	}
+
+	return server.Audit
+}
+
+// clientName returns the subject of the client certificate, the client is anonymous without one.
+func clientName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return r.TLS.PeerCertificates[0].Subject.String()
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
+
+// ServerTLSConfig returns the TLS config of a service requiring client certificates signed by the CAs of
+// clientCAFile.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := loadCAs(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientTLSConfig returns the TLS config of a client authenticating with its certificate, and checking the
+// service certificate against the CAs of caFile, the system ones if empty.
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		if config.RootCAs, err = loadCAs(caFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// loadCAs reads the PEM encoded CA certificates of path.
+func loadCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate in " + path)
+	}
+
+	return pool, nil
+}
+
+// hashName returns the name of the hash of opts, as sent to the service.
+func hashName(opts crypto.SignerOpts) (string, error) {
+	name := opts.HashFunc().String()
+	if _, ok := hashes[name]; !ok {
+		return "", fmt.Errorf("unsupported hash %s", strings.TrimPrefix(name, "unknown hash value "))
+	}
+
+	return name, nil
+}
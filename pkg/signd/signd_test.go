@@ -0,0 +1,198 @@
+package signd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Signd test Suite")
+}
+
+// writeCert writes a certificate for name, signed by parent, and its key, to dir.
+func writeCert(dir, name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0o600)).To(Succeed())
+
+	return cert, key
+}
+
+// otherKey advertises the public key of RSAKey but signs with another one.
+type otherKey struct {
+	types.RSAKey
+	other *rsa.PrivateKey
+}
+
+func (k otherKey) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.other.Sign(random, digest, opts)
+}
+
+var _ = Describe("Signing service", func() {
+	var dir string
+	var audit *bytes.Buffer
+	var server *Server
+	var service *httptest.Server
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+
+		ca, caKey := writeCert(dir, "ca", &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil, nil)
+		writeCert(dir, "server", &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ca, caKey)
+		writeCert(dir, "builder", &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, caKey)
+
+		sb, err := pesign.NewSecureBootSigner("../pesign/testdata/sb.pem", "../pesign/testdata/sb.key")
+		Expect(err).ToNot(HaveOccurred())
+		pcr, err := pesign.NewPCRSigner("../pesign/testdata/sb.key")
+		Expect(err).ToNot(HaveOccurred())
+
+		audit = &bytes.Buffer{}
+		server = &Server{SecureBoot: sb, PCR: pcr, Audit: slog.New(slog.NewJSONHandler(audit, nil))}
+		service = httptest.NewUnstartedServer(server)
+		service.TLS, err = ServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+		Expect(err).ToNot(HaveOccurred())
+		service.StartTLS()
+		DeferCleanup(service.Close)
+	})
+
+	client := func() *Client {
+		tlsConfig, err := ClientTLSConfig(filepath.Join(dir, "builder.pem"), filepath.Join(dir, "builder.key"), filepath.Join(dir, "ca.pem"))
+		Expect(err).ToNot(HaveOccurred())
+
+		return NewClient(service.URL, tlsConfig)
+	}
+
+	It("Signs efi files with the remote SecureBoot key", func() {
+		remote, err := client().SecureBootSigner()
+		Expect(err).ToNot(HaveOccurred())
+
+		signer, err := pesign.NewSigner(remote)
+		Expect(err).ToNot(HaveOccurred())
+
+		out := filepath.Join(dir, "file.signed.efi")
+		Expect(signer.Sign("../pesign/testdata/file.efi", out)).To(Succeed())
+
+		cert, err := pesign.LoadCertificate("../pesign/testdata/sb.pem")
+		Expect(err).ToNot(HaveOccurred())
+		ok, err := pesign.VerifyFile(out, cert)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		Expect(audit.String()).To(ContainSubstring(`"msg":"Signed digest"`))
+		Expect(audit.String()).To(ContainSubstring(`"client":"CN=builder"`))
+		Expect(audit.String()).To(ContainSubstring(`"key":"secureboot"`))
+	})
+
+	It("Signs with the remote PCR key", func() {
+		remote, err := client().PCRSigner()
+		Expect(err).ToNot(HaveOccurred())
+
+		digest := sha256.Sum256([]byte("policy"))
+		signature, err := remote.Sign(rand.Reader, digest[:], crypto.SHA256)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rsa.VerifyPKCS1v15(remote.PublicRSAKey(), crypto.SHA256, digest[:], signature)).To(Succeed())
+
+		signature, err = remote.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rsa.VerifyPSS(remote.PublicRSAKey(), crypto.SHA256, digest[:], signature, nil)).To(Succeed())
+	})
+
+	It("Refuses and audits invalid requests", func() {
+		remote, err := client().PCRSigner()
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = remote.Sign(rand.Reader, []byte("short"), crypto.SHA256)
+		Expect(err).To(MatchError(ContainSubstring("SHA-256 digests are 32 bytes, got 5")))
+		Expect(audit.String()).To(ContainSubstring(`"msg":"Refused signing"`))
+	})
+
+	It("Refuses SHA-1 digests", func() {
+		remote, err := client().PCRSigner()
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = remote.Sign(rand.Reader, make([]byte, crypto.SHA1.Size()), crypto.SHA1)
+		Expect(err).To(MatchError(ContainSubstring("unsupported hash SHA-1")))
+
+		var response SignResponse
+		err = client().do(http.MethodPost, SignPath, SignRequest{Key: KeyPCR, Digest: make([]byte, crypto.SHA1.Size()), Hash: crypto.SHA1.String()}, &response)
+		Expect(err).To(MatchError(ContainSubstring(`unsupported hash "SHA-1"`)))
+	})
+	It("Rejects signatures not made by the advertised key", func() {
+		remote, err := client().PCRSigner()
+		Expect(err).ToNot(HaveOccurred())
+
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		server.PCR = otherKey{RSAKey: server.PCR, other: other}
+
+		digest := sha256.Sum256([]byte("policy"))
+		_, err = remote.Sign(rand.Reader, digest[:], crypto.SHA256)
+		Expect(err).To(MatchError(types.ErrSigning))
+		_, err = remote.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+		Expect(err).To(MatchError(types.ErrSigning))
+	})
+	It("Rejects clients without certificate", func() {
+		tlsConfig, err := ClientTLSConfig(filepath.Join(dir, "builder.pem"), filepath.Join(dir, "builder.key"), filepath.Join(dir, "ca.pem"))
+		Expect(err).ToNot(HaveOccurred())
+		tlsConfig.Certificates = nil
+
+		_, err = NewClient(service.URL, tlsConfig).Keys()
+		Expect(err).To(HaveOccurred())
+		Expect(audit.Len()).To(BeZero())
+	})
+})
@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package splash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ErrInvalidBMP is returned for images that are not BMP images systemd-stub can show.
+var ErrInvalidBMP = errors.New("not a BMP image")
+
+// Screen size many firmware boot in, the stub does not show splashes larger than the screen.
+const (
+	TypicalWidth  = 1024
+	TypicalHeight = 768
+)
+
+// Compressions of the BMP pixel data systemd-stub reads.
+const (
+	compressionRGB       = 0
+	compressionBitfields = 3
+)
+
+// dibHeaderSizes are the sizes of the DIB headers the stub reads, from BITMAPINFOHEADER to BITMAPV5HEADER.
+var dibHeaderSizes = []uint32{40, 52, 56, 64, 108, 124}
+
+// bitCounts are the bits per pixel the stub reads.
+var bitCounts = []int{1, 4, 8, 16, 24, 32}
+
+// Info describes a BMP image.
+type Info struct {
+	// Size of the image in pixels.
+	Width, Height int
+	// Bits per pixel.
+	BitCount int
+	// Compression of the pixel data, 0 for none and 3 for bit fields.
+	Compression uint32
+}
+
+// Inspect checks the size bytes read from r are a BMP image systemd-stub can show, only reading its
+// headers, and describes it.
+//
+// The stub reads uncompressed images with bottom-up rows, of 1, 4, 8, 16, 24 or 32 bits per pixel,
+// the 16 and 32 bits ones possibly with bit fields.
+// ref: https://github.com/systemd/systemd/blob/v255/src/boot/efi/splash.c
+func Inspect(r io.ReaderAt, size int64) (*Info, error) {
+	header := make([]byte, fileHeaderSize+infoHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, ErrInvalidBMP
+	}
+
+	if string(header[0:2]) != "BM" {
+		return nil, ErrInvalidBMP
+	}
+
+	// the pixel data starts after the headers, within the file
+	dataOffset := int64(binary.LittleEndian.Uint32(header[10:14]))
+	dibSize := binary.LittleEndian.Uint32(header[14:18])
+
+	if !slices.Contains(dibHeaderSizes, dibSize) || dataOffset < fileHeaderSize+int64(dibSize) || dataOffset > size {
+		return nil, fmt.Errorf("%w: invalid headers", ErrInvalidBMP)
+	}
+
+	info := &Info{
+		Width:       int(int32(binary.LittleEndian.Uint32(header[18:22]))),
+		Height:      int(int32(binary.LittleEndian.Uint32(header[22:26]))),
+		BitCount:    int(binary.LittleEndian.Uint16(header[28:30])),
+		Compression: binary.LittleEndian.Uint32(header[30:34]),
+	}
+
+	if planes := binary.LittleEndian.Uint16(header[26:28]); planes != 1 {
+		return nil, fmt.Errorf("%w: invalid number of planes %d", ErrInvalidBMP, planes)
+	}
+
+	if info.Width <= 0 || info.Height == 0 {
+		return nil, fmt.Errorf("%w: invalid size %dx%d", ErrInvalidBMP, info.Width, info.Height)
+	}
+
+	if info.Height < 0 {
+		return nil, fmt.Errorf("%w: top-down rows are not supported by the stub", ErrInvalidBMP)
+	}
+
+	if !slices.Contains(bitCounts, info.BitCount) {
+		return nil, fmt.Errorf("%w: %d bits per pixel are not supported by the stub", ErrInvalidBMP, info.BitCount)
+	}
+
+	switch {
+	case info.Compression == compressionRGB:
+	case info.Compression == compressionBitfields && (info.BitCount == 16 || info.BitCount == 32):
+	default:
+		return nil, fmt.Errorf("%w: compression %d is not supported by the stub, the image must be uncompressed", ErrInvalidBMP, info.Compression)
+	}
+
+	// rows are padded to 4 bytes
+	stride := (int64(info.Width)*int64(info.BitCount) + 31) / 32 * 4
+	if dataOffset+stride*int64(info.Height) > size {
+		return nil, fmt.Errorf("%w: the pixel data of the %dx%d image is truncated", ErrInvalidBMP, info.Width, info.Height)
+	}
+
+	return info, nil
+}
+
+// Oversized returns whether the image is larger than the typical screen, see TypicalWidth and TypicalHeight.
+func (info *Info) Oversized() bool {
+	return info.Width > TypicalWidth || info.Height > TypicalHeight
+}
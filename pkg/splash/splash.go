@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package splash converts images to the BMP format of the splash systemd-stub shows at boot.
+package splash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+
+	// formats converted by Convert
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// ErrUnknownFormat is returned by Convert for images that are neither PNG nor JPEG.
+var ErrUnknownFormat = errors.New("unknown image format, expected PNG or JPEG")
+
+// Sizes of the BMP headers written by Encode: the file header and BITMAPINFOHEADER.
+const (
+	fileHeaderSize = 14
+	infoHeaderSize = 40
+)
+
+// Convert decodes a PNG or JPEG image and encodes it as a BMP, see Encode.
+func Convert(r io.Reader) ([]byte, error) {
+	img, _, err := image.Decode(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, ErrUnknownFormat
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding the image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err = Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Encode writes the image as the BMP systemd-stub and the firmware BGRT read: uncompressed 24 bits per
+// pixel, with bottom-up rows padded to 4 bytes. Transparent pixels are blended over black, the
+// background the stub draws the splash on.
+func Encode(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width == 0 || height == 0 {
+		return errors.New("the image is empty")
+	}
+
+	stride := (width*3 + 3) &^ 3
+	size := int64(stride) * int64(height)
+
+	if fileHeaderSize+infoHeaderSize+size > 0xffffffff {
+		return fmt.Errorf("the image is too large, %dx%d", width, height)
+	}
+
+	header := make([]byte, fileHeaderSize+infoHeaderSize)
+	copy(header, "BM")
+	binary.LittleEndian.PutUint32(header[2:], uint32(fileHeaderSize+infoHeaderSize+size))
+	binary.LittleEndian.PutUint32(header[10:], fileHeaderSize+infoHeaderSize)
+	binary.LittleEndian.PutUint32(header[14:], infoHeaderSize)
+	binary.LittleEndian.PutUint32(header[18:], uint32(width))
+	// a positive height tells the rows are bottom-up
+	binary.LittleEndian.PutUint32(header[22:], uint32(height))
+	binary.LittleEndian.PutUint16(header[26:], 1)
+	binary.LittleEndian.PutUint16(header[28:], 24)
+	binary.LittleEndian.PutUint32(header[34:], uint32(size))
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	row := make([]byte, stride)
+
+	for y := bounds.Max.Y - 1; y >= bounds.Min.Y; y-- {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// alpha premultiplied, so blended over black
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA) //nolint:forcetypeassert
+			i := (x - bounds.Min.X) * 3
+			row[i], row[i+1], row[i+2] = c.B, c.G, c.R
+		}
+
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
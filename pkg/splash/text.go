@@ -0,0 +1,66 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package splash
+
+import (
+	"image"
+	"image/color"
+)
+
+// DefaultTextScale is the scale of the bundled font Text renders with when not given.
+const DefaultTextScale = 4
+
+// Text renders the lines centered in white on black with the bundled font, each pixel of the 5x7
+// glyphs scaled to scale x scale pixels. The image only holds the text and a margin, the stub centers
+// it on the screen.
+func Text(lines []string, scale int) *image.Gray {
+	if scale < 1 {
+		scale = DefaultTextScale
+	}
+
+	// a column between the characters, and a row between the lines
+	advance, lineHeight := (glyphWidth+1)*scale, (glyphHeight+2)*scale
+	margin := 2 * lineHeight
+
+	columns := 1
+	for _, line := range lines {
+		columns = max(columns, len([]rune(line)))
+	}
+
+	width := columns*advance + 2*margin
+	height := max(len(lines), 1)*lineHeight + 2*margin
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+
+	for i, line := range lines {
+		runes := []rune(line)
+		x := (width - len(runes)*advance) / 2
+		y := margin + i*lineHeight
+
+		for _, r := range runes {
+			drawGlyph(img, glyph(r), x, y, scale)
+			x += advance
+		}
+	}
+
+	return img
+}
+
+// drawGlyph draws the glyph with its top left corner at x, y.
+func drawGlyph(img *image.Gray, g [glyphWidth]byte, x, y, scale int) {
+	for column, bits := range g {
+		for row := 0; row < glyphHeight; row++ {
+			if bits&(1<<row) == 0 {
+				continue
+			}
+
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray(x+column*scale+dx, y+row*scale+dy, color.Gray{Y: 0xff})
+				}
+			}
+		}
+	}
+}
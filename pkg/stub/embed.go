@@ -0,0 +1,79 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// ErrNotEmbedded is returned when the binary was not embedded at build time.
+var ErrNotEmbedded = errors.New("binary not embedded, build with -tags embedstubs")
+
+// Embedded returns the sd-stub embedded for the architecture, written to the cache so it can be read from a path.
+//
+// Binaries are embedded from the embedded/ directory when building with the embedstubs tag, each listed
+// with its SHA256 in embedded/SHA256SUMS.
+func Embedded(arch string) (*Binary, error) {
+	efiArch, err := EFIArch(arch)
+	if err != nil {
+		return nil, err
+	}
+
+	if embedded == nil {
+		return nil, ErrNotEmbedded
+	}
+
+	name := fmt.Sprintf("linux%s.efi.stub", efiArch)
+
+	sums, err := fs.ReadFile(embedded, "embedded/SHA256SUMS")
+	if err != nil {
+		return nil, ErrNotEmbedded
+	}
+
+	digest := embeddedDigest(sums, name)
+	if digest == "" {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotEmbedded)
+	}
+
+	data, err := fs.ReadFile(embedded, "embedded/"+name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotEmbedded)
+	}
+
+	if err = checkDigest(data, digest); err != nil {
+		return nil, fmt.Errorf("embedded %s: %w", name, err)
+	}
+
+	path, err := cachePath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if Verify(path, digest) != nil {
+		if err = store(path, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return Inspect(path)
+}
+
+// embeddedDigest returns the digest of name in a sha256sum file, or an empty string.
+func embeddedDigest(sums []byte, name string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return fields[0]
+		}
+	}
+
+	return ""
+}
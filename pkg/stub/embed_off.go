@@ -0,0 +1,8 @@
+//go:build !embedstubs
+
+package stub
+
+import "io/fs"
+
+// embedded is nil as no binaries are embedded without the embedstubs tag.
+var embedded fs.FS
@@ -0,0 +1,15 @@
+//go:build embedstubs
+
+package stub
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// embeddedFS holds the binaries of the embedded/ directory.
+//
+//go:embed embedded
+var embeddedFS embed.FS
+
+var embedded fs.FS = embeddedFS
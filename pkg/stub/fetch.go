@@ -0,0 +1,133 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// CacheDir is where fetched and embedded binaries are stored, named after their SHA256.
+// It defaults to go-ukify/stubs in the user cache directory.
+var CacheDir = ""
+
+// fetchTimeout bounds the download of a binary.
+const fetchTimeout = 5 * time.Minute
+
+// IsURL reports whether the path is an http or https URL to fetch the binary from.
+func IsURL(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// Fetch downloads the binary at url, checks it has the given SHA256 and returns its path in the cache.
+//
+// A binary already in the cache is not downloaded again.
+func Fetch(url, digest string) (string, error) {
+	if digest == "" {
+		return "", fmt.Errorf("a SHA256 is required to fetch %s", url)
+	}
+
+	path, err := cachePath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if Verify(path, digest) == nil {
+		slog.Debug("Using cached binary", "url", url, "path", path)
+
+		return path, nil
+	}
+
+	slog.Info("Fetching binary", "url", url)
+
+	client := &http.Client{Timeout: fetchTimeout}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed fetching %s: %s", url, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed fetching %s: %w", url, err)
+	}
+
+	if err = checkDigest(data, digest); err != nil {
+		return "", fmt.Errorf("%s: %w", url, err)
+	}
+
+	return path, store(path, data)
+}
+
+// Verify checks that the file has the given hex encoded SHA256.
+func Verify(path, digest string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err = checkDigest(data, digest); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+func checkDigest(data []byte, digest string) error {
+	want, err := hex.DecodeString(digest)
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("invalid SHA256 %q", digest)
+	}
+
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], want) {
+		return fmt.Errorf("SHA256 mismatch, expected %s got %s", digest, hex.EncodeToString(got[:]))
+	}
+
+	return nil
+}
+
+func cachePath(digest string) (string, error) {
+	dir := CacheDir
+	if dir == "" {
+		userDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(userDir, "go-ukify", "stubs")
+	}
+
+	if strings.ContainsAny(digest, `/\.`) {
+		return "", errors.New("invalid SHA256")
+	}
+
+	return filepath.Join(dir, strings.ToLower(digest)), nil
+}
+
+// store writes data to path atomically, see utils.WriteFile, so concurrent builds never see a partial binary.
+func store(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return utils.WriteFile(path, data, 0o600)
+}
@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package stub finds and describes the systemd-stub and systemd-boot EFI binaries installed on the host.
+package stub
+
+import (
+	"debug/pe"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Auto is the path value asking for the binary to be discovered.
+const Auto = "auto"
+
+// ErrNotFound is returned when a binary is not installed on the host.
+var ErrNotFound = errors.New("not found")
+
+// Dir is where systemd installs its EFI binaries.
+var Dir = "/usr/lib/systemd/boot/efi"
+
+// Binary is a systemd EFI binary.
+type Binary struct {
+	// Path to the binary.
+	Path string `json:"path"`
+	// EFI architecture name, i.e. x64 or aa64.
+	Arch string `json:"arch"`
+	// Name from the LoaderInfo marker, i.e. systemd-stub or systemd-boot.
+	Name string `json:"name,omitempty"`
+	// Version from the LoaderInfo marker, i.e. 254.10-1.fc39.
+	Version string `json:"version,omitempty"`
+}
+
+// loaderInfo is the marker systemd EFI binaries carry in their .sdmagic section.
+var loaderInfo = regexp.MustCompile(`#### LoaderInfo: (\S+) (\S+) ####`)
+
+// EFIArch returns the EFI architecture name for a Go or EFI architecture name, defaulting to the host one.
+func EFIArch(arch string) (string, error) {
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+
+	switch arch {
+	case "amd64", "x86_64", "x64":
+		return "x64", nil
+	case "arm64", "aarch64", "aa64":
+		return "aa64", nil
+	case "386", "ia32":
+		return "ia32", nil
+	case "arm":
+		return "arm", nil
+	case "riscv64":
+		return "riscv64", nil
+	default:
+		return "", fmt.Errorf("unsupported architecture %q", arch)
+	}
+}
+
+// FindStub returns the systemd-stub for the architecture, i.e. linuxx64.efi.stub, falling back to the
+// embedded one when it is not installed on the host.
+func FindStub(arch string) (*Binary, error) {
+	binary, err := find(arch, "linux%s.efi.stub")
+	if errors.Is(err, ErrNotFound) && embedded != nil {
+		embeddedBinary, embeddedErr := Embedded(arch)
+		if !errors.Is(embeddedErr, ErrNotEmbedded) {
+			return embeddedBinary, embeddedErr
+		}
+	}
+
+	return binary, err
+}
+
+// FindBoot returns the systemd-boot for the architecture, i.e. systemd-bootx64.efi.
+func FindBoot(arch string) (*Binary, error) {
+	return find(arch, "systemd-boot%s.efi")
+}
+
+// List returns the systemd-stub and systemd-boot binaries found for every architecture.
+func List() ([]*Binary, error) {
+	binaries := []*Binary{}
+
+	for _, pattern := range []string{"linux*.efi.stub", "systemd-boot*.efi"} {
+		paths, err := filepath.Glob(filepath.Join(Dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			binary, err := Inspect(path)
+			if err != nil {
+				return nil, err
+			}
+
+			binaries = append(binaries, binary)
+		}
+	}
+
+	return binaries, nil
+}
+
+func find(arch, name string) (*Binary, error) {
+	efiArch, err := EFIArch(arch)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(Dir, fmt.Sprintf(name, efiArch))
+
+	if _, err = os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%s %w, is systemd-boot installed?", path, ErrNotFound)
+		}
+
+		return nil, err
+	}
+
+	return Inspect(path)
+}
+
+// Inspect returns the architecture, name and version of a systemd EFI binary.
+//
+// Name and version are left empty if the binary has no LoaderInfo marker.
+func Inspect(path string) (*Binary, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %w", path, err)
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	arch, err := utils.EFIArch(f.Machine)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	binary := &Binary{Path: path, Arch: arch}
+
+	if section := f.Section(".sdmagic"); section != nil {
+		data, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %w", path, err)
+		}
+
+		if m := loaderInfo.FindSubmatch(data); m != nil {
+			binary.Name, binary.Version = string(m[1]), string(m[2])
+		}
+	}
+
+	return binary, nil
+}
@@ -0,0 +1,116 @@
+package stub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Stub test Suite")
+}
+
+var _ = Describe("Stub tests", func() {
+	BeforeEach(func() {
+		dir := Dir
+		DeferCleanup(func() { Dir = dir })
+		Dir = GinkgoT().TempDir()
+	})
+
+	It("Reads the version from the LoaderInfo marker", func() {
+		binary, err := Inspect("../pesign/testdata/file.efi")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*binary).To(Equal(Binary{Path: "../pesign/testdata/file.efi", Arch: "x64", Name: "systemd-boot", Version: "254.10-1.fc39"}))
+	})
+	It("Finds the binaries of the architecture", func() {
+		data, err := os.ReadFile("../pesign/testdata/file.efi")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(Dir, "systemd-bootx64.efi"), data, 0o644)).To(Succeed())
+
+		binary, err := FindBoot("amd64")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(binary.Path).To(Equal(filepath.Join(Dir, "systemd-bootx64.efi")))
+
+		_, err = FindStub("amd64")
+		Expect(err).To(MatchError(ContainSubstring("not found")))
+
+		binaries, err := List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(binaries).To(HaveLen(1))
+	})
+	It("Maps Go architectures to EFI ones", func() {
+		Expect(EFIArch("arm64")).To(Equal("aa64"))
+		Expect(EFIArch("x64")).To(Equal("x64"))
+		_, err := EFIArch("mips")
+		Expect(err).To(HaveOccurred())
+	})
+	Describe("Fetch", func() {
+		var data []byte
+		var digest string
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			cache := CacheDir
+			DeferCleanup(func() { CacheDir = cache })
+			CacheDir = GinkgoT().TempDir()
+
+			data = []byte("stub")
+			sum := sha256.Sum256(data)
+			digest = hex.EncodeToString(sum[:])
+
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(data)
+			}))
+			DeferCleanup(server.Close)
+		})
+
+		It("Downloads once and pins the checksum", func() {
+			path, err := Fetch(server.URL+"/linuxx64.efi.stub", digest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.ReadFile(path)).To(Equal(data))
+
+			server.Close()
+			Expect(Fetch(server.URL+"/linuxx64.efi.stub", digest)).To(Equal(path))
+		})
+		It("Rejects mismatching or missing checksums", func() {
+			_, err := Fetch(server.URL, strings.Repeat("0", 64))
+			Expect(err).To(MatchError(ContainSubstring("mismatch")))
+			_, err = Fetch(server.URL, "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	It("Reads embedded digests from SHA256SUMS", func() {
+		Expect(embeddedDigest([]byte("aa  linuxx64.efi.stub\nbb *linuxaa64.efi.stub\n"), "linuxaa64.efi.stub")).To(Equal("bb"))
+	})
+	Describe("Stubs", func() {
+		It("Knows the sections of the systemd-stub version", func() {
+			Expect((&SystemdStub{major: 251}).Supports(constants.PCRSig)).To(BeFalse())
+			Expect((&SystemdStub{major: 253}).Supports(constants.Uname)).To(BeFalse())
+			Expect((&SystemdStub{major: 254}).Supports(constants.Uname)).To(BeTrue())
+			Expect((&SystemdStub{major: 257}).Supports(constants.EFIFW)).To(BeFalse())
+			Expect((&SystemdStub{major: 258}).Supports(constants.EFIFW)).To(BeTrue())
+			Expect((&SystemdStub{}).Supports(constants.Uname)).To(BeTrue())
+
+			s, err := NewSystemdStub("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.major).To(Equal(254))
+			Expect(s.SBAT()).To(HavePrefix("sbat,1,"))
+		})
+		It("Limits custom stubs to their sections", func() {
+			custom := &Custom{StubPath: "../pesign/testdata/file.efi", Sections: []constants.Section{constants.Linux, constants.Initrd}}
+			Expect(custom.Supports(constants.Initrd)).To(BeTrue())
+			Expect(custom.Supports(constants.Splash)).To(BeFalse())
+			Expect((&Custom{}).Supports(constants.Splash)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stub
+
+import (
+	"debug/pe"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+// Stub is an EFI stub UKIs are assembled from, by appending the sections to it.
+type Stub interface {
+	// Path to the stub PE binary.
+	Path() string
+	// Supports reports whether the stub handles the section, unsupported sections are left out of the UKI.
+	Supports(section constants.Section) bool
+	// SBAT returns the SBAT section of the stub, or nil if it has none and the UKI needs its own.
+	SBAT() ([]byte, error)
+}
+
+// Verify interface.
+var (
+	_ Stub = (*SystemdStub)(nil)
+	_ Stub = (*Custom)(nil)
+)
+
+// sectionsSince lists the sections systemd-stub only handles from a given major version on.
+var sectionsSince = map[constants.Section]int{
+	constants.PCRSig:  252,
+	constants.PCRPKey: 252,
+	constants.Uname:   254,
+	constants.EFIFW:   258,
+}
+
+// SystemdStub is the systemd-stub, handling the sections its version knows about.
+type SystemdStub struct {
+	path string
+	// major version, 0 when unknown
+	major int
+}
+
+// NewSystemdStub returns the systemd-stub at path.
+//
+// Its version is read from the LoaderInfo marker, a stub without one is assumed to handle all the sections.
+func NewSystemdStub(path string) (*SystemdStub, error) {
+	binary, err := Inspect(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SystemdStub{path: path}
+
+	// versions look like 254, 254.10 or 254.10-1.fc39
+	major, _, _ := strings.Cut(binary.Version, ".")
+	major, _, _ = strings.Cut(major, "-")
+	s.major, _ = strconv.Atoi(major)
+
+	return s, nil
+}
+
+// Path implements Stub.
+func (s *SystemdStub) Path() string {
+	return s.path
+}
+
+// Supports implements Stub.
+func (s *SystemdStub) Supports(section constants.Section) bool {
+	since, ok := sectionsSince[section]
+
+	return !ok || s.major == 0 || s.major >= since
+}
+
+// SBAT implements Stub, systemd-stub always carries its own SBAT section.
+func (s *SystemdStub) SBAT() ([]byte, error) {
+	data, err := peSection(s.path, string(constants.SBAT))
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		return nil, fmt.Errorf("could not find SBAT section in %s", s.path)
+	}
+
+	return data, nil
+}
+
+// Custom is an alternative stub handling a fixed set of sections.
+type Custom struct {
+	// Path to the stub PE binary.
+	StubPath string
+	// Sections the stub handles, all of them when empty.
+	Sections []constants.Section
+}
+
+// Path implements Stub.
+func (c *Custom) Path() string {
+	return c.StubPath
+}
+
+// Supports implements Stub.
+func (c *Custom) Supports(section constants.Section) bool {
+	if len(c.Sections) == 0 {
+		return true
+	}
+
+	for _, s := range c.Sections {
+		if s == section {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SBAT implements Stub, returning the SBAT section of the stub if it has one.
+func (c *Custom) SBAT() ([]byte, error) {
+	return peSection(c.StubPath, string(constants.SBAT))
+}
+
+// peSection returns the contents of a PE section without the alignment padding, or nil if the file does not have it.
+func peSection(path, name string) ([]byte, error) {
+	f, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	section := f.Section(name)
+	if section == nil {
+		return nil, nil
+	}
+
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	if section.VirtualSize < uint32(len(data)) {
+		data = data[:section.VirtualSize]
+	}
+
+	return data, nil
+}
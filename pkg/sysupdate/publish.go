@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sysupdate
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// ChecksumsFile is the name of the file listing the digests of the published UKIs, next to them.
+const ChecksumsFile = "SHA256SUMS"
+
+// NewTransfer returns the transfer for a UKI published under its current name in the directory at url.
+//
+// The version is taken from the IMAGE_VERSION or VERSION_ID of its .osrel section, the entry token defaults
+// to its IMAGE_ID or ID like the install command does.
+func NewTransfer(ukiPath, url, token string) (*Transfer, error) {
+	data, err := uki.GetSection(ukiPath, constants.OSRel)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading os-release from %s: %w", ukiPath, err)
+	}
+
+	osRelease := utils.ParseOSRelease(data)
+
+	version := osRelease["IMAGE_VERSION"]
+	if version == "" {
+		version = osRelease["VERSION_ID"]
+	}
+
+	pattern, err := SourcePatternFor(filepath.Base(ukiPath), version)
+	if err != nil {
+		return nil, err
+	}
+
+	if token == "" {
+		token = osRelease["IMAGE_ID"]
+	}
+
+	if token == "" {
+		token = osRelease["ID"]
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("os-release in %s has no ID", ukiPath)
+	}
+
+	return &Transfer{SourceURL: url, SourcePattern: pattern, EntryToken: token}, nil
+}
+
+// AddChecksum adds the digest of the file to the SHA256SUMS next to it, replacing the previous digest of
+// the same name, so a directory can hold several versions.
+//
+// Returns the path of the SHA256SUMS file.
+func AddChecksum(path string) (string, error) {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", err
+	}
+
+	checksumsPath := filepath.Join(filepath.Dir(path), ChecksumsFile)
+
+	sums := map[string]string{}
+
+	existing, err := os.ReadFile(checksumsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(existing))
+	for scanner.Scan() {
+		sum, name, ok := strings.Cut(scanner.Text(), "  ")
+		if ok {
+			sums[name] = sum
+		}
+	}
+
+	sums[filepath.Base(path)] = digest
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var sb strings.Builder
+
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s  %s\n", sums[name], name)
+	}
+
+	return checksumsPath, utils.WriteFile(checksumsPath, []byte(sb.String()), 0o644)
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close() //nolint:errcheck
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
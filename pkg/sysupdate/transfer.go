@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sysupdate generates systemd-sysupdate transfer definitions for UKIs, see sysupdate.d(5).
+package sysupdate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// VersionPattern is the sysupdate match pattern placeholder for the version.
+const VersionPattern = "@v"
+
+// DefaultInstances is the number of UKI versions kept on the ESP when not given.
+const DefaultInstances = 2
+
+// Transfer is a transfer definition downloading UKIs published with their SHA256SUMS into EFI/Linux/ on the ESP.
+//
+// Installed UKIs are named `<entry-token>-<version>.efi`, as the install command does, so both can be mixed.
+type Transfer struct {
+	// URL of the directory the UKIs and SHA256SUMS are published in.
+	SourceURL string
+	// Name of the published UKIs, with @v in place of the version, i.e. kairos_@v.efi.
+	SourcePattern string
+	// Entry token prefixing the installed UKIs.
+	EntryToken string
+	// Number of boot counting tries given to new UKIs, boot counting is disabled when 0.
+	Tries int
+	// Number of versions kept on the ESP, DefaultInstances when 0.
+	Instances int
+}
+
+// SourcePatternFor returns the source pattern of a published UKI name by replacing the version in it with @v.
+func SourcePatternFor(name, version string) (string, error) {
+	if version == "" {
+		return "", errors.New("a version is required to publish UKIs for sysupdate")
+	}
+
+	if !strings.Contains(name, version) {
+		return "", fmt.Errorf("UKI name %s does not contain its version %s", name, version)
+	}
+
+	return strings.Replace(name, version, VersionPattern, 1), nil
+}
+
+// Marshal returns the transfer definition, to be installed in /etc/sysupdate.d/ as <name>.transfer.
+func (t *Transfer) Marshal() ([]byte, error) {
+	if t.SourceURL == "" || t.EntryToken == "" {
+		return nil, errors.New("a source URL and an entry token are required")
+	}
+
+	if !strings.Contains(t.SourcePattern, VersionPattern) {
+		return nil, fmt.Errorf("source pattern %q has no %s", t.SourcePattern, VersionPattern)
+	}
+
+	instances := t.Instances
+	if instances == 0 {
+		instances = DefaultInstances
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("[Transfer]\n")
+	// never remove the running version
+	sb.WriteString("ProtectVersion=%A\n")
+	// SHA256SUMS is signed with the SecureBoot key, not with GPG
+	sb.WriteString("Verify=no\n\n")
+
+	sb.WriteString("[Source]\n")
+	sb.WriteString("Type=url-file\n")
+	fmt.Fprintf(&sb, "Path=%s\n", strings.TrimSuffix(t.SourceURL, "/")+"/")
+	fmt.Fprintf(&sb, "MatchPattern=%s\n\n", t.SourcePattern)
+
+	sb.WriteString("[Target]\n")
+	sb.WriteString("Type=regular-file\n")
+	sb.WriteString("Path=/EFI/Linux\n")
+	sb.WriteString("PathRelativeTo=esp\n")
+
+	// renamed by systemd-boot while counting tries, so all the forms have to match
+	name := t.EntryToken + "-" + VersionPattern
+	fmt.Fprintf(&sb, "MatchPattern=%s+@l-@d.efi \\\n             %s+@l.efi \\\n             %s.efi\n", name, name, name)
+	sb.WriteString("Mode=0444\n")
+
+	if t.Tries > 0 {
+		fmt.Fprintf(&sb, "TriesLeft=%d\n", t.Tries)
+		sb.WriteString("TriesDone=0\n")
+	}
+
+	fmt.Fprintf(&sb, "InstancesMax=%d\n", instances)
+
+	return []byte(sb.String()), nil
+}
@@ -0,0 +1,71 @@
+package sysupdate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sysupdate test Suite")
+}
+
+var _ = Describe("Sysupdate tests", func() {
+	It("Writes the transfer matching the published and installed names", func() {
+		transfer := &Transfer{SourceURL: "https://example.com/uki", SourcePattern: "kairos_@v.efi", EntryToken: "kairos", Tries: 3}
+
+		data, err := transfer.Marshal()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`[Transfer]
+ProtectVersion=%A
+Verify=no
+
+[Source]
+Type=url-file
+Path=https://example.com/uki/
+MatchPattern=kairos_@v.efi
+
+[Target]
+Type=regular-file
+Path=/EFI/Linux
+PathRelativeTo=esp
+MatchPattern=kairos-@v+@l-@d.efi \
+             kairos-@v+@l.efi \
+             kairos-@v.efi
+Mode=0444
+TriesLeft=3
+TriesDone=0
+InstancesMax=2
+`))
+	})
+	It("Derives the source pattern from the UKI name", func() {
+		Expect(SourcePatternFor("kairos_1.2.3.efi", "1.2.3")).To(Equal("kairos_@v.efi"))
+		_, err := SourcePatternFor("uki.signed.efi", "1.2.3")
+		Expect(err).To(HaveOccurred())
+		_, err = SourcePatternFor("uki.signed.efi", "")
+		Expect(err).To(HaveOccurred())
+	})
+	It("Keeps the checksums of the other published versions", func() {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "kairos_1.efi"), []byte("1"), 0o644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "kairos_2.efi"), []byte("2"), 0o644)).To(Succeed())
+
+		_, err := AddChecksum(filepath.Join(dir, "kairos_2.efi"))
+		Expect(err).ToNot(HaveOccurred())
+		path, err := AddChecksum(filepath.Join(dir, "kairos_1.efi"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join(dir, ChecksumsFile)))
+
+		Expect(os.WriteFile(filepath.Join(dir, "kairos_1.efi"), []byte("3"), 0o644)).To(Succeed())
+		_, err = AddChecksum(filepath.Join(dir, "kairos_1.efi"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(os.ReadFile(path)).To(BeEquivalentTo(
+			"4e07408562bedb8b60ce05c1decfe3ad16b72230967de01f640b7e4729b49fce  kairos_1.efi\n" +
+				"d4735e3a265e16eee03f59718b9b5d03019c07d8b6c51f90da3a666eec13ab35  kairos_2.efi\n"))
+	})
+})
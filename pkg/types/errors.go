@@ -0,0 +1,96 @@
+package types
+
+import (
+	"errors"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+// Error categories, matched with errors.Is so callers like the CLI can tell failures apart.
+var (
+	// ErrInvalidInput is a missing or invalid input file, key or option.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrSigning is a failure while signing a PE file.
+	ErrSigning = errors.New("signing failed")
+	// ErrMeasurement is a failure while measuring sections or signing the PCR policy.
+	ErrMeasurement = errors.New("measurement failed")
+	// ErrVerification is a file that does not verify against the expected certificate.
+	ErrVerification = errors.New("verification failed")
+)
+
+// categorizedError attaches an error category without changing the error message.
+type categorizedError struct {
+	category error
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() []error {
+	return []error{e.category, e.err}
+}
+
+// WithCategory returns err so that it also matches category with errors.Is.
+// A nil err returns nil.
+func WithCategory(category, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &categorizedError{category: category, err: err}
+}
+
+// Stage is a step of the UKI build.
+type Stage string
+
+// Build stages, in the order they run.
+const (
+	StageGenerate   Stage = "generate"
+	StageMeasure    Stage = "measure"
+	StageAssemble   Stage = "assemble"
+	StageSignSdBoot Stage = "sign-sd-boot"
+	StageSign       Stage = "sign"
+)
+
+// BuildError is a failure of a build stage on a section or a file, found with errors.As.
+type BuildError struct {
+	// Stage failing.
+	Stage Stage
+	// Section being processed, empty for the stages working on whole files like signing.
+	Section constants.Section
+	// Path the section or the file is read from, empty for sections kept in memory.
+	Path string
+	// Err is the cause.
+	Err error
+}
+
+func (e *BuildError) Error() string {
+	msg := string(e.Stage)
+
+	if e.Section != "" {
+		msg += " section " + string(e.Section)
+	}
+
+	if e.Path != "" {
+		msg += " (" + e.Path + ")"
+	}
+
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// NewBuildError returns err with the stage, section and path it happened in, unless it has them already.
+// A nil err returns nil.
+func NewBuildError(stage Stage, section constants.Section, path string, err error) error {
+	var buildErr *BuildError
+	if err == nil || errors.As(err, &buildErr) {
+		return err
+	}
+
+	return &BuildError{Stage: stage, Section: section, Path: path, Err: err}
+}
@@ -0,0 +1,80 @@
+// Package v1 holds the version 1 of the PCR signature and prediction data written by go-ukify.
+//
+// The JSON encoding of these types is stable: within v1 fields are only ever added, never renamed,
+// removed or given another meaning, and readers must ignore the fields they do not know. A change
+// breaking that is released as a new version package instead. The JSON schemas of the types are
+// embedded, see Schema.
+//
+// PCRData is the systemd .pcrsig format, its fields follow the systemd one.
+package v1
+
+import "embed"
+
+// Version is the version of the types of this package.
+const Version = "v1"
+
+// PCRData is the data structure for PCR signature json.
+type PCRData struct {
+	SHA1   []BankData `json:"sha1,omitempty"`
+	SHA256 []BankData `json:"sha256,omitempty"`
+	SHA384 []BankData `json:"sha384,omitempty"`
+	SHA512 []BankData `json:"sha512,omitempty"`
+}
+
+// BankData constains data for a specific PCR bank.
+type BankData struct {
+	// list of PCR banks
+	PCRs []int `json:"pcrs"`
+	// Public key of the TPM
+	PKFP string `json:"pkfp"`
+	// Policy digest
+	Pol string `json:"pol"`
+	// Signature of the policy digest in base64
+	Sig string `json:"sig"`
+}
+
+// PCRMeasurement is the expected value of a PCR after a given phase has been measured.
+type PCRMeasurement struct {
+	// Phase after which the PCR has this value.
+	Phase string `json:"phase"`
+	// PCR number.
+	PCR int `json:"pcr"`
+	// Hash algorithm of the bank.
+	Algorithm string `json:"algorithm"`
+	// Expected PCR value in hex.
+	Digest string `json:"digest"`
+	// Build variant the value is expected for, i.e. recovery, empty for the main UKI.
+	Variant string `json:"variant,omitempty"`
+}
+
+// PCREvent is a single measurement extended into a PCR.
+type PCREvent struct {
+	// PCR number.
+	PCR int `json:"pcr"`
+	// Hash algorithm of the bank.
+	Algorithm string `json:"algorithm"`
+	// Digest extended into the PCR in hex.
+	Digest string `json:"digest"`
+	// What is being measured.
+	Description string `json:"description"`
+}
+
+// Names of the embedded JSON schemas.
+const (
+	SchemaPCRData        = "pcrdata"
+	SchemaPCRMeasurement = "pcrmeasurement"
+	SchemaPCREvent       = "pcrevent"
+)
+
+//go:embed schema/*.json
+var schemas embed.FS
+
+// Schema returns the JSON schema of the named type, nil if unknown.
+func Schema(name string) []byte {
+	data, err := schemas.ReadFile("schema/" + name + ".json")
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
@@ -0,0 +1,87 @@
+package v1_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	v1 "github.com/kairos-io/go-ukify/pkg/types/measurement/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Measurement types v1 test Suite")
+}
+
+// schemaProperties returns the properties and required properties of an object schema.
+func schemaProperties(schema map[string]any) ([]string, []string) {
+	var properties, required []string
+
+	for name := range schema["properties"].(map[string]any) {
+		properties = append(properties, name)
+	}
+
+	for _, name := range schema["required"].([]any) {
+		required = append(required, name.(string))
+	}
+
+	return properties, required
+}
+
+// fields returns the JSON field names of v.
+func fields(v any) []string {
+	data, err := json.Marshal(v)
+	Expect(err).ToNot(HaveOccurred())
+
+	var object map[string]any
+	Expect(json.Unmarshal(data, &object)).To(Succeed())
+
+	var names []string
+	for name := range object {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+var _ = Describe("Measurement types v1", func() {
+	It("Keeps the JSON encoding", func() {
+		data, err := json.Marshal(v1.PCRData{SHA256: []v1.BankData{{PCRs: []int{11}, PKFP: "aa", Pol: "bb", Sig: "cc"}}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"sha256":[{"pcrs":[11],"pkfp":"aa","pol":"bb","sig":"cc"}]}`))
+
+		data, err = json.Marshal(v1.PCRMeasurement{Phase: "enter-initrd", PCR: 11, Algorithm: "SHA-256", Digest: "dd"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"phase":"enter-initrd","pcr":11,"algorithm":"SHA-256","digest":"dd"}`))
+
+		data, err = json.Marshal(v1.PCREvent{PCR: 12, Algorithm: "SHA-256", Digest: "ee", Description: ".cmdline"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"pcr":12,"algorithm":"SHA-256","digest":"ee","description":".cmdline"}`))
+	})
+
+	It("Matches the embedded schemas", func() {
+		for name, value := range map[string]any{
+			v1.SchemaPCRMeasurement: v1.PCRMeasurement{Variant: "recovery"},
+			v1.SchemaPCREvent:       v1.PCREvent{},
+		} {
+			var schema map[string]any
+			Expect(json.Unmarshal(v1.Schema(name), &schema)).To(Succeed(), name)
+
+			properties, required := schemaProperties(schema)
+			Expect(fields(value)).To(ConsistOf(properties), name)
+			Expect(properties).To(ContainElements(required), name)
+		}
+
+		var schema map[string]any
+		Expect(json.Unmarshal(v1.Schema(v1.SchemaPCRData), &schema)).To(Succeed())
+
+		bank := schema["$defs"].(map[string]any)["bank"].(map[string]any)
+		properties, required := schemaProperties(bank)
+		Expect(fields(v1.BankData{})).To(ConsistOf(properties))
+		Expect(required).To(ConsistOf(properties))
+
+		Expect(v1.Schema("unknown")).To(BeNil())
+	})
+})
@@ -0,0 +1,48 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// SectionSource is the contents of a section read from memory or a stream instead of a file.
+//
+// Sections are read more than once, to measure and to assemble them, so the contents are read
+// at offsets and not consumed.
+type SectionSource struct {
+	// Reader of the contents.
+	io.ReaderAt
+	// Size of the contents in bytes.
+	Size int64
+}
+
+// NewSectionSource returns the source of the size bytes read from r.
+//
+// Readers which can't be read at an offset, like network streams, are read in memory once.
+func NewSectionSource(r io.Reader, size int64) (*SectionSource, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid section size %d", size)
+	}
+
+	if ra, ok := r.(io.ReaderAt); ok {
+		return &SectionSource{ReaderAt: ra, Size: size}, nil
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed reading section contents: %w", err)
+	}
+
+	return BytesSource(data), nil
+}
+
+// BytesSource returns the source of the data kept in memory.
+func BytesSource(data []byte) *SectionSource {
+	return &SectionSource{ReaderAt: bytes.NewReader(data), Size: int64(len(data))}
+}
+
+// Open returns a reader of the contents from their start.
+func (s *SectionSource) Open() *io.SectionReader {
+	return io.NewSectionReader(s.ReaderAt, 0, s.Size)
+}
@@ -7,27 +7,21 @@ import (
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	v1 "github.com/kairos-io/go-ukify/pkg/types/measurement/v1"
 )
 
-// PCRData is the data structure for PCR signature json.
-type PCRData struct {
-	SHA1   []BankData `json:"sha1,omitempty"`
-	SHA256 []BankData `json:"sha256,omitempty"`
-	SHA384 []BankData `json:"sha384,omitempty"`
-	SHA512 []BankData `json:"sha512,omitempty"`
-}
-
-// BankData constains data for a specific PCR bank.
-type BankData struct {
-	// list of PCR banks
-	PCRs []int `json:"pcrs"`
-	// Public key of the TPM
-	PKFP string `json:"pkfp"`
-	// Policy digest
-	Pol string `json:"pol"`
-	// Signature of the policy digest in base64
-	Sig string `json:"sig"`
-}
+// The PCR signature and prediction types, kept as aliases of the versioned ones.
+type (
+	// PCRData is the data structure for PCR signature json, see v1.PCRData.
+	PCRData = v1.PCRData
+	// BankData constains data for a specific PCR bank, see v1.BankData.
+	BankData = v1.BankData
+	// PCRMeasurement is the expected value of a PCR after a given phase, see v1.PCRMeasurement.
+	PCRMeasurement = v1.PCRMeasurement
+	// PCREvent is a single measurement extended into a PCR, see v1.PCREvent.
+	PCREvent = v1.PCREvent
+)
 
 type Algorithm struct {
 	Alg            tpm2.TPMAlgID
@@ -54,6 +48,12 @@ func GetTPMALGorithm() (*PCRData, []Algorithm) {
 			BankDataSetter: &data.SHA512,
 		},
 	}
+
+	// SHA-1 is not approved in FIPS mode, the bank is left out
+	if fips.Enabled() {
+		algs = algs[1:]
+	}
+
 	return data, algs
 }
 
@@ -99,12 +99,28 @@ func PhasesToString(s []PhaseInfo) string {
 	return strings.Join(data, ":")
 }
 
+// PhasesFromString parses a list of phases separated by colons, in order of measurement.
+// An empty string returns no phases.
+func PhasesFromString(s string) []PhaseInfo {
+	if s == "" {
+		return nil
+	}
+
+	var phases []PhaseInfo
+	for _, phase := range strings.Split(s, ":") {
+		phases = append(phases, PhaseInfo{Phase: constants.Phase(phase)})
+	}
+	return phases
+}
+
 // UkiSection is a UKI file section.
 type UkiSection struct {
 	// Section name.
 	Name constants.Section
 	// Path to the contents of the section.
 	Path string
+	// Contents of the section read instead of Path when not nil, i.e. kept in memory.
+	Source *SectionSource
 	// Should the section be measured to the TPM?
 	Measure bool
 	// Should the section be appended, or is it already in the PE file.
@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// AddonBuilder builds systemd-stub addons.
+//
+// Addons are PE files built out of the addon stub that carry extra cmdline, devicetree or initrd
+// sections, which systemd-stub picks up from `<uki>.extra.d/` or `loader/addons/` and
+// measures into PCR 12.
+type AddonBuilder struct {
+	// Path to the addon stub, i.e. addonx64.efi.stub.
+	AddonStubPath string
+	// Kernel cmdline to append.
+	Cmdline string
+	// Path to the devicetree blob.
+	DTBPath string
+	// Contents of an initrd passed to the kernel after the one of the UKI, i.e. part of an initrd split
+	// out of the UKI, see Builder.MaxInitrdSize.
+	Initrd *types.SectionSource
+
+	// SecureBoot certificate and signer.
+	SecureBootSigner *pesign.Signer
+	// SecureBoot key
+	SBKey string
+	// SecureBoot cert
+	SBCert string
+	// Called to obtain the passphrase of encrypted keys
+	Passphrase pesign.PassphraseFunc
+
+	// Path to the output addon file.
+	OutPath string
+
+	// Logger of the build messages, slog.Default() when nil.
+	Logger *slog.Logger
+
+	// fields initialized during build
+	sections     []types.UkiSection
+	scratchDir   string
+	measurements []types.PCREvent
+}
+
+// Build the addon file.
+func (addon *AddonBuilder) Build() error {
+	var err error
+
+	if addon.Cmdline == "" && addon.DTBPath == "" && addon.Initrd == nil {
+		return types.WithCategory(types.ErrInvalidInput, errors.New("addon needs at least a cmdline, a devicetree or an initrd"))
+	}
+
+	if addon.SecureBootSigner == nil && addon.SBCert != "" && addon.SBKey != "" {
+		sb, err := pesign.NewSecureBootSignerWithPassphrase(addon.SBCert, addon.SBKey, addon.Passphrase)
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+		addon.SecureBootSigner, err = pesign.NewSigner(sb)
+		if err != nil {
+			return err
+		}
+		addon.SecureBootSigner.Logger = addon.Logger
+	}
+
+	addon.scratchDir, err = os.MkdirTemp("", "ukify-addon")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err = os.RemoveAll(addon.scratchDir); err != nil {
+			addon.log().Warn("Failed to remove scratch dir", "path", addon.scratchDir, "error", err)
+		}
+	}()
+
+	addon.sections = nil
+
+	if addon.Cmdline != "" {
+		addon.log().Debug("Using addon cmdline", "cmdline", addon.Cmdline)
+		path := filepath.Join(addon.scratchDir, "cmdline")
+
+		if err = os.WriteFile(path, []byte(addon.Cmdline), 0o600); err != nil {
+			return err
+		}
+
+		addon.sections = append(addon.sections, types.UkiSection{
+			Name:    constants.CMDLine,
+			Path:    path,
+			Measure: true,
+			Append:  true,
+		})
+	}
+
+	if addon.DTBPath != "" {
+		addon.log().Debug("Using addon devicetree", "path", addon.DTBPath)
+		addon.sections = append(addon.sections, types.UkiSection{
+			Name:    constants.DTB,
+			Path:    addon.DTBPath,
+			Measure: true,
+			Append:  true,
+		})
+	}
+
+	if addon.Initrd != nil {
+		addon.log().Debug("Using addon initrd", "size", addon.Initrd.Size)
+		addon.sections = append(addon.sections, types.UkiSection{
+			Name:    constants.Initrd,
+			Source:  addon.Initrd,
+			Measure: true,
+			Append:  true,
+		})
+	}
+
+	addon.measurements, err = measure.CalculateAddonMeasurements(utils.SectionsData(addon.sections),
+		measure.WithContents(utils.SectionsContents(addon.sections)))
+	if err != nil {
+		return types.WithCategory(types.ErrMeasurement, fmt.Errorf("error measuring addon: %w", err))
+	}
+
+	unsignedPath := filepath.Join(addon.scratchDir, "unsigned.addon")
+
+	digest, err := assemblePE(addon.log(), addon.AddonStubPath, addon.sections, unsignedPath)
+	if err != nil {
+		return fmt.Errorf("error assembling addon: %w", err)
+	}
+
+	if addon.SecureBootSigner != nil {
+		addon.log().Info("Signing addon")
+		if _, err = addon.SecureBootSigner.SignDigested(unsignedPath, addon.OutPath, digest); err != nil {
+			return types.WithCategory(types.ErrSigning, fmt.Errorf("error signing addon: %w", err))
+		}
+		addon.log().Info("Signed addon", "path", addon.OutPath)
+
+		return nil
+	}
+
+	if err = utils.Publish(unsignedPath, addon.OutPath, 0o644); err != nil {
+		return err
+	}
+
+	addon.log().Info("Unsigned addon", "path", addon.OutPath)
+
+	return nil
+}
+
+// log returns the logger of the build messages.
+func (addon *AddonBuilder) log() *slog.Logger {
+	if addon.Logger == nil {
+		return slog.Default()
+	}
+
+	return addon.Logger
+}
+
+// Measurements returns the events the addon contributes to PCR 12 when loaded by systemd-stub.
+func (addon *AddonBuilder) Measurements() []types.PCREvent {
+	return addon.measurements
+}
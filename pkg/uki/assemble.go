@@ -5,23 +5,73 @@
 package uki
 
 import (
+	"bufio"
+	"bytes"
 	"debug/pe"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// PE layout offsets, from the PE format specification.
+const (
+	peHeaderOffset     = 0x3c
+	coffHeaderSize     = 20
+	sectionHeaderSize  = 40
+	optSizeOfCode      = 4
+	optSizeOfData      = 8
+	optSizeOfImage     = 56
+	optSizeOfHeaders   = 60
+	optCheckSum        = 64
+	optDataDirectories = 112
+	debugEntrySize     = 28
+)
+
+// Section flags of the appended sections, initialized read only data and, for .linux, code.
+const (
+	sectionFlagsData = pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ
+	sectionFlagsCode = pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE | pe.IMAGE_SCN_MEM_READ
 )
 
 // assemble the UKI file out of sections.
 func (builder *Builder) assemble() error {
-	peFile, err := pe.Open(builder.SdStubPath)
+	if builder.unsignedUKIPath == "" {
+		builder.unsignedUKIPath = filepath.Join(builder.scratchDir, "unsigned.uki")
+	}
+
+	digest, err := assemblePE(builder.log(), builder.stub.Path(), builder.sections, builder.unsignedUKIPath)
+	builder.unsignedDigest = digest
+
+	return err
+}
+
+// assemblePE appends the sections to the stub PE file and writes the result to output.
+//
+// Only the stub is read in memory, the sections not kept in memory already are streamed from their paths
+// into the output, so large kernels and initrds are read once and never copied around. Stub sections with
+// the same name as an appended one, like a merged .sbat, are replaced.
+//
+// Size and VMA of the appended sections are filled in. The Authenticode digest of the file is computed
+// in the same pass and returned, for signing it without reading it again, nil if the layout does not allow it.
+func assemblePE(logger *slog.Logger, stubPath string, sections []types.UkiSection, output string) ([]byte, error) {
+	image, err := os.ReadFile(stubPath)
 	if err != nil {
-		return err
+		return nil, types.NewBuildError(StageAssemble, "", stubPath, err)
 	}
 
-	defer peFile.Close() //nolint: errcheck
+	peFile, err := pe.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return nil, types.NewBuildError(StageAssemble, "", stubPath, fmt.Errorf("failed parsing stub: %w", err))
+	}
 
 	// find the first VMA address
 	lastSection := peFile.Sections[len(peFile.Sections)-1]
@@ -32,55 +82,504 @@ func (builder *Builder) assemble() error {
 
 	header, ok := peFile.OptionalHeader.(*pe.OptionalHeader64)
 	if !ok {
-		return errors.New("failed to get optional header")
+		return nil, types.NewBuildError(StageAssemble, "", stubPath, errors.New("failed to get optional header"))
 	}
 
 	baseVMA := header.ImageBase + uint64(lastSection.VirtualAddress) + uint64(lastSection.VirtualSize)
 	baseVMA = (baseVMA + alignment) &^ alignment
 
 	// calculate sections size and VMA
-	for i := range builder.sections {
-		if !builder.sections[i].Append {
+	replaced := map[string]bool{}
+
+	var appended []*types.UkiSection
+
+	for i := range sections {
+		if !sections[i].Append {
 			continue
 		}
 
-		st, err := os.Stat(builder.sections[i].Path)
+		size, err := sectionSize(&sections[i])
 		if err != nil {
-			return err
+			return nil, types.NewBuildError(StageAssemble, sections[i].Name, sections[i].Path, err)
 		}
 
-		builder.sections[i].Size = uint64(st.Size())
-		builder.sections[i].VMA = baseVMA
+		sections[i].Size = uint64(size)
+		sections[i].VMA = baseVMA
 
-		baseVMA += builder.sections[i].Size
+		baseVMA += sections[i].Size
 		baseVMA = (baseVMA + alignment) &^ alignment
+
+		replaced[string(sections[i].Name)] = true
+		appended = append(appended, &sections[i])
+	}
+
+	layout, err := newPELayout(image, header, replaced)
+	if err != nil {
+		return nil, types.NewBuildError(StageAssemble, "", stubPath, fmt.Errorf("failed laying out the stub: %w", err))
+	}
+
+	for _, section := range appended {
+		if err = layout.appendSection(section, header.ImageBase); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Debug("Assembling", "stub", stubPath, "sections", len(layout.headers), "output", output)
+
+	return layout.write(image, header, output)
+}
+
+// stripPE writes the PE file at path to output without the removed sections. The certificate table
+// is not part of any section, so the signatures are left out too.
+func stripPE(path string, removed map[string]bool, output string) error {
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	peFile, err := pe.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return fmt.Errorf("failed parsing PE file: %w", err)
+	}
+
+	header, ok := peFile.OptionalHeader.(*pe.OptionalHeader64)
+	if !ok {
+		return errors.New("failed to get optional header")
+	}
+
+	layout, err := newPELayout(image, header, removed)
+	if err != nil {
+		return fmt.Errorf("failed laying out the PE file: %w", err)
+	}
+
+	_, err = layout.write(image, header, output)
+
+	return err
+}
+
+// peSectionHeader is a section table entry, and where its data comes from.
+type peSectionHeader struct {
+	pe.SectionHeader32
+
+	// offset of the data in the stub, for the stub sections
+	stubOffset uint32
+	// appended section, for the others
+	source *types.UkiSection
+}
+
+// peLayout is the layout of an assembled PE file: the stub headers and kept sections, followed by the
+// appended sections.
+type peLayout struct {
+	headers []peSectionHeader
+
+	optOffset     int
+	tableOffset   int
+	fileAlignment uint32
+	sizeOfImage   uint32
+}
+
+// newPELayout lays out the stub sections not replaced, moving their data after the grown section table.
+func newPELayout(image []byte, header *pe.OptionalHeader64, replaced map[string]bool) (*peLayout, error) {
+	if len(image) < peHeaderOffset+4 {
+		return nil, errors.New("file is too short")
+	}
+
+	coffOffset := int(binary.LittleEndian.Uint32(image[peHeaderOffset:])) + 4
+	if coffOffset+coffHeaderSize > len(image) {
+		return nil, errors.New("file is too short")
+	}
+
+	count := int(binary.LittleEndian.Uint16(image[coffOffset+2:]))
+	optOffset := coffOffset + coffHeaderSize
+	tableOffset := optOffset + int(binary.LittleEndian.Uint16(image[coffOffset+16:]))
+
+	if tableOffset+count*sectionHeaderSize > len(image) {
+		return nil, errors.New("section table is truncated")
+	}
+
+	layout := &peLayout{
+		optOffset:     optOffset,
+		tableOffset:   tableOffset,
+		fileAlignment: header.FileAlignment,
+	}
+
+	for i := range count {
+		var section pe.SectionHeader32
+		if err := binary.Read(bytes.NewReader(image[tableOffset+i*sectionHeaderSize:]), binary.LittleEndian, &section); err != nil {
+			return nil, err
+		}
+
+		if replaced[sectionName(section.Name)] {
+			continue
+		}
+
+		if uint64(section.PointerToRawData)+uint64(section.SizeOfRawData) > uint64(len(image)) {
+			return nil, fmt.Errorf("section %s is truncated", sectionName(section.Name))
+		}
+
+		layout.headers = append(layout.headers, peSectionHeader{SectionHeader32: section, stubOffset: section.PointerToRawData})
+		layout.grow(section.VirtualAddress + section.VirtualSize)
+	}
+
+	return layout, nil
+}
+
+// appendSection adds a section after the ones already laid out, empty sections are left out like objcopy does.
+func (layout *peLayout) appendSection(section *types.UkiSection, imageBase uint64) error {
+	if section.Size == 0 {
+		return nil
+	}
+
+	if len(section.Name) > len(pe.SectionHeader32{}.Name) {
+		return types.NewBuildError(StageAssemble, section.Name, section.Path, errors.New("section name is too long"))
+	}
+
+	header := peSectionHeader{source: section}
+	copy(header.Name[:], section.Name)
+	header.VirtualSize = uint32(section.Size)
+	header.VirtualAddress = uint32(section.VMA - imageBase)
+	header.SizeOfRawData = layout.align(uint32(section.Size))
+	header.Characteristics = sectionFlagsData
+
+	if section.Name == constants.Linux {
+		// Set the section flag to CODE for .linux not usre if this does anything?
+		header.Characteristics = sectionFlagsCode
+	}
+
+	layout.headers = append(layout.headers, header)
+	layout.grow(header.VirtualAddress + header.VirtualSize)
+
+	return nil
+}
+
+// grow extends the image size to hold a section ending at end.
+func (layout *peLayout) grow(end uint32) {
+	layout.sizeOfImage = max(layout.sizeOfImage, end)
+}
+
+func (layout *peLayout) align(size uint32) uint32 {
+	return (size + layout.fileAlignment - 1) &^ (layout.fileAlignment - 1)
+}
+
+// place assigns the file offsets of the section data, once the size of the section table is known.
+//
+// It returns the size of the headers.
+func (layout *peLayout) place() (uint32, error) {
+	sizeOfHeaders := layout.align(uint32(layout.tableOffset + len(layout.headers)*sectionHeaderSize))
+
+	for _, header := range layout.headers {
+		if header.VirtualSize > 0 && header.VirtualAddress < sizeOfHeaders {
+			return 0, fmt.Errorf("no room in the headers for %d sections", len(layout.headers))
+		}
+	}
+
+	offset := sizeOfHeaders
+
+	for i := range layout.headers {
+		if layout.headers[i].SizeOfRawData == 0 {
+			layout.headers[i].PointerToRawData = 0
+
+			continue
+		}
+
+		layout.headers[i].PointerToRawData = offset
+		offset += layout.align(layout.headers[i].SizeOfRawData)
+	}
+
+	return sizeOfHeaders, nil
+}
+
+// stubOffset translates an offset in the stub file to the assembled one, 0 if it is not in a kept section.
+func (layout *peLayout) stubOffset(offset uint32) uint32 {
+	for _, header := range layout.headers {
+		if header.source == nil && offset >= header.stubOffset && offset < header.stubOffset+header.SizeOfRawData {
+			return header.PointerToRawData + offset - header.stubOffset
+		}
+	}
+
+	return 0
+}
+
+// headerBytes returns the updated stub headers, followed by the section table.
+func (layout *peLayout) headerBytes(image []byte, sectionAlignment, sizeOfHeaders uint32) ([]byte, error) {
+	headers := make([]byte, sizeOfHeaders)
+	copy(headers, image[:layout.tableOffset])
+
+	coffOffset := layout.optOffset - coffHeaderSize
+	binary.LittleEndian.PutUint16(headers[coffOffset+2:], uint16(len(layout.headers)))
+	// stubs are stripped, a symbol table would not be copied
+	binary.LittleEndian.PutUint32(headers[coffOffset+8:], 0)
+	binary.LittleEndian.PutUint32(headers[coffOffset+12:], 0)
+
+	var sizeOfCode, sizeOfData uint32
+
+	for _, header := range layout.headers {
+		if header.Characteristics&pe.IMAGE_SCN_CNT_CODE != 0 {
+			sizeOfCode += layout.align(header.SizeOfRawData)
+		}
+
+		if header.Characteristics&pe.IMAGE_SCN_CNT_INITIALIZED_DATA != 0 {
+			sizeOfData += layout.align(header.SizeOfRawData)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(headers[layout.optOffset+optSizeOfCode:], sizeOfCode)
+	binary.LittleEndian.PutUint32(headers[layout.optOffset+optSizeOfData:], sizeOfData)
+
+	sizeOfImage := (layout.sizeOfImage + sectionAlignment - 1) &^ (sectionAlignment - 1)
+	binary.LittleEndian.PutUint32(headers[layout.optOffset+optSizeOfImage:], sizeOfImage)
+	binary.LittleEndian.PutUint32(headers[layout.optOffset+optSizeOfHeaders:], sizeOfHeaders)
+	// written once the whole file is known
+	binary.LittleEndian.PutUint32(headers[layout.optOffset+optCheckSum:], 0)
+
+	// a stub signature does not cover the UKI
+	if security := layout.optOffset + optDataDirectories + pe.IMAGE_DIRECTORY_ENTRY_SECURITY*8; security+8 <= layout.tableOffset {
+		clear(headers[security : security+8])
 	}
 
-	// create the output file
-	args := []string{}
+	table := bytes.NewBuffer(headers[layout.tableOffset:layout.tableOffset])
+
+	for _, header := range layout.headers {
+		if err := binary.Write(table, binary.LittleEndian, header.SectionHeader32); err != nil {
+			return nil, err
+		}
+	}
 
-	for _, section := range builder.sections {
-		if !section.Append {
+	return headers, nil
+}
+
+// relocateDebugDirectory updates the file offsets of the stub debug directory entries to the moved sections.
+func (layout *peLayout) relocateDebugDirectory(image []byte, header *pe.OptionalHeader64) {
+	if len(header.DataDirectory) <= pe.IMAGE_DIRECTORY_ENTRY_DEBUG {
+		return
+	}
+
+	directory := header.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_DEBUG]
+	if directory.Size == 0 {
+		return
+	}
+
+	for _, section := range layout.headers {
+		if section.source != nil || directory.VirtualAddress < section.VirtualAddress ||
+			directory.VirtualAddress+directory.Size > section.VirtualAddress+section.SizeOfRawData {
 			continue
 		}
 
-		args = append(args, "--add-section", fmt.Sprintf("%s=%s", section.Name, section.Path), "--change-section-vma", fmt.Sprintf("%s=0x%x", section.Name, section.VMA))
+		start := section.stubOffset + directory.VirtualAddress - section.VirtualAddress
+
+		for entry := start; entry+debugEntrySize <= start+directory.Size; entry += debugEntrySize {
+			pointer := image[entry+24 : entry+28]
+			binary.LittleEndian.PutUint32(pointer, layout.stubOffset(binary.LittleEndian.Uint32(pointer)))
+		}
+
+		return
+	}
+}
+
+// write streams the headers, the stub sections and the appended sections to output, hashing them on the way.
+func (layout *peLayout) write(image []byte, header *pe.OptionalHeader64, output string) ([]byte, error) {
+	sizeOfHeaders, err := layout.place()
+	if err != nil {
+		return nil, err
+	}
+
+	layout.relocateDebugDirectory(image, header)
+
+	headers, err := layout.headerBytes(image, header.SectionAlignment, sizeOfHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	// in the scratch dir, kept private until published with the output mode
+	f, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	digester := pesign.NewDigester(int64(layout.optOffset))
+
+	buffered := bufio.NewWriterSize(f, utils.StreamBufferSize())
+	w := &peChecksum{w: io.MultiWriter(buffered, digester)}
+
+	if _, err = w.Write(headers); err != nil {
+		return nil, err
+	}
+
+	for _, section := range layout.headers {
+		if section.SizeOfRawData == 0 {
+			continue
+		}
+
+		size := section.SizeOfRawData
+
+		if section.source != nil {
+			size = section.VirtualSize
+			err = copySection(w, section.source)
+		} else {
+			_, err = w.Write(image[section.stubOffset : section.stubOffset+size])
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = w.pad(layout.align(section.SizeOfRawData) - size); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = buffered.Flush(); err != nil {
+		return nil, err
+	}
+
+	// left out of the Authenticode digest
+	checksum := binary.LittleEndian.AppendUint32(nil, w.sum())
+	if _, err = f.WriteAt(checksum, int64(layout.optOffset+optCheckSum)); err != nil {
+		return nil, err
+	}
+
+	if err = utils.DoneWith(f, true); err != nil {
+		return nil, err
+	}
+
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+
+	if !layout.contiguous() {
+		return nil, nil
+	}
+
+	return digester.Digest(), nil
+}
+
+// contiguous reports whether the section data follows the headers without gaps, the Authenticode digest
+// then hashes the file front to back.
+func (layout *peLayout) contiguous() bool {
+	for _, header := range layout.headers {
+		if header.SizeOfRawData != layout.align(header.SizeOfRawData) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sectionSize returns the size of the section contents.
+func sectionSize(section *types.UkiSection) (int64, error) {
+	if section.Source != nil {
+		return section.Source.Size, nil
 	}
 
-	// Set the section flag to CODE for .linux not usre if this does anything?
-	args = append(args, "--set-section-flags", ".linux=code,readonly")
+	st, err := os.Stat(section.Path)
+	if err != nil {
+		return 0, err
+	}
 
-	builder.unsignedUKIPath = filepath.Join(builder.scratchDir, "unsigned.uki")
+	return st.Size(), nil
+}
 
-	args = append(args, builder.SdStubPath, builder.unsignedUKIPath)
+// copySection streams the section data, padded to its raw size.
+func copySection(w *peChecksum, section *types.UkiSection) error {
+	var (
+		n   int64
+		err error
+	)
 
-	objcopy := "objcopy"
+	if section.Source != nil {
+		n, err = utils.Copy(w, section.Source.Open())
+	} else {
+		n, err = copySectionFile(w, section.Path)
+	}
+
+	if err != nil {
+		return types.NewBuildError(StageAssemble, section.Name, section.Path, fmt.Errorf("failed copying section: %w", err))
+	}
 
-	slog.Debug("Assembling", "args", args)
+	if uint64(n) != section.Size {
+		return types.NewBuildError(StageAssemble, section.Name, section.Path, errors.New("section changed size while assembling"))
+	}
+
+	return nil
+}
+
+// copySectionFile streams the file, dropping it from the page cache afterwards if asked to.
+func copySectionFile(w io.Writer, path string) (int64, error) {
+	f, err := utils.OpenSequential(path)
+	if err != nil {
+		return 0, err
+	}
 
-	cmd := exec.Command(objcopy, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	defer f.Close() //nolint:errcheck
+
+	n, err := utils.Copy(w, f)
+	if err != nil {
+		return n, err
+	}
+
+	return n, utils.DoneWith(f, false)
+}
+
+func sectionName(name [8]uint8) string {
+	return string(bytes.TrimRight(name[:], "\x00"))
+}
+
+// peChecksum computes the PE checksum of the data written through it.
+//
+// The checksum is the 16 bits one's complement sum of the file, with the checksum field zeroed,
+// plus the file size.
+type peChecksum struct {
+	w     io.Writer
+	total uint64
+	size  int64
+	// low byte of a word split across writes
+	low *byte
+}
+
+func (c *peChecksum) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+
+	data := p[:n]
+	c.size += int64(n)
+
+	if c.low != nil && len(data) > 0 {
+		c.total += uint64(*c.low) | uint64(data[0])<<8
+		c.low = nil
+		data = data[1:]
+	}
+
+	for len(data) >= 2 {
+		c.total += uint64(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+	}
+
+	if len(data) == 1 {
+		low := data[0]
+		c.low = &low
+	}
+
+	return n, err
+}
+
+// pad writes n zero bytes.
+func (c *peChecksum) pad(n uint32) error {
+	_, err := c.Write(make([]byte, n))
+
+	return err
+}
+
+// sum returns the checksum of the data written so far.
+func (c *peChecksum) sum() uint32 {
+	total := c.total
+	if c.low != nil {
+		total += uint64(*c.low)
+	}
+
+	for total > 0xffff {
+		total = (total & 0xffff) + (total >> 16)
+	}
 
-	return cmd.Run()
+	return uint32(total) + uint32(c.size)
 }
@@ -0,0 +1,784 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"gopkg.in/yaml.v3"
+
+	"github.com/kairos-io/go-ukify/pkg/cmdline"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/oci"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/rekor"
+	"github.com/kairos-io/go-ukify/pkg/stub"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Manifest describes a set of UKIs to build in a single run.
+//
+// Every entry in Builds is merged on top of Defaults, so shared options like the
+// stub and signing keys only need to be given once.
+type Manifest struct {
+	// Number of builds to run in parallel, defaults to 1.
+	Jobs int `yaml:"jobs,omitempty"`
+	// Bound on the size of the inputs of the builds running at once, i.e. 8G, unlimited if empty.
+	MemoryLimit string `yaml:"memory-limit,omitempty"`
+	// URL the build events are posted to when each build finishes, see Webhook. Its secret is not
+	// part of the manifest.
+	Webhook string `yaml:"webhook,omitempty"`
+	// Options applied to every build.
+	Defaults BuildConfig `yaml:"defaults,omitempty"`
+	// List of UKIs to build.
+	Builds []BuildConfig `yaml:"builds"`
+}
+
+// BuildConfig holds the options for a single UKI build, mirroring the create command flags.
+type BuildConfig struct {
+	Name          string `yaml:"name,omitempty"`
+	Arch          string `yaml:"arch,omitempty"`
+	Version       string `yaml:"version,omitempty"`
+	SdStubPath    string `yaml:"sd-stub-path,omitempty"`
+	SdStubSHA256  string `yaml:"sd-stub-sha256,omitempty"`
+	SdBootPath    string `yaml:"sd-boot-path,omitempty"`
+	KernelPath    string `yaml:"kernel,omitempty"`
+	InitrdPath    string `yaml:"initrd,omitempty"`
+	Uname         string `yaml:"uname,omitempty"`
+	UnamePath     string `yaml:"uname-path,omitempty"`
+	Cmdline       string `yaml:"cmdline,omitempty"`
+	OsRelease     string `yaml:"os-release,omitempty"`
+	Splash        string `yaml:"splash,omitempty"`
+	Firmware      string `yaml:"efifw,omitempty"`
+	Phases        string `yaml:"phases,omitempty"`
+	SBKey         string `yaml:"sb-key,omitempty"`
+	SBCert        string `yaml:"sb-cert,omitempty"`
+	PCRKey        string `yaml:"pcr-key,omitempty"`
+	OutSdBootPath string `yaml:"output-sdboot,omitempty"`
+	OutUKIPath    string `yaml:"output-uki,omitempty"`
+	OutChecksums  string `yaml:"output-checksums,omitempty"`
+	OutBundle     string `yaml:"output-bundle,omitempty"`
+	OutSBOM       string `yaml:"output-sbom,omitempty"`
+	Dbx           string `yaml:"dbx,omitempty"`
+	SBATPolicy    string `yaml:"sbat-policy,omitempty"`
+	BuildCache    string `yaml:"build-cache,omitempty"`
+	// Whether a missing or invalid splash falls back to the bundled logo.
+	SplashFallback bool `yaml:"splash-fallback,omitempty"`
+	// Size budget of the splash, i.e. 512K, see Builder.SplashMaxSize.
+	SplashMaxSize string `yaml:"splash-max-size,omitempty"`
+	// Whether the splash is rendered with the name, version and build date, see Builder.SplashText.
+	SplashText bool `yaml:"splash-text,omitempty"`
+	// Whether signing with key files is refused, see Builder.RequireHardwareKeys.
+	RequireHardwareKeys bool `yaml:"require-hardware-keys,omitempty"`
+	// URL of the transparency log the SecureBoot signatures are submitted to, see Builder.TransparencyLog.
+	TransparencyLog string `yaml:"transparency-log,omitempty"`
+	// Public key of the transparency log, see Builder.TransparencyLogKey.
+	TransparencyLogKey string `yaml:"transparency-log-key,omitempty"`
+	// Kernel signature mode, record or require, and the CAs a required signature must chain to.
+	KernelSignature string   `yaml:"kernel-signature,omitempty"`
+	KernelCAs       []string `yaml:"kernel-cas,omitempty"`
+	// Whether the kernel is described in the result, see Builder.KernelReport.
+	KernelReport bool `yaml:"kernel-report,omitempty"`
+	// System and configuration extension images placed next to the UKI.
+	Extensions []string `yaml:"extensions,omitempty"`
+	// Size the embedded initrd is limited to, i.e. 512M, and the addon stub the rest is split into
+	// addons with, see Builder.MaxInitrdSize.
+	MaxInitrdSize string `yaml:"max-initrd-size,omitempty"`
+	AddonStubPath string `yaml:"addon-stub-path,omitempty"`
+	// Conventions of the UKI, i.e. talos.
+	Profile string `yaml:"profile,omitempty"`
+	// SBOM format, cyclonedx or spdx, and whether it is embedded as a .sbom section.
+	SBOMFormat string `yaml:"sbom-format,omitempty"`
+	EmbedSBOM  bool   `yaml:"embed-sbom,omitempty"`
+	// Octal mode, i.e. 0640, and user[:group] owner of the outputs, see Builder.OutputMode.
+	OutputMode  string `yaml:"output-mode,omitempty"`
+	OutputOwner string `yaml:"output-owner,omitempty"`
+	// Identity options.
+	OSName         string `yaml:"os-name,omitempty"`
+	OSID           string `yaml:"os-id,omitempty"`
+	OSURL          string `yaml:"os-url,omitempty"`
+	SBATVendor     string `yaml:"sbat-vendor,omitempty"`
+	SBATGeneration int    `yaml:"sbat-generation,omitempty"`
+	// Generation and vendor overrides of SBAT components, by component name.
+	SBATGenerations map[string]int    `yaml:"sbat-generations,omitempty"`
+	SBATVendors     map[string]string `yaml:"sbat-vendors,omitempty"`
+	// Severity of the cmdline rules by rule name, see Builder.CmdlineLint.
+	CmdlineLint map[string]cmdline.Severity `yaml:"cmdline-lint,omitempty"`
+	// Recovery UKI options.
+	RecoveryCmdline string `yaml:"recovery-cmdline,omitempty"`
+	RecoveryInitrd  string `yaml:"recovery-initrd,omitempty"`
+	RecoverySplash  string `yaml:"recovery-splash,omitempty"`
+	OutRecoveryUKI  string `yaml:"output-recovery-uki,omitempty"`
+}
+
+// LoadManifest reads a manifest file.
+//
+// Relative paths in the manifest are resolved against the manifest directory.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+
+	if err = yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed parsing manifest %s: %w", path, err)
+	}
+
+	if len(manifest.Builds) == 0 {
+		return nil, fmt.Errorf("manifest %s has no builds", path)
+	}
+
+	dir := filepath.Dir(path)
+
+	manifest.Defaults.resolvePaths(dir)
+
+	for i := range manifest.Builds {
+		manifest.Builds[i].resolvePaths(dir)
+	}
+
+	return &manifest, nil
+}
+
+// resolvePaths makes all relative paths in the config relative to dir.
+func (c *BuildConfig) resolvePaths(dir string) {
+	for _, p := range []*string{
+		&c.SdStubPath, &c.SdBootPath, &c.KernelPath, &c.InitrdPath, &c.OsRelease, &c.Splash,
+		&c.Firmware, &c.SBKey, &c.SBCert, &c.PCRKey, &c.OutSdBootPath, &c.OutUKIPath, &c.OutChecksums, &c.OutBundle,
+		&c.OutSBOM, &c.RecoveryInitrd, &c.RecoverySplash, &c.OutRecoveryUKI, &c.BuildCache, &c.UnamePath, &c.AddonStubPath,
+		&c.TransparencyLogKey,
+	} {
+		if *p != "" && !filepath.IsAbs(*p) && !stub.IsURL(*p) && !oci.IsImagePath(*p) && *p != stub.Auto {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+
+	for i, ca := range c.KernelCAs {
+		if !filepath.IsAbs(ca) {
+			c.KernelCAs[i] = filepath.Join(dir, ca)
+		}
+	}
+
+	for i, extension := range c.Extensions {
+		if !filepath.IsAbs(extension) {
+			c.Extensions[i] = filepath.Join(dir, extension)
+		}
+	}
+
+	if c.Dbx != "" && c.Dbx != DbxSystem && !filepath.IsAbs(c.Dbx) {
+		c.Dbx = filepath.Join(dir, c.Dbx)
+	}
+
+	if c.SBATPolicy != "" && c.SBATPolicy != SBATPolicyLatest && c.SBATPolicy != SBATPolicySystem && !filepath.IsAbs(c.SBATPolicy) {
+		c.SBATPolicy = filepath.Join(dir, c.SBATPolicy)
+	}
+}
+
+// Merge returns a copy of c with the empty fields taken from defaults.
+func (c BuildConfig) Merge(defaults BuildConfig) BuildConfig {
+	merged := c
+
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&merged.Arch, defaults.Arch},
+		{&merged.Version, defaults.Version},
+		{&merged.SdStubPath, defaults.SdStubPath},
+		{&merged.SdStubSHA256, defaults.SdStubSHA256},
+		{&merged.SdBootPath, defaults.SdBootPath},
+		{&merged.KernelPath, defaults.KernelPath},
+		{&merged.InitrdPath, defaults.InitrdPath},
+		{&merged.Uname, defaults.Uname},
+		{&merged.UnamePath, defaults.UnamePath},
+		{&merged.Cmdline, defaults.Cmdline},
+		{&merged.OsRelease, defaults.OsRelease},
+		{&merged.Splash, defaults.Splash},
+		{&merged.Firmware, defaults.Firmware},
+		{&merged.Phases, defaults.Phases},
+		{&merged.SBKey, defaults.SBKey},
+		{&merged.SBCert, defaults.SBCert},
+		{&merged.PCRKey, defaults.PCRKey},
+		{&merged.OutSdBootPath, defaults.OutSdBootPath},
+		{&merged.OutUKIPath, defaults.OutUKIPath},
+		{&merged.OutChecksums, defaults.OutChecksums},
+		{&merged.OutBundle, defaults.OutBundle},
+		{&merged.OutSBOM, defaults.OutSBOM},
+		{&merged.SBOMFormat, defaults.SBOMFormat},
+		{&merged.Dbx, defaults.Dbx},
+		{&merged.SBATPolicy, defaults.SBATPolicy},
+		{&merged.BuildCache, defaults.BuildCache},
+		{&merged.Profile, defaults.Profile},
+		{&merged.KernelSignature, defaults.KernelSignature},
+		{&merged.MaxInitrdSize, defaults.MaxInitrdSize},
+		{&merged.SplashMaxSize, defaults.SplashMaxSize},
+		{&merged.OutputMode, defaults.OutputMode},
+		{&merged.OutputOwner, defaults.OutputOwner},
+		{&merged.TransparencyLog, defaults.TransparencyLog},
+		{&merged.TransparencyLogKey, defaults.TransparencyLogKey},
+		{&merged.AddonStubPath, defaults.AddonStubPath},
+		{&merged.OSName, defaults.OSName},
+		{&merged.OSID, defaults.OSID},
+		{&merged.OSURL, defaults.OSURL},
+		{&merged.SBATVendor, defaults.SBATVendor},
+		{&merged.RecoveryCmdline, defaults.RecoveryCmdline},
+		{&merged.RecoveryInitrd, defaults.RecoveryInitrd},
+		{&merged.RecoverySplash, defaults.RecoverySplash},
+		{&merged.OutRecoveryUKI, defaults.OutRecoveryUKI},
+	} {
+		if *f.dst == "" {
+			*f.dst = f.src
+		}
+	}
+
+	if !merged.SplashFallback {
+		merged.SplashFallback = defaults.SplashFallback
+	}
+
+	if !merged.SplashText {
+		merged.SplashText = defaults.SplashText
+	}
+
+	if !merged.RequireHardwareKeys {
+		merged.RequireHardwareKeys = defaults.RequireHardwareKeys
+	}
+
+	if !merged.EmbedSBOM {
+		merged.EmbedSBOM = defaults.EmbedSBOM
+	}
+
+	if !merged.KernelReport {
+		merged.KernelReport = defaults.KernelReport
+	}
+
+	if merged.SBATGeneration == 0 {
+		merged.SBATGeneration = defaults.SBATGeneration
+	}
+
+	if merged.KernelCAs == nil {
+		merged.KernelCAs = defaults.KernelCAs
+	}
+
+	if merged.Extensions == nil {
+		merged.Extensions = defaults.Extensions
+	}
+
+	if merged.SBATGenerations == nil {
+		merged.SBATGenerations = defaults.SBATGenerations
+	}
+
+	if merged.SBATVendors == nil {
+		merged.SBATVendors = defaults.SBATVendors
+	}
+
+	if merged.CmdlineLint == nil {
+		merged.CmdlineLint = defaults.CmdlineLint
+	}
+
+	return merged
+}
+
+// Builder returns a Builder configured from the config.
+func (c BuildConfig) Builder() *Builder {
+	// checked by Validate
+	maxInitrdSize, _ := utils.ParseSize(c.MaxInitrdSize) //nolint:errcheck
+	splashMaxSize, _ := utils.ParseSize(c.SplashMaxSize) //nolint:errcheck
+	outputMode, _ := utils.ParseMode(c.OutputMode)       //nolint:errcheck
+
+	builder := &Builder{
+		Arch:             c.Arch,
+		Version:          c.Version,
+		SdStubPath:       c.SdStubPath,
+		SdStubSHA256:     c.SdStubSHA256,
+		SdBootPath:       c.SdBootPath,
+		KernelPath:       c.KernelPath,
+		InitrdPath:       c.InitrdPath,
+		Uname:            c.Uname,
+		UnamePath:        c.UnamePath,
+		KernelSignature:  c.KernelSignature,
+		KernelCAs:        c.KernelCAs,
+		KernelReport:     c.KernelReport,
+		Cmdline:          c.Cmdline,
+		CmdlineLint:      c.CmdlineLint,
+		Extensions:       c.Extensions,
+		MaxInitrdSize:    maxInitrdSize,
+		AddonStubPath:    c.AddonStubPath,
+		OsRelease:        c.OsRelease,
+		Splash:           c.Splash,
+		SplashFallback:   c.SplashFallback,
+		SplashMaxSize:    splashMaxSize,
+		SplashText:       c.SplashText,
+		Firmware:         c.Firmware,
+		Phases:           types.PhasesFromString(c.Phases),
+		SBKey:            c.SBKey,
+		SBCert:           c.SBCert,
+		PCRKey:           c.PCRKey,
+		OutSdBootPath:    c.OutSdBootPath,
+		OutUKIPath:       c.OutUKIPath,
+		OutChecksumsPath: c.OutChecksums,
+		OutBundlePath:    c.OutBundle,
+		OutSBOMPath:      c.OutSBOM,
+		SBOMFormat:       c.SBOMFormat,
+		EmbedSBOM:        c.EmbedSBOM,
+		OutputMode:       outputMode,
+		OutputOwner:      c.OutputOwner,
+		DbxPath:          c.Dbx,
+		SBATPolicyPath:   c.SBATPolicy,
+		BuildCacheDir:    c.BuildCache,
+		Identity: Identity{
+			Name:           c.OSName,
+			ID:             c.OSID,
+			URL:            c.OSURL,
+			Vendor:         c.SBATVendor,
+			SBATGeneration: c.SBATGeneration,
+		},
+		SBATGenerations: c.SBATGenerations,
+		SBATVendors:     c.SBATVendors,
+		Profile:         c.Profile,
+
+		RecoveryCmdline:    c.RecoveryCmdline,
+		RecoveryInitrdPath: c.RecoveryInitrd,
+		RecoverySplash:     c.RecoverySplash,
+		OutRecoveryUKIPath: c.OutRecoveryUKI,
+
+		RequireHardwareKeys: c.RequireHardwareKeys,
+	}
+
+	if c.TransparencyLog != "" {
+		builder.TransparencyLog = rekor.NewClient(c.TransparencyLog)
+	}
+
+	builder.TransparencyLogKey = c.TransparencyLogKey
+
+	return builder
+}
+
+// Validate checks that the config has the minimum inputs needed to build.
+func (c BuildConfig) Validate() error {
+	var errs []error
+
+	if c.KernelPath == "" {
+		errs = append(errs, errors.New("missing kernel"))
+	}
+
+	if c.InitrdPath == "" {
+		errs = append(errs, errors.New("missing initrd"))
+	}
+
+	if c.OutUKIPath == "" {
+		errs = append(errs, errors.New("missing output-uki"))
+	}
+
+	if _, err := utils.ParseSize(c.MaxInitrdSize); err != nil {
+		errs = append(errs, fmt.Errorf("invalid max-initrd-size: %w", err))
+	}
+
+	if _, err := utils.ParseSize(c.SplashMaxSize); err != nil {
+		errs = append(errs, fmt.Errorf("invalid splash-max-size: %w", err))
+	}
+
+	if _, err := utils.ParseMode(c.OutputMode); err != nil {
+		errs = append(errs, fmt.Errorf("invalid output-mode: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// MultiBuilder builds several UKIs in one process.
+//
+// Signers are initialized once per distinct key and shared between all the builders using them.
+// So are the section digests, so a kernel shared by several builds is only hashed once.
+type MultiBuilder struct {
+	// Names of the builds, used in the report.
+	Names []string
+	// Builders to run.
+	Builders []*Builder
+	// Number of builds to run in parallel, defaults to 1.
+	Jobs int
+	// Upper bound of the size of the inputs of the builds running at once, unlimited if 0.
+	// Workers wait for running builds to finish instead of going over it, a build larger
+	// than the limit runs alone.
+	MemoryLimit int64
+	// Called to obtain the passphrase of encrypted keys
+	Passphrase pesign.PassphraseFunc
+	// Logger of the batch messages, and of the builds without their own logger. slog.Default() when nil.
+	Logger *slog.Logger
+	// Webhook the events of the builds are posted to, none when nil. Failing to post one does not
+	// fail the build.
+	Webhook *Webhook
+}
+
+// NewMultiBuilder creates a MultiBuilder out of a manifest.
+//
+// The output paths must be distinct between the builds, except for sd-boot: the builds signing the
+// same sd-boot with the same key to the same path, i.e. the one of the defaults, sign it once.
+func NewMultiBuilder(manifest *Manifest) (*MultiBuilder, error) {
+	memoryLimit, err := utils.ParseSize(manifest.MemoryLimit)
+	if err != nil {
+		return nil, fmt.Errorf("memory-limit: %w", err)
+	}
+
+	multi := &MultiBuilder{Jobs: manifest.Jobs, MemoryLimit: memoryLimit}
+
+	if manifest.Webhook != "" {
+		multi.Webhook = &Webhook{URL: manifest.Webhook}
+	}
+
+	configs := make([]BuildConfig, len(manifest.Builds))
+
+	for i, build := range manifest.Builds {
+		config := build.Merge(manifest.Defaults)
+
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("build-%d", i)
+		}
+
+		if err := config.Validate(); err != nil {
+			return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("build %s: %w", config.Name, err))
+		}
+
+		configs[i] = config
+	}
+
+	shareSdBoot(configs)
+
+	if err := checkOutputs(configs); err != nil {
+		return nil, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	for _, config := range configs {
+		multi.Names = append(multi.Names, config.Name)
+		multi.Builders = append(multi.Builders, config.Builder())
+	}
+
+	return multi, nil
+}
+
+// shareSdBoot leaves the signing of sd-boot to the first of the builds signing the same sd-boot with
+// the same key to the same output, i.e. the one of the defaults, as upgradeManifest does.
+func shareSdBoot(configs []BuildConfig) {
+	for i := range configs {
+		if configs[i].OutSdBootPath == "" {
+			continue
+		}
+
+		for _, first := range configs[:i] {
+			if first.OutSdBootPath != "" && filepath.Clean(first.OutSdBootPath) == filepath.Clean(configs[i].OutSdBootPath) &&
+				first.SdBootPath == configs[i].SdBootPath && first.SBKey == configs[i].SBKey && first.SBCert == configs[i].SBCert {
+				configs[i].SdBootPath, configs[i].OutSdBootPath = "", ""
+
+				break
+			}
+		}
+	}
+}
+
+// checkOutputs refuses the output paths written by more than one build, as the builds running at
+// once would write the same file.
+func checkOutputs(configs []BuildConfig) error {
+	owners := map[string]string{}
+
+	var errs []error
+
+	for _, config := range configs {
+		for _, path := range []string{
+			config.OutUKIPath, config.OutSdBootPath, config.OutChecksums, config.OutBundle, config.OutSBOM, config.OutRecoveryUKI,
+		} {
+			if path == "" {
+				continue
+			}
+
+			path = filepath.Clean(path)
+
+			if owner, ok := owners[path]; ok {
+				errs = append(errs, fmt.Errorf("%s is written by both build %s and build %s", path, owner, config.Name))
+
+				continue
+			}
+
+			owners[path] = config.Name
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// BatchResult is the outcome of one of the builds run by a MultiBuilder.
+type BatchResult struct {
+	// Name of the build.
+	Name string `json:"name"`
+	// Error message if the build failed.
+	Error string `json:"error,omitempty"`
+	// Build duration.
+	Duration time.Duration `json:"duration"`
+	// Result of the build.
+	Result *Result `json:"result,omitempty"`
+}
+
+// Build runs all the builds and returns one result per build, in the same order as the builders.
+//
+// A failing build does not stop the others, the returned error joins all build errors.
+func (multi *MultiBuilder) Build() ([]BatchResult, error) {
+	destroyKeys, err := multi.initSigners()
+
+	defer destroyKeys()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := multi.initHashCaches(); err != nil {
+		return nil, err
+	}
+
+	jobs := multi.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var memory *semaphore.Weighted
+	if multi.MemoryLimit > 0 {
+		memory = semaphore.NewWeighted(multi.MemoryLimit)
+
+		// the builds stream their inputs within the limit, as MaxMemory builds do
+		defer utils.LimitMemory(multi.MemoryLimit)()
+	}
+
+	results := make([]BatchResult, len(multi.Builders))
+	queue := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for range jobs {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range queue {
+				if memory == nil {
+					results[i] = multi.buildOne(i)
+					continue
+				}
+
+				weight := min(multi.Builders[i].inputsSize(), multi.MemoryLimit)
+				_ = memory.Acquire(context.Background(), weight) //nolint:errcheck
+
+				results[i] = multi.buildOne(i)
+
+				memory.Release(weight)
+			}
+		}()
+	}
+
+	for i := range multi.Builders {
+		queue <- i
+	}
+
+	close(queue)
+	wg.Wait()
+
+	var errs []error
+
+	for _, result := range results {
+		if result.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", result.Name, result.Error))
+		}
+	}
+
+	return results, errors.Join(errs...)
+}
+
+// buildOne runs the i-th build.
+func (multi *MultiBuilder) buildOne(i int) BatchResult {
+	name := multi.name(i)
+	builder := multi.Builders[i]
+	if builder.Logger == nil {
+		builder.Logger = multi.Logger
+	}
+
+	multi.log().Info("Building UKI", "name", name)
+
+	start := time.Now()
+	err := builder.Build()
+
+	result := BatchResult{
+		Name:     name,
+		Duration: time.Since(start),
+		Result:   builder.Result(),
+	}
+
+	if err != nil {
+		multi.log().Error("Failed building UKI", "name", name, "error", err)
+		result.Error = err.Error()
+	} else {
+		multi.log().Info("Built UKI", "name", name, "duration", result.Duration)
+	}
+
+	if multi.Webhook != nil {
+		if err := multi.Webhook.Notify(NewBuildEvent(name, builder, err)); err != nil {
+			multi.log().Warn("Failed posting the build event", "name", name, "error", err)
+		}
+	}
+
+	return result
+}
+
+// log returns the logger of the batch messages.
+func (multi *MultiBuilder) log() *slog.Logger {
+	if multi.Logger == nil {
+		return slog.Default()
+	}
+
+	return multi.Logger
+}
+
+func (multi *MultiBuilder) name(i int) string {
+	if i < len(multi.Names) && multi.Names[i] != "" {
+		return multi.Names[i]
+	}
+
+	return fmt.Sprintf("build-%d", i)
+}
+
+// initHashCaches shares the section digests between the builders, one cache per build cache
+// directory plus one for the builders not using any.
+func (multi *MultiBuilder) initHashCaches() error {
+	shared := pcr.CurrentHashCache()
+	if shared == nil {
+		shared = pcr.NewHashCache()
+	}
+
+	caches := map[string]*pcr.HashCache{}
+
+	for _, builder := range multi.Builders {
+		if builder.hashCache != nil {
+			continue
+		}
+
+		if builder.BuildCacheDir == "" {
+			builder.hashCache = shared
+			continue
+		}
+
+		cache, ok := caches[builder.BuildCacheDir]
+		if !ok {
+			var err error
+			if cache, err = pcr.LoadHashCache(filepath.Join(builder.BuildCacheDir, buildCacheFile)); err != nil {
+				return fmt.Errorf("error loading build cache: %w", err)
+			}
+			caches[builder.BuildCacheDir] = cache
+		}
+
+		builder.hashCache = cache
+	}
+
+	return nil
+}
+
+// inputsSize returns the size of the input files of the build, an estimate of the memory it needs.
+func (builder *Builder) inputsSize() int64 {
+	var size int64
+
+	for _, path := range []string{
+		builder.SdStubPath, builder.SdBootPath, builder.KernelPath, builder.InitrdPath, builder.OsRelease, builder.Splash,
+		builder.RecoveryInitrdPath, builder.RecoverySplash,
+	} {
+		if path != "" {
+			size += fileSize(path)
+		}
+	}
+
+	for _, source := range []*types.SectionSource{builder.KernelSource, builder.InitrdSource} {
+		if source != nil {
+			size += source.Size
+		}
+	}
+
+	return size
+}
+
+// initSigners creates the signers for all builders, reusing them for builders sharing the same keys.
+//
+// The returned func zeroes the loaded keys and drops their signers once the builds are done.
+func (multi *MultiBuilder) initSigners() (func(), error) {
+	pcrSigners := map[string]types.RSAKey{}
+	sbSigners := map[[2]string]*pesign.Signer{}
+
+	var (
+		loaded   []interface{ Destroy() }
+		pcrUsers []*Builder
+		sbUsers  []*Builder
+	)
+
+	destroy := func() {
+		for _, key := range loaded {
+			key.Destroy()
+		}
+
+		for _, builder := range pcrUsers {
+			builder.PCRSigner = nil
+		}
+
+		for _, builder := range sbUsers {
+			builder.SecureBootSigner = nil
+		}
+	}
+
+	for _, builder := range multi.Builders {
+		// refused by the build, the keys are not loaded
+		if builder.RequireHardwareKeys {
+			continue
+		}
+
+		if builder.PCRSigner == nil && builder.PCRKey != "" {
+			signer, ok := pcrSigners[builder.PCRKey]
+			if !ok {
+				pcrSigner, err := pesign.NewPCRSignerWithPassphrase(builder.PCRKey, multi.Passphrase)
+				if err != nil {
+					return destroy, types.WithCategory(types.ErrInvalidInput, err)
+				}
+				loaded = append(loaded, pcrSigner)
+				signer = pcrSigner
+				pcrSigners[builder.PCRKey] = signer
+			}
+			builder.PCRSigner = signer
+			pcrUsers = append(pcrUsers, builder)
+		}
+
+		if builder.SecureBootSigner == nil && builder.SBKey != "" && builder.SBCert != "" {
+			key := [2]string{builder.SBCert, builder.SBKey}
+
+			signer, ok := sbSigners[key]
+			if !ok {
+				sb, err := pesign.NewSecureBootSignerWithPassphrase(builder.SBCert, builder.SBKey, multi.Passphrase)
+				if err != nil {
+					return destroy, types.WithCategory(types.ErrInvalidInput, err)
+				}
+				loaded = append(loaded, sb)
+				signer, err = pesign.NewSigner(sb)
+				if err != nil {
+					return destroy, err
+				}
+				signer.Logger = multi.Logger
+				sbSigners[key] = signer
+			}
+			builder.SecureBootSigner = signer
+			sbUsers = append(sbUsers, builder)
+		}
+	}
+
+	return destroy, nil
+}
@@ -0,0 +1,244 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// File names in the bundle, next to the outputs.
+const (
+	BundleManifestFile     = "manifest.json"
+	BundleMeasurementsFile = "measurements.json"
+)
+
+// bundleFile is a file to put in the bundle, either copied from a path or read from the source.
+type bundleFile struct {
+	name   string
+	path   string
+	source *types.SectionSource
+}
+
+// writeCollectedOutputs writes the outputs covering the other ones, the checksums first so they end in the bundle.
+func (builder *Builder) writeCollectedOutputs() error {
+	if err := builder.writeSBOM(); err != nil {
+		return err
+	}
+
+	if err := builder.writeChecksums(); err != nil {
+		return err
+	}
+
+	return builder.writeBundle()
+}
+
+// writeBundle collects the outputs, the PCR public key and signature, the predicted PCR values and
+// the build manifest into the bundle.
+//
+// The manifest is the build result, with the output paths relative to the bundle.
+func (builder *Builder) writeBundle() error {
+	if builder.OutBundlePath == "" {
+		return nil
+	}
+
+	manifest := builder.result
+	manifest.Outputs = nil
+
+	var files []bundleFile
+
+	for _, output := range builder.result.Outputs {
+		name := filepath.Base(output.Path)
+		files = append(files, bundleFile{name: name, path: output.Path})
+
+		output.Path = name
+		manifest.Outputs = append(manifest.Outputs, output)
+	}
+
+	for _, section := range builder.sections {
+		switch section.Name {
+		case constants.PCRPKey:
+			files = append(files, bundleFile{name: constants.PCRPublicKeyFile, path: section.Path, source: section.Source})
+		case constants.PCRSig:
+			files = append(files, bundleFile{name: constants.PCRSignatureFile, path: section.Path, source: section.Source})
+		}
+	}
+
+	measurements, err := json.MarshalIndent(builder.result.Measurements, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	files = append(files,
+		bundleFile{name: BundleMeasurementsFile, source: types.BytesSource(append(measurements, '\n'))},
+		bundleFile{name: BundleManifestFile, source: types.BytesSource(append(manifestData, '\n'))},
+	)
+
+	if isTarball(builder.OutBundlePath) {
+		err = writeTarball(builder.OutBundlePath, files)
+	} else {
+		err = writeBundleDir(builder.OutBundlePath, files)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error writing bundle: %w", err)
+	}
+
+	builder.log().Info("Wrote bundle", "path", builder.OutBundlePath)
+
+	if isTarball(builder.OutBundlePath) {
+		return builder.recordOutput("bundle", builder.OutBundlePath, false)
+	}
+
+	return nil
+}
+
+func isTarball(path string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// open returns a reader of the data of the file and its size, so big outputs are streamed into the bundle.
+func (f bundleFile) open() (io.ReadCloser, int64, error) {
+	if f.source != nil {
+		return io.NopCloser(f.source.Open()), f.source.Size, nil
+	}
+
+	in, err := utils.OpenSequential(f.path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	st, err := in.Stat()
+	if err != nil {
+		in.Close() //nolint:errcheck
+
+		return nil, 0, err
+	}
+
+	return in, st.Size(), nil
+}
+
+func writeBundleDir(dir string, files []bundleFile) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+
+		if f.source == nil {
+			if err := utils.CopyFileAtomic(f.path, path, 0o644); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := writeSource(path, f.source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeSource writes the contents of the source to the file.
+func writeSource(path string, source *types.SectionSource) error {
+	return utils.WriteFileAtomic(path, 0o644, func(w io.Writer) error {
+		_, err := utils.Copy(w, source.Open())
+
+		return err
+	})
+}
+
+// writeTarball writes the files to a tarball, gzip compressed depending on the extension.
+//
+// Entries have a fixed modification time so the same build gives the same tarball.
+func writeTarball(path string, files []bundleFile) error {
+	return utils.WriteFileAtomic(path, 0o644, func(out io.Writer) error {
+		return writeTarEntries(out, path, files)
+	})
+}
+
+// writeTarEntries writes the tarball of the files to out, gzip compressed unless path ends in .tar.
+func writeTarEntries(out io.Writer, path string, files []bundleFile) error {
+	buffered := bufio.NewWriterSize(out, utils.StreamBufferSize())
+
+	var w io.Writer = buffered
+
+	var gz *gzip.Writer
+	if !strings.HasSuffix(path, ".tar") {
+		gz = gzip.NewWriter(buffered)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, f := range files {
+		if err := writeTarEntry(tw, f); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	return buffered.Flush()
+}
+
+// writeTarEntry streams the file into the tarball.
+func writeTarEntry(tw *tar.Writer, f bundleFile) error {
+	in, size, err := f.open()
+	if err != nil {
+		return err
+	}
+
+	defer in.Close() //nolint:errcheck
+
+	if err = tw.WriteHeader(&tar.Header{
+		Name:    f.name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: time.Unix(0, 0),
+		Format:  tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+
+	// a file changing size meanwhile fails the write, or the next header
+	_, err = utils.Copy(tw, in)
+
+	return err
+}
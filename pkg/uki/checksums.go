@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Checksums returns the outputs in the sha256sum format, i.e. `<digest>  <file>` lines.
+//
+// File names are relative to dir when the outputs are below it, so the file can be checked
+// with `sha256sum -c` from there.
+func (r *Result) Checksums(dir string) []byte {
+	var sb strings.Builder
+
+	for _, output := range r.Outputs {
+		name := filepath.Base(output.Path)
+
+		if abs, err := filepath.Abs(output.Path); err == nil {
+			if absDir, err := filepath.Abs(dir); err == nil {
+				if rel, err := filepath.Rel(absDir, abs); err == nil && !strings.HasPrefix(rel, "..") {
+					name = rel
+				}
+			}
+		}
+
+		fmt.Fprintf(&sb, "%s  %s\n", output.SHA256, filepath.ToSlash(name))
+	}
+
+	return []byte(sb.String())
+}
+
+// writeChecksums writes the checksums file, and its signature if signing is enabled.
+func (builder *Builder) writeChecksums() error {
+	if builder.OutChecksumsPath == "" {
+		return nil
+	}
+
+	data := builder.result.Checksums(filepath.Dir(builder.OutChecksumsPath))
+
+	if err := utils.WriteFile(builder.OutChecksumsPath, data, 0o644); err != nil {
+		return err
+	}
+
+	if err := builder.recordOutput("checksums", builder.OutChecksumsPath, false); err != nil {
+		return err
+	}
+
+	builder.log().Info("Wrote checksums", "path", builder.OutChecksumsPath)
+
+	if !builder.sbSignEnabled() {
+		return nil
+	}
+
+	signature, err := builder.SecureBootSigner.SignDetached(data)
+	if err != nil {
+		return types.WithCategory(types.ErrSigning, fmt.Errorf("error signing checksums: %w", err))
+	}
+
+	signaturePath := builder.OutChecksumsPath + ".p7s"
+
+	if err = utils.WriteFile(signaturePath, signature, 0o644); err != nil {
+		return err
+	}
+
+	builder.log().Info("Signed checksums", "path", signaturePath)
+
+	return builder.recordOutput("checksums-signature", signaturePath, true)
+}
@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/cmdline"
+)
+
+// lintCmdlines checks the cmdlines of the UKI and the recovery UKI against the cmdline rules, with
+// the severities of CmdlineLint.
+func (builder *Builder) lintCmdlines() []error {
+	if err := cmdline.ValidateSeverities(builder.CmdlineLint); err != nil {
+		return []error{err}
+	}
+
+	errs := builder.lintCmdline("", builder.Cmdline)
+
+	if builder.OutRecoveryUKIPath != "" {
+		errs = append(errs, builder.lintCmdline(RecoveryVariant, builder.RecoveryCmdline)...)
+	}
+
+	return errs
+}
+
+// lintCmdline returns the options of the cmdline flagged by error rules, and warns about the ones
+// flagged by warn rules.
+func (builder *Builder) lintCmdline(variant, cmd string) []error {
+	name := "cmdline"
+	if variant != "" {
+		name = variant + " cmdline"
+	}
+
+	var errs []error
+
+	for _, finding := range cmdline.Lint(cmd, builder.CmdlineLint) {
+		if finding.Severity == cmdline.SeverityError {
+			errs = append(errs, fmt.Errorf("%s: %s", name, finding))
+
+			continue
+		}
+
+		builder.warn("Dangerous cmdline option", "cmdline", name, "option", finding.Param, "rule", finding.Rule, "reason", finding.Description)
+	}
+
+	return errs
+}
@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// DbxSystem is the DbxPath value reading the dbx of the running system.
+const DbxSystem = "system"
+
+func loadDbx(path string) (*secureboot.Revocations, error) {
+	if path == DbxSystem {
+		dbx, err := secureboot.SystemRevocations()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading the system dbx: %w", err)
+		}
+
+		return dbx, nil
+	}
+
+	return secureboot.LoadRevocations(path)
+}
+
+// checkRevoked checks the SecureBoot certificate and the given images against the dbx.
+func (builder *Builder) checkRevoked(paths ...string) error {
+	if builder.Dbx == nil || !builder.sbSignEnabled() {
+		return nil
+	}
+
+	if err := builder.revoked(builder.Dbx.CheckCertificate(builder.SecureBootSigner.Certificate())); err != nil {
+		return err
+	}
+
+	return builder.checkRevokedImages(paths...)
+}
+
+// checkRevokedImages checks the given images against the dbx, empty paths are skipped.
+func (builder *Builder) checkRevokedImages(paths ...string) error {
+	if builder.Dbx == nil || !builder.sbSignEnabled() {
+		return nil
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		if err := builder.revoked(builder.Dbx.CheckImage(path)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRevokedUKI checks the unsigned UKI against the dbx, with the digest computed while assembling it if known.
+func (builder *Builder) checkRevokedUKI() error {
+	if builder.unsignedDigest == nil {
+		return builder.checkRevokedImages(builder.unsignedUKIPath)
+	}
+
+	if builder.Dbx == nil || !builder.sbSignEnabled() {
+		return nil
+	}
+
+	return builder.revoked(builder.Dbx.CheckDigest(builder.unsignedUKIPath, builder.unsignedDigest))
+}
+
+// revoked turns a dbx match into a warning with DbxWarnOnly, other errors are returned as is.
+func (builder *Builder) revoked(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, secureboot.ErrRevoked) {
+		return types.WithCategory(types.ErrVerification, err)
+	}
+
+	if builder.DbxWarnOnly {
+		builder.warn("Firmware would reject the output", "reason", err.Error())
+
+		return nil
+	}
+
+	return types.WithCategory(types.ErrVerification, fmt.Errorf("firmware would reject the output: %w", err))
+}
+
+// checkHostSecureBoot warns when the Secure Boot state of the running system would not accept the
+// SecureBoot certificate, with CheckHostSecureBoot.
+func (builder *Builder) checkHostSecureBoot() {
+	if !builder.CheckHostSecureBoot || !builder.sbSignEnabled() {
+		return
+	}
+
+	state, err := secureboot.SystemState()
+	if err != nil {
+		builder.warn("Could not read the Secure Boot state of the host", "error", err)
+
+		return
+	}
+
+	if err = state.Accepts(builder.SecureBootSigner.Certificate()); err != nil {
+		builder.warn("The host would not boot the output, its db does not hold the SecureBoot certificate", "reason", err.Error())
+
+		return
+	}
+
+	builder.log().Info("The host accepts the SecureBoot certificate", "secureBoot", state.SecureBoot, "setupMode", state.SetupMode)
+}
@@ -0,0 +1,54 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"github.com/kairos-io/go-ukify/pkg/stub"
+)
+
+// DiscoverStubs replaces the sd-stub and sd-boot paths left to discovery with the binaries installed on the host,
+// fetches the sd-stub if given as an URL, and checks it against SdStubSHA256.
+//
+// Build does it first thing, it only needs to be called to know the paths beforehand.
+func (builder *Builder) DiscoverStubs() error {
+	switch {
+	case builder.Stub != nil:
+		// an explicit stub needs no sd-stub
+	case stub.IsURL(builder.SdStubPath):
+		path, err := stub.Fetch(builder.SdStubPath, builder.SdStubSHA256)
+		if err != nil {
+			return err
+		}
+
+		builder.log().Info("Fetched sd-stub", "url", builder.SdStubPath, "path", path)
+		builder.SdStubPath = path
+	case builder.SdStubPath == "" || builder.SdStubPath == stub.Auto:
+		binary, err := stub.FindStub(builder.Arch)
+		if err != nil {
+			return err
+		}
+
+		builder.log().Info("Found sd-stub", "path", binary.Path, "version", binary.Version)
+		builder.SdStubPath = binary.Path
+	}
+
+	if builder.SdStubSHA256 != "" && builder.Stub == nil {
+		if err := stub.Verify(builder.SdStubPath, builder.SdStubSHA256); err != nil {
+			return err
+		}
+	}
+
+	if builder.SdBootPath == stub.Auto {
+		binary, err := stub.FindBoot(builder.Arch)
+		if err != nil {
+			return err
+		}
+
+		builder.log().Info("Found sd-boot", "path", binary.Path, "version", binary.Version)
+		builder.SdBootPath = binary.Path
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Output kinds of the extension images placed next to the UKI.
+const (
+	OutputSysext  = "sysext"
+	OutputConfext = "confext"
+)
+
+// ExtensionResult is an extension image or an initrd addon placed for systemd-stub to pick up.
+type ExtensionResult struct {
+	// Path the image was placed at, in the `<uki>.extra.d/` directory.
+	Path string `json:"path"`
+	// Kind of extension, sysext, confext or initrd-addon.
+	Kind string `json:"kind"`
+	// PCR the stub measures the image into.
+	PCR int `json:"pcr"`
+	// Events the stub extends for the image, one per bank.
+	Events []types.PCREvent `json:"events"`
+}
+
+// extensionsDir returns the directory systemd-stub picks up the extensions of the UKI from.
+func (builder *Builder) extensionsDir() string {
+	return builder.OutUKIPath + ".extra.d"
+}
+
+// checkExtensions checks the extension images are named after their kind, and can all be placed in the
+// same directory.
+func (builder *Builder) checkExtensions() []error {
+	var errs []error
+
+	names := map[string]bool{}
+
+	for _, path := range builder.Extensions {
+		name := filepath.Base(path)
+
+		if _, ok := measure.ExtensionPCR(name); !ok {
+			errs = append(errs, fmt.Errorf("extension %s: the name must end in %s or %s for systemd-stub to pick it up", path, measure.SysextSuffix, measure.ConfextSuffix))
+		}
+
+		if names[name] {
+			errs = append(errs, fmt.Errorf("extension %s: another extension is named %s", path, name))
+		}
+
+		names[name] = true
+
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("extension: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// placeExtensions copies the extension images to the extensions directory of the UKI and adds their
+// measurements to the result: the PCR 13 values for each phase, and the events of each image.
+func (builder *Builder) placeExtensions() error {
+	if len(builder.Extensions) == 0 {
+		return nil
+	}
+
+	events, measurements, err := measure.CalculateExtensionMeasurements(builder.Extensions, builder.Phases)
+	if err != nil {
+		return types.WithCategory(types.ErrMeasurement, fmt.Errorf("error measuring extensions: %w", err))
+	}
+
+	dir := builder.extensionsDir()
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, path := range measure.SortExtensions(builder.Extensions) {
+		name := filepath.Base(path)
+		out := filepath.Join(dir, name)
+
+		builder.log().Info("Placing extension", "path", out)
+
+		if err = utils.CopyFileAtomic(path, out, 0o644); err != nil {
+			return fmt.Errorf("error placing extension %s: %w", path, err)
+		}
+
+		kind, index := extensionKind(name)
+
+		if err = builder.recordOutput(kind, out, false); err != nil {
+			return err
+		}
+
+		extension := ExtensionResult{Path: out, Kind: kind, PCR: index}
+
+		for _, event := range events {
+			if event.Description == name {
+				extension.Events = append(extension.Events, event)
+			}
+		}
+
+		builder.result.Extensions = append(builder.result.Extensions, extension)
+	}
+
+	if !builder.hasSysext() {
+		return nil
+	}
+
+	for _, m := range measurements {
+		builder.log().Info("PCR measurement", "phase", m.Phase, "pcr", m.PCR, "algorithm", m.Algorithm, "digest", m.Digest)
+	}
+
+	builder.result.Measurements = append(builder.result.Measurements, measurements...)
+
+	return nil
+}
+
+// planExtensions returns the outputs and the PCR 13 values of the extension images.
+func (builder *Builder) planExtensions() ([]PlannedOutput, []types.PCRMeasurement, error) {
+	if len(builder.Extensions) == 0 {
+		return nil, nil, nil
+	}
+
+	_, measurements, err := measure.CalculateExtensionMeasurements(builder.Extensions, builder.Phases)
+	if err != nil {
+		return nil, nil, types.WithCategory(types.ErrMeasurement, fmt.Errorf("error measuring extensions: %w", err))
+	}
+
+	var outputs []PlannedOutput
+
+	for _, path := range measure.SortExtensions(builder.Extensions) {
+		name := filepath.Base(path)
+		kind, _ := extensionKind(name)
+
+		outputs = append(outputs, PlannedOutput{Kind: kind, Path: filepath.Join(builder.extensionsDir(), name)})
+	}
+
+	if !builder.hasSysext() {
+		measurements = nil
+	}
+
+	return outputs, measurements, nil
+}
+
+// extensionKind returns the output kind of the extension image, and the PCR it is measured into.
+func extensionKind(name string) (string, int) {
+	if index, _ := measure.ExtensionPCR(name); index == constants.KernelConfigPCR {
+		return OutputConfext, index
+	}
+
+	return OutputSysext, constants.SysextPCR
+}
+
+// hasSysext returns whether one of the extensions is a system extension, which PCR 13 is left alone without.
+func (builder *Builder) hasSysext() bool {
+	for _, path := range builder.Extensions {
+		if kind, _ := extensionKind(filepath.Base(path)); kind == OutputSysext {
+			return true
+		}
+	}
+
+	return false
+}
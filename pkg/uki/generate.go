@@ -5,233 +5,339 @@
 package uki
 
 import (
-	"crypto/x509"
+	"bytes"
 	"encoding/json"
-	"encoding/pem"
+	"fmt"
 	"github.com/kairos-io/go-ukify/internal/common"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"github.com/kairos-io/go-ukify/pkg/utils"
-	"log/slog"
 	"os"
 	"path/filepath"
 
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	sbatpkg "github.com/kairos-io/go-ukify/pkg/sbat"
+	"github.com/kairos-io/go-ukify/pkg/splash"
 )
 
-func (builder *Builder) generateOSRel() error {
-	var path string
-	if builder.OsRelease != "" {
-		slog.Debug("Using existing os-release", "path", builder.OsRelease)
-		path = builder.OsRelease
-	} else {
+func (builder *Builder) generateOSRel() ([]types.UkiSection, error) {
+	if builder.OsRelease == "" {
 		// Generate a simplified os-release
-		slog.Debug("Generating a new os-release")
-		osRelease, err := constants.OSReleaseFor(constants.Name, builder.Version)
+		builder.log().Debug("Generating a new os-release")
+		osRelease, err := builder.generatedOSRelease()
 		if err != nil {
-			return err
-		}
-		path = filepath.Join(builder.scratchDir, "os-release")
-		if err = os.WriteFile(path, osRelease, 0o600); err != nil {
-			return err
+			return nil, types.NewBuildError(StageGenerate, constants.OSRel, "", err)
 		}
+
+		return builder.ephemeralSection(types.UkiSection{Name: constants.OSRel, Measure: true, Append: true}, "os-release", osRelease)
 	}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
+	builder.log().Debug("Using existing os-release", "path", builder.OsRelease)
+
+	return []types.UkiSection{
+		{
 			Name:    constants.OSRel,
-			Path:    path,
+			Path:    builder.OsRelease,
 			Measure: true,
 			Append:  true,
 		},
-	)
-
-	return nil
+	}, nil
 }
 
-func (builder *Builder) generateCmdline() error {
-	slog.Debug("Using cmdline", "cmdline", builder.Cmdline)
-	path := filepath.Join(builder.scratchDir, "cmdline")
+func (builder *Builder) generateCmdline() ([]types.UkiSection, error) {
+	builder.log().Debug("Using cmdline", "cmdline", builder.Cmdline)
 
-	if err := os.WriteFile(path, []byte(builder.Cmdline), 0o600); err != nil {
-		return err
-	}
-
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.CMDLine,
-			Path:    path,
-			Measure: true,
-			Append:  true,
-		},
-	)
-
-	return nil
+	return builder.ephemeralSection(types.UkiSection{Name: constants.CMDLine, Measure: true, Append: true}, "cmdline", []byte(builder.Cmdline))
 }
 
-func (builder *Builder) generateInitrd() error {
-	slog.Debug("Using initrd", "path", builder.InitrdPath)
-	builder.sections = append(builder.sections,
-		types.UkiSection{
+func (builder *Builder) generateInitrd() ([]types.UkiSection, error) {
+	builder.log().Debug("Using initrd", "path", builder.InitrdPath)
+	return []types.UkiSection{
+		{
 			Name:    constants.Initrd,
 			Path:    builder.InitrdPath,
+			Source:  builder.initrdSource(),
 			Measure: true,
 			Append:  true,
 		},
-	)
-
-	return nil
+	}, nil
 }
 
-func (builder *Builder) generateSplash() error {
-	path := filepath.Join(builder.scratchDir, "splash.bmp")
-	var data []byte
+func (builder *Builder) generateSplash() ([]types.UkiSection, error) {
+	section := types.UkiSection{Name: constants.Splash, Measure: true, Append: true}
+
+	if builder.Splash == "" && builder.SplashSource == nil && !builder.SplashText {
+		builder.log().Debug("Using generic bundled splash")
+		section.Source = types.BytesSource(common.Logo)
+
+		return []types.UkiSection{section}, nil
+	}
+
+	if builder.SplashText {
+		builder.log().Debug("Rendering text splash")
+
+		var buf bytes.Buffer
+		if err := splash.Encode(&buf, splash.Text(builder.splashLines(), 0)); err != nil {
+			return nil, types.NewBuildError(StageGenerate, constants.Splash, "", fmt.Errorf("error rendering splash: %w", err))
+		}
+
+		return builder.ephemeralSection(section, "splash.bmp", buf.Bytes())
+	}
+
+	source := builder.SplashSource
+	name := "splash contents"
+
+	if source == nil {
+		builder.log().Debug("Using splash", "file", builder.Splash)
+
+		var (
+			done func()
+			err  error
+		)
+
+		if source, done, err = openSplash(builder.Splash); err != nil {
+			return builder.invalidSplash(section, err)
+		}
 
-	if builder.Splash != "" {
-		slog.Debug("Using splash", "file", builder.Splash)
-		data, _ = os.ReadFile(builder.Splash)
+		defer done()
+
+		name = builder.Splash
+	}
+
+	// valid BMP files are only read when measured and assembled, straight from their path or source
+	info, converted, err := readSplash(source)
+	if err != nil {
+		return builder.invalidSplash(section, fmt.Errorf("%s: %w", name, err))
+	}
+
+	if converted != nil {
+		builder.log().Info("Converted splash to BMP", "file", name)
+		builder.checkSplashSize(info, int64(len(converted)))
+
+		return builder.ephemeralSection(section, "splash.bmp", converted)
+	}
+
+	builder.checkSplashSize(info, source.Size)
+
+	if builder.SplashSource != nil {
+		section.Source = builder.SplashSource
 	} else {
-		slog.Debug("Using generic bundled splash")
-		data = common.Logo
+		section.Path = builder.Splash
 	}
 
-	if err := os.WriteFile(path, data, 0o600); err != nil {
-		return err
+	return []types.UkiSection{section}, nil
+}
+
+// invalidSplash fails on the invalid splash, or falls back to the bundled one with SplashFallback.
+func (builder *Builder) invalidSplash(section types.UkiSection, err error) ([]types.UkiSection, error) {
+	err = fmt.Errorf("invalid splash: %w", err)
+	if !builder.SplashFallback {
+		return nil, types.WithCategory(types.ErrInvalidInput, types.NewBuildError(StageGenerate, constants.Splash, builder.Splash, err))
 	}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.Splash,
-			Path:    path,
-			Measure: true,
-			Append:  true,
-		},
-	)
+	builder.warn("Using generic bundled splash instead", "error", err)
+	section.Source = types.BytesSource(common.Logo)
 
-	return nil
+	return []types.UkiSection{section}, nil
 }
 
-func (builder *Builder) generateUname() error {
+func (builder *Builder) generateUname() ([]types.UkiSection, error) {
 	// it is not always possible to get the kernel version from the kernel image, so we
 	// do a bit of pre-checks
-	var kernelVersion string
-
-	// otherwise, try to get the kernel version from the kernel image
-	kernelVersion, _ = DiscoverKernelVersion(builder.KernelPath) //nolint:errcheck
+	kernelVersion, err := builder.kernelRelease()
+	if err != nil && builder.UnamePath != "" {
+		return nil, types.NewBuildError(StageGenerate, constants.Uname, builder.UnamePath, err)
+	}
 
 	if kernelVersion == "" {
 		// we haven't got the kernel version, skip the uname section
-		slog.Info("We could not infer kernel version", "path", builder.KernelPath)
-		return nil
+		builder.warn("We could not infer kernel version", "path", builder.KernelPath, "error", err)
+		return nil, nil
 	} else {
-		slog.Debug("Getting uname", "version", kernelVersion, "path", builder.KernelPath)
+		builder.log().Debug("Getting uname", "version", kernelVersion, "path", builder.KernelPath)
 	}
 
-	path := filepath.Join(builder.scratchDir, "uname")
+	return builder.ephemeralSection(types.UkiSection{Name: constants.Uname, Measure: true, Append: true}, "uname", []byte(kernelVersion))
+}
 
-	if err := os.WriteFile(path, []byte(kernelVersion), 0o600); err != nil {
-		return err
+func (builder *Builder) generateSBAT() ([]types.UkiSection, error) {
+	builder.log().Debug("Getting SBAT", "path", builder.stub.Path())
+	sbat, err := builder.stub.SBAT()
+	if err != nil {
+		return nil, types.NewBuildError(StageGenerate, constants.SBAT, builder.stub.Path(), err)
 	}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.Uname,
-			Path:    path,
-			Measure: true,
-			Append:  true,
-		},
-	)
-
-	return nil
-}
+	// the entry of the identity first, so the extra entries can override it
+	extra := append(builder.Identity.sbatEntries(builder.Version), builder.SBAT...)
 
-func (builder *Builder) generateSBAT() error {
-	slog.Debug("Getting SBAT", "path", builder.SdStubPath)
-	sbat, err := GetSBAT(builder.SdStubPath)
-	if err != nil {
-		return err
+	// stubs without their own SBAT only get the extra entries, if any
+	if sbat == nil && len(extra) == 0 {
+		builder.log().Debug("Stub has no SBAT section", "path", builder.stub.Path())
+		return nil, nil
 	}
 
-	slog.Debug("Generated SBAT", "sbat", sbat, "path", builder.SdStubPath)
+	// with extra entries or overrides the merged SBAT replaces the stub one
+	merge := len(extra) > 0 || len(builder.SBATGenerations) > 0 || len(builder.SBATVendors) > 0
+	if merge {
+		entries, err := sbatpkg.Parse(sbat)
+		if err != nil {
+			return nil, types.NewBuildError(StageGenerate, constants.SBAT, builder.stub.Path(), err)
+		}
 
-	path := filepath.Join(builder.scratchDir, "sbat")
+		entries, err = sbatpkg.Override(sbatpkg.Merge(entries, extra), builder.SBATGenerations, builder.SBATVendors)
+		if err != nil {
+			return nil, types.WithCategory(types.ErrInvalidInput, types.NewBuildError(StageGenerate, constants.SBAT, "", err))
+		}
+
+		sbat, err = sbatpkg.Marshal(entries)
+		if err != nil {
+			return nil, types.NewBuildError(StageGenerate, constants.SBAT, "", err)
+		}
 
-	if err = os.WriteFile(path, sbat, 0o600); err != nil {
-		return err
+		// the overrides can lower generations below the ones the policy allows
+		if builder.SBATPolicy != nil {
+			if err = builder.checkSBATPolicy("the generated SBAT", entries); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	// SBAT needs to be measured but NOT added
+	builder.log().Debug("Generated SBAT", "sbat", sbat, "path", builder.stub.Path())
+
+	// SBAT needs to be measured but NOT added, unless merged
 	// This is because we build with the systemd-stub as base, and that already has a .sbat section!
 	// So int he final PE file we will get the .sbat section in there, so we need to measure.
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.SBAT,
-			Path:    path,
-			Measure: true,
-		},
-	)
-
-	return nil
+	return builder.ephemeralSection(types.UkiSection{Name: constants.SBAT, Measure: true, Append: merge}, "sbat", sbat)
 }
 
-func (builder *Builder) generatePCRPublicKey() error {
+func (builder *Builder) generatePCRPublicKey() ([]types.UkiSection, error) {
 	if !builder.pcrSignEnabled() {
-		return nil
+		return nil, nil
 	}
-	slog.Debug("Getting Public PCR key")
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(builder.PCRSigner.PublicRSAKey())
+	builder.log().Debug("Getting Public PCR key")
+	publicKeyPEM, err := measure.PublicKeyPEM(builder.PCRSigner.PublicRSAKey())
 	if err != nil {
-		return err
+		return nil, types.NewBuildError(StageGenerate, constants.PCRPKey, "", err)
 	}
 
-	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  constants.PEMTypeRSAPublic,
-		Bytes: publicKeyBytes,
-	})
-
-	path := filepath.Join(builder.scratchDir, "pcr-public.pem")
+	return builder.ephemeralSection(types.UkiSection{Name: constants.PCRPKey, Append: true, Measure: true}, "pcr-public.pem", publicKeyPEM)
+}
 
-	if err = os.WriteFile(path, publicKeyPEM, 0o600); err != nil {
-		return err
+func (builder *Builder) generateFirmware() ([]types.UkiSection, error) {
+	if builder.Firmware == "" {
+		return nil, nil
 	}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.PCRPKey,
-			Path:    path,
-			Append:  true,
+	builder.log().Debug("Using firmware", "path", builder.Firmware)
+
+	return []types.UkiSection{
+		{
+			Name:    constants.EFIFW,
+			Path:    builder.Firmware,
 			Measure: true,
+			Append:  true,
 		},
-	)
-
-	return nil
-
+	}, nil
 }
 
-func (builder *Builder) generateKernel() error {
-	slog.Debug("Getting kernel")
+func (builder *Builder) generateKernel() ([]types.UkiSection, error) {
+	builder.log().Debug("Getting kernel")
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
+	return []types.UkiSection{
+		{
 			Name:    constants.Linux,
 			Path:    builder.KernelPath,
+			Source:  builder.KernelSource,
 			Append:  true,
 			Measure: true,
 		},
-	)
+	}, nil
+}
+
+// ephemeralSection returns the section with the generated data, kept in memory with InMemory
+// or written to the file in the scratch dir otherwise.
+func (builder *Builder) ephemeralSection(section types.UkiSection, file string, data []byte) ([]types.UkiSection, error) {
+	if builder.InMemory {
+		section.Source = types.BytesSource(data)
+
+		return []types.UkiSection{section}, nil
+	}
+
+	section.Path = filepath.Join(builder.scratchDir, file)
+
+	if err := os.WriteFile(section.Path, data, 0o600); err != nil {
+		return nil, types.NewBuildError(StageGenerate, section.Name, section.Path, err)
+	}
+
+	return []types.UkiSection{section}, nil
+}
+
+// sectionHashCache returns the cache of the section digests, the global one if set.
+//
+// It is kept across builds of the same builder, and shared with the recovery build,
+// so the kernel and the other shared inputs are read only once.
+func (builder *Builder) sectionHashCache() *pcr.HashCache {
+	if builder.hashCache == nil {
+		builder.hashCache = pcr.CurrentHashCache()
+	}
+
+	if builder.hashCache == nil {
+		builder.hashCache = pcr.NewHashCache()
+	}
+
+	return builder.hashCache
+}
+
+// buildCacheFile is the file holding the section digests in the build cache.
+const buildCacheFile = "hashes.json"
+
+// loadBuildCache uses the digests of the on-disk build cache, if enabled and not loaded yet.
+func (builder *Builder) loadBuildCache() error {
+	if builder.BuildCacheDir == "" || builder.hashCache != nil {
+		return nil
+	}
+
+	cache, err := pcr.LoadHashCache(filepath.Join(builder.BuildCacheDir, buildCacheFile))
+	if err != nil {
+		return fmt.Errorf("error loading build cache: %w", err)
+	}
+
+	builder.hashCache = cache
 
 	return nil
 }
 
+// saveBuildCache stores the section digests in the on-disk build cache, if enabled and hashed already.
+//
+// The cache only speeds up later builds, failing to save it is not fatal.
+func (builder *Builder) saveBuildCache() {
+	if builder.BuildCacheDir == "" || builder.hashCache == nil {
+		return
+	}
+
+	if err := builder.hashCache.Save(filepath.Join(builder.BuildCacheDir, buildCacheFile)); err != nil {
+		builder.log().Warn("Could not save the build cache", "dir", builder.BuildCacheDir, "error", err)
+	}
+}
+
 func (builder *Builder) generatePCRSig() error {
-	slog.Info("Generating PCR measurements")
-	slog.Debug("Using PCR slot", "number", constants.UKIPCR)
+	builder.log().Info("Generating PCR measurements")
+	builder.log().Debug("Using PCR slot", "number", constants.UKIPCR)
 	sectionsData := utils.SectionsData(builder.sections)
 
-	// If we have the signer sign the measurements and attach them to the uki file
-	if builder.pcrSignEnabled() {
-		slog.Info("Generating signed policy")
-		pcrData, err := measure.GenerateSignedPCR(sectionsData, builder.Phases, builder.PCRSigner, constants.UKIPCR)
+	// the signed policy, the measurements and the result hash the same sections, only do it once
+	opts := []measure.Option{
+		measure.WithProgress(builder.measureProgress),
+		measure.WithHashCache(builder.sectionHashCache().WithStats(&builder.hashStats)),
+		measure.WithContents(utils.SectionsContents(builder.sections)),
+		measure.WithLogger(builder.log()),
+	}
+
+	// If we have the signer, and the stub reads the signature, sign the measurements and attach them to the uki file
+	if builder.pcrSignEnabled() && builder.stub.Supports(constants.PCRSig) {
+		builder.log().Info("Generating signed policy")
+		pcrData, err := measure.GenerateSignedPCR(sectionsData, builder.Phases, builder.PCRSigner, constants.UKIPCR, opts...)
 		if err != nil {
 			return err
 		}
@@ -240,22 +346,24 @@ func (builder *Builder) generatePCRSig() error {
 			return err
 		}
 
-		path := filepath.Join(builder.scratchDir, "pcrpsig")
-
-		if err = os.WriteFile(path, pcrSignatureData, 0o600); err != nil {
+		pcrSig, err := builder.ephemeralSection(types.UkiSection{Name: constants.PCRSig, Append: true}, "pcrpsig", pcrSignatureData)
+		if err != nil {
 			return err
 		}
 
-		builder.sections = append(builder.sections,
-			types.UkiSection{
-				Name:   constants.PCRSig,
-				Path:   path,
-				Append: true,
-			},
-		)
+		builder.sections = append(builder.sections, pcrSig...)
+
+		builder.result.Measurements, err = measure.CalculateMeasurements(sectionsData, builder.Phases, constants.UKIPCR, opts...)
+		if err != nil {
+			return err
+		}
 	} else {
 		// Otherwise just measure and print the measurements
-		measure.GenerateMeasurements(sectionsData, builder.Phases, constants.UKIPCR)
+		measurements, err := measure.GenerateMeasurements(sectionsData, builder.Phases, constants.UKIPCR, opts...)
+		if err != nil {
+			return err
+		}
+		builder.result.Measurements = measurements
 	}
 
 	return nil
@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+)
+
+// Identity is the distribution the UKI is built for, written to the generated os-release and to the
+// SBAT entry of the UKI.
+type Identity struct {
+	// Product name, NAME of the os-release. constants.Name when empty.
+	Name string
+	// Lower case identifier, ID of the os-release and SBAT component. The lower case Name when empty.
+	ID string
+	// Vendor URL, HOME_URL of the os-release and URL of the SBAT entry.
+	URL string
+	// Vendor of the SBAT entry, Name when empty.
+	Vendor string
+	// SBAT generation of the UKI, bumped to revoke the previous UKIs. No SBAT entry is added when 0.
+	SBATGeneration int
+}
+
+// Resolve returns the identity with the defaults filled in.
+func (identity Identity) Resolve() Identity {
+	if identity.Name == "" {
+		identity.Name = constants.Name
+	}
+
+	if identity.ID == "" {
+		identity.ID = strings.ToLower(identity.Name)
+	}
+
+	if identity.Vendor == "" {
+		identity.Vendor = identity.Name
+	}
+
+	return identity
+}
+
+// osRelease returns the generated os-release of the given version.
+func (identity Identity) osRelease(version string) ([]byte, error) {
+	identity = identity.Resolve()
+
+	return constants.OSRelease(constants.OSReleaseInfo{
+		Name:    identity.Name,
+		ID:      identity.ID,
+		Version: version,
+		HomeURL: identity.URL,
+	})
+}
+
+// sbatEntries returns the SBAT entry of the UKI of the given version, none without SBATGeneration.
+func (identity Identity) sbatEntries(version string) []sbat.Entry {
+	if identity.SBATGeneration == 0 {
+		return nil
+	}
+
+	identity = identity.Resolve()
+
+	return []sbat.Entry{{
+		Component:  identity.ID,
+		Generation: identity.SBATGeneration,
+		Vendor:     identity.Vendor,
+		Package:    identity.ID,
+		Version:    version,
+		URL:        identity.URL,
+	}}
+}
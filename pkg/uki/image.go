@@ -0,0 +1,44 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/oci"
+)
+
+// pullImageInputs replaces the inputs given as a path in an OCI image, oci://registry/repository:tag!/path,
+// with the files pulled out of the image. They are kept in oci.CacheDir, like fetched stubs.
+func (builder *Builder) pullImageInputs() error {
+	for _, input := range []struct {
+		name string
+		path *string
+	}{
+		{"kernel", &builder.KernelPath},
+		{"initrd", &builder.InitrdPath},
+		{"os-release", &builder.OsRelease},
+		{"recovery initrd", &builder.RecoveryInitrdPath},
+	} {
+		if !oci.IsImagePath(*input.path) {
+			continue
+		}
+
+		client := builder.Registry
+		if client == nil {
+			client = &oci.Client{}
+		}
+
+		path, err := client.Pull(*input.path, builder.Arch)
+		if err != nil {
+			return fmt.Errorf("failed pulling the %s: %w", input.name, err)
+		}
+
+		builder.log().Info("Pulled "+input.name, "image", *input.path, "path", path)
+		*input.path = path
+	}
+
+	return nil
+}
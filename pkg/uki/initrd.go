@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// generateInitrdImage runs InitrdGenerator, if set, into the scratch dir, or next to the output for in
+// memory builds. InitrdPath points to the generated initrd until the state is closed.
+func (builder *Builder) generateInitrdImage(state *BuildState) error {
+	if builder.InitrdGenerator == nil {
+		return nil
+	}
+
+	var version string
+
+	// an initramfs tree is archived as is, whatever the kernel
+	if _, ok := builder.InitrdGenerator.(*initrd.Directory); !ok {
+		var err error
+
+		if version, err = builder.initrdKernelVersion(); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(builder.scratchDir, "initrd")
+	if builder.InMemory {
+		path = filepath.Join(filepath.Dir(builder.OutUKIPath), "."+filepath.Base(builder.OutUKIPath)+".initrd")
+	}
+
+	builder.log().Info("Generating initrd", "kernel", version)
+
+	if err := builder.InitrdGenerator.Generate(version, path); err != nil {
+		if builder.InMemory {
+			os.Remove(path) //nolint:errcheck
+		}
+
+		return types.NewBuildError(StageGenerate, constants.Initrd, path, fmt.Errorf("error generating initrd: %w", err))
+	}
+
+	builder.log().Info("Generated initrd", "path", path)
+	builder.InitrdPath = path
+
+	closeState := state.close
+	state.close = func() {
+		builder.InitrdPath = ""
+
+		if builder.InMemory {
+			os.Remove(path) //nolint:errcheck
+		}
+
+		closeState()
+	}
+
+	return nil
+}
+
+// initrdKernelVersion returns the kernel version to generate the initrd for, KernelVersion or the one
+// of the .uname section.
+func (builder *Builder) initrdKernelVersion() (string, error) {
+	if builder.KernelVersion != "" {
+		return builder.KernelVersion, nil
+	}
+
+	version, _ := builder.kernelRelease() //nolint:errcheck
+	if version == "" {
+		return "", types.WithCategory(types.ErrInvalidInput, errors.New("could not read the version of the kernel to generate the initrd for, set it explicitly"))
+	}
+
+	return version, nil
+}
@@ -0,0 +1,174 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// OutputInitrdAddon is the output kind of the addons carrying the initrd split out of the UKI.
+const OutputInitrdAddon = "initrd-addon"
+
+// initrdAlignment is the alignment systemd-stub pads the initrds it passes to the kernel to, so the
+// parts are concatenated back as they were split.
+const initrdAlignment = 4
+
+// splitInitrd splits an initrd larger than MaxInitrdSize: the first MaxInitrdSize bytes are embedded
+// in the UKI, the rest is carried by the initrd addons placed by placeInitrdAddons. The initrd is kept
+// whole until the returned function is called.
+func (builder *Builder) splitInitrd() (func(), error) {
+	done := func() {}
+
+	if builder.MaxInitrdSize <= 0 || (builder.InitrdPath == "" && builder.InitrdSource == nil) {
+		return done, nil
+	}
+
+	source := builder.InitrdSource
+	if source == nil {
+		f, err := os.Open(builder.InitrdPath)
+		if err != nil {
+			return nil, types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		st, err := f.Stat()
+		if err != nil {
+			f.Close() //nolint:errcheck
+
+			return nil, types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		source = &types.SectionSource{ReaderAt: f, Size: st.Size()}
+		done = func() { f.Close() } //nolint:errcheck
+	}
+
+	if source.Size <= builder.MaxInitrdSize {
+		done()
+
+		return func() {}, nil
+	}
+
+	if err := builder.checkRevoked(builder.AddonStubPath); err != nil {
+		done()
+
+		return nil, err
+	}
+
+	if err := builder.checkSBAT(builder.AddonStubPath); err != nil {
+		done()
+
+		return nil, err
+	}
+
+	// every part is a PE image of its own, held to the same limit
+	partSize := builder.MaxInitrdSize &^ (initrdAlignment - 1)
+
+	var parts []*types.SectionSource
+
+	for offset := int64(0); offset < source.Size; offset += partSize {
+		size := min(partSize, source.Size-offset)
+		parts = append(parts, &types.SectionSource{ReaderAt: io.NewSectionReader(source, offset, size), Size: size})
+	}
+
+	builder.warn("The initrd is larger than the maximum size, splitting it into addons",
+		"size", source.Size, "max", builder.MaxInitrdSize, "addons", len(parts)-1)
+
+	builder.initrdParts = parts
+
+	return func() {
+		builder.initrdParts = nil
+		done()
+	}, nil
+}
+
+// initrdSource returns the contents of the initrd embedded in the UKI, nil if read from InitrdPath.
+func (builder *Builder) initrdSource() *types.SectionSource {
+	if len(builder.initrdParts) > 0 {
+		return builder.initrdParts[0]
+	}
+
+	return builder.InitrdSource
+}
+
+// initrdAddonPaths returns the paths of the initrd addons, named so systemd-stub loads them in order.
+func (builder *Builder) initrdAddonPaths() []string {
+	if len(builder.initrdParts) < 2 {
+		return nil
+	}
+
+	width := len(strconv.Itoa(len(builder.initrdParts) - 1))
+	paths := make([]string, len(builder.initrdParts)-1)
+
+	for i := range paths {
+		paths[i] = filepath.Join(builder.extensionsDir(), fmt.Sprintf("initrd-%0*d.addon.efi", width, i+1))
+	}
+
+	return paths
+}
+
+// placeInitrdAddons builds the addons carrying the initrd split out of the UKI, signed if signing is
+// enabled, and adds them and the events systemd-stub extends into PCR 12 for them to the result.
+func (builder *Builder) placeInitrdAddons() error {
+	paths := builder.initrdAddonPaths()
+	if len(paths) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(builder.extensionsDir(), 0o755); err != nil {
+		return err
+	}
+
+	for i, path := range paths {
+		addon := &AddonBuilder{
+			AddonStubPath: builder.AddonStubPath,
+			Initrd:        builder.initrdParts[i+1],
+			OutPath:       path,
+			Logger:        builder.Logger,
+		}
+
+		if builder.sbSignEnabled() {
+			// the addons need the approvals too, the shared signer is left alone
+			signer := *builder.SecureBootSigner
+			signer.Threshold = builder.Approvals
+			addon.SecureBootSigner = &signer
+		}
+
+		builder.log().Info("Building initrd addon", "path", path)
+
+		if err := addon.Build(); err != nil {
+			return fmt.Errorf("error building initrd addon %s: %w", path, err)
+		}
+
+		if err := builder.recordOutput(OutputInitrdAddon, path, addon.SecureBootSigner != nil); err != nil {
+			return err
+		}
+
+		builder.result.Extensions = append(builder.result.Extensions, ExtensionResult{
+			Path:   path,
+			Kind:   OutputInitrdAddon,
+			PCR:    constants.KernelConfigPCR,
+			Events: addon.Measurements(),
+		})
+	}
+
+	return nil
+}
+
+// planInitrdAddons returns the outputs of the initrd addons.
+func (builder *Builder) planInitrdAddons() []PlannedOutput {
+	var outputs []PlannedOutput
+
+	for _, path := range builder.initrdAddonPaths() {
+		outputs = append(outputs, PlannedOutput{Kind: OutputInitrdAddon, Path: path, Signed: builder.sbSignEnabled()})
+	}
+
+	return outputs
+}
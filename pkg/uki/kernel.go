@@ -5,18 +5,213 @@
 package uki
 
 import (
+	"bufio"
 	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"debug/pe"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"os"
+	"os/exec"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// kernelProbeKey identifies a version of a kernel image.
+type kernelProbeKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// kernelProbe is the result of probing a kernel image.
+type kernelProbe struct {
+	version string
+	err     error
+}
+
+var (
+	kernelProbesMu sync.Mutex
+	kernelProbes   = map[kernelProbeKey]kernelProbe{}
 )
 
+// probeKernelVersion is DiscoverKernelVersion remembering the result as long as the kernel image
+// does not change, so rebuilds and the builds of a batch sharing the kernel do not read it again.
+func probeKernelVersion(kernelPath string) (string, error) {
+	st, err := os.Stat(kernelPath)
+	if err != nil || !st.Mode().IsRegular() {
+		return DiscoverKernelVersion(kernelPath)
+	}
+
+	key := kernelProbeKey{path: kernelPath, size: st.Size(), modTime: st.ModTime()}
+
+	kernelProbesMu.Lock()
+	probe, ok := kernelProbes[key]
+	kernelProbesMu.Unlock()
+
+	if ok {
+		return probe.version, probe.err
+	}
+
+	probe.version, probe.err = DiscoverKernelVersion(kernelPath)
+
+	kernelProbesMu.Lock()
+	defer kernelProbesMu.Unlock()
+
+	// drop stale results of the same path
+	for k := range kernelProbes {
+		if k.path == kernelPath {
+			delete(kernelProbes, k)
+		}
+	}
+
+	kernelProbes[key] = probe
+
+	return probe.version, probe.err
+}
+
+// kernelRelease returns the version of the kernel: Uname, the contents of UnamePath or the one read from
+// the kernel image.
+func (builder *Builder) kernelRelease() (string, error) {
+	switch {
+	case builder.Uname != "":
+		return builder.Uname, nil
+	case builder.UnamePath != "":
+		data, err := os.ReadFile(builder.UnamePath)
+		if err != nil {
+			return "", err
+		}
+
+		version := strings.TrimSpace(string(data))
+		if version == "" || strings.ContainsAny(version, " \t\n") {
+			return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid kernel version in %s", builder.UnamePath))
+		}
+
+		return version, nil
+	case builder.KernelSource != nil:
+		return readKernelVersion(builder.KernelSource.Open())
+	default:
+		return probeKernelVersion(builder.KernelPath)
+	}
+}
+
+// riscv64Magic is the magic of the header of riscv64 Image files, at the same offset as the arm64 one.
+const riscv64Magic = "RSC\x05"
+
+// checkKernelImage fails if the kernel is a Linux image built without CONFIG_EFI_STUB, as systemd-stub
+// only boots kernels which are PE files, or if it is built for another architecture than the stub.
+// Unknown images are left to the stub.
+func (builder *Builder) checkKernelImage() error {
+	var r io.ReaderAt
+
+	if builder.KernelSource != nil {
+		r = builder.KernelSource.Open()
+	} else {
+		f, err := os.Open(builder.KernelPath)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close() //nolint:errcheck
+
+		r = f
+	}
+
+	machine, err := kernelMachine(r)
+	if err != nil {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("kernel %s: %w", builder.KernelPath, err))
+	}
+
+	if machine == 0 || builder.stub == nil {
+		return nil
+	}
+
+	f, err := pe.Open(builder.stub.Path())
+	if err != nil {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("failed reading the stub %s: %w", builder.stub.Path(), err))
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	// the ia32 stub boots x86_64 kernels built with CONFIG_EFI_MIXED, through the EFI handover protocol
+	if f.Machine == machine || (f.Machine == pe.IMAGE_FILE_MACHINE_I386 && machine == pe.IMAGE_FILE_MACHINE_AMD64) {
+		return nil
+	}
+
+	return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("kernel %s is built for %s but the stub %s for %s, the firmware would fail to boot the UKI",
+		builder.KernelPath, machineName(machine), builder.stub.Path(), machineName(f.Machine)))
+}
+
+// machineName returns the EFI architecture name of a PE machine type, or its number when unknown.
+func machineName(machine uint16) string {
+	if arch, err := utils.EFIArch(machine); err == nil {
+		return arch
+	}
+
+	return fmt.Sprintf("machine %#x", machine)
+}
+
+// kernelMachine returns the PE machine type of the kernel image, 0 if it is not a PE file. It returns an
+// error if the kernel is an x86 bzImage, or an arm64 or riscv64 Image, without the PE header of the EFI
+// stub.
+func kernelMachine(r io.ReaderAt) (uint16, error) {
+	header := make([]byte, 1024)
+
+	n, err := r.ReadAt(header, 0)
+	if err != nil && (!errors.Is(err, io.EOF) || n == 0) {
+		return 0, err
+	}
+
+	header = header[:n]
+
+	// the MZ header points to the PE header, as the arm64 and riscv64 headers do at the same offset
+	if len(header) >= 0x40 && string(header[:2]) == "MZ" {
+		offset := int64(binary.LittleEndian.Uint32(header[0x3c:]))
+		signature := make([]byte, 6)
+
+		if _, err = r.ReadAt(signature, offset); err == nil && string(signature[:4]) == "PE\x00\x00" {
+			// the machine type follows the signature, unknown ones are left to the stub
+			machine := binary.LittleEndian.Uint16(signature[4:])
+			if _, err = utils.EFIArch(machine); err != nil {
+				return 0, nil
+			}
+
+			return machine, nil
+		}
+	}
+
+	var kind string
+
+	switch {
+	case len(header) >= 0x206 && string(header[0x202:0x206]) == "HdrS":
+		kind = "x86 bzImage"
+	case len(header) >= arm64HeaderSize && string(header[56:60]) == arm64Magic:
+		kind = "arm64 Image"
+	case len(header) >= arm64HeaderSize && string(header[56:60]) == riscv64Magic:
+		kind = "riscv64 Image"
+	default:
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("the %s has no EFI stub, systemd-stub can't boot it: rebuild it with CONFIG_EFI_STUB=y", kind)
+}
+
 // DiscoverKernelVersion reads kernel version from the kernel image.
 //
-// This only works for x86 kernel images.
-//
-// Based on https://www.kernel.org/doc/html/v5.6/x86/boot.html.
+// It is read from the setup header of x86 images, based on https://www.kernel.org/doc/html/v5.6/x86/boot.html,
+// or from the "Linux version" banner of the kernel otherwise: the one of arm64 images, once their header
+// is checked, of riscv64 images, of
+// EFI zboot images and of the payload of x86 images without a version in their header. Compressed
+// images and payloads are decompressed on the fly, gzip and bzip2 in process, zstd, xz, lzma, lz4 and
+// lzo with their command line tools.
 func DiscoverKernelVersion(kernelPath string) (string, error) {
 	f, err := os.Open(kernelPath)
 	if err != nil {
@@ -25,18 +220,133 @@ func DiscoverKernelVersion(kernelPath string) (string, error) {
 
 	defer f.Close() //nolint:errcheck
 
-	header := make([]byte, 1024)
+	return readKernelVersion(f)
+}
 
-	_, err = f.Read(header)
+// readKernelVersion reads the kernel version from the header of the kernel image, or its banner.
+func readKernelVersion(r io.ReaderAt) (string, error) {
+	format, payload, compression, err := kernelPayload(r)
 	if err != nil {
 		return "", err
 	}
 
-	// check header magic
-	if string(header[0x202:0x206]) != "HdrS" {
-		return "", errors.New("invalid kernel image")
+	if format != KernelFormatBzImage {
+		return payloadVersion(payload, compression)
 	}
 
+	header := make([]byte, 0x250)
+	if _, err = r.ReadAt(header, 0); err != nil {
+		return "", err
+	}
+
+	version, err := readSetupVersion(r, header)
+	if err == nil {
+		return version, nil
+	}
+
+	// the version is left out of the header of some images, the compressed payload has it
+	if banner, bannerErr := payloadVersion(payload, compression); bannerErr == nil {
+		return banner, nil
+	}
+
+	return "", err
+}
+
+// kernelPayload returns the format of the kernel image, the part of it holding the kernel and the name
+// of its compression, empty when it is to be found from its magic, or compressionNone.
+func kernelPayload(r io.ReaderAt) (string, *io.SectionReader, string, error) {
+	header := make([]byte, 1024)
+
+	n, err := r.ReadAt(header, 0)
+	if err != nil && (!errors.Is(err, io.EOF) || n == 0) {
+		return "", nil, "", err
+	}
+
+	header = header[:n]
+
+	switch {
+	case len(header) >= 0x250 && string(header[0x202:0x206]) == "HdrS":
+		setupSects := int64(header[0x1f1])
+		if setupSects == 0 {
+			setupSects = 4
+		}
+
+		// the compressed kernel follows the setup code
+		setupSize := (setupSects + 1) * 0x200
+		payload := io.NewSectionReader(r, setupSize+int64(binary.LittleEndian.Uint32(header[0x248:])), int64(binary.LittleEndian.Uint32(header[0x24c:])))
+
+		return KernelFormatBzImage, payload, "", nil
+	case len(header) >= arm64HeaderSize && string(header[56:60]) == arm64Magic:
+		arm64, err := parseARM64Header(header)
+		if err != nil {
+			return "", nil, "", err
+		}
+
+		size := int64(arm64.ImageSize)
+		if size == 0 {
+			size = math.MaxInt64
+		}
+
+		// the banner is within the image, bss excluded
+		return KernelFormatARM64, io.NewSectionReader(r, 0, size), compressionNone, nil
+	case len(header) >= arm64HeaderSize && string(header[56:60]) == riscv64Magic:
+		return KernelFormatRISCV64, io.NewSectionReader(r, 0, math.MaxInt64), compressionNone, nil
+	case len(header) >= 0x38 && string(header[:2]) == "MZ" && string(header[4:8]) == "zimg":
+		// EFI zboot image: offset and size of the payload, followed by the name of its compression
+		payload := io.NewSectionReader(r, int64(binary.LittleEndian.Uint32(header[8:])), int64(binary.LittleEndian.Uint32(header[12:])))
+		name, _, _ := bytes.Cut(header[24:56], []byte{0})
+
+		return KernelFormatZboot, payload, string(name), nil
+	default:
+		return KernelFormatUnknown, io.NewSectionReader(r, 0, math.MaxInt64), "", nil
+	}
+}
+
+// arm64Magic is the magic of the header of arm64 Image files.
+const arm64Magic = "ARM\x64"
+
+// arm64HeaderSize is the size of the header of arm64 Image files.
+const arm64HeaderSize = 64
+
+// arm64Header is the header of arm64 Image files, see https://www.kernel.org/doc/html/latest/arch/arm64/booting.html.
+type arm64Header struct {
+	// Offset of the image from a 2MB aligned base, 0 since Linux 5.8.
+	TextOffset uint64
+	// Size of the image once loaded, bss included, 0 before Linux 3.17.
+	ImageSize uint64
+	// Endianness, page size and placement of the kernel.
+	Flags uint64
+	// Offset of the PE header of images with an EFI stub, 0 without.
+	PEOffset uint32
+}
+
+// parseARM64Header parses and checks the header of an arm64 Image.
+func parseARM64Header(header []byte) (*arm64Header, error) {
+	if len(header) < arm64HeaderSize || string(header[56:60]) != arm64Magic {
+		return nil, errors.New("invalid arm64 kernel image")
+	}
+
+	h := &arm64Header{
+		TextOffset: binary.LittleEndian.Uint64(header[8:]),
+		ImageSize:  binary.LittleEndian.Uint64(header[16:]),
+		Flags:      binary.LittleEndian.Uint64(header[24:]),
+		PEOffset:   binary.LittleEndian.Uint32(header[60:]),
+	}
+
+	switch {
+	case h.Flags&1 != 0:
+		return nil, errors.New("invalid arm64 kernel image: big-endian kernels can't be booted by UEFI")
+	case h.TextOffset%4096 != 0:
+		return nil, fmt.Errorf("invalid arm64 kernel image: unaligned text offset %#x", h.TextOffset)
+	case h.ImageSize != 0 && h.ImageSize < arm64HeaderSize:
+		return nil, fmt.Errorf("invalid arm64 kernel image: image size %d", h.ImageSize)
+	}
+
+	return h, nil
+}
+
+// readSetupVersion reads the kernel version from the setup header of an x86 image.
+func readSetupVersion(r io.ReaderAt, header []byte) (string, error) {
 	setupSects := header[0x1f1]
 	versionOffset := binary.LittleEndian.Uint16(header[0x20e:0x210])
 
@@ -52,7 +362,7 @@ func DiscoverKernelVersion(kernelPath string) (string, error) {
 
 	version := make([]byte, 256)
 
-	_, err = f.ReadAt(version, int64(versionOffset))
+	_, err := r.ReadAt(version, int64(versionOffset))
 	if err != nil {
 		return "", err
 	}
@@ -67,3 +377,170 @@ func DiscoverKernelVersion(kernelPath string) (string, error) {
 
 	return versionString, nil
 }
+
+// kernelCompressions are the compressions of kernel payloads and their magic, the names are the ones of
+// the EFI zboot header.
+var kernelCompressions = []struct {
+	name  string
+	magic []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"bzip2", []byte("BZh")},
+	{"xzkern", []byte{0xfd, '7', 'z', 'X', 'Z', 0}},
+	{"zstd22", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"lz4", []byte{0x02, 0x21, 0x4c, 0x18}},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	{"lzo", []byte{0x89, 'L', 'Z', 'O'}},
+	{"lzma", []byte{0x5d, 0, 0}},
+}
+
+// compressionNone is the compression of the kernel payloads scanned as is, whatever their magic.
+const compressionNone = "none"
+
+// kernelDecompressors are the command line tools decompressing the payloads not decompressed in process.
+var kernelDecompressors = map[string][]string{
+	"xzkern": {"xz", "-dc"},
+	"lzma":   {"xz", "--format=lzma", "-dc"},
+	"zstd22": {"zstd", "-dc"},
+	"lz4":    {"lz4", "-dc"},
+	"lzo":    {"lzop", "-dc"},
+}
+
+// payloadVersion reads the kernel version from the banner of the payload, decompressed according to
+// the compression name, or its magic if empty. Payloads of unknown compression are scanned as is.
+func payloadVersion(payload io.Reader, compression string) (string, error) {
+	decompressed, _, done, err := decompressKernel(payload, compression)
+	if err != nil {
+		return "", err
+	}
+
+	defer done()
+
+	return bannerVersion(decompressed)
+}
+
+// decompressKernel returns the decompressed payload, decompressed according to the compression name,
+// or its magic if empty, and the name of its compression, empty if it is not compressed. done must be
+// called once done with the payload.
+func decompressKernel(payload io.Reader, compression string) (decompressed io.Reader, name string, done func(), err error) {
+	br := bufio.NewReaderSize(payload, 1<<16)
+
+	if compression == "" {
+		magic, _ := br.Peek(8) //nolint:errcheck
+
+		for _, c := range kernelCompressions {
+			if bytes.HasPrefix(magic, c.magic) {
+				compression = c.name
+
+				break
+			}
+		}
+	}
+
+	switch compression {
+	case "", compressionNone:
+		return br, "", func() {}, nil
+	case "gzip":
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		// the payload is followed by its size
+		zr.Multistream(false)
+
+		return zr, compression, func() {}, nil
+	case "bzip2":
+		return bzip2.NewReader(br), compression, func() {}, nil
+	default:
+		tool, ok := kernelDecompressors[compression]
+		if !ok {
+			return nil, "", nil, fmt.Errorf("unknown kernel compression %q", compression)
+		}
+
+		cmd := exec.Command(tool[0], tool[1:]...)
+		cmd.Stdin = br
+
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		if err = cmd.Start(); err != nil {
+			return nil, "", nil, fmt.Errorf("failed decompressing the %s kernel: %w", compression, err)
+		}
+
+		return out, compression, func() {
+			_ = cmd.Process.Kill() //nolint:errcheck
+			_ = cmd.Wait()         //nolint:errcheck
+		}, nil
+	}
+}
+
+// kernelBanner starts the banner of the kernel, followed by its version, i.e. "Linux version 6.1.0-13-arm64 (...".
+var kernelBanner = []byte("Linux version ")
+
+// bannerVersion scans the kernel for its banner and returns its version.
+func bannerVersion(r io.Reader) (string, error) {
+	banner, err := findBanner(r)
+	if err != nil {
+		return "", err
+	}
+
+	version, _, _ := strings.Cut(strings.TrimPrefix(banner, string(kernelBanner)), " ")
+
+	return version, nil
+}
+
+// findBanner scans the kernel for its banner and returns it, up to the end of its line.
+func findBanner(r io.Reader) (string, error) {
+	// bound of the length of the banner
+	const maxBanner = 512
+
+	buf := make([]byte, 0, 2<<16)
+	chunk := make([]byte, 1<<16)
+
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		for {
+			idx := bytes.Index(buf, kernelBanner)
+			if idx == -1 {
+				// keep what may be the start of the banner
+				buf = append(buf[:0], buf[max(len(buf)-len(kernelBanner), 0):]...)
+
+				break
+			}
+
+			rest := buf[idx+len(kernelBanner):]
+			end := bytes.IndexAny(rest, "\n\x00")
+
+			if end == -1 && len(rest) < maxBanner && err == nil {
+				// the banner goes on in the next chunk
+				buf = append(buf[:0], buf[idx:]...)
+
+				break
+			}
+
+			if end == -1 {
+				end = min(len(rest), maxBanner)
+			}
+
+			// skip the format strings mentioning the banner
+			if end > 0 && rest[0] >= '0' && rest[0] <= '9' {
+				return string(kernelBanner) + string(rest[:end]), nil
+			}
+
+			buf = rest
+		}
+
+		if errors.Is(err, io.EOF) {
+			return "", errors.New("no kernel version banner")
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Formats of kernel images, see KernelInfo.
+const (
+	KernelFormatBzImage = "bzImage"
+	KernelFormatARM64   = "arm64"
+	KernelFormatRISCV64 = "riscv64"
+	KernelFormatZboot   = "zboot"
+	KernelFormatUnknown = "unknown"
+)
+
+// KernelReportOptions are the options of the embedded kernel configuration reported in KernelInfo:
+// the ones deciding how the UKI boots, and the ones auditors look for.
+var KernelReportOptions = []string{
+	"CONFIG_EFI_STUB",
+	"CONFIG_EFI_ZBOOT",
+	"CONFIG_EFI_MIXED",
+	"CONFIG_EFI_HANDOVER_PROTOCOL",
+	"CONFIG_BLK_DEV_INITRD",
+	"CONFIG_RD_GZIP",
+	"CONFIG_RD_ZSTD",
+	"CONFIG_RD_XZ",
+	"CONFIG_KERNEL_GZIP",
+	"CONFIG_KERNEL_ZSTD",
+	"CONFIG_KERNEL_XZ",
+	"CONFIG_MODULE_SIG",
+	"CONFIG_MODULE_SIG_FORCE",
+	"CONFIG_MODULE_SIG_HASH",
+	"CONFIG_SECURITY_LOCKDOWN_LSM",
+	"CONFIG_LOCK_DOWN_KERNEL_FORCE_INTEGRITY",
+	"CONFIG_LOCK_DOWN_KERNEL_FORCE_CONFIDENTIALITY",
+	"CONFIG_INTEGRITY_MACHINE_KEYRING",
+	"CONFIG_IMA",
+	"CONFIG_TCG_TPM",
+	"CONFIG_DM_VERITY",
+	"CONFIG_DM_VERITY_VERIFY_ROOTHASH_SIG",
+	"CONFIG_BLK_DEV_LOOP",
+	"CONFIG_SQUASHFS",
+	"CONFIG_EROFS_FS",
+	"CONFIG_OVERLAY_FS",
+}
+
+// ikconfigMarker starts the gzipped configuration embedded in kernels built with CONFIG_IKCONFIG.
+var ikconfigMarker = []byte("IKCFG_ST")
+
+// ErrNoKernelConfig is returned when the kernel has no embedded configuration, i.e. it is built without
+// CONFIG_IKCONFIG or with it as a module.
+var ErrNoKernelConfig = errors.New("no embedded kernel configuration, the kernel is built without CONFIG_IKCONFIG=y")
+
+// maxKernelConfig bounds the size of the decompressed kernel configuration.
+const maxKernelConfig = 4 << 20
+
+// KernelInfo describes a kernel image, for auditing the kernels UKIs are built from.
+type KernelInfo struct {
+	// Format of the image, i.e. bzImage or arm64, unknown when it is not a Linux image.
+	Format string `json:"format"`
+	// EFI architecture of the PE image, empty if it is not one.
+	Arch string `json:"arch,omitempty"`
+	// Whether the image is a PE file, as the images of kernels built with CONFIG_EFI_STUB are.
+	EFIStub bool `json:"efiStub"`
+	// Compression of the kernel in the image, empty if it is not compressed.
+	Compression string `json:"compression,omitempty"`
+	// Banner of the kernel, i.e. Linux version 6.1.0 (builder@host) (gcc ...) #1 SMP ..., empty if not found.
+	Banner string `json:"banner,omitempty"`
+	// SHA256 of the configuration embedded with CONFIG_IKCONFIG in hex, empty if there is none.
+	ConfigSHA256 string `json:"configSha256,omitempty"`
+	// Values of the KernelReportOptions in the embedded configuration, n for the unset ones.
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// InspectKernel describes the kernel image at path. The banner and the embedded configuration are
+// read from the decompressed kernel, and left out when they can't be found.
+func InspectKernel(path string) (*KernelInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	return inspectKernel(f)
+}
+
+// ReadKernelConfig returns the configuration embedded in the kernel image at path, as a .config file.
+// It returns ErrNoKernelConfig if the kernel has none.
+func ReadKernelConfig(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	_, payload, compression, err := kernelPayload(f)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, _, done, err := decompressKernel(payload, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	defer done()
+
+	return findKernelConfig(decompressed)
+}
+
+// inspectKernel describes the kernel image.
+func inspectKernel(r io.ReaderAt) (*KernelInfo, error) {
+	info := &KernelInfo{}
+
+	machine, err := kernelMachine(r)
+	if err == nil && machine != 0 {
+		info.EFIStub = true
+		info.Arch = machineName(machine)
+	}
+
+	format, payload, compression, err := kernelPayload(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Format = format
+
+	// the banner and the configuration are looked for in two passes, as their order is not known
+	decompressed, name, done, err := decompressKernel(payload, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Compression = name
+	info.Banner, _ = findBanner(decompressed) //nolint:errcheck
+
+	done()
+
+	if _, err = payload.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if decompressed, _, done, err = decompressKernel(payload, compression); err != nil {
+		return nil, err
+	}
+
+	defer done()
+
+	config, err := findKernelConfig(decompressed)
+	if errors.Is(err, ErrNoKernelConfig) {
+		return info, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed reading the kernel configuration: %w", err)
+	}
+
+	sum := sha256.Sum256(config)
+	info.ConfigSHA256 = hex.EncodeToString(sum[:])
+	info.Config = kernelConfigOptions(config, KernelReportOptions)
+
+	return info, nil
+}
+
+// findKernelConfig scans the decompressed kernel for its embedded configuration and decompresses it.
+func findKernelConfig(r io.Reader) ([]byte, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	start := ikconfigMarker
+
+	for {
+		buf, err := br.Peek(br.Size())
+		if idx := bytes.Index(buf, start); idx != -1 {
+			if _, err = br.Discard(idx + len(start)); err != nil {
+				return nil, err
+			}
+
+			break
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, ErrNoKernelConfig
+			}
+
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				return nil, err
+			}
+		}
+
+		// keep what may be the start of the marker
+		if _, err = br.Discard(max(len(buf)-len(start)+1, 1)); err != nil {
+			return nil, err
+		}
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	zr.Multistream(false)
+
+	config, err := io.ReadAll(io.LimitReader(zr, maxKernelConfig+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config) > maxKernelConfig {
+		return nil, errors.New("the kernel configuration is too large")
+	}
+
+	return config, nil
+}
+
+// kernelConfigOptions returns the values of the options in the .config file, n for the unset ones.
+func kernelConfigOptions(config []byte, options []string) map[string]string {
+	values := make(map[string]string, len(options))
+	for _, option := range options {
+		values[option] = "n"
+	}
+
+	for _, line := range strings.Split(string(config), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(name, "#") {
+			continue
+		}
+
+		if _, wanted := values[name]; wanted {
+			values[name] = strings.Trim(value, `"`)
+		}
+	}
+
+	return values
+}
+
+// inspectKernelImage records the description of the kernel in the result if KernelReport is set. The
+// build goes on without it when the kernel can't be read.
+func (builder *Builder) inspectKernelImage() {
+	if !builder.KernelReport {
+		return
+	}
+
+	var (
+		info *KernelInfo
+		err  error
+	)
+
+	if builder.KernelSource != nil {
+		info, err = inspectKernel(builder.KernelSource.Open())
+	} else {
+		info, err = InspectKernel(builder.KernelPath)
+	}
+
+	if err != nil {
+		builder.warn("Could not inspect the kernel", "error", err)
+
+		return
+	}
+
+	if info.Config == nil {
+		builder.warn("The kernel has no embedded configuration, only its banner is reported")
+	}
+
+	builder.result.KernelInfo = info
+}
@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Kernel signature modes, see Builder.KernelSignature.
+const (
+	// KernelSignatureRecord records the vendor signatures of the kernel in the result.
+	KernelSignatureRecord = "record"
+	// KernelSignatureRequire records them, and fails the build unless one of them is valid and, if
+	// KernelCAs is given, chains to one of the CAs.
+	KernelSignatureRequire = "require"
+)
+
+// KernelResult describes the vendor signatures of the kernel embedded in the UKI.
+type KernelResult struct {
+	// Authenticode SHA256 of the kernel in hex.
+	Digest string `json:"digest"`
+	// Signatures of the kernel, none if it is unsigned.
+	Signatures []KernelSignatureResult `json:"signatures"`
+}
+
+// KernelSignatureResult is a vendor signature of the kernel.
+type KernelSignatureResult struct {
+	// Subject, issuer and serial number of the signer certificate, empty if the signature is invalid.
+	Subject string `json:"subject,omitempty"`
+	Issuer  string `json:"issuer,omitempty"`
+	Serial  string `json:"serial,omitempty"`
+	// SHA256 of the signer certificate in hex.
+	SHA256 string `json:"sha256,omitempty"`
+	// Whether the signature covers the kernel and chains to one of the kernel CAs, or is valid when there are none.
+	Verified bool `json:"verified"`
+	// Why the signature could not be verified.
+	Error string `json:"error,omitempty"`
+}
+
+// checkKernelSignature records the vendor signatures of the kernel in the result, and requires a valid
+// one with KernelSignatureRequire.
+//
+// The kernel is embedded as is, so its signature is kept for the vendor chain either way.
+func (builder *Builder) checkKernelSignature() error {
+	if builder.KernelSignature == "" {
+		return nil
+	}
+
+	require := builder.KernelSignature == KernelSignatureRequire
+
+	if builder.KernelSource != nil {
+		if require {
+			return types.WithCategory(types.ErrInvalidInput, errors.New("the signature of a streamed kernel can't be checked"))
+		}
+
+		builder.warn("Not recording the signature of the streamed kernel")
+
+		return nil
+	}
+
+	cas := make([]*x509.Certificate, 0, len(builder.KernelCAs))
+
+	for _, path := range builder.KernelCAs {
+		ca, err := pesign.LoadCertificate(path)
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("kernel CA %s: %w", path, err))
+		}
+
+		cas = append(cas, ca)
+	}
+
+	digest, signatures, err := pesign.Signatures(builder.KernelPath)
+	if err != nil && require {
+		return types.WithCategory(types.ErrVerification, fmt.Errorf("failed reading the kernel signatures: %w", err))
+	}
+
+	if err != nil {
+		builder.warn("Could not read the kernel signatures", "error", err)
+
+		return nil
+	}
+
+	kernel := &KernelResult{Digest: hex.EncodeToString(digest), Signatures: []KernelSignatureResult{}}
+	verified := false
+
+	for _, signature := range signatures {
+		result := KernelSignatureResult{}
+
+		if signature.Signer != nil {
+			sum := sha256.Sum256(signature.Signer.Raw)
+
+			result.Subject = signature.Signer.Subject.String()
+			result.Issuer = signature.Signer.Issuer.String()
+			result.Serial = signature.Signer.SerialNumber.String()
+			result.SHA256 = hex.EncodeToString(sum[:])
+		}
+
+		roots := cas
+		if len(roots) == 0 && signature.Signer != nil {
+			// any valid signature
+			roots = []*x509.Certificate{signature.Signer}
+		}
+
+		if err := signature.Verify(roots); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Verified = true
+			verified = true
+		}
+
+		kernel.Signatures = append(kernel.Signatures, result)
+	}
+
+	builder.result.Kernel = kernel
+
+	switch {
+	case verified:
+		builder.log().Info("Kernel signature verified", "signatures", len(signatures))
+	case len(signatures) == 0 && require:
+		return types.WithCategory(types.ErrVerification, errors.New("the kernel is not signed"))
+	case require:
+		return types.WithCategory(types.ErrVerification, errors.New("no kernel signature could be verified"))
+	case len(signatures) == 0:
+		builder.log().Info("Kernel is not signed")
+	default:
+		builder.warn("No kernel signature could be verified", "signatures", len(signatures))
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// SectionOrder is the policy laying out the sections of the UKI.
+//
+// The listed sections come first, in this order. The others follow in the order of their generators,
+// see DefaultGenerators, the sections added with AddSection coming right before the kernel. Whatever
+// the order, systemd-stub needs:
+//   - .linux after all the other sections read from the inputs, to account for the kernel decompression.
+//     If listed, it must be the last one.
+//   - .pcrsig last, as it is generated from the measurements of the sections laid out before it.
+//     It can't be listed.
+//
+// Each section is listed once. Sections not in the UKI may be listed, they are skipped.
+type SectionOrder []constants.Section
+
+// DefaultSectionOrder returns the order the default generators lay the sections out in, to adjust it
+// i.e. with Insert.
+func DefaultSectionOrder() SectionOrder {
+	return SectionOrder{
+		constants.OSRel,
+		constants.CMDLine,
+		constants.Initrd,
+		constants.Splash,
+		constants.Uname,
+		constants.SBAT,
+		constants.PCRPKey,
+		constants.EFIFW,
+		constants.Linux,
+	}
+}
+
+// Insert returns a copy of the order with the sections inserted right before the listed section before.
+func (order SectionOrder) Insert(before constants.Section, sections ...constants.Section) (SectionOrder, error) {
+	i := slices.Index(order, before)
+	if i < 0 {
+		return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("section %s is not in the section order", before))
+	}
+
+	return slices.Insert(slices.Clone(order), i, sections...), nil
+}
+
+// Validate checks the order follows the rules of the stub.
+func (order SectionOrder) Validate() error {
+	var errs []error
+
+	for i, name := range order {
+		if err := checkSectionName(name); err != nil {
+			errs = append(errs, err)
+		}
+
+		if slices.Contains(order[:i], name) {
+			errs = append(errs, fmt.Errorf("section %s is listed twice in the section order", name))
+		}
+
+		switch {
+		case name == constants.PCRSig:
+			errs = append(errs, errors.New("section .pcrsig is always last, it can't be ordered"))
+		case name == constants.Linux && i != len(order)-1:
+			errs = append(errs, errors.New("section .linux must be the last one of the section order"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// rank returns the position of the section in the layout: listed, unlisted, kernel and PCR signature.
+func (order SectionOrder) rank(name constants.Section) int {
+	switch name {
+	case constants.Linux:
+		return len(order) + 1
+	case constants.PCRSig:
+		return len(order) + 2
+	}
+
+	if i := slices.Index(order, name); i >= 0 {
+		return i
+	}
+
+	return len(order)
+}
+
+// Compare compares the positions of two sections in the layout, as in slices.SortStableFunc.
+// Unlisted sections compare equal, so a stable sort keeps their order.
+func (order SectionOrder) Compare(a, b constants.Section) int {
+	return order.rank(a) - order.rank(b)
+}
+
+// Sort lays the sections out in the order.
+func (order SectionOrder) Sort(sections []Section) {
+	slices.SortStableFunc(sections, func(a, b Section) int {
+		return order.Compare(a.Name, b.Name)
+	})
+}
+
+// orderSections lays the sections out in SectionOrder, the ones it does not list follow in their order.
+// Without SectionOrder the kernel is still moved last, i.e. after the sections of an inserted generator.
+func (builder *Builder) orderSections() {
+	builder.SectionOrder.Sort(builder.sections)
+}
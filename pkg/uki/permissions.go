@@ -0,0 +1,109 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultOutputMode is the mode of the outputs when OutputMode is not set, but for the unsigned UKI.
+const defaultOutputMode = 0o644
+
+// outputMode returns the mode of the output of the kind, OutputMode if set.
+func (builder *Builder) outputMode(kind string, signed bool) os.FileMode {
+	switch {
+	case builder.OutputMode != 0:
+		return builder.OutputMode
+	case kind == "uki" && !signed:
+		return unsignedMode
+	default:
+		return defaultOutputMode
+	}
+}
+
+// setOutputMode gives the output its mode and owner, once in place. Outputs are written from files
+// created 0600, so they are never more open than asked for.
+//
+// Directories, i.e. the bundle, keep their mode, their files get the output mode.
+func (builder *Builder) setOutputMode(path string, mode os.FileMode) error {
+	uid, gid, err := parseOwner(builder.OutputOwner)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			if err = os.Chmod(p, mode); err != nil {
+				return err
+			}
+		}
+
+		if uid == -1 && gid == -1 {
+			return nil
+		}
+
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// parseOwner resolves the user[:group] owner, each a name or an id, to its uid and gid. Either can be
+// left out, i.e. :group, and is -1, unchanged, then.
+func parseOwner(owner string) (uid, gid int, err error) {
+	name, group, _ := strings.Cut(owner, ":")
+
+	uid, gid = -1, -1
+
+	if name != "" {
+		if uid, err = lookupID(name, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+
+			return u.Uid, nil
+		}); err != nil {
+			return 0, 0, fmt.Errorf("invalid output owner %q: %w", owner, err)
+		}
+	}
+
+	if group != "" {
+		if gid, err = lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+
+			return g.Gid, nil
+		}); err != nil {
+			return 0, 0, fmt.Errorf("invalid output owner %q: %w", owner, err)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// lookupID returns the id given as is, or the id of the name found with lookup.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id)
+}
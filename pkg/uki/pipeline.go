@@ -0,0 +1,219 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Section is a section of the UKI, read from Path or Source.
+//
+// Measure adds it to the PCR 11 measurements, only the sections systemd-stub measures can be measured.
+// Append adds it to the stub, otherwise it is only measured, i.e. it is in the stub already.
+type Section = types.UkiSection
+
+// SectionGenerator generates sections of the UKI out of the builder inputs.
+//
+// The generators of a build run concurrently, they must only read the builder.
+type SectionGenerator interface {
+	// Name identifies the generator, to replace or remove it.
+	Name() string
+	// Generate returns the sections, none to leave them out.
+	Generate(builder *Builder) ([]Section, error)
+}
+
+// Names of the default generators.
+const (
+	GeneratorOSRelease = "os-release"
+	GeneratorCmdline   = "cmdline"
+	GeneratorInitrd    = "initrd"
+	GeneratorSplash    = "splash"
+	GeneratorUname     = "uname"
+	GeneratorSBAT      = "sbat"
+	GeneratorPCRPKey   = "pcrpkey"
+	GeneratorFirmware  = "firmware"
+	GeneratorKernel    = "kernel"
+)
+
+type generatorFunc struct {
+	name     string
+	generate func(builder *Builder) ([]Section, error)
+}
+
+func (g generatorFunc) Name() string {
+	return g.name
+}
+
+func (g generatorFunc) Generate(builder *Builder) ([]Section, error) {
+	return g.generate(builder)
+}
+
+// GeneratorFunc returns a SectionGenerator calling generate.
+func GeneratorFunc(name string, generate func(builder *Builder) ([]Section, error)) SectionGenerator {
+	return generatorFunc{name: name, generate: generate}
+}
+
+// DefaultGenerators returns the generators of the sections of a UKI, in layout order.
+func DefaultGenerators() []SectionGenerator {
+	return []SectionGenerator{
+		GeneratorFunc(GeneratorOSRelease, (*Builder).generateOSRel),
+		GeneratorFunc(GeneratorCmdline, (*Builder).generateCmdline),
+		GeneratorFunc(GeneratorInitrd, (*Builder).generateInitrd),
+		GeneratorFunc(GeneratorSplash, (*Builder).generateSplash),
+		GeneratorFunc(GeneratorUname, (*Builder).generateUname),
+		GeneratorFunc(GeneratorSBAT, (*Builder).generateSBAT),
+		GeneratorFunc(GeneratorPCRPKey, (*Builder).generatePCRPublicKey),
+		GeneratorFunc(GeneratorFirmware, (*Builder).generateFirmware),
+		// append kernel last to account for decompression
+		GeneratorFunc(GeneratorKernel, (*Builder).generateKernel),
+	}
+}
+
+// generators returns the generators of the build, the default ones unless Generators is set.
+func (builder *Builder) generators() []SectionGenerator {
+	if builder.Generators == nil {
+		return DefaultGenerators()
+	}
+
+	return builder.Generators
+}
+
+// generatorIndex returns the position of the named generator, starting from the default ones.
+func (builder *Builder) generatorIndex(name string) (int, error) {
+	builder.Generators = builder.generators()
+
+	i := slices.IndexFunc(builder.Generators, func(g SectionGenerator) bool { return g.Name() == name })
+	if i < 0 {
+		return 0, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("unknown section generator %s", name))
+	}
+
+	return i, nil
+}
+
+// ReplaceGenerator replaces the named generator, i.e. GeneratorOSRelease by one providing the distro os-release.
+func (builder *Builder) ReplaceGenerator(name string, generator SectionGenerator) error {
+	i, err := builder.generatorIndex(name)
+	if err != nil {
+		return err
+	}
+
+	builder.Generators = slices.Clone(builder.Generators)
+	builder.Generators[i] = generator
+
+	return nil
+}
+
+// RemoveGenerator leaves the sections of the named generator out, i.e. GeneratorSplash for no splash.
+func (builder *Builder) RemoveGenerator(name string) error {
+	i, err := builder.generatorIndex(name)
+	if err != nil {
+		return err
+	}
+
+	builder.Generators = slices.Delete(slices.Clone(builder.Generators), i, i+1)
+
+	return nil
+}
+
+// InsertGenerator adds a generator after the named one, its sections are then laid out after the ones of it.
+func (builder *Builder) InsertGenerator(after string, generator SectionGenerator) error {
+	i, err := builder.generatorIndex(after)
+	if err != nil {
+		return err
+	}
+
+	if _, err = builder.generatorIndex(generator.Name()); err == nil {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("section generator %s added twice", generator.Name()))
+	}
+
+	builder.Generators = slices.Insert(slices.Clone(builder.Generators), i+1, generator)
+
+	return nil
+}
+
+// maxSectionName is the length of the PE section names, longer ones can't be stored in the section table.
+const maxSectionName = 8
+
+// AddSection adds a section to the UKI on top of the generated ones, i.e. a .dtb or a vendor section.
+//
+// It replaces the generated section with the same name if any, otherwise it is placed before the kernel,
+// see SectionOrder. The section is measured, assembled and signed like the generated ones.
+func (builder *Builder) AddSection(section Section) error {
+	if err := checkSection(section); err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	if slices.ContainsFunc(builder.addedSections, func(added Section) bool { return added.Name == section.Name }) {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("section %s added twice", section.Name))
+	}
+
+	builder.addedSections = append(builder.addedSections, section)
+
+	return nil
+}
+
+// checkSectionName checks the name can be stored in the PE section table.
+func checkSectionName(section constants.Section) error {
+	name := string(section)
+
+	switch {
+	case !strings.HasPrefix(name, ".") || len(name) < 2:
+		return fmt.Errorf("invalid section name %q", name)
+	case len(name) > maxSectionName:
+		return fmt.Errorf("section name %s is too long", name)
+	}
+
+	return nil
+}
+
+// checkSection checks a section can be assembled and measured as asked.
+func checkSection(section Section) error {
+	name := string(section.Name)
+
+	if err := checkSectionName(section.Name); err != nil {
+		return err
+	}
+
+	switch {
+	case section.Name == constants.PCRSig:
+		return fmt.Errorf("section %s is generated from the measurements", name)
+	case (section.Path == "") == (section.Source == nil):
+		return fmt.Errorf("section %s needs either a path or a source", name)
+	case section.Measure && !slices.Contains(constants.OrderedSections(), section.Name):
+		return fmt.Errorf("section %s is not measured by systemd-stub", name)
+	case !section.Measure && !section.Append:
+		return fmt.Errorf("section %s is neither measured nor appended", name)
+	}
+
+	return nil
+}
+
+// addSections merges the added sections into the generated ones, replacing them or placing them before the kernel.
+func (builder *Builder) addSections(sections []types.UkiSection) []types.UkiSection {
+	for _, added := range builder.addedSections {
+		// the size and VMA are filled in by assembling
+		added.Size, added.VMA = 0, 0
+
+		if i := slices.IndexFunc(sections, func(s types.UkiSection) bool { return s.Name == added.Name }); i >= 0 {
+			sections[i] = added
+
+			continue
+		}
+
+		i := slices.IndexFunc(sections, func(s types.UkiSection) bool { return s.Name == constants.Linux })
+		if i < 0 {
+			i = len(sections)
+		}
+
+		sections = slices.Insert(sections, i, added)
+	}
+
+	return sections
+}
@@ -0,0 +1,204 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kairos-io/go-ukify/internal/common"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Plan describes what a build would produce.
+type Plan struct {
+	// Outputs the build would write.
+	Outputs []PlannedOutput `json:"outputs"`
+	// Sections the build would embed in and/or measure into the UKI.
+	//
+	// The PCR signature is only known once signed, so it is listed without contents.
+	Sections []SectionResult `json:"sections"`
+	// Expected PCR values for each bank and phase.
+	Measurements []types.PCRMeasurement `json:"measurements,omitempty"`
+	// Warnings raised while planning.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// PlannedOutput is a file the build would write.
+type PlannedOutput struct {
+	// Kind of output, i.e. uki or sd-boot.
+	Kind string `json:"kind"`
+	// Path to the output file.
+	Path string `json:"path"`
+	// Whether the output would be signed for SecureBoot.
+	Signed bool `json:"signed"`
+}
+
+// Plan validates the inputs and keys, and computes the sections and measurements of the UKI
+// without signing or writing any output.
+func (builder *Builder) Plan() (*Plan, error) {
+	var err error
+
+	builder.result = Result{}
+
+	defer builder.destroyKeys()
+
+	if err = builder.init(); err != nil {
+		return nil, err
+	}
+
+	removeScratchDir, err := builder.makeScratchDir("")
+	if err != nil {
+		return nil, err
+	}
+
+	defer removeScratchDir()
+
+	if err = builder.checkRevoked(builder.stub.Path(), builder.SdBootPath); err != nil {
+		return nil, err
+	}
+
+	if err = builder.checkSBAT(builder.stub.Path(), builder.SdBootPath); err != nil {
+		return nil, err
+	}
+
+	if err = builder.checkKernelImage(); err != nil {
+		return nil, err
+	}
+
+	splitDone, err := builder.splitInitrd()
+	if err != nil {
+		return nil, err
+	}
+
+	defer splitDone()
+
+	if err = builder.generateSections(); err != nil {
+		return nil, err
+	}
+
+	measurements, err := measure.CalculateMeasurements(utils.SectionsData(builder.sections), builder.Phases, constants.UKIPCR,
+		measure.WithHashCache(builder.sectionHashCache()))
+	if err != nil {
+		return nil, types.WithCategory(types.ErrMeasurement, fmt.Errorf("error measuring sections: %w", err))
+	}
+
+	if err = builder.recordSections(); err != nil {
+		return nil, fmt.Errorf("error generating sections: %w", err)
+	}
+
+	plan := &Plan{
+		Sections:     builder.result.Sections,
+		Measurements: measurements,
+		Warnings:     builder.result.Warnings,
+	}
+
+	if builder.pcrSignEnabled() && builder.stub.Supports(constants.PCRSig) {
+		plan.Sections = append(plan.Sections, SectionResult{
+			Name:     string(constants.PCRSig),
+			Appended: true,
+		})
+	}
+
+	if builder.SdBootPath != "" && builder.sbSignEnabled() {
+		plan.Outputs = append(plan.Outputs, PlannedOutput{Kind: "sd-boot", Path: builder.OutSdBootPath, Signed: true})
+	}
+
+	if builder.sbSignEnabled() {
+		plan.Outputs = append(plan.Outputs, PlannedOutput{Kind: "uki", Path: builder.OutUKIPath, Signed: true})
+	} else {
+		plan.Outputs = append(plan.Outputs, PlannedOutput{Kind: "uki", Path: builder.unsignedOutputPath()})
+	}
+
+	extensions, extensionMeasurements, err := builder.planExtensions()
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Outputs = append(plan.Outputs, extensions...)
+	plan.Outputs = append(plan.Outputs, builder.planInitrdAddons()...)
+	plan.Measurements = append(plan.Measurements, extensionMeasurements...)
+
+	if recovery := builder.recoveryBuilder(); recovery != nil {
+		recoveryPlan, err := recovery.Plan()
+		if err != nil {
+			return nil, fmt.Errorf("error planning recovery UKI: %w", err)
+		}
+
+		for _, output := range recoveryPlan.Outputs {
+			output.Kind = RecoveryVariant + "-" + output.Kind
+			plan.Outputs = append(plan.Outputs, output)
+		}
+
+		for _, measurement := range recoveryPlan.Measurements {
+			measurement.Variant = RecoveryVariant
+			plan.Measurements = append(plan.Measurements, measurement)
+		}
+	}
+
+	return plan, nil
+}
+
+// estimateMargin covers the small generated sections, the section alignment and the signature.
+const estimateMargin = 64 * 1024
+
+// EstimatedSize returns an estimate of the size of the UKI from the size of its inputs, without generating it.
+func (builder *Builder) EstimatedSize() (int64, error) {
+	if err := builder.DiscoverStubs(); err != nil {
+		return 0, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	if err := builder.pullImageInputs(); err != nil {
+		return 0, types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	stubPath := builder.SdStubPath
+	if builder.Stub != nil {
+		stubPath = builder.Stub.Path()
+	}
+
+	splash := builder.Splash
+	if splash != "" && builder.SplashFallback && !validSplash(splash) {
+		splash = ""
+	}
+
+	size := int64(len(builder.Cmdline)) + estimateMargin
+	if splash == "" && builder.SplashSource == nil {
+		size += int64(len(common.Logo))
+	}
+
+	for _, source := range []*types.SectionSource{builder.KernelSource, builder.InitrdSource, builder.SplashSource} {
+		if source != nil {
+			size += source.Size
+		}
+	}
+
+	paths := []string{stubPath, builder.KernelPath, builder.InitrdPath, builder.OsRelease, splash, builder.Firmware}
+
+	for _, section := range builder.addedSections {
+		if section.Source != nil {
+			size += section.Source.Size
+		}
+
+		paths = append(paths, section.Path)
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, types.WithCategory(types.ErrInvalidInput, err)
+		}
+		size += info.Size()
+	}
+
+	return size, nil
+}
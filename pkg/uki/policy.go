@@ -0,0 +1,56 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// errFileKey is returned with RequireHardwareKeys for signers using a key file.
+var errFileKey = errors.New("hardware-backed keys are required")
+
+// checkKeyFiles refuses the key files and PEM keys given to the builder with RequireHardwareKeys,
+// before they are loaded and their passphrases asked for.
+func (builder *Builder) checkKeyFiles() []error {
+	if !builder.RequireHardwareKeys {
+		return nil
+	}
+
+	var errs []error
+
+	if builder.SBKey != "" || builder.SBKeyPEM != nil {
+		errs = append(errs, fmt.Errorf("%w, the SecureBoot key is a key file", errFileKey))
+	}
+
+	if builder.PCRKey != "" || builder.PCRKeyPEM != nil {
+		errs = append(errs, fmt.Errorf("%w, the PCR key is a key file", errFileKey))
+	}
+
+	return errs
+}
+
+// checkHardwareKeys refuses the given signers using a key file with RequireHardwareKeys, see
+// pesign.Signer.FileKey and pesign.IsHardwareBacked.
+func (builder *Builder) checkHardwareKeys() error {
+	if !builder.RequireHardwareKeys {
+		return nil
+	}
+
+	var errs []error
+
+	if builder.SecureBootSigner != nil && builder.SecureBootSigner.FileKey() {
+		errs = append(errs, fmt.Errorf("%w, the SecureBoot signer uses a key file", errFileKey))
+	}
+
+	if builder.PCRSigner != nil && !pesign.IsHardwareBacked(builder.PCRSigner) {
+		errs = append(errs, fmt.Errorf("%w, the PCR signer uses a key file", errFileKey))
+	}
+
+	return types.WithCategory(types.ErrInvalidInput, errors.Join(errs...))
+}
@@ -0,0 +1,98 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Profiles of the conventions the UKIs follow.
+const (
+	// ProfileKairos builds the UKIs of Kairos, the default.
+	ProfileKairos = "kairos"
+	// ProfileTalos builds the UKIs as the siderolabs Talos imager does, for Talos derived projects:
+	//   - the Talos os-release and identity, with its version as VERSION_ID, unless OsRelease is set
+	//   - the PCR 11 policy only signed for the enter-initrd phase, unless Phases is set
+	//   - the UKI written to vmlinuz.efi and sd-boot to systemd-boot.efi, unless their paths are set.
+	// The sections are the ones of the default generators in both profiles.
+	ProfileTalos = "talos"
+)
+
+// Conventions of the Talos imager.
+const (
+	talosName       = "Talos"
+	talosUKIFile    = "vmlinuz.efi"
+	talosSdBootFile = "systemd-boot.efi"
+	// os-release of the Talos machinery constants
+	talosOSReleaseTemplate = `NAME="{{ .Name }}"
+ID={{ .ID }}
+VERSION_ID={{ .Version }}
+PRETTY_NAME="{{ .Name }} ({{ .Version }})"
+HOME_URL="https://www.talos.dev/"
+BUG_REPORT_URL="https://github.com/siderolabs/talos/issues"
+VENDOR_NAME="Sidero Labs"
+VENDOR_URL="https://www.siderolabs.com/"
+`
+)
+
+// Profiles returns the known profiles.
+func Profiles() []string {
+	return []string{ProfileKairos, ProfileTalos}
+}
+
+// applyProfile fills in the options the profile sets, leaving the given ones alone.
+func (builder *Builder) applyProfile() error {
+	switch builder.Profile {
+	case "", ProfileKairos:
+		return nil
+	case ProfileTalos:
+	default:
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("unknown profile %q, one of: %s", builder.Profile, strings.Join(Profiles(), ", ")))
+	}
+
+	if builder.Identity.Name == "" {
+		builder.Identity.Name = talosName
+	}
+
+	if len(builder.Phases) == 0 {
+		builder.Phases = []types.PhaseInfo{{Phase: constants.EnterInitrd}}
+	}
+
+	if builder.OutUKIPath == "" {
+		builder.OutUKIPath = talosUKIFile
+	}
+
+	if builder.SdBootPath != "" && builder.OutSdBootPath == "" {
+		builder.OutSdBootPath = talosSdBootFile
+	}
+
+	return nil
+}
+
+// generatedOSRelease returns the os-release generated when OsRelease is not set, the one of the profile.
+func (builder *Builder) generatedOSRelease() ([]byte, error) {
+	if builder.Profile != ProfileTalos {
+		return builder.Identity.osRelease(builder.Version)
+	}
+
+	identity := builder.Identity.Resolve()
+
+	tmpl, err := template.New("").Parse(talosOSReleaseTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var writer bytes.Buffer
+
+	err = tmpl.Execute(&writer, constants.OSReleaseInfo{Name: identity.Name, ID: identity.ID, Version: builder.Version})
+
+	return writer.Bytes(), err
+}
@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Stage is a step of the UKI build.
+type Stage = types.Stage
+
+// Build stages, in the order they run.
+const (
+	StageGenerate   = types.StageGenerate
+	StageMeasure    = types.StageMeasure
+	StageAssemble   = types.StageAssemble
+	StageSignSdBoot = types.StageSignSdBoot
+	StageSign       = types.StageSign
+)
+
+// Progress is reported to Builder.Progress while building.
+//
+// An event with Done and Total set to zero starts a stage, the stage ends with
+// an event with Finished set. In between, stages working on files report the
+// bytes processed so far.
+type Progress struct {
+	// Stage running.
+	Stage Stage
+	// Item being processed, i.e. the section being hashed.
+	Item string
+	// Bytes processed so far and bytes to process, Total is zero if unknown.
+	Done  int64
+	Total int64
+	// Whether the stage is done, Elapsed holds how long the stage took.
+	Finished bool
+	Elapsed  time.Duration
+}
+
+// StageTiming is how long a build stage took.
+type StageTiming struct {
+	// Stage name.
+	Stage Stage `json:"stage"`
+	// Duration of the stage in nanoseconds.
+	Duration time.Duration `json:"duration"`
+}
+
+// report sends a progress event to the Progress callback if set.
+func (builder *Builder) report(progress Progress) {
+	if builder.Progress != nil {
+		builder.Progress(progress)
+	}
+}
+
+// stage runs fn as the given build stage, reporting its progress and recording its timing.
+func (builder *Builder) stage(stage Stage, item string, total int64, fn func() error) error {
+	start := time.Now()
+
+	builder.report(Progress{Stage: stage, Item: item, Total: total})
+
+	err := fn()
+	elapsed := time.Since(start)
+
+	builder.result.Timings = append(builder.result.Timings, StageTiming{Stage: stage, Duration: elapsed})
+
+	bytes := total
+	if stage == StageMeasure {
+		bytes = builder.hashStats.BytesHashed
+	}
+	builder.result.Report.Stages = append(builder.result.Report.Stages, StageReport{Stage: stage, Duration: elapsed, Bytes: bytes})
+	builder.report(Progress{Stage: stage, Item: item, Done: total, Total: total, Finished: true, Elapsed: elapsed})
+
+	return err
+}
+
+// measureProgress reports the hashing of the sections while measuring them.
+func (builder *Builder) measureProgress(section constants.Section, alg crypto.Hash, done, total int64) {
+	item := string(section)
+	if alg != 0 {
+		item = fmt.Sprintf("%s %s", section, alg)
+	}
+
+	builder.report(Progress{Stage: StageMeasure, Item: item, Done: done, Total: total})
+}
+
+// sectionsSize returns the size of the recorded sections.
+func (builder *Builder) sectionsSize() int64 {
+	var size int64
+
+	for _, section := range builder.result.Sections {
+		size += section.Size
+	}
+
+	return size
+}
+
+// fileSize returns the size of a file, or zero if it can not be read.
+func fileSize(path string) int64 {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return st.Size()
+}
@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/oci"
+)
+
+// Push pushes the UKI of the result to reference as an OCI artifact, with the build manifest and the
+// PCR predictions attached as referrers, as written to the bundle.
+func (r *Result) Push(client *oci.Client, reference string) (*oci.PushResult, error) {
+	var output *OutputResult
+
+	for i := range r.Outputs {
+		if r.Outputs[i].Kind == "uki" {
+			output = &r.Outputs[i]
+
+			break
+		}
+	}
+
+	if output == nil {
+		return nil, errors.New("the build has no UKI output")
+	}
+
+	// the output paths are relative to the artifact, as in the bundle
+	manifest := *r
+	manifest.Outputs = nil
+
+	for _, o := range r.Outputs {
+		o.Path = filepath.Base(o.Path)
+		manifest.Outputs = append(manifest.Outputs, o)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	measurements, err := json.MarshalIndent(r.Measurements, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return client.PushUKI(reference, output.Path,
+		oci.Referrer{ArtifactType: oci.ArtifactTypeManifest, Name: BundleManifestFile, Data: append(manifestData, '\n')},
+		oci.Referrer{ArtifactType: oci.ArtifactTypeMeasurements, Name: BundleMeasurementsFile, Data: append(measurements, '\n')},
+	)
+}
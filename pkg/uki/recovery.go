@@ -0,0 +1,132 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+)
+
+// RecoveryVariant is the variant of the measurements of the recovery UKI.
+const RecoveryVariant = "recovery"
+
+// finish builds the recovery UKI, if any, logs the signatures and writes the outputs covering all
+// the others.
+func (builder *Builder) finish() error {
+	if err := builder.placeExtensions(); err != nil {
+		return err
+	}
+
+	if err := builder.placeInitrdAddons(); err != nil {
+		return err
+	}
+
+	if err := builder.buildRecovery(); err != nil {
+		return err
+	}
+
+	if err := builder.logSignatures(); err != nil {
+		return err
+	}
+
+	return builder.writeCollectedOutputs()
+}
+
+// recoveryBuilder returns a builder for the recovery UKI, or nil if there is none.
+//
+// It shares the stub, kernel, os-release and the already loaded signers with the main build,
+// so keys are only read, and passphrases asked for, once.
+func (builder *Builder) recoveryBuilder() *Builder {
+	if builder.OutRecoveryUKIPath == "" {
+		return nil
+	}
+
+	recovery := *builder
+
+	recovery.Cmdline = builder.RecoveryCmdline
+	// the generated initrd is shared
+	recovery.InitrdGenerator = nil
+	if builder.RecoveryInitrdPath != "" {
+		recovery.InitrdPath = builder.RecoveryInitrdPath
+		recovery.InitrdSource = nil
+	}
+
+	if builder.RecoverySplash != "" {
+		recovery.Splash = builder.RecoverySplash
+		recovery.SplashSource = nil
+		recovery.SplashText = false
+	}
+
+	recovery.splashVariant = RecoveryVariant
+
+	// sd-boot and the files covering the outputs belong to the main build
+	recovery.SdBootPath = ""
+	recovery.OutUKIPath = builder.OutRecoveryUKIPath
+	recovery.OutRecoveryUKIPath = ""
+	recovery.OutChecksumsPath = ""
+	recovery.OutBundlePath = ""
+	recovery.OutSBOMPath = ""
+	// logged with the outputs of the main build
+	recovery.TransparencyLog, recovery.TransparencyLogKey = nil, ""
+
+	recovery.sections = nil
+	recovery.scratchDir = ""
+	recovery.unsignedUKIPath = ""
+	recovery.unsignedDigest = nil
+	// split again after its own initrd, next to its own output
+	recovery.initrdParts = nil
+	// the keys are destroyed by the main build
+	recovery.loadedPCRSigner = nil
+	recovery.loadedSBSigner = nil
+
+	return &recovery
+}
+
+// buildRecovery builds the recovery UKI and adds its outputs and measurements to the result.
+func (builder *Builder) buildRecovery() error {
+	recovery := builder.recoveryBuilder()
+	if recovery == nil {
+		return nil
+	}
+
+	builder.log().Info("Building recovery UKI", "path", builder.OutRecoveryUKIPath)
+
+	if err := recovery.Build(); err != nil {
+		return fmt.Errorf("error building recovery UKI: %w", err)
+	}
+
+	builder.mergeRecovery(recovery.Result())
+
+	return nil
+}
+
+// mergeRecovery adds the outputs, measurements, warnings and metrics of the recovery build to the result.
+func (builder *Builder) mergeRecovery(result *Result) {
+	for _, stage := range result.Report.Stages {
+		stage.Variant = RecoveryVariant
+		builder.result.Report.Stages = append(builder.result.Report.Stages, stage)
+	}
+
+	builder.hashStats.Add(pcr.HashStats{
+		Hits:        result.Report.CacheHits,
+		Misses:      result.Report.CacheMisses,
+		BytesHashed: result.Report.BytesHashed,
+	})
+
+	for _, output := range result.Outputs {
+		output.Kind = RecoveryVariant + "-" + output.Kind
+		builder.result.Outputs = append(builder.result.Outputs, output)
+	}
+
+	for _, measurement := range result.Measurements {
+		measurement.Variant = RecoveryVariant
+		builder.result.Measurements = append(builder.result.Measurements, measurement)
+	}
+
+	for _, warning := range result.Warnings {
+		builder.result.Warnings = append(builder.result.Warnings, RecoveryVariant+": "+warning)
+	}
+}
@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Repack rebuilds an existing UKI with the builder.
+//
+// The stub, kernel, initrd, splash, cmdline and os-release are taken from the UKI unless set
+// in the builder, so only the options to change need to be given. The other sections are
+// generated again and the result is measured and signed with the builder keys.
+func Repack(path string, builder *Builder) error {
+	dir, err := os.MkdirTemp("", "ukify-repack")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err = os.RemoveAll(dir); err != nil {
+			builder.log().Warn("Failed to remove scratch dir", "path", dir, "error", err)
+		}
+	}()
+
+	sections, err := ListSections(path)
+	if err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	extracted := map[constants.Section]string{}
+
+	for _, name := range sections {
+		switch name {
+		case constants.DTB:
+			return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s has a %s section, which can not be repacked yet", path, name))
+		case constants.Linux, constants.Initrd, constants.Splash, constants.CMDLine, constants.OSRel:
+			data, err := GetSection(path, name)
+			if err != nil {
+				return err
+			}
+
+			extracted[name] = filepath.Join(dir, strings.TrimPrefix(string(name), "."))
+
+			if err = os.WriteFile(extracted[name], data, 0o600); err != nil {
+				return err
+			}
+		}
+	}
+
+	if extracted[constants.Linux] == "" && builder.KernelPath == "" {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s has no kernel", path))
+	}
+
+	builder.log().Info("Recovering stub", "path", path)
+
+	stub := filepath.Join(dir, "stub.efi")
+	if err = stripUKI(builder.log(), path, sections, stub); err != nil {
+		return fmt.Errorf("error recovering stub from %s: %w", path, err)
+	}
+
+	builder.SdStubPath = stub
+
+	for _, f := range []struct {
+		dst     *string
+		section constants.Section
+	}{
+		{&builder.KernelPath, constants.Linux},
+		{&builder.InitrdPath, constants.Initrd},
+		{&builder.Splash, constants.Splash},
+		{&builder.OsRelease, constants.OSRel},
+	} {
+		if *f.dst == "" {
+			*f.dst = extracted[f.section]
+		}
+	}
+
+	if builder.Cmdline == "" && extracted[constants.CMDLine] != "" {
+		cmdline, err := os.ReadFile(extracted[constants.CMDLine])
+		if err != nil {
+			return err
+		}
+
+		builder.Cmdline = string(cmdline)
+	}
+
+	if builder.InitrdPath == "" {
+		// the builder always appends an initrd
+		builder.InitrdPath = filepath.Join(dir, "initrd")
+
+		if err = os.WriteFile(builder.InitrdPath, nil, 0o600); err != nil {
+			return err
+		}
+	}
+
+	return builder.Build()
+}
+
+// stripUKI recovers the stub of a UKI by laying it out again without its signatures and all the
+// UKI sections except .sbat, which comes with the stub.
+func stripUKI(logger *slog.Logger, path string, sections []constants.Section, output string) error {
+	removed := map[string]bool{}
+
+	for _, name := range sections {
+		if name != constants.SBAT {
+			removed[string(name)] = true
+		}
+	}
+
+	if len(removed) == 0 {
+		return errors.New("no UKI sections found")
+	}
+
+	logger.Debug("Stripping UKI", "path", path, "sections", len(removed))
+
+	return stripPE(path, removed, output)
+}
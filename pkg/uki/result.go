@@ -0,0 +1,300 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/rekor"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Result describes what a build produced.
+//
+// It is meant to be consumed by pipelines, so the json field names are part of the API.
+type Result struct {
+	// Outputs written by the build.
+	Outputs []OutputResult `json:"outputs"`
+	// Sections that were embedded in and/or measured into the UKI.
+	Sections []SectionResult `json:"sections"`
+	// Vendor signatures of the kernel, recorded with Builder.KernelSignature.
+	Kernel *KernelResult `json:"kernel,omitempty"`
+	// Description of the kernel, recorded with Builder.KernelReport.
+	KernelInfo *KernelInfo `json:"kernelInfo,omitempty"`
+	// Expected PCR values for each bank and phase.
+	Measurements []types.PCRMeasurement `json:"measurements,omitempty"`
+	// Extension images and initrd addons placed next to the UKI, with the events systemd-stub extends for them.
+	Extensions []ExtensionResult `json:"extensions,omitempty"`
+	// Warnings raised during the build.
+	Warnings []string `json:"warnings,omitempty"`
+	// Time spent in each build stage.
+	Timings []StageTiming `json:"timings,omitempty"`
+	// Metrics of the build.
+	Report BuildReport `json:"report"`
+}
+
+// BuildReport holds metrics to track the performance of builds over time.
+type BuildReport struct {
+	// Duration of the whole build in nanoseconds, recovery UKI included.
+	Duration time.Duration `json:"duration"`
+	// Stages run, the ones of the recovery UKI included.
+	Stages []StageReport `json:"stages"`
+	// Bytes read to hash the sections, not counting the ones whose digests were cached.
+	BytesHashed int64 `json:"bytesHashed"`
+	// Total size of the outputs.
+	OutputBytes int64 `json:"outputBytes"`
+	// Section files whose digests were cached, and the ones hashed.
+	CacheHits   int `json:"cacheHits"`
+	CacheMisses int `json:"cacheMisses"`
+	// Share of the section files whose digests were cached, between 0 and 1.
+	CacheHitRate float64 `json:"cacheHitRate"`
+}
+
+// StageReport holds the metrics of a build stage.
+type StageReport struct {
+	// Stage name.
+	Stage Stage `json:"stage"`
+	// Variant of the UKI built by the stage, empty for the main one.
+	Variant string `json:"variant,omitempty"`
+	// Duration of the stage in nanoseconds.
+	Duration time.Duration `json:"duration"`
+	// Bytes processed by the stage: the bytes hashed when measuring, the input size otherwise.
+	Bytes int64 `json:"bytes"`
+}
+
+// OutputResult is a file written by the build.
+type OutputResult struct {
+	// Kind of output, i.e. uki or sd-boot.
+	Kind string `json:"kind"`
+	// Path to the output file.
+	Path string `json:"path"`
+	// Whether the output was signed for SecureBoot.
+	Signed bool `json:"signed"`
+	// Size of the output in bytes.
+	Size int64 `json:"size"`
+	// SHA256 of the output file in hex.
+	SHA256 string `json:"sha256"`
+	// Entry of the SecureBoot signature in the transparency log, with its inclusion proof.
+	Transparency *rekor.LogEntry `json:"transparency,omitempty"`
+	// Approvals of the Authenticode digest of the output, with Builder.Approvals.
+	Approvals []pesign.Approval `json:"approvals,omitempty"`
+}
+
+// SectionResult is a section of the produced UKI.
+type SectionResult struct {
+	// Section name.
+	Name string `json:"name"`
+	// Source the section contents were read from, empty for sections kept in memory.
+	Path string `json:"path,omitempty"`
+	// Size of the section in bytes.
+	Size int64 `json:"size"`
+	// SHA256 of the section contents in hex.
+	SHA256 string `json:"sha256"`
+	// Whether the section is measured into the PCR.
+	Measured bool `json:"measured"`
+	// Whether the section was appended to the stub.
+	Appended bool `json:"appended"`
+}
+
+// Result returns the result of the last build.
+func (builder *Builder) Result() *Result {
+	return &builder.result
+}
+
+// Report returns the metrics of the last build.
+func (builder *Builder) Report() *BuildReport {
+	return &builder.result.Report
+}
+
+// finishReport fills the totals of the report once the build is done.
+func (builder *Builder) finishReport(duration time.Duration) {
+	report := &builder.result.Report
+
+	report.Duration = duration
+	report.BytesHashed = builder.hashStats.BytesHashed
+	report.CacheHits = builder.hashStats.Hits
+	report.CacheMisses = builder.hashStats.Misses
+	report.CacheHitRate = builder.hashStats.HitRate()
+
+	report.OutputBytes = 0
+	for _, output := range builder.result.Outputs {
+		report.OutputBytes += output.Size
+	}
+}
+
+// warnMu guards the result warnings, as section generators run concurrently.
+var warnMu sync.Mutex
+
+// warn logs a warning and records it in the build result.
+func (builder *Builder) warn(msg string, args ...any) {
+	builder.log().Warn(msg, args...)
+
+	for i := 0; i+1 < len(args); i += 2 {
+		msg = fmt.Sprintf("%s %v=%v", msg, args[i], args[i+1])
+	}
+
+	warnMu.Lock()
+	defer warnMu.Unlock()
+
+	builder.result.Warnings = append(builder.result.Warnings, msg)
+}
+
+// recordSections fills the result with the digests of the generated sections.
+func (builder *Builder) recordSections() error {
+	for _, section := range builder.sections {
+		size, sum, err := builder.sectionDigest(&section)
+		if err != nil {
+			return err
+		}
+
+		builder.result.Sections = append(builder.result.Sections, SectionResult{
+			Name:     string(section.Name),
+			Path:     section.Path,
+			Size:     size,
+			SHA256:   hex.EncodeToString(sum),
+			Measured: section.Measure,
+			Appended: section.Append,
+		})
+	}
+
+	return nil
+}
+
+// sectionDigest returns the size and SHA256 of the section contents.
+func (builder *Builder) sectionDigest(section *types.UkiSection) (int64, []byte, error) {
+	if section.Source != nil {
+		h := sha256.New()
+
+		size, err := utils.Copy(h, section.Source.Open())
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return size, h.Sum(nil), nil
+	}
+
+	// measuring hashed the sections with SHA256 already
+	st, err := os.Stat(section.Path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sum, err := builder.sectionHashCache().Sum(crypto.SHA256, section.Path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return st.Size(), sum, nil
+}
+
+// recordOutput gives an output file its mode and owner, and adds it to the result.
+func (builder *Builder) recordOutput(kind, path string, signed bool) error {
+	if err := builder.setOutputMode(path, builder.outputMode(kind, signed)); err != nil {
+		return err
+	}
+
+	size, digest, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+
+	builder.result.Outputs = append(builder.result.Outputs, OutputResult{
+		Kind:   kind,
+		Path:   path,
+		Signed: signed,
+		Size:   size,
+		SHA256: digest,
+	})
+
+	return nil
+}
+
+// recordSignedOutput adds a signed output file to the result, with its SHA256 computed while writing it,
+// nil if unknown, and the approvals of its signature, checked against the output.
+func (builder *Builder) recordSignedOutput(kind, path string, sum []byte, approvals []pesign.Approval) error {
+	if err := builder.checkApprovals(path, approvals); err != nil {
+		return err
+	}
+
+	if sum == nil {
+		if err := builder.recordOutput(kind, path, true); err != nil {
+			return err
+		}
+
+		builder.result.Outputs[len(builder.result.Outputs)-1].Approvals = approvals
+
+		return nil
+	}
+
+	if err := builder.setOutputMode(path, builder.outputMode(kind, true)); err != nil {
+		return err
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	builder.result.Outputs = append(builder.result.Outputs, OutputResult{
+		Kind:      kind,
+		Path:      path,
+		Signed:    true,
+		Size:      st.Size(),
+		SHA256:    hex.EncodeToString(sum),
+		Approvals: approvals,
+	})
+
+	return nil
+}
+
+// checkApprovals verifies the approvals reach the threshold of Builder.Approvals, with the Authenticode
+// digest recomputed from the signed output.
+func (builder *Builder) checkApprovals(path string, approvals []pesign.Approval) error {
+	if builder.Approvals == nil {
+		return nil
+	}
+
+	digest, _, err := pesign.Signatures(path)
+	if err != nil {
+		return err
+	}
+
+	if err = builder.Approvals.Verify(digest, approvals); err != nil {
+		return fmt.Errorf("approvals of %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// fileDigest returns the size and hex encoded SHA256 of a file.
+func fileDigest(path string) (int64, string, error) {
+	f, err := utils.OpenSequential(path)
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	h := sha256.New()
+
+	size, err := utils.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err = utils.DoneWith(f, false); err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
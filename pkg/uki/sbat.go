@@ -5,30 +5,96 @@
 package uki
 
 import (
-	"debug/pe"
 	"errors"
+	"fmt"
+	"os"
+
 	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// SBATPolicyPath values reading the bundled latest revocations of shim, and the revocations applied
+// by the running system. The latest revocations only list shim and grub, so they never reject
+// systemd-stub or systemd-boot.
+const (
+	SBATPolicyLatest = "latest"
+	SBATPolicySystem = "system"
 )
 
 // GetSBAT returns the SBAT section from the PE file.
 func GetSBAT(path string) ([]byte, error) {
-	pefile, err := pe.Open(path)
+	data, err := GetSection(path, constants.SBAT)
+	if errors.Is(err, ErrSectionNotFound) {
+		return nil, errors.New("could not find SBAT section")
+	}
+
+	return data, err
+}
+
+func loadSBATPolicy(path string) (sbat.Policy, error) {
+	switch path {
+	case SBATPolicyLatest:
+		return sbat.LatestPolicy(), nil
+	case SBATPolicySystem:
+		return sbat.SystemPolicy()
+	}
+
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	defer pefile.Close() //nolint:errcheck
+	return sbat.ParsePolicy(data)
+}
+
+// checkSBAT checks the SBAT of the given stubs against the SBAT policy, so revoked stubs are not
+// embedded. Empty paths and stubs without SBAT are skipped.
+func (builder *Builder) checkSBAT(paths ...string) error {
+	if builder.SBATPolicy == nil {
+		return nil
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		data, err := GetSection(path, constants.SBAT)
+		if errors.Is(err, ErrSectionNotFound) {
+			continue
+		}
 
-	for _, section := range pefile.Sections {
-		if section.Name == string(constants.SBAT) {
-			data, err := section.Data()
-			if err != nil {
-				return nil, err
-			}
+		if err != nil {
+			return err
+		}
 
-			return data[:section.VirtualSize], nil
+		entries, err := sbat.Parse(data)
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("%s: %w", path, err))
 		}
+
+		if err = builder.checkSBATPolicy(path, entries); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSBATPolicy checks the SBAT entries of what, a stub or the generated section, against the SBAT
+// policy, only warning with SBATWarnOnly.
+func (builder *Builder) checkSBATPolicy(what string, entries []sbat.Entry) error {
+	err := builder.SBATPolicy.Check(entries)
+	if err == nil {
+		return nil
+	}
+
+	if builder.SBATWarnOnly {
+		builder.warn("Firmware would reject the stub", "path", what, "reason", err.Error())
+
+		return nil
 	}
 
-	return nil, errors.New("could not find SBAT section")
+	return types.WithCategory(types.ErrVerification, fmt.Errorf("firmware would reject %s: %w", what, err))
 }
@@ -0,0 +1,419 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/go-ukify/internal/common"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// SBOM formats, see Builder.SBOMFormat.
+const (
+	SBOMCycloneDX = "cyclonedx"
+	SBOMSPDX      = "spdx"
+)
+
+// sbomComponentNames names the components of the well-known sections.
+var sbomComponentNames = map[constants.Section]string{
+	constants.Linux:   "kernel",
+	constants.Initrd:  "initrd",
+	constants.Splash:  "splash",
+	constants.OSRel:   "os-release",
+	constants.CMDLine: "cmdline",
+	constants.Uname:   "uname",
+	constants.SBAT:    "sbat",
+	constants.DTB:     "devicetree",
+	constants.PCRPKey: "pcr-public-key",
+	constants.PCRSig:  "pcr-signature",
+	constants.SBOM:    "sbom",
+	constants.EFIFW:   "firmware",
+}
+
+// sbomComponent is a part of the UKI, or an output, listed in the SBOM.
+type sbomComponent struct {
+	// CycloneDX component type, i.e. application or file.
+	kind        string
+	name        string
+	version     string
+	description string
+	// SHA256 in hex, empty if unknown.
+	sha256 string
+}
+
+// sbomComponents returns the stub, the sections, sd-boot and the SecureBoot certificate.
+func (builder *Builder) sbomComponents() ([]sbomComponent, error) {
+	_, sum, err := fileDigest(builder.stub.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	components := []sbomComponent{{kind: "application", name: "stub", description: filepath.Base(builder.stub.Path()), sha256: sum}}
+
+	var kernelVersion string
+
+	for _, section := range builder.sections {
+		_, digest, err := builder.sectionDigest(&section)
+		if err != nil {
+			return nil, err
+		}
+
+		name, ok := sbomComponentNames[section.Name]
+		if !ok {
+			name = string(section.Name)
+		}
+
+		if section.Name == constants.Uname {
+			kernelVersion, err = sectionContents(&section)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		components = append(components, sbomComponent{
+			kind:        "file",
+			name:        name,
+			description: "section " + string(section.Name),
+			sha256:      hex.EncodeToString(digest),
+		})
+	}
+
+	for i := range components {
+		if components[i].name == "kernel" {
+			components[i].kind = "operating-system"
+			components[i].version = kernelVersion
+		}
+	}
+
+	if builder.SdBootPath != "" {
+		_, sum, err := fileDigest(builder.SdBootPath)
+		if err != nil {
+			return nil, err
+		}
+
+		components = append(components, sbomComponent{kind: "application", name: "systemd-boot", description: filepath.Base(builder.SdBootPath), sha256: sum})
+	}
+
+	if builder.SecureBootSigner != nil {
+		cert := builder.SecureBootSigner.Certificate()
+		sum := sha256.Sum256(cert.Raw)
+
+		components = append(components, sbomComponent{
+			kind:        "cryptographic-asset",
+			name:        "secureboot-certificate",
+			version:     cert.SerialNumber.String(),
+			description: cert.Subject.String(),
+			sha256:      hex.EncodeToString(sum[:]),
+		})
+	}
+
+	return components, nil
+}
+
+// sectionContents returns the contents of a small generated section.
+func sectionContents(section *types.UkiSection) (string, error) {
+	if section.Source == nil {
+		data, err := os.ReadFile(section.Path)
+
+		return string(data), err
+	}
+
+	var buf bytes.Buffer
+
+	if _, err := utils.Copy(&buf, section.Source.Open()); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// sbom returns the SBOM of the UKI in SBOMFormat. The outputs of the build are listed as well when
+// withOutputs is set, the signed UKI being the component the SBOM describes.
+func (builder *Builder) sbom(withOutputs bool) ([]byte, error) {
+	components, err := builder.sbomComponents()
+	if err != nil {
+		return nil, err
+	}
+
+	main := sbomComponent{kind: "application", name: filepath.Base(builder.OutUKIPath), version: builder.Version}
+
+	if withOutputs {
+		for _, output := range builder.result.Outputs {
+			if output.Kind == "uki" {
+				main.name, main.sha256 = filepath.Base(output.Path), output.SHA256
+
+				continue
+			}
+
+			components = append(components, sbomComponent{kind: "file", name: output.Kind, description: filepath.Base(output.Path), sha256: output.SHA256})
+		}
+	}
+
+	var doc any
+
+	switch builder.SBOMFormat {
+	case SBOMSPDX:
+		doc = spdxDocument(main, components)
+	default:
+		doc = cycloneDXDocument(main, components)
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// generateSBOM returns the .sbom section listing the inputs of the UKI.
+//
+// It is not measured, systemd-stub does not know it.
+func (builder *Builder) generateSBOM() ([]types.UkiSection, error) {
+	data, err := builder.sbom(false)
+	if err != nil {
+		return nil, types.NewBuildError(StageGenerate, constants.SBOM, "", err)
+	}
+
+	return builder.ephemeralSection(types.UkiSection{Name: constants.SBOM, Append: true}, "sbom.json", data)
+}
+
+// writeSBOM writes the SBOM of the UKI and the outputs to OutSBOMPath.
+func (builder *Builder) writeSBOM() error {
+	if builder.OutSBOMPath == "" {
+		return nil
+	}
+
+	data, err := builder.sbom(true)
+	if err != nil {
+		return fmt.Errorf("error generating SBOM: %w", err)
+	}
+
+	if err = utils.WriteFile(builder.OutSBOMPath, data, 0o644); err != nil {
+		return err
+	}
+
+	builder.log().Info("Wrote SBOM", "path", builder.OutSBOMPath, "format", builder.sbomFormat())
+
+	return builder.recordOutput("sbom", builder.OutSBOMPath, false)
+}
+
+// sbomFormat returns SBOMFormat, SBOMCycloneDX when empty.
+func (builder *Builder) sbomFormat() string {
+	if builder.SBOMFormat == "" {
+		return SBOMCycloneDX
+	}
+
+	return builder.SBOMFormat
+}
+
+// sbomTime returns the creation time of the SBOM, SOURCE_DATE_EPOCH if set, so the UKI embedding it
+// can be reproduced.
+func sbomTime() string {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC().Format(time.RFC3339)
+	}
+
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// sbomUUID returns a UUID derived from the components, stable across builds of the same UKI.
+func sbomUUID(main sbomComponent, components []sbomComponent) string {
+	h := sha256.New()
+
+	for _, c := range append([]sbomComponent{main}, components...) {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\n", c.kind, c.name, c.version, c.sha256)
+	}
+
+	sum := h.Sum(nil)
+	// name based, RFC 4122 variant
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDXComponent struct {
+	Type        string          `json:"type"`
+	BOMRef      string          `json:"bom-ref,omitempty"`
+	Name        string          `json:"name"`
+	Version     string          `json:"version,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Hashes      []cycloneDXHash `json:"hashes,omitempty"`
+}
+
+func (c sbomComponent) cycloneDX() cycloneDXComponent {
+	component := cycloneDXComponent{Type: c.kind, BOMRef: c.name, Name: c.name, Version: c.version, Description: c.description}
+
+	if c.sha256 != "" {
+		component.Hashes = []cycloneDXHash{{Alg: "SHA-256", Content: c.sha256}}
+	}
+
+	return component
+}
+
+// cycloneDXDocument returns a CycloneDX 1.6 BOM describing main.
+func cycloneDXDocument(main sbomComponent, components []sbomComponent) any {
+	type tools struct {
+		Components []cycloneDXComponent `json:"components"`
+	}
+
+	type metadata struct {
+		Timestamp string             `json:"timestamp"`
+		Tools     tools              `json:"tools"`
+		Component cycloneDXComponent `json:"component"`
+	}
+
+	type dependency struct {
+		Ref       string   `json:"ref"`
+		DependsOn []string `json:"dependsOn"`
+	}
+
+	type bom struct {
+		BOMFormat    string               `json:"bomFormat"`
+		SpecVersion  string               `json:"specVersion"`
+		SerialNumber string               `json:"serialNumber"`
+		Version      int                  `json:"version"`
+		Metadata     metadata             `json:"metadata"`
+		Components   []cycloneDXComponent `json:"components"`
+		Dependencies []dependency         `json:"dependencies"`
+	}
+
+	doc := bom{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.6",
+		SerialNumber: "urn:uuid:" + sbomUUID(main, components),
+		Version:      1,
+		Metadata: metadata{
+			Timestamp: sbomTime(),
+			Tools:     tools{Components: []cycloneDXComponent{{Type: "application", Name: "go-ukify", Version: common.GetVersion()}}},
+			Component: main.cycloneDX(),
+		},
+		Dependencies: []dependency{{Ref: main.name, DependsOn: []string{}}},
+	}
+
+	for _, c := range components {
+		doc.Components = append(doc.Components, c.cycloneDX())
+		doc.Dependencies[0].DependsOn = append(doc.Dependencies[0].DependsOn, c.name)
+	}
+
+	return doc
+}
+
+// spdxDocument returns an SPDX 2.3 document describing main.
+func spdxDocument(main sbomComponent, components []sbomComponent) any {
+	type checksum struct {
+		Algorithm     string `json:"algorithm"`
+		ChecksumValue string `json:"checksumValue"`
+	}
+
+	type pkg struct {
+		Name                  string     `json:"name"`
+		SPDXID                string     `json:"SPDXID"`
+		VersionInfo           string     `json:"versionInfo,omitempty"`
+		Description           string     `json:"description,omitempty"`
+		DownloadLocation      string     `json:"downloadLocation"`
+		FilesAnalyzed         bool       `json:"filesAnalyzed"`
+		Checksums             []checksum `json:"checksums,omitempty"`
+		PrimaryPackagePurpose string     `json:"primaryPackagePurpose"`
+	}
+
+	type relationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+
+	type creationInfo struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	}
+
+	type document struct {
+		SPDXVersion       string         `json:"spdxVersion"`
+		DataLicense       string         `json:"dataLicense"`
+		SPDXID            string         `json:"SPDXID"`
+		Name              string         `json:"name"`
+		DocumentNamespace string         `json:"documentNamespace"`
+		CreationInfo      creationInfo   `json:"creationInfo"`
+		Packages          []pkg          `json:"packages"`
+		Relationships     []relationship `json:"relationships"`
+	}
+
+	purposes := map[string]string{
+		"application":         "APPLICATION",
+		"file":                "FILE",
+		"operating-system":    "OPERATING-SYSTEM",
+		"cryptographic-asset": "OTHER",
+	}
+
+	toPackage := func(c sbomComponent) pkg {
+		p := pkg{
+			Name:                  c.name,
+			SPDXID:                "SPDXRef-" + spdxID(c.name),
+			VersionInfo:           c.version,
+			Description:           c.description,
+			DownloadLocation:      "NOASSERTION",
+			PrimaryPackagePurpose: purposes[c.kind],
+		}
+
+		if c.sha256 != "" {
+			p.Checksums = []checksum{{Algorithm: "SHA256", ChecksumValue: c.sha256}}
+		}
+
+		return p
+	}
+
+	uuid := sbomUUID(main, components)
+	mainPackage := toPackage(main)
+
+	doc := document{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              main.name,
+		DocumentNamespace: "https://kairos.io/spdxdocs/" + spdxID(main.name) + "-" + uuid,
+		CreationInfo:      creationInfo{Created: sbomTime(), Creators: []string{"Tool: go-ukify-" + common.GetVersion()}},
+		Packages:          []pkg{mainPackage},
+		Relationships:     []relationship{{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: mainPackage.SPDXID}},
+	}
+
+	for _, c := range components {
+		p := toPackage(c)
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, relationship{SPDXElementID: mainPackage.SPDXID, RelationshipType: "CONTAINS", RelatedSPDXElement: p.SPDXID})
+	}
+
+	return doc
+}
+
+// spdxID returns name with the characters SPDX identifiers can't hold replaced.
+func spdxID(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+}
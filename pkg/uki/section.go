@@ -0,0 +1,70 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"debug/pe"
+	"errors"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+// ErrSectionNotFound is returned when the PE file does not have the requested section.
+var ErrSectionNotFound = errors.New("section not found")
+
+// GetSection returns the contents of the first section with the given name in the PE file.
+//
+// The data is trimmed to the section virtual size, so the file alignment padding is not returned.
+func GetSection(path string, name constants.Section) ([]byte, error) {
+	pefile, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer pefile.Close() //nolint:errcheck
+
+	section := pefile.Section(string(name))
+	if section == nil {
+		return nil, ErrSectionNotFound
+	}
+
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	if section.VirtualSize < uint32(len(data)) {
+		data = data[:section.VirtualSize]
+	}
+
+	return data, nil
+}
+
+// ListSections returns the names of the UKI sections found in the PE file, in file order.
+//
+// Only the well-known UKI sections are returned, the stub own code and data sections are skipped.
+func ListSections(path string) ([]constants.Section, error) {
+	pefile, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer pefile.Close() //nolint:errcheck
+
+	known := map[constants.Section]bool{constants.PCRSig: true}
+	for _, name := range constants.OrderedSections() {
+		known[name] = true
+	}
+
+	var sections []constants.Section
+
+	for _, section := range pefile.Sections {
+		if known[constants.Section(section.Name)] {
+			sections = append(sections, constants.Section(section.Name))
+		}
+	}
+
+	return sections, nil
+}
@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/splash"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// errInvalidBMP is returned for splash files that are not BMP images.
+var errInvalidBMP = splash.ErrInvalidBMP
+
+// openSplash opens the splash file, the returned function closes it.
+func openSplash(path string) (*types.SectionSource, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close() //nolint:errcheck
+
+		return nil, nil, err
+	}
+
+	return &types.SectionSource{ReaderAt: f, Size: st.Size()}, func() { f.Close() }, nil //nolint:errcheck
+}
+
+// readSplash checks the splash is a BMP image the stub can show, only reading its headers, or converts
+// it to one if it is a PNG or JPEG image. It returns the converted image, nil if it is a BMP one already.
+func readSplash(source *types.SectionSource) (*splash.Info, []byte, error) {
+	info, err := splash.Inspect(source, source.Size)
+	if !errors.Is(err, errInvalidBMP) {
+		return info, nil, err
+	}
+
+	data, convertErr := splash.Convert(source.Open())
+	if errors.Is(convertErr, splash.ErrUnknownFormat) {
+		return nil, nil, err
+	}
+
+	if convertErr != nil {
+		return nil, nil, convertErr
+	}
+
+	if info, err = splash.Inspect(bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, nil, err
+	}
+
+	return info, data, nil
+}
+
+// validSplash returns whether the splash file is a BMP image the stub can show, or one converted to it.
+func validSplash(path string) bool {
+	source, done, err := openSplash(path)
+	if err != nil {
+		return false
+	}
+
+	defer done()
+
+	_, _, err = readSplash(source)
+
+	return err == nil
+}
+
+// checkSplashSize warns when the splash is larger than the typical screen, which the stub does not
+// show it on, or than SplashMaxSize.
+func (builder *Builder) checkSplashSize(info *splash.Info, size int64) {
+	if info.Oversized() {
+		builder.warn("The splash is larger than the screen of many firmware, which systemd-stub does not show it on",
+			"width", info.Width, "height", info.Height, "typical", fmt.Sprintf("%dx%d", splash.TypicalWidth, splash.TypicalHeight))
+	}
+
+	if builder.SplashMaxSize > 0 && size > builder.SplashMaxSize {
+		builder.warn("The splash is larger than its size budget", "size", size, "max", builder.SplashMaxSize)
+	}
+}
+
+// splashLines returns the lines of the rendered splash: the name and version, the build date, and the
+// variant of the UKI if any.
+func (builder *Builder) splashLines() []string {
+	lines := []string{strings.TrimSpace(builder.Identity.Resolve().Name + " " + builder.Version), buildDate()}
+
+	if builder.splashVariant != "" {
+		lines = append(lines, strings.ToUpper(builder.splashVariant))
+	}
+
+	return lines
+}
+
+// buildDate returns the date of the build, SOURCE_DATE_EPOCH if set so the UKI can be reproduced.
+func buildDate() string {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC().Format(time.DateOnly)
+	}
+
+	return time.Now().UTC().Format(time.DateOnly)
+}
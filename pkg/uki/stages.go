@@ -0,0 +1,332 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/stub"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// BuildState is the state of a build run stage by stage: PrepareSections, Measure, Assemble and Sign.
+//
+// Build runs all of them. Running them one by one lets callers split a build, i.e. assemble unsigned
+// UKIs in one service and sign them in another one holding the keys, with a state only setting UnsignedPath.
+type BuildState struct {
+	// Stub the sections are assembled onto.
+	Stub stub.Stub
+	// Sections of the UKI in layout order, the PCR signature included once measured.
+	Sections []Section
+	// Path to the unsigned UKI. Assemble writes it to the scratch dir when empty.
+	UnsignedPath string
+	// Authenticode digest of the unsigned UKI computed while assembling it, nil if unknown.
+	UnsignedDigest []byte
+
+	scratchDir string
+	started    time.Time
+	measured   bool
+	// the unsigned UKI assembled out of the scratch dir, removed on Close
+	temporary string
+	close     func()
+}
+
+// Close removes the generated sections and the unsigned UKI when assembled to the scratch dir,
+// and saves the build cache. The state can't be used by the later stages after it.
+func (state *BuildState) Close() {
+	if state.temporary != "" {
+		os.Remove(state.temporary) //nolint:errcheck
+		state.temporary = ""
+	}
+
+	if state.close != nil {
+		state.close()
+		state.close = nil
+	}
+}
+
+// use continues the build from state.
+func (builder *Builder) use(state *BuildState) {
+	builder.stub = state.Stub
+	builder.sections = state.Sections
+	builder.scratchDir = state.scratchDir
+	builder.unsignedUKIPath = state.UnsignedPath
+	builder.unsignedDigest = state.UnsignedDigest
+}
+
+// keep saves the progress of the build to state.
+func (builder *Builder) keep(state *BuildState) {
+	state.Stub = builder.stub
+	state.Sections = builder.sections
+	state.scratchDir = builder.scratchDir
+	state.UnsignedPath = builder.unsignedUKIPath
+	state.UnsignedDigest = builder.unsignedDigest
+}
+
+// PrepareSections checks the inputs and keys, generates the initrd if InitrdGenerator is set, and the
+// sections of the UKI into a new state.
+//
+// The state must be closed once done with it, to remove the generated sections.
+func (builder *Builder) PrepareSections() (*BuildState, error) {
+	builder.result = Result{}
+	builder.hashStats = pcr.HashStats{}
+
+	state := &BuildState{started: time.Now()}
+	builder.use(state)
+
+	if err := builder.init(); err != nil {
+		builder.destroyKeys()
+
+		return nil, err
+	}
+
+	// on the file system of the output, so the UKI is published by renaming it
+	removeScratchDir, err := builder.makeScratchDir(filepath.Dir(builder.OutUKIPath))
+	if err != nil {
+		builder.destroyKeys()
+
+		return nil, err
+	}
+
+	state.close = func() {
+		builder.destroyKeys()
+		removeScratchDir()
+		// saved after the scratch dir is removed, leaving the generated sections out
+		builder.saveBuildCache()
+	}
+
+	if err = builder.checkRevoked(builder.stub.Path()); err != nil {
+		state.Close()
+
+		return nil, err
+	}
+
+	if err = builder.checkSBAT(builder.stub.Path(), builder.SdBootPath); err != nil {
+		state.Close()
+
+		return nil, err
+	}
+
+	builder.checkHostSecureBoot()
+
+	if err = builder.checkKernelImage(); err != nil {
+		state.Close()
+
+		return nil, err
+	}
+
+	if err = builder.checkKernelSignature(); err != nil {
+		state.Close()
+
+		return nil, err
+	}
+
+	builder.inspectKernelImage()
+
+	if err = builder.generateInitrdImage(state); err != nil {
+		state.Close()
+
+		return nil, err
+	}
+
+	splitDone, err := builder.splitInitrd()
+	if err != nil {
+		state.Close()
+
+		return nil, err
+	}
+
+	closeState := state.close
+	state.close = func() {
+		splitDone()
+		closeState()
+	}
+
+	builder.log().Info("Generating UKI sections")
+
+	if err = builder.stage(StageGenerate, "", 0, builder.generateSections); err != nil {
+		state.Close()
+
+		return nil, err
+	}
+
+	builder.keep(state)
+
+	return state, nil
+}
+
+// Measure computes the PCR measurements of the sections, and adds their signature to them if a PCR
+// signer is set.
+func (builder *Builder) Measure(state *BuildState) error {
+	if state.measured {
+		return types.WithCategory(types.ErrInvalidInput, errors.New("the sections are measured already"))
+	}
+
+	builder.use(state)
+
+	if err := builder.loadBuildCache(); err != nil {
+		return err
+	}
+
+	// measure sections last
+	if err := builder.stage(StageMeasure, "", 0, builder.generatePCRSig); err != nil {
+		return types.WithCategory(types.ErrMeasurement, fmt.Errorf("error measuring sections: %w", err))
+	}
+
+	builder.log().Info("Generated UKI sections")
+
+	if err := builder.recordSections(); err != nil {
+		return fmt.Errorf("error generating sections: %w", err)
+	}
+
+	state.measured = true
+	builder.keep(state)
+
+	return nil
+}
+
+// Assemble writes the unsigned UKI out of the measured sections to UnsignedPath.
+func (builder *Builder) Assemble(state *BuildState) error {
+	if !state.measured {
+		return types.WithCategory(types.ErrInvalidInput, errors.New("the sections must be measured before assembling them"))
+	}
+
+	builder.use(state)
+
+	if builder.unsignedUKIPath == "" && builder.InMemory {
+		// without scratch dir, next to the output it is published to by renaming it
+		builder.unsignedUKIPath = filepath.Join(filepath.Dir(builder.OutUKIPath), "."+filepath.Base(builder.OutUKIPath)+".unsigned")
+		state.temporary = builder.unsignedUKIPath
+	}
+
+	builder.log().Info("Assembling UKI")
+
+	// assemble the final UKI file
+	if err := builder.stage(StageAssemble, builder.stub.Path(), builder.sectionsSize(), builder.assemble); err != nil {
+		return fmt.Errorf("error assembling UKI: %w", err)
+	}
+
+	builder.log().Info("Assembled UKI")
+	builder.keep(state)
+
+	return nil
+}
+
+// Sign signs sd-boot to OutSdBootPath and the unsigned UKI to OutUKIPath if signing is enabled,
+// otherwise the unsigned UKI is moved to its unsigned output path. The recovery UKI and the files
+// covering the outputs are written last.
+//
+// The state may come from another builder, Sign only reads UnsignedPath and UnsignedDigest of it.
+func (builder *Builder) Sign(state *BuildState) error {
+	if state.UnsignedPath == "" {
+		return types.WithCategory(types.ErrInvalidInput, errors.New("no assembled UKI to sign"))
+	}
+
+	if state.started.IsZero() {
+		state.started = time.Now()
+	}
+
+	defer builder.destroyKeys()
+
+	// the state may not be prepared by this builder, its signers are created here then
+	if err := builder.initSigners(); err != nil {
+		return err
+	}
+
+	builder.use(state)
+
+	if err := builder.signSdBoot(); err != nil {
+		return err
+	}
+
+	if err := builder.signUKI(); err != nil {
+		return err
+	}
+
+	if err := builder.finish(); err != nil {
+		return err
+	}
+
+	builder.finishReport(time.Since(state.started))
+
+	return nil
+}
+
+// signSdBoot signs sd-boot to OutSdBootPath, if given and signing is enabled.
+func (builder *Builder) signSdBoot() error {
+	if builder.SdBootPath == "" || !builder.sbSignEnabled() {
+		builder.log().Info("Not signing systemd-boot")
+
+		return nil
+	}
+
+	if err := builder.checkRevoked(builder.SdBootPath); err != nil {
+		return err
+	}
+
+	builder.log().Info("Signing systemd-boot", "path", builder.SdBootPath)
+
+	var (
+		sum       []byte
+		approvals []pesign.Approval
+	)
+
+	err := builder.stage(StageSignSdBoot, builder.OutSdBootPath, fileSize(builder.SdBootPath), func() (err error) {
+		sum, approvals, err = builder.SecureBootSigner.SignApproved(builder.SdBootPath, builder.OutSdBootPath, nil, builder.Approvals)
+
+		return types.NewBuildError(StageSignSdBoot, "", builder.SdBootPath, err)
+	})
+	if err != nil {
+		return types.WithCategory(types.ErrSigning, fmt.Errorf("error signing sd-boot: %w", err))
+	}
+
+	builder.log().Info("Signed systemd-boot", "path", builder.OutSdBootPath)
+
+	return builder.recordSignedOutput("sd-boot", builder.OutSdBootPath, sum, approvals)
+}
+
+// signUKI signs the unsigned UKI to OutUKIPath if signing is enabled, or publishes it unsigned.
+func (builder *Builder) signUKI() error {
+	if !builder.sbSignEnabled() {
+		// Move it to final place as we will remove the scratch dir
+		unsignedPath := builder.unsignedOutputPath()
+		if err := utils.Publish(builder.unsignedUKIPath, unsignedPath, builder.outputMode("uki", false)); err != nil {
+			return err
+		}
+		builder.log().Info("Unsigned UKI", "path", unsignedPath)
+
+		return builder.recordOutput("uki", unsignedPath, false)
+	}
+
+	if err := builder.checkRevokedUKI(); err != nil {
+		return err
+	}
+
+	// signed with the digest computed while assembling, the UKI is read only once to write the output
+	var (
+		sum       []byte
+		approvals []pesign.Approval
+	)
+
+	builder.log().Info("Signing UKI")
+	err := builder.stage(StageSign, builder.OutUKIPath, fileSize(builder.unsignedUKIPath), func() (err error) {
+		sum, approvals, err = builder.SecureBootSigner.SignApproved(builder.unsignedUKIPath, builder.OutUKIPath, builder.unsignedDigest, builder.Approvals)
+
+		return types.NewBuildError(StageSign, "", builder.unsignedUKIPath, err)
+	})
+	if err != nil {
+		return types.WithCategory(types.ErrSigning, fmt.Errorf("error signing UKI: %w", err))
+	}
+	builder.log().Info("Signed UKI", "path", builder.OutUKIPath)
+
+	return builder.recordSignedOutput("uki", builder.OutUKIPath, sum, approvals)
+}
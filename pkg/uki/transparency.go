@@ -0,0 +1,71 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+)
+
+// transparencyLogged returns whether the SecureBoot signature of the output kind is logged, the
+// signed PE files: the UKIs, sd-boot and the initrd addons.
+func transparencyLogged(kind string) bool {
+	switch strings.TrimPrefix(kind, RecoveryVariant+"-") {
+	case "uki", "sd-boot", OutputInitrdAddon:
+		return true
+	default:
+		return false
+	}
+}
+
+// logSignatures submits the SecureBoot signatures of the signed outputs to the transparency log, and
+// records their entries, with the inclusion proofs, in the result.
+//
+// The logged signature is the one of the Authenticode signed data of the output: its attributes,
+// which cover the Authenticode digest, signed with the key of the certificate.
+func (builder *Builder) logSignatures() error {
+	if builder.TransparencyLog == nil {
+		return nil
+	}
+
+	cert := builder.SecureBootSigner.Certificate()
+
+	for i := range builder.result.Outputs {
+		output := &builder.result.Outputs[i]
+		if !output.Signed || output.Transparency != nil || !transparencyLogged(output.Kind) {
+			continue
+		}
+
+		_, signatures, err := pesign.Signatures(output.Path)
+		if err != nil {
+			return err
+		}
+
+		var signature *pesign.Signature
+
+		for j := range signatures {
+			if signatures[j].Signer != nil && signatures[j].Signer.Equal(cert) && signatures[j].SignedAttributes != nil {
+				signature = &signatures[j]
+			}
+		}
+
+		if signature == nil {
+			return fmt.Errorf("%s has no signature of the SecureBoot certificate to log", output.Path)
+		}
+
+		digest := sha256.Sum256(signature.SignedAttributes)
+
+		if output.Transparency, err = builder.TransparencyLog.Submit(digest[:], signature.Value, cert); err != nil {
+			return fmt.Errorf("error logging the signature of %s: %w", output.Path, err)
+		}
+
+		builder.log().Info("Logged signature", "path", output.Path, "index", output.Transparency.LogIndex)
+	}
+
+	return nil
+}
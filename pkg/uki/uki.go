@@ -6,14 +6,25 @@
 package uki
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/kairos-io/go-ukify/pkg/cmdline"
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/oci"
 	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/rekor"
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/kairos-io/go-ukify/pkg/stub"
 	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	"golang.org/x/sync/errgroup"
 )
 
 // Builder is a UKI file builder.
@@ -24,18 +35,69 @@ type Builder struct {
 	Arch string
 	// Version of Talos.
 	Version string
-	// Path to the sd-stub.
+	// Path to the sd-stub, discovered in stub.Dir for Arch when empty or stub.Auto.
+	// An http or https URL is fetched into the stub cache, SdStubSHA256 is then required.
 	SdStubPath string
-	// Path to the sd-boot.
+	// Expected SHA256 of the sd-stub in hex, checked when set.
+	SdStubSHA256 string
+	// Stub the UKI is assembled from, the systemd-stub at SdStubPath when nil.
+	// Sections the stub does not support are left out of the UKI.
+	Stub stub.Stub
+	// Path to the sd-boot, discovered in stub.Dir for Arch when stub.Auto.
 	SdBootPath string
-	// Path to the kernel image.
+	// Path to the kernel image. The kernel, initrd, os-release and recovery initrd may also be given as a
+	// path in an OCI image, oci://registry/repository:tag!/boot/vmlinuz, to pull them out of it.
 	KernelPath string
 	// Path to the initrd image.
 	InitrdPath string
+	// What to do with the vendor signature of a kernel signed already, i.e. a distribution one: nothing
+	// when empty, KernelSignatureRecord or KernelSignatureRequire. The kernel is embedded as is, so its
+	// signature is kept either way.
+	KernelSignature string
+	// Paths to the PEM certificates a required kernel signature must chain to, any valid signature is
+	// accepted when empty.
+	KernelCAs []string
+	// Contents of the kernel image read instead of KernelPath when set, i.e. streamed from the network.
+	KernelSource *types.SectionSource
+	// Contents of the initrd image read instead of InitrdPath when set, i.e. generated in memory.
+	InitrdSource *types.SectionSource
+	// Generator of the initrd run before generating the sections, i.e. an initrd.Dracut, instead of reading
+	// InitrdPath or InitrdSource. It generates the initrd of KernelVersion.
+	InitrdGenerator initrd.Generator
+	// Size the initrd embedded in the UKI is limited to, for firmware failing to load large images, no
+	// limit when 0. The rest of a larger initrd is split into addons built from AddonStubPath, placed in
+	// `<OutUKIPath>.extra.d/`, which systemd-stub measures into PCR 12 and passes to the kernel after the
+	// embedded part. Their events are added to the result next to the extensions.
+	MaxInitrdSize int64
+	// Path to the addon stub the initrd addons are built from, i.e. addonx64.efi.stub.
+	AddonStubPath string
+	// Version of the kernel the initrd is generated for, Uname or the one read from the kernel image when empty.
+	KernelVersion string
+	// Kernel version embedded as the .uname section instead of the one read from the kernel image, i.e.
+	// when it can't be read or the kernel is built for another architecture. Without it, and when it
+	// can't be read, the section is left out, which changes the PCR predictions.
+	Uname string
+	// Path to a file holding the kernel version, as include/config/kernel.release, read instead of Uname.
+	UnamePath string
+	// Whether the kernel is inspected, its format, banner and embedded configuration recorded in the
+	// result, see KernelInfo.
+	KernelReport bool
 	// Kernel cmdline.
 	Cmdline string
+	// Severity of the cmdline rules by rule name, or cmdline.AllRules for all of them, overriding the
+	// default ones. The cmdlines of the UKI and the recovery UKI are checked before building: options
+	// flagged by error rules fail the build, i.e. rd.break or init=/bin/sh, options flagged by warn
+	// rules raise a warning. See cmdline.Rules.
+	CmdlineLint map[string]cmdline.Severity
+	// Paths to system (*.sysext.raw) and configuration (*.confext.raw) extension images, copied to
+	// `<OutUKIPath>.extra.d/` for systemd-stub to pick up. Their PCR 13 values and the events they
+	// extend are added to the result.
+	Extensions []string
 	// Os-release file
 	OsRelease string
+	// Order of the sections in the UKI: the listed ones come first in this order, the others follow in the
+	// default order, with the kernel last. Sections not in the UKI may be listed. See SectionOrder for the rules.
+	SectionOrder SectionOrder
 	// Phases to measure for
 	Phases []types.PhaseInfo
 
@@ -45,13 +107,123 @@ type Builder struct {
 	SBKey string
 	// SecureBoot cert
 	SBCert string
+	// PEM encoded SecureBoot key and cert, instead of SBKey and SBCert, for keys that are never written
+	// to disk. The builder keeps no copy of the key, the caller should zero it once the build is done.
+	SBKeyPEM  []byte
+	SBCertPEM []byte
 
 	// PCR signer.
 	PCRSigner types.RSAKey
 	// Path to the PCR signing key
 	PCRKey string
+	// PEM encoded PCR signing key, instead of PCRKey. See SBKeyPEM.
+	PCRKeyPEM []byte
+	// Whether the signers loaded from the keys are kept for the next build, i.e. when rebuilding on
+	// changes, instead of zeroing the keys once the build is done.
+	KeepKeys bool
 
+	// Forbidden signature database checked before signing: the build fails if it revokes the SecureBoot
+	// certificate, the sd-stub, sd-boot or the assembled UKI. Not checked if nil.
+	Dbx *secureboot.Revocations
+	// Path to the dbx signature list loaded into Dbx, or DbxSystem for the dbx of the running system.
+	DbxPath string
+	// Whether dbx matches only raise a warning.
+	DbxWarnOnly bool
+	// SBAT revocation policy the stubs are checked against before being embedded: the build fails if
+	// it revokes a component of the sd-stub, sd-boot, the addon stub or the generated .sbat section.
+	// Not checked if nil.
+	SBATPolicy sbat.Policy
+	// Path to the policy in the SbatLevel format loaded into SBATPolicy, SBATPolicyLatest for the
+	// bundled latest revocations of shim, which only list shim and grub, or SBATPolicySystem for the
+	// ones of the running system.
+	SBATPolicyPath string
+	// Whether SBAT revocations only raise a warning.
+	SBATWarnOnly bool
+	// Whether to warn when the Secure Boot state of the running system, the target host, would not
+	// accept the SecureBoot certificate.
+	CheckHostSecureBoot bool
+	// Whether to refuse to sign with key files, so production UKIs are only signed with keys held out
+	// of the process, i.e. in a PKCS#11 token, a TPM or a signing service. Key paths, PEM keys and
+	// signers not marked hardware-backed are refused, see pesign.HardwareBacked, and
+	// pesign.Signer.FileKey for the external tools.
+	RequireHardwareKeys bool
+	// Approvals the SecureBoot signatures need, Required of the Approvers signing the Authenticode
+	// digest of each file before its signature is attached, see pesign.Signer.SignApproved. The
+	// Threshold of the SecureBoot signer is ignored, none when nil.
+	Approvals *pesign.Threshold
+	// Transparency log the SecureBoot signatures of the outputs are submitted to, recording their
+	// entries and inclusion proofs in the result, none when nil.
+	TransparencyLog *rekor.Client
+	// PEM public key of the transparency log, set as its PublicKey to verify the inclusion of the
+	// entries, see rekor.LogEntry.Verify.
+	TransparencyLogKey string
+
+	// Called to obtain the passphrase of encrypted keys
+	Passphrase pesign.PassphraseFunc
+
+	// Client of the registries the inputs given as a path in an OCI image are pulled from, an anonymous
+	// one using the docker config credentials when nil.
+	Registry *oci.Client
+
+	// Called with the progress of each build stage, may be nil.
+	Progress func(Progress)
+	// Logger of the build messages, slog.Default() when nil. A logger with its own handler and level keeps
+	// the build messages apart from the ones of an application embedding the builder.
+	Logger *slog.Logger
+
+	// Directory of the on-disk build cache, disabled if empty.
+	// The digests of inputs unchanged since the previous build are reused from it, so a rebuild
+	// after a cmdline change only hashes the small generated sections again.
+	BuildCacheDir string
+
+	// Keep the generated sections in memory instead of a scratch directory, for read-only file systems
+	// without temp space. The UKI is then assembled next to its output instead.
+	InMemory bool
+
+	// Memory budget of the build in bytes, unlimited if 0, i.e. for 256M build containers.
+	// Inputs are then streamed through buffers sized after it instead of being memory mapped,
+	// and the Go runtime collects garbage before reaching it, see utils.LimitMemory.
+	MaxMemory int64
+
+	// Path to the splash image, the bundled logo is used when empty. PNG and JPEG images are converted
+	// to the BMP format systemd-stub reads.
 	Splash string
+	// Contents of the splash image read instead of Splash when set, i.e. rendered at build time. They
+	// are converted and checked as the Splash file is, see types.BytesSource and types.NewSectionSource.
+	SplashSource *types.SectionSource
+	// Whether the splash is rendered with the name of the Identity, the Version and the build date,
+	// SOURCE_DATE_EPOCH or today, instead of reading Splash, so the UKI identifies itself at boot.
+	SplashText bool
+	// Whether a missing or invalid Splash falls back to the bundled logo with a warning, instead of failing.
+	SplashFallback bool
+	// Size in bytes of the BMP splash over which the build warns, no budget when 0. It also warns about
+	// splashes larger than the typical screen, see splash.TypicalWidth.
+	SplashMaxSize int64
+
+	// Path to a firmware image embedded as the .efifw section, for systemd-stub 258 or later to expose to
+	// the OS, not embedded if empty. It is measured like the other sections.
+	Firmware string
+
+	// Extra SBAT entries, merged into the SBAT of the sd-stub.
+	SBAT []sbat.Entry
+	// Identity of the distribution in the generated os-release and the SBAT, the Kairos one when empty.
+	Identity Identity
+	// Conventions the UKI follows, ProfileKairos when empty. See ProfileTalos.
+	Profile string
+	// Generation and vendor of SBAT components by component name, overriding the ones of the sd-stub SBAT,
+	// the extra entries and the identity, i.e. to bump a generation for a revocation without a new stub.
+	SBATGenerations map[string]int
+	SBATVendors     map[string]string
+
+	// Recovery options, see OutRecoveryUKIPath.
+	//
+	// Kernel cmdline of the recovery UKI.
+	RecoveryCmdline string
+	// Path to the initrd of the recovery UKI, InitrdPath is used when empty.
+	RecoveryInitrdPath string
+	// Path to the splash image of the recovery UKI, i.e. one marked RECOVERY, converted and checked as
+	// Splash is. Splash is used when empty.
+	RecoverySplash string
 
 	// Output options:
 	//
@@ -59,23 +231,156 @@ type Builder struct {
 	OutSdBootPath string
 	// Path to the output UKI file.
 	OutUKIPath string
+	// Path to the checksums file covering the outputs, not written if empty.
+	// It is signed with the SecureBoot key to <path>.p7s if signing is enabled.
+	OutChecksumsPath string
+	// Path to a bundle collecting the outputs, the PCR files and the build manifest, not written if empty.
+	// It is a tarball if the path ends in .tar, .tar.gz or .tgz, a directory otherwise.
+	OutBundlePath string
+	// Path to a recovery UKI built from the same stub, kernel and keys with the recovery cmdline and initrd,
+	// not built if empty. Its outputs and measurements are added to the result.
+	OutRecoveryUKIPath string
+	// Path to an SBOM listing the stub, sections, sd-boot, SecureBoot certificate and outputs with their
+	// digests, not written if empty.
+	OutSBOMPath string
+	// Format of the SBOM, SBOMCycloneDX when empty or SBOMSPDX.
+	SBOMFormat string
+	// Whether an SBOM of the inputs is embedded into the UKI as a .sbom section.
+	EmbedSBOM bool
+	// Mode of the output files: the UKIs, sd-boot, addons, extensions, checksums, SBOM and bundle.
+	// 0644 when zero, 0755 for the unsigned UKI.
+	OutputMode os.FileMode
+	// Owner of the output files as user[:group], each a name or an id, unchanged when empty.
+	OutputOwner string
+
+	// Generators of the UKI sections run by the build, DefaultGenerators when nil.
+	// See ReplaceGenerator, RemoveGenerator and InsertGenerator.
+	Generators []SectionGenerator
+
+	// sections added with AddSection
+	addedSections []Section
 
 	// fields initialized during build
+	stub            stub.Stub
 	sections        []types.UkiSection
 	scratchDir      string
 	unsignedUKIPath string
+	// Authenticode digest of the unsigned UKI computed while assembling it, nil if unknown
+	unsignedDigest []byte
+	result         Result
+	// digests of the section files, shared by the measurements and the result
+	hashCache *pcr.HashCache
+	// how the sections of the last build were hashed
+	hashStats pcr.HashStats
+	// parts of the initrd split after MaxInitrdSize, the embedded one first
+	initrdParts []*types.SectionSource
+	// variant stamped on the rendered splash, see SplashText
+	splashVariant string
+	// signers loaded from the given keys, zeroed once the build is done, see destroyKeys
+	loadedPCRSigner *pesign.PCRSigner
+	loadedSBSigner  *pesign.SecureBootSigner
 }
 
 // Build the UKI file.
 //
 // Build process is as follows:
-//   - sign the sd-boot EFI binary, and write it to the OutSdBootPath
-//   - build ephemeral sections (uname, os-release), and other proposed sections
-//   - measure sections, generate signature, and append to the list of sections
-//   - assemble the final UKI file starting from sd-stub and appending generated section.
+//   - build ephemeral sections (uname, os-release), and other proposed sections, see PrepareSections
+//   - measure sections, generate signature, and append to the list of sections, see Measure
+//   - assemble the final UKI file starting from sd-stub and appending generated section, see Assemble
+//   - sign the sd-boot EFI binary and the UKI, and write them to OutSdBootPath and OutUKIPath, see Sign.
 func (builder *Builder) Build() error {
+	start := time.Now()
+
+	defer func() {
+		builder.finishReport(time.Since(start))
+	}()
+
+	if builder.MaxMemory > 0 {
+		defer utils.LimitMemory(builder.MaxMemory)()
+	}
+
+	state, err := builder.PrepareSections()
+	if err != nil {
+		return err
+	}
+
+	defer state.Close()
+
+	if err = builder.Measure(state); err != nil {
+		return err
+	}
+
+	if err = builder.Assemble(state); err != nil {
+		return err
+	}
+
+	return builder.Sign(state)
+}
+
+// unsignedMode is the mode of the unsigned UKI output.
+const unsignedMode = 0o755
+
+// makeScratchDir creates the directory of the generated sections and the unsigned UKI in parent,
+// or the temp dir if empty or not writable, unless the sections are kept in memory.
+func (builder *Builder) makeScratchDir(parent string) (remove func(), err error) {
+	if builder.InMemory {
+		return func() {}, nil
+	}
+
+	if parent != "" {
+		builder.scratchDir, err = os.MkdirTemp(parent, ".ukify-")
+	}
+
+	if parent == "" || err != nil {
+		builder.scratchDir, err = os.MkdirTemp("", "ukify")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	dir := builder.scratchDir
+
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			builder.log().Warn("Failed to remove scratch dir", "path", dir, "error", err)
+		}
+	}, nil
+}
+
+// init checks the inputs and creates the signers from the given keys.
+func (builder *Builder) init() error {
 	var err error
 
+	if err = builder.applyProfile(); err != nil {
+		return err
+	}
+
+	if err = builder.DiscoverStubs(); err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	if err = builder.pullImageInputs(); err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	if err = builder.checkInputs(); err != nil {
+		return types.WithCategory(types.ErrInvalidInput, err)
+	}
+
+	builder.stub = builder.Stub
+	if builder.stub == nil {
+		if builder.stub, err = stub.NewSystemdStub(builder.SdStubPath); err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+	}
+
+	if builder.SBATPolicy == nil && builder.SBATPolicyPath != "" {
+		if builder.SBATPolicy, err = loadSBATPolicy(builder.SBATPolicyPath); err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+	}
+
 	// Check if we got any phases
 	if len(builder.Phases) == 0 {
 		// use default phases
@@ -83,123 +388,314 @@ func (builder *Builder) Build() error {
 	}
 
 	if builder.PCRSigner == nil {
-		if builder.PCRKey != "" {
-			signer, err := pesign.NewPCRSigner(builder.PCRKey)
-			if err != nil {
-				return err
-			}
+		var signer *pesign.PCRSigner
+
+		switch {
+		case builder.PCRKeyPEM != nil:
+			signer, err = pesign.NewPCRSignerFromPEM(builder.PCRKeyPEM, builder.Passphrase)
+		case builder.PCRKey != "":
+			signer, err = pesign.NewPCRSignerWithPassphrase(builder.PCRKey, builder.Passphrase)
+		}
+
+		if err != nil {
+			return types.WithCategory(types.ErrInvalidInput, err)
+		}
+
+		if signer != nil {
 			builder.PCRSigner = signer
+			builder.loadedPCRSigner = signer
 		}
 	}
 
+	return builder.initSigners()
+}
+
+// initSigners creates the SecureBoot signer from the given keys and loads the dbx and the transparency log
+// key, if signing is enabled, and checks the signers are hardware-backed if required.
+func (builder *Builder) initSigners() error {
+	var err error
+
 	// Try to generate a signer base on our given args
 	// If we have a	either a signer or key/cert
 	// Try to use first the signer as we can use a custom signed passed in the struct
 	// otherwise create a new default signer with the key and cert
 	if builder.sbSignEnabled() {
 		if builder.SecureBootSigner == nil {
-			if builder.SBCert != "" && builder.SBKey != "" {
-				sb, err := pesign.NewSecureBootSigner(builder.SBCert, builder.SBKey)
-				if err != nil {
-					return err
-				}
+			var sb *pesign.SecureBootSigner
+
+			switch {
+			case builder.SBKeyPEM != nil && builder.SBCertPEM != nil:
+				sb, err = pesign.NewSecureBootSignerFromPEM(builder.SBCertPEM, builder.SBKeyPEM, builder.Passphrase)
+			case builder.SBCert != "" && builder.SBKey != "":
+				sb, err = pesign.NewSecureBootSignerWithPassphrase(builder.SBCert, builder.SBKey, builder.Passphrase)
+			}
+
+			if err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+
+			if sb != nil {
+				builder.loadedSBSigner = sb
+
 				sbSigner, err := pesign.NewSigner(sb)
 				if err != nil {
 					return err
 				}
+				sbSigner.Logger = builder.Logger
 				builder.SecureBootSigner = sbSigner
 			}
 		}
-	}
 
-	builder.scratchDir, err = os.MkdirTemp("", "ukify")
-	if err != nil {
-		return err
-	}
+		if builder.Dbx == nil && builder.DbxPath != "" {
+			if builder.Dbx, err = loadDbx(builder.DbxPath); err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
+		}
 
-	defer func() {
-		if err = os.RemoveAll(builder.scratchDir); err != nil {
-			log.Printf("failed to remove scratch dir: %v", err)
+		if builder.TransparencyLog != nil && builder.TransparencyLog.PublicKey == nil && builder.TransparencyLogKey != "" {
+			if builder.TransparencyLog.PublicKey, err = rekor.LoadPublicKey(builder.TransparencyLogKey); err != nil {
+				return types.WithCategory(types.ErrInvalidInput, err)
+			}
 		}
-	}()
+	}
 
-	// Sign sd-boot if given and signing is enabled
-	if builder.SdBootPath != "" && builder.sbSignEnabled() {
-		slog.Info("Signing systemd-boot", "path", builder.SdBootPath)
+	return builder.checkHardwareKeys()
+}
 
-		// sign sd-boot
-		if err = builder.SecureBootSigner.Sign(builder.SdBootPath, builder.OutSdBootPath); err != nil {
-			return fmt.Errorf("error signing sd-boot: %w", err)
-		}
+// generateSections builds the list of all sections, except the PCR signature.
+//
+// The generators are independent of each other, so they run concurrently. Their sections are
+// collected in generator order, keeping the final layout deterministic.
+func (builder *Builder) generateSections() error {
+	builder.sections = nil
+
+	generators := builder.generators()
+	generated := make([][]types.UkiSection, len(generators))
+
+	var group errgroup.Group
+
+	for i, generator := range generators {
+		group.Go(func() error {
+			sections, err := generator.Generate(builder)
+			if err != nil {
+				// errors not telling the section are told by the generator name
+				var buildErr *types.BuildError
+				if !errors.As(err, &buildErr) {
+					err = &types.BuildError{Stage: StageGenerate, Err: fmt.Errorf("%s generator: %w", generator.Name(), err)}
+				}
+
+				return err
+			}
+
+			generated[i] = sections
 
-		slog.Info("Signed systemd-boot", "path", builder.OutSdBootPath)
-	} else {
-		slog.Info("Not signing systemd-boot")
+			return nil
+		})
 	}
 
-	slog.Info("Generating UKI sections")
+	if err := group.Wait(); err != nil {
+		return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("error generating sections: %w", err))
+	}
 
-	// generate and build list of all sections
-	for _, generateSection := range []func() error{
-		builder.generateOSRel,
-		builder.generateCmdline,
-		builder.generateInitrd,
-		builder.generateSplash,
-		builder.generateUname,
-		builder.generateSBAT,
-		builder.generatePCRPublicKey,
-		// append kernel last to account for decompression
-		builder.generateKernel,
-		// measure sections last
-		builder.generatePCRSig,
-	} {
-		if err = generateSection(); err != nil {
-			return fmt.Errorf("error generating sections: %w", err)
-		}
+	for _, sections := range generated {
+		builder.sections = append(builder.sections, sections...)
 	}
 
-	slog.Info("Generated UKI sections")
+	builder.sections = builder.addSections(builder.sections)
 
-	slog.Info("Assembling UKI")
+	supported := builder.sections[:0]
 
-	// assemble the final UKI file
-	if err = builder.assemble(); err != nil {
-		return fmt.Errorf("error assembling UKI: %w", err)
+	for _, section := range builder.sections {
+		if !builder.stub.Supports(section.Name) {
+			builder.warn("Stub does not support section, leaving it out", "section", section.Name, "stub", builder.stub.Path())
+			continue
+		}
+
+		supported = append(supported, section)
 	}
 
-	slog.Info("Assembled UKI")
+	builder.sections = supported
 
-	// sign the UKI file if signing is enabled
-	if builder.sbSignEnabled() {
-		slog.Info("Signing UKI")
-		err = builder.SecureBootSigner.Sign(builder.unsignedUKIPath, builder.OutUKIPath)
-		if err == nil {
-			slog.Info(fmt.Sprintf("Signed UKI at %s", builder.OutUKIPath))
-		}
-	} else {
-		// Move it to final place as we will remove the scratch dir
-		fileRead, err := os.ReadFile(builder.unsignedUKIPath)
+	if builder.EmbedSBOM {
+		sbom, err := builder.generateSBOM()
 		if err != nil {
-			return err
+			return types.WithCategory(types.ErrInvalidInput, fmt.Errorf("error generating sections: %w", err))
 		}
-		err = os.WriteFile(strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1), fileRead, os.ModePerm)
-		if err != nil {
-			return err
-		}
-		slog.Info(fmt.Sprintf("Unsigned UKI at %s", strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1)))
+
+		builder.sections = append(builder.sections, sbom...)
 	}
 
-	return err
+	builder.orderSections()
+
+	return nil
+}
+
+// unsignedOutputPath is where the UKI is written when it is not signed.
+func (builder *Builder) unsignedOutputPath() string {
+	return strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1)
+}
+
+// log returns the logger of the build messages.
+func (builder *Builder) log() *slog.Logger {
+	if builder.Logger == nil {
+		return slog.Default()
+	}
+
+	return builder.Logger
 }
 
 // sbSignEnabled let us know if we have to sign the sd-boot and uki final file
 // Checks if we have a signer or a key/cert pair to sign
 func (builder *Builder) sbSignEnabled() bool {
-	return builder.SecureBootSigner != nil || (builder.SBKey != "" && builder.SBCert != "")
+	return builder.SecureBootSigner != nil || (builder.SBKey != "" && builder.SBCert != "") ||
+		(builder.SBKeyPEM != nil && builder.SBCertPEM != nil)
 }
 
 // pcrSignEnabled let us know if we have to sign the measurements
 // Checks if we have a pcr signer or a pcrkey
 func (builder *Builder) pcrSignEnabled() bool {
-	return builder.PCRSigner != nil || builder.PCRKey != ""
+	return builder.PCRSigner != nil || builder.PCRKey != "" || builder.PCRKeyPEM != nil
+}
+
+// destroyKeys zeroes the keys the builder loaded itself and drops their signers, so the keys don't
+// outlive the build in memory. The next build loads them again.
+func (builder *Builder) destroyKeys() {
+	if builder.KeepKeys {
+		return
+	}
+
+	if builder.loadedPCRSigner != nil {
+		builder.loadedPCRSigner.Destroy()
+		builder.PCRSigner = nil
+		builder.loadedPCRSigner = nil
+	}
+
+	if builder.loadedSBSigner != nil {
+		builder.loadedSBSigner.Destroy()
+		builder.SecureBootSigner = nil
+		builder.loadedSBSigner = nil
+	}
+}
+
+// checkInputs verifies that all the input files given to the builder exist.
+func (builder *Builder) checkInputs() error {
+	var errs []error
+
+	for _, path := range []string{
+		builder.SdStubPath, builder.SdBootPath, builder.KernelPath, builder.InitrdPath, builder.OsRelease,
+		builder.RecoveryInitrdPath, builder.Firmware, builder.UnamePath, builder.AddonStubPath,
+	} {
+		if path == "" {
+			continue
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// checked when generated with a fallback
+	if builder.Splash != "" && !builder.SplashFallback {
+		if _, err := os.Stat(builder.Splash); err != nil {
+			errs = append(errs, fmt.Errorf("splash: %w", err))
+		}
+	}
+
+	if builder.RecoverySplash != "" && !builder.SplashFallback {
+		if _, err := os.Stat(builder.RecoverySplash); err != nil {
+			errs = append(errs, fmt.Errorf("recovery splash: %w", err))
+		}
+	}
+
+	for _, section := range builder.addedSections {
+		if section.Path == "" {
+			continue
+		}
+
+		if _, err := os.Stat(section.Path); err != nil {
+			errs = append(errs, fmt.Errorf("section %s: %w", section.Name, err))
+		}
+	}
+
+	errs = append(errs, builder.checkExtensions()...)
+	errs = append(errs, builder.checkKeyFiles()...)
+	errs = append(errs, builder.lintCmdlines()...)
+
+	if builder.InitrdGenerator != nil && (builder.InitrdPath != "" || builder.InitrdSource != nil) {
+		errs = append(errs, errors.New("the initrd can't be both generated and given"))
+	}
+
+	if builder.MaxInitrdSize < 0 || (builder.MaxInitrdSize > 0 && builder.MaxInitrdSize < initrdAlignment) {
+		errs = append(errs, fmt.Errorf("invalid maximum initrd size %d", builder.MaxInitrdSize))
+	}
+
+	if builder.MaxInitrdSize > 0 && builder.AddonStubPath == "" {
+		errs = append(errs, errors.New("splitting the initrd after its maximum size needs the addon stub"))
+	}
+
+	if builder.OutputMode&^os.ModePerm != 0 {
+		errs = append(errs, fmt.Errorf("invalid output mode %v, only permission bits can be set", builder.OutputMode))
+	}
+
+	if _, _, err := parseOwner(builder.OutputOwner); err != nil {
+		errs = append(errs, err)
+	}
+
+	if builder.PCRKey != "" && builder.PCRKeyPEM != nil {
+		errs = append(errs, errors.New("the PCR key can't be both read from a file and given"))
+	}
+
+	if (builder.SBKey != "" || builder.SBCert != "") && (builder.SBKeyPEM != nil || builder.SBCertPEM != nil) {
+		errs = append(errs, errors.New("the SecureBoot key can't be both read from a file and given"))
+	}
+
+	if (builder.SBKeyPEM != nil) != (builder.SBCertPEM != nil) {
+		errs = append(errs, errors.New("the SecureBoot key and certificate must be given together"))
+	}
+
+	if builder.Splash != "" && builder.SplashSource != nil {
+		errs = append(errs, errors.New("the splash can't be both read from a file and given"))
+	}
+
+	if builder.SplashText && (builder.Splash != "" || builder.SplashSource != nil) {
+		errs = append(errs, errors.New("the splash can't be both rendered and given"))
+	}
+
+	if builder.Uname != "" && builder.UnamePath != "" {
+		errs = append(errs, errors.New("the kernel version can't be both given and read from a file"))
+	}
+
+	if err := builder.SectionOrder.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if builder.Approvals != nil {
+		if err := builder.Approvals.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if builder.TransparencyLog != nil && !builder.sbSignEnabled() {
+		errs = append(errs, errors.New("signatures are only logged when signing for SecureBoot"))
+	}
+
+	if builder.TransparencyLogKey != "" && builder.TransparencyLog == nil {
+		errs = append(errs, errors.New("a transparency log key needs a transparency log"))
+	}
+
+	if builder.SBOMFormat != "" && builder.SBOMFormat != SBOMCycloneDX && builder.SBOMFormat != SBOMSPDX {
+		errs = append(errs, fmt.Errorf("unknown SBOM format %q", builder.SBOMFormat))
+	}
+
+	switch builder.KernelSignature {
+	case "", KernelSignatureRecord, KernelSignatureRequire:
+	default:
+		errs = append(errs, fmt.Errorf("unknown kernel signature mode %q", builder.KernelSignature))
+	}
+
+	if builder.OutRecoveryUKIPath != "" && builder.RecoveryCmdline == "" && builder.RecoveryInitrdPath == "" {
+		errs = append(errs, errors.New("the recovery UKI needs a recovery cmdline or initrd"))
+	}
+
+	return errors.Join(errs...)
 }
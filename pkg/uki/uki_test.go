@@ -0,0 +1,2369 @@
+package uki
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/kairos-io/go-ukify/internal/common"
+	"github.com/kairos-io/go-ukify/pkg/cmdline"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/rekor"
+	"github.com/kairos-io/go-ukify/pkg/secureboot"
+	"github.com/kairos-io/go-ukify/pkg/splash"
+	"github.com/kairos-io/go-ukify/pkg/stub"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "UKI test Suite")
+}
+
+// hardwareSigner and hardwarePCRKey mark the keys they wrap hardware-backed.
+type (
+	hardwareSigner struct{ pesign.CertificateSigner }
+	hardwarePCRKey struct{ types.RSAKey }
+)
+
+func (hardwareSigner) HardwareBacked() bool { return true }
+func (hardwarePCRKey) HardwareBacked() bool { return true }
+
+var _ = Describe("UKI tests", func() {
+	Describe("Manifest", func() {
+		It("Merges the defaults into each build", func() {
+			manifest, err := LoadManifest("testdata/manifest.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.Jobs).To(Equal(2))
+
+			multi, err := NewMultiBuilder(manifest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(multi.MemoryLimit).To(BeEquivalentTo(1 << 30))
+			Expect(multi.Names).To(Equal([]string{"default", "recovery"}))
+			Expect(multi.Builders).To(HaveLen(2))
+
+			def := multi.Builders[0]
+			Expect(def.SdStubPath).To(Equal("/usr/lib/systemd/boot/efi/linuxx64.efi.stub"))
+			Expect(def.KernelPath).To(Equal(filepath.Join("testdata", "kernel")))
+			Expect(def.InitrdPath).To(Equal(filepath.Join("testdata", "initrd")))
+			Expect(def.OutUKIPath).To(Equal(filepath.Join("testdata", "default.efi")))
+			Expect(def.Cmdline).To(Equal("console=ttyS0"))
+			Expect(def.Phases).To(Equal([]types.PhaseInfo{{Phase: constants.EnterInitrd}, {Phase: constants.LeaveInitrd}}))
+
+			recovery := multi.Builders[1]
+			Expect(recovery.InitrdPath).To(Equal(filepath.Join("testdata", "recovery-initrd")))
+			Expect(recovery.Cmdline).To(Equal("console=ttyS0 recovery"))
+		})
+		It("Builds within the memory limit sharing the section digests", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			multi, err := NewMultiBuilder(&Manifest{
+				Jobs:        2,
+				MemoryLimit: "1K",
+				Defaults: BuildConfig{
+					SdStubPath: "../pesign/testdata/file.efi",
+					KernelPath: filepath.Join(dir, "kernel"),
+					InitrdPath: filepath.Join(dir, "initrd"),
+				},
+				Builds: []BuildConfig{
+					{Name: "a", Cmdline: "console=ttyS0", OutUKIPath: filepath.Join(dir, "a.signed.efi")},
+					{Name: "b", Cmdline: "console=tty0", OutUKIPath: filepath.Join(dir, "b.signed.efi")},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			// the stub alone is over the limit, so the builds run one at a time
+			Expect(multi.Builders[0].inputsSize()).To(BeNumerically(">", multi.MemoryLimit))
+
+			results, err := multi.Build()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).To(HaveLen(2))
+			Expect(multi.Builders[0].hashCache).To(BeIdenticalTo(multi.Builders[1].hashCache))
+		})
+		It("Fails on invalid memory limits", func() {
+			_, err := NewMultiBuilder(&Manifest{MemoryLimit: "lots"})
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+		})
+		It("Refuses outputs written by several builds and signs the shared sd-boot once", func() {
+			defaults := BuildConfig{KernelPath: "kernel", InitrdPath: "initrd", SdBootPath: "systemd-bootx64.efi", OutSdBootPath: "out/systemd-bootx64.efi"}
+
+			multi, err := NewMultiBuilder(&Manifest{
+				Jobs:     2,
+				Defaults: defaults,
+				Builds:   []BuildConfig{{Name: "a", OutUKIPath: "out/a.efi"}, {Name: "b", OutUKIPath: "out/b.efi"}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(multi.Builders[0].OutSdBootPath).To(Equal("out/systemd-bootx64.efi"))
+			Expect(multi.Builders[1].OutSdBootPath).To(BeEmpty())
+			Expect(multi.Builders[1].SdBootPath).To(BeEmpty())
+
+			for _, builds := range [][]BuildConfig{
+				{{Name: "a", OutUKIPath: "out/uki.efi"}, {Name: "b", OutUKIPath: "out/./uki.efi"}},
+				{{Name: "a", OutUKIPath: "out/a.efi"}, {Name: "b", OutUKIPath: "out/b.efi", SdBootPath: "other.efi"}},
+				{{Name: "a", OutUKIPath: "out/a.efi", OutChecksums: "out/SHA256SUMS"}, {Name: "b", OutUKIPath: "out/b.efi", OutChecksums: "out/SHA256SUMS"}},
+			} {
+				_, err = NewMultiBuilder(&Manifest{Defaults: defaults, Builds: builds})
+				Expect(err).To(MatchError(types.ErrInvalidInput))
+				Expect(err).To(MatchError(ContainSubstring("is written by both build a and build b")))
+			}
+		})
+		It("Fails on builds missing required inputs", func() {
+			_, err := NewMultiBuilder(&Manifest{Builds: []BuildConfig{{Name: "empty"}}})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("missing kernel"))
+		})
+	})
+	Describe("Plan", func() {
+		var builder *Builder
+
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder = &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Cmdline:    "console=ttyS0",
+				OutUKIPath: filepath.Join(dir, "uki.signed.efi"),
+			}
+		})
+
+		It("Plans the sections and outputs without writing them", func() {
+			plan, err := builder.Plan()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.Outputs).To(Equal([]PlannedOutput{{Kind: "uki", Path: builder.unsignedOutputPath()}}))
+			Expect(builder.unsignedOutputPath()).ToNot(BeAnExistingFile())
+
+			var names []string
+			for _, section := range plan.Sections {
+				names = append(names, section.Name)
+			}
+			Expect(names).To(Equal([]string{".osrel", ".cmdline", ".initrd", ".splash", ".sbat", ".linux"}))
+			_, banks := types.GetTPMALGorithm()
+			Expect(plan.Measurements).To(HaveLen(len(types.OrderedPhases()) * len(banks)))
+		})
+		It("Leaves out the SHA-1 bank in FIPS mode", func() {
+			fips.Enforce(true)
+			DeferCleanup(fips.Enforce, false)
+
+			plan, err := builder.Plan()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.Measurements).To(HaveLen(len(types.OrderedPhases()) * 3))
+			for _, measurement := range plan.Measurements {
+				Expect(measurement.Algorithm).ToNot(Equal("SHA-1"))
+			}
+		})
+		It("Leaves out the sections the stub does not support", func() {
+			builder.Stub = &stub.Custom{StubPath: builder.SdStubPath, Sections: []constants.Section{constants.Linux, constants.Initrd, constants.CMDLine, constants.SBAT}}
+
+			plan, err := builder.Plan()
+			Expect(err).ToNot(HaveOccurred())
+
+			var names []string
+			for _, section := range plan.Sections {
+				names = append(names, section.Name)
+			}
+			Expect(names).To(Equal([]string{".cmdline", ".initrd", ".sbat", ".linux"}))
+			Expect(plan.Warnings).To(ContainElement(ContainSubstring("section=.osrel")))
+		})
+		It("Keeps the section order while generating them concurrently", func() {
+			for range 10 {
+				plan, err := builder.Plan()
+				Expect(err).ToNot(HaveOccurred())
+
+				var names []string
+				for _, section := range plan.Sections {
+					names = append(names, section.Name)
+				}
+				Expect(names).To(Equal([]string{".osrel", ".cmdline", ".initrd", ".splash", ".sbat", ".linux"}))
+				Expect(plan.Warnings).To(ContainElement(ContainSubstring("could not infer kernel version")))
+			}
+		})
+		It("Refuses dangerous cmdline options unless only warning", func() {
+			builder.Cmdline = "console=ttyS0 rd.break init=/bin/sh"
+			_, err := builder.Plan()
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+			Expect(err).To(MatchError(ContainSubstring("cmdline: rd.break drops to a shell in the initrd")))
+			Expect(err).To(MatchError(ContainSubstring("cmdline: init=/bin/sh runs a shell instead of init")))
+
+			builder.CmdlineLint = map[string]cmdline.Severity{cmdline.AllRules: cmdline.SeverityWarn}
+			plan, err := builder.Plan()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.Warnings).To(ContainElement(ContainSubstring("Dangerous cmdline option cmdline=cmdline option=rd.break")))
+
+			builder.CmdlineLint = map[string]cmdline.Severity{"shell": cmdline.SeverityWarn}
+			_, err = builder.Plan()
+			Expect(err).To(MatchError(ContainSubstring("unknown cmdline rule")))
+		})
+		It("Fails on missing inputs", func() {
+			builder.KernelPath = "does-not-exist"
+			_, err := builder.Plan()
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+		})
+	})
+	Describe("Sections", func() {
+		It("Lists only the UKI sections", func() {
+			sections, err := ListSections("../pesign/testdata/file.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sections).To(Equal([]constants.Section{constants.OSRel, constants.SBAT}))
+		})
+		It("Extracts a section without the alignment padding", func() {
+			data, err := GetSection("../pesign/testdata/file.efi", constants.SBAT)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(HavePrefix("sbat,1,"))
+			Expect(data).To(HaveLen(223))
+		})
+		It("Fails on missing sections", func() {
+			_, err := GetSection("../pesign/testdata/file.efi", constants.Initrd)
+			Expect(err).To(MatchError(ErrSectionNotFound))
+		})
+	})
+	Describe("Assemble", func() {
+		It("Streams the sections into the stub, replacing the ones it has", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "sbat"), []byte("sbat,1,SBAT Version,sbat,1,https://x\n"), 0o644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "linux"), make([]byte, 1000), 0o644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "cmdline"), nil, 0o644)).To(Succeed())
+
+			sections := []types.UkiSection{
+				{Name: constants.SBAT, Path: filepath.Join(dir, "sbat"), Append: true},
+				{Name: constants.CMDLine, Path: filepath.Join(dir, "cmdline"), Append: true},
+				{Name: constants.Linux, Path: filepath.Join(dir, "linux"), Append: true},
+			}
+			output := filepath.Join(dir, "uki.efi")
+			digest, err := assemblePE(slog.Default(), "../pesign/testdata/file.efi", sections, output)
+			Expect(err).ToNot(HaveOccurred())
+			// hashed for signing while assembled
+			Expect(pesign.Digest(output)).To(Equal(digest))
+
+			// the empty .cmdline is left out
+			Expect(ListSections(output)).To(Equal([]constants.Section{constants.OSRel, constants.SBAT, constants.Linux}))
+			Expect(GetSection(output, constants.SBAT)).To(BeEquivalentTo("sbat,1,SBAT Version,sbat,1,https://x\n"))
+			Expect(GetSection(output, constants.Linux)).To(Equal(make([]byte, 1000)))
+			osRelease, err := GetSection("../pesign/testdata/file.efi", constants.OSRel)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(GetSection(output, constants.OSRel)).To(Equal(osRelease))
+
+			peFile, err := pe.Open(output)
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+			header := peFile.OptionalHeader.(*pe.OptionalHeader64)
+			Expect(uint64(peFile.Section(string(constants.Linux)).VirtualAddress) + header.ImageBase).To(Equal(sections[2].VMA))
+			Expect(header.SizeOfImage % header.SectionAlignment).To(BeZero())
+
+			data, err := os.ReadFile(output)
+			Expect(err).ToNot(HaveOccurred())
+			// the checksum does not cover itself
+			checksumOffset := int(binary.LittleEndian.Uint32(data[peHeaderOffset:])) + 4 + coffHeaderSize + optCheckSum
+			w := &peChecksum{w: io.Discard}
+			_, _ = w.Write(data[:checksumOffset])
+			_, _ = w.Write(make([]byte, 4))
+			_, _ = w.Write(data[checksumOffset+4:])
+			Expect(header.CheckSum).To(Equal(w.sum()))
+
+			_, err = authenticode.Parse(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+	Describe("Repack", func() {
+		var builder *Builder
+
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder = &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Cmdline:    "console=ttyS0",
+				SBKey:      "../pesign/testdata/sb.key",
+				SBCert:     "../pesign/testdata/sb.pem",
+				PCRKey:     "../pesign/testdata/sb.key",
+				OutUKIPath: filepath.Join(dir, "uki.signed.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+		})
+
+		It("Recovers the stub without the UKI sections and signatures", func() {
+			sections, err := ListSections(builder.OutUKIPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			stub := filepath.Join(GinkgoT().TempDir(), "stub.efi")
+			Expect(stripUKI(slog.Default(), builder.OutUKIPath, sections, stub)).To(Succeed())
+			Expect(ListSections(stub)).To(Equal([]constants.Section{constants.SBAT}))
+			sbat, err := GetSection(builder.OutUKIPath, constants.SBAT)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(GetSection(stub, constants.SBAT)).To(Equal(sbat))
+
+			_, signatures, err := pesign.Signatures(stub)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signatures).To(BeEmpty())
+
+			// the stub code is kept as is
+			names := func(path string) []string {
+				f, err := pe.Open(path)
+				Expect(err).ToNot(HaveOccurred())
+				defer f.Close()
+
+				var names []string
+				for _, section := range f.Sections {
+					if !slices.Contains(sections, constants.Section(section.Name)) {
+						data, err := section.Data()
+						Expect(err).ToNot(HaveOccurred())
+						names = append(names, fmt.Sprintf("%s %x", section.Name, sha256.Sum256(data)))
+					}
+				}
+
+				return names
+			}
+			Expect(names(stub)).To(Equal(names("../pesign/testdata/file.efi")))
+		})
+		It("Rebuilds the UKI with the sections replaced and signs it", func() {
+			output := filepath.Join(GinkgoT().TempDir(), "repacked.efi")
+			repacker := &Builder{
+				Cmdline:    "console=tty0 quiet",
+				SBKey:      builder.SBKey,
+				SBCert:     builder.SBCert,
+				PCRKey:     builder.PCRKey,
+				OutUKIPath: output,
+			}
+			Expect(Repack(builder.OutUKIPath, repacker)).To(Succeed())
+
+			section := func(path string, name constants.Section) []byte {
+				data, err := GetSection(path, name)
+				Expect(err).ToNot(HaveOccurred())
+
+				return data
+			}
+
+			sections, err := ListSections(builder.OutUKIPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ListSections(output)).To(Equal(sections))
+			Expect(GetSection(output, constants.CMDLine)).To(BeEquivalentTo("console=tty0 quiet"))
+			for _, name := range []constants.Section{constants.Linux, constants.Initrd, constants.OSRel, constants.SBAT} {
+				Expect(section(output, name)).To(Equal(section(builder.OutUKIPath, name)), string(name))
+			}
+			// measured again for the new cmdline
+			Expect(section(output, constants.PCRSig)).ToNot(Equal(section(builder.OutUKIPath, constants.PCRSig)))
+
+			// signed once, the previous signature is not carried over
+			_, signatures, err := pesign.Signatures(output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signatures).To(HaveLen(1))
+
+			signer, err := pesign.NewSecureBootSigner(builder.SBCert, builder.SBKey)
+			Expect(err).ToNot(HaveOccurred())
+			ok, err := pesign.VerifyFile(output, signer.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		})
+		It("Fails on files which are not UKIs", func() {
+			err := Repack("../pesign/testdata/sb.pem", &Builder{OutUKIPath: filepath.Join(GinkgoT().TempDir(), "uki.efi")})
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+		})
+	})
+	Describe("Kernel", func() {
+		fakeKernel := func(path, version string) {
+			header := make([]byte, 0x400)
+			// the PE header of the EFI stub
+			copy(header, "MZ")
+			binary.LittleEndian.PutUint32(header[0x3c:], 0x40)
+			copy(header[0x40:], "PE\x00\x00")
+			binary.LittleEndian.PutUint16(header[0x44:], pe.IMAGE_FILE_MACHINE_AMD64)
+			copy(header[0x202:], "HdrS")
+			header[0x1f1] = 1
+			binary.LittleEndian.PutUint16(header[0x20e:], 0x10)
+			copy(header[0x210:], version+" (builder@host) #1\x00")
+			Expect(os.WriteFile(path, header, 0o600)).To(Succeed())
+		}
+
+		It("Probes the kernel again only when it changes", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "kernel")
+			fakeKernel(path, "6.1.0")
+
+			version, err := probeKernelVersion(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version).To(Equal("6.1.0"))
+
+			fakeKernel(path, "6.2.0")
+			Expect(os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))).To(Succeed())
+
+			version, err = probeKernelVersion(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version).To(Equal("6.2.0"))
+		})
+		Describe("Banner", func() {
+			// image is an uncompressed kernel whose banner follows a format string mentioning it
+			image := []byte("\x00ARMd Linux version %s\x00 padding Linux version 6.8.0-31-arm64 (buildd@host) #31 SMP\x00")
+
+			gzipped := func(data []byte) []byte {
+				var buf bytes.Buffer
+				zw := gzip.NewWriter(&buf)
+				_, err := zw.Write(data)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(zw.Close()).To(Succeed())
+				// kernels append the uncompressed size
+				return binary.LittleEndian.AppendUint32(buf.Bytes(), uint32(len(data)))
+			}
+
+			It("Reads the version of uncompressed and compressed images", func() {
+				for _, data := range [][]byte{image, gzipped(image)} {
+					version, err := readKernelVersion(bytes.NewReader(data))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(version).To(Equal("6.8.0-31-arm64"))
+				}
+			})
+			It("Reports the banner and the embedded configuration", func() {
+				config := []byte("CONFIG_EFI_STUB=y\n# CONFIG_EFI_MIXED is not set\nCONFIG_MODULE_SIG_HASH=\"sha512\"\n")
+
+				var zconfig bytes.Buffer
+				zw := gzip.NewWriter(&zconfig)
+				_, err := zw.Write(config)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(zw.Close()).To(Succeed())
+
+				kernel := slices.Concat(image, []byte("IKCFG_ST"), zconfig.Bytes(), []byte("IKCFG_ED"))
+
+				path := filepath.Join(GinkgoT().TempDir(), "kernel")
+				Expect(os.WriteFile(path, gzipped(kernel), 0o600)).To(Succeed())
+
+				info, err := InspectKernel(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Format).To(Equal(KernelFormatUnknown))
+				Expect(info.EFIStub).To(BeFalse())
+				Expect(info.Compression).To(Equal("gzip"))
+				Expect(info.Banner).To(Equal("Linux version 6.8.0-31-arm64 (buildd@host) #31 SMP"))
+				Expect(info.ConfigSHA256).To(Equal(fmt.Sprintf("%x", sha256.Sum256(config))))
+				Expect(info.Config).To(HaveKeyWithValue("CONFIG_EFI_STUB", "y"))
+				Expect(info.Config).To(HaveKeyWithValue("CONFIG_EFI_MIXED", "n"))
+				Expect(info.Config).To(HaveKeyWithValue("CONFIG_MODULE_SIG_HASH", "sha512"))
+
+				extracted, err := ReadKernelConfig(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(extracted).To(Equal(config))
+
+				Expect(os.WriteFile(path, image, 0o600)).To(Succeed())
+
+				info, err = InspectKernel(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Config).To(BeNil())
+
+				_, err = ReadKernelConfig(path)
+				Expect(err).To(MatchError(ErrNoKernelConfig))
+			})
+			It("Checks the header of arm64 images", func() {
+				header := make([]byte, 64)
+				binary.LittleEndian.PutUint64(header[16:], uint64(64+len(image)))
+				copy(header[56:], "ARM\x64")
+
+				version, err := readKernelVersion(bytes.NewReader(append(header, image...)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(version).To(Equal("6.8.0-31-arm64"))
+
+				// big-endian
+				header[24] = 1
+				_, err = readKernelVersion(bytes.NewReader(append(header, image...)))
+				Expect(err).To(MatchError(ContainSubstring("big-endian")))
+
+				header[24] = 0
+				binary.LittleEndian.PutUint64(header[8:], 0x80001)
+				_, err = readKernelVersion(bytes.NewReader(append(header, image...)))
+				Expect(err).To(MatchError(ContainSubstring("unaligned text offset")))
+			})
+			It("Reads the version of EFI zboot images", func() {
+				payload := gzipped(image)
+				header := make([]byte, 0x40)
+				copy(header, "MZ\x00\x00zimg")
+				binary.LittleEndian.PutUint32(header[8:], uint32(len(header)))
+				binary.LittleEndian.PutUint32(header[12:], uint32(len(payload)))
+				copy(header[24:], "gzip")
+
+				version, err := readKernelVersion(bytes.NewReader(append(header, payload...)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(version).To(Equal("6.8.0-31-arm64"))
+			})
+			It("Reads the version of the payload of x86 images without one in their header", func() {
+				payload := gzipped(image)
+				header := make([]byte, 0x400)
+				copy(header[0x202:], "HdrS")
+				header[0x1f1] = 1
+				binary.LittleEndian.PutUint32(header[0x248:], 0x10)
+				binary.LittleEndian.PutUint32(header[0x24c:], uint32(len(payload)))
+				data := append(append(header, make([]byte, 0x10)...), payload...)
+
+				version, err := readKernelVersion(bytes.NewReader(data))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(version).To(Equal("6.8.0-31-arm64"))
+			})
+			It("Decompresses xz images with the xz tool", func() {
+				if _, err := exec.LookPath("xz"); err != nil {
+					Skip("xz is not installed")
+				}
+
+				cmd := exec.Command("xz", "-c", "--check=crc32")
+				cmd.Stdin = bytes.NewReader(image)
+				data, err := cmd.Output()
+				Expect(err).ToNot(HaveOccurred())
+
+				version, err := readKernelVersion(bytes.NewReader(data))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(version).To(Equal("6.8.0-31-arm64"))
+			})
+			It("Fails without a banner", func() {
+				_, err := readKernelVersion(bytes.NewReader([]byte("Linux version %s\x00")))
+				Expect(err).To(MatchError(ContainSubstring("no kernel version banner")))
+			})
+		})
+		It("Refuses kernels without an EFI stub", func() {
+			dir := GinkgoT().TempDir()
+			fakeKernel(filepath.Join(dir, "kernel"), "6.1.0")
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			data, err := os.ReadFile(builder.KernelPath)
+			Expect(err).ToNot(HaveOccurred())
+			copy(data, "\x00\x00")
+			Expect(os.WriteFile(builder.KernelPath, data, 0o600)).To(Succeed())
+
+			err = builder.Build()
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+			Expect(err).To(MatchError(ContainSubstring("CONFIG_EFI_STUB")))
+
+			arm64 := make([]byte, 64)
+			copy(arm64[56:], "ARM\x64")
+			_, err = kernelMachine(bytes.NewReader(arm64))
+			Expect(err).To(MatchError(ContainSubstring("arm64 Image has no EFI stub")))
+
+			machine, err := kernelMachine(bytes.NewReader([]byte("kernel")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(machine).To(BeZero())
+		})
+		It("Describes the kernel in the result", func() {
+			dir := GinkgoT().TempDir()
+			fakeKernel(filepath.Join(dir, "kernel"), "6.1.0")
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:   "../pesign/testdata/file.efi",
+				KernelPath:   filepath.Join(dir, "kernel"),
+				InitrdPath:   filepath.Join(dir, "initrd"),
+				KernelReport: true,
+				OutUKIPath:   filepath.Join(dir, "uki.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			info := builder.Result().KernelInfo
+			Expect(info).ToNot(BeNil())
+			Expect(info.Format).To(Equal(KernelFormatBzImage))
+			Expect(info.EFIStub).To(BeTrue())
+			Expect(info.Arch).To(Equal("x64"))
+			Expect(builder.Result().Warnings).To(ContainElement(ContainSubstring("no embedded configuration")))
+		})
+		It("Refuses kernels built for another architecture than the stub", func() {
+			dir := GinkgoT().TempDir()
+			fakeKernel(filepath.Join(dir, "kernel"), "6.1.0")
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+
+			// an arm64 Image with the EFI stub
+			arm64 := make([]byte, 0x400)
+			copy(arm64, "MZ")
+			copy(arm64[56:], "ARM\x64")
+			binary.LittleEndian.PutUint32(arm64[0x3c:], 0x40)
+			copy(arm64[0x40:], "PE\x00\x00")
+			binary.LittleEndian.PutUint16(arm64[0x44:], pe.IMAGE_FILE_MACHINE_ARM64)
+			Expect(os.WriteFile(builder.KernelPath, arm64, 0o600)).To(Succeed())
+
+			err := builder.Build()
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+			Expect(err).To(MatchError(ContainSubstring("built for aa64 but the stub ../pesign/testdata/file.efi for x64")))
+
+			_, err = builder.Plan()
+			Expect(err).To(MatchError(ContainSubstring("built for aa64")))
+		})
+		It("Embeds the given kernel version instead of the one of the kernel", func() {
+			dir := GinkgoT().TempDir()
+			for _, name := range []string{"kernel", "initrd"} {
+				Expect(os.WriteFile(filepath.Join(dir, name), []byte(name), 0o600)).To(Succeed())
+			}
+			Expect(os.WriteFile(filepath.Join(dir, "kernel.release"), []byte("6.9.0-cross\n"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			// the version of the fake kernel can't be read
+			Expect(builder.Build()).To(Succeed())
+			Expect(builder.Result().Sections).ToNot(ContainElement(HaveField("Name", string(constants.Uname))))
+
+			for _, set := range []func(){
+				func() { builder.Uname = "6.9.0-cross" },
+				func() { builder.Uname, builder.UnamePath = "", filepath.Join(dir, "kernel.release") },
+			} {
+				set()
+				Expect(builder.Build()).To(Succeed())
+
+				uname, err := GetSection(filepath.Join(dir, "uki.efi"), constants.Uname)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(uname)).To(Equal("6.9.0-cross"))
+			}
+
+			builder.Uname = "6.9.0"
+			Expect(builder.Build()).To(MatchError(ContainSubstring("can't be both given and read from a file")))
+		})
+		It("Builds from kernel and initrd sources instead of files", func() {
+			dir := GinkgoT().TempDir()
+			fakeKernel(filepath.Join(dir, "kernel"), "6.1.0")
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			files := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OutUKIPath: filepath.Join(dir, "files.signed.efi"),
+			}
+			Expect(files.Build()).To(Succeed())
+
+			kernel, err := os.ReadFile(filepath.Join(dir, "kernel"))
+			Expect(err).ToNot(HaveOccurred())
+
+			kernelSource, err := types.NewSectionSource(bytes.NewReader(kernel), int64(len(kernel)))
+			Expect(err).ToNot(HaveOccurred())
+
+			// a stream which can't be read at offsets
+			initrdSource, err := types.NewSectionSource(io.MultiReader(strings.NewReader("init"), strings.NewReader("rd")), 6)
+			Expect(err).ToNot(HaveOccurred())
+
+			sources := &Builder{
+				SdStubPath:   "../pesign/testdata/file.efi",
+				KernelSource: kernelSource,
+				InitrdSource: initrdSource,
+				OutUKIPath:   filepath.Join(dir, "sources.signed.efi"),
+			}
+			Expect(sources.Build()).To(Succeed())
+
+			Expect(sources.Result().Measurements).To(Equal(files.Result().Measurements))
+			Expect(sources.Result().Outputs[0].SHA256).To(Equal(files.Result().Outputs[0].SHA256))
+
+			_, err = types.NewSectionSource(io.MultiReader(strings.NewReader("short")), 6)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Records the section digests from the measurements", func() {
+			dir := GinkgoT().TempDir()
+			fakeKernel(filepath.Join(dir, "kernel"), "6.1.0")
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OutUKIPath: filepath.Join(dir, "uki.signed.efi"),
+			}
+
+			plan, err := builder.Plan()
+			Expect(err).ToNot(HaveOccurred())
+
+			var names []string
+			for _, section := range plan.Sections {
+				names = append(names, section.Name)
+				if section.Name == string(constants.Linux) {
+					_, digest, err := fileDigest(builder.KernelPath)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(section.SHA256).To(Equal(digest))
+					Expect(section.Size).To(BeEquivalentTo(0x400))
+				}
+			}
+			Expect(names).To(ContainElements(".uname", ".linux"))
+		})
+	})
+	Describe("Splash", func() {
+		It("Uses valid BMP files in place and fails on invalid ones", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "splash.bmp"), common.Logo, 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "splash.png"), []byte("\x89PNG\r\n\x1a\n"), 0o600)).To(Succeed())
+
+			builder := &Builder{Splash: filepath.Join(dir, "splash.bmp")}
+			sections, err := builder.generateSplash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sections).To(HaveLen(1))
+			Expect(sections[0].Path).To(Equal(builder.Splash))
+			Expect(sections[0].Source).To(BeNil())
+
+			Expect(os.WriteFile(filepath.Join(dir, "splash.txt"), []byte("not an image"), 0o600)).To(Succeed())
+			builder.Splash = filepath.Join(dir, "splash.txt")
+			_, err = builder.generateSplash()
+			Expect(err).To(MatchError(errInvalidBMP))
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+
+			// broken images are not embedded either
+			builder.Splash = filepath.Join(dir, "splash.png")
+			_, err = builder.generateSplash()
+			Expect(err).To(MatchError(ContainSubstring("failed decoding the image")))
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+
+			builder.Splash = filepath.Join(dir, "missing.bmp")
+			_, err = builder.generateSplash()
+			Expect(err).To(MatchError(os.ErrNotExist))
+
+			// the bundled one is not copied either
+			builder.Splash = ""
+			sections, err = builder.generateSplash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sections[0].Source.Size).To(BeEquivalentTo(len(common.Logo)))
+		})
+		It("Falls back to the bundled splash if asked to", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "splash.png"), []byte("\x89PNG\r\n\x1a\n"), 0o600)).To(Succeed())
+
+			builder := &Builder{Splash: filepath.Join(dir, "missing.bmp")}
+			Expect(builder.checkInputs()).To(MatchError(ContainSubstring("splash: stat")))
+
+			builder.SplashFallback = true
+			Expect(builder.checkInputs()).To(Succeed())
+
+			for _, splash := range []string{filepath.Join(dir, "missing.bmp"), filepath.Join(dir, "splash.png")} {
+				builder.Splash = splash
+				sections, err := builder.generateSplash()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sections[0].Path).To(BeEmpty())
+				Expect(io.ReadAll(sections[0].Source.Open())).To(Equal(common.Logo))
+			}
+
+			Expect(builder.Result().Warnings).To(HaveLen(2))
+			Expect(builder.Result().Warnings[1]).To(ContainSubstring("invalid splash"))
+		})
+		It("Refuses BMP files the stub can't show", func() {
+			dir := GinkgoT().TempDir()
+
+			for name, corrupt := range map[string]func([]byte) []byte{
+				"compression":    func(data []byte) []byte { binary.LittleEndian.PutUint32(data[30:], 1); return data },
+				"bits per pixel": func(data []byte) []byte { binary.LittleEndian.PutUint16(data[28:], 2); return data },
+				"top-down": func(data []byte) []byte {
+					binary.LittleEndian.PutUint32(data[22:], uint32(-int32(binary.LittleEndian.Uint32(data[22:]))))
+					return data
+				},
+				"truncated": func(data []byte) []byte { return data[:len(data)-1] },
+			} {
+				path := filepath.Join(dir, "splash.bmp")
+				Expect(os.WriteFile(path, corrupt(slices.Clone(common.Logo)), 0o600)).To(Succeed())
+
+				builder := &Builder{Splash: path}
+				_, err := builder.generateSplash()
+				Expect(err).To(MatchError(errInvalidBMP), name)
+				Expect(err).To(MatchError(ContainSubstring(name)))
+			}
+		})
+		It("Warns about splashes larger than the screen or the size budget", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "splash.bmp")
+
+			var buf bytes.Buffer
+			Expect(splash.Encode(&buf, image.NewRGBA(image.Rect(0, 0, splash.TypicalWidth+1, 1)))).To(Succeed())
+			Expect(os.WriteFile(path, buf.Bytes(), 0o600)).To(Succeed())
+
+			builder := &Builder{Splash: path, SplashMaxSize: 1024}
+			_, err := builder.generateSplash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(builder.Result().Warnings).To(ConsistOf(ContainSubstring("larger than the screen"), ContainSubstring("size budget")))
+
+			builder = &Builder{}
+			_, err = builder.generateSplash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(builder.Result().Warnings).To(BeEmpty())
+		})
+		It("Converts PNG and JPEG splash files to BMP", func() {
+			dir := GinkgoT().TempDir()
+
+			img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+			img.Set(0, 0, color.RGBA{R: 0xff, A: 0xff})
+			img.Set(2, 1, color.RGBA{B: 0xff, A: 0xff})
+
+			var buf bytes.Buffer
+			Expect(png.Encode(&buf, img)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "splash.png"), buf.Bytes(), 0o600)).To(Succeed())
+
+			buf.Reset()
+			Expect(jpeg.Encode(&buf, img, nil)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "splash.jpg"), buf.Bytes(), 0o600)).To(Succeed())
+
+			for _, name := range []string{"splash.png", "splash.jpg"} {
+				builder := &Builder{Splash: filepath.Join(dir, name)}
+				builder.scratchDir = dir
+
+				sections, err := builder.generateSplash()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sections[0].Path).To(Equal(filepath.Join(dir, "splash.bmp")))
+				Expect(validSplash(sections[0].Path)).To(BeTrue())
+
+				if name == "splash.png" {
+					data, err := os.ReadFile(sections[0].Path)
+					Expect(err).ToNot(HaveOccurred())
+					// 24 bits per pixel, rows bottom-up and padded to 4 bytes
+					Expect(binary.LittleEndian.Uint16(data[28:])).To(Equal(uint16(24)))
+					Expect(data).To(HaveLen(54 + 2*12))
+					Expect(data[54+6 : 54+9]).To(Equal([]byte{0xff, 0, 0}))
+					Expect(data[54+12 : 54+15]).To(Equal([]byte{0, 0, 0xff}))
+				}
+			}
+		})
+		It("Renders the name, version and build date as the splash", func() {
+			GinkgoT().Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+			builder := &Builder{SplashText: true, Version: "v3.2.1", InMemory: true, OutRecoveryUKIPath: "recovery.efi"}
+			Expect(builder.splashLines()).To(Equal([]string{constants.Name + " v3.2.1", "2023-11-14"}))
+			Expect(builder.recoveryBuilder().splashLines()).To(Equal([]string{constants.Name + " v3.2.1", "2023-11-14", "RECOVERY"}))
+
+			sections, err := builder.generateSplash()
+			Expect(err).ToNot(HaveOccurred())
+
+			source := sections[0].Source
+			info, err := splash.Inspect(source, source.Size)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.BitCount).To(Equal(24))
+			Expect(info.Oversized()).To(BeFalse())
+
+			rendered, err := io.ReadAll(source.Open())
+			Expect(err).ToNot(HaveOccurred())
+
+			// reproducible
+			again, err := builder.generateSplash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(io.ReadAll(again[0].Source.Open())).To(Equal(rendered))
+
+			builder.Splash = "splash.bmp"
+			Expect(builder.checkInputs()).To(MatchError(ContainSubstring("both rendered and given")))
+		})
+		It("Reads the splash from its contents", func() {
+			builder := &Builder{SplashSource: types.BytesSource(common.Logo), InMemory: true}
+			sections, err := builder.generateSplash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sections[0].Source).To(BeIdenticalTo(builder.SplashSource))
+
+			var buf bytes.Buffer
+			Expect(png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)))).To(Succeed())
+
+			builder.SplashSource = types.BytesSource(buf.Bytes())
+			sections, err = builder.generateSplash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(io.ReadAll(sections[0].Source.Open())).To(HaveLen(54 + 2*8))
+
+			builder.SplashSource = types.BytesSource([]byte("not an image"))
+			_, err = builder.generateSplash()
+			Expect(err).To(MatchError(errInvalidBMP))
+
+			builder.Splash = "splash.bmp"
+			Expect(builder.checkInputs()).To(MatchError(ContainSubstring("both read from a file and given")))
+		})
+	})
+	Describe("Custom sections", func() {
+		It("Adds, replaces and orders sections", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "dtb"), []byte("devicetree"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:   "../pesign/testdata/file.efi",
+				KernelPath:   filepath.Join(dir, "kernel"),
+				InitrdPath:   filepath.Join(dir, "initrd"),
+				Cmdline:      "console=tty0",
+				OutUKIPath:   filepath.Join(dir, "uki.efi"),
+				SectionOrder: []constants.Section{constants.DTB},
+			}
+			Expect(builder.AddSection(Section{Name: constants.DTB, Path: filepath.Join(dir, "dtb"), Measure: true, Append: true})).To(Succeed())
+			Expect(builder.AddSection(Section{Name: ".vendor", Source: types.BytesSource([]byte("vendor")), Append: true})).To(Succeed())
+			Expect(builder.AddSection(Section{Name: constants.CMDLine, Source: types.BytesSource([]byte("console=ttyS0")), Measure: true, Append: true})).To(Succeed())
+			Expect(builder.Build()).To(Succeed())
+
+			Expect(GetSection(builder.OutUKIPath, constants.DTB)).To(BeEquivalentTo("devicetree"))
+			Expect(GetSection(builder.OutUKIPath, ".vendor")).To(BeEquivalentTo("vendor"))
+			Expect(GetSection(builder.OutUKIPath, constants.CMDLine)).To(BeEquivalentTo("console=ttyS0"))
+
+			var names []constants.Section
+			for _, section := range builder.sections {
+				names = append(names, section.Name)
+			}
+			// the listed .dtb first, .vendor before the kernel
+			Expect(names[0]).To(Equal(constants.DTB))
+			Expect(names[len(names)-2:]).To(Equal([]constants.Section{".vendor", constants.Linux}))
+			// the generated .cmdline is replaced
+			cmdline := slices.Index(names, constants.CMDLine)
+			Expect(cmdline).To(BeNumerically(">=", 0))
+			Expect(slices.Contains(names[cmdline+1:], constants.CMDLine)).To(BeFalse())
+
+			// the added sections are measured as well
+			plain := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Cmdline:    "console=ttyS0",
+				OutUKIPath: filepath.Join(dir, "plain.efi"),
+			}
+			Expect(plain.Build()).To(Succeed())
+			Expect(builder.Result().Measurements).ToNot(Equal(plain.Result().Measurements))
+		})
+		It("Runs the replaced, removed and inserted generators", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			Expect(builder.ReplaceGenerator(GeneratorOSRelease, GeneratorFunc("distro", func(*Builder) ([]Section, error) {
+				return []Section{{Name: constants.OSRel, Source: types.BytesSource([]byte("ID=distro\n")), Measure: true, Append: true}}, nil
+			}))).To(Succeed())
+			Expect(builder.RemoveGenerator(GeneratorSplash)).To(Succeed())
+			Expect(builder.InsertGenerator(GeneratorUname, GeneratorFunc("vendor", func(*Builder) ([]Section, error) {
+				return []Section{{Name: ".vendor", Source: types.BytesSource([]byte("vendor")), Append: true}}, nil
+			}))).To(Succeed())
+			Expect(builder.Build()).To(Succeed())
+
+			Expect(GetSection(builder.OutUKIPath, constants.OSRel)).To(BeEquivalentTo("ID=distro\n"))
+			_, err := GetSection(builder.OutUKIPath, constants.Splash)
+			Expect(err).To(MatchError(ErrSectionNotFound))
+
+			var names []constants.Section
+			for _, section := range builder.sections {
+				names = append(names, section.Name)
+			}
+			// no .uname for a kernel without version
+			Expect(names).To(Equal([]constants.Section{constants.OSRel, constants.CMDLine, constants.Initrd, ".vendor", constants.SBAT, constants.Linux}))
+
+			Expect(builder.RemoveGenerator(GeneratorSplash)).To(MatchError(types.ErrInvalidInput))
+			Expect(builder.InsertGenerator(GeneratorKernel, GeneratorFunc("vendor", nil))).To(MatchError(ContainSubstring("twice")))
+			// the defaults are left alone
+			Expect(DefaultGenerators()).To(HaveLen(9))
+		})
+		It("Rejects sections which can't be assembled or measured", func() {
+			builder := &Builder{}
+			for _, section := range []Section{
+				{Name: "vendor", Path: "vendor", Append: true},
+				{Name: ".toolongname", Path: "vendor", Append: true},
+				{Name: constants.PCRSig, Path: "pcrsig", Append: true},
+				{Name: ".vendor", Append: true},
+				{Name: ".vendor", Path: "vendor", Measure: true, Append: true},
+				{Name: ".vendor", Path: "vendor"},
+			} {
+				Expect(builder.AddSection(section)).To(MatchError(types.ErrInvalidInput), string(section.Name))
+			}
+
+			Expect(builder.AddSection(Section{Name: ".vendor", Path: "vendor", Append: true})).To(Succeed())
+			Expect(builder.AddSection(Section{Name: ".vendor", Path: "other", Append: true})).To(MatchError(ContainSubstring("twice")))
+
+			builder.SectionOrder = []constants.Section{constants.DTB, constants.DTB}
+			Expect(builder.checkInputs()).To(MatchError(ContainSubstring("listed twice")))
+		})
+		It("Validates and applies section orders", func() {
+			order := DefaultSectionOrder()
+			Expect(order.Validate()).To(Succeed())
+			Expect(order[len(order)-1]).To(Equal(constants.Linux))
+
+			custom, err := order.Insert(constants.Linux, constants.DTB)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(custom[len(custom)-2:]).To(Equal(SectionOrder{constants.DTB, constants.Linux}))
+			Expect(custom.Validate()).To(Succeed())
+			// the defaults are left alone
+			Expect(DefaultSectionOrder()).To(Equal(order))
+
+			_, err = order.Insert(".vendor", constants.DTB)
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+
+			for _, invalid := range []SectionOrder{
+				{constants.DTB, constants.DTB},
+				{constants.Linux, constants.DTB},
+				{constants.PCRSig},
+				{"vendor"},
+				{".toolongname"},
+			} {
+				Expect(invalid.Validate()).To(HaveOccurred(), fmt.Sprint(invalid))
+			}
+
+			// the kernel and the PCR signature stay last, whatever is listed
+			sections := []Section{{Name: constants.Linux}, {Name: constants.PCRSig}, {Name: ".vendor"}, {Name: constants.OSRel}, {Name: constants.DTB}}
+			SectionOrder{constants.DTB}.Sort(sections)
+
+			var names []constants.Section
+			for _, section := range sections {
+				names = append(names, section.Name)
+			}
+			Expect(names).To(Equal([]constants.Section{constants.DTB, ".vendor", constants.OSRel, constants.Linux, constants.PCRSig}))
+		})
+	})
+	Describe("Logger", func() {
+		It("Logs to the builder logger only", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			var global, own bytes.Buffer
+
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&global, nil)))
+			defer slog.SetDefault(previous)
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				SBKey:      "../pesign/testdata/sb.key",
+				SBCert:     "../pesign/testdata/sb.pem",
+				OutUKIPath: filepath.Join(dir, "uki.signed.efi"),
+				Logger:     slog.New(slog.NewJSONHandler(&own, &slog.HandlerOptions{Level: slog.LevelDebug})),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			Expect(global.String()).To(BeEmpty())
+			Expect(own.String()).To(ContainSubstring(`"msg":"Signed UKI"`))
+			Expect(own.String()).To(ContainSubstring(`"msg":"PCR measurement"`))
+			Expect(own.String()).To(ContainSubstring(`"msg":"Signing file"`))
+			Expect(slog.Default().Enabled(context.Background(), slog.LevelDebug)).To(BeFalse())
+		})
+	})
+	Describe("In-memory keys", func() {
+		It("Signs with the given keys and drops them once done", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			keyPEM, err := os.ReadFile("../pesign/testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+			certPEM, err := os.ReadFile("../pesign/testdata/sb.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				SBKeyPEM:   keyPEM,
+				SBCertPEM:  certPEM,
+				PCRKeyPEM:  keyPEM,
+				OutUKIPath: filepath.Join(dir, "uki.signed.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+			Expect(GetSection(builder.OutUKIPath, constants.PCRSig)).ToNot(BeEmpty())
+			Expect(builder.SecureBootSigner).To(BeNil())
+			Expect(builder.PCRSigner).To(BeNil())
+
+			_, signatures, err := pesign.Signatures(builder.OutUKIPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signatures).To(HaveLen(1))
+
+			// loaded again by the next build
+			Expect(builder.Build()).To(Succeed())
+
+			builder.SBKey = "../pesign/testdata/sb.key"
+			Expect(builder.Build()).To(MatchError(ContainSubstring("the SecureBoot key can't be both read from a file and given")))
+		})
+	})
+	Describe("Transparency log", func() {
+		It("Logs the SecureBoot signatures with their inclusion proofs", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			cert, err := pesign.LoadCertificate("../pesign/testdata/sb.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			var logged int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				body, err := io.ReadAll(r.Body)
+				Expect(err).ToNot(HaveOccurred())
+
+				// checked like the log does, the signature of the hash with the certificate
+				var record struct {
+					Spec struct {
+						Signature struct{ Content []byte }
+						Data      struct{ Hash struct{ Value string } }
+					}
+				}
+				Expect(json.Unmarshal(body, &record)).To(Succeed())
+				hash, err := hex.DecodeString(record.Spec.Data.Hash.Value)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, hash, record.Spec.Signature.Content)).To(Succeed())
+
+				// a log of a single entry, its leaf hash is the root
+				logged++
+				w.WriteHeader(http.StatusCreated)
+				Expect(json.NewEncoder(w).Encode(map[string]any{"uuid": map[string]any{
+					"body":         base64.StdEncoding.EncodeToString(body),
+					"logIndex":     logged,
+					"verification": map[string]any{"inclusionProof": rekor.InclusionProof{TreeSize: 1, RootHash: hex.EncodeToString(rekor.LeafHash(body))}},
+				}})).To(Succeed())
+			}))
+			defer server.Close()
+
+			builder := &Builder{
+				SdStubPath:         "../pesign/testdata/file.efi",
+				SdBootPath:         "../pesign/testdata/file.efi",
+				KernelPath:         filepath.Join(dir, "kernel"),
+				InitrdPath:         filepath.Join(dir, "initrd"),
+				SBKey:              "../pesign/testdata/sb.key",
+				SBCert:             "../pesign/testdata/sb.pem",
+				OutUKIPath:         filepath.Join(dir, "uki.signed.efi"),
+				OutSdBootPath:      filepath.Join(dir, "sdboot.signed.efi"),
+				RecoveryCmdline:    "recovery",
+				OutRecoveryUKIPath: filepath.Join(dir, "recovery.signed.efi"),
+				TransparencyLog:    rekor.NewClient(server.URL),
+			}
+			Expect(builder.Build()).To(Succeed())
+			Expect(logged).To(Equal(3))
+
+			for _, output := range builder.Result().Outputs {
+				Expect(output.Transparency).ToNot(BeNil(), output.Kind)
+				Expect(output.Transparency.UUID).To(Equal("uuid"))
+			}
+
+			// with the key of the log, the inclusion proofs need a checkpoint signed with it
+			keyDER, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(dir, "rekor.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyDER}), 0o600)).To(Succeed())
+			builder.TransparencyLog = rekor.NewClient(server.URL)
+			builder.TransparencyLogKey = filepath.Join(dir, "rekor.pub")
+			err = builder.Build()
+			Expect(err).To(MatchError(types.ErrVerification))
+			Expect(err).To(MatchError(ContainSubstring("no checkpoint")))
+
+			builder.TransparencyLog = nil
+			Expect(builder.Build()).To(MatchError(ContainSubstring("a transparency log key needs a transparency log")))
+
+			builder.TransparencyLog, builder.TransparencyLogKey = rekor.NewClient(server.URL), ""
+			builder.SBKey, builder.SBCert = "", ""
+			Expect(builder.Build()).To(MatchError(ContainSubstring("signatures are only logged when signing for SecureBoot")))
+		})
+	})
+	Describe("Hardware keys", func() {
+		It("Refuses key files and accepts keys held out of the process", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:          "../pesign/testdata/file.efi",
+				KernelPath:          filepath.Join(dir, "kernel"),
+				InitrdPath:          filepath.Join(dir, "initrd"),
+				SBKey:               "../pesign/testdata/sb.key",
+				SBCert:              "../pesign/testdata/sb.pem",
+				PCRKey:              "../pesign/testdata/sb.key",
+				RequireHardwareKeys: true,
+				OutUKIPath:          filepath.Join(dir, "uki.signed.efi"),
+			}
+			err := builder.Build()
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+			Expect(err).To(MatchError(ContainSubstring("the SecureBoot key is a key file")))
+			Expect(err).To(MatchError(ContainSubstring("the PCR key is a key file")))
+
+			sb, err := pesign.NewSecureBootSigner("../pesign/testdata/sb.pem", "../pesign/testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+			pcrSigner, err := pesign.NewPCRSigner("../pesign/testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder.SBKey, builder.SBCert, builder.PCRKey = "", "", ""
+			builder.SecureBootSigner, err = pesign.NewSigner(sb)
+			Expect(err).ToNot(HaveOccurred())
+			builder.PCRSigner = pcrSigner
+			Expect(builder.Build()).To(MatchError(ContainSubstring("the SecureBoot signer uses a key file")))
+
+			// wrapped keys are still key files unless marked hardware-backed
+			builder.SecureBootSigner, err = pesign.NewSigner(struct{ pesign.CertificateSigner }{sb})
+			Expect(err).ToNot(HaveOccurred())
+			builder.PCRSigner = struct{ types.RSAKey }{pcrSigner}
+			err = builder.Build()
+			Expect(err).To(MatchError(ContainSubstring("the SecureBoot signer uses a key file")))
+			Expect(err).To(MatchError(ContainSubstring("the PCR signer uses a key file")))
+
+			// i.e. a token or a signing service
+			builder.SecureBootSigner, err = pesign.NewSigner(hardwareSigner{sb})
+			Expect(err).ToNot(HaveOccurred())
+			builder.PCRSigner = hardwarePCRKey{pcrSigner}
+			Expect(builder.Build()).To(Succeed())
+		})
+	})
+	Describe("Approvals", func() {
+		It("Records the approvals of the signed outputs", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			approver, err := pesign.NewSecureBootSigner("../pesign/testdata/sb.pem", "../pesign/testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				SBKey:      "../pesign/testdata/sb.key",
+				SBCert:     "../pesign/testdata/sb.pem",
+				Approvals:  &pesign.Threshold{Required: 1, Approvers: []pesign.CertificateSigner{approver}},
+				OutUKIPath: filepath.Join(dir, "uki.signed.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			outputs := builder.Result().Outputs
+			Expect(outputs).To(HaveLen(1))
+			Expect(outputs[0].Approvals).To(HaveLen(1))
+			Expect(outputs[0].Approvals[0].Certificate).To(Equal(approver.Certificate().Raw))
+			Expect(pesign.VerifyApprovals(outputs[0].Path, outputs[0].Approvals)).To(Succeed())
+
+			// kept in the JSON result
+			data, err := json.Marshal(builder.Result())
+			Expect(err).ToNot(HaveOccurred())
+			var result Result
+			Expect(json.Unmarshal(data, &result)).To(Succeed())
+			Expect(result.Outputs[0].Approvals).To(Equal(outputs[0].Approvals))
+		})
+		It("Approves the inputs signed already and leaves the signer threshold alone", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			approver, err := pesign.NewSecureBootSigner("../pesign/testdata/sb.pem", "../pesign/testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+			signer, err := pesign.NewSigner(approver)
+			Expect(err).ToNot(HaveOccurred())
+			signedSdBoot := filepath.Join(dir, "systemd-boot.signed.efi")
+			Expect(signer.Sign("../pesign/testdata/file.efi", signedSdBoot)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:       "../pesign/testdata/file.efi",
+				KernelPath:       filepath.Join(dir, "kernel"),
+				InitrdPath:       filepath.Join(dir, "initrd"),
+				SdBootPath:       signedSdBoot,
+				OutSdBootPath:    filepath.Join(dir, "systemd-bootx64.efi"),
+				SecureBootSigner: signer,
+				Approvals:        &pesign.Threshold{Required: 1, Approvers: []pesign.CertificateSigner{approver}},
+				OutUKIPath:       filepath.Join(dir, "uki.signed.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			outputs := builder.Result().Outputs
+			Expect(outputs).To(HaveLen(2))
+			for _, output := range outputs {
+				Expect(output.Approvals).To(HaveLen(1), output.Kind)
+				Expect(pesign.VerifyApprovals(output.Path, output.Approvals)).To(Succeed(), output.Kind)
+			}
+			Expect(signer.Threshold).To(BeNil())
+		})
+	})
+	Describe("Identity", func() {
+		It("Writes the identity to the os-release and the SBAT", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Version:    "1.0",
+				Identity:   Identity{Name: "Acme", URL: "https://acme.example", SBATGeneration: 2},
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			osRelease, err := GetSection(builder.OutUKIPath, constants.OSRel)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(osRelease)).To(HavePrefix("NAME=\"Acme\"\nID=acme\nVERSION_ID=1.0\n"))
+			Expect(string(osRelease)).To(ContainSubstring("HOME_URL=\"https://acme.example\"\n"))
+			Expect(GetSection(builder.OutUKIPath, constants.SBAT)).To(ContainSubstring("acme,2,Acme,acme,1.0,https://acme.example\n"))
+
+			// the default identity is the Kairos one, without SBAT entry
+			builder.Identity = Identity{}
+			Expect(builder.Build()).To(Succeed())
+
+			defaultRelease, err := constants.OSReleaseFor(constants.Name, "1.0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(GetSection(builder.OutUKIPath, constants.OSRel)).To(Equal(defaultRelease))
+			Expect(GetSection(builder.OutUKIPath, constants.SBAT)).ToNot(ContainSubstring("acme"))
+		})
+
+		It("Overrides the SBAT generations and vendors", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:      "../pesign/testdata/file.efi",
+				KernelPath:      filepath.Join(dir, "kernel"),
+				InitrdPath:      filepath.Join(dir, "initrd"),
+				Version:         "1.0",
+				Identity:        Identity{Name: "Acme", SBATGeneration: 1},
+				SBATGenerations: map[string]int{"acme": 3},
+				SBATVendors:     map[string]string{"acme": "Acme Corp"},
+				OutUKIPath:      filepath.Join(dir, "uki.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+			Expect(GetSection(builder.OutUKIPath, constants.SBAT)).To(ContainSubstring("acme,3,Acme Corp,acme,1.0,\n"))
+
+			builder.SBATGenerations = map[string]int{"missing": 2}
+			Expect(builder.Build()).To(MatchError(types.ErrInvalidInput))
+		})
+		It("Refuses stubs revoked by the SBAT policy", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "SbatLevel"), []byte("sbat,1,2024010900\nsystemd,2\n"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:     "../pesign/testdata/file.efi",
+				KernelPath:     filepath.Join(dir, "kernel"),
+				InitrdPath:     filepath.Join(dir, "initrd"),
+				SBATPolicyPath: filepath.Join(dir, "SbatLevel"),
+				OutUKIPath:     filepath.Join(dir, "uki.efi"),
+			}
+			err := builder.Build()
+			Expect(err).To(MatchError(types.ErrVerification))
+			Expect(err).To(MatchError(ContainSubstring("systemd generation 1 is revoked by SBAT policy, minimum is 2")))
+			Expect(builder.OutUKIPath).ToNot(BeAnExistingFile())
+
+			builder.SBATWarnOnly = true
+			Expect(builder.Build()).To(Succeed())
+			Expect(builder.Result().Warnings).To(ContainElement(ContainSubstring("Firmware would reject the stub")))
+
+			// the bundled shim revocations leave systemd-stub alone
+			builder.SBATPolicy, builder.SBATPolicyPath, builder.SBATWarnOnly = nil, SBATPolicyLatest, false
+			Expect(builder.Build()).To(Succeed())
+			Expect(builder.Result().Warnings).ToNot(ContainElement(ContainSubstring("Firmware would reject the stub")))
+		})
+		It("Refuses generated SBAT entries revoked by the SBAT policy", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "SbatLevel"), []byte("sbat,1,2024010900\nacme,2\n"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:     "../pesign/testdata/file.efi",
+				KernelPath:     filepath.Join(dir, "kernel"),
+				InitrdPath:     filepath.Join(dir, "initrd"),
+				Version:        "1.0",
+				Identity:       Identity{Name: "Acme", SBATGeneration: 1},
+				SBATPolicyPath: filepath.Join(dir, "SbatLevel"),
+				OutUKIPath:     filepath.Join(dir, "uki.efi"),
+			}
+			err := builder.Build()
+			Expect(err).To(MatchError(types.ErrVerification))
+			Expect(err).To(MatchError(ContainSubstring("firmware would reject the generated SBAT: acme generation 1 is revoked by SBAT policy, minimum is 2")))
+			Expect(builder.OutUKIPath).ToNot(BeAnExistingFile())
+
+			builder.SBATGenerations = map[string]int{"acme": 2}
+			Expect(builder.Build()).To(Succeed())
+			Expect(GetSection(builder.OutUKIPath, constants.SBAT)).To(ContainSubstring("acme,2,"))
+		})
+	})
+	Describe("Build errors", func() {
+		It("Tells the stage, section and path of the failure", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "splash.png"), []byte("\x89PNG\r\n\x1a\n"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Splash:     filepath.Join(dir, "splash.png"),
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+
+			err := builder.Build()
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+
+			var buildErr *types.BuildError
+			Expect(errors.As(err, &buildErr)).To(BeTrue())
+			Expect(buildErr.Stage).To(Equal(StageGenerate))
+			Expect(buildErr.Section).To(Equal(constants.Splash))
+			Expect(buildErr.Path).To(Equal(builder.Splash))
+			Expect(err.Error()).To(ContainSubstring("generate section .splash (" + builder.Splash + "): invalid splash"))
+
+			// generators failing without telling the section are named
+			builder.Splash = ""
+			Expect(builder.ReplaceGenerator(GeneratorSplash, GeneratorFunc("vendor-splash", func(*Builder) ([]Section, error) {
+				return nil, errors.New("no splash")
+			}))).To(Succeed())
+
+			err = builder.Build()
+			Expect(errors.As(err, &buildErr)).To(BeTrue())
+			Expect(buildErr.Stage).To(Equal(StageGenerate))
+			Expect(buildErr.Section).To(BeEmpty())
+			Expect(err.Error()).To(ContainSubstring("generate: vendor-splash generator: no splash"))
+		})
+	})
+	Describe("Stages", func() {
+		It("Signs a UKI assembled by another builder", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			assembler := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+
+			state, err := assembler.PrepareSections()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(assembler.Assemble(state)).To(MatchError(types.ErrInvalidInput))
+			Expect(assembler.Measure(state)).To(Succeed())
+			Expect(assembler.Measure(state)).To(MatchError(types.ErrInvalidInput))
+
+			state.UnsignedPath = filepath.Join(dir, "unsigned.efi")
+			Expect(assembler.Assemble(state)).To(Succeed())
+			Expect(state.UnsignedDigest).ToNot(BeEmpty())
+			state.Close()
+			Expect(state.UnsignedPath).To(BeAnExistingFile())
+
+			signer := &Builder{
+				SBKey:      "../pesign/testdata/sb.key",
+				SBCert:     "../pesign/testdata/sb.pem",
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			Expect(signer.Sign(&BuildState{})).To(MatchError(types.ErrInvalidInput))
+
+			// a digest not of the unsigned UKI is not signed
+			stale := slices.Clone(state.UnsignedDigest)
+			stale[0] ^= 0xff
+			staleSigner := &Builder{SBKey: signer.SBKey, SBCert: signer.SBCert, OutUKIPath: signer.OutUKIPath}
+			Expect(staleSigner.Sign(&BuildState{UnsignedPath: state.UnsignedPath, UnsignedDigest: stale})).To(MatchError(types.ErrVerification))
+			Expect(signer.OutUKIPath).ToNot(BeAnExistingFile())
+
+			Expect(signer.Sign(&BuildState{UnsignedPath: state.UnsignedPath, UnsignedDigest: state.UnsignedDigest})).To(Succeed())
+
+			Expect(signer.Result().Outputs).To(HaveLen(1))
+			Expect(signer.Result().Outputs[0].Signed).To(BeTrue())
+			Expect(GetSection(signer.OutUKIPath, constants.Initrd)).To(Equal([]byte("initrd")))
+		})
+	})
+	Describe("Initrd generator", func() {
+		It("Builds the UKI with the generated initrd", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+
+			var version string
+
+			builder := &Builder{
+				SdStubPath:    "../pesign/testdata/file.efi",
+				KernelPath:    filepath.Join(dir, "kernel"),
+				KernelVersion: "6.1.0-kairos",
+				OutUKIPath:    filepath.Join(dir, "uki.efi"),
+				InitrdGenerator: initrd.GeneratorFunc(func(kernelVersion, out string) error {
+					version = kernelVersion
+
+					return os.WriteFile(out, []byte("generated"), 0o600)
+				}),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			Expect(version).To(Equal("6.1.0-kairos"))
+			Expect(GetSection(builder.OutUKIPath, constants.Initrd)).To(BeEquivalentTo("generated"))
+			// the generated initrd is removed with the scratch dir
+			Expect(builder.InitrdPath).To(BeEmpty())
+		})
+		It("Fails without the kernel version or with a given initrd", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+
+			generator := initrd.GeneratorFunc(func(string, string) error { return errors.New("not called") })
+
+			builder := &Builder{
+				SdStubPath:      "../pesign/testdata/file.efi",
+				KernelPath:      filepath.Join(dir, "kernel"),
+				OutUKIPath:      filepath.Join(dir, "uki.efi"),
+				InitrdGenerator: generator,
+			}
+			Expect(builder.Build()).To(MatchError(types.ErrInvalidInput))
+
+			builder.KernelVersion = "6.1.0"
+			builder.InitrdPath = filepath.Join(dir, "kernel")
+			Expect(builder.Build()).To(MatchError(ContainSubstring("both generated and given")))
+
+			builder.InitrdPath = ""
+			err := builder.Build()
+			Expect(err).To(MatchError(ContainSubstring("not called")))
+
+			var buildErr *types.BuildError
+			Expect(errors.As(err, &buildErr)).To(BeTrue())
+			Expect(buildErr.Section).To(Equal(constants.Initrd))
+		})
+	})
+	Describe("Upgrades", func() {
+		It("Builds the boot entries out of a rootfs", func() {
+			rootfs := GinkgoT().TempDir()
+			for path, contents := range map[string]string{
+				"boot/vmlinuz-6.1.0": "kernel",
+				"boot/initrd-6.1.0":  "initrd",
+				"etc/os-release":     "ID=acme\n",
+				"etc/kernel/cmdline": "console=tty0\n  rd.immucore.uki\n",
+			} {
+				Expect(os.MkdirAll(filepath.Dir(filepath.Join(rootfs, path)), 0o755)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(rootfs, path), []byte(contents), 0o600)).To(Succeed())
+			}
+			// absolute links point to the root of the rootfs
+			Expect(os.Symlink("/boot/vmlinuz-6.1.0", filepath.Join(rootfs, "boot/vmlinuz"))).To(Succeed())
+
+			kernel, initrd, err := FindBootFiles(rootfs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kernel).To(Equal(filepath.Join(rootfs, "boot/vmlinuz-6.1.0")))
+			Expect(initrd).To(Equal(filepath.Join(rootfs, "boot/initrd-6.1.0")))
+
+			out := GinkgoT().TempDir()
+			config := UpgradeConfig{
+				BuildConfig: BuildConfig{SdStubPath: "../pesign/testdata/file.efi"},
+				OutDir:      out,
+				Entries:     append(DefaultUpgradeEntries()[:2], UpgradeEntry{Name: "recovery", Cmdline: "rd.immucore.recovery"}),
+			}
+			results, err := BuildForUpgrade(rootfs, config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).To(HaveLen(3))
+
+			for _, name := range []string{"active", "passive"} {
+				Expect(GetSection(filepath.Join(out, name+".efi"), constants.CMDLine)).To(BeEquivalentTo("console=tty0 rd.immucore.uki"))
+				Expect(GetSection(filepath.Join(out, name+".efi"), constants.OSRel)).To(BeEquivalentTo("ID=acme\n"))
+			}
+			Expect(GetSection(filepath.Join(out, "recovery.efi"), constants.CMDLine)).To(BeEquivalentTo("console=tty0 rd.immucore.uki rd.immucore.recovery"))
+		})
+		It("Rejects ambiguous rootfs and entries", func() {
+			rootfs := GinkgoT().TempDir()
+			Expect(os.MkdirAll(filepath.Join(rootfs, "boot"), 0o755)).To(Succeed())
+			for _, name := range []string{"vmlinuz-6.1.0", "vmlinuz-6.2.0", "initrd"} {
+				Expect(os.WriteFile(filepath.Join(rootfs, "boot", name), nil, 0o600)).To(Succeed())
+			}
+
+			_, _, err := FindBootFiles(rootfs)
+			Expect(err).To(MatchError(ContainSubstring("several kernels")))
+
+			Expect(os.Remove(filepath.Join(rootfs, "boot/vmlinuz-6.2.0"))).To(Succeed())
+			// links out of the rootfs are left out
+			Expect(os.Symlink("../../outside", filepath.Join(rootfs, "boot/vmlinuz"))).To(Succeed())
+
+			kernel, _, err := FindBootFiles(rootfs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kernel).To(Equal(filepath.Join(rootfs, "boot/vmlinuz-6.1.0")))
+
+			_, err = BuildForUpgrade(rootfs, UpgradeConfig{Entries: []UpgradeEntry{{Name: "active"}, {Name: "active"}}})
+			Expect(err).To(MatchError(types.ErrInvalidInput))
+		})
+	})
+	Describe("Profiles", func() {
+		It("Follows the Talos conventions", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Version:    "v1.7.0",
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+				Profile:    ProfileTalos,
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			Expect(GetSection(builder.OutUKIPath, constants.OSRel)).To(BeEquivalentTo(`NAME="Talos"
+ID=talos
+VERSION_ID=v1.7.0
+PRETTY_NAME="Talos (v1.7.0)"
+HOME_URL="https://www.talos.dev/"
+BUG_REPORT_URL="https://github.com/siderolabs/talos/issues"
+VENDOR_NAME="Sidero Labs"
+VENDOR_URL="https://www.siderolabs.com/"
+`))
+			Expect(builder.Result().Measurements).ToNot(BeEmpty())
+			for _, m := range builder.Result().Measurements {
+				Expect(m.Phase).To(Equal(string(constants.EnterInitrd)))
+			}
+
+			named := &Builder{Profile: ProfileTalos, SdBootPath: "sd-boot.efi"}
+			Expect(named.applyProfile()).To(Succeed())
+			Expect(named.OutUKIPath).To(Equal("vmlinuz.efi"))
+			Expect(named.OutSdBootPath).To(Equal("systemd-boot.efi"))
+
+			builder.Profile = "unknown"
+			Expect(builder.Build()).To(MatchError(types.ErrInvalidInput))
+		})
+	})
+	Describe("SBOM", func() {
+		It("Lists the inputs and outputs with their digests", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:  "../pesign/testdata/file.efi",
+				KernelPath:  filepath.Join(dir, "kernel"),
+				InitrdPath:  filepath.Join(dir, "initrd"),
+				Cmdline:     "console=ttyS0",
+				SBKey:       "../pesign/testdata/sb.key",
+				SBCert:      "../pesign/testdata/sb.pem",
+				OutUKIPath:  filepath.Join(dir, "uki.signed.efi"),
+				OutSBOMPath: filepath.Join(dir, "uki.cdx.json"),
+				EmbedSBOM:   true,
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			var bom struct {
+				BOMFormat string `json:"bomFormat"`
+				Metadata  struct {
+					Component struct {
+						Name   string `json:"name"`
+						Hashes []struct {
+							Content string `json:"content"`
+						} `json:"hashes"`
+					} `json:"component"`
+				} `json:"metadata"`
+				Components []struct {
+					Type   string `json:"type"`
+					Name   string `json:"name"`
+					Hashes []struct {
+						Content string `json:"content"`
+					} `json:"hashes"`
+				} `json:"components"`
+			}
+
+			data, err := os.ReadFile(builder.OutSBOMPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(data, &bom)).To(Succeed())
+			Expect(bom.BOMFormat).To(Equal("CycloneDX"))
+			Expect(bom.Metadata.Component.Name).To(Equal("uki.signed.efi"))
+			Expect(bom.Metadata.Component.Hashes[0].Content).To(Equal(builder.Result().Outputs[0].SHA256))
+
+			components := map[string]string{}
+			for _, c := range bom.Components {
+				components[c.Name] = c.Type
+			}
+			Expect(components).To(HaveKeyWithValue("kernel", "operating-system"))
+			Expect(components).To(HaveKeyWithValue("initrd", "file"))
+			Expect(components).To(HaveKeyWithValue("stub", "application"))
+			Expect(components).To(HaveKeyWithValue("splash", "file"))
+			Expect(components).To(HaveKeyWithValue("secureboot-certificate", "cryptographic-asset"))
+
+			embedded, err := GetSection(builder.OutUKIPath, constants.SBOM)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(embedded)).To(ContainSubstring(`"kernel"`))
+			Expect(builder.Result().Outputs[len(builder.Result().Outputs)-1].Kind).To(Equal("sbom"))
+		})
+		It("Writes SPDX documents", func() {
+			main := sbomComponent{kind: "application", name: "uki.signed.efi", sha256: "aa"}
+			data, err := json.Marshal(spdxDocument(main, []sbomComponent{{kind: "file", name: ".vendor", sha256: "bb"}}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"spdxVersion":"SPDX-2.3"`))
+			Expect(string(data)).To(ContainSubstring(`"SPDXID":"SPDXRef-.vendor"`))
+			Expect(string(data)).To(ContainSubstring(`"relationshipType":"CONTAINS"`))
+		})
+		It("Fails with an unknown format", func() {
+			builder := &Builder{SBOMFormat: "swid"}
+			Expect(builder.checkInputs()).To(MatchError(ContainSubstring("SBOM format")))
+		})
+	})
+	Describe("Kernel signature", func() {
+		It("Records and verifies the vendor signature of the kernel", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			sb, err := pesign.NewSecureBootSigner("../pesign/testdata/sb.pem", "../pesign/testdata/sb.key")
+			Expect(err).ToNot(HaveOccurred())
+			vendor, err := pesign.NewSigner(sb)
+			Expect(err).ToNot(HaveOccurred())
+			kernel := filepath.Join(dir, "vmlinuz.signed")
+			Expect(vendor.Sign("../pesign/testdata/file.efi", kernel)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:      "../pesign/testdata/file.efi",
+				KernelPath:      kernel,
+				InitrdPath:      filepath.Join(dir, "initrd"),
+				KernelSignature: KernelSignatureRequire,
+				KernelCAs:       []string{"../pesign/testdata/sb.pem"},
+				OutUKIPath:      filepath.Join(dir, "uki.signed.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			Expect(builder.Result().Kernel.Signatures).To(HaveLen(1))
+			Expect(builder.Result().Kernel.Signatures[0].Verified).To(BeTrue())
+			Expect(builder.Result().Kernel.Signatures[0].Subject).To(Equal(sb.Certificate().Subject.String()))
+
+			linux, err := GetSection(builder.unsignedOutputPath(), constants.Linux)
+			Expect(err).ToNot(HaveOccurred())
+			signed, err := os.ReadFile(kernel)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(linux).To(Equal(signed))
+		})
+		It("Fails to require the signature of an unsigned kernel", func() {
+			builder := &Builder{KernelPath: "../pesign/testdata/file.efi", KernelSignature: KernelSignatureRequire}
+			Expect(builder.checkKernelSignature()).To(MatchError(types.ErrVerification))
+
+			builder.KernelSignature = KernelSignatureRecord
+			Expect(builder.checkKernelSignature()).To(Succeed())
+			Expect(builder.Result().Kernel.Signatures).To(BeEmpty())
+		})
+		It("Fails with an unknown mode", func() {
+			builder := &Builder{KernelSignature: "keep"}
+			Expect(builder.checkInputs()).To(MatchError(ContainSubstring("kernel signature mode")))
+		})
+	})
+	Describe("Firmware", func() {
+		It("Embeds and measures the firmware image as .efifw", func() {
+			dir := GinkgoT().TempDir()
+			for _, name := range []string{"kernel", "initrd", "firmware.bin"} {
+				Expect(os.WriteFile(filepath.Join(dir, name), []byte(name), 0o600)).To(Succeed())
+			}
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Firmware:   filepath.Join(dir, "firmware.bin"),
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			// the systemd-stub 254 of the test data does not know the section
+			Expect(builder.Build()).To(Succeed())
+			Expect(builder.Result().Warnings).To(ContainElement(ContainSubstring(".efifw")))
+
+			builder.Stub = &stub.Custom{StubPath: "../pesign/testdata/file.efi"}
+			Expect(builder.Build()).To(Succeed())
+
+			firmware, err := GetSection(filepath.Join(dir, "uki.efi"), constants.EFIFW)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(firmware)).To(Equal("firmware.bin"))
+
+			names, err := ListSections(filepath.Join(dir, "uki.efi"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names[len(names)-2:]).To(Equal([]constants.Section{constants.EFIFW, constants.Linux}))
+			Expect(builder.Result().Sections).To(ContainElement(HaveField("Name", string(constants.EFIFW))))
+		})
+	})
+	Describe("Webhook", func() {
+		It("Posts a signed event when each build finishes", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			var (
+				mu     sync.Mutex
+				events []BuildEvent
+			)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				Expect(err).ToNot(HaveOccurred())
+
+				signature := WebhookSignature("secret", r.Header.Get(WebhookTimestampHeader), body)
+				Expect(r.Header.Get(WebhookSignatureHeader)).To(Equal("sha256=" + signature))
+
+				var event BuildEvent
+				Expect(json.Unmarshal(body, &event)).To(Succeed())
+				Expect(r.Header.Get(WebhookEventHeader)).To(Equal(event.Type))
+
+				mu.Lock()
+				events = append(events, event)
+				mu.Unlock()
+			}))
+			defer server.Close()
+
+			multi, err := NewMultiBuilder(&Manifest{
+				Webhook: server.URL,
+				Defaults: BuildConfig{
+					SdStubPath: "../pesign/testdata/file.efi",
+					KernelPath: filepath.Join(dir, "kernel"),
+					InitrdPath: filepath.Join(dir, "initrd"),
+				},
+				Builds: []BuildConfig{
+					{Name: "ok", OutUKIPath: filepath.Join(dir, "ok.efi")},
+					{Name: "broken", Splash: filepath.Join(dir, "missing.bmp"), OutUKIPath: filepath.Join(dir, "broken.efi")},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			multi.Webhook.Secret = "secret"
+
+			_, err = multi.Build()
+			Expect(err).To(HaveOccurred())
+			Expect(events).To(HaveLen(2))
+
+			Expect(events[0].Type).To(Equal(EventBuildSucceeded))
+			Expect(events[0].Name).To(Equal("ok"))
+			Expect(events[0].Outputs).To(ContainElement(And(HaveField("Kind", "uki"), HaveField("SHA256", Not(BeEmpty())))))
+
+			Expect(events[1].Type).To(Equal(EventBuildFailed))
+			Expect(events[1].Name).To(Equal("broken"))
+			Expect(events[1].Error).ToNot(BeEmpty())
+		})
+		It("Fails on error responses", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer server.Close()
+
+			webhook := &Webhook{URL: server.URL}
+			Expect(webhook.Notify(&BuildEvent{Type: EventBuildSucceeded})).To(MatchError(ContainSubstring("403")))
+		})
+	})
+	Describe("Extensions", func() {
+		It("Places the extensions next to the UKI and predicts their measurements", func() {
+			dir := GinkgoT().TempDir()
+			for _, name := range []string{"kernel", "initrd", "b.sysext.raw", "a.sysext.raw", "etc.confext.raw"} {
+				Expect(os.WriteFile(filepath.Join(dir, name), []byte(name), 0o600)).To(Succeed())
+			}
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Extensions: []string{filepath.Join(dir, "b.sysext.raw"), filepath.Join(dir, "etc.confext.raw"), filepath.Join(dir, "a.sysext.raw")},
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			placed, err := os.ReadFile(filepath.Join(dir, "uki.efi.extra.d", "a.sysext.raw"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(placed)).To(Equal("a.sysext.raw"))
+
+			result := builder.Result()
+			Expect(result.Outputs).To(ContainElement(And(HaveField("Kind", OutputConfext), HaveField("Path", filepath.Join(dir, "uki.efi.extra.d", "etc.confext.raw")))))
+			Expect(result.Extensions).To(HaveLen(3))
+			Expect(result.Extensions[0].Kind).To(Equal(OutputSysext))
+			Expect(result.Extensions[1].PCR).To(Equal(constants.SysextPCR))
+			Expect(result.Extensions[2].PCR).To(Equal(constants.KernelConfigPCR))
+			Expect(result.Extensions[2].Events).To(ContainElement(And(HaveField("Algorithm", "SHA-256"), HaveField("Digest", fmt.Sprintf("%x", sha256.Sum256([]byte("etc.confext.raw")))))))
+
+			// extended in the order of the file names
+			expected := make([]byte, sha256.Size)
+			for _, name := range []string{"a.sysext.raw", "b.sysext.raw"} {
+				sum := sha256.Sum256([]byte(name))
+				next := sha256.Sum256(append(expected, sum[:]...))
+				expected = next[:]
+			}
+
+			Expect(result.Measurements).To(ContainElement(And(
+				HaveField("PCR", constants.SysextPCR),
+				HaveField("Algorithm", "SHA-256"),
+				HaveField("Phase", string(constants.EnterInitrd)),
+				HaveField("Digest", hex.EncodeToString(expected)),
+			)))
+		})
+		It("Refuses extensions systemd-stub does not pick up", func() {
+			dir := GinkgoT().TempDir()
+			for _, name := range []string{"kernel", "initrd", "image.raw"} {
+				Expect(os.WriteFile(filepath.Join(dir, name), []byte(name), 0o600)).To(Succeed())
+			}
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				Extensions: []string{filepath.Join(dir, "image.raw")},
+				OutUKIPath: filepath.Join(dir, "uki.efi"),
+			}
+			Expect(builder.Build()).To(MatchError(ContainSubstring(".sysext.raw")))
+		})
+		It("Splits the initrd over the maximum size into addons", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("0123456789"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:    "../pesign/testdata/file.efi",
+				KernelPath:    filepath.Join(dir, "kernel"),
+				InitrdPath:    filepath.Join(dir, "initrd"),
+				OutUKIPath:    filepath.Join(dir, "uki.efi"),
+				MaxInitrdSize: 6,
+				AddonStubPath: "../pesign/testdata/file.efi",
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			section := func(path string) string {
+				f, err := pe.Open(path)
+				Expect(err).ToNot(HaveOccurred())
+				defer f.Close()
+
+				s := f.Section(string(constants.Initrd))
+				Expect(s).ToNot(BeNil())
+
+				data, err := s.Data()
+				Expect(err).ToNot(HaveOccurred())
+
+				return string(data[:s.VirtualSize])
+			}
+
+			// split at the 4 bytes the stub aligns the initrds to
+			Expect(section(builder.unsignedOutputPath())).To(Equal("0123"))
+			Expect(section(filepath.Join(dir, "uki.efi.extra.d", "initrd-1.addon.efi"))).To(Equal("4567"))
+			Expect(section(filepath.Join(dir, "uki.efi.extra.d", "initrd-2.addon.efi"))).To(Equal("89"))
+
+			result := builder.Result()
+			Expect(result.Outputs).To(ContainElement(HaveField("Kind", OutputInitrdAddon)))
+			Expect(result.Extensions).To(HaveLen(2))
+			Expect(result.Extensions[0].PCR).To(Equal(constants.KernelConfigPCR))
+			Expect(result.Extensions[0].Events).To(ContainElement(And(HaveField("Algorithm", "SHA-256"), HaveField("Digest", fmt.Sprintf("%x", sha256.Sum256([]byte("4567")))))))
+			Expect(result.Sections).To(ContainElement(And(HaveField("Name", string(constants.Initrd)), HaveField("Size", int64(4)))))
+		})
+		It("Needs the addon stub to split the initrd", func() {
+			builder := &Builder{
+				SdStubPath:    "../pesign/testdata/file.efi",
+				KernelPath:    "../pesign/testdata/file.efi",
+				InitrdPath:    "../pesign/testdata/file.efi",
+				OutUKIPath:    filepath.Join(GinkgoT().TempDir(), "uki.efi"),
+				MaxInitrdSize: 1 << 20,
+			}
+			Expect(builder.Build()).To(MatchError(ContainSubstring("needs the addon stub")))
+		})
+	})
+	Describe("Addons", func() {
+		It("Builds and measures the addon sections", func() {
+			dir := GinkgoT().TempDir()
+			dtb := []byte("\xd0\x0d\xfe\xedtree")
+			Expect(os.WriteFile(filepath.Join(dir, "board.dtb"), dtb, 0o600)).To(Succeed())
+
+			addon := &AddonBuilder{
+				AddonStubPath: "../pesign/testdata/file.efi",
+				Cmdline:       "console=ttyS0\n",
+				DTBPath:       filepath.Join(dir, "board.dtb"),
+				SBKey:         "../pesign/testdata/sb.key",
+				SBCert:        "../pesign/testdata/sb.pem",
+				OutPath:       filepath.Join(dir, "console.addon.efi"),
+			}
+			Expect(addon.Build()).To(Succeed())
+
+			Expect(ListSections(addon.OutPath)).To(ContainElements(constants.CMDLine, constants.DTB))
+			Expect(GetSection(addon.OutPath, constants.CMDLine)).To(BeEquivalentTo("console=ttyS0\n"))
+			Expect(GetSection(addon.OutPath, constants.DTB)).To(Equal(dtb))
+
+			cert, err := pesign.NewSecureBootSigner(addon.SBCert, addon.SBKey)
+			Expect(err).ToNot(HaveOccurred())
+			ok, err := pesign.VerifyFile(addon.OutPath, cert.Certificate())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			// the stub measures the cmdline as UTF-16, control characters replaced by spaces and the
+			// trailing spaces stripped
+			cmdline := []byte{}
+			for _, c := range "console=ttyS0" {
+				cmdline = append(cmdline, byte(c), 0)
+			}
+			cmdline = append(cmdline, 0, 0)
+			Expect(measure.AddonCmdlineData(addon.Cmdline)).To(Equal(cmdline))
+			Expect(measure.AddonCmdlineData("quiet\tro \r\n")).To(Equal([]byte{'q', 0, 'u', 0, 'i', 0, 'e', 0, 't', 0, ' ', 0, 'r', 0, 'o', 0, 0, 0}))
+
+			Expect(addon.Measurements()).To(ContainElements(
+				types.PCREvent{PCR: constants.KernelConfigPCR, Algorithm: "SHA-256", Digest: fmt.Sprintf("%x", sha256.Sum256(cmdline)), Description: string(constants.CMDLine)},
+				types.PCREvent{PCR: constants.KernelConfigPCR, Algorithm: "SHA-256", Digest: fmt.Sprintf("%x", sha256.Sum256(dtb)), Description: string(constants.DTB)},
+			))
+			// one event per section and bank
+			_, banks := types.GetTPMALGorithm()
+			Expect(addon.Measurements()).To(HaveLen(2 * len(banks)))
+		})
+		It("Fails without any section", func() {
+			addon := &AddonBuilder{AddonStubPath: "../pesign/testdata/file.efi", OutPath: filepath.Join(GinkgoT().TempDir(), "empty.addon.efi")}
+			Expect(addon.Build()).To(MatchError(types.ErrInvalidInput))
+		})
+	})
+	Describe("Checksums", func() {
+		It("Lists the outputs relative to the checksums file", func() {
+			result := &Result{Outputs: []OutputResult{
+				{Kind: "uki", Path: "out/uki.signed.efi", SHA256: "aa"},
+				{Kind: "sd-boot", Path: "/elsewhere/sdboot.signed.efi", SHA256: "bb"},
+			}}
+			Expect(string(result.Checksums("out"))).To(Equal("aa  uki.signed.efi\nbb  sdboot.signed.efi\n"))
+		})
+		It("Signs the checksums file with a detached signature", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:       "../pesign/testdata/file.efi",
+				KernelPath:       filepath.Join(dir, "kernel"),
+				InitrdPath:       filepath.Join(dir, "initrd"),
+				SBKey:            "../pesign/testdata/sb.key",
+				SBCert:           "../pesign/testdata/sb.pem",
+				OutUKIPath:       filepath.Join(dir, "uki.signed.efi"),
+				OutChecksumsPath: filepath.Join(dir, "SHA256SUMS"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			sums, err := os.ReadFile(builder.OutChecksumsPath)
+			Expect(err).ToNot(HaveOccurred())
+			uki, err := os.ReadFile(builder.OutUKIPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(sums)).To(Equal(fmt.Sprintf("%x  uki.signed.efi\n", sha256.Sum256(uki))))
+
+			signature, err := os.ReadFile(builder.OutChecksumsPath + ".p7s")
+			Expect(err).ToNot(HaveOccurred())
+			signer, err := pesign.NewSecureBootSigner(builder.SBCert, builder.SBKey)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pesign.VerifyDetached(sums, signature, signer.Certificate())).To(BeTrue())
+
+			// not a signature of other checksums
+			Expect(pesign.VerifyDetached(append(sums, "00  other.efi\n"...), signature, signer.Certificate())).To(BeFalse())
+		})
+	})
+	Describe("Recovery", func() {
+		It("Builds the recovery UKI with its own cmdline and initrd", func() {
+			builder := &Builder{
+				Cmdline:            "console=ttyS0",
+				InitrdPath:         "initrd",
+				SdBootPath:         "sd-boot.efi",
+				OutUKIPath:         "uki.signed.efi",
+				OutBundlePath:      "bundle.tar",
+				RecoveryInitrdPath: "recovery-initrd",
+				RecoveryCmdline:    "console=ttyS0 recovery",
+				RecoverySplash:     "recovery.png",
+				Splash:             "splash.bmp",
+				OutRecoveryUKIPath: "recovery.signed.efi",
+			}
+			Expect((&Builder{}).recoveryBuilder()).To(BeNil())
+
+			recovery := builder.recoveryBuilder()
+			Expect(recovery.Cmdline).To(Equal("console=ttyS0 recovery"))
+			Expect(recovery.InitrdPath).To(Equal("recovery-initrd"))
+			Expect(recovery.Splash).To(Equal("recovery.png"))
+			Expect(recovery.OutUKIPath).To(Equal("recovery.signed.efi"))
+			Expect(recovery.SdBootPath).To(BeEmpty())
+			Expect(recovery.OutBundlePath).To(BeEmpty())
+			Expect(recovery.recoveryBuilder()).To(BeNil())
+		})
+		It("Tags the recovery outputs and measurements", func() {
+			builder := &Builder{}
+			builder.mergeRecovery(&Result{
+				Outputs:      []OutputResult{{Kind: "uki", Path: "recovery.signed.efi"}},
+				Measurements: []types.PCRMeasurement{{Phase: string(constants.EnterInitrd), PCR: constants.UKIPCR}},
+			})
+			Expect(builder.result.Outputs).To(Equal([]OutputResult{{Kind: "recovery-uki", Path: "recovery.signed.efi"}}))
+			Expect(builder.result.Measurements[0].Variant).To(Equal(RecoveryVariant))
+		})
+		It("Fails without a different cmdline or initrd", func() {
+			builder := &Builder{OutRecoveryUKIPath: "recovery.signed.efi"}
+			Expect(builder.checkInputs()).To(MatchError(ContainSubstring("recovery")))
+		})
+	})
+	Describe("Build cache", func() {
+		It("Reuses the digests of unchanged inputs across builds", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			newBuilder := func(cmdline string) *Builder {
+				return &Builder{
+					SdStubPath:    "../pesign/testdata/file.efi",
+					KernelPath:    filepath.Join(dir, "kernel"),
+					InitrdPath:    filepath.Join(dir, "initrd"),
+					Cmdline:       cmdline,
+					OutUKIPath:    filepath.Join(dir, "uki.signed.efi"),
+					BuildCacheDir: filepath.Join(dir, "cache"),
+				}
+			}
+
+			Expect(newBuilder("console=ttyS0").Build()).To(Succeed())
+
+			cacheFile := filepath.Join(dir, "cache", buildCacheFile)
+			data, err := os.ReadFile(cacheFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(filepath.Join(dir, "initrd")))
+			// the generated sections are left out
+			Expect(string(data)).ToNot(ContainSubstring("cmdline"))
+
+			// a digest only the cache knows of shows up in the next build
+			_, digest, err := fileDigest(filepath.Join(dir, "initrd"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(cacheFile, bytes.ReplaceAll(data, []byte(digest), []byte(strings.Repeat("0", 64))), 0o600)).To(Succeed())
+
+			builder := newBuilder("console=tty0")
+			Expect(builder.Build()).To(Succeed())
+
+			// only the generated sections are hashed again, the kernel and initrd are cached
+			// and the bundled splash is not a file
+			report := builder.Report()
+			Expect(report.CacheHits).To(Equal(2))
+			Expect(report.CacheMisses).To(Equal(3))
+			Expect(report.CacheHitRate).To(BeNumerically("~", 2.0/5))
+			Expect(report.OutputBytes).To(Equal(builder.Result().Outputs[0].Size))
+			Expect(report.Duration).To(BeNumerically(">", 0))
+
+			var stages []Stage
+			for _, stage := range report.Stages {
+				stages = append(stages, stage.Stage)
+			}
+			Expect(stages).To(Equal([]Stage{StageGenerate, StageMeasure, StageAssemble}))
+
+			for _, section := range builder.Result().Sections {
+				if section.Name == string(constants.Initrd) {
+					Expect(section.SHA256).To(Equal(strings.Repeat("0", 64)))
+				}
+			}
+		})
+	})
+	Describe("Memory limit", func() {
+		It("Builds the same UKI streaming the inputs and bundle", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), bytes.Repeat([]byte("initrd"), 100000), 0o600)).To(Succeed())
+
+			build := func(name string, maxMemory int64) *Builder {
+				builder := &Builder{
+					SdStubPath:    "../pesign/testdata/file.efi",
+					KernelPath:    filepath.Join(dir, "kernel"),
+					InitrdPath:    filepath.Join(dir, "initrd"),
+					OutUKIPath:    filepath.Join(dir, name+".signed.efi"),
+					OutBundlePath: filepath.Join(dir, name+".tar.gz"),
+					MaxMemory:     maxMemory,
+				}
+				Expect(builder.Build()).To(Succeed())
+				Expect(utils.MemoryLimited()).To(BeFalse())
+
+				return builder
+			}
+
+			unlimited := build("unlimited", 0).Result()
+			limited := build("limited", 256<<20).Result()
+
+			Expect(limited.Measurements).To(Equal(unlimited.Measurements))
+			Expect(limited.Outputs[0].SHA256).To(Equal(unlimited.Outputs[0].SHA256))
+
+			f, err := os.Open(filepath.Join(dir, "limited.tar.gz"))
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+
+			gz, err := gzip.NewReader(f)
+			Expect(err).ToNot(HaveOccurred())
+
+			tr := tar.NewReader(gz)
+			hdr, err := tr.Next()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hdr.Name).To(Equal(filepath.Base(limited.Outputs[0].Path)))
+			Expect(hdr.Size).To(Equal(limited.Outputs[0].Size))
+
+			data, err := io.ReadAll(tr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(int64(len(data))).To(Equal(hdr.Size))
+		})
+	})
+	Describe("In memory", func() {
+		It("Builds without a scratch dir", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			newBuilder := func(name string, inMemory bool) *Builder {
+				return &Builder{
+					SdStubPath:    "../pesign/testdata/file.efi",
+					KernelPath:    filepath.Join(dir, "kernel"),
+					InitrdPath:    filepath.Join(dir, "initrd"),
+					Cmdline:       "console=ttyS0",
+					PCRKey:        "../pesign/testdata/tpm.pem",
+					SBKey:         "../pesign/testdata/sb.key",
+					SBCert:        "../pesign/testdata/sb.pem",
+					OutUKIPath:    filepath.Join(dir, name+".signed.efi"),
+					OutBundlePath: filepath.Join(dir, name+"-bundle"),
+					InMemory:      inMemory,
+				}
+			}
+
+			scratch := newBuilder("scratch", false)
+			Expect(scratch.Build()).To(Succeed())
+
+			// no temp space at all
+			GinkgoT().Setenv("TMPDIR", filepath.Join(dir, "missing"))
+
+			builder := newBuilder("memory", true)
+			Expect(builder.Build()).To(Succeed())
+
+			Expect(builder.Result().Measurements).To(Equal(scratch.Result().Measurements))
+			Expect(builder.Result().Sections).To(HaveLen(len(scratch.Result().Sections)))
+			for i, section := range builder.Result().Sections {
+				Expect(section.SHA256).To(Equal(scratch.Result().Sections[i].SHA256), section.Name)
+
+				if section.Name != string(constants.Linux) && section.Name != string(constants.Initrd) {
+					Expect(section.Path).To(BeEmpty(), section.Name)
+				}
+			}
+
+			cert, err := pesign.LoadCertificate("../pesign/testdata/sb.pem")
+			Expect(err).ToNot(HaveOccurred())
+			ok, err := pesign.VerifyFile(builder.OutUKIPath, cert)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			for _, name := range []string{constants.PCRPublicKeyFile, constants.PCRSignatureFile} {
+				Expect(filepath.Join(dir, "memory-bundle", name)).To(BeAnExistingFile())
+			}
+
+			// neither the unsigned UKI nor the signing temp file are left behind
+			entries, err := os.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			Expect(names).To(ConsistOf("kernel", "initrd", "scratch.signed.efi", "scratch-bundle", "memory.signed.efi", "memory-bundle"))
+		})
+	})
+	Describe("Publish", func() {
+		It("Places the scratch dir next to the output and renames the UKI into place", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "uki.unsigned.efi"), []byte("previous"), 0o600)).To(Succeed())
+
+			// the temp dir is not used when the output dir is writable
+			GinkgoT().Setenv("TMPDIR", filepath.Join(dir, "missing"))
+
+			builder := &Builder{
+				SdStubPath: "../pesign/testdata/file.efi",
+				KernelPath: filepath.Join(dir, "kernel"),
+				InitrdPath: filepath.Join(dir, "initrd"),
+				OutUKIPath: filepath.Join(dir, "uki.signed.efi"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			st, err := os.Stat(filepath.Join(dir, "uki.unsigned.efi"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st.Mode().Perm()).To(Equal(os.FileMode(unsignedMode)))
+			Expect(st.Size()).To(Equal(builder.Result().Outputs[0].Size))
+
+			entries, err := os.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(3))
+		})
+		It("Gives the outputs their mode and owner", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "kernel"), []byte("kernel"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "initrd"), []byte("initrd"), 0o600)).To(Succeed())
+
+			builder := &Builder{
+				SdStubPath:       "../pesign/testdata/file.efi",
+				KernelPath:       filepath.Join(dir, "kernel"),
+				InitrdPath:       filepath.Join(dir, "initrd"),
+				SBKey:            "../pesign/testdata/sb.key",
+				SBCert:           "../pesign/testdata/sb.pem",
+				OutUKIPath:       filepath.Join(dir, "uki.signed.efi"),
+				OutChecksumsPath: filepath.Join(dir, "SHA256SUMS"),
+			}
+			Expect(builder.Build()).To(Succeed())
+
+			// regardless of the umask and the mode of the inputs
+			for _, output := range builder.Result().Outputs {
+				st, err := os.Stat(output.Path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(st.Mode().Perm()).To(Equal(os.FileMode(defaultOutputMode)), output.Kind)
+			}
+
+			builder.OutputMode = 0o640
+			builder.OutputOwner = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+			Expect(builder.Build()).To(Succeed())
+
+			for _, output := range builder.Result().Outputs {
+				st, err := os.Stat(output.Path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(st.Mode().Perm()).To(Equal(os.FileMode(0o640)), output.Kind)
+			}
+
+			uid, gid, err := parseOwner(":" + strconv.Itoa(os.Getgid()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(uid).To(Equal(-1))
+			Expect(gid).To(Equal(os.Getgid()))
+
+			builder.OutputOwner = "no-such-user-ukify"
+			Expect(builder.Build()).To(MatchError(ContainSubstring("invalid output owner")))
+
+			builder.OutputOwner = ""
+			builder.OutputMode = os.ModeSetuid | 0o755
+			Expect(builder.Build()).To(MatchError(ContainSubstring("only permission bits can be set")))
+		})
+	})
+	Describe("Dbx", func() {
+		It("Fails on revoked outputs unless only warning", func() {
+			err := fmt.Errorf("stub.efi: %w", secureboot.ErrRevoked)
+
+			Expect((&Builder{}).revoked(err)).To(MatchError(types.ErrVerification))
+
+			builder := &Builder{DbxWarnOnly: true}
+			Expect(builder.revoked(err)).To(Succeed())
+			Expect(builder.result.Warnings).To(HaveLen(1))
+		})
+	})
+	Describe("Bundle", func() {
+		It("Collects the outputs, PCR files and manifest", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "uki.signed.efi"), []byte("uki"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "pcrpkey"), []byte("key"), 0o600)).To(Succeed())
+
+			builder := &Builder{OutBundlePath: filepath.Join(dir, "bundle")}
+			builder.sections = []types.UkiSection{{Name: constants.PCRPKey, Path: filepath.Join(dir, "pcrpkey")}}
+			builder.result = Result{Outputs: []OutputResult{{Kind: "uki", Path: filepath.Join(dir, "uki.signed.efi"), SHA256: "aa"}}}
+			Expect(builder.writeBundle()).To(Succeed())
+
+			for _, name := range []string{"uki.signed.efi", constants.PCRPublicKeyFile, BundleMeasurementsFile, BundleManifestFile} {
+				Expect(filepath.Join(dir, "bundle", name)).To(BeAnExistingFile())
+			}
+			manifest, err := os.ReadFile(filepath.Join(dir, "bundle", BundleManifestFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(manifest)).To(ContainSubstring(`"path": "uki.signed.efi"`))
+		})
+		It("Writes tarballs depending on the extension", func() {
+			Expect(isTarball("out.tar.gz")).To(BeTrue())
+			Expect(isTarball("out.tgz")).To(BeTrue())
+			Expect(isTarball("out.tar")).To(BeTrue())
+			Expect(isTarball("out")).To(BeFalse())
+		})
+	})
+})
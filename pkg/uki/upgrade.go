@@ -0,0 +1,263 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// UpgradeEntry is a UKI written by BuildForUpgrade, booted as a boot entry of its name.
+type UpgradeEntry struct {
+	// Name of the entry, the UKI is written to <name>.efi.
+	Name string `yaml:"name"`
+	// Cmdline options of the entry, appended to the shared cmdline.
+	Cmdline string `yaml:"cmdline,omitempty"`
+}
+
+// DefaultUpgradeEntries returns the Kairos boot entries: active, passive and recovery. They share
+// the same UKI contents, the booted entry tells them apart.
+func DefaultUpgradeEntries() []UpgradeEntry {
+	return []UpgradeEntry{{Name: "active"}, {Name: "passive"}, {Name: "recovery"}}
+}
+
+// UpgradeConfig configures the UKIs BuildForUpgrade writes out of an upgrade artifact.
+type UpgradeConfig struct {
+	// Options shared by the UKIs, i.e. the stub and the keys. The kernel, initrd, os-release and
+	// cmdline are taken from the artifact when empty. The outputs of BuildConfig are the entries,
+	// only sd-boot is signed to output-sdboot, once.
+	BuildConfig `yaml:",inline"`
+	// Directory the UKIs are written to, the artifact directory when empty.
+	OutDir string `yaml:"output-dir,omitempty"`
+	// UKIs to write, DefaultUpgradeEntries when empty.
+	Entries []UpgradeEntry `yaml:"entries,omitempty"`
+	// Number of UKIs to build in parallel, defaults to 1.
+	Jobs int `yaml:"jobs,omitempty"`
+	// Called to obtain the passphrase of encrypted keys
+	Passphrase pesign.PassphraseFunc `yaml:"-"`
+}
+
+// LoadUpgradeConfig reads an upgrade config file.
+//
+// Relative paths in the config are resolved against the config directory.
+func LoadUpgradeConfig(path string) (*UpgradeConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config UpgradeConfig
+
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed parsing upgrade config %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+
+	config.resolvePaths(dir)
+
+	if config.OutDir != "" && !filepath.IsAbs(config.OutDir) {
+		config.OutDir = filepath.Join(dir, config.OutDir)
+	}
+
+	return &config, nil
+}
+
+// kernelCandidates are the kernel images looked for in an artifact, relative to its root, in order.
+// Globs match the versioned images of the distributions without an unversioned link.
+var kernelCandidates = []string{"boot/vmlinuz", "boot/Image", "boot/vmlinuz-*", "boot/Image-*", "usr/lib/modules/*/vmlinuz", "lib/modules/*/vmlinuz"}
+
+// initrdCandidates are the initrds looked for in an artifact, relative to its root, in order.
+var initrdCandidates = []string{"boot/initrd", "boot/initramfs.img", "boot/initrd-*", "boot/initramfs-*.img", "boot/initrd.img-*", "usr/lib/modules/*/initrd", "lib/modules/*/initrd"}
+
+// FindBootFiles returns the kernel image and the initrd of an extracted rootfs, i.e. of an OCI image.
+//
+// The unversioned /boot/vmlinuz and /boot/initrd are used first, otherwise there must be a single versioned
+// one. Links are resolved within the rootfs, as absolute links point to its root.
+func FindBootFiles(rootfs string) (kernel, initrd string, err error) {
+	if kernel, err = findBootFile(rootfs, "kernel", kernelCandidates); err != nil {
+		return "", "", err
+	}
+
+	if initrd, err = findBootFile(rootfs, "initrd", initrdCandidates); err != nil {
+		return "", "", err
+	}
+
+	return kernel, initrd, nil
+}
+
+// findBootFile returns the first of the candidates found in the rootfs.
+func findBootFile(rootfs, kind string, candidates []string) (string, error) {
+	for _, candidate := range candidates {
+		matches, err := filepath.Glob(filepath.Join(rootfs, candidate))
+		if err != nil {
+			return "", err
+		}
+
+		// leave out the links resolving out of the rootfs or to nothing
+		matches = slices.DeleteFunc(matches, func(match string) bool {
+			resolved, err := resolveInRoot(rootfs, match)
+			if err != nil {
+				return true
+			}
+
+			st, err := os.Stat(resolved)
+
+			return err != nil || !st.Mode().IsRegular()
+		})
+
+		switch len(matches) {
+		case 0:
+			continue
+		case 1:
+			return resolveInRoot(rootfs, matches[0])
+		default:
+			return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("found several %ss in %s: %s", kind, rootfs, strings.Join(matches, ", ")))
+		}
+	}
+
+	return "", types.WithCategory(types.ErrInvalidInput, fmt.Errorf("no %s found in %s", kind, rootfs))
+}
+
+// maxLinks is the number of links followed resolving a path, as the kernel does.
+const maxLinks = 40
+
+// resolveInRoot follows the links of path as if rootfs was the root directory.
+func resolveInRoot(rootfs, path string) (string, error) {
+	for range maxLinks {
+		target, err := os.Readlink(path)
+		if err != nil {
+			// not a link
+			return path, nil //nolint:nilerr
+		}
+
+		if filepath.IsAbs(target) {
+			path = filepath.Join(rootfs, target)
+		} else {
+			path = filepath.Join(filepath.Dir(path), target)
+		}
+
+		if rel, err := filepath.Rel(rootfs, path); err != nil || strings.HasPrefix(rel, "..") {
+			return "", fmt.Errorf("%s resolves out of %s", path, rootfs)
+		}
+	}
+
+	return "", fmt.Errorf("too many links resolving %s", path)
+}
+
+// upgradeManifest returns the manifest of the builds of the entries.
+func upgradeManifest(artifactDir string, config UpgradeConfig) (*Manifest, error) {
+	defaults := config.BuildConfig
+
+	if defaults.KernelPath == "" || defaults.InitrdPath == "" {
+		kernel, initrd, err := FindBootFiles(artifactDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if defaults.KernelPath == "" {
+			defaults.KernelPath = kernel
+		}
+
+		if defaults.InitrdPath == "" {
+			defaults.InitrdPath = initrd
+		}
+	}
+
+	if defaults.OsRelease == "" {
+		if osRelease, err := resolveInRoot(artifactDir, filepath.Join(artifactDir, "etc/os-release")); err == nil && fileExists(osRelease) {
+			defaults.OsRelease = osRelease
+		}
+	}
+
+	// the systemd kernel-install cmdline of the image
+	if defaults.Cmdline == "" {
+		if data, err := os.ReadFile(filepath.Join(artifactDir, "etc/kernel/cmdline")); err == nil {
+			defaults.Cmdline = strings.Join(strings.Fields(string(data)), " ")
+		}
+	}
+
+	outDir := config.OutDir
+	if outDir == "" {
+		outDir = artifactDir
+	}
+
+	entries := config.Entries
+	if len(entries) == 0 {
+		entries = DefaultUpgradeEntries()
+	}
+
+	manifest := &Manifest{Jobs: config.Jobs}
+
+	for i, entry := range entries {
+		if entry.Name == "" || strings.ContainsRune(entry.Name, filepath.Separator) {
+			return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid upgrade entry name %q", entry.Name))
+		}
+
+		if slices.ContainsFunc(entries[:i], func(e UpgradeEntry) bool { return e.Name == entry.Name }) {
+			return nil, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("upgrade entry %s listed twice", entry.Name))
+		}
+
+		build := BuildConfig{
+			Name:       entry.Name,
+			Cmdline:    strings.TrimSpace(defaults.Cmdline + " " + entry.Cmdline),
+			OutUKIPath: filepath.Join(outDir, entry.Name+".efi"),
+		}
+
+		// sd-boot is shared by the entries, signed with the first one
+		if i == 0 {
+			build.SdBootPath, build.OutSdBootPath = defaults.SdBootPath, defaults.OutSdBootPath
+		}
+
+		manifest.Builds = append(manifest.Builds, build)
+	}
+
+	// the entries are the outputs
+	defaults.Name, defaults.OutUKIPath, defaults.SdBootPath, defaults.OutSdBootPath = "", "", "", ""
+	defaults.OutChecksums, defaults.OutBundle, defaults.OutRecoveryUKI = "", "", ""
+	manifest.Defaults = defaults
+
+	return manifest, nil
+}
+
+// BuildForUpgrade writes the UKIs of an upgrade out of the extracted rootfs of an upgrade artifact, i.e.
+// an OCI image: one per entry of config, DefaultUpgradeEntries unless set, to the output directory.
+//
+// The kernel and initrd are found in the rootfs with FindBootFiles, the os-release and the cmdline
+// are the ones of the rootfs, /etc/os-release and /etc/kernel/cmdline, unless given in config.
+func BuildForUpgrade(artifactDir string, config UpgradeConfig) ([]BatchResult, error) {
+	manifest, err := upgradeManifest(artifactDir, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.OutDir != "" {
+		if err = os.MkdirAll(config.OutDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	multi, err := NewMultiBuilder(manifest)
+	if err != nil {
+		return nil, err
+	}
+	multi.Passphrase = config.Passphrase
+
+	return multi.Build()
+}
+
+// fileExists returns whether path is a regular file.
+func fileExists(path string) bool {
+	st, err := os.Stat(path)
+
+	return err == nil && st.Mode().IsRegular()
+}
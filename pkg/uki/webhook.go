@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kairos-io/go-ukify/pkg/fips"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// Build event types, see BuildEvent.
+const (
+	EventBuildSucceeded = "build.succeeded"
+	EventBuildFailed    = "build.failed"
+)
+
+// Webhook headers, see Webhook.
+const (
+	// WebhookSignatureHeader holds the HMAC-SHA256 of the timestamp, a dot and the body, keyed
+	// with the secret, as sha256=<hex>.
+	WebhookSignatureHeader = "X-Ukify-Signature"
+	// WebhookTimestampHeader holds the unix time the event was sent at, for receivers to refuse
+	// replayed events.
+	WebhookTimestampHeader = "X-Ukify-Timestamp"
+	// WebhookEventHeader holds the event type.
+	WebhookEventHeader = "X-Ukify-Event"
+)
+
+// webhookTimeout bounds the delivery of an event.
+const webhookTimeout = 30 * time.Second
+
+// BuildEvent is posted to the webhook when a build finishes, for update orchestration systems to pick
+// up the outputs.
+type BuildEvent struct {
+	// Event type, EventBuildSucceeded or EventBuildFailed.
+	Type string `json:"type"`
+	// Name of the build.
+	Name string `json:"name,omitempty"`
+	// Version of the UKI.
+	Version string `json:"version,omitempty"`
+	// Time the build finished at.
+	Time time.Time `json:"time"`
+	// Error message if the build failed.
+	Error string `json:"error,omitempty"`
+	// Outputs, with their digests, and the expected PCR values of the build.
+	Outputs      []OutputResult         `json:"outputs"`
+	Measurements []types.PCRMeasurement `json:"measurements,omitempty"`
+}
+
+// NewBuildEvent returns the event of the finished build of builder, err is the build error.
+func NewBuildEvent(name string, builder *Builder, err error) *BuildEvent {
+	event := &BuildEvent{
+		Type:    EventBuildSucceeded,
+		Name:    name,
+		Version: builder.Version,
+		Time:    time.Now().UTC(),
+		Outputs: []OutputResult{},
+	}
+
+	if err != nil {
+		event.Type = EventBuildFailed
+		event.Error = err.Error()
+	}
+
+	if result := builder.Result(); result != nil {
+		event.Outputs = append(event.Outputs, result.Outputs...)
+		event.Measurements = result.Measurements
+	}
+
+	return event
+}
+
+// Webhook posts the build events as JSON to a URL.
+//
+// With a secret, the events are signed with HMAC-SHA256 so the receiver can authenticate them, see
+// WebhookSignatureHeader.
+type Webhook struct {
+	// URL the events are posted to.
+	URL string
+	// Secret the events are signed with, unsigned when empty.
+	Secret string
+	// HTTP client the events are posted with, one with a timeout of 30s when nil.
+	HTTPClient *http.Client
+}
+
+// Notify posts the event, a response other than 2xx is an error.
+func (webhook *Webhook) Notify(event *BuildEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event.Type)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+
+	if webhook.Secret != "" {
+		if err = fips.CheckHMACKey([]byte(webhook.Secret)); err != nil {
+			return fmt.Errorf("webhook secret: %w", err)
+		}
+
+		req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(webhook.Secret, timestamp, body))
+	}
+
+	resp, err := webhook.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16)) //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// WebhookSignature returns the HMAC-SHA256 in hex of an event body sent at timestamp, as in
+// WebhookSignatureHeader, for receivers to check it.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (webhook *Webhook) httpClient() *http.Client {
+	if webhook.HTTPClient == nil {
+		return &http.Client{Timeout: webhookTimeout}
+	}
+
+	return webhook.HTTPClient
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"math"
+	"runtime/debug"
+	"sync"
+)
+
+// bufferShare is the fraction of the memory limit a single stream buffer may use.
+const bufferShare = 64
+
+var memoryLimits = struct {
+	sync.Mutex
+	active []int64
+	// soft memory limit of the runtime before the first limit
+	runtime int64
+}{}
+
+// LimitMemory keeps the process within limit bytes until release is called: files are streamed
+// through buffers capped to a fraction of it instead of being memory mapped, and the runtime
+// soft memory limit is set to it so the heap is collected before reaching it.
+//
+// The limits are process wide, with several of them in place the lowest one applies.
+func LimitMemory(limit int64) (release func()) {
+	memoryLimits.Lock()
+	defer memoryLimits.Unlock()
+
+	if len(memoryLimits.active) == 0 {
+		memoryLimits.runtime = debug.SetMemoryLimit(-1)
+	}
+
+	memoryLimits.active = append(memoryLimits.active, limit)
+	debug.SetMemoryLimit(lowestLimit())
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			memoryLimits.Lock()
+			defer memoryLimits.Unlock()
+
+			for i, active := range memoryLimits.active {
+				if active == limit {
+					memoryLimits.active = append(memoryLimits.active[:i], memoryLimits.active[i+1:]...)
+					break
+				}
+			}
+
+			if len(memoryLimits.active) == 0 {
+				debug.SetMemoryLimit(memoryLimits.runtime)
+				return
+			}
+
+			debug.SetMemoryLimit(lowestLimit())
+		})
+	}
+}
+
+// MemoryLimited reports whether a memory limit is in place, files must then be streamed.
+func MemoryLimited() bool {
+	memoryLimits.Lock()
+	defer memoryLimits.Unlock()
+
+	return len(memoryLimits.active) > 0
+}
+
+// StreamBufferSize is the size of the buffers streaming files: BufferSize, capped by the memory limit.
+func StreamBufferSize() int {
+	memoryLimits.Lock()
+	defer memoryLimits.Unlock()
+
+	size := BufferSize
+	if len(memoryLimits.active) > 0 {
+		size = int(min(int64(size), lowestLimit()/bufferShare))
+	}
+
+	return max(size, minBufferSize)
+}
+
+// lowestLimit returns the lowest of the active limits, with memoryLimits locked.
+func lowestLimit() int64 {
+	lowest := int64(math.MaxInt64)
+	for _, limit := range memoryLimits.active {
+		lowest = min(lowest, limit)
+	}
+
+	return lowest
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrFileChanged is returned by MappedFile.Read when the file is truncated while being read.
+var ErrFileChanged = errors.New("file changed while being read")
+
+// MappedFile holds the contents of a file, memory mapped where supported so large files are
+// read straight from the page cache instead of being copied into the heap.
+type MappedFile struct {
+	data  []byte
+	unmap func() error
+}
+
+// Bytes returns the file contents, only valid until Close. Reading them crashes the process if a
+// mapped file is truncated meanwhile, see Read.
+func (m *MappedFile) Bytes() []byte {
+	return m.data
+}
+
+// Close releases the mapping.
+func (m *MappedFile) Close() error {
+	if m.unmap == nil {
+		return nil
+	}
+
+	unmap := m.unmap
+	m.data, m.unmap = nil, nil
+
+	return unmap()
+}
+
+// Read calls read with the file contents. A mapped file truncated meanwhile, i.e. an initrd being
+// regenerated, faults on the pages past its new end: the fault is returned as ErrFileChanged
+// instead of crashing the process. read must not keep the contents.
+func (m *MappedFile) Read(read func(data []byte)) (err error) {
+	// faults only panic instead of crashing in the goroutine reading
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		if fault, ok := r.(interface{ Addr() uintptr }); ok {
+			err = fmt.Errorf("%w: fault at %#x", ErrFileChanged, fault.Addr())
+
+			return
+		}
+
+		panic(r)
+	}()
+
+	read(m.data)
+
+	return nil
+}
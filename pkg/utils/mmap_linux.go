@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// MapFile maps the file read only, falling back to reading it for empty and non regular files.
+func MapFile(path string) (*MappedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	if !st.Mode().IsRegular() || st.Size() == 0 {
+		f.Close() //nolint:errcheck
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return &MappedFile{data: data}, nil
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(st.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		f.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	// the inputs are hashed front to back, let the kernel read ahead
+	_ = unix.Madvise(data, unix.MADV_SEQUENTIAL) //nolint:errcheck
+
+	// the file is kept open until unmapped, to drop it from the page cache then if asked to
+	unmap := func() error {
+		err := unix.Munmap(data)
+
+		if dropErr := DoneWith(f, false); err == nil {
+			err = dropErr
+		}
+
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+
+		return err
+	}
+
+	return &MappedFile{data: data, unmap: unmap}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package utils
+
+import "os"
+
+// MapFile reads the file, memory mapping is only used on Linux.
+func MapFile(path string) (*MappedFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MappedFile{data: data}, nil
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileIdentity returns the device, inode and change time of the file. The change time is updated
+// by every write and can't be set back, unlike the modification time normalized by reproducible
+// builds, so together they tell whether a file with the same size and modification time changed.
+func FileIdentity(st os.FileInfo) FileID {
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}
+	}
+
+	// the field types vary with the architecture
+	return FileID{Device: uint64(sys.Dev), Inode: uint64(sys.Ino), ChangeTime: sys.Ctim.Nano()} //nolint:unconvert
+}
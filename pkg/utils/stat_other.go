@@ -0,0 +1,10 @@
+//go:build !linux
+
+package utils
+
+import "os"
+
+// FileIdentity returns an empty FileID, the device, inode and change time are only read on Linux.
+func FileIdentity(os.FileInfo) FileID {
+	return FileID{}
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// BufferSize is the size of the buffers used to stream inputs into outputs.
+var BufferSize = 1 << 20
+
+// minBufferSize is the smallest buffer NewBuffer returns.
+const minBufferSize = 4 << 10
+
+// DropCache makes streamed files leave the page cache once done with, so huge inputs and outputs
+// do not evict the cache of other jobs on shared build hosts. Written files are synced first.
+var DropCache = false
+
+// NewBuffer returns a buffer of StreamBufferSize bytes to stream files with.
+func NewBuffer() []byte {
+	return make([]byte, StreamBufferSize())
+}
+
+// Copy copies src to dst through a buffer of StreamBufferSize bytes.
+//
+// Unlike io.Copy it always uses the buffer, instead of the fixed size one of the
+// io.WriterTo of files.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, NewBuffer())
+}
+
+// OpenSequential opens a file read once front to back, hinting the kernel to read ahead.
+func OpenSequential(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	adviseSequential(f)
+
+	return f, nil
+}
+
+// DoneWith hints the file contents are not needed anymore, dropping them from the page cache
+// if DropCache is set. Written files are synced first, as dirty pages can not be dropped.
+func DoneWith(f *os.File, written bool) error {
+	if !DropCache {
+		return nil
+	}
+
+	if written {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	adviseDontNeed(f)
+
+	return nil
+}
+
+// CopyFile streams src into dst, created with perm if missing.
+func CopyFile(src, dst string, perm os.FileMode) error {
+	in, err := OpenSequential(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close() //nolint:errcheck
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = Copy(out, in); err == nil {
+		err = DoneWith(out, true)
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return DoneWith(in, false)
+}
+
+// Publish moves the finished file src to dst with perm, synced first so after a power loss dst is
+// either the previous file or the complete new one. src is copied next to dst first when on another
+// file system, so dst is still replaced by a rename.
+func Publish(src, dst string, perm os.FileMode) error {
+	if err := syncFile(src); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(src, perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+
+		tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+
+		if err = CopyFile(src, tmp, perm); err != nil {
+			os.Remove(tmp) //nolint:errcheck
+
+			return err
+		}
+
+		if err = syncFile(tmp); err == nil {
+			err = os.Rename(tmp, dst)
+		}
+
+		if err != nil {
+			os.Remove(tmp) //nolint:errcheck
+
+			return err
+		}
+	}
+
+	return SyncDir(filepath.Dir(dst))
+}
+
+// WriteFileAtomic writes the file at path with write, through a temporary file in the same directory
+// synced and renamed over it, so after a power loss path is either the previous file or the complete
+// new one, never a truncated one.
+func WriteFileAtomic(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	out, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(out.Name()) //nolint:errcheck
+
+	if err = write(out); err == nil {
+		err = out.Chmod(perm)
+	}
+
+	// synced before the rename, so the rename never exposes a partially written file
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if err == nil {
+		err = DoneWith(out, false)
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(out.Name(), path); err != nil {
+		return err
+	}
+
+	return SyncDir(filepath.Dir(path))
+}
+
+// WriteFile writes data to the file at path atomically, see WriteFileAtomic.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+
+		return err
+	})
+}
+
+// CopyFileAtomic streams src into dst atomically, see WriteFileAtomic.
+func CopyFileAtomic(src, dst string, perm os.FileMode) error {
+	in, err := OpenSequential(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close() //nolint:errcheck
+
+	if err = WriteFileAtomic(dst, perm, func(w io.Writer) error {
+		_, err := Copy(w, in)
+
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return DoneWith(in, false)
+}
+
+// SyncDir flushes the entries of the directory, so files renamed into it survive a power loss.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close() //nolint:errcheck
+
+	return d.Sync()
+}
+
+// syncFile flushes the file contents to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	return f.Sync()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package utils
+
+import "os"
+
+// page cache hints are only given on Linux.
+func adviseSequential(*os.File) {}
+
+func adviseDontNeed(*os.File) {}
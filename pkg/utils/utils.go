@@ -1,14 +1,20 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"crypto"
 	"crypto/x509"
+	"debug/pe"
 	"errors"
+	"fmt"
 	"github.com/foxboron/go-uefi/authenticode"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"log/slog"
+	"os"
+	"strconv"
+	"strings"
 )
 
 // SectionsData transforms a []types.UkiSection into a map[constants.Section]string
@@ -17,7 +23,7 @@ import (
 func SectionsData(sections []types.UkiSection) map[constants.Section]string {
 	data := map[constants.Section]string{}
 	for _, s := range sections {
-		if s.Measure {
+		if s.Measure && s.Source == nil {
 			data[s.Name] = s.Path
 		}
 	}
@@ -28,6 +34,20 @@ func SectionsData(sections []types.UkiSection) map[constants.Section]string {
 	return data
 }
 
+// SectionsContents returns the sources of the measured sections not read from files, nil if none.
+func SectionsContents(sections []types.UkiSection) map[constants.Section]*types.SectionSource {
+	var contents map[constants.Section]*types.SectionSource
+	for _, s := range sections {
+		if s.Measure && s.Source != nil {
+			if contents == nil {
+				contents = map[constants.Section]*types.SectionSource{}
+			}
+			contents[s.Name] = s.Source
+		}
+	}
+	return contents
+}
+
 // SignEFIExecutable signs an executable
 // go-uefi dropped this but they still all of the methods needed to sign an executable
 func SignEFIExecutable(key crypto.Signer, cert *x509.Certificate, file []byte) ([]byte, error) {
@@ -50,3 +70,94 @@ func SignEFIExecutable(key crypto.Signer, cert *x509.Certificate, file []byte) (
 
 	return signedFile, nil
 }
+
+// EFIArch returns the architecture name used in EFI file names (i.e. BOOTX64.EFI) for a PE machine type.
+func EFIArch(machine uint16) (string, error) {
+	switch machine {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return "x64", nil
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return "aa64", nil
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return "ia32", nil
+	case pe.IMAGE_FILE_MACHINE_ARMNT:
+		return "arm", nil
+	case pe.IMAGE_FILE_MACHINE_RISCV64:
+		return "riscv64", nil
+	default:
+		return "", errors.New("unsupported PE machine type")
+	}
+}
+
+// ParseOSRelease parses the contents of an os-release file into a map of keys to values.
+// Quoted values are unquoted, comments and malformed lines are skipped.
+func ParseOSRelease(data []byte) map[string]string {
+	values := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `"'`)
+		}
+
+		values[key] = value
+	}
+
+	return values
+}
+
+// ParseSize parses a size in bytes, with an optional K, M or G binary suffix, i.e. 512M.
+// An empty string is zero.
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+
+	switch suffix := strings.ToUpper(s[len(s)-1:]); suffix {
+	case "K", "M", "G":
+		multiplier = int64(1) << (10 * (strings.Index("KMG", suffix) + 1))
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid size %q", s))
+	}
+
+	return n * multiplier, nil
+}
+
+// ParseMode parses an octal file mode of permission bits only, i.e. 0640. An empty string is zero.
+func ParseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || os.FileMode(n)&^os.ModePerm != 0 {
+		return 0, types.WithCategory(types.ErrInvalidInput, fmt.Errorf("invalid file mode %q", s))
+	}
+
+	return os.FileMode(n), nil
+}
+
+// FileID identifies a version of a file on top of its path, see FileIdentity.
+type FileID struct {
+	Device     uint64
+	Inode      uint64
+	ChangeTime int64
+}
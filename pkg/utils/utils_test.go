@@ -1,10 +1,15 @@
 package utils
 
 import (
+	"bytes"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/types"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -74,4 +79,181 @@ var _ = Describe("Utils tests", func() {
 			Expect(SectionsData(ukiSections)).To(Equal(expectedSections))
 		})
 	})
+	Describe("ParseOSRelease", func() {
+		It("Parses quoted and unquoted values", func() {
+			values := ParseOSRelease([]byte(`# comment
+NAME="Kairos"
+ID=kairos
+VERSION_ID='v3.0.0'
+PRETTY_NAME="Kairos (v3.0.0)"
+garbage
+`))
+			Expect(values).To(Equal(map[string]string{
+				"NAME":        "Kairos",
+				"ID":          "kairos",
+				"VERSION_ID":  "v3.0.0",
+				"PRETTY_NAME": "Kairos (v3.0.0)",
+			}))
+		})
+	})
+	Describe("MapFile", func() {
+		It("Maps the file contents, and empty files", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "data"), []byte("contents"), 0o644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "empty"), nil, 0o644)).To(Succeed())
+
+			mapped, err := MapFile(filepath.Join(dir, "data"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mapped.Bytes()).To(BeEquivalentTo("contents"))
+			Expect(mapped.Close()).To(Succeed())
+			Expect(mapped.Close()).To(Succeed())
+
+			empty, err := MapFile(filepath.Join(dir, "empty"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(empty.Bytes()).To(BeEmpty())
+		})
+		It("Fails reading files truncated while mapped", func() {
+			if runtime.GOOS != "linux" {
+				Skip("files are only mapped on Linux")
+			}
+
+			path := filepath.Join(GinkgoT().TempDir(), "initrd")
+			Expect(os.WriteFile(path, make([]byte, 1<<20), 0o644)).To(Succeed())
+
+			mapped, err := MapFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer mapped.Close()
+
+			var sum int
+			Expect(mapped.Read(func(data []byte) { sum += int(data[len(data)-1]) })).To(Succeed())
+
+			Expect(os.Truncate(path, 0)).To(Succeed())
+			Expect(mapped.Read(func(data []byte) { sum += int(data[len(data)-1]) })).To(MatchError(ErrFileChanged))
+			Expect(sum).To(BeZero())
+		})
+	})
+	Describe("ParseSize", func() {
+		It("Parses sizes with binary suffixes", func() {
+			for in, want := range map[string]int64{"": 0, "512": 512, "4k": 4 << 10, "512M": 512 << 20, "8G": 8 << 30} {
+				got, err := ParseSize(in)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(got).To(Equal(want), in)
+			}
+
+			_, err := ParseSize("-1M")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("ParseMode", func() {
+		It("Parses octal permission bits", func() {
+			Expect(ParseMode("")).To(BeZero())
+			Expect(ParseMode("0640")).To(Equal(os.FileMode(0o640)))
+			Expect(ParseMode("755")).To(Equal(os.FileMode(0o755)))
+
+			for _, mode := range []string{"rw-r--r--", "0986", "4755"} {
+				_, err := ParseMode(mode)
+				Expect(err).To(HaveOccurred(), mode)
+			}
+		})
+	})
+	Describe("Streaming", func() {
+		It("Copies with the configured buffer and drops the files from the cache", func() {
+			defer func(size int, drop bool) { BufferSize, DropCache = size, drop }(BufferSize, DropCache)
+			BufferSize, DropCache = 1, true
+			Expect(NewBuffer()).To(HaveLen(minBufferSize))
+
+			dir := GinkgoT().TempDir()
+			data := bytes.Repeat([]byte("ukify"), 10000)
+			Expect(os.WriteFile(filepath.Join(dir, "in"), data, 0o644)).To(Succeed())
+
+			in, err := OpenSequential(filepath.Join(dir, "in"))
+			Expect(err).ToNot(HaveOccurred())
+			defer in.Close()
+
+			out, err := os.Create(filepath.Join(dir, "out"))
+			Expect(err).ToNot(HaveOccurred())
+			defer out.Close()
+
+			n, err := Copy(out, in)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(BeEquivalentTo(len(data)))
+			Expect(DoneWith(in, false)).To(Succeed())
+			Expect(DoneWith(out, true)).To(Succeed())
+
+			mapped, err := MapFile(filepath.Join(dir, "out"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mapped.Bytes()).To(Equal(data))
+			Expect(mapped.Close()).To(Succeed())
+		})
+		It("Caps the buffers and streams files under a memory limit", func() {
+			defer func(size int) { BufferSize = size }(BufferSize)
+			BufferSize = 4 << 20
+
+			Expect(MemoryLimited()).To(BeFalse())
+			Expect(StreamBufferSize()).To(Equal(4 << 20))
+
+			release := LimitMemory(256 << 20)
+			Expect(MemoryLimited()).To(BeTrue())
+			Expect(StreamBufferSize()).To(Equal(256 << 20 / bufferShare))
+			Expect(debug.SetMemoryLimit(-1)).To(BeEquivalentTo(256 << 20))
+
+			// the lowest of the limits applies
+			releaseLower := LimitMemory(64 << 20)
+			Expect(StreamBufferSize()).To(Equal(64 << 20 / bufferShare))
+			releaseLower()
+			releaseLower()
+			Expect(StreamBufferSize()).To(Equal(256 << 20 / bufferShare))
+
+			release()
+			Expect(MemoryLimited()).To(BeFalse())
+			Expect(StreamBufferSize()).To(Equal(4 << 20))
+			Expect(debug.SetMemoryLimit(-1)).To(BeEquivalentTo(math.MaxInt64))
+
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "in"), []byte("ukify"), 0o600)).To(Succeed())
+			Expect(CopyFile(filepath.Join(dir, "in"), filepath.Join(dir, "out"), 0o600)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(dir, "out"))).To(Equal([]byte("ukify")))
+		})
+		It("Publishes files by renaming them", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "new"), []byte("new"), 0o600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "out"), []byte("old"), 0o600)).To(Succeed())
+
+			Expect(Publish(filepath.Join(dir, "new"), filepath.Join(dir, "out"), 0o644)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(dir, "out"))).To(Equal([]byte("new")))
+			Expect(filepath.Join(dir, "new")).ToNot(BeAnExistingFile())
+
+			st, err := os.Stat(filepath.Join(dir, "out"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st.Mode().Perm()).To(Equal(os.FileMode(0o644)))
+		})
+		It("Writes files through a temporary file renamed over them", func() {
+			dir := GinkgoT().TempDir()
+			out := filepath.Join(dir, "out")
+			Expect(os.WriteFile(out, []byte("old"), 0o600)).To(Succeed())
+
+			Expect(WriteFile(out, []byte("new"), 0o644)).To(Succeed())
+			Expect(os.ReadFile(out)).To(Equal([]byte("new")))
+
+			st, err := os.Stat(out)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st.Mode().Perm()).To(Equal(os.FileMode(0o644)))
+
+			Expect(CopyFileAtomic(out, filepath.Join(dir, "copy"), 0o600)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(dir, "copy"))).To(Equal([]byte("new")))
+
+			// a failed write leaves the previous file in place
+			err = WriteFileAtomic(out, 0o644, func(w io.Writer) error {
+				_, _ = w.Write([]byte("partial"))
+
+				return io.ErrShortWrite
+			})
+			Expect(err).To(MatchError(io.ErrShortWrite))
+			Expect(os.ReadFile(out)).To(Equal([]byte("new")))
+
+			entries, err := os.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(2))
+		})
+	})
 })